@@ -29,12 +29,14 @@ package b2
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
 	"regexp"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
@@ -47,12 +49,52 @@ type Client struct {
 	sWriters map[string]*Writer
 	sReaders map[string]*Reader
 	sMethods []methodCounter
+	latency  sync.Map // of method names to *latencyCounter
+	retries  sync.Map // of method names to *int64
 	opts     clientOptions
+
+	uploadPools sync.Map // of bucket IDs to *urlPool
+	partPools   sync.Map // of large file IDs to *urlPool
+
+	ccOnce sync.Once
+	cc     *consistencyCache
+
+	bufs bufferPool // Writer chunk buffers
+
+	limOnce   sync.Once
+	transfers *semaphore   // for MaxTransferConcurrency
+	buffered  *semaphore   // for MaxBufferedBytes
+	upload    *tokenBucket // for UploadRateLimit
+	download  *tokenBucket // for DownloadRateLimit
+
+	readRate, writeRate rateMeter // of all Readers and Writers
 }
 
 // NewClient creates and returns a new Client with valid B2 service account
-// tokens.
+// tokens.  The client authorizes with the application key ID account and the
+// application key key, unless it is given WithCredentials.
 func NewClient(ctx context.Context, account, key string, opts ...ClientOption) (*Client, error) {
+	c := newClient(opts)
+	if err := c.backend.authorizeAccount(ctx, account, key, c.opts); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// NewClientFromSession returns a Client that resumes a session saved by
+// another's Session, without authorizing the account.  When the session's
+// authorization expires, the client authorizes the account with the
+// application key given WithCredentials; without it, calls that need a new
+// authorization fail with ErrNoCredentials.
+func NewClientFromSession(ctx context.Context, session []byte, opts ...ClientOption) (*Client, error) {
+	c := newClient(opts)
+	if err := c.backend.resumeSession(ctx, session, c.opts); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func newClient(opts []ClientOption) *Client {
 	c := &Client{
 		backend: &beRoot{
 			b2i: &b2Root{},
@@ -68,21 +110,122 @@ func NewClient(ctx context.Context, account, key string, opts ...ClientOption) (
 	for _, f := range opts {
 		f(&c.opts)
 	}
-	if err := c.backend.authorizeAccount(ctx, account, key, c.opts); err != nil {
+	if c.opts.transport == nil {
+		c.opts.transport = c.opts.transportOpts.newTransport()
+	}
+	c.opts.budget.useClock(c.opts.getClock())
+	return c
+}
+
+// AccountInfo describes the account and application key with which a client
+// was authorized.
+type AccountInfo struct {
+	AccountID string
+
+	// Capabilities lists the capabilities granted to the application key.
+	Capabilities []string
+
+	// BucketID and BucketName are set if the key is restricted to a single
+	// bucket.  Prefix is set if the key is further restricted to objects whose
+	// names begin with it.
+	BucketID   string
+	BucketName string
+	Prefix     string
+
+	// RecommendedPartSize is the part size B2 recommends for large files.
+	// AbsoluteMinimumPartSize is the smallest part size B2 accepts for any but
+	// the last part.
+	RecommendedPartSize     int
+	AbsoluteMinimumPartSize int
+
+	// KeyExpiration is when the application key expires, or the zero time if
+	// it does not.
+	KeyExpiration time.Time
+}
+
+// HasCapability reports whether the application key has been granted the
+// named capability, e.g. CapWriteFiles.
+func (a *AccountInfo) HasCapability(capability string) bool {
+	for _, c := range a.Capabilities {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
+
+// AccountInfo returns information about the account and application key with
+// which the client was authorized.  It reflects the most recent
+// authorization; no request is made to B2.
+func (c *Client) AccountInfo(ctx context.Context) (*AccountInfo, error) {
+	if err := ctx.Err(); err != nil {
 		return nil, err
 	}
-	return c, nil
+	return c.backend.accountInfo(), nil
+}
+
+// PartSizes returns the smallest part size B2 accepts for any but the last
+// part of a large file, and the part size it recommends, which is the default
+// ChunkSize of the client's Writers.  They come from the most recent
+// authorization, and are zero if B2 did not give them.
+func (c *Client) PartSizes() (min, recommended int) {
+	ai := c.backend.accountInfo()
+	return ai.AbsoluteMinimumPartSize, ai.RecommendedPartSize
+}
+
+// Session returns the client's current session, which NewClientFromSession
+// can resume in another process until its authorization expires, saving it
+// the call to authorize the account.  It holds the authorization token, and
+// should be kept as secret as the application key.
+func (c *Client) Session() ([]byte, error) {
+	return c.backend.session()
+}
+
+// TokenExpiresAt returns when the client's current authorization expires: a
+// day after it was made, or when the application key expires, if that is
+// sooner.  Calls made in the last minute of an authorization renew it first,
+// unless it expires with the key.  It returns the zero time if the client has
+// not been authorized.
+func (c *Client) TokenExpiresAt() time.Time {
+	return c.backend.authExpiry()
 }
 
 type clientOptions struct {
-	client          *Client
-	transport       http.RoundTripper
-	failSomeUploads bool
-	expireTokens    bool
-	capExceeded     bool
-	apiBase         string
-	userAgents      []string
-	writerOpts      []WriterOption
+	client           *Client
+	transport        http.RoundTripper
+	failSomeUploads  bool
+	expireTokens     bool
+	capExceeded      bool
+	apiBase          string
+	userAgents       []string
+	writerOpts       []WriterOption
+	consistencyTTL   time.Duration
+	skipValidation   bool
+	maxTransfers     int
+	maxBuffered      int64
+	uploadRate       int64
+	downloadRate     int64
+	maxRPS           float64
+	rpsBurst         int
+	retry            RetryPolicy
+	retryFor         map[OpClass]RetryPolicy
+	onRetry          func(string, int, error, time.Duration)
+	budget           *retryBudget
+	credentials      CredentialsProvider
+	breakThreshold   int
+	breakCooldown    time.Duration
+	breakProbes      int
+	headAttrs        bool
+	logger           Logger
+	onRequest        []func(RequestInfo)
+	onResponse       []func(ResponseInfo)
+	tracer           Tracer
+	metrics          MetricsCollector
+	urlPoolSize      int
+	urlPoolIdle      time.Duration
+	transportOpts    transportOptions
+	batchConcurrency int
+	clock            Clock
 }
 
 // A ClientOption allows callers to adjust various per-client settings.
@@ -106,8 +249,10 @@ func APIBase(url string) ClientOption {
 	}
 }
 
-// Transport sets the underlying HTTP transport mechanism.  If unset,
-// http.DefaultTransport is used.
+// Transport sets the underlying HTTP transport mechanism.  If unset, the
+// client makes an *http.Transport of its own, tuned by MaxIdleConnsPerHost,
+// DialTimeout, TLSHandshakeTimeout, ResponseHeaderTimeout, and Proxy, which
+// have no effect on a transport given here.
 func Transport(rt http.RoundTripper) ClientOption {
 	return func(c *clientOptions) {
 		c.transport = rt
@@ -138,6 +283,29 @@ func ForceCapExceeded() ClientOption {
 	}
 }
 
+// SkipValidation disables the checks that are otherwise made on object names
+// and file info before anything is uploaded, such as the limits of 1024 bytes
+// for names and ten keys for info.  B2 still enforces its own limits; this is
+// an escape hatch for when they are relaxed before this package's.
+func SkipValidation() ClientOption {
+	return func(c *clientOptions) {
+		c.skipValidation = true
+	}
+}
+
+// HeadAttrs makes Object.Attrs, for objects known only by name, read the
+// metadata that downloads carry in their headers from a single HEAD request,
+// which B2 bills as a Class B transaction, instead of following the request
+// that finds the object's ID with a call to b2_get_file_info, which is Class
+// C.  The attributes are those of the object's current version, as B2 serves
+// them, and so CacheControl may be the bucket's default rather than the
+// object's own.  Objects from listings and Writers are unaffected.
+func HeadAttrs() ClientOption {
+	return func(c *clientOptions) {
+		c.headAttrs = true
+	}
+}
+
 func client(cl *Client) ClientOption {
 	return func(c *clientOptions) {
 		c.client = cl
@@ -155,13 +323,34 @@ func (ct *clientTransport) RoundTrip(r *http.Request) (*http.Response, error) {
 	if t == nil {
 		t = http.DefaultTransport
 	}
+	var attempt int
+	if ct.client != nil {
+		attempt = nextAttempt(r.Context())
+		r = ct.hook(r, attempt)
+		ct.client.inc("b2_requests_in_flight", 1, "method", m)
+	}
 	b := time.Now()
 	resp, err := t.RoundTrip(r)
 	e := time.Now()
+	if ct.client != nil {
+		ct.client.inc("b2_requests_in_flight", -1, "method", m)
+		ct.record(m, r, resp, err, e.Sub(b))
+		ct.hookResponse(r, attempt, resp, err, e.Sub(b))
+	}
+	if s := spanFrom(r.Context()); s != nil && err == nil {
+		s.SetAttribute("status", resp.StatusCode)
+		switch m {
+		case "b2_upload_file", "b2_upload_part":
+			s.SetAttribute("bytes", r.ContentLength)
+		case "b2_download_file_by_name":
+			s.SetAttribute("bytes", resp.ContentLength)
+		}
+	}
 	if err != nil {
 		return resp, err
 	}
 	if m != "" && ct.client != nil {
+		ct.client.recordLatency(m, e.Sub(b))
 		ct.client.slock.Lock()
 		m := method{
 			name:     m,
@@ -176,6 +365,31 @@ func (ct *clientTransport) RoundTrip(r *http.Request) (*http.Response, error) {
 	return resp, nil
 }
 
+// record reports the metrics of a request for method.
+func (ct *clientTransport) record(method string, r *http.Request, resp *http.Response, err error, d time.Duration) {
+	mc := ct.client.opts.metrics
+	if mc == nil {
+		return
+	}
+	status := "error"
+	if err == nil {
+		status = statusClass(resp.StatusCode)
+	}
+	mc.Inc("b2_requests_total", 1, "method", method, "status", status)
+	mc.Observe("b2_request_duration_seconds", d.Seconds(), "method", method)
+	if err != nil {
+		return
+	}
+	switch method {
+	case "b2_upload_file", "b2_upload_part":
+		mc.Inc("b2_uploaded_bytes_total", r.ContentLength)
+	case "b2_download_file_by_name":
+		if resp.ContentLength > 0 {
+			mc.Inc("b2_downloaded_bytes_total", resp.ContentLength)
+		}
+	}
+}
+
 // Bucket is a reference to a B2 bucket.
 type Bucket struct {
 	b beBucketInterface
@@ -209,6 +423,112 @@ type BucketAttrs struct {
 	// the rules are not modified.  A bucket's rules can be removed by updating
 	// with an empty slice.
 	LifecycleRules []LifecycleRule
+
+	// FileLockEnabled reports or sets whether object lock is enabled for the
+	// bucket.  Object lock can be enabled on an existing bucket during a
+	// bucket.Update, but once enabled it cannot be disabled.
+	FileLockEnabled bool
+
+	// DefaultRetention reports or sets the retention applied to new objects in
+	// a bucket with object lock enabled.  If nil during a bucket.Update, the
+	// retention is not modified.  A bucket's default retention can be removed
+	// by updating with an empty DefaultRetention.
+	//
+	// DefaultRetention is also nil if the client's key is not authorized to
+	// read the bucket's retention settings.
+	DefaultRetention *DefaultRetention
+
+	// Replication reports or sets the bucket's Cloud Replication
+	// configuration.  If nil during a bucket.Update, the configuration is not
+	// modified.  A bucket's replication can be removed by updating with an
+	// empty Replication.
+	//
+	// Replication is nil if the bucket has no replication configured, or if
+	// the client's key is not authorized to read it.
+	Replication *Replication
+
+	// Revision reports the bucket's revision, which B2 increments on every
+	// change.  It is ignored on creation.  If non-zero during a bucket.Update,
+	// the update is made only if the bucket is still at this revision;
+	// otherwise, the revision last seen by the Bucket is used.  Either way, an
+	// update made against a stale revision fails with an error for which
+	// IsUpdateConflict is true.
+	Revision int
+}
+
+// Replication describes a bucket's Cloud Replication configuration.  A bucket
+// can be a replication source, a replication destination, or both.
+type Replication struct {
+	// SourceKeyID is the ID of the application key used to replicate objects
+	// from this bucket.  Rules lists where, and which, objects are replicated.
+	// Together they configure the bucket as a replication source.
+	SourceKeyID string
+	Rules       []ReplicationRule
+
+	// DestinationKeyMapping maps the IDs of source application keys to the
+	// IDs of keys in this account that may write replicated objects into this
+	// bucket, and configures the bucket as a replication destination.
+	DestinationKeyMapping map[string]string
+}
+
+// ReplicationRule describes how objects are replicated to a single
+// destination bucket.
+type ReplicationRule struct {
+	// Name must be unique among the bucket's rules.
+	Name string
+
+	// DestinationBucketID is the ID, not name, of the destination bucket.
+	DestinationBucketID string
+
+	// Prefix limits the rule to objects whose names begin with it.  An empty
+	// Prefix matches all objects.
+	Prefix string
+
+	// Priority breaks ties when more than one rule matches an object; higher
+	// values win.
+	Priority int
+
+	// IncludeExistingFiles causes objects that existed before the rule was
+	// created to be replicated as well.
+	IncludeExistingFiles bool
+
+	// Enabled reports or sets whether the rule is active.
+	Enabled bool
+}
+
+// RetentionMode is an object lock mode.
+type RetentionMode string
+
+const (
+	// Governance mode allows users with the bypassGovernance capability to
+	// delete or shorten the retention of locked objects.
+	Governance RetentionMode = "governance"
+
+	// Compliance mode prevents any user from deleting or shortening the
+	// retention of locked objects.
+	Compliance RetentionMode = "compliance"
+)
+
+// RetentionUnit is the unit of a RetentionPeriod.
+type RetentionUnit string
+
+const (
+	Days  RetentionUnit = "days"
+	Years RetentionUnit = "years"
+)
+
+// RetentionPeriod is a length of time during which an object is locked.
+type RetentionPeriod struct {
+	Duration int
+	Unit     RetentionUnit
+}
+
+// DefaultRetention describes the object lock settings given to new objects in
+// a bucket.  A DefaultRetention with an empty Mode means that new objects are
+// not locked.
+type DefaultRetention struct {
+	Mode   RetentionMode
+	Period RetentionPeriod
 }
 
 // A LifecycleRule describes an object's life cycle, namely how many days after
@@ -228,6 +548,11 @@ type LifecycleRule struct {
 	// DaysHiddenUntilDeleted specifies the number of days after which a hidden
 	// file is deleted.  0 means "do not automatically delete hidden files".
 	DaysHiddenUntilDeleted int
+
+	// DaysStartedUntilCanceled specifies the number of days after which an
+	// unfinished large file is canceled, discarding any parts already
+	// uploaded.  0 means "do not automatically cancel unfinished large files".
+	DaysStartedUntilCanceled int
 }
 
 type b2err struct {
@@ -240,60 +565,317 @@ func (e b2err) Error() string {
 	return e.err.Error()
 }
 
-// IsNotExist reports whether a given error indicates that an object or bucket
-// does not exist.
+func (e b2err) Unwrap() error { return e.err }
+
+// An Error is an error that B2 returned for an API call.  The errors of
+// calls to B2 wrap one when B2 refused them, which errors.As finds:
+//
+//	var e *b2.Error
+//	if errors.As(err, &e) && e.Code == "duplicate_bucket_name" {
+//		...
+//	}
+type Error struct {
+	Status  int    // The HTTP status, such as 400.
+	Code    string // B2's code for the error, such as "bad_request".
+	Message string
+	Method  string // The API call, such as "b2_create_bucket".
+	Retried int    // The number of times the call was retried before it failed.
+
+	// RequestID is the X-Blazer-Request-ID of the last attempt, and Host is
+	// the host that served it.  Backblaze support may ask for them.
+	RequestID string
+	Host      string
+
+	err error
+}
+
+func (e *Error) Error() string {
+	if e.Retried > 0 {
+		return fmt.Sprintf("%v, after %d attempts", e.err, e.Retried+1)
+	}
+	return e.err.Error()
+}
+
+func (e *Error) Unwrap() error { return e.err }
+
+// IsNotExist reports whether a given error indicates that an object, bucket,
+// or key does not exist.
 func IsNotExist(err error) bool {
-	berr, ok := err.(b2err)
-	if !ok {
+	var berr b2err
+	return errors.As(err, &berr) && berr.notFoundErr
+}
+
+// IsStorageCapExceeded reports whether err shows that the account has reached
+// its storage cap.  Writes will keep failing until the cap is raised, so
+// callers should stop and alert rather than retry.
+func IsStorageCapExceeded(err error) bool {
+	return storageCapExceeded(err)
+}
+
+// IsBucketExists reports whether err shows that a bucket could not be created
+// because its name is taken, by this account or another.
+func IsBucketExists(err error) bool {
+	return hasCode(err, "duplicate_bucket_name")
+}
+
+// IsAccessDenied reports whether err shows that the application key may not
+// do what was asked, such as when it lacks a capability or is restricted to
+// another bucket or prefix.
+func IsAccessDenied(err error) bool {
+	var re *RestrictionError
+	return errors.As(err, &re) || hasCode(err, "unauthorized", "access_denied")
+}
+
+// A RestrictionError is returned, in place of the refusal B2 would give, when
+// the client's application key is restricted to a bucket or to a prefix of
+// object names, and what was asked for lies outside it.
+type RestrictionError struct {
+	Bucket string // The bucket asked for.
+	Name   string // The object name or listing prefix asked for, if any.
+
+	AllowedBucket string // The bucket to which the key is restricted.
+	AllowedPrefix string // The prefix to which the key is restricted, if any.
+}
+
+func (e *RestrictionError) Error() string {
+	if e.Bucket != e.AllowedBucket {
+		return fmt.Sprintf("b2: %s: key restricted to bucket '%s'", e.Bucket, e.AllowedBucket)
+	}
+	return fmt.Sprintf("b2: %s: key restricted to prefix '%s'", e.Name, e.AllowedPrefix)
+}
+
+// IsCapExceeded reports whether err shows that the account has reached any of
+// its caps: storage, transactions, or downloads.
+func IsCapExceeded(err error) bool {
+	return hasCode(err, "cap_exceeded", "storage_cap_exceeded", "transaction_cap_exceeded", "download_cap_exceeded")
+}
+
+// IsBadRequest reports whether err shows that B2 found the request itself at
+// fault, such as for an invalid argument.
+func IsBadRequest(err error) bool {
+	return hasCode(err, "bad_request")
+}
+
+// hasCode reports whether err wraps an *Error with one of the given codes.
+func hasCode(err error, codes ...string) bool {
+	var e *Error
+	if !errors.As(err, &e) {
 		return false
 	}
-	return berr.notFoundErr
+	for _, c := range codes {
+		if e.Code == c {
+			return true
+		}
+	}
+	return false
 }
 
-const uploadURLPoolSize = 100
+// How many upload URLs are kept for each bucket and large file, and for how
+// long an unused one is kept, unless UploadURLPool says otherwise.
+const (
+	uploadURLPoolSize = 100
+	uploadURLPoolIdle = time.Hour
+)
+
+// UploadURLPool sets how many upload URLs the client keeps, for each bucket
+// and for each large file, to use again after an upload with one succeeds, and
+// how long it keeps one that is not used.  B2 allows an upload URL to be used
+// until an upload with it fails, and so reusing one saves a call to
+// b2_get_upload_url, or to b2_get_upload_part_url, for every upload.  URLs
+// whose uploads fail in a way that asks for a new URL are discarded.  Zero
+// keeps the default for either, which is 100 URLs and an hour; a size less
+// than zero keeps none.
+func UploadURLPool(size int, idle time.Duration) ClientOption {
+	return func(c *clientOptions) {
+		c.urlPoolSize = size
+		c.urlPoolIdle = idle
+	}
+}
 
+// A urlPool keeps the upload URLs, or part upload URLs, that are free to be
+// used again, and is safe for concurrent use.
 type urlPool struct {
-	ch chan beURLInterface
+	size  int
+	idle  time.Duration
+	clock Clock
+
+	mu   sync.Mutex
+	urls []pooledURL // the most recently used last
+	last time.Time   // when a URL was last taken or given back
 }
 
-func newURLPool() *urlPool {
-	return &urlPool{ch: make(chan beURLInterface, uploadURLPoolSize)}
+type pooledURL struct {
+	u    interface{}
+	used time.Time
+}
+
+func newURLPool(o clientOptions) *urlPool {
+	p := &urlPool{size: o.urlPoolSize, idle: o.urlPoolIdle, clock: o.getClock()}
+	if p.size == 0 {
+		p.size = uploadURLPoolSize
+	}
+	if p.idle <= 0 {
+		p.idle = uploadURLPoolIdle
+	}
+	p.last = p.clock.Now()
+	return p
 }
 
-func (p *urlPool) get() beURLInterface {
-	select {
-	case ue := <-p.ch:
-		// if the channel has an upload URL available, use that
-		return ue
-	default:
-		// otherwise return nil, a new upload URL needs to be generated
+// get returns the URL that was used most recently, or nil if there are none
+// that have been used within the idle time.
+func (p *urlPool) get() interface{} {
+	if p == nil {
 		return nil
 	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.last = p.clock.Now()
+	if n := len(p.urls); n > 0 {
+		u := p.urls[n-1]
+		p.urls[n-1] = pooledURL{}
+		p.urls = p.urls[:n-1]
+		if p.clock.Now().Sub(u.used) < p.idle {
+			return u.u
+		}
+		// The rest are older still.
+		for i := range p.urls {
+			p.urls[i] = pooledURL{}
+		}
+		p.urls = p.urls[:0]
+	}
+	return nil
+}
+
+// put returns u to the pool, if it isn't full.
+func (p *urlPool) put(u interface{}) {
+	if p == nil || u == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.last = p.clock.Now()
+	if len(p.urls) >= p.size {
+		return
+	}
+	p.urls = append(p.urls, pooledURL{u: u, used: p.clock.Now()})
+}
+
+// stale reports whether the pool has gone unused for longer than a URL is
+// kept, so that it holds none worth keeping.
+func (p *urlPool) stale() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.clock.Now().Sub(p.last) >= p.idle
+}
+
+// uploadURLs returns the pool of upload URLs for the bucket with the given ID,
+// which is shared by all of the client's Buckets for it.
+func (c *Client) uploadURLs(bucketID string) *urlPool {
+	v, ok := c.uploadPools.Load(bucketID)
+	if !ok {
+		v, _ = c.uploadPools.LoadOrStore(bucketID, newURLPool(c.opts))
+	}
+	return v.(*urlPool)
 }
 
-func (p *urlPool) put(u beURLInterface) {
-	select {
-	case p.ch <- u:
-		// put the URL back if possible
-	default:
-		// if the channel is full, throw it away
+// partURLs returns the pool of part upload URLs for the large file with the
+// given ID, which is shared by all of the client's Writers for it, or nil if
+// the ID is not known.
+func (c *Client) partURLs(fileID string) *urlPool {
+	if fileID == "" {
+		return nil
 	}
+	v, ok := c.partPools.Load(fileID)
+	if !ok {
+		c.sweepPartURLs()
+		v, _ = c.partPools.LoadOrStore(fileID, newURLPool(c.opts))
+	}
+	return v.(*urlPool)
+}
+
+// dropPartURLs forgets the part upload URLs of a large file that has been
+// finished or cancelled.
+func (c *Client) dropPartURLs(fileID string) {
+	c.partPools.Delete(fileID)
+}
+
+// sweepPartURLs forgets the pools of large files that have gone unused for
+// longer than their URLs are kept.  These are left by Writers that keep their
+// large files unfinished, fail to cancel them, or are never closed, and would
+// otherwise be kept for the life of the client.
+func (c *Client) sweepPartURLs() {
+	c.partPools.Range(func(k, v interface{}) bool {
+		if v.(*urlPool).stale() {
+			c.partPools.Delete(k)
+		}
+		return true
+	})
 }
 
 // Bucket returns a bucket if it exists.
+//
+// If the client's application key is restricted to a single bucket, the
+// bucket is identified from the key's authorization rather than from B2's
+// bucket list, and no request is made; if the name is that of another bucket,
+// the error is a *RestrictionError.  Such a bucket can be used normally, but
+// if the key lacks the listBuckets capability, its Attrs are empty.
 func (c *Client) Bucket(ctx context.Context, name string) (*Bucket, error) {
+	bucket, err := c.lookupBucket(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return &Bucket{
+		b:       bucket,
+		r:       c.backend,
+		c:       c,
+		urlPool: c.uploadURLs(bucket.id()),
+	}, nil
+}
+
+// BucketExists reports whether the named bucket exists and is visible to the
+// client's application key.
+func (c *Client) BucketExists(ctx context.Context, name string) (bool, error) {
+	_, err := c.lookupBucket(ctx, name)
+	if IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// lookupBucket finds the named bucket.  Keys restricted to a single bucket
+// may lack the listBuckets capability, and so for these the bucket is taken
+// from the authorization instead of from b2_list_buckets.  Asking such a key
+// for any other bucket is a *RestrictionError, for which IsNotExist also
+// reports true.
+func (c *Client) lookupBucket(ctx context.Context, name string) (beBucketInterface, error) {
+	if info := c.backend.accountInfo(); info.BucketID != "" {
+		if name != info.BucketName {
+			return nil, b2err{
+				err: &RestrictionError{
+					Bucket:        name,
+					AllowedBucket: info.BucketName,
+					AllowedPrefix: info.Prefix,
+				},
+				notFoundErr: true,
+			}
+		}
+		return c.backend.bucket(info.BucketID, name), nil
+	}
+	return c.listBucket(ctx, name)
+}
+
+// listBucket finds the named bucket with b2_list_buckets.
+func (c *Client) listBucket(ctx context.Context, name string) (beBucketInterface, error) {
 	buckets, err := c.backend.listBuckets(ctx, name)
 	if err != nil {
 		return nil, err
 	}
 	for _, bucket := range buckets {
 		if bucket.name() == name {
-			return &Bucket{
-				b:       bucket,
-				r:       c.backend,
-				c:       c,
-				urlPool: newURLPool(),
-			}, nil
+			return bucket, nil
 		}
 	}
 	return nil, b2err{
@@ -302,36 +884,63 @@ func (c *Client) Bucket(ctx context.Context, name string) (*Bucket, error) {
 	}
 }
 
+// restricted returns a *RestrictionError if the client's application key is
+// restricted to another bucket, or to a prefix that name lacks, and nil if it
+// may use the named object.
+func (b *Bucket) restricted(name string) error {
+	info := b.c.backend.accountInfo()
+	if info.BucketID == "" {
+		return nil
+	}
+	if info.BucketID != b.b.id() || !strings.HasPrefix(name, info.Prefix) {
+		return &RestrictionError{
+			Bucket:        b.Name(),
+			Name:          name,
+			AllowedBucket: info.BucketName,
+			AllowedPrefix: info.Prefix,
+		}
+	}
+	return nil
+}
+
 // NewBucket returns a bucket.  The bucket is created with the given attributes
 // if it does not already exist.  If attrs is nil, it is created as a private
 // bucket with no info metadata and no lifecycle rules.
 func (c *Client) NewBucket(ctx context.Context, name string, attrs *BucketAttrs) (*Bucket, error) {
-	buckets, err := c.backend.listBuckets(ctx, name)
-	if err != nil {
+	bucket, err := c.lookupBucket(ctx, name)
+	var re *RestrictionError
+	if errors.As(err, &re) {
 		return nil, err
 	}
-	for _, bucket := range buckets {
-		if bucket.name() == name {
-			return &Bucket{
-				b:       bucket,
-				r:       c.backend,
-				c:       c,
-				urlPool: newURLPool(),
-			}, nil
-		}
+	if err == nil {
+		return &Bucket{
+			b:       bucket,
+			r:       c.backend,
+			c:       c,
+			urlPool: c.uploadURLs(bucket.id()),
+		}, nil
+	}
+	if !IsNotExist(err) {
+		return nil, err
 	}
 	if attrs == nil {
 		attrs = &BucketAttrs{Type: Private}
 	}
-	b, err := c.backend.createBucket(ctx, name, string(attrs.Type), attrs.Info, attrs.LifecycleRules)
+	b, err := c.backend.createBucket(ctx, name, string(attrs.Type), attrs.Info, attrs.LifecycleRules, attrs.FileLockEnabled)
 	if err != nil {
 		return nil, err
 	}
+	if attrs.DefaultRetention != nil {
+		// B2 doesn't accept a default retention on bucket creation.
+		if err := b.updateBucket(ctx, &BucketAttrs{DefaultRetention: attrs.DefaultRetention}); err != nil {
+			return nil, err
+		}
+	}
 	return &Bucket{
 		b:       b,
 		r:       c.backend,
 		c:       c,
-		urlPool: newURLPool(),
+		urlPool: c.uploadURLs(b.id()),
 	}, err
 }
 
@@ -347,7 +956,7 @@ func (c *Client) ListBuckets(ctx context.Context) ([]*Bucket, error) {
 			b:       b,
 			r:       c.backend,
 			c:       c,
-			urlPool: newURLPool(),
+			urlPool: c.uploadURLs(b.id()),
 		})
 	}
 	return buckets, nil
@@ -356,11 +965,8 @@ func (c *Client) ListBuckets(ctx context.Context) ([]*Bucket, error) {
 // IsUpdateConflict reports whether a given error is the result of a bucket
 // update conflict.
 func IsUpdateConflict(err error) bool {
-	e, ok := err.(b2err)
-	if !ok {
-		return false
-	}
-	return e.isUpdateConflict
+	var e b2err
+	return errors.As(err, &e) && e.isUpdateConflict
 }
 
 // Update modifies the given bucket with new attributes.  It is possible that
@@ -370,13 +976,45 @@ func (b *Bucket) Update(ctx context.Context, attrs *BucketAttrs) error {
 	return b.b.updateBucket(ctx, attrs)
 }
 
+// UpdateFunc updates the bucket by applying f to its current attributes,
+// retrying when the update conflicts with a concurrent change.  Each attempt
+// fetches the latest attributes, passes them to f to be modified in place,
+// and then updates the bucket at the revision they were fetched at.  At most
+// tries attempts are made; if all of them conflict, the last conflict error is
+// returned.  If f returns an error, UpdateFunc returns it without updating
+// the bucket.
+func (b *Bucket) UpdateFunc(ctx context.Context, tries int, f func(*BucketAttrs) error) error {
+	if tries < 1 {
+		tries = 1
+	}
+	var err error
+	for i := 0; i < tries; i++ {
+		var attrs *BucketAttrs
+		attrs, err = b.Attrs(ctx)
+		if err != nil {
+			return err
+		}
+		if err := f(attrs); err != nil {
+			return err
+		}
+		err = b.Update(ctx, attrs)
+		if !IsUpdateConflict(err) {
+			return err
+		}
+	}
+	return err
+}
+
 // Attrs retrieves and returns the current bucket's attributes.
 func (b *Bucket) Attrs(ctx context.Context) (*BucketAttrs, error) {
-	bucket, err := b.c.Bucket(ctx, b.Name())
+	if info := b.c.backend.accountInfo(); info.BucketID != "" && !info.HasCapability(CapListBuckets) {
+		return b.b.attrs(), nil
+	}
+	bucket, err := b.c.listBucket(ctx, b.Name())
 	if err != nil {
 		return nil, err
 	}
-	b.b = bucket.b
+	b.b = bucket
 	return b.b.attrs(), nil
 }
 
@@ -426,15 +1064,45 @@ type Object struct {
 }
 
 // Attrs holds an object's metadata.
+//
+// B2 stores file info keys in lowercase, and so Info keys are lowercased on
+// upload and are always lowercase when read back: a key of "SrcHash" is
+// stored and reported as "srchash".  Other characters are left alone, so
+// "src_hash" and "src-hash" remain distinct keys.
 type Attrs struct {
+	ID              string            // The version ID.  Not used on upload.
 	Name            string            // Not used on upload.
 	Size            int64             // Not used on upload.
 	ContentType     string            // Used on upload, default is "application/octet-stream".
 	Status          ObjectState       // Not used on upload.
 	UploadTimestamp time.Time         // Not used on upload.
-	SHA1            string            // Can be "none" for large files.  If set on upload, will be used for large files.
+	SHA1            string            // "none" for large files uploaded without one.  If set on upload, B2 checks it against objects sent in one request, and records it for large files.
 	LastModified    time.Time         // If present, and there are fewer than 10 keys in the Info field, this is saved on upload.
 	Info            map[string]string // Save arbitrary metadata on upload, but limited to 10 keys.
+
+	// These are saved on upload as the file info keys that B2 returns as HTTP
+	// headers when the object is downloaded, e.g. CacheControl is saved as
+	// b2-cache-control and served as Cache-Control.  Each counts against the
+	// ten Info keys.  Setting both a field and its Info key to different
+	// values is an error.
+	CacheControl       string
+	ContentDisposition string
+	ContentEncoding    string
+	ContentLanguage    string
+	Expires            string
+}
+
+// headerInfo lists the file info keys that B2 serves as HTTP headers.
+var headerInfo = []struct {
+	key   string
+	name  string
+	field func(*Attrs) *string
+}{
+	{"b2-cache-control", "CacheControl", func(a *Attrs) *string { return &a.CacheControl }},
+	{"b2-content-disposition", "ContentDisposition", func(a *Attrs) *string { return &a.ContentDisposition }},
+	{"b2-content-encoding", "ContentEncoding", func(a *Attrs) *string { return &a.ContentEncoding }},
+	{"b2-content-language", "ContentLanguage", func(a *Attrs) *string { return &a.ContentLanguage }},
+	{"b2-expires", "Expires", func(a *Attrs) *string { return &a.Expires }},
 }
 
 // Name returns an object's name
@@ -449,14 +1117,65 @@ func (o *Object) ID() string {
 
 // Attrs returns an object's attributes.
 func (o *Object) Attrs(ctx context.Context) (*Attrs, error) {
+	if o.f == nil && o.b.c.opts.headAttrs && o.b.c.consistency().written(o.b, o.name) == nil {
+		return o.headAttrs(ctx)
+	}
 	if err := o.ensure(ctx); err != nil {
 		return nil, err
 	}
+	if o.b.c.consistency().gone(o) {
+		return nil, b2err{err: fmt.Errorf("%s: not found", o.name), notFoundErr: true}
+	}
+	if o.attrs != nil {
+		return o.attrs.clone(), nil
+	}
+	if o.IsDir() {
+		return &Attrs{Name: o.name, Status: Folder, Info: map[string]string{}}, nil
+	}
 	fi, err := o.f.getFileInfo(ctx)
 	if err != nil {
 		return nil, err
 	}
-	name, sha, size, ct, info, st, stamp := fi.stats()
+	attrs, err := attrsFromStats(fi.stats())
+	if err != nil {
+		return nil, err
+	}
+	attrs.ID = o.f.id()
+	return attrs, nil
+}
+
+// headAttrs returns the attributes served with the object's current version,
+// for HeadAttrs.
+func (o *Object) headAttrs(ctx context.Context) (*Attrs, error) {
+	if o.b.c.consistency().gone(o) {
+		return nil, b2err{err: fmt.Errorf("%s: not found", o.name), notFoundErr: true}
+	}
+	fr, err := o.b.b.downloadFileByName(ctx, o.name, 0, 0, true, downloadOverrides{})
+	if err != nil {
+		return nil, err
+	}
+	fr.Close()
+	return attrsFromReader(o.name, fr)
+}
+
+// attrsFromReader builds Attrs from the headers of a download of name.
+func attrsFromReader(name string, fr beFileReaderInterface) (*Attrs, error) {
+	_, ct, sha, info := fr.stats()
+	attrs, err := attrsFromStats(name, sha, fr.size(), ct, info, "upload", fr.timestamp())
+	if err != nil {
+		return nil, err
+	}
+	attrs.ID = fr.id()
+	return attrs, nil
+}
+
+// attrsFromStats builds Attrs from the raw file info returned by B2, lifting
+// the mtime and large file hash out of the info map.
+func attrsFromStats(name, sha string, size int64, ct string, rawInfo map[string]string, st string, stamp time.Time) (*Attrs, error) {
+	info := make(map[string]string, len(rawInfo))
+	for k, v := range rawInfo {
+		info[strings.ToLower(k)] = v
+	}
 	var state ObjectState
 	switch st {
 	case "upload":
@@ -480,7 +1199,7 @@ func (o *Object) Attrs(ctx context.Context) (*Attrs, error) {
 	if v, ok := info["large_file_sha1"]; ok {
 		sha = v
 	}
-	return &Attrs{
+	attrs := &Attrs{
 		Name:            name,
 		Size:            size,
 		ContentType:     ct,
@@ -489,7 +1208,38 @@ func (o *Object) Attrs(ctx context.Context) (*Attrs, error) {
 		Info:            info,
 		Status:          state,
 		LastModified:    mtime,
-	}, nil
+	}
+	for _, h := range headerInfo {
+		if v, ok := info[h.key]; ok {
+			*h.field(attrs) = v
+			delete(info, h.key)
+		}
+	}
+	return attrs, nil
+}
+
+func (a *Attrs) clone() *Attrs {
+	c := *a
+	c.Info = make(map[string]string, len(a.Info))
+	for k, v := range a.Info {
+		c.Info[k] = v
+	}
+	return &c
+}
+
+// IsHideMarker reports whether the object is a hide marker, i.e. the version
+// B2 records when an object is hidden, rather than a version with content.
+// Only objects returned by a listing carry their version and can be hide
+// markers; for any other object IsHideMarker returns false.
+func (o *Object) IsHideMarker() bool {
+	return o.f != nil && o.f.status() == "hide"
+}
+
+// IsDir reports whether the object is a folder: a common prefix returned by a
+// listing with ListDelimiter, standing in for all of the objects beneath it.
+// A folder is not itself an object and cannot be read, deleted, or hidden.
+func (o *Object) IsDir() bool {
+	return o.f != nil && o.f.status() == "folder"
 }
 
 // ObjectState represents the various states an object can be in.
@@ -521,9 +1271,10 @@ func (b *Bucket) Object(name string) *Object {
 	}
 }
 
-// URL returns the full URL to the given object.
+// URL returns the full URL to the given object.  The name is percent-encoded,
+// so names containing characters such as '?', '#', and '+' are not mangled.
 func (o *Object) URL() string {
-	return fmt.Sprintf("%s/file/%s/%s", o.b.BaseURL(), o.b.Name(), o.name)
+	return fmt.Sprintf("%s/file/%s/%s", o.b.BaseURL(), o.b.Name(), escapeName(o.name))
 }
 
 // NewWriter returns a new writer for the given object.  Objects that are
@@ -531,12 +1282,16 @@ func (o *Object) URL() string {
 //
 // Callers must close the writer when finished and check the error status.
 func (o *Object) NewWriter(ctx context.Context, opts ...WriterOption) *Writer {
+	ctx, span := o.b.c.startSpan(ctx, "b2.Writer", "bucket", o.b.Name(), "object", o.name)
+	o.b.c.inc("b2_operations_in_flight", 1, "op", "write")
 	ctx, cancel := context.WithCancel(ctx)
 	w := &Writer{
 		o:      o,
 		name:   o.name,
 		ctx:    ctx,
 		cancel: cancel,
+		rate:   rateMeter{parent: &o.b.c.writeRate},
+		span:   span,
 	}
 	for _, f := range o.b.c.opts.writerOpts {
 		f(w)
@@ -549,26 +1304,57 @@ func (o *Object) NewWriter(ctx context.Context, opts ...WriterOption) *Writer {
 
 // NewRangeReader returns a reader for the given object, reading up to length
 // bytes.  If length is negative, the rest of the object is read.
-func (o *Object) NewRangeReader(ctx context.Context, offset, length int64) *Reader {
-	ctx, cancel := context.WithCancel(ctx)
-	return &Reader{
-		ctx:    ctx,
-		cancel: cancel,
-		o:      o,
-		name:   o.name,
-		chunks: make(map[int]*rchunk),
-		length: length,
-		offset: offset,
+func (o *Object) NewRangeReader(ctx context.Context, offset, length int64, opts ...ReaderOption) *Reader {
+	ctx, span := o.b.c.startSpan(ctx, "b2.Reader", "bucket", o.b.Name(), "object", o.name)
+	o.b.c.inc("b2_operations_in_flight", 1, "op", "read")
+	lctx, lcancel := context.WithCancel(ctx)
+	ctx, cancel := context.WithCancel(lctx)
+	r := &Reader{
+		lctx:    lctx,
+		lcancel: lcancel,
+		ctx:     ctx,
+		cancel:  cancel,
+		o:       o,
+		name:    o.name,
+		chunks:  make(map[int]*rchunk),
+		base:    offset,
+		rlen:    length,
+		length:  length,
+		offset:  offset,
+		rate:    rateMeter{parent: &o.b.c.readRate},
+		span:    span,
+	}
+	for _, f := range opts {
+		f(r)
 	}
+	if err := o.b.restricted(o.name); err != nil {
+		r.err = err
+	}
+	return r
 }
 
 // NewReader returns a reader for the given object.
-func (o *Object) NewReader(ctx context.Context) *Reader {
-	return o.NewRangeReader(ctx, 0, -1)
+func (o *Object) NewReader(ctx context.Context, opts ...ReaderOption) *Reader {
+	return o.NewRangeReader(ctx, 0, -1, opts...)
+}
+
+// NewReaderIfChanged returns a reader for the given object, as NewReader
+// does with IfNoneMatch(lastSHA1): its first Read returns a
+// *NotModifiedError, without downloading anything, if the object's SHA1 hash
+// is still lastSHA1.
+func (o *Object) NewReaderIfChanged(ctx context.Context, lastSHA1 string, opts ...ReaderOption) *Reader {
+	return o.NewReader(ctx, append(opts, IfNoneMatch(lastSHA1))...)
 }
 
 func (o *Object) ensure(ctx context.Context) error {
 	if o.f == nil {
+		if err := o.b.restricted(o.name); err != nil {
+			return err
+		}
+		if w := o.b.c.consistency().written(o.b, o.name); w != nil {
+			o.f = w.f
+			return nil
+		}
 		f, err := o.b.getObject(ctx, o.name)
 		if err != nil {
 			return err
@@ -580,19 +1366,32 @@ func (o *Object) ensure(ctx context.Context) error {
 
 // Delete removes the given object.
 func (o *Object) Delete(ctx context.Context) error {
+	if o.IsDir() {
+		return fmt.Errorf("b2: %s is a folder, not an object", o.name)
+	}
 	if err := o.ensure(ctx); err != nil {
 		return err
 	}
-	return o.f.deleteFileVersion(ctx)
+	if err := o.f.deleteFileVersion(ctx); err != nil {
+		return err
+	}
+	o.b.c.consistency().deleted(o)
+	return nil
 }
 
 // Hide hides the object from name-based listing.
 func (o *Object) Hide(ctx context.Context) error {
+	if o.IsDir() {
+		return fmt.Errorf("b2: %s is a folder, not an object", o.name)
+	}
 	if err := o.ensure(ctx); err != nil {
 		return err
 	}
-	_, err := o.b.b.hideFile(ctx, o.name)
-	return err
+	if _, err := o.b.b.hideFile(ctx, o.name); err != nil {
+		return err
+	}
+	o.b.c.consistency().hid(o)
+	return nil
 }
 
 // Reveal unhides (if hidden) the named object.  If there are multiple objects
@@ -622,7 +1421,7 @@ func (discard) Write(p []byte) (int, error) {
 }
 
 func (b *Bucket) getObject(ctx context.Context, name string) (*Object, error) {
-	fr, err := b.b.downloadFileByName(ctx, name, 0, 0, true)
+	fr, err := b.b.downloadFileByName(ctx, name, 0, 0, true, downloadOverrides{})
 	if err != nil {
 		return nil, err
 	}
@@ -639,24 +1438,129 @@ func (b *Bucket) getObject(ctx context.Context, name string) (*Object, error) {
 // in a private bucket.  Only objects that begin with prefix can be accessed.
 // The token expires after the given duration.
 func (b *Bucket) AuthToken(ctx context.Context, prefix string, valid time.Duration) (string, error) {
-	return b.b.getDownloadAuthorization(ctx, prefix, valid, "")
+	return b.b.getDownloadAuthorization(ctx, prefix, valid, downloadAuthOptions{})
 }
 
-// AuthURL returns a URL for the given object with embedded token and,
-// possibly, b2ContentDisposition arguments.  Leave b2cd blank for no content
-// disposition.
-func (o *Object) AuthURL(ctx context.Context, valid time.Duration, b2cd string) (*url.URL, error) {
-	token, err := o.b.b.getDownloadAuthorization(ctx, o.name, valid, b2cd)
-	if err != nil {
-		return nil, err
+type downloadAuthOptions struct {
+	contentDisposition string
+	contentLanguage    string
+	expires            string
+	cacheControl       string
+	contentEncoding    string
+	contentType        string
+}
+
+// query returns the b2* query parameters that must accompany downloads made
+// with a token generated from these options.
+func (o downloadAuthOptions) query() url.Values {
+	v := url.Values{}
+	for key, val := range map[string]string{
+		"b2ContentDisposition": o.contentDisposition,
+		"b2ContentLanguage":    o.contentLanguage,
+		"b2Expires":            o.expires,
+		"b2CacheControl":       o.cacheControl,
+		"b2ContentEncoding":    o.contentEncoding,
+		"b2ContentType":        o.contentType,
+	} {
+		if val != "" {
+			v.Set(key, val)
+		}
+	}
+	return v
+}
+
+// downloadOverrides are the optional parts of a download request.
+type downloadOverrides struct {
+	headers downloadAuthOptions // sent as b2* query parameters
+	token   string              // used in place of the client's authorization
+}
+
+// A DownloadAuthorizationOption overrides a response header B2 sends when
+// serving a download authorized by DownloadAuthorization, or read with
+// WithResponseHeaders.
+type DownloadAuthorizationOption func(*downloadAuthOptions)
+
+// ResponseContentDisposition overrides the Content-Disposition header.
+func ResponseContentDisposition(s string) DownloadAuthorizationOption {
+	return func(o *downloadAuthOptions) {
+		o.contentDisposition = s
+	}
+}
+
+// ResponseContentLanguage overrides the Content-Language header.
+func ResponseContentLanguage(s string) DownloadAuthorizationOption {
+	return func(o *downloadAuthOptions) {
+		o.contentLanguage = s
+	}
+}
+
+// ResponseExpires overrides the Expires header.
+func ResponseExpires(s string) DownloadAuthorizationOption {
+	return func(o *downloadAuthOptions) {
+		o.expires = s
+	}
+}
+
+// ResponseCacheControl overrides the Cache-Control header.
+func ResponseCacheControl(s string) DownloadAuthorizationOption {
+	return func(o *downloadAuthOptions) {
+		o.cacheControl = s
+	}
+}
+
+// ResponseContentEncoding overrides the Content-Encoding header.
+func ResponseContentEncoding(s string) DownloadAuthorizationOption {
+	return func(o *downloadAuthOptions) {
+		o.contentEncoding = s
+	}
+}
+
+// ResponseContentType overrides the Content-Type header.
+func ResponseContentType(s string) DownloadAuthorizationOption {
+	return func(o *downloadAuthOptions) {
+		o.contentType = s
+	}
+}
+
+// DownloadAuthorization returns an authorization token for objects in the
+// bucket that begin with prefix, valid for the given duration, along with a
+// download URL for prefix that carries the token and any response header
+// overrides.  If prefix is the full name of an object, the URL downloads that
+// object; otherwise, replace the path to download other objects under the
+// prefix, keeping the query.
+func (b *Bucket) DownloadAuthorization(ctx context.Context, prefix string, valid time.Duration, opts ...DownloadAuthorizationOption) (string, *url.URL, error) {
+	if valid < time.Second || valid > maxDownloadAuthorization {
+		return "", nil, fmt.Errorf("b2: download authorization validity %v is outside B2's allowed range of one second to seven days", valid)
 	}
-	urlString := fmt.Sprintf("%s?Authorization=%s", o.URL(), url.QueryEscape(token))
-	if b2cd != "" {
-		urlString = fmt.Sprintf("%s&b2ContentDisposition=%s", urlString, url.QueryEscape(b2cd))
+	var o downloadAuthOptions
+	for _, f := range opts {
+		f(&o)
 	}
-	u, err := url.Parse(urlString)
+	token, err := b.b.getDownloadAuthorization(ctx, prefix, valid, o)
 	if err != nil {
-		return nil, err
+		return "", nil, err
 	}
-	return u, nil
+	q := o.query()
+	q.Set("Authorization", token)
+	u, err := url.Parse(fmt.Sprintf("%s/file/%s/%s?%s", b.BaseURL(), b.Name(), escapeName(prefix), q.Encode()))
+	if err != nil {
+		return "", nil, err
+	}
+	return token, u, nil
+}
+
+// maxDownloadAuthorization is the longest validity B2 allows for a download
+// authorization.
+const maxDownloadAuthorization = 7 * 24 * time.Hour
+
+// AuthURL returns a URL for the given object with embedded token and,
+// possibly, b2ContentDisposition arguments.  Leave b2cd blank for no content
+// disposition.
+//
+// The token is scoped to this object alone, so AuthURL works with keys that
+// are restricted to a prefix containing the object.  B2 limits validity to
+// seven days; longer durations return an error.
+func (o *Object) AuthURL(ctx context.Context, valid time.Duration, b2cd string) (*url.URL, error) {
+	_, u, err := o.b.DownloadAuthorization(ctx, o.name, valid, ResponseContentDisposition(b2cd))
+	return u, err
 }
@@ -16,18 +16,33 @@ package b2
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
 	"crypto/sha1"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
+	"math/rand"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
 	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
+
+	"github.com/Backblaze/blazer/b2test"
 )
 
 const (
@@ -38,15 +53,28 @@ const (
 
 var gmux = &sync.Mutex{}
 
+// fakeClock returns a clock that retries and throttled transfers don't wait
+// on.
+func fakeClock() *b2test.FakeClock {
+	fc := b2test.NewFakeClock(time.Now())
+	fc.AdvanceOnWait(true)
+	return fc
+}
+
 type testError struct {
 	retry    bool
 	backoff  time.Duration
 	reauth   bool
 	reupload bool
+	badHash  bool
+
+	// For uploadPart, lost and garbled succeed, but keep nothing or the
+	// wrong data.
+	lost, garbled bool
 }
 
 func (t testError) Error() string {
-	return fmt.Sprintf("retry %v; backoff %v; reauth %v; reupload %v", t.retry, t.backoff, t.reauth, t.reupload)
+	return fmt.Sprintf("retry %v; backoff %v; reauth %v; reupload %v; bad hash %v", t.retry, t.backoff, t.reauth, t.reupload, t.badHash)
 }
 
 type errCont struct {
@@ -67,13 +95,87 @@ type testRoot struct {
 	errs      *errCont
 	auths     int
 	bucketMap map[string]map[string]string
+	keys      []*testKey
+	partSize  int
+	minParts  int    // the absolute minimum part size
+	restrict  string // if set, the key is restricted to this bucket
+	prefix    string // and this prefix
+	meta      map[string]*testBucketMeta
+	expires   time.Time // when the key expires
+	key       string    // the application key last authorized with
+}
+
+// testBucketMeta is the server-side state of a test bucket.
+type testBucketMeta struct {
+	info  map[string]string
+	rev   int
+	files map[string]*testFileInfo // uploaded with a content type or info
+
+	unfinished map[string]*testLargeFile // by key
+	started    int                       // large files started so far
+	served     int64                     // bytes of content downloaded
+
+	tokens map[string]testToken // download authorizations given out
+}
+
+// testToken records what a download authorization allows.
+type testToken struct {
+	prefix string
+	opts   downloadAuthOptions
+}
+
+func (t *testRoot) bucketMeta(name string) *testBucketMeta {
+	gmux.Lock()
+	defer gmux.Unlock()
+	if t.meta == nil {
+		t.meta = make(map[string]*testBucketMeta)
+	}
+	m, ok := t.meta[name]
+	if !ok {
+		m = &testBucketMeta{rev: 1}
+		t.meta[name] = m
+	}
+	return m
 }
 
-func (t *testRoot) authorizeAccount(context.Context, string, string, clientOptions) error {
+func (t *testRoot) authorizeAccount(_ context.Context, _, key string, _ clientOptions) error {
 	t.auths++
+	t.key = key
 	return nil
 }
 
+func (t *testRoot) accountInfo() *AccountInfo {
+	partSize := t.partSize
+	if partSize == 0 {
+		partSize = 1e8
+	}
+	if t.restrict != "" {
+		return &AccountInfo{
+			AccountID:           "account",
+			Capabilities:        []string{"readFiles"},
+			BucketID:            t.restrict,
+			BucketName:          t.restrict,
+			Prefix:              t.prefix,
+			RecommendedPartSize: partSize,
+		}
+	}
+	return &AccountInfo{
+		AccountID:               "account",
+		Capabilities:            []string{"listBuckets", "readFiles"},
+		RecommendedPartSize:     partSize,
+		AbsoluteMinimumPartSize: t.minParts,
+		KeyExpiration:           t.expires,
+	}
+}
+
+func (t *testRoot) session() ([]byte, error) {
+	return json.Marshal(t.key)
+}
+
+func (t *testRoot) resumeSession(data []byte, _ clientOptions) error {
+	return json.Unmarshal(data, &t.key)
+}
+
 func (t *testRoot) backoff(err error) time.Duration {
 	e, ok := err.(testError)
 	if !ok {
@@ -98,6 +200,14 @@ func (t *testRoot) reupload(err error) bool {
 	return e.reupload
 }
 
+func (t *testRoot) hashMismatch(err error) bool {
+	e, ok := err.(testError)
+	if !ok {
+		return false
+	}
+	return e.badHash
+}
+
 func (t *testRoot) transient(err error) bool {
 	e, ok := err.(testError)
 	if !ok {
@@ -106,14 +216,51 @@ func (t *testRoot) transient(err error) bool {
 	return e.retry || e.reupload || e.backoff > 0
 }
 
-func (t *testRoot) createKey(context.Context, string, []string, time.Duration, string, string) (b2KeyInterface, error) {
-	return nil, nil
+func (t *testRoot) createKey(_ context.Context, name string, caps []string, valid time.Duration, bucketID, prefix string) (b2KeyInterface, error) {
+	k := &testKey{
+		n:      name,
+		i:      fmt.Sprintf("key%04d", len(t.keys)),
+		c:      caps,
+		bucket: bucketID,
+		pfx:    prefix,
+	}
+	if valid > 0 {
+		k.e = time.Now().Add(valid)
+	}
+	t.keys = append(t.keys, k)
+	return k, nil
+}
+
+func (t *testRoot) listKeys(_ context.Context, max int, next string) ([]b2KeyInterface, string, error) {
+	var keys []b2KeyInterface
+	for _, k := range t.keys {
+		if k.i < next {
+			continue
+		}
+		if len(keys) == max {
+			return keys, k.i, nil
+		}
+		keys = append(keys, k)
+	}
+	return keys, "", nil
 }
-func (t *testRoot) listKeys(context.Context, int, string) ([]b2KeyInterface, string, error) {
-	return nil, "", nil
+
+type testKey struct {
+	n, i, bucket, pfx string
+	c                 []string
+	e                 time.Time
 }
 
-func (t *testRoot) createBucket(_ context.Context, name, _ string, _ map[string]string, _ []LifecycleRule) (b2BucketInterface, error) {
+func (t *testKey) del(context.Context) error { return nil }
+func (t *testKey) caps() []string            { return t.c }
+func (t *testKey) name() string              { return t.n }
+func (t *testKey) expires() time.Time        { return t.e }
+func (t *testKey) secret() string            { return "" }
+func (t *testKey) id() string                { return t.i }
+func (t *testKey) bucketID() string          { return t.bucket }
+func (t *testKey) prefix() string            { return t.pfx }
+
+func (t *testRoot) createBucket(_ context.Context, name, _ string, _ map[string]string, _ []LifecycleRule, _ bool) (b2BucketInterface, error) {
 	if err := t.errs.getError("createBucket"); err != nil {
 		return nil, err
 	}
@@ -122,20 +269,40 @@ func (t *testRoot) createBucket(_ context.Context, name, _ string, _ map[string]
 	}
 	m := make(map[string]string)
 	t.bucketMap[name] = m
+	meta := t.bucketMeta(name)
 	return &testBucket{
 		n:     name,
 		errs:  t.errs,
 		files: m,
+		all:   t.bucketMap,
+		meta:  meta,
+		rev:   meta.rev,
 	}, nil
 }
 
+func (t *testRoot) bucket(id, name string) b2BucketInterface {
+	return &testBucket{
+		n:     name,
+		errs:  t.errs,
+		files: t.bucketMap[name],
+		all:   t.bucketMap,
+	}
+}
+
 func (t *testRoot) listBuckets(context.Context, string) ([]b2BucketInterface, error) {
+	if t.restrict != "" {
+		return nil, fmt.Errorf("401: unauthorized")
+	}
 	var b []b2BucketInterface
 	for k, v := range t.bucketMap {
+		meta := t.bucketMeta(k)
 		b = append(b, &testBucket{
 			n:     k,
 			errs:  t.errs,
 			files: v,
+			all:   t.bucketMap,
+			meta:  meta,
+			rev:   meta.rev,
 		})
 	}
 	return b, nil
@@ -145,14 +312,48 @@ type testBucket struct {
 	n     string
 	errs  *errCont
 	files map[string]string
+	all   map[string]map[string]string // every bucket's files, for copies
+	meta  *testBucketMeta              // may be nil
+	rev   int                          // the revision last seen
+}
+
+func (t *testBucket) name() string                       { return t.n }
+func (t *testBucket) btype() string                      { return "allPrivate" }
+func (t *testBucket) deleteBucket(context.Context) error { return nil }
+func (t *testBucket) id() string                         { return t.n }
+
+func (t *testBucket) attrs() *BucketAttrs {
+	if t.meta == nil {
+		return nil
+	}
+	gmux.Lock()
+	defer gmux.Unlock()
+	return &BucketAttrs{Type: Private, Info: t.meta.info, Revision: t.rev}
 }
 
-func (t *testBucket) name() string                                     { return t.n }
-func (t *testBucket) btype() string                                    { return "allPrivate" }
-func (t *testBucket) attrs() *BucketAttrs                              { return nil }
-func (t *testBucket) deleteBucket(context.Context) error               { return nil }
-func (t *testBucket) updateBucket(context.Context, *BucketAttrs) error { return nil }
-func (t *testBucket) id() string                                       { return "" }
+func (t *testBucket) updateBucket(_ context.Context, attrs *BucketAttrs) error {
+	if err := t.errs.getError("updateBucket"); err != nil {
+		return err
+	}
+	if t.meta == nil || attrs == nil {
+		return nil
+	}
+	gmux.Lock()
+	defer gmux.Unlock()
+	rev := attrs.Revision
+	if rev == 0 {
+		rev = t.rev
+	}
+	if rev != t.meta.rev {
+		return b2err{err: fmt.Errorf("revision %d is stale", rev), isUpdateConflict: true}
+	}
+	if attrs.Info != nil {
+		t.meta.info = attrs.Info
+	}
+	t.meta.rev++
+	t.rev = t.meta.rev
+	return nil
+}
 
 func (t *testBucket) getUploadURL(context.Context) (b2URLInterface, error) {
 	if err := t.errs.getError("getUploadURL"); err != nil {
@@ -160,23 +361,56 @@ func (t *testBucket) getUploadURL(context.Context) (b2URLInterface, error) {
 	}
 	return &testURL{
 		files: t.files,
+		meta:  t.meta,
+		errs:  t.errs,
 	}, nil
 }
 
-func (t *testBucket) startLargeFile(_ context.Context, name, _ string, _ map[string]string) (b2LargeFileInterface, error) {
-	return &testLargeFile{
+func (t *testBucket) startLargeFile(_ context.Context, name, ct string, info map[string]string) (b2LargeFileInterface, error) {
+	lf := &testLargeFile{
 		name:  name,
+		ct:    ct,
+		info:  info,
+		meta:  t.meta,
 		parts: make(map[int][]byte),
 		files: t.files,
+		all:   t.all,
 		errs:  t.errs,
-	}, nil
+	}
+	if t.meta != nil {
+		gmux.Lock()
+		if t.meta.unfinished == nil {
+			t.meta.unfinished = make(map[string]*testLargeFile)
+		}
+		t.meta.started++
+		lf.key = fmt.Sprintf("%s\x00%08d", name, t.meta.started)
+		lf.started = time.Unix(int64(t.meta.started), 0)
+		t.meta.unfinished[lf.key] = lf
+		gmux.Unlock()
+	}
+	return lf, nil
 }
 
-func (t *testBucket) listFileNames(ctx context.Context, count int, cont, pfx, del string) ([]b2FileInterface, string, error) {
+func (t *testBucket) listFileNames(ctx context.Context, count int, cont, pfx, del string, emit func(b2FileInterface)) ([]b2FileInterface, string, error) {
+	if err := t.errs.getError("listFileNames"); err != nil {
+		return nil, "", err
+	}
 	var f []string
 	gmux.Lock()
 	defer gmux.Unlock()
+	folders := make(map[string]bool)
 	for name := range t.files {
+		if !strings.HasPrefix(name, pfx) {
+			continue
+		}
+		if i := strings.Index(name[len(pfx):], del); del != "" && i >= 0 {
+			folder := name[:len(pfx)+i+len(del)]
+			if !folders[folder] {
+				folders[folder] = true
+				f = append(f, folder)
+			}
+			continue
+		}
 		f = append(f, name)
 	}
 	sort.Strings(f)
@@ -184,82 +418,349 @@ func (t *testBucket) listFileNames(ctx context.Context, count int, cont, pfx, de
 	var b []b2FileInterface
 	var next string
 	for i := idx; i < len(f) && i-idx < count; i++ {
-		b = append(b, &testFile{
-			n:     f[i],
-			s:     int64(len(t.files[f[i]])),
-			files: t.files,
-		})
+		if folders[f[i]] {
+			b = append(b, &testFile{n: f[i], a: "folder", files: t.files})
+		} else {
+			b = append(b, &testFile{
+				n:     f[i],
+				s:     int64(len(t.files[f[i]])),
+				files: t.files,
+				errs:  t.errs,
+			})
+		}
 		if i+1 < len(f) {
 			next = f[i+1]
 		}
 		if i+1 == len(f) {
 			next = ""
 		}
+		if emit != nil {
+			emit(b[len(b)-1])
+		}
 	}
 	return b, next, nil
 }
 
-func (t *testBucket) listFileVersions(ctx context.Context, count int, a, b, c, d string) ([]b2FileInterface, string, string, error) {
-	x, y, z := t.listFileNames(ctx, count, a, c, d)
-	return x, y, "", z
+func (t *testBucket) listFileVersions(ctx context.Context, count int, a, b, c, d string, emit func(b2FileInterface)) ([]b2FileInterface, string, string, error) {
+	x, y, z := t.listFileNames(ctx, count, a, c, d, emit)
+	return x, y, y, z // test file IDs are their names
 }
 
 func (t *testBucket) listUnfinishedLargeFiles(ctx context.Context, count int, cont string) ([]b2FileInterface, string, error) {
-	return nil, "", fmt.Errorf("testBucket.listUnfinishedLargeFiles(ctx, %d, %q): not implemented", count, cont)
+	if t.meta == nil {
+		return nil, "", fmt.Errorf("testBucket.listUnfinishedLargeFiles(ctx, %d, %q): not implemented", count, cont)
+	}
+	gmux.Lock()
+	defer gmux.Unlock()
+	var keys []string
+	for key := range t.meta.unfinished {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var files []b2FileInterface
+	for _, key := range keys {
+		lf := t.meta.unfinished[key]
+		files = append(files, &testUnfinishedFile{
+			testFile: testFile{n: lf.name, t: lf.started, a: "start", files: t.files},
+			lf:       lf,
+		})
+	}
+	return files, "", nil
+}
+
+// testUnfinishedFile is a large file that was started but not finished.
+type testUnfinishedFile struct {
+	testFile
+	lf *testLargeFile
+}
+
+func (t *testUnfinishedFile) listParts(ctx context.Context, next, count int) ([]b2FilePartInterface, int, error) {
+	return t.lf.listParts(ctx, next, count)
+}
+
+func (t *testLargeFile) listParts(_ context.Context, next, _ int) ([]b2FilePartInterface, int, error) {
+	if err := t.errs.getError("listParts"); err != nil {
+		return nil, 0, err
+	}
+	gmux.Lock()
+	defer gmux.Unlock()
+	var nums []int
+	for i := range t.parts {
+		if i >= next {
+			nums = append(nums, i)
+		}
+	}
+	sort.Ints(nums)
+	var parts []b2FilePartInterface
+	for _, i := range nums {
+		p := t.parts[i]
+		parts = append(parts, testPart{n: i, sha: fmt.Sprintf("%x", sha1.Sum(p)), s: int64(len(p))})
+	}
+	return parts, 0, nil
+}
+
+func (t *testUnfinishedFile) compileParts(int64, map[int]string) b2LargeFileInterface { return t.lf }
+
+type testPart struct {
+	n   int
+	sha string
+	s   int64
 }
 
-func (t *testBucket) downloadFileByName(_ context.Context, name string, offset, size int64, _ bool) (b2FileReaderInterface, error) {
+func (p testPart) number() int  { return p.n }
+func (p testPart) sha1() string { return p.sha }
+func (p testPart) size() int64  { return p.s }
+
+func (t *testBucket) downloadFileByName(_ context.Context, name string, offset, size int64, header bool, ov downloadOverrides) (b2FileReaderInterface, error) {
 	gmux.Lock()
 	defer gmux.Unlock()
-	f := t.files[name]
+	if ov.token != "" {
+		// As B2 does, refuse tokens for other names, or whose overrides
+		// aren't sent with them.
+		var tok testToken
+		var ok bool
+		if t.meta != nil {
+			tok, ok = t.meta.tokens[ov.token]
+		}
+		if !ok || !strings.HasPrefix(name, tok.prefix) {
+			return nil, fmt.Errorf("%s: token not valid", name)
+		}
+		if tok.opts != ov.headers {
+			return nil, fmt.Errorf("%s: b2* parameters don't match the token", name)
+		}
+	}
+	f, ok := t.files[name]
+	if header {
+		if !ok {
+			return nil, b2err{err: fmt.Errorf("%s: not found", name), notFoundErr: true}
+		}
+		fr := &testFileReader{
+			b:    ioutil.NopCloser(&bytes.Buffer{}),
+			s:    len(f),
+			n:    name,
+			sha1: t.sha1(name, f),
+			z:    int64(len(f)),
+		}
+		if t.meta != nil {
+			if fi, ok := t.meta.files[name]; ok {
+				fr.ct, fr.info, fr.ts = fi.ct, fi.info, fi.stamp
+			}
+		}
+		return fr, nil
+	}
 	end := int(offset + size)
-	if end >= len(f) {
+	if end >= len(f) || size == 0 {
+		// A size of 0 asks for the rest of the file, as in base.
 		end = len(f)
 	}
 	if int(offset) >= len(f) {
 		return nil, errNoMoreContent
 	}
-	return &testFileReader{
-		b: ioutil.NopCloser(bytes.NewBufferString(f[offset:end])),
-		s: end - int(offset),
-		n: name,
-	}, nil
+	body := f[offset:end]
+	length, whole := len(body), int64(len(f))
+	var r io.Reader = strings.NewReader(body)
+	if err := t.errs.getError("readBody"); err != nil {
+		switch te, _ := err.(testError); {
+		case te.garbled:
+			// A flipped bit that nothing between here and the reader notices.
+			b := []byte(body)
+			b[0] ^= 1
+			body = string(b)
+			r = strings.NewReader(body)
+		case te.lost:
+			// A proxy cuts the body short, and says so only in its length,
+			// having dropped the Content-Range header.
+			body = body[:len(body)-1]
+			length, whole = len(body), 0
+			r = strings.NewReader(body)
+		default:
+			// The connection drops halfway through the body.
+			body = body[:len(body)/2]
+			r = io.MultiReader(strings.NewReader(body), &errReader{err: err})
+		}
+	}
+	fr := &testFileReader{
+		b:    ioutil.NopCloser(r),
+		s:    length,
+		n:    name,
+		sha1: t.sha1(name, f),
+		z:    whole,
+	}
+	if t.meta != nil {
+		atomic.AddInt64(&t.meta.served, int64(len(body)))
+		if fi, ok := t.meta.files[name]; ok {
+			fr.ct, fr.info, fr.ts = fi.ct, fi.info, fi.stamp
+		}
+	}
+	return fr, nil
+}
+
+// sha1 returns the hash sent with downloads of the named file: the one it was
+// uploaded with, which for large files is "none", or that of f.
+func (t *testBucket) sha1(name, f string) string {
+	if t.meta != nil {
+		if fi, ok := t.meta.files[name]; ok {
+			if fi.sha1 == "none" && fi.info["large_file_sha1"] != "" {
+				return fi.info["large_file_sha1"]
+			}
+			return fi.sha1
+		}
+	}
+	return fmt.Sprintf("%x", sha1.Sum([]byte(f)))
+}
+
+type errReader struct{ err error }
+
+func (e *errReader) Read([]byte) (int, error) { return 0, e.err }
+
+func (t *testBucket) hideFile(context.Context, string) (b2FileInterface, error) {
+	return nil, t.errs.getError("hideFile")
+}
+func (t *testBucket) copyFile(_ context.Context, srcID, name string, offset, size int64, ct string, info map[string]string) (b2FileInterface, error) {
+	if err := t.errs.getError("copyFile"); err != nil {
+		return nil, err
+	}
+	gmux.Lock()
+	defer gmux.Unlock()
+	src, ok := testSource(srcID, t.files, t.all)
+	if !ok {
+		return nil, b2err{err: fmt.Errorf("%s: not found", srcID), notFoundErr: true}
+	}
+	t.files[name] = testRange(src, offset, size)
+	f := &testFile{
+		n:     name,
+		s:     int64(len(t.files[name])),
+		files: t.files,
+	}
+	if ct != "" {
+		// Like b2_copy_file, return the new file's info with the file.
+		f.fi = &testFileInfo{
+			name: name,
+			sha1: fmt.Sprintf("%x", sha1.Sum([]byte(t.files[name]))),
+			size: f.s,
+			ct:   ct,
+			info: info,
+		}
+	}
+	return f, nil
+}
+
+// testSource finds the file with the given ID, preferring the destination
+// bucket since test file IDs are only unique within a bucket.
+func testSource(id string, files map[string]string, all map[string]map[string]string) (string, bool) {
+	if f, ok := files[id]; ok {
+		return f, true
+	}
+	for _, fs := range all {
+		if f, ok := fs[id]; ok {
+			return f, true
+		}
+	}
+	return "", false
+}
+
+// testRange returns the given range of s, following the conventions of
+// base.mkRange.
+func testRange(s string, offset, size int64) string {
+	if size == 0 {
+		return s[offset:]
+	}
+	return s[offset : offset+size]
 }
 
-func (t *testBucket) hideFile(context.Context, string) (b2FileInterface, error) { return nil, nil }
-func (t *testBucket) getDownloadAuthorization(context.Context, string, time.Duration, string) (string, error) {
-	return "", nil
+func (t *testBucket) getDownloadAuthorization(_ context.Context, p string, v time.Duration, o downloadAuthOptions) (string, error) {
+	token := fmt.Sprintf("token:%s:%v:%s", p, v, o.contentType)
+	if t.meta != nil {
+		gmux.Lock()
+		if t.meta.tokens == nil {
+			t.meta.tokens = make(map[string]testToken)
+		}
+		t.meta.tokens[token] = testToken{prefix: p, opts: o}
+		gmux.Unlock()
+	}
+	return token, nil
+}
+func (t *testBucket) baseURL() string { return "https://f000.example.com" }
+func (t *testBucket) s3URL() string   { return "" }
+func (t *testBucket) file(id, name string) b2FileInterface {
+	gmux.Lock()
+	defer gmux.Unlock()
+	f := &testFile{n: name, s: int64(len(t.files[name])), files: t.files, errs: t.errs}
+	if t.meta != nil {
+		f.fi = t.meta.files[name]
+	}
+	return f
 }
-func (t *testBucket) baseURL() string                      { return "" }
-func (t *testBucket) s3URL() string                        { return "" }
-func (t *testBucket) file(id, name string) b2FileInterface { return nil }
 
 type testURL struct {
 	files map[string]string
+	meta  *testBucketMeta // may be nil
+	errs  *errCont
 }
 
 func (t *testURL) reload(context.Context) error { return nil }
 
-func (t *testURL) uploadFile(_ context.Context, r io.Reader, _ int, name, _, _ string, _ map[string]string) (b2FileInterface, error) {
+func (t *testURL) uploadFile(_ context.Context, r io.Reader, _ int, name, ct, sha string, info map[string]string) (b2FileInterface, error) {
+	if err := t.errs.getError("uploadFile"); err != nil {
+		return nil, err
+	}
 	buf := &bytes.Buffer{}
 	if _, err := io.Copy(buf, r); err != nil {
 		return nil, err
 	}
+	if sha == "hex_digits_at_end" {
+		buf.Truncate(buf.Len() - 40)
+	} else if sha != fmt.Sprintf("%x", sha1.Sum(buf.Bytes())) {
+		return nil, testError{badHash: true}
+	}
 	gmux.Lock()
 	defer gmux.Unlock()
 	t.files[name] = buf.String()
-	return &testFile{
+	f := &testFile{
 		n:     name,
 		s:     int64(len(t.files[name])),
 		files: t.files,
-	}, nil
+	}
+	t.meta.saveFile(f, ct, info, fmt.Sprintf("%x", sha1.Sum(buf.Bytes())))
+	return f, nil
+}
+
+// saveFile attaches file info to f, as B2 returns it with uploads, and
+// records the content type and info, if it has any, so that later lookups
+// report them.  It must be called with gmux held.
+func (m *testBucketMeta) saveFile(f *testFile, ct string, info map[string]string, sha string) {
+	f.fi = &testFileInfo{
+		name:  f.n,
+		sha1:  sha,
+		size:  f.s,
+		ct:    ct,
+		info:  info,
+		stamp: time.Now(),
+	}
+	if m == nil {
+		return
+	}
+	if ct == "application/octet-stream" && len(info) == 0 {
+		delete(m.files, f.n)
+		return
+	}
+	if m.files == nil {
+		m.files = make(map[string]*testFileInfo)
+	}
+	m.files[f.n] = f.fi
 }
 
 type testLargeFile struct {
-	name  string
-	parts map[int][]byte
-	files map[string]string
-	errs  *errCont
+	name    string
+	key     string    // in meta.unfinished
+	started time.Time // when startLargeFile was called
+	ct      string
+	info    map[string]string
+	meta    *testBucketMeta // may be nil
+	parts   map[int][]byte
+	files   map[string]string
+	all     map[string]map[string]string
+	errs    *errCont
 }
 
 func (t *testLargeFile) finishLargeFile(context.Context) (b2FileInterface, error) {
@@ -267,17 +768,31 @@ func (t *testLargeFile) finishLargeFile(context.Context) (b2FileInterface, error
 	gmux.Lock()
 	defer gmux.Unlock()
 	for i := 1; i <= len(t.parts); i++ {
-		total = append(total, t.parts[i]...)
+		p, ok := t.parts[i]
+		if !ok {
+			return nil, fmt.Errorf("part number %d missing", i)
+		}
+		total = append(total, p...)
 	}
 	t.files[t.name] = string(total)
-	return &testFile{
+	if t.meta != nil {
+		delete(t.meta.unfinished, t.key)
+	}
+	f := &testFile{
 		n:     t.name,
 		s:     int64(len(total)),
 		files: t.files,
-	}, nil
+	}
+	t.meta.saveFile(f, t.ct, t.info, "none")
+	return f, nil
 }
 
+func (t *testLargeFile) id() string { return t.key }
+
 func (t *testLargeFile) getUploadPartURL(context.Context) (b2FileChunkInterface, error) {
+	if err := t.errs.getError("getUploadPartURL"); err != nil {
+		return nil, err
+	}
 	gmux.Lock()
 	defer gmux.Unlock()
 	return &testFileChunk{
@@ -286,7 +801,31 @@ func (t *testLargeFile) getUploadPartURL(context.Context) (b2FileChunkInterface,
 	}, nil
 }
 
-func (t *testLargeFile) cancel(ctx context.Context) error { return ctx.Err() }
+func (t *testLargeFile) copyPart(_ context.Context, srcID string, index int, offset, size int64) (int64, error) {
+	if err := t.errs.getError("copyPart"); err != nil {
+		return 0, err
+	}
+	gmux.Lock()
+	defer gmux.Unlock()
+	src, ok := testSource(srcID, t.files, t.all)
+	if !ok {
+		return 0, b2err{err: fmt.Errorf("%s: not found", srcID), notFoundErr: true}
+	}
+	t.parts[index] = []byte(testRange(src, offset, size))
+	return int64(len(t.parts[index])), nil
+}
+
+func (t *testLargeFile) cancel(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if t.meta != nil {
+		gmux.Lock()
+		delete(t.meta.unfinished, t.key)
+		gmux.Unlock()
+	}
+	return ctx.Err()
+}
 
 type testFileChunk struct {
 	parts map[int][]byte
@@ -295,15 +834,31 @@ type testFileChunk struct {
 
 func (t *testFileChunk) reload(context.Context) error { return nil }
 
-func (t *testFileChunk) uploadPart(_ context.Context, r io.Reader, _ string, _, index int) (int, error) {
+func (t *testFileChunk) uploadPart(_ context.Context, r io.Reader, sha string, _, index int) (int, error) {
+	var lost, garbled bool
 	if err := t.errs.getError("uploadPart"); err != nil {
-		return 0, err
+		te, ok := err.(testError)
+		if !ok || !te.lost && !te.garbled {
+			return 0, err
+		}
+		lost, garbled = te.lost, te.garbled
 	}
 	buf := &bytes.Buffer{}
 	i, err := io.Copy(buf, r)
 	if err != nil {
 		return int(i), err
 	}
+	if sha == "hex_digits_at_end" {
+		buf.Truncate(buf.Len() - 40)
+	} else if sha != fmt.Sprintf("%x", sha1.Sum(buf.Bytes())) {
+		return 0, testError{badHash: true}
+	}
+	if lost {
+		return int(i), nil
+	}
+	if garbled {
+		buf.Bytes()[0] ^= 0xff
+	}
 	gmux.Lock()
 	defer gmux.Unlock()
 	t.parts[index] = buf.Bytes()
@@ -315,7 +870,9 @@ type testFile struct {
 	s     int64
 	t     time.Time
 	a     string
+	fi    *testFileInfo // if set, returned by getFileInfo
 	files map[string]string
+	errs  *errCont // may be nil
 }
 
 func (t *testFile) id() string           { return t.n }
@@ -329,7 +886,45 @@ func (t *testFile) compileParts(int64, map[int]string) b2LargeFileInterface {
 }
 
 func (t *testFile) getFileInfo(context.Context) (b2FileInfoInterface, error) {
-	return nil, nil
+	if t.errs != nil {
+		if err := t.errs.getError("getFileInfo"); err != nil {
+			return nil, err
+		}
+	}
+	if t.fi != nil {
+		return t.fi, nil
+	}
+	gmux.Lock()
+	defer gmux.Unlock()
+	f, ok := t.files[t.n]
+	if !ok {
+		return nil, b2err{err: fmt.Errorf("%s: not found", t.n), notFoundErr: true}
+	}
+	return &testFileInfo{
+		name: t.n,
+		sha1: fmt.Sprintf("%x", sha1.Sum([]byte(f))),
+		size: int64(len(f)),
+	}, nil
+}
+
+type testFileInfo struct {
+	name  string
+	sha1  string
+	size  int64
+	ct    string
+	info  map[string]string
+	stamp time.Time
+}
+
+func (t *testFileInfo) stats() (string, string, int64, string, map[string]string, string, time.Time) {
+	ct, info := t.ct, t.info
+	if ct == "" {
+		ct = "application/octet-stream"
+	}
+	if info == nil {
+		info = map[string]string{}
+	}
+	return t.name, t.sha1, t.size, ct, info, "upload", t.stamp
 }
 
 func (t *testFile) listParts(context.Context, int, int) ([]b2FilePartInterface, int, error) {
@@ -337,6 +932,11 @@ func (t *testFile) listParts(context.Context, int, int) ([]b2FilePartInterface,
 }
 
 func (t *testFile) deleteFileVersion(context.Context) error {
+	if t.errs != nil {
+		if err := t.errs.getError("deleteFileVersion"); err != nil {
+			return err
+		}
+	}
 	gmux.Lock()
 	defer gmux.Unlock()
 	delete(t.files, t.n)
@@ -344,15 +944,24 @@ func (t *testFile) deleteFileVersion(context.Context) error {
 }
 
 type testFileReader struct {
-	b io.ReadCloser
-	s int
-	n string
+	b    io.ReadCloser
+	s    int
+	n    string
+	sha1 string
+	z    int64 // the whole file's size
+	ct   string
+	info map[string]string
+	ts   time.Time
 }
 
-func (t *testFileReader) Read(p []byte) (int, error)                      { return t.b.Read(p) }
-func (t *testFileReader) Close() error                                    { return nil }
-func (t *testFileReader) stats() (int, string, string, map[string]string) { return t.s, "", "", nil }
-func (t *testFileReader) id() string                                      { return t.n }
+func (t *testFileReader) Read(p []byte) (int, error) { return t.b.Read(p) }
+func (t *testFileReader) Close() error               { return nil }
+func (t *testFileReader) stats() (int, string, string, map[string]string) {
+	return t.s, t.ct, t.sha1, t.info
+}
+func (t *testFileReader) id() string           { return t.n }
+func (t *testFileReader) size() int64          { return t.z }
+func (t *testFileReader) timestamp() time.Time { return t.ts }
 
 type zReader struct{}
 
@@ -467,18 +1076,154 @@ func TestReauth(t *testing.T) {
 	}
 }
 
-func TestBackoff(t *testing.T) {
+func TestRetryPaths(t *testing.T) {
 	ctx := context.Background()
 	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
 	defer cancel()
 
-	var calls []time.Duration
-	ch := make(chan time.Time)
-	close(ch)
-	after = func(d time.Duration) <-chan time.Time {
-		calls = append(calls, d)
-		return ch
+	table := []struct {
+		name     string
+		errs     map[string]map[int]error
+		attempts int
+		maxAfter time.Duration // the policy's MaxRetryAfter
+		large    bool          // upload a large file, one part at a time
+		op       string        // whose calls are counted
+		calls    int
+		auths    int
+		delays   []time.Duration // zero for any
+		methods  []string        // given to the client's OnRetry
+		wantErr  bool
+	}{
+		{
+			name:    "expired auth token",
+			errs:    map[string]map[int]error{"createBucket": {0: testError{reauth: true}}},
+			op:      "createBucket",
+			calls:   2,
+			auths:   1,
+			delays:  []time.Duration{0},
+			methods: []string{"b2_create_bucket"},
+		},
+		{
+			// Authorizing again doesn't help, and isn't tried again.
+			name:    "auth token keeps expiring",
+			errs:    map[string]map[int]error{"createBucket": {0: testError{reauth: true}, 1: testError{reauth: true}}},
+			op:      "createBucket",
+			calls:   2,
+			auths:   1,
+			delays:  []time.Duration{0},
+			methods: []string{"b2_create_bucket"},
+			wantErr: true,
+		},
+		{
+			name:    "503 with Retry-After",
+			errs:    map[string]map[int]error{"createBucket": {0: testError{backoff: 7 * time.Second}, 1: testError{retry: true}}},
+			op:      "createBucket",
+			calls:   3,
+			delays:  []time.Duration{7 * time.Second, 0},
+			methods: []string{"b2_create_bucket", "b2_create_bucket"},
+		},
+		{
+			name:   "Retry-After of an hour",
+			errs:   map[string]map[int]error{"createBucket": {0: testError{backoff: time.Hour}}},
+			op:     "createBucket",
+			calls:  2,
+			delays: []time.Duration{5 * time.Minute},
+		},
+		{
+			name:     "Retry-After over MaxRetryAfter",
+			errs:     map[string]map[int]error{"createBucket": {0: testError{backoff: 7 * time.Second}}},
+			maxAfter: 2 * time.Second,
+			op:       "createBucket",
+			calls:    2,
+			delays:   []time.Duration{2 * time.Second},
+		},
+		{
+			// The part fails with its first URL, in the backend's retry and
+			// then in the writer's, which asks for another.
+			name:     "invalidated upload URL",
+			errs:     map[string]map[int]error{"uploadPart": {0: testError{reupload: true}, 1: testError{reupload: true}}},
+			attempts: 2,
+			large:    true,
+			op:       "getUploadPartURL",
+			calls:    2,
+			delays:   []time.Duration{0, 0},
+			methods:  []string{"b2_upload_part", "b2_upload_part"},
+		},
+	}
+	for _, e := range table {
+		root := &testRoot{
+			bucketMap: make(map[string]map[string]string),
+			errs:      &errCont{errMap: map[string]map[int]error{}},
+		}
+		var delays []time.Duration
+		var methods []string
+		be := &beRoot{b2i: root}
+		WithClock(fakeClock())(&be.options)
+		WithRetryPolicy(RetryPolicy{
+			MaxAttempts:   e.attempts,
+			MaxRetryAfter: e.maxAfter,
+			OnRetry: func(_ int, _ error, d time.Duration) {
+				delays = append(delays, d)
+			},
+		})(&be.options)
+		OnRetry(func(method string, _ int, _ error, _ time.Duration) {
+			methods = append(methods, method)
+		})(&be.options)
+		client := &Client{backend: be}
+		if e.large {
+			bucket, err := client.NewBucket(ctx, bucketName, &BucketAttrs{Type: Private})
+			if err != nil {
+				t.Fatal(err)
+			}
+			root.errs.errMap = e.errs
+			w := bucket.Object("large").NewWriter(ctx)
+			w.ChunkSize = 1e4
+			w.ConcurrentUploads = 1
+			_, err = io.Copy(w, io.LimitReader(zReader{}, 2e4))
+			if cerr := w.Close(); err == nil {
+				err = cerr
+			}
+			if (err != nil) != e.wantErr {
+				t.Errorf("%s: got error %v, want error: %v", e.name, err, e.wantErr)
+			}
+		} else {
+			root.errs.errMap = e.errs
+			_, err := client.NewBucket(ctx, bucketName, &BucketAttrs{Type: Private})
+			if (err != nil) != e.wantErr {
+				t.Errorf("%s: got error %v, want error: %v", e.name, err, e.wantErr)
+			}
+		}
+		var calls uint32
+		if v, ok := root.errs.opMap.Load(e.op); ok {
+			calls = atomic.LoadUint32(v.(*uint32))
+		}
+		if int(calls) != e.calls {
+			t.Errorf("%s: %d calls to %s, want %d", e.name, calls, e.op, e.calls)
+		}
+		if root.auths != e.auths {
+			t.Errorf("%s: authorized %d times, want %d", e.name, root.auths, e.auths)
+		}
+		if e.methods != nil && !reflect.DeepEqual(methods, e.methods) {
+			t.Errorf("%s: OnRetry got methods %v, want %v", e.name, methods, e.methods)
+		}
+		if len(delays) != len(e.delays) {
+			t.Errorf("%s: got delays %v, want %v", e.name, delays, e.delays)
+			continue
+		}
+		for i, d := range delays {
+			if e.delays[i] != 0 && d != e.delays[i] {
+				t.Errorf("%s: delay %d: got %v, want %v", e.name, i, d, e.delays[i])
+			}
+		}
 	}
+}
+
+func TestBackoff(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	fc := fakeClock()
 
 	table := []struct {
 		root *testRoot
@@ -517,7 +1262,8 @@ func TestBackoff(t *testing.T) {
 	for _, ent := range table {
 		client := &Client{
 			backend: &beRoot{
-				b2i: ent.root,
+				b2i:     ent.root,
+				options: clientOptions{clock: fc},
 			},
 		}
 		b, err := client.NewBucket(ctx, "fun", &BucketAttrs{Type: Private})
@@ -534,7 +1280,7 @@ func TestBackoff(t *testing.T) {
 		}
 		total += ent.want
 	}
-	if len(calls) != total {
+	if calls := fc.Waits(); len(calls) != total {
 		t.Errorf("got %d calls, wanted %d", len(calls), total)
 	}
 }
@@ -544,16 +1290,7 @@ func TestBackoffWithoutRetryAfter(t *testing.T) {
 	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
 	defer cancel()
 
-	var calls []time.Duration
-	var cmux = &sync.Mutex{}
-	ch := make(chan time.Time)
-	close(ch)
-	after = func(d time.Duration) <-chan time.Time {
-		cmux.Lock()
-		defer cmux.Unlock()
-		calls = append(calls, d)
-		return ch
-	}
+	fc := fakeClock()
 
 	root := &testRoot{
 		bucketMap: make(map[string]map[string]string),
@@ -568,18 +1305,290 @@ func TestBackoffWithoutRetryAfter(t *testing.T) {
 	}
 	client := &Client{
 		backend: &beRoot{
-			b2i: root,
+			b2i:     root,
+			options: clientOptions{clock: fc},
 		},
 	}
 	if _, err := client.NewBucket(ctx, "fun", &BucketAttrs{Type: Private}); err != nil {
 		t.Errorf("bucket should not err, got %v", err)
 	}
-	if len(calls) != 2 {
+	if calls := fc.Waits(); len(calls) != 2 {
 		t.Errorf("wrong number of backoff calls; got %d, want 2", len(calls))
 	}
 }
 
-type badTransport struct{}
+func TestRetryPolicy(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	failing := func(err error) map[int]error {
+		m := make(map[int]error)
+		for i := 0; i < 20; i++ {
+			m[i] = err
+		}
+		return m
+	}
+	table := []struct {
+		name     string
+		op       string // whose calls are counted
+		errs     map[int]error
+		attempts int
+		calls    int
+		delays   []time.Duration // before any jitter
+		wantErr  bool
+	}{
+		{
+			name:     "api call",
+			op:       "createBucket",
+			errs:     failing(testError{retry: true}),
+			attempts: 3,
+			calls:    3,
+			delays:   []time.Duration{time.Millisecond, 2 * time.Millisecond},
+			wantErr:  true,
+		},
+		{
+			name:   "api call recovers",
+			op:     "createBucket",
+			errs:   map[int]error{0: testError{retry: true}, 1: testError{retry: true}, 2: testError{retry: true}},
+			calls:  4,
+			delays: []time.Duration{time.Millisecond, 2 * time.Millisecond, 3 * time.Millisecond},
+		},
+		{
+			// Each new upload URL is retried in the backend as well.
+			name:     "part upload",
+			op:       "uploadPart",
+			errs:     failing(testError{reupload: true}),
+			attempts: 2,
+			calls:    4,
+			delays:   []time.Duration{time.Millisecond, time.Millisecond, time.Millisecond},
+			wantErr:  true,
+		},
+		{
+			name:     "download",
+			op:       "readBody",
+			errs:     failing(io.ErrUnexpectedEOF),
+			attempts: 2,
+			calls:    2,
+			delays:   []time.Duration{time.Millisecond},
+			wantErr:  true,
+		},
+	}
+	for _, e := range table {
+		root := &testRoot{
+			bucketMap: make(map[string]map[string]string),
+			errs:      &errCont{},
+		}
+		var mu sync.Mutex
+		var delays []time.Duration
+		var attempts []int
+		be := &beRoot{b2i: root}
+		WithRetryPolicy(RetryPolicy{
+			MaxAttempts:    e.attempts,
+			InitialBackoff: time.Millisecond,
+			MaxBackoff:     3 * time.Millisecond,
+			OnRetry: func(attempt int, err error, delay time.Duration) {
+				mu.Lock()
+				defer mu.Unlock()
+				attempts = append(attempts, attempt)
+				delays = append(delays, delay)
+			},
+		})(&be.options)
+		client := &Client{backend: be}
+
+		var bucket *Bucket
+		var obj *Object
+		if e.op != "createBucket" {
+			var err error
+			if bucket, err = client.NewBucket(ctx, bucketName, &BucketAttrs{Type: Private}); err != nil {
+				t.Fatal(err)
+			}
+			// A failing download of one byte never makes headway.
+			if obj, _, err = writeFile(ctx, bucket, "obj", 1, 1e5); err != nil {
+				t.Fatal(err)
+			}
+		}
+		root.errs.errMap = map[string]map[int]error{e.op: e.errs}
+		var err error
+		switch e.op {
+		case "createBucket":
+			_, err = client.NewBucket(ctx, bucketName, &BucketAttrs{Type: Private})
+		case "uploadPart":
+			w := bucket.Object("large").NewWriter(ctx)
+			w.ChunkSize = 1e4
+			w.ConcurrentUploads = 1
+			_, err = io.Copy(w, io.LimitReader(zReader{}, 3e4))
+			if cerr := w.Close(); err == nil {
+				err = cerr
+			}
+		case "readBody":
+			r := obj.NewReader(ctx)
+			_, err = io.Copy(ioutil.Discard, r)
+			r.Close()
+		}
+		if (err != nil) != e.wantErr {
+			t.Errorf("%s: got error %v, want error: %v", e.name, err, e.wantErr)
+		}
+		var calls uint32
+		if v, ok := root.errs.opMap.Load(e.op); ok {
+			calls = atomic.LoadUint32(v.(*uint32))
+		}
+		if int(calls) != e.calls {
+			t.Errorf("%s: %d calls, want %d", e.name, calls, e.calls)
+		}
+		if len(delays) != len(e.delays) {
+			t.Errorf("%s: got delays %v, want %v", e.name, delays, e.delays)
+			continue
+		}
+		for i, d := range delays {
+			if d < e.delays[i] || d > e.delays[i]*21/20 {
+				t.Errorf("%s: delay %d: got %v, want about %v", e.name, i, d, e.delays[i])
+			}
+		}
+		if attempts[0] != 1 {
+			t.Errorf("%s: first retry after attempt %d, want 1", e.name, attempts[0])
+		}
+	}
+}
+
+func TestRetryFor(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	root := &testRoot{
+		bucketMap: make(map[string]map[string]string),
+		errs:      &errCont{},
+	}
+	var mu sync.Mutex
+	var retries int
+	be := &beRoot{b2i: root}
+	WithRetryPolicy(RetryPolicy{
+		InitialBackoff: time.Millisecond,
+		MaxBackoff:     time.Millisecond,
+		OnRetry: func(int, error, time.Duration) {
+			mu.Lock()
+			defer mu.Unlock()
+			retries++
+		},
+	})(&be.options)
+	RetryFor(OpOther, RetryPolicy{MaxAttempts: 2})(&be.options)
+	client := &Client{backend: be}
+
+	failing := make(map[int]error)
+	for i := 0; i < 20; i++ {
+		failing[i] = testError{retry: true}
+	}
+	root.errs.errMap = map[string]map[int]error{
+		"createBucket": failing,
+		"getUploadURL": {0: testError{retry: true}, 1: testError{retry: true}, 2: testError{retry: true}},
+	}
+	if _, err := client.NewBucket(ctx, bucketName, &BucketAttrs{Type: Private}); err == nil {
+		t.Error("NewBucket: got no error after two attempts")
+	}
+	if v, ok := root.errs.opMap.Load("createBucket"); !ok || atomic.LoadUint32(v.(*uint32)) != 2 {
+		t.Errorf("createBucket wasn't attempted twice")
+	}
+	if retries != 1 {
+		t.Errorf("createBucket: OnRetry called %d times, want 1", retries)
+	}
+
+	// Uploads keep the client's policy.
+	retries = 0
+	root.errs.errMap = map[string]map[int]error{"getUploadURL": root.errs.errMap["getUploadURL"]}
+	bucket, err := client.NewBucket(ctx, bucketName, &BucketAttrs{Type: Private})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := writeFile(ctx, bucket, "small", 1e3, 1e5); err != nil {
+		t.Fatal(err)
+	}
+	if retries != 3 {
+		t.Errorf("getUploadURL: OnRetry called %d times, want 3", retries)
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	failing := make(map[int]error)
+	for i := 0; i < 20; i++ {
+		failing[i] = testError{retry: true}
+	}
+	root := &testRoot{
+		bucketMap: make(map[string]map[string]string),
+		errs:      &errCont{errMap: map[string]map[int]error{"createBucket": failing}},
+	}
+	be := &beRoot{b2i: root}
+	WithRetryPolicy(RetryPolicy{InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond})(&be.options)
+	RetryBudget(2)(&be.options)
+	client := &Client{backend: be}
+
+	if st := client.Status().RetryBudget; st == nil || st.PerMinute != 2 || st.Available != 2 {
+		t.Errorf("before: got status %+v, want 2 of 2 available", st)
+	}
+	_, err := client.NewBucket(ctx, bucketName, &BucketAttrs{Type: Private})
+	var berr *RetryBudgetError
+	if !errors.As(err, &berr) {
+		t.Fatalf("got error %v, want a *RetryBudgetError", err)
+	}
+	var terr testError
+	if !errors.As(err, &terr) || !terr.retry {
+		t.Errorf("RetryBudgetError hides the error %v", err)
+	}
+	if v, _ := root.errs.opMap.Load("createBucket"); atomic.LoadUint32(v.(*uint32)) != 3 {
+		t.Errorf("createBucket called %d times, want 3", atomic.LoadUint32(v.(*uint32)))
+	}
+	st := client.Status().RetryBudget
+	if st.Available != 0 || st.Refused != 1 {
+		t.Errorf("after: got status %+v, want none available and one refused", st)
+	}
+
+	// Without a budget, there's no status.
+	if st := (&Client{backend: &beRoot{b2i: root}}).Status().RetryBudget; st != nil {
+		t.Errorf("got status %+v without a budget", st)
+	}
+}
+
+func TestOpClass(t *testing.T) {
+	table := map[string]OpClass{
+		"b2_authorize_account":           OpAuthorize,
+		"b2_create_bucket":               OpOther,
+		"b2_update_bucket":               OpOther,
+		"b2_delete_bucket":               OpOther,
+		"b2_list_buckets":                OpList,
+		"b2_create_key":                  OpOther,
+		"b2_delete_key":                  OpOther,
+		"b2_list_keys":                   OpList,
+		"b2_list_file_names":             OpList,
+		"b2_list_file_versions":          OpList,
+		"b2_list_unfinished_large_files": OpList,
+		"b2_list_parts":                  OpList,
+		"b2_get_upload_url":              OpUpload,
+		"b2_upload_file":                 OpUpload,
+		"b2_start_large_file":            OpUpload,
+		"b2_get_upload_part_url":         OpUpload,
+		"b2_upload_part":                 OpUpload,
+		"b2_finish_large_file":           OpUpload,
+		"b2_cancel_large_file":           OpUpload,
+		"b2_download_file_by_name":       OpDownload,
+		"b2_copy_file":                   OpCopy,
+		"b2_copy_part":                   OpCopy,
+		"b2_get_file_info":               OpOther,
+		"b2_hide_file":                   OpOther,
+		"b2_delete_file_version":         OpOther,
+		"b2_get_download_authorization":  OpOther,
+	}
+	for method, want := range table {
+		if got := opClass(method); got != want {
+			t.Errorf("opClass(%q): got %v, want %v", method, got, want)
+		}
+	}
+}
+
+type badTransport struct{}
 
 func (badTransport) RoundTrip(r *http.Request) (*http.Response, error) {
 	return &http.Response{
@@ -602,36 +1611,90 @@ func TestCustomTransport(t *testing.T) {
 	}
 }
 
-func TestReaderDoubleClose(t *testing.T) {
-	ctx := context.Background()
+// outageTransport authorizes accounts, and replies to every other API call
+// with 503 Service Unavailable.
+type outageTransport struct {
+	mu    sync.Mutex
+	calls int // other than authorizations
+}
 
-	client := &Client{
-		backend: &beRoot{
-			b2i: &testRoot{
-				bucketMap: make(map[string]map[string]string),
-				errs:      &errCont{},
-			},
-		},
+func (ot *outageTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Request:    req,
 	}
-	bucket, err := client.NewBucket(ctx, "bucket", &BucketAttrs{Type: Private})
-	if err != nil {
-		t.Fatal(err)
+	if req.Header.Get("X-Blazer-Method") == "b2_authorize_account" {
+		resp.Body = ioutil.NopCloser(strings.NewReader(`{"accountId": "acct", "authorizationToken": "tok", "apiUrl": "https://api.example.com", "downloadUrl": "https://f000.example.com"}`))
+		return resp, nil
 	}
-	o, _, err := writeFile(ctx, bucket, "file", 10, 10)
+	ot.mu.Lock()
+	ot.calls++
+	ot.mu.Unlock()
+	resp.StatusCode = http.StatusServiceUnavailable
+	resp.Body = ioutil.NopCloser(strings.NewReader(`{"status": 503, "code": "service_unavailable", "message": "down"}`))
+	return resp, nil
+}
+
+func TestBreakCircuit(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	ot := &outageTransport{}
+	client, err := NewClient(ctx, "id", "key", Transport(ot), BreakCircuit(3, time.Hour, 1),
+		WithRetryPolicy(RetryPolicy{InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}))
 	if err != nil {
 		t.Fatal(err)
 	}
-	r := o.NewReader(ctx)
-	// Read to EOF, and then read some more.
-	if _, err := io.Copy(ioutil.Discard, r); err != nil {
-		t.Fatal(err)
+	if _, err := client.ListBuckets(ctx); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("ListBuckets: got %v, want %v", err, ErrCircuitOpen)
 	}
-	if _, err := io.Copy(ioutil.Discard, r); err != nil {
-		t.Fatal(err)
+	if ot.calls != 3 {
+		t.Errorf("ListBuckets: %d calls made, want 3", ot.calls)
+	}
+	if _, err := client.ListBuckets(ctx); !errors.Is(err, ErrCircuitOpen) || ot.calls != 3 {
+		t.Errorf("ListBuckets again: got %v after %d calls, want %v after 3", err, ot.calls, ErrCircuitOpen)
 	}
 }
 
-func TestReadWrite(t *testing.T) {
+func TestErrorCodes(t *testing.T) {
+	table := []struct {
+		code string
+		is   func(error) bool
+	}{
+		{code: "duplicate_bucket_name", is: IsBucketExists},
+		{code: "unauthorized", is: IsAccessDenied},
+		{code: "access_denied", is: IsAccessDenied},
+		{code: "cap_exceeded", is: IsCapExceeded},
+		{code: "storage_cap_exceeded", is: IsCapExceeded},
+		{code: "transaction_cap_exceeded", is: IsCapExceeded},
+		{code: "download_cap_exceeded", is: IsCapExceeded},
+		{code: "bad_request", is: IsBadRequest},
+	}
+	helpers := []func(error) bool{IsBucketExists, IsAccessDenied, IsCapExceeded, IsBadRequest}
+	for _, e := range table {
+		err := fmt.Errorf("wrapped: %w", &Error{Code: e.code, err: errors.New(e.code)})
+		var matched int
+		for _, is := range helpers {
+			if is(err) {
+				matched++
+			}
+		}
+		if !e.is(err) || matched != 1 {
+			t.Errorf("%s: matched by %d helpers, want only one", e.code, matched)
+		}
+	}
+	for _, err := range []error{nil, errors.New("duplicate_bucket_name"), &Error{Code: "expired_auth_token", err: errors.New("expired")}} {
+		for i, is := range helpers {
+			if is(err) {
+				t.Errorf("helper %d matched %v", i, err)
+			}
+		}
+	}
+}
+
+func TestInterrupted(t *testing.T) {
 	ctx := context.Background()
 	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
 	defer cancel()
@@ -640,101 +1703,229 @@ func TestReadWrite(t *testing.T) {
 		backend: &beRoot{
 			b2i: &testRoot{
 				bucketMap: make(map[string]map[string]string),
-				errs:      &errCont{},
+				errs: &errCont{errMap: map[string]map[int]error{
+					"createBucket": {0: testError{retry: true}},
+					"uploadPart":   {0: testError{reupload: true}},
+				}},
 			},
 		},
 	}
+	WithRetryPolicy(RetryPolicy{InitialBackoff: time.Hour, MaxBackoff: time.Hour})(&client.backend.(*beRoot).options)
 
-	bucket, err := client.NewBucket(ctx, bucketName, &BucketAttrs{Type: Private})
-	if err != nil {
-		t.Fatal(err)
+	// Done while waiting to make an API call again.
+	cctx, ccancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer ccancel()
+	_, err := client.NewBucket(cctx, bucketName, nil)
+	if !errors.Is(err, context.DeadlineExceeded) || !strings.HasPrefix(err.Error(), "b2_create_bucket: ") {
+		t.Errorf("NewBucket: got %v, want %v from b2_create_bucket", err, context.DeadlineExceeded)
 	}
-	defer func() {
-		if err := bucket.Delete(ctx); err != nil {
-			t.Error(err)
-		}
-	}()
 
-	sobj, wsha, err := writeFile(ctx, bucket, smallFileName, 1e6+42, 1e8)
+	// Done while waiting to upload a part again.
+	bucket, err := client.NewBucket(ctx, bucketName, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
+	wctx, wcancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer wcancel()
+	w := bucket.Object("obj").NewWriter(wctx)
+	w.ChunkSize = 1e4
+	if _, err := io.Copy(w, io.LimitReader(zReader{}, 1e4+1)); err != nil {
+		t.Fatal(err)
+	}
+	<-wctx.Done()
+	time.Sleep(10 * time.Millisecond) // for part 1 to give up
+	err = w.Close()
+	if !errors.Is(err, context.DeadlineExceeded) || !strings.HasPrefix(err.Error(), "b2: writing obj part 1: ") {
+		t.Errorf("Close: got %v, want %v from part 1", err, context.DeadlineExceeded)
+	}
+}
 
-	defer func() {
-		if err := sobj.Delete(ctx); err != nil {
-			t.Error(err)
-		}
-	}()
+// refusingTransport authorizes any key and finds no buckets.  It fails the
+// first busy calls of method with 503 Service Unavailable, and refuses the
+// rest with status and body.
+type refusingTransport struct {
+	method string
+	busy   int
+	status int
+	body   string
 
-	if err := readFile(ctx, sobj, wsha, 1e5, 10); err != nil {
-		t.Error(err)
-	}
+	mu    sync.Mutex
+	calls int
+}
 
-	lobj, wshaL, err := writeFile(ctx, bucket, largeFileName, 1e6-1e5, 1e4)
-	if err != nil {
-		t.Fatal(err)
+func (rt *refusingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Request:    req,
 	}
-	defer func() {
-		if err := lobj.Delete(ctx); err != nil {
-			t.Error(err)
-		}
-	}()
-
-	if err := readFile(ctx, lobj, wshaL, 1e5, 10); err != nil {
-		t.Error(err)
+	if req.Header.Get("X-Blazer-Method") == "b2_authorize_account" {
+		resp.Body = ioutil.NopCloser(strings.NewReader(`{"accountId": "acct", "authorizationToken": "tok", "apiUrl": "https://api.example.com", "downloadUrl": "https://f000.example.com"}`))
+		return resp, nil
+	}
+	if req.Header.Get("X-Blazer-Method") != rt.method {
+		resp.Body = ioutil.NopCloser(strings.NewReader(`{"buckets": []}`))
+		return resp, nil
 	}
+	rt.mu.Lock()
+	rt.calls++
+	busy := rt.calls <= rt.busy
+	rt.mu.Unlock()
+	if busy {
+		resp.StatusCode = http.StatusServiceUnavailable
+		resp.Body = ioutil.NopCloser(strings.NewReader(`{"status": 503, "code": "service_unavailable", "message": "busy"}`))
+		return resp, nil
+	}
+	resp.StatusCode = rt.status
+	resp.Body = ioutil.NopCloser(strings.NewReader(rt.body))
+	return resp, nil
 }
 
-func TestLargeFileCancellation(t *testing.T) {
+// headerTransport records the value of a header in each request.
+type headerTransport struct {
+	http.RoundTripper
+	key string
+
+	mu   sync.Mutex
+	seen []string
+}
+
+func (ht *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ht.mu.Lock()
+	ht.seen = append(ht.seen, req.Header.Get(ht.key))
+	ht.mu.Unlock()
+	return ht.RoundTripper.RoundTrip(req)
+}
+
+func TestRequestHooks(t *testing.T) {
 	ctx := context.Background()
-	ctx, cancel := context.WithCancel(ctx)
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
 	defer cancel()
 
-	client := &Client{
-		backend: &beRoot{
-			b2i: &testRoot{
-				bucketMap: make(map[string]map[string]string),
-				errs:      &errCont{},
-			},
+	rt := &headerTransport{
+		RoundTripper: &refusingTransport{
+			method: "b2_create_bucket",
+			busy:   2,
+			status: http.StatusOK,
+			body:   `{"bucketId": "id", "bucketName": "bucket", "bucketType": "allPrivate"}`,
 		},
+		key: "X-Tenant",
 	}
-
-	b, err := client.NewBucket(ctx, bucketName, nil)
+	var mu sync.Mutex
+	var reqs []RequestInfo
+	var resps []ResponseInfo
+	client, err := NewClient(ctx, "id", "key", Transport(rt),
+		WithRetryPolicy(RetryPolicy{InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}),
+		OnRequest(func(info RequestInfo) {
+			mu.Lock()
+			defer mu.Unlock()
+			if _, ok := info.Header["Authorization"]; ok {
+				t.Errorf("%s: OnRequest was given the Authorization header", info.Method)
+			}
+			info.Header.Set("X-Tenant", "tenant")
+			reqs = append(reqs, info)
+		}),
+		OnResponse(func(info ResponseInfo) {
+			mu.Lock()
+			defer mu.Unlock()
+			resps = append(resps, info)
+		}),
+	)
 	if err != nil {
 		t.Fatal(err)
 	}
-	var called bool
-	w := b.Object("foo").NewWriter(ctx, WithCancelOnError(func() context.Context { return context.Background() }, func(err error) {
-		called = true
-		if err != nil {
-			t.Errorf("expected no error, got %v", err)
-		}
-	}))
-	w.ChunkSize = 10
+	if _, err := client.NewBucket(ctx, "bucket", &BucketAttrs{Type: Private}); err != nil {
+		t.Fatal(err)
+	}
 
-	for i := 0; i < 10; i++ {
-		r := io.LimitReader(zReader{}, 20)
-		if _, err := io.Copy(w, r); err != nil && err != context.Canceled {
-			t.Errorf("Copy: %v", err)
+	type call struct {
+		method  string
+		attempt int
+		status  int
+	}
+	want := []call{
+		{"b2_authorize_account", 1, 200},
+		{"b2_list_buckets", 1, 200},
+		{"b2_create_bucket", 1, 503},
+		{"b2_create_bucket", 2, 503},
+		{"b2_create_bucket", 3, 200},
+	}
+	var gotReqs, gotResps []call
+	for _, info := range reqs {
+		gotReqs = append(gotReqs, call{info.Method, info.Attempt, 200})
+		if info.Host != "api.example.com" && info.Method != "b2_authorize_account" {
+			t.Errorf("%s: Host: got %q, want api.example.com", info.Method, info.Host)
 		}
-		cancel()
 	}
-
-	if err := w.Close(); err != context.Canceled {
-		t.Errorf("expected cancelled context; got %v", err)
+	for _, info := range resps {
+		gotResps = append(gotResps, call{info.Method, info.Attempt, info.Status})
+		if info.Err != nil || info.Duration < 0 {
+			t.Errorf("%s: got Err %v and Duration %v", info.Method, info.Err, info.Duration)
+		}
 	}
-
-	if !called {
-		t.Errorf("error callback not called")
+	var wantReqs []call
+	for _, c := range want {
+		wantReqs = append(wantReqs, call{c.method, c.attempt, 200})
+	}
+	if !reflect.DeepEqual(gotReqs, wantReqs) {
+		t.Errorf("OnRequest: got %v, want %v", gotReqs, wantReqs)
+	}
+	if !reflect.DeepEqual(gotResps, want) {
+		t.Errorf("OnResponse: got %v, want %v", gotResps, want)
+	}
+	for i, v := range rt.seen {
+		if v != "tenant" {
+			t.Errorf("request %d: X-Tenant: got %q, want %q", i, v, "tenant")
+		}
 	}
 }
 
-func TestReadRangeReturnsRight(t *testing.T) {
+func TestMetrics(t *testing.T) {
 	ctx := context.Background()
 	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
 	defer cancel()
 
-	client := &Client{
+	rt := &refusingTransport{
+		method: "b2_create_bucket",
+		busy:   2,
+		status: http.StatusOK,
+		body:   `{"bucketId": "id", "bucketName": "bucket", "bucketType": "allPrivate"}`,
+	}
+	m := NewMetrics()
+	client, err := NewClient(ctx, "id", "key", Transport(rt), WithMetrics(m),
+		WithRetryPolicy(RetryPolicy{InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.NewBucket(ctx, "bucket", &BucketAttrs{Type: Private}); err != nil {
+		t.Fatal(err)
+	}
+	snap := m.Snapshot()
+	for k, want := range map[string]int64{
+		`b2_requests_total{method="b2_authorize_account",status="2xx"}`:            1,
+		`b2_requests_total{method="b2_create_bucket",status="5xx"}`:                2,
+		`b2_requests_total{method="b2_create_bucket",status="2xx"}`:                1,
+		`b2_retries_total{method="b2_create_bucket",reason="service_unavailable"}`: 2,
+		`b2_requests_in_flight{method="b2_create_bucket"}`:                         0,
+	} {
+		if got := snap.Counters[k]; got != want {
+			t.Errorf("%s: got %d, want %d", k, got, want)
+		}
+	}
+	if o := snap.Observations[`b2_request_duration_seconds{method="b2_create_bucket"}`]; o.Count != 3 {
+		t.Errorf("b2_create_bucket durations: got %d, want 3", o.Count)
+	}
+	var fromJSON MetricsSnapshot
+	if err := json.Unmarshal([]byte(m.String()), &fromJSON); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(fromJSON, snap) {
+		t.Errorf("String: got %v, want %v", fromJSON, snap)
+	}
+
+	// Writers and readers are in flight until they are closed.
+	m = NewMetrics()
+	fake := &Client{
 		backend: &beRoot{
 			b2i: &testRoot{
 				bucketMap: make(map[string]map[string]string),
@@ -742,177 +1933,6440 @@ func TestReadRangeReturnsRight(t *testing.T) {
 			},
 		},
 	}
-
-	bucket, err := client.NewBucket(ctx, bucketName, &BucketAttrs{Type: Private})
+	WithMetrics(m)(&fake.opts)
+	bucket, err := fake.NewBucket(ctx, bucketName, &BucketAttrs{Type: Private})
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer func() {
-		if err := bucket.Delete(ctx); err != nil {
-			t.Error(err)
-		}
-	}()
-
-	obj, _, err := writeFile(ctx, bucket, "file", 1e6+42, 1e8)
-	if err != nil {
+	const writing, reading = `b2_operations_in_flight{op="write"}`, `b2_operations_in_flight{op="read"}`
+	w := bucket.Object("file").NewWriter(ctx)
+	if got := m.Snapshot().Counters[writing]; got != 1 {
+		t.Errorf("writing: got %d writers in flight, want 1", got)
+	}
+	if _, err := io.Copy(w, io.LimitReader(zReader{}, 10)); err != nil {
 		t.Fatal(err)
 	}
-	r := obj.NewRangeReader(ctx, 200, 1400)
-	r.ChunkSize = 1000
-
-	i, err := io.Copy(ioutil.Discard, r)
-	if err != nil {
-		t.Error(err)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
 	}
-	if i != 1400 {
-		t.Errorf("NewRangeReader(_, 200, 1400): want 1400, got %d", i)
+	w.Close()
+	r := bucket.Object("file").NewReader(ctx)
+	if got := m.Snapshot().Counters[reading]; got != 1 {
+		t.Errorf("reading: got %d readers in flight, want 1", got)
+	}
+	if _, err := io.Copy(ioutil.Discard, r); err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+	r.Close()
+	if s := m.Snapshot(); s.Counters[writing] != 0 || s.Counters[reading] != 0 {
+		t.Errorf("after closing: got %d writers and %d readers in flight, want none", s.Counters[writing], s.Counters[reading])
 	}
 }
 
-func TestWriterReturnsError(t *testing.T) {
+func TestError(t *testing.T) {
 	ctx := context.Background()
 	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
 	defer cancel()
 
-	client := &Client{
-		backend: &beRoot{
-			b2i: &testRoot{
-				bucketMap: make(map[string]map[string]string),
-				errs: &errCont{
-					errMap: map[string]map[int]error{
-						"uploadPart": {
-							0: testError{},
-							1: testError{},
-							2: testError{},
-							3: testError{},
-							4: testError{},
-							5: testError{},
-							6: testError{},
-						},
+	rt := &refusingTransport{
+		method: "b2_create_bucket",
+		busy:   2,
+		status: http.StatusBadRequest,
+		body:   `{"status": 400, "code": "duplicate_bucket_name", "message": "Bucket name is already in use."}`,
+	}
+	client, err := NewClient(ctx, "id", "key", Transport(rt), WithRetryPolicy(RetryPolicy{
+		InitialBackoff: time.Millisecond,
+		MaxBackoff:     time.Millisecond,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.NewBucket(ctx, "taken", nil)
+	var e *Error
+	if !errors.As(err, &e) {
+		t.Fatalf("NewBucket: got %v, want an *Error", err)
+	}
+	want := Error{
+		Status:  400,
+		Code:    "duplicate_bucket_name",
+		Message: "Bucket name is already in use.",
+		Method:  "b2_create_bucket",
+		Retried: 2,
+		Host:    "api.example.com",
+	}
+	got := *e
+	got.err = nil
+	if got.RequestID == "" {
+		t.Error("NewBucket: no request ID")
+	}
+	got.RequestID = ""
+	if got != want {
+		t.Errorf("NewBucket: got %+v, want %+v", got, want)
+	}
+	if w := e.Unwrap().Error() + ", after 3 attempts"; e.Error() != w {
+		t.Errorf("Error() = %q, want %q", e.Error(), w)
+	}
+}
+
+// expiringTransport is a B2 with no buckets which, like the real one when
+// asked with ExpireSomeAuthTokens, expires authorization tokens now and then:
+// here, once they are older than life.
+type expiringTransport struct {
+	life time.Duration
+
+	mu      sync.Mutex
+	token   string // the valid token, if any
+	issued  time.Time
+	auths   int
+	expired int
+}
+
+func (et *expiringTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Request:    req,
+	}
+	if req.Header.Get("X-Blazer-Method") == "b2_authorize_account" {
+		// Give everyone else time to find the token expired.
+		time.Sleep(10 * time.Millisecond)
+		et.mu.Lock()
+		et.auths++
+		et.token = fmt.Sprintf("tok%d", et.auths)
+		et.issued = time.Now()
+		body := fmt.Sprintf(`{"accountId": "acct", "authorizationToken": %q, "apiUrl": "https://api.example.com", "downloadUrl": "https://f000.example.com"}`, et.token)
+		et.mu.Unlock()
+		resp.Body = ioutil.NopCloser(strings.NewReader(body))
+		return resp, nil
+	}
+	et.mu.Lock()
+	if req.Header.Get("X-Bz-Test-Mode") == "expire_some_account_authorization_tokens" && et.token != "" && time.Since(et.issued) > et.life {
+		et.token = ""
+		et.expired++
+	}
+	valid := et.token != "" && req.Header.Get("Authorization") == et.token
+	et.mu.Unlock()
+	if !valid {
+		resp.StatusCode = http.StatusUnauthorized
+		resp.Body = ioutil.NopCloser(strings.NewReader(`{"status": 401, "code": "expired_auth_token", "message": "expired"}`))
+		return resp, nil
+	}
+	resp.Body = ioutil.NopCloser(strings.NewReader(`{"buckets": []}`))
+	return resp, nil
+}
+
+func TestSession(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	et := &expiringTransport{life: time.Hour}
+	client, err := NewClient(ctx, "id", "key", Transport(et))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := client.Session()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resumed, err := NewClientFromSession(ctx, data, Transport(et))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := resumed.ListBuckets(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if et.auths != 1 {
+		t.Errorf("authorized %d times, want 1", et.auths)
+	}
+	if got, want := resumed.TokenExpiresAt(), client.TokenExpiresAt(); !got.Equal(want) {
+		t.Errorf("resumed session expires at %v, want %v", got, want)
+	}
+	info, err := resumed.AccountInfo(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.AccountID != "acct" {
+		t.Errorf("resumed session's account is %q, want %q", info.AccountID, "acct")
+	}
+
+	// Once the token is refused, only a client with credentials can carry on.
+	et.mu.Lock()
+	et.token = ""
+	et.mu.Unlock()
+	if _, err := resumed.ListBuckets(ctx); !errors.Is(err, ErrNoCredentials) {
+		t.Errorf("ListBuckets without credentials: got %v, want %v", err, ErrNoCredentials)
+	}
+	withCreds, err := NewClientFromSession(ctx, data, Transport(et), WithCredentials(StaticCredentials("id", "key")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := withCreds.ListBuckets(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if et.auths != 2 {
+		t.Errorf("authorized %d times, want 2", et.auths)
+	}
+
+	if _, err := NewClientFromSession(ctx, []byte("{"), Transport(et)); err == nil {
+		t.Error("NewClientFromSession: resumed a bad session")
+	}
+}
+
+func TestConcurrentReauth(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	et := &expiringTransport{life: 50 * time.Millisecond}
+	client, err := NewClient(ctx, "id", "key", Transport(et), ExpireSomeAuthTokens())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var failed int
+	end := time.Now().Add(300 * time.Millisecond)
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for time.Now().Before(end) {
+				if _, err := client.ListBuckets(ctx); err != nil {
+					mu.Lock()
+					failed++
+					mu.Unlock()
+				}
+				time.Sleep(time.Millisecond)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if et.expired == 0 {
+		t.Fatal("no tokens expired")
+	}
+	// One authorization to begin with, and one for each expired token.
+	if et.auths != et.expired+1 {
+		t.Errorf("authorized %d times for %d expired tokens, want %d", et.auths, et.expired, et.expired+1)
+	}
+	if failed > 0 {
+		t.Errorf("%d calls failed", failed)
+	}
+}
+
+// testLogger records the messages at levels up to max.
+type testLogger struct {
+	max  int
+	mu   sync.Mutex
+	msgs []string
+}
+
+func (l *testLogger) Enabled(level int) bool { return level <= l.max }
+
+func (l *testLogger) Log(level int, msg string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.msgs = append(l.msgs, fmt.Sprintf("%d: %s", level, msg))
+}
+
+func TestLogger(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	for _, max := range []int{0, 1} {
+		l := &testLogger{max: max}
+		client := &Client{
+			backend: &beRoot{
+				b2i: &testRoot{
+					bucketMap: make(map[string]map[string]string),
+					errs: &errCont{
+						errMap: map[string]map[int]error{"uploadPart": {0: testError{}}},
 					},
 				},
 			},
+		}
+		WithLogger(l)(&client.opts)
+		bucket, err := client.NewBucket(ctx, bucketName, &BucketAttrs{Type: Private})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := writeFile(ctx, bucket, "file", 3e4, 1e4); err == nil {
+			t.Fatal("writeFile: got no error")
+		}
+		var logged bool
+		for _, msg := range l.msgs {
+			if strings.HasPrefix(msg, "1: error writing file: ") {
+				logged = true
+			}
+		}
+		if logged != (max >= 1) {
+			t.Errorf("logging up to level %d: got %q", max, l.msgs)
+		}
+	}
+}
+
+// testTracer records the spans it starts.
+type testTracer struct {
+	mu    sync.Mutex
+	spans []*testSpan
+}
+
+type testSpan struct {
+	tr     *testTracer
+	name   string
+	parent *testSpan
+	attrs  map[string]interface{}
+	ended  bool
+	err    error
+}
+
+type testSpanKey struct{}
+
+func (tr *testTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	parent, _ := ctx.Value(testSpanKey{}).(*testSpan)
+	s := &testSpan{tr: tr, name: name, parent: parent, attrs: make(map[string]interface{})}
+	tr.mu.Lock()
+	tr.spans = append(tr.spans, s)
+	tr.mu.Unlock()
+	return context.WithValue(ctx, testSpanKey{}, s), s
+}
+
+func (s *testSpan) SetAttribute(key string, value interface{}) {
+	s.tr.mu.Lock()
+	defer s.tr.mu.Unlock()
+	s.attrs[key] = value
+}
+
+func (s *testSpan) End(err error) {
+	s.tr.mu.Lock()
+	defer s.tr.mu.Unlock()
+	s.ended, s.err = true, err
+}
+
+func TestTracer(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	tr := &testTracer{}
+	be := &beRoot{
+		b2i: &testRoot{
+			bucketMap: make(map[string]map[string]string),
+			errs:      &errCont{},
+		},
+	}
+	WithTracer(tr)(&be.options)
+	client := &Client{backend: be}
+	WithTracer(tr)(&client.opts)
+	bucket, err := client.NewBucket(ctx, bucketName, &BucketAttrs{Type: Private})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := writeFile(ctx, bucket, "file", 3e4, 1e4); err != nil {
+		t.Fatal(err)
+	}
+	r := bucket.Object("file").NewReader(ctx)
+	if _, err := io.Copy(ioutil.Discard, r); err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+	iter := bucket.List(ctx)
+	for iter.Next() {
+	}
+	if err := iter.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	byName := make(map[string][]*testSpan)
+	for _, s := range tr.spans {
+		if !s.ended || s.err != nil {
+			t.Errorf("%s: ended %v with %v, want ended without error", s.name, s.ended, s.err)
+		}
+		byName[s.name] = append(byName[s.name], s)
+	}
+	for _, name := range []string{"b2.Writer", "b2.Reader"} {
+		if len(byName[name]) != 1 {
+			t.Fatalf("got %d %s spans, want 1", len(byName[name]), name)
+		}
+		s := byName[name][0]
+		if s.attrs["bucket"] != bucketName || s.attrs["object"] != "file" || s.attrs["bytes"] != int64(3e4) {
+			t.Errorf("%s: got attributes %v", name, s.attrs)
+		}
+	}
+	if len(byName["b2_upload_part"]) != 3 {
+		t.Errorf("got %d b2_upload_part spans, want 3", len(byName["b2_upload_part"]))
+	}
+	for _, s := range byName["b2_upload_part"] {
+		if s.parent != byName["b2.Writer"][0] || s.attrs["method"] != "b2_upload_part" || s.attrs["retries"] != 0 {
+			t.Errorf("b2_upload_part: got parent %v and attributes %v, want a child of the writer", s.parent, s.attrs)
+		}
+	}
+	for _, s := range byName["b2_download_file_by_name"] {
+		if s.parent != byName["b2.Reader"][0] {
+			t.Errorf("b2_download_file_by_name: got parent %v, want the reader", s.parent)
+		}
+	}
+	if len(byName["b2.ListPage"]) != 1 || byName["b2.ListPage"][0].attrs["objects"] != 1 {
+		t.Errorf("got list pages %v, want one with one object", byName["b2.ListPage"])
+	}
+	if len(byName["b2_list_file_names"]) != 1 || byName["b2_list_file_names"][0].parent != byName["b2.ListPage"][0] {
+		t.Errorf("got b2_list_file_names spans %v, want one in the list page", byName["b2_list_file_names"])
+	}
+}
+
+func TestCredentials(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	root := &testRoot{
+		bucketMap: make(map[string]map[string]string),
+		errs:      &errCont{},
+	}
+	be := &beRoot{b2i: root}
+	client := &Client{backend: be}
+	if err := be.authorizeAccount(ctx, "id", "static", be.options); err != nil {
+		t.Fatal(err)
+	}
+	if root.key != "static" {
+		t.Errorf("authorized with %q, want %q", root.key, "static")
+	}
+
+	// A key that is rotated is picked up when B2 refuses the old one.
+	var mu sync.Mutex
+	key := "old"
+	errBroken := errors.New("vault is sealed")
+	var broken bool
+	p := CredentialsFunc(func(context.Context) (string, string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if broken {
+			return "", "", errBroken
+		}
+		return "id", key, nil
+	})
+	WithCredentials(p)(&be.options)
+	if err := be.authorizeAccount(ctx, "", "", be.options); err != nil {
+		t.Fatal(err)
+	}
+	if root.key != "old" {
+		t.Errorf("authorized with %q, want %q", root.key, "old")
+	}
+	mu.Lock()
+	key = "new"
+	mu.Unlock()
+	root.errs.errMap = map[string]map[int]error{
+		"createBucket": {0: testError{reauth: true}, 2: testError{reauth: true}},
+	}
+	if _, err := client.NewBucket(ctx, "bucket", nil); err != nil {
+		t.Fatal(err)
+	}
+	if root.key != "new" {
+		t.Errorf("authorized with %q, want %q", root.key, "new")
+	}
+
+	// The provider's failures aren't B2's.
+	mu.Lock()
+	broken = true
+	mu.Unlock()
+	_, err := client.NewBucket(ctx, "other", nil)
+	var ce *CredentialsError
+	if !errors.As(err, &ce) || !errors.Is(err, errBroken) {
+		t.Errorf("NewBucket: got %v, want a *CredentialsError for %v", err, errBroken)
+	}
+	if root.key != "new" {
+		t.Errorf("authorized with %q, want %q", root.key, "new")
+	}
+}
+
+func TestExpiringAuthorization(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	// Every authorization is in its last minute.
+	defer func(d time.Duration) { tokenLifetime = d }(tokenLifetime)
+	tokenLifetime = 30 * time.Second
+
+	table := []struct {
+		name    string
+		expires time.Duration // from now, of the key
+		auths   int
+	}{
+		{
+			name:  "renewed",
+			auths: 4,
+		},
+		{
+			name:    "outlived by the key",
+			expires: time.Hour,
+			auths:   4,
+		},
+		{
+			name:    "expires with the key",
+			expires: 10 * time.Second,
+			auths:   1,
+		},
+	}
+	for _, e := range table {
+		root := &testRoot{
+			bucketMap: make(map[string]map[string]string),
+			errs:      &errCont{},
+		}
+		if e.expires != 0 {
+			root.expires = time.Now().Add(e.expires)
+		}
+		be := &beRoot{b2i: root}
+		client := &Client{backend: be}
+		if !client.TokenExpiresAt().IsZero() {
+			t.Errorf("%s: unauthorized client expires at %v", e.name, client.TokenExpiresAt())
+		}
+		start := time.Now()
+		if err := be.authorizeAccount(ctx, "id", "key", be.options); err != nil {
+			t.Fatal(err)
+		}
+		want := start.Add(tokenLifetime)
+		if !root.expires.IsZero() && root.expires.Before(want) {
+			want = root.expires
+		}
+		if got := client.TokenExpiresAt(); got.Before(want) || got.After(want.Add(time.Second)) {
+			t.Errorf("%s: TokenExpiresAt() = %v, want %v", e.name, got, want)
+		}
+		for i := 0; i < 3; i++ {
+			if _, err := client.ListBuckets(ctx); err != nil {
+				t.Fatalf("%s: %v", e.name, err)
+			}
+		}
+		if root.auths != e.auths {
+			t.Errorf("%s: authorized %d times, want %d", e.name, root.auths, e.auths)
+		}
+	}
+}
+
+// cutTransport is a B2 with one object, whose downloads cut can cut short.
+type cutTransport struct {
+	data []byte
+
+	// cut is given the number of earlier downloads and the length of a
+	// response, and returns how much of it to send, and whether to admit to
+	// sending less in the response's headers.
+	cut func(call, n int) (send int, admit bool)
+
+	mu    sync.Mutex
+	calls int
+}
+
+func (ct *cutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Request:    req,
+	}
+	switch req.Header.Get("X-Blazer-Method") {
+	case "b2_authorize_account":
+		resp.Body = ioutil.NopCloser(strings.NewReader(`{"accountId": "acct", "authorizationToken": "tok", "apiUrl": "https://api.example.com", "downloadUrl": "https://f000.example.com",
+			"allowed": {"bucketId": "bid", "bucketName": "bucket", "capabilities": ["readFiles"]}}`))
+		return resp, nil
+	case "b2_download_file_by_name":
+	default:
+		return nil, fmt.Errorf("unexpected request %s", req.URL)
+	}
+	start, end := 0, len(ct.data)-1
+	if rng := req.Header.Get("Range"); rng != "" {
+		if _, err := fmt.Sscanf(rng, "bytes=%d-%d", &start, &end); err != nil {
+			return nil, err
+		}
+	}
+	if end >= len(ct.data) {
+		end = len(ct.data) - 1
+	}
+	if start >= len(ct.data) {
+		resp.StatusCode = http.StatusRequestedRangeNotSatisfiable
+		resp.Body = ioutil.NopCloser(strings.NewReader(`{"status": 416, "code": "range_not_satisfiable", "message": "out of range"}`))
+		return resp, nil
+	}
+	ct.mu.Lock()
+	call := ct.calls
+	ct.calls++
+	ct.mu.Unlock()
+	n := end - start + 1
+	send, admit := n, false
+	if ct.cut != nil {
+		send, admit = ct.cut(call, n)
+	}
+	if admit {
+		end = start + send - 1
+		n = send
+	}
+	resp.StatusCode = http.StatusPartialContent
+	resp.Header = http.Header{
+		"Content-Length":        []string{fmt.Sprint(n)},
+		"Content-Range":         []string{fmt.Sprintf("bytes %d-%d/%d", start, end, len(ct.data))},
+		"X-Bz-File-Id":          []string{"id"},
+		"X-Bz-Content-Sha1":     []string{fmt.Sprintf("%x", sha1.Sum(ct.data))},
+		"X-Bz-File-Name":        []string{"cut"},
+		"X-Bz-Upload-Timestamp": []string{"0"},
+	}
+	// Like a connection that closes early, the body simply ends.
+	resp.Body = ioutil.NopCloser(bytes.NewReader(ct.data[start : start+send]))
+	return resp, nil
+}
+
+func TestTruncatedDownloads(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	data := make([]byte, 25007)
+	rand.New(rand.NewSource(4)).Read(data)
+	half := func(calls ...int) func(int, int) (int, bool) {
+		return func(call, n int) (int, bool) {
+			for _, c := range calls {
+				if c == call {
+					return n / 2, false
+				}
+			}
+			return n, false
+		}
+	}
+	table := []struct {
+		name    string
+		cut     func(call, n int) (int, bool)
+		wantErr bool
+	}{
+		{name: "whole"},
+		{name: "cut once", cut: half(0, 3)},
+		{name: "cut to nothing", cut: func(call, n int) (int, bool) {
+			if call%2 == 0 {
+				return 0, false
+			}
+			return n, false
+		}},
+		{name: "admitted", cut: func(call, n int) (int, bool) {
+			if call == 1 {
+				return n - 100, true
+			}
+			return n, false
+		}},
+		{name: "always cut", cut: func(_, n int) (int, bool) { return n / 2, false }, wantErr: true},
+	}
+	for _, e := range table {
+		for _, at := range []bool{false, true} {
+			ct := &cutTransport{data: data, cut: e.cut}
+			client, err := NewClient(ctx, "id", "key", Transport(ct))
+			if err != nil {
+				t.Fatal(err)
+			}
+			bucket, err := client.Bucket(ctx, "bucket")
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := bucket.Object("cut").NewReader(ctx)
+			r.ChunkSize = 4000
+			r.ConcurrentDownloads = 3
+			var got []byte
+			if at {
+				got = make([]byte, len(data)+1)
+				var n int
+				n, err = r.ReadAt(got, 0)
+				got = got[:n]
+				if err == io.EOF {
+					err = nil
+				}
+			} else {
+				got, err = ioutil.ReadAll(r)
+			}
+			r.Close()
+			name := fmt.Sprintf("%s, ReadAt %v", e.name, at)
+			if e.wantErr {
+				if !errors.Is(err, io.ErrUnexpectedEOF) {
+					t.Errorf("%s: got %v, want io.ErrUnexpectedEOF", name, err)
+				} else if !strings.Contains(err.Error(), " bytes") {
+					t.Errorf("%s: error %q doesn't say how many bytes arrived", name, err)
+				}
+				continue
+			}
+			if err != nil {
+				t.Errorf("%s: %v", name, err)
+				continue
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("%s: got %d bytes, want the %d written", name, len(got), len(data))
+			}
+		}
+	}
+}
+
+func TestReaderDoubleClose(t *testing.T) {
+	ctx := context.Background()
+
+	client := &Client{
+		backend: &beRoot{
+			b2i: &testRoot{
+				bucketMap: make(map[string]map[string]string),
+				errs:      &errCont{},
+			},
+		},
+	}
+	bucket, err := client.NewBucket(ctx, "bucket", &BucketAttrs{Type: Private})
+	if err != nil {
+		t.Fatal(err)
+	}
+	o, _, err := writeFile(ctx, bucket, "file", 10, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := o.NewReader(ctx)
+	// Read to EOF, and then read some more.
+	if _, err := io.Copy(ioutil.Discard, r); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.Copy(ioutil.Discard, r); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadWrite(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	client := &Client{
+		backend: &beRoot{
+			b2i: &testRoot{
+				bucketMap: make(map[string]map[string]string),
+				errs:      &errCont{},
+			},
+		},
+	}
+
+	bucket, err := client.NewBucket(ctx, bucketName, &BucketAttrs{Type: Private})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := bucket.Delete(ctx); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	sobj, wsha, err := writeFile(ctx, bucket, smallFileName, 1e6+42, 1e8)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		if err := sobj.Delete(ctx); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	if err := readFile(ctx, sobj, wsha, 1e5, 10); err != nil {
+		t.Error(err)
+	}
+
+	lobj, wshaL, err := writeFile(ctx, bucket, largeFileName, 1e6-1e5, 1e4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := lobj.Delete(ctx); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	if err := readFile(ctx, lobj, wshaL, 1e5, 10); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLargeFileCancellation(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	client := &Client{
+		backend: &beRoot{
+			b2i: &testRoot{
+				bucketMap: make(map[string]map[string]string),
+				errs:      &errCont{},
+			},
+		},
+	}
+
+	b, err := client.NewBucket(ctx, bucketName, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var called bool
+	w := b.Object("foo").NewWriter(ctx, WithCancelOnError(func() context.Context { return context.Background() }, func(err error) {
+		called = true
+		if err != nil {
+			t.Errorf("expected no error, got %v", err)
+		}
+	}))
+	w.ChunkSize = 10
+
+	for i := 0; i < 10; i++ {
+		r := io.LimitReader(zReader{}, 20)
+		if _, err := io.Copy(w, r); err != nil && err != context.Canceled {
+			t.Errorf("Copy: %v", err)
+		}
+		cancel()
+	}
+
+	if err := w.Close(); err != context.Canceled {
+		t.Errorf("expected cancelled context; got %v", err)
+	}
+
+	if !called {
+		t.Errorf("error callback not called")
+	}
+}
+
+func TestReadRangeReturnsRight(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	client := &Client{
+		backend: &beRoot{
+			b2i: &testRoot{
+				bucketMap: make(map[string]map[string]string),
+				errs:      &errCont{},
+			},
+		},
+	}
+
+	bucket, err := client.NewBucket(ctx, bucketName, &BucketAttrs{Type: Private})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := bucket.Delete(ctx); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	obj, _, err := writeFile(ctx, bucket, "file", 1e6+42, 1e8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := obj.NewRangeReader(ctx, 200, 1400)
+	r.ChunkSize = 1000
+
+	i, err := io.Copy(ioutil.Discard, r)
+	if err != nil {
+		t.Error(err)
+	}
+	if i != 1400 {
+		t.Errorf("NewRangeReader(_, 200, 1400): want 1400, got %d", i)
+	}
+}
+
+func TestReaderSeek(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	root := &testRoot{
+		bucketMap: make(map[string]map[string]string),
+		errs:      &errCont{},
+	}
+	client := &Client{backend: &beRoot{b2i: root}}
+	bucket, err := client.NewBucket(ctx, bucketName, &BucketAttrs{Type: Private})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 10007)
+	rand.New(rand.NewSource(1)).Read(data)
+	obj := bucket.Object("seek")
+	w := obj.NewWriter(ctx)
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	table := []struct {
+		name           string
+		offset, length int64
+	}{
+		{name: "whole", length: -1},
+		{name: "range", offset: 100, length: 5000},
+		{name: "range past end", offset: 9000, length: 5000},
+	}
+	for _, e := range table {
+		want := data[e.offset:]
+		if e.length >= 0 && int64(len(want)) > e.length {
+			want = want[:e.length]
+		}
+		size := int64(len(want))
+		r := obj.NewRangeReader(ctx, e.offset, e.length)
+		r.ChunkSize = 1000
+		r.ConcurrentDownloads = 3
+
+		steps := []struct {
+			offset int64
+			whence int
+			read   int
+		}{
+			{offset: 300, whence: io.SeekStart, read: 1500},
+			{offset: -500, whence: io.SeekCurrent, read: 100},
+			{offset: -10, whence: io.SeekEnd, read: 100},
+			{offset: 0, whence: io.SeekCurrent, read: 100},
+			{offset: 1e6, whence: io.SeekStart, read: 100},
+			{offset: 0, whence: io.SeekStart, read: int(size) + 1},
+		}
+		var cur int64
+		for _, st := range steps {
+			wantPos := st.offset
+			switch st.whence {
+			case io.SeekCurrent:
+				wantPos += cur
+			case io.SeekEnd:
+				wantPos += size
+			}
+			pos, err := r.Seek(st.offset, st.whence)
+			if err != nil {
+				t.Fatalf("%s: Seek(%d, %d): %v", e.name, st.offset, st.whence, err)
+			}
+			if pos != wantPos {
+				t.Errorf("%s: Seek(%d, %d): got %d, want %d", e.name, st.offset, st.whence, pos, wantPos)
+			}
+			got, err := ioutil.ReadAll(io.LimitReader(r, int64(st.read)))
+			if err != nil {
+				t.Fatalf("%s: read at %d: %v", e.name, pos, err)
+			}
+			var exp []byte
+			if pos < size {
+				exp = want[pos:]
+				if len(exp) > st.read {
+					exp = exp[:st.read]
+				}
+			}
+			if !bytes.Equal(got, exp) {
+				t.Errorf("%s: read at %d: got %d bytes, want %d bytes of the object from there", e.name, pos, len(got), len(exp))
+			}
+			cur = pos + int64(len(got))
+		}
+		if _, err := r.Seek(-1, io.SeekStart); err == nil {
+			t.Errorf("%s: Seek(-1, io.SeekStart): got no error", e.name)
+		}
+		if err := r.Close(); err != nil {
+			t.Error(err)
+		}
+		if _, err := r.Seek(0, io.SeekStart); err == nil {
+			t.Errorf("%s: Seek after Close: got no error", e.name)
+		}
+	}
+}
+
+func TestReaderAt(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	root := &testRoot{
+		bucketMap: make(map[string]map[string]string),
+		errs:      &errCont{},
+	}
+	client := &Client{backend: &beRoot{b2i: root}}
+	bucket, err := client.NewBucket(ctx, bucketName, &BucketAttrs{Type: Private})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 10007)
+	rand.New(rand.NewSource(2)).Read(data)
+	obj := bucket.Object("readat")
+	w := obj.NewWriter(ctx)
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r := obj.NewRangeReader(ctx, 7, 9000)
+	defer r.Close()
+	want := data[7:9007]
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			off := int64(i) * 1000
+			p := make([]byte, 1500)
+			n, err := r.ReadAt(p, off)
+			exp := want[off:]
+			if len(exp) > len(p) {
+				exp = exp[:len(p)]
+			}
+			if len(exp) == len(p) && err != nil {
+				t.Errorf("ReadAt(_, %d): %v", off, err)
+			}
+			if len(exp) < len(p) && err != io.EOF {
+				t.Errorf("ReadAt(_, %d): got %v, want io.EOF", off, err)
+			}
+			if !bytes.Equal(p[:n], exp) {
+				t.Errorf("ReadAt(_, %d): got %d bytes, want %d bytes of the object from there", off, n, len(exp))
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// Reading at offsets doesn't move Read.
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("Read after ReadAt: got %d bytes, want %d", len(got), len(want))
+	}
+	if n, err := r.ReadAt(make([]byte, 10), 9000); n != 0 || err != io.EOF {
+		t.Errorf("ReadAt at the end: got %d, %v, want 0, io.EOF", n, err)
+	}
+	if _, err := r.ReadAt(make([]byte, 10), -1); err == nil {
+		t.Errorf("ReadAt(_, -1): got no error")
+	}
+	sr := io.NewSectionReader(r, 8000, 2000)
+	got, err = ioutil.ReadAll(sr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want[8000:]) {
+		t.Errorf("SectionReader: got %d bytes, want %d", len(got), len(want[8000:]))
+	}
+}
+
+func TestReaderResume(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	reset := &net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}
+	table := []struct {
+		name    string
+		fail    map[int]error // by download
+		wantErr bool
+	}{
+		{name: "unexpected EOF", fail: map[int]error{1: io.ErrUnexpectedEOF, 4: io.ErrUnexpectedEOF}},
+		{name: "connection reset", fail: map[int]error{0: reset, 1: reset, 2: reset, 7: reset}},
+		{name: "other error", fail: map[int]error{2: errors.New("bad")}, wantErr: true},
+	}
+	const size = 10007
+	for _, e := range table {
+		root := &testRoot{
+			bucketMap: make(map[string]map[string]string),
+			errs:      &errCont{},
+		}
+		client := &Client{backend: &beRoot{b2i: root}}
+		bucket, err := client.NewBucket(ctx, bucketName, &BucketAttrs{Type: Private})
+		if err != nil {
+			t.Fatal(err)
+		}
+		obj, sha, err := writeFile(ctx, bucket, "resume", size, 1e8)
+		if err != nil {
+			t.Fatal(err)
+		}
+		root.errs.errMap = map[string]map[int]error{"readBody": e.fail}
+		served := atomic.LoadInt64(&root.meta[bucketName].served)
+
+		r := obj.NewReader(ctx)
+		r.ChunkSize = 1000
+		r.ConcurrentDownloads = 2
+		h := sha1.New()
+		n, err := io.Copy(h, r)
+		r.Close()
+		if e.wantErr {
+			if err == nil {
+				t.Errorf("%s: got no error", e.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", e.name, err)
+			continue
+		}
+		if n != size {
+			t.Errorf("%s: read %d bytes, want %d", e.name, n, size)
+		}
+		if got := fmt.Sprintf("%x", h.Sum(nil)); got != sha {
+			t.Errorf("%s: got SHA1 %s, want %s", e.name, got, sha)
+		}
+		// Each chunk resumes where its connection dropped, rather than starting
+		// again.
+		if got := atomic.LoadInt64(&root.meta[bucketName].served) - served; got != size {
+			t.Errorf("%s: %d bytes were downloaded, want %d", e.name, got, size)
+		}
+	}
+
+	// A connection that keeps failing before any of the body arrives is
+	// eventually given up on.
+	root := &testRoot{
+		bucketMap: make(map[string]map[string]string),
+		errs:      &errCont{},
+	}
+	client := &Client{backend: &beRoot{b2i: root}}
+	bucket, err := client.NewBucket(ctx, bucketName, &BucketAttrs{Type: Private})
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj, _, err := writeFile(ctx, bucket, "resume", 1, 1e8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fail := make(map[int]error)
+	for i := 0; i < 20; i++ {
+		fail[i] = io.ErrUnexpectedEOF
+	}
+	root.errs.errMap = map[string]map[int]error{"readBody": fail}
+	r := obj.NewReader(ctx)
+	if _, err := io.Copy(ioutil.Discard, r); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("persistent failures: got %v, want io.ErrUnexpectedEOF", err)
+	}
+	r.Close()
+	if calls, _ := root.errs.opMap.Load("readBody"); atomic.LoadUint32(calls.(*uint32)) != maxBodyRetries+1 {
+		t.Errorf("persistent failures: %d downloads, want %d", atomic.LoadUint32(calls.(*uint32)), maxBodyRetries+1)
+	}
+}
+
+func TestReaderWriteTo(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	data := make([]byte, 25007)
+	rand.New(rand.NewSource(5)).Read(data)
+	table := []struct {
+		name           string
+		concur         int
+		offset, length int64
+		fail           map[int]error // by download
+		failAt         int           // the destination fails after this many bytes
+		wantErr        bool
+	}{
+		{name: "stream", concur: 1},
+		{name: "chunks", concur: 3},
+		{name: "stream range", concur: 1, offset: 7, length: 20000},
+		{name: "chunks range", concur: 3, offset: 7, length: 20000},
+		{name: "stream past end", concur: 1, offset: 30000, length: -1},
+		{name: "stream resumed", concur: 1, fail: map[int]error{0: io.ErrUnexpectedEOF, 1: io.ErrUnexpectedEOF}},
+		{name: "stream, bad data", concur: 1, fail: map[int]error{0: testError{garbled: true}}, wantErr: true},
+		{name: "chunks, bad data", concur: 3, fail: map[int]error{2: testError{garbled: true}}, wantErr: true},
+		{name: "stream, destination fails", concur: 1, failAt: 12345},
+		{name: "chunks, destination fails", concur: 3, failAt: 12345},
+	}
+	for _, e := range table {
+		root := &testRoot{
+			bucketMap: make(map[string]map[string]string),
+			errs:      &errCont{},
+		}
+		client := &Client{backend: &beRoot{b2i: root}}
+		bucket, err := client.NewBucket(ctx, bucketName, &BucketAttrs{Type: Private})
+		if err != nil {
+			t.Fatal(err)
+		}
+		obj := bucket.Object("writeto")
+		w := obj.NewWriter(ctx)
+		if _, err := w.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		root.errs.errMap = map[string]map[int]error{"readBody": e.fail}
+
+		want := data
+		if e.offset < int64(len(want)) {
+			want = want[e.offset:]
+		} else {
+			want = nil
+		}
+		if e.length > 0 && int64(len(want)) > e.length {
+			want = want[:e.length]
+		}
+		r := obj.NewReader(ctx)
+		if e.offset > 0 || e.length > 0 {
+			r = obj.NewRangeReader(ctx, e.offset, e.length)
+		}
+		r.ChunkSize = 4000
+		r.ConcurrentDownloads = e.concur
+		var last int64
+		r.ProgressFunc = func(read, _ int64) { last = read }
+
+		buf := &bytes.Buffer{}
+		var dst io.Writer = buf
+		if e.failAt > 0 {
+			dst = &failWriter{w: buf, left: e.failAt}
+		}
+		n, err := r.WriteTo(dst)
+		if e.failAt > 0 {
+			if err != errFailWriter || n != int64(e.failAt) {
+				t.Errorf("%s: WriteTo: got %d, %v, want %d, %v", e.name, n, err, e.failAt, errFailWriter)
+			}
+			// The rest can still be read.
+			if _, err := io.Copy(buf, r); err != nil {
+				t.Errorf("%s: reading the rest: %v", e.name, err)
+			}
+		} else if e.wantErr {
+			var cerr *ChecksumMismatchError
+			if !errors.As(err, &cerr) {
+				t.Errorf("%s: got %v, want a *ChecksumMismatchError", e.name, err)
+			}
+			r.Close()
+			continue
+		} else if err != nil {
+			t.Errorf("%s: %v", e.name, err)
+		} else if n != int64(len(want)) {
+			t.Errorf("%s: WriteTo returned %d, want %d", e.name, n, len(want))
+		}
+		r.Close()
+		if !bytes.Equal(buf.Bytes(), want) {
+			t.Errorf("%s: got %d bytes, want %d bytes of the object", e.name, buf.Len(), len(want))
+		}
+		if last != int64(len(want)) {
+			t.Errorf("%s: last progress was %d, want %d", e.name, last, len(want))
+		}
+		if n, err := r.WriteTo(buf); n != 0 || err != nil {
+			t.Errorf("%s: WriteTo at the end: got %d, %v, want 0, nil", e.name, n, err)
+		}
+	}
+}
+
+var errFailWriter = errors.New("destination failed")
+
+// failWriter fails once left bytes have been written to w.
+type failWriter struct {
+	w    io.Writer
+	left int
+}
+
+func (fw *failWriter) Write(p []byte) (int, error) {
+	if len(p) <= fw.left {
+		fw.left -= len(p)
+		return fw.w.Write(p)
+	}
+	n, _ := fw.w.Write(p[:fw.left])
+	fw.left = 0
+	return n, errFailWriter
+}
+
+func TestReaderChecksum(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	data := make([]byte, 25007)
+	rand.New(rand.NewSource(3)).Read(data)
+	sha := fmt.Sprintf("%x", sha1.Sum(data))
+
+	table := []struct {
+		name           string
+		large          bool // uploaded in parts, which B2 has no hash for
+		attrs          *Attrs
+		offset, length int64
+		fail           map[int]error // by download
+		want           *ChecksumMismatchError
+	}{
+		{name: "ok"},
+		{name: "bad chunk", fail: map[int]error{2: testError{garbled: true}}, want: &ChecksumMismatchError{Expected: sha}},
+		{name: "large", large: true},
+		{name: "large, short chunk", large: true, fail: map[int]error{1: testError{lost: true}}, want: &ChecksumMismatchError{ExpectedSize: 25007, ActualSize: 25006}},
+		{name: "large, bad chunk", large: true, fail: map[int]error{1: testError{garbled: true}}},
+		{name: "large with SHA1, bad chunk", large: true, attrs: &Attrs{SHA1: sha}, fail: map[int]error{1: testError{garbled: true}}, want: &ChecksumMismatchError{Expected: sha}},
+		{name: "range", offset: 1, length: 25006, fail: map[int]error{2: testError{garbled: true}}},
+	}
+	for _, e := range table {
+		root := &testRoot{
+			bucketMap: make(map[string]map[string]string),
+			errs:      &errCont{},
+		}
+		client := &Client{backend: &beRoot{b2i: root}}
+		bucket, err := client.NewBucket(ctx, bucketName, &BucketAttrs{Type: Private})
+		if err != nil {
+			t.Fatal(err)
+		}
+		attrs := &Attrs{ContentType: "application/x-test"}
+		if e.attrs != nil {
+			attrs = e.attrs
+			attrs.ContentType = "application/x-test"
+		}
+		obj := bucket.Object("checked")
+		w := obj.NewWriter(ctx, WithAttrsOption(attrs))
+		if e.large {
+			w.ChunkSize = 1e4
+		}
+		if _, err := w.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		root.errs.errMap = map[string]map[int]error{"readBody": e.fail}
+
+		r := obj.NewReader(ctx)
+		if e.length > 0 {
+			r = obj.NewRangeReader(ctx, e.offset, e.length)
+		}
+		r.ChunkSize = 4000
+		r.ConcurrentDownloads = 3
+		_, err = io.Copy(ioutil.Discard, r)
+		r.Close()
+		if e.want == nil {
+			if err != nil {
+				t.Errorf("%s: %v", e.name, err)
+			}
+			continue
+		}
+		var cerr *ChecksumMismatchError
+		if !errors.As(err, &cerr) {
+			t.Errorf("%s: got %v, want a *ChecksumMismatchError", e.name, err)
+			continue
+		}
+		if cerr.Name != "checked" || cerr.Expected != e.want.Expected || (cerr.Actual == "") != (e.want.Expected == "") || cerr.ExpectedSize != e.want.ExpectedSize || cerr.ActualSize != e.want.ActualSize {
+			t.Errorf("%s: got %#v, want %#v", e.name, cerr, e.want)
+		}
+		if _, err := r.Read(make([]byte, 1)); err != cerr {
+			t.Errorf("%s: Read after mismatch: got %v, want the mismatch", e.name, err)
+		}
+	}
+}
+
+func TestReaderAttrs(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	root := &testRoot{
+		bucketMap: make(map[string]map[string]string),
+		errs:      &errCont{},
+	}
+	client := &Client{backend: &beRoot{b2i: root}}
+	bucket, err := client.NewBucket(ctx, bucketName, &BucketAttrs{Type: Private})
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj := bucket.Object("described")
+	w := obj.NewWriter(ctx, WithAttrsOption(&Attrs{
+		ContentType:        "text/plain",
+		Info:               map[string]string{"k": "v"},
+		CacheControl:       "max-age=60",
+		ContentDisposition: "attachment",
+		LastModified:       time.Unix(1500000000, 0),
+	}))
+	if _, err := io.Copy(w, io.LimitReader(zReader{}, 25007)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	want, err := obj.Attrs(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	table := []struct {
+		name       string
+		r          func() *Reader
+		concurrent int
+		copy       bool // with WriteTo
+		stat       bool
+	}{
+		{name: "read", r: func() *Reader { return obj.NewReader(ctx) }},
+		{name: "copy", r: func() *Reader { return obj.NewReader(ctx) }, copy: true},
+		{name: "concurrent", r: func() *Reader { return obj.NewReader(ctx) }, concurrent: 3},
+		{name: "range", r: func() *Reader { return obj.NewRangeReader(ctx, 20000, 100) }, concurrent: 3},
+		{name: "stat", r: func() *Reader { return obj.NewReader(ctx) }, stat: true},
+	}
+	for _, e := range table {
+		r := e.r()
+		r.ConcurrentDownloads = e.concurrent
+		r.ChunkSize = 1000
+		if attrs := r.Attrs(); attrs != nil {
+			t.Errorf("%s: Attrs before reading: got %+v, want nil", e.name, attrs)
+		}
+		if e.stat {
+			served := atomic.LoadInt64(&root.meta[bucketName].served)
+			attrs, err := r.Stat(ctx)
+			if err != nil {
+				t.Errorf("%s: Stat: %v", e.name, err)
+			} else if !reflect.DeepEqual(attrs, want) {
+				t.Errorf("%s: Stat: got %+v, want %+v", e.name, attrs, want)
+			}
+			if n := atomic.LoadInt64(&root.meta[bucketName].served) - served; n != 0 {
+				t.Errorf("%s: Stat downloaded %d bytes", e.name, n)
+			}
+		} else if e.copy {
+			if _, err := io.Copy(ioutil.Discard, r); err != nil {
+				t.Errorf("%s: Copy: %v", e.name, err)
+			}
+		} else if _, err := r.Read(make([]byte, 10)); err != nil {
+			t.Errorf("%s: Read: %v", e.name, err)
+		}
+		if attrs := r.Attrs(); !reflect.DeepEqual(attrs, want) {
+			t.Errorf("%s: Attrs: got %+v, want %+v", e.name, attrs, want)
+		}
+		r.Close()
+	}
+}
+
+func TestReaderDownloadAuthorization(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	root := &testRoot{
+		bucketMap: make(map[string]map[string]string),
+		errs:      &errCont{},
+	}
+	client := &Client{backend: &beRoot{b2i: root}}
+	bucket, err := client.NewBucket(ctx, bucketName, &BucketAttrs{Type: Private})
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj := bucket.Object("shared/report.pdf")
+	w := obj.NewWriter(ctx)
+	if _, err := io.WriteString(w, "report"); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	cd := `attachment; filename="report.pdf"`
+	token, _, err := bucket.DownloadAuthorization(ctx, "shared/", time.Hour, ResponseContentDisposition(cd))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	table := []struct {
+		name string
+		opts []ReaderOption
+		ok   bool
+	}{
+		{name: "client's authorization", opts: []ReaderOption{WithContentDisposition(cd)}, ok: true},
+		{name: "matching token", opts: []ReaderOption{WithDownloadAuthorization(token), WithContentDisposition(cd)}, ok: true},
+		{name: "matching token, as options", opts: []ReaderOption{WithDownloadAuthorization(token), WithResponseHeaders(ResponseContentDisposition(cd))}, ok: true},
+		{name: "token without its overrides", opts: []ReaderOption{WithDownloadAuthorization(token)}},
+		{name: "token with other overrides", opts: []ReaderOption{WithDownloadAuthorization(token), WithContentDisposition("inline")}},
+		{name: "unknown token", opts: []ReaderOption{WithDownloadAuthorization("bogus"), WithContentDisposition(cd)}},
+	}
+	for _, e := range table {
+		for _, concurrent := range []int{1, 2} {
+			r := obj.NewReader(ctx, e.opts...)
+			r.ConcurrentDownloads = concurrent
+			got := &bytes.Buffer{}
+			_, err := io.Copy(got, r)
+			r.Close()
+			if e.ok && (err != nil || got.String() != "report") {
+				t.Errorf("%s, %d concurrent: got %q, %v; want the object", e.name, concurrent, got, err)
+			}
+			if !e.ok && err == nil {
+				t.Errorf("%s, %d concurrent: got no error", e.name, concurrent)
+			}
+		}
+	}
+}
+
+func TestReaderIfChanged(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	root := &testRoot{
+		bucketMap: make(map[string]map[string]string),
+		errs:      &errCont{},
+	}
+	client := &Client{backend: &beRoot{b2i: root}}
+	bucket, err := client.NewBucket(ctx, bucketName, &BucketAttrs{Type: Private})
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj := bucket.Object("cached")
+	w := obj.NewWriter(ctx, WithAttrsOption(&Attrs{ContentType: "text/plain"}))
+	if _, err := io.WriteString(w, "fresh content"); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	attrs, err := obj.Attrs(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := fmt.Sprintf("%x", sha1.Sum([]byte("stale content")))
+	before, after := attrs.UploadTimestamp.Add(-time.Second), attrs.UploadTimestamp.Add(time.Second)
+
+	table := []struct {
+		name      string
+		r         func() *Reader
+		unchanged bool
+	}{
+		{name: "same hash", r: func() *Reader { return obj.NewReaderIfChanged(ctx, attrs.SHA1) }, unchanged: true},
+		{name: "other hash", r: func() *Reader { return obj.NewReaderIfChanged(ctx, other) }},
+		{name: "not since", r: func() *Reader { return obj.NewReader(ctx, IfModifiedSince(after)) }, unchanged: true},
+		{name: "since", r: func() *Reader { return obj.NewReader(ctx, IfModifiedSince(before)) }},
+		{name: "other hash, not since", r: func() *Reader { return obj.NewReader(ctx, IfNoneMatch(other), IfModifiedSince(after)) }},
+		{name: "no hash, not since", r: func() *Reader { return obj.NewReader(ctx, IfNoneMatch("none"), IfModifiedSince(after)) }, unchanged: true},
+	}
+	for _, e := range table {
+		for _, concurrent := range []int{1, 2} {
+			served := atomic.LoadInt64(&root.meta[bucketName].served)
+			r := e.r()
+			r.ConcurrentDownloads = concurrent
+			got := &bytes.Buffer{}
+			_, err := io.Copy(got, r)
+			r.Close()
+			name := fmt.Sprintf("%s, %d concurrent", e.name, concurrent)
+			if !e.unchanged {
+				if err != nil || got.String() != "fresh content" {
+					t.Errorf("%s: got %q, %v; want the content", name, got, err)
+				}
+				continue
+			}
+			var nm *NotModifiedError
+			if !errors.As(err, &nm) {
+				t.Errorf("%s: got %v, want a *NotModifiedError", name, err)
+				continue
+			}
+			if nm.Name != "cached" || nm.SHA1 != attrs.SHA1 || !nm.UploadTimestamp.Equal(attrs.UploadTimestamp) {
+				t.Errorf("%s: got %+v", name, nm)
+			}
+			if n := atomic.LoadInt64(&root.meta[bucketName].served) - served; n != 0 {
+				t.Errorf("%s: downloaded %d bytes, want none", name, n)
+			}
+		}
+	}
+
+	r := bucket.Object("missing").NewReaderIfChanged(ctx, other)
+	if _, err := r.Read(make([]byte, 10)); !IsNotExist(err) {
+		t.Errorf("missing object: got %v, want not found", err)
+	}
+	r.Close()
+}
+
+func TestReaderDecompression(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	data := make([]byte, 25007)
+	rand.New(rand.NewSource(4)).Read(data)
+	for i := range data {
+		data[i] %= 16 // compressible, but not too much
+	}
+	buf := &bytes.Buffer{}
+	zw := gzip.NewWriter(buf)
+	zw.Write(data)
+	zw.Close()
+	gz := buf.Bytes()
+
+	root := &testRoot{
+		bucketMap: make(map[string]map[string]string),
+		errs:      &errCont{},
+	}
+	client := &Client{backend: &beRoot{b2i: root}}
+	bucket, err := client.NewBucket(ctx, bucketName, &BucketAttrs{Type: Private})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, attrs := range map[string]*Attrs{
+		"gzipped": {ContentType: "application/x-test", ContentEncoding: "gzip"},
+		"plain":   {ContentType: "application/x-test"},
+	} {
+		w := bucket.Object(name).NewWriter(ctx, WithAttrsOption(attrs))
+		if _, err := w.Write(gz); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if attrs, err := bucket.Object("gzipped").Attrs(ctx); err != nil {
+		t.Fatal(err)
+	} else if attrs.ContentEncoding != "gzip" {
+		t.Errorf("Attrs: got ContentEncoding %q, want gzip", attrs.ContentEncoding)
+	}
+
+	table := []struct {
+		name   string
+		object string
+		opts   []ReaderOption
+		copy   bool          // with io.Copy, and so WriteTo
+		fail   map[int]error // by download
+		want   []byte
+		check  bool // want a *ChecksumMismatchError
+		bad    bool // want some other error
+	}{
+		{name: "raw", object: "gzipped", want: gz},
+		{name: "read", object: "gzipped", opts: []ReaderOption{TransparentDecompression()}, want: data},
+		{name: "copy", object: "gzipped", opts: []ReaderOption{TransparentDecompression()}, copy: true, want: data},
+		{name: "not gzipped", object: "plain", opts: []ReaderOption{TransparentDecompression()}, want: gz},
+		{name: "not gzipped, bad chunk", object: "plain", opts: []ReaderOption{TransparentDecompression()}, fail: map[int]error{2: testError{garbled: true}}, check: true},
+		{name: "bad chunk", object: "gzipped", opts: []ReaderOption{TransparentDecompression()}, fail: map[int]error{1: testError{garbled: true}}, bad: true},
+		{name: "retried chunk", object: "gzipped", opts: []ReaderOption{TransparentDecompression()}, fail: map[int]error{1: io.ErrUnexpectedEOF}, want: data},
+	}
+	for _, e := range table {
+		root.errs.errMap = map[string]map[int]error{"readBody": e.fail}
+		root.errs.opMap = sync.Map{}
+		r := bucket.Object(e.object).NewReader(ctx, e.opts...)
+		r.ChunkSize = 1000
+		r.ConcurrentDownloads = 3
+		got := &bytes.Buffer{}
+		if e.copy {
+			_, err = io.Copy(got, r)
+		} else {
+			_, err = io.Copy(got, struct{ io.Reader }{r})
+		}
+		r.Close()
+		var cerr *ChecksumMismatchError
+		switch {
+		case e.check:
+			if !errors.As(err, &cerr) {
+				t.Errorf("%s: got %v, want a *ChecksumMismatchError", e.name, err)
+			}
+		case e.bad:
+			if err == nil || errors.As(err, &cerr) {
+				t.Errorf("%s: got %v, want a decompression error", e.name, err)
+			}
+		case err != nil:
+			t.Errorf("%s: %v", e.name, err)
+		case !bytes.Equal(got.Bytes(), e.want):
+			t.Errorf("%s: got %d bytes, want %d", e.name, got.Len(), len(e.want))
+		}
+	}
+
+	r := bucket.Object("gzipped").NewRangeReader(ctx, 10, 100, TransparentDecompression())
+	if _, err := r.Read(make([]byte, 10)); err == nil {
+		t.Error("NewRangeReader with TransparentDecompression: got no error")
+	}
+	r.Close()
+	r = bucket.Object("gzipped").NewReader(ctx, TransparentDecompression())
+	if _, err := r.Seek(10, io.SeekStart); err == nil {
+		t.Error("Seek with TransparentDecompression: got no error")
+	}
+	if _, err := r.ReadAt(make([]byte, 10), 10); err == nil {
+		t.Error("ReadAt with TransparentDecompression: got no error")
+	}
+	r.Close()
+}
+
+func TestWriterReturnsError(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	client := &Client{
+		backend: &beRoot{
+			b2i: &testRoot{
+				bucketMap: make(map[string]map[string]string),
+				errs: &errCont{
+					errMap: map[string]map[int]error{
+						"uploadPart": {
+							0: testError{},
+							1: testError{},
+							2: testError{},
+							3: testError{},
+							4: testError{},
+							5: testError{},
+							6: testError{},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	bucket, err := client.NewBucket(ctx, bucketName, &BucketAttrs{Type: Private})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := bucket.Object("test").NewWriter(ctx)
+	r := io.LimitReader(zReader{}, 1e7)
+	w.ChunkSize = 1e4
+	w.ConcurrentUploads = 4
+	if _, err := io.Copy(w, r); err == nil {
+		t.Fatalf("io.Copy: should have returned an error")
+	}
+}
+
+func TestFileBuffer(t *testing.T) {
+	r := io.LimitReader(zReader{}, 1e8)
+	w, err := newFileBuffer("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if _, err := io.Copy(w, r); err != nil {
+		t.Fatal(err)
+	}
+	bReader, err := w.Reader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hsh := sha1.New()
+	if _, err := io.Copy(hsh, bReader); err != nil {
+		t.Fatal(err)
+	}
+	hshText := fmt.Sprintf("%x", hsh.Sum(nil))
+	if hshText != w.Hash() {
+		t.Errorf("hashes are not equal: bufferWriter is %q, read buffer is %q", w.Hash(), hshText)
+	}
+}
+
+func TestNonBuffer(t *testing.T) {
+	table := []struct {
+		str  string
+		off  int64
+		len  int64
+		want string
+	}{
+		{
+			str:  "a string",
+			off:  0,
+			len:  3,
+			want: "a s",
+		},
+		{
+			str:  "a string",
+			off:  3,
+			len:  1,
+			want: "t",
+		},
+		{
+			str:  "a string",
+			off:  3,
+			len:  5,
+			want: "tring",
+		},
+	}
+
+	for _, e := range table {
+		nb := newNonBuffer(strings.NewReader(e.str), e.off, e.len)
+		want := fmt.Sprintf("%s%x", e.want, sha1.Sum([]byte(e.str[int(e.off):int(e.off+e.len)])))
+		r, err := nb.Reader()
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		got, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Errorf("ioutil.ReadAll(%#v): %v", e, err)
+			continue
+		}
+		if want != string(got) {
+			t.Errorf("ioutil.ReadAll(%#v): got %q, want %q", e, string(got), want)
+		}
+	}
+}
+
+type memWriterAt struct {
+	mu  sync.Mutex
+	buf []byte
+}
+
+func (m *memWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if end := int(off) + len(p); end > len(m.buf) {
+		m.buf = append(m.buf, make([]byte, end-len(m.buf))...)
+	}
+	return copy(m.buf[off:], p), nil
+}
+
+func (m *memWriterAt) ReadAt(p []byte, off int64) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if int(off) >= len(m.buf) {
+		return 0, io.EOF
+	}
+	n := copy(p, m.buf[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// staleBucket lists objects from a snapshot, simulating a listing that has
+// not caught up with recent changes.
+type staleBucket struct {
+	b2BucketInterface
+	stale *testBucket
+}
+
+func (s *staleBucket) listFileNames(ctx context.Context, count int, cont, pfx, del string, emit func(b2FileInterface)) ([]b2FileInterface, string, error) {
+	return s.stale.listFileNames(ctx, count, cont, pfx, del, emit)
+}
+
+func (s *staleBucket) listFileVersions(ctx context.Context, count int, a, b, c, d string, emit func(b2FileInterface)) ([]b2FileInterface, string, string, error) {
+	return s.stale.listFileVersions(ctx, count, a, b, c, d, emit)
+}
+
+func TestLocalConsistency(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	for _, enabled := range []bool{false, true} {
+		root := &testRoot{
+			bucketMap: make(map[string]map[string]string),
+			errs:      &errCont{},
+		}
+		client := &Client{
+			backend: &beRoot{b2i: root},
+		}
+		if enabled {
+			client.opts.consistencyTTL = time.Minute
+		}
+		bucket, err := client.NewBucket(ctx, bucketName, &BucketAttrs{Type: Private})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range []string{"a", "b", "c"} {
+			if _, _, err := writeFile(ctx, bucket, name, 10, 1e8); err != nil {
+				t.Fatal(err)
+			}
+		}
+		snap := make(map[string]string)
+		for k, v := range root.bucketMap[bucketName] {
+			snap[k] = v
+		}
+		bucket.b = &beBucket{
+			b2bucket: &staleBucket{
+				b2BucketInterface: bucket.b.(*beBucket).b2bucket,
+				stale:             &testBucket{n: bucketName, errs: root.errs, files: snap},
+			},
+			ri: client.backend,
+		}
+
+		if err := bucket.Object("a").Delete(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if err := bucket.Object("b").Hide(ctx); err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range []string{"0", "c", "d"} {
+			if _, _, err := writeFile(ctx, bucket, name, 20, 1e8); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		list := func() (string, error) {
+			var got []string
+			iter := bucket.List(ctx, ListPageSize(2))
+			for iter.Next() {
+				obj := iter.Object()
+				got = append(got, fmt.Sprintf("%s:%d", obj.Name(), obj.f.size()))
+			}
+			return strings.Join(got, ","), iter.Err()
+		}
+		got, err := list()
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := "a:10,b:10,c:10"
+		if enabled {
+			want = "0:20,c:20,d:20"
+		}
+		if got != want {
+			t.Errorf("enabled %v: List: got %s, want %s", enabled, got, want)
+		}
+
+		for _, name := range []string{"a", "b"} {
+			_, err := bucket.Object(name).Attrs(ctx)
+			if enabled && !IsNotExist(err) {
+				t.Errorf("enabled %v: Attrs(%q): got %v, want not exist", enabled, name, err)
+			}
+		}
+
+		if !enabled {
+			continue
+		}
+		// Once the entries expire, the listing is again whatever B2 reports.
+		cc := client.consistency()
+		cc.now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+		got, err = list()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := "a:10,b:10,c:10"; got != want {
+			t.Errorf("after expiry: List: got %s, want %s", got, want)
+		}
+	}
+}
+
+func TestLocalConsistencyServer(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	for _, enabled := range []bool{false, true} {
+		srv := b2test.NewServer()
+		defer srv.Close()
+		id, key := srv.Credentials()
+		clock := fakeClock()
+		opts := []ClientOption{APIBase(srv.URL), WithClock(clock)}
+		if enabled {
+			opts = append(opts, LocalConsistency(time.Minute))
+		}
+		client, err := NewClient(ctx, id, key, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bucket, err := client.NewBucket(ctx, bucketName, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range []string{"a", "b", "c"} {
+			if _, _, err := writeFile(ctx, bucket, name, 10, 1e8); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// B2's listings lag behind what follows.
+		srv.FreezeListings()
+		if err := bucket.Object("a").Delete(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if err := bucket.Object("b").Hide(ctx); err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range []string{"0", "c", "d"} {
+			if _, _, err := writeFile(ctx, bucket, name, 20, 1e8); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		list := func() (string, error) {
+			var got []string
+			iter := bucket.List(ctx, ListPageSize(2))
+			for iter.Next() {
+				obj := iter.Object()
+				got = append(got, fmt.Sprintf("%s:%d", obj.Name(), obj.f.size()))
+			}
+			return strings.Join(got, ","), iter.Err()
+		}
+		got, err := list()
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := "a:10,b:10,c:10"
+		if enabled {
+			want = "0:20,c:20,d:20"
+		}
+		if got != want {
+			t.Errorf("enabled %v: List: got %s, want %s", enabled, got, want)
+		}
+
+		if !enabled {
+			continue
+		}
+		// Once the entries expire, the listing is again whatever B2 reports,
+		// until B2 catches up.
+		clock.Advance(2 * time.Minute)
+		got, err = list()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := "a:10,b:10,c:10"; got != want {
+			t.Errorf("after expiry: List: got %s, want %s", got, want)
+		}
+		srv.ThawListings()
+		got, err = list()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := "0:20,c:20,d:20"; got != want {
+			t.Errorf("after B2 caught up: List: got %s, want %s", got, want)
+		}
+	}
+}
+
+func TestAccountInfo(t *testing.T) {
+	client := &Client{
+		backend: &beRoot{
+			b2i: &testRoot{
+				bucketMap: make(map[string]map[string]string),
+				errs:      &errCont{},
+			},
+		},
+	}
+	info, err := client.AccountInfo(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.HasCapability("readFiles") {
+		t.Errorf("HasCapability(readFiles): got false, want true")
+	}
+	if info.HasCapability("writeFiles") {
+		t.Errorf("HasCapability(writeFiles): got true, want false")
+	}
+
+	client.backend.(*beRoot).b2i.(*testRoot).minParts = 5e6
+	if min, rec := client.PartSizes(); min != 5e6 || rec != 1e8 {
+		t.Errorf("PartSizes: got %d, %d, want %d, %d", min, rec, int(5e6), int(1e8))
+	}
+}
+
+func TestDownloadAuthorization(t *testing.T) {
+	ctx := context.Background()
+	client := &Client{
+		backend: &beRoot{
+			b2i: &testRoot{
+				bucketMap: make(map[string]map[string]string),
+				errs:      &errCont{},
+			},
+		},
+	}
+	bucket, err := client.NewBucket(ctx, bucketName, &BucketAttrs{Type: Private})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, u, err := bucket.DownloadAuthorization(ctx, "some dir/file", time.Hour, ResponseContentType("text/plain"), ResponseCacheControl("max-age=60"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "token:some dir/file:1h0m0s:text/plain"; token != want {
+		t.Errorf("DownloadAuthorization: got token %q, want %q", token, want)
+	}
+	want := "https://f000.example.com/file/b2-tests/some%20dir/file?Authorization=token%3Asome+dir%2Ffile%3A1h0m0s%3Atext%2Fplain&b2CacheControl=max-age%3D60&b2ContentType=text%2Fplain"
+	if got := u.String(); got != want {
+		t.Errorf("DownloadAuthorization: got URL %s, want %s", got, want)
+	}
+}
+
+func TestAuthURL(t *testing.T) {
+	ctx := context.Background()
+	client := &Client{
+		backend: &beRoot{
+			b2i: &testRoot{
+				bucketMap: make(map[string]map[string]string),
+				errs:      &errCont{},
+			},
+		},
+	}
+	bucket, err := client.NewBucket(ctx, bucketName, &BucketAttrs{Type: Private})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	table := []struct {
+		name  string
+		valid time.Duration
+		b2cd  string
+		want  string
+		fail  bool
+	}{
+		{
+			name:  "plain",
+			valid: time.Hour,
+			want:  "https://f000.example.com/file/b2-tests/plain?Authorization=token%3Aplain%3A1h0m0s%3A",
+		},
+		{
+			name:  "a+b c/d?e#f",
+			valid: 7 * 24 * time.Hour,
+			b2cd:  "attachment",
+			want:  "https://f000.example.com/file/b2-tests/a%2Bb%20c/d%3Fe%23f?Authorization=token%3Aa%2Bb+c%2Fd%3Fe%23f%3A168h0m0s%3A&b2ContentDisposition=attachment",
+		},
+		{
+			name:  "too long",
+			valid: 7*24*time.Hour + time.Second,
+			fail:  true,
+		},
+		{
+			name:  "too short",
+			valid: time.Millisecond,
+			fail:  true,
+		},
+	}
+
+	for _, e := range table {
+		u, err := bucket.Object(e.name).AuthURL(ctx, e.valid, e.b2cd)
+		if e.fail {
+			if err == nil {
+				t.Errorf("AuthURL(%q, %v): expected error, got %v", e.name, e.valid, u)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("AuthURL(%q, %v): %v", e.name, e.valid, err)
+			continue
+		}
+		if got := u.String(); got != e.want {
+			t.Errorf("AuthURL(%q, %v): got %s, want %s", e.name, e.valid, got, e.want)
+		}
+	}
+}
+
+func TestObjectURL(t *testing.T) {
+	ctx := context.Background()
+	root := &testRoot{
+		bucketMap: make(map[string]map[string]string),
+		errs:      &errCont{},
+	}
+	client := &Client{backend: &beRoot{b2i: root}}
+	bucket, err := client.NewBucket(ctx, bucketName, &BucketAttrs{Type: Private})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range []struct {
+		name, want string
+	}{
+		{"plain", "https://f000.example.com/file/b2-tests/plain"},
+		{"dir/a b+c?d#e", "https://f000.example.com/file/b2-tests/dir/a%20b%2Bc%3Fd%23e"},
+		{"ünï", "https://f000.example.com/file/b2-tests/%C3%BCn%C3%AF"},
+	} {
+		if got := bucket.Object(e.name).URL(); got != e.want {
+			t.Errorf("URL(%q): got %q, want %q", e.name, got, e.want)
+		}
+	}
+}
+
+func TestCopyTo(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	defer func(n int64) { maxSimpleCopy = n }(maxSimpleCopy)
+	maxSimpleCopy = 1e5
+
+	root := &testRoot{
+		bucketMap: make(map[string]map[string]string),
+		errs:      &errCont{},
+		partSize:  3e4,
+	}
+	client := &Client{backend: &beRoot{b2i: root}}
+	bucket, err := client.NewBucket(ctx, bucketName, &BucketAttrs{Type: Private})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := writeFile(ctx, bucket, "small", 5e4, 1e8); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := writeFile(ctx, bucket, "large", 2e5+7, 1e8); err != nil {
+		t.Fatal(err)
+	}
+	files := root.bucketMap[bucketName]
+	mtime := time.Unix(1e9, 0)
+
+	table := []struct {
+		src    string
+		opts   []CopyOption
+		want   func(string) string
+		large  bool
+		wantCT string
+	}{
+		{
+			src:  "small",
+			want: func(s string) string { return s },
+		},
+		{
+			src:  "small",
+			opts: []CopyOption{CopyRange(100, 1000)},
+			want: func(s string) string { return s[100:1100] },
+		},
+		{
+			src:  "small",
+			opts: []CopyOption{CopyRange(100, -1)},
+			want: func(s string) string { return s[100:] },
+		},
+		{
+			src:   "large",
+			want:  func(s string) string { return s },
+			large: true,
+		},
+		{
+			src:   "large",
+			opts:  []CopyOption{CopyRange(12345, 1e5+1)},
+			want:  func(s string) string { return s[12345 : 12345+1e5+1] },
+			large: true,
+		},
+		{
+			src:    "large",
+			opts:   []CopyOption{CopyAttrs(&Attrs{ContentType: "text/plain", LastModified: mtime, Info: map[string]string{"k": "v"}})},
+			want:   func(s string) string { return s },
+			large:  true,
+			wantCT: "text/plain",
+		},
+	}
+
+	for i, e := range table {
+		dst := bucket.Object(fmt.Sprintf("copy-%d", i))
+		if err := bucket.Object(e.src).CopyTo(ctx, dst, e.opts...); err != nil {
+			t.Errorf("%d: CopyTo: %v", i, err)
+			continue
+		}
+		want := e.want(files[e.src])
+		if got := files[dst.Name()]; got != want {
+			t.Errorf("%d: got %d bytes, want %d bytes", i, len(got), len(want))
+		}
+		if e.large != (dst.attrs != nil) {
+			t.Errorf("%d: large copy %v, but cached attrs %v", i, e.large, dst.attrs)
+		}
+		attrs, err := dst.Attrs(ctx)
+		if err != nil {
+			t.Errorf("%d: Attrs: %v", i, err)
+			continue
+		}
+		if attrs.Size != int64(len(want)) {
+			t.Errorf("%d: Attrs: got size %d, want %d", i, attrs.Size, len(want))
+		}
+		if e.wantCT != "" {
+			if attrs.ContentType != e.wantCT {
+				t.Errorf("%d: Attrs: got content type %q, want %q", i, attrs.ContentType, e.wantCT)
+			}
+			if !attrs.LastModified.Equal(mtime) {
+				t.Errorf("%d: Attrs: got mtime %v, want %v", i, attrs.LastModified, mtime)
+			}
+			if attrs.Info["k"] != "v" || len(attrs.Info) != 1 {
+				t.Errorf("%d: Attrs: got info %v", i, attrs.Info)
+			}
+		}
+	}
+
+	if err := bucket.Object("small").CopyTo(ctx, bucket.Object("bad"), CopyRange(5e4, 1)); err == nil {
+		t.Error("CopyTo with an out of range offset: expected error")
+	}
+
+	root.errs.errMap = map[string]map[int]error{"copyPart": {1: fmt.Errorf("copy failed")}}
+	if err := bucket.Object("large").CopyTo(ctx, bucket.Object("failed")); err == nil {
+		t.Error("CopyTo with a failing part: expected error")
+	}
+	if _, ok := files["failed"]; ok {
+		t.Error("CopyTo with a failing part: destination was created")
+	}
+}
+
+func TestMove(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	root := &testRoot{
+		bucketMap: make(map[string]map[string]string),
+		errs:      &errCont{},
+	}
+	client := &Client{backend: &beRoot{b2i: root}}
+	bucket, err := client.NewBucket(ctx, bucketName, &BucketAttrs{Type: Private})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := client.NewBucket(ctx, "other", &BucketAttrs{Type: Private})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := writeFile(ctx, bucket, "a", 1e4, 1e8); err != nil {
+		t.Fatal(err)
+	}
+	files := root.bucketMap[bucketName]
+	want := files["a"]
+
+	if _, err := bucket.Object("a").Rename(ctx, "a"); err == nil {
+		t.Error("Rename onto itself: expected error")
+	}
+
+	b, err := bucket.Object("a").Rename(ctx, "b")
+	if err != nil {
+		t.Fatalf("Rename: %v", err)
+	}
+	if _, ok := files["a"]; ok {
+		t.Error("Rename: source still exists")
+	}
+	if files["b"] != want {
+		t.Error("Rename: destination has the wrong content")
+	}
+
+	c, err := b.MoveTo(ctx, other, "c", MoveAllVersions())
+	if err != nil {
+		t.Fatalf("MoveTo: %v", err)
+	}
+	if _, ok := files["b"]; ok {
+		t.Error("MoveTo: source still exists")
+	}
+	if got := root.bucketMap["other"]["c"]; got != want {
+		t.Error("MoveTo: destination has the wrong content")
+	}
+
+	if _, err := bucket.Object("missing").Rename(ctx, "d"); err == nil {
+		t.Error("Rename of a missing object: expected error")
+	} else if _, ok := err.(*MoveError); ok {
+		t.Errorf("Rename of a missing object: got %v, want an error without a copy", err)
+	}
+
+	root.errs.errMap = map[string]map[int]error{"hideFile": {0: fmt.Errorf("hide failed")}}
+	d, err := c.Rename(ctx, "d", MoveHideSource())
+	merr, ok := err.(*MoveError)
+	if !ok {
+		t.Fatalf("Rename with a failing hide: got %v, want a *MoveError", err)
+	}
+	if merr.Dst != d || d.Name() != "d" {
+		t.Errorf("Rename with a failing hide: got %v and %v, want the copy", d, merr.Dst)
+	}
+	if root.bucketMap["other"]["d"] != want {
+		t.Error("Rename with a failing hide: destination has the wrong content")
+	}
+}
+
+func TestMoveLatest(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	srv := b2test.NewServer()
+	defer srv.Close()
+	id, key := srv.Credentials()
+	client, err := NewClient(ctx, id, key, APIBase(srv.URL), WithClock(fakeClock()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bucket, err := client.NewBucket(ctx, bucketName, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, size := range []int64{1e3, 2e3} {
+		if _, _, err := writeFile(ctx, bucket, "file", size, 1e8); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Rename the older version, as a listing of versions gives it.
+	var old *Object
+	iter := bucket.List(ctx, ListHidden())
+	for iter.Next() {
+		old = iter.Object()
+	}
+	if err := iter.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if attrs, err := old.Attrs(ctx); err != nil || attrs.Size != 1e3 {
+		t.Fatalf("the older version: got %v, %v; want 1000 bytes", attrs, err)
+	}
+	dst, err := old.Rename(ctx, "renamed")
+	if err != nil {
+		t.Fatalf("Rename: %v", err)
+	}
+	if attrs, err := dst.Attrs(ctx); err != nil || attrs.Size != 2e3 {
+		t.Errorf("Rename copied %v, %v; want the latest version, of 2000 bytes", attrs, err)
+	}
+	// The latest version was the one removed, leaving the older.
+	if attrs, err := bucket.Object("file").Attrs(ctx); err != nil || attrs.Size != 1e3 {
+		t.Errorf("after Rename, the source is %v, %v; want the older version, of 1000 bytes", attrs, err)
+	}
+}
+
+func TestUpdateAttrs(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	defer func(n int64) { maxSimpleCopy = n }(maxSimpleCopy)
+	maxSimpleCopy = 1e5
+
+	root := &testRoot{
+		bucketMap: make(map[string]map[string]string),
+		errs:      &errCont{},
+		partSize:  3e4,
+	}
+	client := &Client{backend: &beRoot{b2i: root}}
+	bucket, err := client.NewBucket(ctx, bucketName, &BucketAttrs{Type: Private})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := writeFile(ctx, bucket, "small", 5e4, 1e8); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := writeFile(ctx, bucket, "large", 2e5, 1e8); err != nil {
+		t.Fatal(err)
+	}
+	files := root.bucketMap[bucketName]
+	small, large := files["small"], files["large"]
+	mtime := time.Unix(1e9, 0)
+	want := &Attrs{
+		ContentType:  "text/plain",
+		LastModified: mtime,
+		Info:         map[string]string{"k": "v"},
+	}
+
+	for _, e := range []struct {
+		name string
+		opts []UpdateAttrsOption
+		fail bool
+	}{
+		{name: "small"},
+		{name: "large", fail: true},
+		{name: "large", opts: []UpdateAttrsOption{UpdateAttrsMultipart()}},
+	} {
+		attrs, err := bucket.Object(e.name).UpdateAttrs(ctx, want, e.opts...)
+		if e.fail {
+			if err == nil {
+				t.Errorf("UpdateAttrs(%s): expected error", e.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("UpdateAttrs(%s): %v", e.name, err)
+			continue
+		}
+		if attrs.ContentType != want.ContentType || !attrs.LastModified.Equal(mtime) || !reflect.DeepEqual(attrs.Info, want.Info) {
+			t.Errorf("UpdateAttrs(%s): got %+v, want %+v", e.name, attrs, want)
+		}
+	}
+	if files["small"] != small || files["large"] != large {
+		t.Error("UpdateAttrs changed object content")
+	}
+}
+
+func TestHeaderAttrs(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	defer func(n int64) { maxSimpleCopy = n }(maxSimpleCopy)
+	maxSimpleCopy = 1e5
+
+	root := &testRoot{
+		bucketMap: make(map[string]map[string]string),
+		errs:      &errCont{},
+		partSize:  3e4,
+	}
+	client := &Client{backend: &beRoot{b2i: root}}
+	bucket, err := client.NewBucket(ctx, bucketName, &BucketAttrs{Type: Private})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := writeFile(ctx, bucket, "small", 5e4, 1e8); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := writeFile(ctx, bucket, "large", 2e5, 1e8); err != nil {
+		t.Fatal(err)
+	}
+	want := &Attrs{
+		ContentType:        "text/plain",
+		Info:               map[string]string{"k": "v", "b2-expires": "never"},
+		CacheControl:       "max-age=60",
+		ContentDisposition: "attachment",
+		ContentEncoding:    "gzip",
+		ContentLanguage:    "en",
+		Expires:            "never",
+	}
+	for _, name := range []string{"small", "large"} {
+		attrs, err := bucket.Object(name).UpdateAttrs(ctx, want, UpdateAttrsMultipart())
+		if err != nil {
+			t.Errorf("UpdateAttrs(%s): %v", name, err)
+			continue
+		}
+		if attrs.CacheControl != want.CacheControl || attrs.ContentDisposition != want.ContentDisposition ||
+			attrs.ContentEncoding != want.ContentEncoding || attrs.ContentLanguage != want.ContentLanguage ||
+			attrs.Expires != want.Expires {
+			t.Errorf("UpdateAttrs(%s): got %+v, want %+v", name, attrs, want)
+		}
+		if info := map[string]string{"k": "v"}; !reflect.DeepEqual(attrs.Info, info) {
+			t.Errorf("UpdateAttrs(%s): got info %v, want %v", name, attrs.Info, info)
+		}
+	}
+
+	conflict := &Attrs{
+		Info:         map[string]string{"b2-cache-control": "no-cache"},
+		CacheControl: "max-age=60",
+	}
+	if _, err := bucket.Object("small").UpdateAttrs(ctx, conflict); err == nil {
+		t.Error("UpdateAttrs: expected error for conflicting Cache-Control")
+	}
+	w := bucket.Object("conflict").NewWriter(ctx, WithAttrsOption(conflict))
+	w.Write([]byte("data"))
+	if err := w.Close(); err == nil {
+		t.Error("Writer: expected error for conflicting Cache-Control")
+	}
+	if _, ok := root.bucketMap[bucketName]["conflict"]; ok {
+		t.Error("Writer: conflicting attrs still uploaded the object")
+	}
+}
+
+func TestUploadDownloadFile(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	root := &testRoot{
+		bucketMap: make(map[string]map[string]string),
+		errs:      &errCont{},
+	}
+	client := &Client{backend: &beRoot{b2i: root}}
+	bucket, err := client.NewBucket(ctx, bucketName, &BucketAttrs{Type: Private})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	if err := os.WriteFile(src, []byte("hello, world"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Unix(1e9, 0)
+	if err := os.Chtimes(src, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	obj, err := bucket.UploadFile(ctx, src, "obj", FileMode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	attrs, err := obj.Attrs(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !attrs.LastModified.Equal(mtime) || attrs.Info[fileModeInfo] != "640" {
+		t.Errorf("UploadFile: got %+v", attrs)
+	}
+
+	dst := filepath.Join(dir, "dst")
+	if _, err := bucket.DownloadFile(ctx, "obj", dst, FileMode()); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "hello, world" {
+		t.Errorf("DownloadFile: got %q", got)
+	}
+	fi, err := os.Stat(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fi.ModTime().Equal(mtime) {
+		t.Errorf("DownloadFile: got mtime %v, want %v", fi.ModTime(), mtime)
+	}
+	if runtime.GOOS != "windows" && fi.Mode().Perm() != 0640 {
+		t.Errorf("DownloadFile: got mode %v, want %v", fi.Mode().Perm(), os.FileMode(0640))
+	}
+
+	// Unchanged files are neither uploaded nor downloaded again.
+	root.bucketMap[bucketName]["obj"] = "hello, world"
+	delete(root.meta[bucketName].files, "obj")
+	if _, err := bucket.UploadFile(ctx, src, "obj", FileSkipUnchanged()); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := root.meta[bucketName].files["obj"]; ok {
+		t.Error("UploadFile: unchanged file was uploaded")
+	}
+	if err := os.Chtimes(dst, time.Now(), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bucket.DownloadFile(ctx, "obj", dst, FileSkipUnchanged()); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(dst); err != nil {
+		t.Fatal(err)
+	} else if fi.ModTime().Equal(mtime) {
+		t.Error("DownloadFile: unchanged file was downloaded")
+	}
+	if entries, err := os.ReadDir(dir); err != nil {
+		t.Fatal(err)
+	} else if len(entries) != 2 {
+		t.Errorf("DownloadFile left temporary files behind: %v", entries)
+	}
+}
+
+func TestDownloadFileResume(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	root := &testRoot{
+		bucketMap: make(map[string]map[string]string),
+		errs:      &errCont{},
+	}
+	client := &Client{backend: &beRoot{b2i: root}}
+	bucket, err := client.NewBucket(ctx, bucketName, &BucketAttrs{Type: Private})
+	if err != nil {
+		t.Fatal(err)
+	}
+	upload := func(seed int64) []byte {
+		data := make([]byte, 25007)
+		rand.New(rand.NewSource(seed)).Read(data)
+		w := bucket.Object("obj").NewWriter(ctx, WithAttrsOption(&Attrs{ContentType: "application/x-test", LastModified: time.Unix(1e9, 0)}))
+		if _, err := w.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	served := func() int64 { return atomic.LoadInt64(&root.meta[bucketName].served) }
+	partials := func(dir string) []string {
+		var names []string
+		ents, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range ents {
+			if strings.Contains(e.Name(), ".b2part-") {
+				names = append(names, e.Name())
+			}
+		}
+		return names
+	}
+	dir := t.TempDir()
+	dst := filepath.Join(dir, "dst")
+
+	// An interrupted download leaves its partial file behind, and the next
+	// download picks it up where it stopped.
+	data := upload(1)
+	boom := errors.New("connection lost for good")
+	root.errs.errMap = map[string]map[int]error{"readBody": {0: boom}}
+	if _, err := bucket.DownloadFile(ctx, "obj", dst, FileResume()); !errors.Is(err, boom) {
+		t.Fatalf("DownloadFile: got %v, want %v", err, boom)
+	}
+	parts := partials(dir)
+	if len(parts) != 1 {
+		t.Fatalf("partial files: got %v, want one", parts)
+	}
+	fi, err := os.Stat(filepath.Join(dir, parts[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() == 0 || fi.Size() >= int64(len(data)) {
+		t.Fatalf("partial file has %d bytes, want some of %d", fi.Size(), len(data))
+	}
+	before := served()
+	if _, err := bucket.DownloadFile(ctx, "obj", dst, FileResume()); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := served()-before, int64(len(data))-fi.Size(); got != want {
+		t.Errorf("resumed download: got %d bytes, want the %d missing", got, want)
+	}
+	if got, err := os.ReadFile(dst); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(got, data) {
+		t.Error("resumed download: wrong content")
+	}
+	if fi, err := os.Stat(dst); err != nil {
+		t.Fatal(err)
+	} else if !fi.ModTime().Equal(time.Unix(1e9, 0)) {
+		t.Errorf("resumed download: got mtime %v", fi.ModTime())
+	}
+	if parts := partials(dir); len(parts) != 0 {
+		t.Errorf("partial files left behind: %v", parts)
+	}
+
+	// A partial file of an older version is discarded.
+	root.errs.errMap = map[string]map[int]error{"readBody": {0: boom}}
+	root.errs.opMap = sync.Map{}
+	if _, err := bucket.DownloadFile(ctx, "obj", dst, FileResume()); !errors.Is(err, boom) {
+		t.Fatalf("DownloadFile: got %v, want %v", err, boom)
+	}
+	old := partials(dir)
+	data = upload(2)
+	if _, err := bucket.DownloadFile(ctx, "obj", dst, FileResume()); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := os.ReadFile(dst); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(got, data) {
+		t.Error("download of a new version: wrong content")
+	}
+	if parts := partials(dir); len(parts) != 0 || len(old) != 1 {
+		t.Errorf("partial files: got %v before and %v after, want one before and none after", old, parts)
+	}
+
+	// A partial file that doesn't match is discarded once the download is
+	// checked, so that the next one starts afresh.
+	attrs, err := bucket.Object("obj").Attrs(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part := partialName(dst, attrs)
+	if err := os.WriteFile(part, []byte("not the beginning"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	var cerr *ChecksumMismatchError
+	if _, err := bucket.DownloadFile(ctx, "obj", dst, FileResume()); !errors.As(err, &cerr) {
+		t.Errorf("DownloadFile with a bad partial file: got %v, want a *ChecksumMismatchError", err)
+	}
+	if _, err := os.Stat(part); !os.IsNotExist(err) {
+		t.Errorf("bad partial file: got %v, want it removed", err)
+	}
+	if _, err := bucket.DownloadFile(ctx, "obj", dst, FileResume()); err != nil {
+		t.Errorf("DownloadFile after a bad partial file: %v", err)
+	}
+}
+
+func TestDetectContentType(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	root := &testRoot{
+		bucketMap: make(map[string]map[string]string),
+		errs:      &errCont{},
+	}
+	client := &Client{backend: &beRoot{b2i: root}}
+	bucket, err := client.NewBucket(ctx, bucketName, &BucketAttrs{Type: Private})
+	if err != nil {
+		t.Fatal(err)
+	}
+	html := "<!DOCTYPE html><html><body>" + strings.Repeat("hello ", 200) + "</body></html>"
+
+	for i, e := range []struct {
+		name   string
+		data   string
+		csize  int
+		stream bool
+		opts   []WriterOption
+		want   string
+	}{
+		{name: "index", data: html, want: "application/octet-stream"},
+		{name: "index", data: html, opts: []WriterOption{DetectContentType()}, want: "text/html; charset=utf-8"},
+		{name: "index", data: html, csize: 100, opts: []WriterOption{DetectContentType()}, want: "text/html; charset=utf-8"},
+		{name: "index", data: html, stream: true, opts: []WriterOption{DetectContentType()}, want: "text/html; charset=utf-8"},
+		{name: "style.css", data: "body { color: red; }", opts: []WriterOption{DetectContentType()}, want: "text/css; charset=utf-8"},
+		{name: "blob", data: "\x00\x01\x02", opts: []WriterOption{DetectContentType()}, want: "application/octet-stream"},
+		{name: "empty.html", opts: []WriterOption{DetectContentType()}, want: "text/html; charset=utf-8"},
+		{name: "index", data: html, opts: []WriterOption{DetectContentType(), WithAttrsOption(&Attrs{ContentType: "text/x-mine"})}, want: "text/x-mine"},
+	} {
+		w := bucket.Object(e.name).NewWriter(ctx, e.opts...)
+		if e.csize > 0 {
+			w.ChunkSize = e.csize
+		}
+		var err error
+		if e.stream {
+			_, err = io.Copy(w, strings.NewReader(e.data))
+		} else {
+			_, err = io.Copy(w, struct{ io.Reader }{strings.NewReader(e.data)})
+		}
+		if err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		if got := root.bucketMap[bucketName][e.name]; got != e.data {
+			t.Errorf("%d: got %d bytes, want %d", i, len(got), len(e.data))
+		}
+		attrs, err := bucket.Object(e.name).Attrs(ctx)
+		if err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		if attrs.ContentType != e.want {
+			t.Errorf("%d: got content type %q, want %q", i, attrs.ContentType, e.want)
+		}
+	}
+}
+
+func TestWriterValidation(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	root := &testRoot{
+		bucketMap: make(map[string]map[string]string),
+		errs:      &errCont{},
+	}
+	client := &Client{backend: &beRoot{b2i: root}}
+	bucket, err := client.NewBucket(ctx, bucketName, &BucketAttrs{Type: Private})
+	if err != nil {
+		t.Fatal(err)
+	}
+	long := strings.Repeat("n", 1025)
+
+	w := bucket.Object(long).NewWriter(ctx)
+	if _, err := w.Write([]byte("data")); err == nil {
+		t.Error("Write: expected error for long name")
+	}
+	if err := w.Close(); err == nil {
+		t.Error("Close: expected error for long name")
+	}
+	w = bucket.Object("info").NewWriter(ctx, WithAttrsOption(&Attrs{Info: map[string]string{"bad key": "v"}}))
+	w.Write([]byte("data"))
+	if err := w.Close(); err == nil || !strings.Contains(err.Error(), `"bad key"`) {
+		t.Errorf("Close: got %v, want an error naming the key", err)
+	}
+	if len(root.bucketMap[bucketName]) != 0 {
+		t.Errorf("invalid objects were uploaded: %v", root.bucketMap[bucketName])
+	}
+
+	client.opts.skipValidation = true
+	if _, _, err := writeFile(ctx, bucket, long, 10, 1e8); err != nil {
+		t.Errorf("SkipValidation: %v", err)
+	}
+}
+
+func TestInfoKeyCase(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	defer func(n int64) { maxSimpleCopy = n }(maxSimpleCopy)
+	maxSimpleCopy = 1e5
+
+	root := &testRoot{
+		bucketMap: make(map[string]map[string]string),
+		errs:      &errCont{},
+		partSize:  3e4,
+	}
+	client := &Client{backend: &beRoot{b2i: root}}
+	bucket, err := client.NewBucket(ctx, bucketName, &BucketAttrs{Type: Private})
+	if err != nil {
+		t.Fatal(err)
+	}
+	attrs := &Attrs{
+		Info:         map[string]string{"SrcHash": "ABC", "src_Mode": "0644", "src-mode": "a b+c%20d"},
+		CacheControl: "no-cache",
+	}
+	want := map[string]string{"srchash": "ABC", "src_mode": "0644", "src-mode": "a b+c%20d"}
+
+	w := bucket.Object("small").NewWriter(ctx, WithAttrsOption(attrs))
+	w.Write([]byte("data"))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := bucket.Object("small").Attrs(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got.Info, want) || got.CacheControl != "no-cache" {
+		t.Errorf("Writer: got %+v, want info %v", got, want)
+	}
+
+	if _, _, err := writeFile(ctx, bucket, "large", 2e5, 1e8); err != nil {
+		t.Fatal(err)
+	}
+	dst := bucket.Object("copy")
+	if err := bucket.Object("large").CopyTo(ctx, dst, CopyAttrs(attrs)); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := dst.Attrs(ctx); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(got.Info, want) {
+		t.Errorf("CopyTo: got info %v, want %v", got.Info, want)
+	}
+
+	conflict := &Attrs{Info: map[string]string{"SrcHash": "a", "srchash": "b"}}
+	w = bucket.Object("conflict").NewWriter(ctx, WithAttrsOption(conflict))
+	w.Write([]byte("data"))
+	if err := w.Close(); err == nil {
+		t.Error("Writer: expected error for keys differing only in case")
+	}
+}
+
+func TestHeadAttrs(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	root := &testRoot{
+		bucketMap: make(map[string]map[string]string),
+		errs:      &errCont{},
+	}
+	client := &Client{backend: &beRoot{b2i: root}}
+	bucket, err := client.NewBucket(ctx, bucketName, &BucketAttrs{Type: Private})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Attrs{
+		ContentType:     "text/plain",
+		Info:            map[string]string{"k": "v"},
+		ContentEncoding: "gzip",
+		LastModified:    time.Unix(1500000000, 0),
+	}
+	w := bucket.Object("obj").NewWriter(ctx, WithAttrsOption(want))
+	w.Write([]byte("data"))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	wantAttrs, err := bucket.Object("obj").Attrs(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errGetFileInfo := errors.New("called b2_get_file_info")
+	root.errs.errMap = map[string]map[int]error{"getFileInfo": {0: errGetFileInfo, 1: errGetFileInfo}}
+	if _, err := bucket.Object("obj").Attrs(ctx); err != errGetFileInfo {
+		t.Fatalf("Attrs without HeadAttrs: got %v, want %v", err, errGetFileInfo)
+	}
+
+	HeadAttrs()(&client.opts)
+	attrs, err := bucket.Object("obj").Attrs(ctx)
+	if err != nil {
+		t.Fatalf("Attrs with HeadAttrs: %v", err)
+	}
+	if !reflect.DeepEqual(attrs, wantAttrs) {
+		t.Errorf("Attrs with HeadAttrs: got %+v, want %+v", attrs, wantAttrs)
+	}
+	if _, err := bucket.Object("missing").Attrs(ctx); !IsNotExist(err) {
+		t.Errorf("Attrs with HeadAttrs of a missing object: got %v, want not found", err)
+	}
+}
+
+func TestWriterResultAttrs(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	root := &testRoot{
+		bucketMap: make(map[string]map[string]string),
+		errs:      &errCont{},
+	}
+	client := &Client{backend: &beRoot{b2i: root}}
+	bucket, err := client.NewBucket(ctx, bucketName, &BucketAttrs{Type: Private})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range []struct {
+		name  string
+		size  int64
+		csize int
+		large bool
+	}{
+		{name: "small", size: 1e3, csize: 1e8},
+		{name: "large", size: 1e4, csize: 1e3, large: true},
+	} {
+		obj, sha, err := writeFile(ctx, bucket, e.name, e.size, e.csize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Make any request for the file's info fail.
+		delete(root.bucketMap[bucketName], e.name)
+		attrs, err := obj.Attrs(ctx)
+		if err != nil {
+			t.Fatalf("%s: Attrs: %v", e.name, err)
+		}
+		want := sha
+		if e.large {
+			want = "none"
+		}
+		if attrs.ID != e.name || attrs.Size != e.size || attrs.SHA1 != want {
+			t.Errorf("%s: got ID %q, size %d, SHA1 %q; want %q, %d, %q", e.name, attrs.ID, attrs.Size, attrs.SHA1, e.name, e.size, want)
+		}
+	}
+}
+
+func TestDeleteObjects(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	root := &testRoot{
+		bucketMap: make(map[string]map[string]string),
+		errs:      &errCont{},
+	}
+	client := &Client{backend: &beRoot{b2i: root}}
+	bucket, err := client.NewBucket(ctx, bucketName, &BucketAttrs{Type: Private})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 50; i++ {
+		if _, _, err := writeFile(ctx, bucket, fmt.Sprintf("del/%02d", i), 10, 1e8); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, err := writeFile(ctx, bucket, "keep", 10, 1e8); err != nil {
+		t.Fatal(err)
+	}
+	files := root.bucketMap[bucketName]
+
+	root.errs.errMap = map[string]map[int]error{"deleteFileVersion": {3: fmt.Errorf("nope"), 7: fmt.Errorf("nope")}}
+	n, err := bucket.DeleteObjects(ctx, "del/", DeleteWorkers(4))
+	if n != 48 {
+		t.Errorf("DeleteObjects: got %d deleted, want 48", n)
+	}
+	derr, ok := err.(*DeleteObjectsError)
+	if !ok {
+		t.Fatalf("DeleteObjects: got %v, want a *DeleteObjectsError", err)
+	}
+	if len(derr.Failures) != 2 {
+		t.Errorf("DeleteObjects: got %d failures, want 2", len(derr.Failures))
+	}
+	for _, f := range derr.Failures {
+		if _, ok := files[f.Name]; !ok {
+			t.Errorf("DeleteObjects: %s reported as failed, but was deleted", f.Name)
+		}
+		if !strings.Contains(err.Error(), f.Name) {
+			t.Errorf("DeleteObjects: error %q does not name %s", err, f.Name)
+		}
+	}
+	if len(files) != 3 {
+		t.Errorf("DeleteObjects: got %d files left, want 3", len(files))
+	}
+
+	root.errs.errMap = nil
+	if n, err := bucket.DeleteObjects(ctx, "del/"); err != nil || n != 2 {
+		t.Errorf("DeleteObjects: got (%d, %v), want (2, nil)", n, err)
+	}
+	if _, ok := files["keep"]; !ok || len(files) != 1 {
+		t.Errorf("DeleteObjects: got %d files left, want only keep", len(files))
+	}
+}
+
+func TestListVersions(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	client := &Client{
+		backend: &beRoot{
+			b2i: &testRoot{
+				bucketMap: make(map[string]map[string]string),
+				errs:      &errCont{},
+			},
+		},
+	}
+	bucket, err := client.NewBucket(ctx, bucketName, &BucketAttrs{Type: Private})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a", "b", "c"} {
+		if _, _, err := writeFile(ctx, bucket, name, 10, 1e8); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var got []string
+	iter := bucket.List(ctx, ListVersions())
+	for iter.Next() {
+		obj := iter.Object()
+		attrs, err := obj.Attrs(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if attrs.ID != obj.ID() {
+			t.Errorf("%s: Attrs.ID: got %q, want %q", obj.Name(), attrs.ID, obj.ID())
+		}
+		if obj.IsHideMarker() {
+			t.Errorf("%s: IsHideMarker: got true, want false", obj.Name())
+		}
+		got = append(got, obj.Name())
+	}
+	if err := iter.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a", "b", "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ListVersions: got %v, want %v", got, want)
+	}
+
+	marker := &Object{name: "a", b: bucket, f: &beFile{b2file: &testFile{n: "a", a: "hide"}}}
+	if !marker.IsHideMarker() {
+		t.Error("IsHideMarker: got false for a hide marker")
+	}
+	if bucket.Object("a").IsHideMarker() {
+		t.Error("IsHideMarker: got true for an unlisted object")
+	}
+}
+
+func TestListDelimiterFolders(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	client := &Client{
+		backend: &beRoot{
+			b2i: &testRoot{
+				bucketMap: make(map[string]map[string]string),
+				errs:      &errCont{},
+			},
+		},
+	}
+	bucket, err := client.NewBucket(ctx, bucketName, &BucketAttrs{Type: Private})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a", "d/x", "d/y", "e/f/g"} {
+		if _, _, err := writeFile(ctx, bucket, name, 10, 1e8); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	table := []struct {
+		prefix string
+		want   []string // folders end in "/"
+	}{
+		{want: []string{"a", "d/", "e/"}},
+		{prefix: "d/", want: []string{"d/x", "d/y"}},
+		{prefix: "e/", want: []string{"e/f/"}},
+	}
+	for _, e := range table {
+		var got []string
+		iter := bucket.List(ctx, ListPrefix(e.prefix), ListDelimiter("/"))
+		for iter.Next() {
+			obj := iter.Object()
+			attrs, err := obj.Attrs(ctx)
+			if err != nil {
+				t.Errorf("%s: Attrs: %v", obj.Name(), err)
+				continue
+			}
+			if obj.IsDir() != (attrs.Status == Folder) || obj.IsDir() != strings.HasSuffix(obj.Name(), "/") {
+				t.Errorf("%s: IsDir %v, but Status %v", obj.Name(), obj.IsDir(), attrs.Status)
+			}
+			if obj.IsDir() {
+				if err := obj.Delete(ctx); err == nil {
+					t.Errorf("%s: Delete on a folder: expected error", obj.Name())
+				}
+			}
+			got = append(got, obj.Name())
+		}
+		if err := iter.Err(); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, e.want) {
+			t.Errorf("List(%q, \"/\"): got %v, want %v", e.prefix, got, e.want)
+		}
+	}
+}
+
+func TestListCursor(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	client := &Client{
+		backend: &beRoot{
+			b2i: &testRoot{
+				bucketMap: make(map[string]map[string]string),
+				errs:      &errCont{},
+			},
+		},
+	}
+	bucket, err := client.NewBucket(ctx, bucketName, &BucketAttrs{Type: Private})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var all []string
+	for i := 0; i < 25; i++ {
+		name := fmt.Sprintf("%02d", i)
+		all = append(all, name)
+		if _, _, err := writeFile(ctx, bucket, name, 10, 1e8); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	list := func(n int, opts ...ListOption) ([]string, string, error) {
+		var got []string
+		iter := bucket.List(ctx, append(opts, ListPageSize(10))...)
+		for len(got) != n && iter.Next() {
+			got = append(got, iter.Object().Name())
+		}
+		return got, iter.Cursor(), iter.Err()
+	}
+
+	for _, mode := range [][]ListOption{nil, {ListVersions()}} {
+		for _, n := range []int{0, 1, 10, 13} {
+			head, cur, err := list(n, mode...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tail, _, err := list(-1, append(mode, ListCursor(cur))...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := append(head, tail...); !reflect.DeepEqual(got, all) {
+				t.Errorf("resuming after %d objects: got %v, want %v", n, got, all)
+			}
+		}
+	}
+
+	_, done, err := list(-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _, err := list(-1, ListCursor(done)); err != nil || len(got) != 0 {
+		t.Errorf("resuming a finished listing: got %v, %v; want nothing", got, err)
+	}
+
+	_, cur, err := list(5, ListVersions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _, err := list(-1, ListCursor(cur)); err == nil || len(got) != 0 {
+		t.Errorf("resuming a versions cursor as names: got %v, %v; want an error", got, err)
+	}
+	if got, _, err := list(-1, ListVersions(), ListPrefix("1"), ListCursor(cur)); err == nil || len(got) != 0 {
+		t.Errorf("resuming with a different prefix: got %v, %v; want an error", got, err)
+	}
+	if _, _, err := list(-1, ListCursor("not a cursor")); err == nil {
+		t.Error("resuming from garbage: expected an error")
+	}
+}
+
+func TestListPrefetch(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	client := &Client{
+		backend: &beRoot{
+			b2i: &testRoot{
+				bucketMap: make(map[string]map[string]string),
+				errs:      &errCont{},
+			},
+		},
+	}
+	bucket, err := client.NewBucket(ctx, bucketName, &BucketAttrs{Type: Private})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var all []string
+	for i := 0; i < 35; i++ {
+		name := fmt.Sprintf("%02d", i)
+		all = append(all, name)
+		if _, _, err := writeFile(ctx, bucket, name, 10, 1e8); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var got []string
+	iter := bucket.List(ctx, ListPageSize(10), ListPrefetch(), ListLocker(&sync.Mutex{}))
+	for iter.Next() {
+		got = append(got, iter.Object().Name())
+	}
+	if err := iter.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, all) {
+		t.Errorf("ListPrefetch: got %v, want %v", got, all)
+	}
+
+	// Abandoning a prefetching iterator, with or without canceling its
+	// context, must not block or leak.
+	actx, acancel := context.WithCancel(ctx)
+	iter = bucket.List(actx, ListPageSize(10), ListPrefetch())
+	if !iter.Next() {
+		t.Fatal(iter.Err())
+	}
+	acancel()
+	if iter.Next() {
+		t.Error("Next after cancellation: got true")
+	}
+	if err := iter.Err(); err != context.Canceled {
+		t.Errorf("Err after cancellation: got %v, want %v", err, context.Canceled)
+	}
+}
+
+// streamBucket hands on the first objects of each page it lists, and then
+// waits for hold to be closed, if it is set, or fails with err, if it is set,
+// once.
+type streamBucket struct {
+	b2BucketInterface
+	first int
+	hold  chan struct{}
+	err   error
+}
+
+func (s *streamBucket) listFileNames(ctx context.Context, count int, cont, pfx, del string, emit func(b2FileInterface)) ([]b2FileInterface, string, error) {
+	fs, next, err := s.b2BucketInterface.listFileNames(ctx, count, cont, pfx, del, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	for i, f := range fs {
+		if i == s.first {
+			if s.hold != nil {
+				<-s.hold
+			}
+			if err := s.err; err != nil {
+				s.err = nil
+				return nil, "", err
+			}
+		}
+		if emit != nil {
+			emit(f)
+		}
+	}
+	return fs, next, nil
+}
+
+func TestListStream(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	client := &Client{
+		backend: &beRoot{
+			options: clientOptions{clock: fakeClock()},
+			b2i: &testRoot{
+				bucketMap: make(map[string]map[string]string),
+				errs:      &errCont{},
+			},
+		},
+	}
+	bucket, err := client.NewBucket(ctx, bucketName, &BucketAttrs{Type: Private})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var all []string
+	for i := 0; i < 35; i++ {
+		name := fmt.Sprintf("%02d", i)
+		all = append(all, name)
+		if _, _, err := writeFile(ctx, bucket, name, 10, 1e8); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sb := &streamBucket{b2BucketInterface: bucket.b.(*beBucket).b2bucket, first: 3}
+	bucket.b = &beBucket{b2bucket: sb, ri: client.backend}
+
+	list := func(opts ...ListOption) []string {
+		var got []string
+		iter := bucket.List(ctx, append([]ListOption{ListPageSize(10), ListStream()}, opts...)...)
+		for iter.Next() {
+			got = append(got, iter.Object().Name())
+		}
+		if err := iter.Err(); err != nil {
+			t.Fatal(err)
+		}
+		return got
+	}
+	for _, e := range []struct {
+		desc string
+		opts []ListOption
+		want []string
+	}{
+		{desc: "streamed", want: all},
+		{desc: "prefetched", opts: []ListOption{ListPrefetch()}, want: all},
+		{desc: "started after", opts: []ListOption{ListStartAfter("04")}, want: all[5:]},
+	} {
+		if got := list(e.opts...); !reflect.DeepEqual(got, e.want) {
+			t.Errorf("%s: got %v, want %v", e.desc, got, e.want)
+		}
+	}
+
+	// The first objects of a page are returned before the page is complete.
+	sb.hold = make(chan struct{})
+	iter := bucket.List(ctx, ListPageSize(10), ListStream())
+	for i := 0; i < sb.first; i++ {
+		if !iter.Next() {
+			t.Fatal(iter.Err())
+		}
+		if got := iter.Object().Name(); got != all[i] {
+			t.Errorf("object %d: got %q, want %q", i, got, all[i])
+		}
+	}
+	cursor := iter.Cursor()
+	close(sb.hold)
+	got := append([]string(nil), all[:sb.first]...)
+	for iter.Next() {
+		got = append(got, iter.Object().Name())
+	}
+	if err := iter.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, all) {
+		t.Errorf("held listing: got %v, want %v", got, all)
+	}
+
+	// A cursor taken partway through a streamed page resumes after the
+	// object most recently returned.
+	if got := list(ListCursor(cursor)); !reflect.DeepEqual(got, all[sb.first:]) {
+		t.Errorf("resumed listing: got %v, want %v", got, all[sb.first:])
+	}
+
+	// A page that fails partway and is listed again hands on each object
+	// once.
+	sb.err = testError{retry: true}
+	if got := list(); !reflect.DeepEqual(got, all) {
+		t.Errorf("retried listing: got %v, want %v", got, all)
+	}
+
+	// If it isn't retried, the objects before the failure are returned,
+	// and the ListError's cursor resumes after them.
+	sb.err = testError{}
+	got = nil
+	iter = bucket.List(ctx, ListPageSize(10), ListStream())
+	for iter.Next() {
+		got = append(got, iter.Object().Name())
+	}
+	if !reflect.DeepEqual(got, all[:sb.first]) {
+		t.Errorf("failed listing: got %v, want %v", got, all[:sb.first])
+	}
+	var le *ListError
+	if !errors.As(iter.Err(), &le) {
+		t.Fatalf("Err: got %v (%T), want a *ListError", iter.Err(), iter.Err())
+	}
+	rest := list(ListCursor(le.Cursor))
+	if got = append(got, rest...); !reflect.DeepEqual(got, all) {
+		t.Errorf("listing resumed after the failure: got %v, want %v", got, all)
+	}
+}
+
+func TestListErrors(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	errs := &errCont{}
+	client := &Client{
+		backend: &beRoot{
+			b2i: &testRoot{
+				bucketMap: make(map[string]map[string]string),
+				errs:      errs,
+			},
+		},
+	}
+	bucket, err := client.NewBucket(ctx, bucketName, &BucketAttrs{Type: Private})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 25; i++ {
+		if _, _, err := writeFile(ctx, bucket, fmt.Sprintf("%02d", i), 10, 1e8); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The second page fails; with prefetching, the failure is reported
+	// before the rest of the first page.
+	fail := testError{}
+	errs.errMap = map[string]map[int]error{"listFileNames": {1: fail}}
+	iter := bucket.List(ctx, ListPageSize(10), ListPrefetch())
+	if !iter.Next() {
+		t.Fatal(iter.Err())
+	}
+	seen := []string{iter.Object().Name()}
+	time.Sleep(50 * time.Millisecond)
+	for iter.Next() {
+		seen = append(seen, iter.Object().Name())
+	}
+	if len(seen) >= 10 {
+		t.Errorf("got %d objects before the error, want fewer than 10", len(seen))
+	}
+	var le *ListError
+	if !errors.As(iter.Err(), &le) {
+		t.Fatalf("Err: got %v (%T), want a *ListError", iter.Err(), iter.Err())
+	}
+	if le.Bucket != bucketName {
+		t.Errorf("ListError.Bucket: got %q, want %q", le.Bucket, bucketName)
+	}
+	if !errors.Is(iter.Err(), fail) {
+		t.Errorf("Err: got %v, want it to wrap %v", iter.Err(), fail)
+	}
+
+	// The cursor resumes the listing after the last object seen.
+	got := seen
+	iter = bucket.List(ctx, ListPageSize(10), ListCursor(le.Cursor))
+	for iter.Next() {
+		got = append(got, iter.Object().Name())
+	}
+	if err := iter.Err(); err != nil {
+		t.Fatal(err)
+	}
+	var want []string
+	for i := 0; i < 25; i++ {
+		want = append(want, fmt.Sprintf("%02d", i))
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("resumed listing: got %v, want %v", got, want)
+	}
+}
+
+func TestListStartAfter(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	client := &Client{
+		backend: &beRoot{
+			b2i: &testRoot{
+				bucketMap: make(map[string]map[string]string),
+				errs:      &errCont{},
+			},
+		},
+	}
+	bucket, err := client.NewBucket(ctx, bucketName, &BucketAttrs{Type: Private})
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{"a", "b", "c", "d", "e"}
+	for _, name := range names {
+		if _, _, err := writeFile(ctx, bucket, name, 10, 1e8); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	table := []struct {
+		after string
+		want  []string
+	}{
+		{after: "a", want: names[1:]},
+		{after: "b", want: names[2:]},
+		{after: "bb", want: names[2:]},
+		{after: "d", want: names[4:]},
+		{after: "e"},
+		{after: "z"},
+	}
+	for _, e := range table {
+		for _, mode := range [][]ListOption{nil, {ListVersions()}} {
+			for _, size := range []int{1, 2, 10} {
+				var got []string
+				opts := append([]ListOption{ListStartAfter(e.after), ListPageSize(size)}, mode...)
+				iter := bucket.List(ctx, opts...)
+				for iter.Next() {
+					got = append(got, iter.Object().Name())
+				}
+				if err := iter.Err(); err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(got, e.want) {
+					t.Errorf("ListStartAfter(%q), page size %d, %d options: got %v, want %v", e.after, size, len(mode), got, e.want)
+				}
+			}
+		}
+	}
+}
+
+func TestBucketExists(t *testing.T) {
+	ctx := context.Background()
+	root := &testRoot{
+		bucketMap: make(map[string]map[string]string),
+		errs:      &errCont{},
+	}
+	client := &Client{backend: &beRoot{b2i: root}}
+	if _, err := client.NewBucket(ctx, bucketName, &BucketAttrs{Type: Private}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, restrict := range []string{"", bucketName} {
+		root.restrict = restrict
+		for name, want := range map[string]bool{bucketName: true, "missing": false} {
+			got, err := client.BucketExists(ctx, name)
+			if err != nil {
+				t.Errorf("restricted to %q: BucketExists(%q): %v", restrict, name, err)
+				continue
+			}
+			if got != want {
+				t.Errorf("restricted to %q: BucketExists(%q): got %v, want %v", restrict, name, got, want)
+			}
+		}
+		bucket, err := client.Bucket(ctx, bucketName)
+		if err != nil {
+			t.Errorf("restricted to %q: Bucket: %v", restrict, err)
+			continue
+		}
+		if _, _, err := writeFile(ctx, bucket, "file", 10, 1e8); err != nil {
+			t.Errorf("restricted to %q: writing to bucket: %v", restrict, err)
+		}
+		if _, err := client.Bucket(ctx, "missing"); !IsNotExist(err) {
+			t.Errorf("restricted to %q: Bucket(missing): got %v, want not found", restrict, err)
+		}
+	}
+}
+
+func TestRestrictedKey(t *testing.T) {
+	ctx := context.Background()
+	root := &testRoot{
+		bucketMap: make(map[string]map[string]string),
+		errs:      &errCont{},
+	}
+	client := &Client{backend: &beRoot{b2i: root}}
+	bucket, err := client.NewBucket(ctx, bucketName, &BucketAttrs{Type: Private})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"photos/a", "photos/b", "docs/c"} {
+		if _, _, err := writeFile(ctx, bucket, name, 10, 1e8); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root.restrict = bucketName
+	root.prefix = "photos/"
+
+	// The test root refuses b2_list_buckets to restricted keys.
+	bucket, err = client.Bucket(ctx, bucketName)
+	if err != nil {
+		t.Fatalf("Bucket: %v", err)
+	}
+	if _, err := bucket.Attrs(ctx); err != nil {
+		t.Errorf("Attrs: %v", err)
+	}
+	for _, name := range []string{"other", "photos"} {
+		_, err := client.Bucket(ctx, name)
+		var re *RestrictionError
+		if !errors.As(err, &re) || !IsNotExist(err) || !IsAccessDenied(err) {
+			t.Errorf("Bucket(%q): got %v, want a *RestrictionError", name, err)
+		}
+		if _, err := client.NewBucket(ctx, name, nil); !errors.As(err, &re) {
+			t.Errorf("NewBucket(%q): got %v, want a *RestrictionError", name, err)
+		}
+	}
+
+	var got []string
+	iter := bucket.List(ctx)
+	for iter.Next() {
+		got = append(got, iter.Object().Name())
+	}
+	if err := iter.Err(); err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if want := []string{"photos/a", "photos/b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("List: got %v, want %v", got, want)
+	}
+	iter = bucket.List(ctx, ListPrefix("photos/a"))
+	if !iter.Next() || iter.Object().Name() != "photos/a" || iter.Next() || iter.Err() != nil {
+		t.Errorf("List(ListPrefix(photos/a)): didn't list photos/a alone: %v", iter.Err())
+	}
+	if _, err := bucket.Object("photos/a").Attrs(ctx); err != nil {
+		t.Errorf("Attrs(photos/a): %v", err)
+	}
+
+	const want = "key restricted to prefix 'photos/'"
+	check := func(what string, err error) {
+		t.Helper()
+		var re *RestrictionError
+		if !errors.As(err, &re) || !IsAccessDenied(err) || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: got %v, want a *RestrictionError, %q", what, err, want)
+		}
+	}
+	iter = bucket.List(ctx, ListPrefix("docs/"))
+	if iter.Next() {
+		t.Errorf("List(ListPrefix(docs/)): listed %s", iter.Object().Name())
+	}
+	check("List(ListPrefix(docs/))", iter.Err())
+	obj := bucket.Object("docs/c")
+	_, err = obj.Attrs(ctx)
+	check("Attrs", err)
+	check("Delete", obj.Delete(ctx))
+	r := obj.NewReader(ctx)
+	_, err = io.ReadAll(r)
+	r.Close()
+	check("Read", err)
+	w := bucket.Object("docs/d").NewWriter(ctx)
+	_, err = io.WriteString(w, "data")
+	check("Write", err)
+	check("Close", w.Close())
+	if _, ok := root.bucketMap[bucketName]["docs/d"]; ok {
+		t.Error("docs/d was written")
+	}
+}
+
+func TestBucketUpdateFunc(t *testing.T) {
+	ctx := context.Background()
+	client := &Client{
+		backend: &beRoot{
+			b2i: &testRoot{
+				bucketMap: make(map[string]map[string]string),
+				errs:      &errCont{},
+			},
+		},
+	}
+	if _, err := client.NewBucket(ctx, bucketName, &BucketAttrs{Type: Private}); err != nil {
+		t.Fatal(err)
+	}
+	b1, err := client.Bucket(ctx, bucketName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b2, err := client.Bucket(ctx, bucketName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b1.Update(ctx, &BucketAttrs{Info: map[string]string{"a": "1"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b2.Update(ctx, &BucketAttrs{Info: map[string]string{"b": "2"}}); !IsUpdateConflict(err) {
+		t.Errorf("stale Update: got %v, want a conflict", err)
+	}
+	attrs, err := b2.Attrs(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale := attrs.Revision
+	if err := b2.Update(ctx, attrs); err != nil {
+		t.Errorf("Update after Attrs: %v", err)
+	}
+	if err := b1.Update(ctx, &BucketAttrs{Revision: stale}); !IsUpdateConflict(err) {
+		t.Errorf("Update with a stale Revision: got %v, want a conflict", err)
+	}
+
+	var calls int
+	err = b2.UpdateFunc(ctx, 3, func(attrs *BucketAttrs) error {
+		calls++
+		if calls == 1 {
+			// Race with another writer.
+			if err := b1.UpdateFunc(ctx, 1, func(*BucketAttrs) error { return nil }); err != nil {
+				t.Fatal(err)
+			}
+		}
+		attrs.Info = map[string]string{"c": fmt.Sprint(calls)}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("UpdateFunc: %v", err)
+	}
+	if calls != 2 {
+		t.Errorf("UpdateFunc: f called %d times, want 2", calls)
+	}
+	attrs, err = b1.Attrs(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{"c": "2"}; !reflect.DeepEqual(attrs.Info, want) {
+		t.Errorf("UpdateFunc: got info %v, want %v", attrs.Info, want)
+	}
+
+	err = b2.UpdateFunc(ctx, 2, func(attrs *BucketAttrs) error {
+		return b1.Update(ctx, &BucketAttrs{Info: map[string]string{}})
+	})
+	if !IsUpdateConflict(err) {
+		t.Errorf("UpdateFunc with constant conflicts: got %v, want a conflict", err)
+	}
+}
+
+func TestKeyIterator(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	client := &Client{
+		backend: &beRoot{
+			b2i: &testRoot{
+				bucketMap: make(map[string]map[string]string),
+				errs:      &errCont{},
+			},
+		},
+	}
+	bucket, err := client.NewBucket(ctx, bucketName, &BucketAttrs{Type: Private})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// More than one page.
+	const n = 2500
+	for i := 0; i < n; i++ {
+		if _, err := client.CreateKey(ctx, fmt.Sprintf("global-%d", i), Capabilities("listBuckets")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := bucket.CreateKey(ctx, "scoped", Capabilities("readFiles"), Prefix("pfx/"), Lifetime(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	var got int
+	var last *Key
+	iter := client.Keys(ctx)
+	for iter.Next() {
+		got++
+		last = iter.Key()
+	}
+	if err := iter.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if got != n+1 {
+		t.Errorf("Keys: got %d keys, want %d", got, n+1)
+	}
+	if last == nil || last.Name() != "scoped" || last.Prefix() != "pfx/" || last.BucketID() != bucket.b.id() {
+		t.Errorf("Keys: last key: got %#v", last)
+	}
+	if caps := last.Capabilities(); len(caps) != 1 || caps[0] != "readFiles" {
+		t.Errorf("Keys: last key capabilities: got %v, want [readFiles]", caps)
+	}
+
+	// Found on the last page.
+	k, err := client.KeyByName(ctx, "scoped")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k.ID() != last.ID() || k.Prefix() != "pfx/" || k.Expires().IsZero() {
+		t.Errorf("KeyByName: got %#v, want %#v", k, last)
+	}
+	if k, err := client.KeyByName(ctx, "global-7"); err != nil || k.Name() != "global-7" {
+		t.Errorf("KeyByName(global-7): got %v, %v", k, err)
+	}
+	if _, err := client.KeyByName(ctx, "missing"); !IsNotExist(err) {
+		t.Errorf("KeyByName(missing): got %v, want an error for which IsNotExist is true", err)
+	}
+}
+
+func TestKeyCapabilities(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	root := &testRoot{
+		bucketMap: make(map[string]map[string]string),
+		errs:      &errCont{},
+	}
+	client := &Client{backend: &beRoot{b2i: root}}
+	bucket, err := client.NewBucket(ctx, bucketName, &BucketAttrs{Type: Private})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := client.CreateKey(ctx, "all", Capabilities(AllCapabilities()...)); err != nil {
+		t.Errorf("CreateKey with AllCapabilities: %v", err)
+	}
+	if _, err := bucket.CreateKey(ctx, "read", Capabilities(ReadOnlyCapabilities()...)); err != nil {
+		t.Errorf("CreateKey with ReadOnlyCapabilities: %v", err)
+	}
+	if _, err := bucket.CreateKey(ctx, "write", Capabilities(WriteOnlyCapabilities()...)); err != nil {
+		t.Errorf("CreateKey with WriteOnlyCapabilities: %v", err)
+	}
+	keys := len(root.keys)
+
+	_, err = client.CreateKey(ctx, "typo", Capabilities(CapListFiles, "readFile"))
+	if err == nil || !strings.Contains(err.Error(), `"readFile"`) || !strings.Contains(err.Error(), CapReadFiles) {
+		t.Errorf("CreateKey with an unknown capability: got %v, want it named, with the valid ones", err)
+	}
+	if _, err := bucket.CreateKey(ctx, "typo", Capabilities("readFile")); err == nil {
+		t.Error("Bucket.CreateKey with an unknown capability: got no error")
+	}
+	if len(root.keys) != keys {
+		t.Errorf("keys with unknown capabilities were requested")
+	}
+	if _, err := client.CreateKey(ctx, "future", Capabilities("readTheFuture"), UnknownCapabilities()); err != nil {
+		t.Errorf("CreateKey with UnknownCapabilities: %v", err)
+	}
+
+	// The sets are copies.
+	AllCapabilities()[0] = "changed"
+	ReadOnlyCapabilities()[0] = "changed"
+	if all := AllCapabilities(); all[0] != CapListKeys {
+		t.Errorf("AllCapabilities: got %v after changing a copy", all)
+	}
+	for _, set := range [][]string{ReadOnlyCapabilities(), WriteOnlyCapabilities()} {
+		for _, c := range set {
+			if !knownCapability(c) {
+				t.Errorf("unknown capability %q in a set", c)
+			}
+		}
+	}
+}
+
+func TestDownloadTo(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	client := &Client{
+		backend: &beRoot{
+			b2i: &testRoot{
+				bucketMap: make(map[string]map[string]string),
+				errs:      &errCont{},
+			},
+		},
+	}
+
+	bucket, err := client.NewBucket(ctx, bucketName, &BucketAttrs{Type: Private})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	table := []struct {
+		size  int64
+		chunk int64
+		conc  int
+	}{
+		{size: 0, chunk: 100, conc: 4},
+		{size: 1e5, chunk: 1e3, conc: 1},
+		{size: 1e5 + 7, chunk: 1e3, conc: 8},
+		{size: 999, chunk: 1e4, conc: 3},
+	}
+
+	for _, e := range table {
+		obj, wsha, err := writeFile(ctx, bucket, "file", e.size, 1e8)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := &memWriterAt{}
+		n, err := obj.DownloadTo(ctx, w, DownloadChunkSize(e.chunk), DownloadConcurrency(e.conc), DownloadVerify())
+		if err != nil {
+			t.Errorf("DownloadTo(%#v): %v", e, err)
+			continue
+		}
+		if n != e.size || int64(len(w.buf)) != e.size {
+			t.Errorf("DownloadTo(%#v): got %d bytes (%d written), want %d", e, n, len(w.buf), e.size)
+		}
+		if got := fmt.Sprintf("%x", sha1.Sum(w.buf)); got != wsha {
+			t.Errorf("DownloadTo(%#v): bad hash: got %s, want %s", e, got, wsha)
+		}
+	}
+
+	// Verification needs to read the content back.
+	if _, err := bucket.Object("file").DownloadTo(ctx, writerAtOnly{&memWriterAt{}}, DownloadVerify()); err == nil {
+		t.Error("DownloadTo with DownloadVerify and a write-only target: expected error, got none")
+	}
+}
+
+func TestDownloadToOverwritten(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	client := &Client{
+		backend: &beRoot{
+			b2i: &testRoot{
+				bucketMap: make(map[string]map[string]string),
+				errs:      &errCont{},
+			},
+		},
+	}
+	bucket, err := client.NewBucket(ctx, bucketName, &BucketAttrs{Type: Private})
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj, _, err := writeFile(ctx, bucket, "file", 1e4, 1e8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vb := &versionedBucket{b2BucketInterface: bucket.b.(*beBucket).b2bucket}
+	bucket.b.(*beBucket).b2bucket = vb
+
+	// The object is overwritten once the first range is being written; the
+	// later ranges are of the new version.
+	w := &hookWriterAt{w: &memWriterAt{}, hook: func() { atomic.StoreInt32(&vb.version, 1) }}
+	_, err = obj.DownloadTo(ctx, w, DownloadChunkSize(1e3), DownloadConcurrency(1))
+	if err == nil || !strings.Contains(err.Error(), "changed while it was being downloaded") {
+		t.Errorf("DownloadTo: got %v, want the object to have changed", err)
+	}
+}
+
+// A versionedBucket gives the files it downloads IDs that change with its
+// version, as though each had been overwritten.
+type versionedBucket struct {
+	b2BucketInterface
+	version int32
+}
+
+func (v *versionedBucket) downloadFileByName(ctx context.Context, name string, offset, size int64, header bool, ov downloadOverrides) (b2FileReaderInterface, error) {
+	fr, err := v.b2BucketInterface.downloadFileByName(ctx, name, offset, size, header, ov)
+	if err != nil {
+		return nil, err
+	}
+	return versionedReader{fr, atomic.LoadInt32(&v.version)}, nil
+}
+
+type versionedReader struct {
+	b2FileReaderInterface
+	version int32
+}
+
+func (v versionedReader) id() string {
+	return fmt.Sprintf("%s-%d", v.b2FileReaderInterface.id(), v.version)
+}
+
+type hookWriterAt struct {
+	w    io.WriterAt
+	hook func()
+}
+
+func (w *hookWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	w.hook()
+	return w.w.WriteAt(p, off)
+}
+
+type writerAtOnly struct{ w io.WriterAt }
+
+func (w writerAtOnly) WriteAt(p []byte, off int64) (int, error) { return w.w.WriteAt(p, off) }
+
+func benchmarkDownload(b *testing.B, f func(context.Context, *Object) error) {
+	ctx := context.Background()
+	client := &Client{
+		backend: &beRoot{
+			b2i: &testRoot{
+				bucketMap: make(map[string]map[string]string),
+				errs:      &errCont{},
+			},
+		},
+	}
+	bucket, err := client.NewBucket(ctx, bucketName, &BucketAttrs{Type: Private})
+	if err != nil {
+		b.Fatal(err)
+	}
+	const size = 1e7
+	obj, _, err := writeFile(ctx, bucket, "file", size, 1e8)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.SetBytes(size)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := f(ctx, obj); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkReaderDownload(b *testing.B) {
+	benchmarkDownload(b, func(ctx context.Context, o *Object) error {
+		r := o.NewReader(ctx)
+		r.ChunkSize = 1e6
+		r.ConcurrentDownloads = 4
+		defer r.Close()
+		_, err := io.Copy(&offsetWriter{w: &memWriterAt{}}, r)
+		return err
+	})
+}
+
+func BenchmarkDownloadTo(b *testing.B) {
+	benchmarkDownload(b, func(ctx context.Context, o *Object) error {
+		_, err := o.DownloadTo(ctx, &memWriterAt{}, DownloadChunkSize(1e6), DownloadConcurrency(4))
+		return err
+	})
+}
+
+// BenchmarkReaderCopyFile copies a 1GB object to a file with io.Copy, through
+// Read alone and through WriteTo, with one stream and with four.
+func BenchmarkReaderCopyFile(b *testing.B) {
+	ctx := context.Background()
+	root := &testRoot{
+		bucketMap: make(map[string]map[string]string),
+		errs:      &errCont{},
+	}
+	client := &Client{backend: &beRoot{b2i: root}}
+	bucket, err := client.NewBucket(ctx, bucketName, &BucketAttrs{Type: Private})
+	if err != nil {
+		b.Fatal(err)
+	}
+	const size = 1 << 30
+	// Uploading it would need several times its size in memory; record its
+	// hash, too, so that downloads of each chunk needn't work it out again.
+	content := strings.Repeat(string(pattern), size/len(pattern)+1)[:size]
+	root.bucketMap[bucketName]["file"] = content
+	meta := root.meta[bucketName]
+	if meta.files == nil {
+		meta.files = make(map[string]*testFileInfo)
+	}
+	meta.files["file"] = &testFileInfo{name: "file", sha1: fmt.Sprintf("%x", sha1.Sum([]byte(content))), size: size}
+	obj := bucket.Object("file")
+	f, err := os.Create(filepath.Join(b.TempDir(), "file"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer f.Close()
+
+	table := []struct {
+		name    string
+		concur  int
+		writeTo bool
+	}{
+		{name: "Read", concur: 1},
+		{name: "WriteTo", concur: 1, writeTo: true},
+		{name: "Read concurrent", concur: 4},
+		{name: "WriteTo concurrent", concur: 4, writeTo: true},
+	}
+	for _, e := range table {
+		b.Run(e.name, func(b *testing.B) {
+			b.SetBytes(size)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := f.Seek(0, io.SeekStart); err != nil {
+					b.Fatal(err)
+				}
+				r := obj.NewReader(ctx)
+				r.ChunkSize = 1e7
+				r.ConcurrentDownloads = e.concur
+				var src io.Reader = r
+				if !e.writeTo {
+					src = struct{ io.Reader }{r} // hide WriteTo
+				}
+				n, err := io.Copy(f, src)
+				r.Close()
+				if err != nil {
+					b.Fatal(err)
+				}
+				if n != size {
+					b.Fatalf("copied %d bytes, want %d", n, size)
+				}
+			}
+		})
+	}
+}
+
+func writeFile(ctx context.Context, bucket *Bucket, name string, size int64, csize int) (*Object, string, error) {
+	r := io.LimitReader(zReader{}, size)
+	o := bucket.Object(name)
+	f := o.NewWriter(ctx)
+	h := sha1.New()
+	w := io.MultiWriter(f, h)
+	f.ConcurrentUploads = 5
+	f.ChunkSize = csize
+	n, err := io.Copy(w, r)
+	if err != nil {
+		return nil, "", err
+	}
+	if n != size {
+		return nil, "", fmt.Errorf("io.Copy(): wrote %d bytes; wanted %d bytes", n, size)
+	}
+	if err := f.Close(); err != nil {
+		return nil, "", err
+	}
+	return o, fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+func readFile(ctx context.Context, obj *Object, sha string, chunk, concur int) error {
+	r := obj.NewReader(ctx)
+	r.ChunkSize = chunk
+	r.ConcurrentDownloads = concur
+	h := sha1.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return err
+	}
+	if err := r.Close(); err != nil {
+		return err
+	}
+	rsha := fmt.Sprintf("%x", h.Sum(nil))
+	if sha != rsha {
+		return fmt.Errorf("bad hash: got %s, want %s", rsha, sha)
+	}
+	return nil
+}
+
+func TestProgressFunc(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	table := []struct {
+		name   string
+		size   int64
+		csize  int
+		seeker bool
+		errs   map[int]error
+	}{
+		{name: "small", size: 1e3, csize: 1e4},
+		{name: "large", size: 1e5 + 7, csize: 1e4},
+		{name: "exact", size: 5e4, csize: 1e4},
+		{name: "seeker", size: 1e5 + 7, csize: 1e4, seeker: true},
+		{name: "small seeker", size: 1e3, csize: 1e4, seeker: true},
+		{
+			name:  "retried",
+			size:  1e5 + 7,
+			csize: 1e4,
+			errs: map[int]error{
+				0: testError{reupload: true},
+				3: testError{reupload: true},
+			},
+		},
+	}
+
+	for _, e := range table {
+		client := &Client{
+			backend: &beRoot{
+				options: clientOptions{clock: fakeClock()},
+				b2i: &testRoot{
+					bucketMap: make(map[string]map[string]string),
+					errs:      &errCont{errMap: map[string]map[int]error{"uploadPart": e.errs}},
+				},
+			},
+		}
+		bucket, err := client.NewBucket(ctx, bucketName, &BucketAttrs{Type: Private})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var mu sync.Mutex
+		var last, total int64 = 0, -1
+		w := bucket.Object(e.name).NewWriter(ctx)
+		w.ConcurrentUploads = 3
+		w.ChunkSize = e.csize
+		w.ProgressFunc = func(written, tot int64) {
+			mu.Lock()
+			defer mu.Unlock()
+			if written < 0 || written > e.size {
+				t.Errorf("%s: written = %d, outside [0, %d]", e.name, written, e.size)
+			}
+			if tot != -1 && tot != e.size {
+				t.Errorf("%s: total = %d, want -1 or %d", e.name, tot, e.size)
+			}
+			last, total = written, tot
+		}
+		data := make([]byte, e.size)
+		var r io.Reader = bytes.NewReader(data)
+		if !e.seeker {
+			r = io.LimitReader(zReader{}, e.size)
+		}
+		if _, err := io.Copy(w, r); err != nil {
+			t.Fatalf("%s: %v", e.name, err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("%s: %v", e.name, err)
+		}
+		if last != e.size || total != e.size {
+			t.Errorf("%s: last progress was (%d, %d), want (%d, %d)", e.name, last, total, e.size, e.size)
+		}
+
+		var rlast, rtotal int64
+		rd := bucket.Object(e.name).NewReader(ctx)
+		rd.ChunkSize = e.csize
+		rd.ProgressFunc = func(read, tot int64) { rlast, rtotal = read, tot }
+		if _, err := io.Copy(ioutil.Discard, rd); err != nil {
+			t.Fatalf("%s: %v", e.name, err)
+		}
+		rd.Close()
+		if rlast != e.size || rtotal != e.size {
+			t.Errorf("%s: last read progress was (%d, %d), want (%d, %d)", e.name, rlast, rtotal, e.size, e.size)
+		}
+	}
+}
+
+func TestMeteredReaderProgress(t *testing.T) {
+	var sent, most int64
+	nb := newNonBuffer(strings.NewReader("some bytes"), 0, 10)
+	r, err := nb.Reader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mr := &meteredReader{
+		r:       r,
+		size:    nb.Len(),
+		payload: payloadLen(nb),
+		progress: func(n int64) {
+			sent += n
+			if sent > most {
+				most = sent
+			}
+		},
+	}
+	if _, err := mr.Read(make([]byte, 4)); err != nil {
+		t.Fatal(err)
+	}
+	if sent != 4 {
+		t.Errorf("after a partial read: got %d, want 4", sent)
+	}
+	if err := mr.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	if sent != 0 {
+		t.Errorf("after Reset: got %d, want 0", sent)
+	}
+	if _, err := ioutil.ReadAll(mr); err != nil {
+		t.Fatal(err)
+	}
+	if sent != 10 || most != 10 {
+		t.Errorf("after reading everything: got %d (at most %d), want 10; the trailing hash should not count", sent, most)
+	}
+}
+
+func TestMeteredReaderRate(t *testing.T) {
+	var client rateMeter
+	mr := &meteredReader{
+		r:    resetter{strings.NewReader("some bytes")},
+		size: 10,
+		rate: &rateMeter{parent: &client},
+	}
+	if _, err := mr.Read(make([]byte, 4)); err != nil {
+		t.Fatal(err)
+	}
+	if err := mr.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.Copy(ioutil.Discard, mr); err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range []*rateMeter{mr.rate, &client} {
+		rate := m.rate()
+		// 14 bytes on the wire, 4 of them again, over the same span.
+		if rate.Effective <= 0 || math.Abs(rate.Wire/rate.Effective-1.4) > 1e-9 {
+			t.Errorf("got effective %v, wire %v; want wire 1.4 times effective", rate.Effective, rate.Wire)
+		}
+	}
+}
+
+func TestTransferRates(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	client := &Client{
+		backend: &beRoot{
+			b2i: &testRoot{
+				bucketMap: make(map[string]map[string]string),
+				errs:      &errCont{},
+			},
+		},
+	}
+	if rs := client.Status(); rs.ReadRate != (TransferRate{}) || rs.WriteRate != (TransferRate{}) {
+		t.Errorf("before any transfers: got read rate %+v and write rate %+v, want zero", rs.ReadRate, rs.WriteRate)
+	}
+	bucket, err := client.NewBucket(ctx, bucketName, &BucketAttrs{Type: Private})
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj := bucket.Object("measured")
+	w := obj.NewWriter(ctx)
+	w.ChunkSize = 1e5
+	if _, err := io.Copy(w, io.LimitReader(zReader{}, 3e5)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if w.Rate() <= 0 {
+		t.Errorf("Writer.Rate: got %v, want more than zero", w.Rate())
+	}
+
+	for _, concurrent := range []int{1, 3} {
+		r := obj.NewReader(ctx)
+		r.ConcurrentDownloads = concurrent
+		r.ChunkSize = 1e5
+		if _, err := io.Copy(ioutil.Discard, r); err != nil {
+			t.Fatal(err)
+		}
+		if r.Rate() <= 0 {
+			t.Errorf("Reader.Rate with %d downloads: got %v, want more than zero", concurrent, r.Rate())
+		}
+		if rs := r.status(); rs.Rate.Wire != rs.Rate.Effective {
+			t.Errorf("Reader status with %d downloads: got %+v, want wire and effective rates the same", concurrent, rs.Rate)
+		}
+		if err := r.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	si := client.Status()
+	if si.WriteRate.Effective <= 0 || si.WriteRate.Wire != si.WriteRate.Effective {
+		t.Errorf("client write rate: got %+v, want the same positive wire and effective rates", si.WriteRate)
+	}
+	if si.ReadRate.Effective <= 0 || si.ReadRate.Wire != si.ReadRate.Effective {
+		t.Errorf("client read rate: got %+v, want the same positive wire and effective rates", si.ReadRate)
+	}
+}
+
+func TestWriterPartSize(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	table := []struct {
+		name    string
+		size    int64
+		csize   int
+		min     int // the account's minimum part size
+		auto    bool
+		seeker  bool
+		want    int    // the part size used
+		wantErr string // a substring of the error from Close
+	}{
+		{name: "recommended", size: 5e4, want: 2e4},
+		{name: "small parts", size: 5e3, csize: 500, min: 1e3, wantErr: "minimum part size"},
+		{name: "small parts, small file", size: 100, csize: 500, min: 1e3, want: 500},
+		{name: "too many parts", size: 1e4 + 1, csize: 1, wantErr: "more than 10000 parts"},
+		{name: "too many seekable parts", size: 1e7 + 1, csize: 1e3, seeker: true, wantErr: "more than 10000 parts"},
+		{name: "auto", size: 1e7 + 1, csize: 1e3, seeker: true, auto: true, want: 1001},
+		{name: "auto, few parts", size: 5e4, csize: 1e4, seeker: true, auto: true, want: 1e4},
+	}
+
+	for _, e := range table {
+		client := &Client{
+			backend: &beRoot{
+				b2i: &testRoot{
+					bucketMap: make(map[string]map[string]string),
+					errs:      &errCont{},
+					partSize:  2e4,
+					minParts:  e.min,
+				},
+			},
+		}
+		bucket, err := client.NewBucket(ctx, bucketName, &BucketAttrs{Type: Private})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var opts []WriterOption
+		if e.auto {
+			opts = append(opts, AutoPartSize())
+		}
+		w := bucket.Object(e.name).NewWriter(ctx, opts...)
+		w.ChunkSize = e.csize
+		if e.seeker {
+			_, err = w.ReadFrom(bytes.NewReader(make([]byte, e.size)))
+		} else {
+			_, err = copyContext(ctx, w, io.LimitReader(zReader{}, e.size))
+		}
+		if cerr := w.Close(); err == nil {
+			err = cerr
+		}
+		if e.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), e.wantErr) {
+				t.Errorf("%s: got error %v, want one containing %q", e.name, err, e.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", e.name, err)
+			continue
+		}
+		if w.csize != e.want {
+			t.Errorf("%s: part size was %d, want %d", e.name, w.csize, e.want)
+		}
+	}
+}
+
+// discardRoot is a testRoot whose buckets throw away the parts of large
+// files, so that benchmarks of big uploads measure only the Writer.
+type discardRoot struct {
+	*testRoot
+}
+
+func (d discardRoot) createBucket(ctx context.Context, name, btype string, info map[string]string, rules []LifecycleRule, lock bool) (b2BucketInterface, error) {
+	b, err := d.testRoot.createBucket(ctx, name, btype, info, rules, lock)
+	if err != nil {
+		return nil, err
+	}
+	return discardBucket{b}, nil
+}
+
+type discardBucket struct {
+	b2BucketInterface
+}
+
+func (d discardBucket) startLargeFile(_ context.Context, name, _ string, _ map[string]string) (b2LargeFileInterface, error) {
+	return &discardLargeFile{name: name}, nil
+}
+
+type discardLargeFile struct {
+	name string
+	size int64
+}
+
+func (d *discardLargeFile) finishLargeFile(context.Context) (b2FileInterface, error) {
+	return &testFile{n: d.name, s: atomic.LoadInt64(&d.size), files: map[string]string{}}, nil
+}
+
+func (d *discardLargeFile) id() string { return "" }
+
+func (d *discardLargeFile) getUploadPartURL(context.Context) (b2FileChunkInterface, error) {
+	return d, nil
+}
+
+func (d *discardLargeFile) copyPart(context.Context, string, int, int64, int64) (int64, error) {
+	return 0, fmt.Errorf("copyPart: not supported")
+}
+
+func (d *discardLargeFile) cancel(context.Context) error { return nil }
+func (d *discardLargeFile) listParts(context.Context, int, int) ([]b2FilePartInterface, int, error) {
+	return nil, 0, nil
+}
+func (d *discardLargeFile) reload(context.Context) error { return nil }
+
+func (d *discardLargeFile) uploadPart(_ context.Context, r io.Reader, _ string, _, _ int) (int, error) {
+	n, err := io.Copy(ioutil.Discard, r)
+	atomic.AddInt64(&d.size, n)
+	return int(n), err
+}
+
+// BenchmarkWriterLarge uploads 1GB with eight concurrent uploads, reporting the
+// peak heap in use alongside the allocations.
+func BenchmarkWriterLarge(b *testing.B) {
+	ctx := context.Background()
+	client := &Client{
+		backend: &beRoot{
+			b2i: discardRoot{&testRoot{
+				bucketMap: make(map[string]map[string]string),
+				errs:      &errCont{},
+			}},
+		},
+	}
+	bucket, err := client.NewBucket(ctx, bucketName, &BucketAttrs{Type: Private})
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	// Start from empty pools, including those left by earlier runs.
+	runtime.GC()
+	runtime.GC()
+
+	var peak uint64
+	done := make(chan struct{})
+	sampled := make(chan struct{})
+	go func() {
+		defer close(sampled)
+		var ms runtime.MemStats
+		for {
+			runtime.ReadMemStats(&ms)
+			if ms.HeapInuse > peak {
+				peak = ms.HeapInuse
+			}
+			select {
+			case <-done:
+				return
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	}()
+
+	const size = 1 << 30
+	b.SetBytes(size)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		w := bucket.Object(largeFileName).NewWriter(ctx)
+		w.ConcurrentUploads = 8
+		if _, err := copyContext(ctx, w, io.LimitReader(zReader{}, size)); err != nil {
+			b.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+	close(done)
+	<-sampled
+	b.ReportMetric(float64(peak)/(1<<20), "peak-MB")
+}
+
+// BenchmarkWriterSerial uploads 256MB one part at a time, so that the time
+// spent buffering and hashing each part isn't hidden by others being sent.
+// The part hashes are computed as the parts are written, or given.
+func BenchmarkWriterSerial(b *testing.B) {
+	ctx := context.Background()
+	client := &Client{
+		backend: &beRoot{
+			b2i: discardRoot{&testRoot{
+				bucketMap: make(map[string]map[string]string),
+				errs:      &errCont{},
+			}},
+		},
+	}
+	bucket, err := client.NewBucket(ctx, bucketName, &BucketAttrs{Type: Private})
+	if err != nil {
+		b.Fatal(err)
+	}
+	given := func(int, int64, int64) string { return "da39a3ee5e6b4b0d3255bfef95601890afd80709" }
+	for _, e := range []struct {
+		name string
+		opts []WriterOption
+	}{
+		{name: "hashed"},
+		{name: "given", opts: []WriterOption{PartSHA1(given)}},
+	} {
+		b.Run(e.name, func(b *testing.B) {
+			const size = 256 << 20
+			b.SetBytes(size)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				w := bucket.Object(largeFileName).NewWriter(ctx, e.opts...)
+				w.ConcurrentUploads = 1
+				w.ChunkSize = 16 << 20
+				if _, err := copyContext(ctx, w, io.LimitReader(zReader{}, size)); err != nil {
+					b.Fatal(err)
+				}
+				if err := w.Close(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestBufferHash(t *testing.T) {
+	sum := func(s string) string { return fmt.Sprintf("%x", sha1.Sum([]byte(s))) }
+	dir := t.TempDir()
+	for _, e := range []struct {
+		name string
+		new  func() writeBuffer
+		kept bool // the hash is kept after Close
+	}{
+		{name: "memory", new: func() writeBuffer { return newMemoryBuffer(nil) }, kept: true},
+		{name: "unhashed memory", new: func() writeBuffer { return newMemoryBuffer(nil).unhashed() }},
+		{name: "file", kept: true, new: func() writeBuffer {
+			fb, err := newFileBuffer(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return fb
+		}},
+	} {
+		// Each buffer's hasher, which may be another's reused, starts
+		// afresh, and a hash that has been asked for changes with more
+		// writes.
+		for i := 0; i < 2; i++ {
+			buf := e.new()
+			io.WriteString(buf, "hello")
+			if got, want := buf.Hash(), sum("hello"); got != want {
+				t.Errorf("%s: got %s, want %s", e.name, got, want)
+			}
+			io.WriteString(buf, ", world")
+			want := sum("hello, world")
+			if got := buf.Hash(); got != want {
+				t.Errorf("%s: after another write: got %s, want %s", e.name, got, want)
+			}
+			buf.Close()
+			if !e.kept {
+				continue
+			}
+			if got := buf.Hash(); got != want {
+				t.Errorf("%s: after Close: got %s, want %s", e.name, got, want)
+			}
+		}
+	}
+}
+
+func TestBufferPool(t *testing.T) {
+	var bp bufferPool
+	sp := bp.acquire(4 << 20)
+
+	small := newMemoryBuffer(sp)
+	small.Write(make([]byte, 1e3))
+	if small.slab {
+		t.Error("a small buffer took a slab")
+	}
+	small.Close()
+
+	large := newMemoryBuffer(sp)
+	for i := 0; i < 4; i++ {
+		large.Write(make([]byte, 1<<20))
+	}
+	if !large.slab || large.buf.Cap() != 4<<20 {
+		t.Errorf("a full chunk has cap %d (slab: %v), want a slab of %d", large.buf.Cap(), large.slab, 4<<20)
+	}
+	large.Close()
+	bp.release(sp)
+
+	if got := bp.acquire(4 << 20); got != sp {
+		t.Error("the pool for an unchanged chunk size was not kept")
+	} else {
+		bp.release(got)
+	}
+	other := bp.acquire(8 << 20)
+	if _, ok := bp.pools[4<<20]; ok {
+		t.Error("the pool for the old chunk size was kept after the size changed")
+	}
+	if b := other.get(); cap(b) != 8<<20 {
+		t.Errorf("got a slab of %d bytes, want %d", cap(b), 8<<20)
+	}
+	bp.release(other)
+}
+
+func TestFileBufferCleanup(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	table := []struct {
+		name    string
+		size    int64
+		resume  bool
+		cancel  bool // cancel the writer's context before Close
+		errs    map[string]map[int]error
+		wantErr bool
+	}{
+		{name: "empty"},
+		{name: "small", size: 1e3},
+		{name: "large", size: 1e5 + 7},
+		{name: "resume", size: 1e5 + 7, resume: true},
+		{
+			name:    "error",
+			size:    1e5 + 7,
+			errs:    map[string]map[int]error{"uploadPart": {2: testError{}}},
+			wantErr: true,
+		},
+		{
+			name: "retried",
+			size: 1e5 + 7,
+			errs: map[string]map[int]error{"uploadPart": {2: testError{reupload: true}}},
+		},
+		{name: "canceled", size: 1e5 + 7, cancel: true, wantErr: true},
+	}
+
+	for _, e := range table {
+		dir := t.TempDir()
+		client := &Client{
+			backend: &beRoot{
+				options: clientOptions{clock: fakeClock()},
+				b2i: &testRoot{
+					bucketMap: make(map[string]map[string]string),
+					errs:      &errCont{errMap: e.errs},
+				},
+			},
+		}
+		bucket, err := client.NewBucket(ctx, bucketName, &BucketAttrs{Type: Private})
+		if err != nil {
+			t.Fatal(err)
+		}
+		wctx, wcancel := context.WithCancel(ctx)
+		w := bucket.Object(e.name).NewWriter(wctx, WithFileBuffer(dir))
+		w.ChunkSize = 1e4
+		w.ConcurrentUploads = 3
+		w.Resume = e.resume
+		_, err = copyContext(ctx, w, io.LimitReader(zReader{}, e.size))
+		if e.cancel {
+			wcancel()
+		}
+		if cerr := w.Close(); err == nil {
+			err = cerr
+		}
+		wcancel()
+		if (err != nil) != e.wantErr {
+			t.Errorf("%s: got error %v, want error: %v", e.name, err, e.wantErr)
+		}
+		left, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(left) != 0 {
+			t.Errorf("%s: %d scratch files left behind", e.name, len(left))
+		}
+	}
+}
+
+func TestFileBufferResume(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	dir := t.TempDir()
+	client := &Client{
+		backend: &beRoot{
+			b2i: &testRoot{
+				bucketMap: make(map[string]map[string]string),
+				errs:      &errCont{errMap: map[string]map[int]error{"uploadPart": {5: testError{}}}},
+			},
+		},
+	}
+	bucket, err := client.NewBucket(ctx, bucketName, &BucketAttrs{Type: Private})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const size = 1e5 + 7
+	write := func(resume bool) (*Writer, error) {
+		w := bucket.Object(largeFileName).NewWriter(ctx, WithFileBuffer(dir), KeepUnfinished())
+		w.ChunkSize = 1e4
+		w.Resume = resume
+		_, err := copyContext(ctx, w, io.LimitReader(zReader{}, size))
+		if cerr := w.Close(); err == nil {
+			err = cerr
+		}
+		return w, err
+	}
+	if _, err := write(false); err == nil {
+		t.Fatal("the first upload succeeded; it should have failed at the sixth part")
+	}
+	w, err := write(true)
+	if err != nil {
+		t.Fatalf("resuming the upload: %v", err)
+	}
+	if len(w.seen) != 5 {
+		t.Errorf("resumed upload found %d parts, want 5", len(w.seen))
+	}
+	left, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(left) != 0 {
+		t.Errorf("%d scratch files left behind", len(left))
+	}
+	attrs, err := bucket.Object(largeFileName).Attrs(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attrs.Size != size {
+		t.Errorf("resumed upload has size %d, want %d", attrs.Size, int64(size))
+	}
+}
+
+func TestWriterAbort(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	table := []struct {
+		name string
+		size int64
+	}{
+		{name: "unwritten"},
+		{name: "small", size: 1e3},
+		{name: "large", size: 5e4 + 7},
+	}
+
+	for _, e := range table {
+		root := &testRoot{
+			bucketMap: make(map[string]map[string]string),
+			errs:      &errCont{},
+		}
+		client := &Client{backend: &beRoot{b2i: root}}
+		bucket, err := client.NewBucket(ctx, bucketName, &BucketAttrs{Type: Private})
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := bucket.Object(e.name).NewWriter(ctx)
+		w.ChunkSize = 1e4
+		w.ConcurrentUploads = 2
+		if _, err := copyContext(ctx, w, io.LimitReader(zReader{}, e.size)); err != nil {
+			t.Fatalf("%s: %v", e.name, err)
+		}
+		if err := w.Abort(ctx); err != nil {
+			t.Errorf("%s: Abort: %v", e.name, err)
+		}
+		if _, err := w.Write([]byte("more")); err != ErrAborted {
+			t.Errorf("%s: Write after Abort: got %v, want ErrAborted", e.name, err)
+		}
+		if err := w.Close(); err != ErrAborted {
+			t.Errorf("%s: Close after Abort: got %v, want ErrAborted", e.name, err)
+		}
+		if err := w.Abort(ctx); err != ErrClosed {
+			t.Errorf("%s: second Abort: got %v, want ErrClosed", e.name, err)
+		}
+		if _, err := bucket.Object(e.name).Attrs(ctx); !IsNotExist(err) {
+			t.Errorf("%s: Attrs after Abort: got %v, want a not-exist error", e.name, err)
+		}
+		if n := len(root.meta[bucketName].unfinished); n != 0 {
+			t.Errorf("%s: %d unfinished large files left after Abort", e.name, n)
+		}
+	}
+}
+
+func TestCancelUnfinished(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	table := []struct {
+		name   string
+		keep   bool
+		cancel bool // cancel the writer's context instead of failing a part
+	}{
+		{name: "error"},
+		{name: "canceled", cancel: true},
+		{name: "kept", keep: true},
+		{name: "kept, canceled", keep: true, cancel: true},
+	}
+
+	for _, e := range table {
+		root := &testRoot{
+			bucketMap: make(map[string]map[string]string),
+			errs:      &errCont{},
+		}
+		if !e.cancel {
+			root.errs.errMap = map[string]map[int]error{"uploadPart": {2: testError{}}}
+		}
+		client := &Client{backend: &beRoot{b2i: root}}
+		bucket, err := client.NewBucket(ctx, bucketName, &BucketAttrs{Type: Private})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var opts []WriterOption
+		if e.keep {
+			opts = append(opts, KeepUnfinished())
+		}
+		wctx, wcancel := context.WithCancel(ctx)
+		w := bucket.Object(e.name).NewWriter(wctx, opts...)
+		w.ChunkSize = 1e4
+		copyContext(ctx, w, io.LimitReader(zReader{}, 5e4+7))
+		if e.cancel {
+			wcancel()
+		}
+		if err := w.Close(); err == nil {
+			t.Errorf("%s: Close succeeded, want an error", e.name)
+		}
+		wcancel()
+		want := 0
+		if e.keep {
+			want = 1
+		}
+		if n := len(root.meta[bucketName].unfinished); n != want {
+			t.Errorf("%s: %d unfinished large files left, want %d", e.name, n, want)
+		}
+	}
+}
+
+func TestCancelUnfinishedCallback(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	root := &testRoot{
+		bucketMap: make(map[string]map[string]string),
+		errs:      &errCont{errMap: map[string]map[int]error{"uploadPart": {2: testError{}}}},
+	}
+	client := &Client{backend: &beRoot{b2i: root}}
+	bucket, err := client.NewBucket(ctx, bucketName, &BucketAttrs{Type: Private})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The callback runs without the writer's locks, and so can ask it for
+	// its error.
+	var w *Writer
+	var werr error
+	errf := func(error) { werr = w.getErr() }
+	w = bucket.Object("file").NewWriter(ctx, WithCancelOnError(func() context.Context { return ctx }, errf))
+	w.ChunkSize = 1e4
+	done := make(chan error, 1)
+	go func() {
+		copyContext(ctx, w, io.LimitReader(zReader{}, 5e4+7))
+		done <- w.Close()
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("Close succeeded, want an error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the writer deadlocked calling its cancel callback")
+	}
+	if werr == nil {
+		t.Error("the callback didn't see the writer's error")
+	}
+	if n := len(root.meta[bucketName].unfinished); n != 0 {
+		t.Errorf("%d unfinished large files left, want 0", n)
+	}
+}
+
+func TestWriterFailsFast(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	// Part 3 of 50 fails permanently, as it would if the account hit its
+	// storage cap.
+	capped := testError{}
+	root := &testRoot{
+		bucketMap: make(map[string]map[string]string),
+		errs:      &errCont{errMap: map[string]map[int]error{"uploadPart": {2: capped}}},
+	}
+	client := &Client{backend: &beRoot{b2i: root}}
+	bucket, err := client.NewBucket(ctx, bucketName, &BucketAttrs{Type: Private})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const csize = 10000
+	w := bucket.Object(largeFileName).NewWriter(ctx)
+	w.ChunkSize = csize
+	buf := make([]byte, csize/10)
+	var accepted int
+	for accepted < 50*csize {
+		n, err := w.Write(buf)
+		accepted += n
+		if err != nil {
+			if err != capped {
+				t.Errorf("Write: got %v, want the part's error", err)
+			}
+			break
+		}
+	}
+	// Parts 1 and 2 were uploaded, part 3 failed, and part 4 may have been
+	// waiting to be sent when it did.
+	if accepted > 4*csize {
+		t.Errorf("Write accepted %d bytes after part 3 failed; want at most %d", accepted, 4*csize)
+	}
+	if _, err := w.Write(buf); err != capped {
+		t.Errorf("Write after failure: got %v, want the part's error", err)
+	}
+	if err := w.Close(); err != capped {
+		t.Errorf("Close: got %v, want the part's error", err)
+	}
+	calls, _ := root.errs.opMap.Load("uploadPart")
+	if n := atomic.LoadUint32(calls.(*uint32)); n != 3 {
+		t.Errorf("%d parts were sent, want 3", n)
+	}
+}
+
+func TestWriterCloseConcurrent(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 20*time.Second)
+	defer cancel()
+
+	table := []struct {
+		name string
+		fail map[int]error // by uploadPart call
+	}{
+		{name: "ok"},
+		{name: "first part fails", fail: map[int]error{0: testError{}}},
+		{name: "later part fails", fail: map[int]error{3: testError{}}},
+	}
+
+	for _, e := range table {
+		for i := 0; i < 20; i++ {
+			root := &testRoot{
+				bucketMap: make(map[string]map[string]string),
+				errs:      &errCont{errMap: map[string]map[int]error{"uploadPart": e.fail}},
+			}
+			client := &Client{backend: &beRoot{b2i: root, options: clientOptions{clock: fakeClock()}}}
+			bucket, err := client.NewBucket(ctx, bucketName, &BucketAttrs{Type: Private})
+			if err != nil {
+				t.Fatal(err)
+			}
+			w := bucket.Object(largeFileName).NewWriter(ctx)
+			w.ChunkSize = 1e4
+			w.ConcurrentUploads = 3
+
+			writing := make(chan struct{})
+			wrote := make(chan error, 1)
+			go func() {
+				buf := make([]byte, 3e3)
+				defer close(wrote)
+				for j := 0; ; j++ {
+					if j == 2 {
+						close(writing)
+					}
+					if _, err := w.Write(buf); err != nil {
+						wrote <- err
+						return
+					}
+				}
+			}()
+			<-writing
+			if i%2 == 0 {
+				// Let some parts start, and perhaps fail.
+				time.Sleep(time.Millisecond)
+			}
+
+			errs := make(chan error, 2)
+			for j := 0; j < 2; j++ {
+				go func() { errs <- w.Close() }()
+			}
+			var got []error
+			for j := 0; j < 2; j++ {
+				select {
+				case err := <-errs:
+					got = append(got, err)
+				case <-ctx.Done():
+					t.Fatalf("%s: Close did not return", e.name)
+				}
+			}
+			if got[0] != got[1] {
+				t.Errorf("%s: concurrent Close: got %v and %v, want the same", e.name, got[0], got[1])
+			}
+			if err := w.Close(); err != got[0] {
+				t.Errorf("%s: third Close: got %v, want %v", e.name, err, got[0])
+			}
+			select {
+			case err := <-wrote:
+				want := got[0]
+				if want == nil {
+					want = ErrClosed
+				}
+				if err != want {
+					t.Errorf("%s: Write after Close: got %v, want %v", e.name, err, want)
+				}
+			case <-ctx.Done():
+				t.Fatalf("%s: Write did not return after Close", e.name)
+			}
+		}
+	}
+}
+
+func TestResumeVerify(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	const size = 1e5 + 7
+	src := make([]byte, size)
+	rand.New(rand.NewSource(1053)).Read(src)
+	want := fmt.Sprintf("%x", sha1.Sum(src))
+
+	table := []struct {
+		name    string
+		seeker  bool
+		check   func([]Part) bool
+		corrupt bool
+		resent  uint32 // parts uploaded by the resumed writer
+	}{
+		{name: "write", resent: 6},
+		{name: "write, corrupt part", corrupt: true, resent: 7},
+		{name: "seeker", seeker: true, resent: 6},
+		{name: "seeker, corrupt part", seeker: true, corrupt: true, resent: 7},
+		{name: "check refuses", check: func([]Part) bool { return false }, resent: 11},
+		{
+			name: "check accepts",
+			check: func(ps []Part) bool {
+				return len(ps) == 5 && ps[4].Number == 5 && ps[4].Size == 1e4
+			},
+			resent: 6,
+		},
+	}
+
+	for _, e := range table {
+		root := &testRoot{
+			bucketMap: make(map[string]map[string]string),
+			errs:      &errCont{errMap: map[string]map[int]error{"uploadPart": {5: testError{}}}},
+		}
+		client := &Client{backend: &beRoot{b2i: root}}
+		bucket, err := client.NewBucket(ctx, bucketName, &BucketAttrs{Type: Private})
+		if err != nil {
+			t.Fatal(err)
+		}
+		write := func(resume bool) (*Writer, error) {
+			opts := []WriterOption{KeepUnfinished()}
+			if e.check != nil {
+				opts = append(opts, ResumeCheck(e.check))
+			}
+			w := bucket.Object(largeFileName).NewWriter(ctx, opts...)
+			w.ChunkSize = 1e4
+			w.Resume = resume
+			if e.seeker {
+				_, err = w.ReadFrom(bytes.NewReader(src))
+			} else {
+				_, err = copyContext(ctx, w, bytes.NewReader(src))
+			}
+			if cerr := w.Close(); err == nil {
+				err = cerr
+			}
+			return w, err
+		}
+		if _, err := write(false); err == nil {
+			t.Errorf("%s: the first upload succeeded; it should have failed at the sixth part", e.name)
+			continue
+		}
+		if e.corrupt {
+			gmux.Lock()
+			for _, lf := range root.meta[bucketName].unfinished {
+				lf.parts[2][0] ^= 0xff
+			}
+			gmux.Unlock()
+		}
+		calls, _ := root.errs.opMap.Load("uploadPart")
+		before := atomic.LoadUint32(calls.(*uint32))
+		if _, err := write(true); err != nil {
+			t.Errorf("%s: resuming the upload: %v", e.name, err)
+			continue
+		}
+		if n := atomic.LoadUint32(calls.(*uint32)) - before; n != e.resent {
+			t.Errorf("%s: resumed writer uploaded %d parts, want %d", e.name, n, e.resent)
+		}
+		gmux.Lock()
+		got := fmt.Sprintf("%x", sha1.Sum([]byte(root.bucketMap[bucketName][largeFileName])))
+		gmux.Unlock()
+		if got != want {
+			t.Errorf("%s: got SHA1 %s, want %s", e.name, got, want)
+		}
+		if n := len(root.meta[bucketName].unfinished); n != 0 {
+			t.Errorf("%s: %d unfinished large files left", e.name, n)
+		}
+	}
+}
+
+func TestResumeNewest(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	for _, others := range []bool{false, true} {
+		root := &testRoot{
+			bucketMap: make(map[string]map[string]string),
+			errs:      &errCont{errMap: map[string]map[int]error{"uploadPart": {5: testError{}}}},
+		}
+		client := &Client{backend: &beRoot{b2i: root}}
+		bucket, err := client.NewBucket(ctx, bucketName, &BucketAttrs{Type: Private})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// An older, abandoned attempt with no parts.
+		if _, err := bucket.b.startLargeFile(ctx, largeFileName, "", nil); err != nil {
+			t.Fatal(err)
+		}
+		write := func(resume bool) (*Writer, error) {
+			opts := []WriterOption{KeepUnfinished()}
+			if others {
+				opts = append(opts, CancelOtherUnfinished())
+			}
+			w := bucket.Object(largeFileName).NewWriter(ctx, opts...)
+			w.ChunkSize = 1e4
+			w.Resume = resume
+			_, err := copyContext(ctx, w, io.LimitReader(zReader{}, 1e5+7))
+			if cerr := w.Close(); err == nil {
+				err = cerr
+			}
+			return w, err
+		}
+		if _, err := write(false); err == nil {
+			t.Fatal("the first upload succeeded; it should have failed at the sixth part")
+		}
+		w, err := write(true)
+		if err != nil {
+			t.Fatalf("resuming the upload: %v", err)
+		}
+		if len(w.seen) != 5 {
+			t.Errorf("CancelOtherUnfinished %v: resumed upload found %d parts, want 5", others, len(w.seen))
+		}
+		want := 1
+		if others {
+			want = 0
+		}
+		if n := len(root.meta[bucketName].unfinished); n != want {
+			t.Errorf("CancelOtherUnfinished %v: %d unfinished large files left, want %d", others, n, want)
+		}
+	}
+}
+
+// slowReaderAt counts how many of its ReadAt calls run at once.
+type slowReaderAt struct {
+	ra        io.ReaderAt
+	hook      func() // if set, called during each ReadAt
+	mu        sync.Mutex
+	busy, max int
+}
+
+func (s *slowReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	s.mu.Lock()
+	s.busy++
+	if s.busy > s.max {
+		s.max = s.busy
+	}
+	s.mu.Unlock()
+	if s.hook != nil {
+		s.hook()
+	}
+	time.Sleep(time.Millisecond)
+	n, err := s.ra.ReadAt(p, off)
+	s.mu.Lock()
+	s.busy--
+	s.mu.Unlock()
+	return n, err
+}
+
+func TestWriteFrom(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	table := []struct {
+		size    int64
+		opts    []WriterOption
+		errs    map[string]map[int]error
+		minBusy int
+	}{
+		{size: 0},
+		{size: 1e3},
+		{size: 1e5 + 7, minBusy: 2},
+		{size: 1e5 + 7, opts: []WriterOption{WithConcurrentUploads(1)}},
+		{size: 1e5, errs: map[string]map[int]error{"uploadPart": {2: testError{retry: true}, 7: testError{retry: true}}}, minBusy: 2},
+	}
+
+	for _, e := range table {
+		root := &testRoot{
+			bucketMap: make(map[string]map[string]string),
+			errs:      &errCont{errMap: e.errs},
+			partSize:  1e4,
+		}
+		client := &Client{backend: &beRoot{b2i: root, options: clientOptions{clock: fakeClock()}}}
+		bucket, err := client.NewBucket(ctx, bucketName, &BucketAttrs{Type: Private})
+		if err != nil {
+			t.Fatal(err)
+		}
+		src := make([]byte, e.size)
+		rand.New(rand.NewSource(e.size)).Read(src)
+		ra := &slowReaderAt{ra: bytes.NewReader(src)}
+		obj := bucket.Object(largeFileName)
+		if err := obj.WriteFrom(ctx, ra, e.size, e.opts...); err != nil {
+			t.Errorf("WriteFrom(%d bytes): %v", e.size, err)
+			continue
+		}
+		gmux.Lock()
+		got := root.bucketMap[bucketName][largeFileName]
+		gmux.Unlock()
+		if got != string(src) {
+			t.Errorf("WriteFrom(%d bytes): got %d bytes with SHA1 %x, want SHA1 %x", e.size, len(got), sha1.Sum([]byte(got)), sha1.Sum(src))
+		}
+		if ra.max < e.minBusy {
+			t.Errorf("WriteFrom(%d bytes): at most %d reads at once, want at least %d", e.size, ra.max, e.minBusy)
+		}
+		if e.minBusy == 0 && ra.max > 1 {
+			t.Errorf("WriteFrom(%d bytes): %d reads at once, want 1", e.size, ra.max)
+		}
+		attrs, err := obj.Attrs(ctx)
+		if err != nil {
+			t.Errorf("WriteFrom(%d bytes): Attrs: %v", e.size, err)
+			continue
+		}
+		if attrs.Size != e.size {
+			t.Errorf("WriteFrom(%d bytes): Attrs reports %d bytes", e.size, attrs.Size)
+		}
+	}
+}
+
+func TestPartSHA1(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	const csize = 10000
+	src := make([]byte, 5*csize+7)
+	rand.New(rand.NewSource(1056)).Read(src)
+	sum := fmt.Sprintf("%x", sha1.Sum(src))
+	sums := func(bad int) func(int, int64, int64) string {
+		return func(part int, off, size int64) string {
+			if part == bad {
+				return fmt.Sprintf("%x", sha1.Sum(nil))
+			}
+			if part == 2 {
+				return "" // computed by the writer
+			}
+			return fmt.Sprintf("%x", sha1.Sum(src[off:off+size]))
+		}
+	}
+
+	table := []struct {
+		name     string
+		size     int
+		seeker   bool
+		opts     []WriterOption
+		wantPart int // of the HashMismatchError; -1 for success
+	}{
+		{name: "small", size: 100, opts: []WriterOption{WithAttrsOption(&Attrs{SHA1: fmt.Sprintf("%x", sha1.Sum(src[:100]))})}, wantPart: -1},
+		{name: "small, bad", size: 100, opts: []WriterOption{WithAttrsOption(&Attrs{SHA1: sum})}, wantPart: 0},
+		{name: "small, seeker", size: 100, seeker: true, opts: []WriterOption{WithAttrsOption(&Attrs{SHA1: fmt.Sprintf("%x", sha1.Sum(src[:100]))})}, wantPart: -1},
+		{name: "small, part", size: 100, opts: []WriterOption{PartSHA1(sums(0))}, wantPart: -1},
+		{name: "small, bad part", size: 100, opts: []WriterOption{PartSHA1(sums(1))}, wantPart: 1},
+		{name: "large", size: len(src), opts: []WriterOption{PartSHA1(sums(0))}, wantPart: -1},
+		{name: "large, object hash", size: len(src), opts: []WriterOption{PartSHA1(sums(0)), WithAttrsOption(&Attrs{SHA1: sum})}, wantPart: -1},
+		{name: "large, file buffer", size: len(src), opts: []WriterOption{PartSHA1(sums(0)), WithFileBuffer(t.TempDir())}, wantPart: -1},
+		{name: "large, seeker", size: len(src), seeker: true, opts: []WriterOption{PartSHA1(sums(0))}, wantPart: -1},
+		{name: "large, bad part", size: len(src), opts: []WriterOption{PartSHA1(sums(4))}, wantPart: 4},
+		{name: "large, seeker, bad part", size: len(src), seeker: true, opts: []WriterOption{PartSHA1(sums(6))}, wantPart: 6},
+	}
+
+	for _, e := range table {
+		root := &testRoot{bucketMap: make(map[string]map[string]string), errs: &errCont{}}
+		client := &Client{backend: &beRoot{b2i: root}}
+		bucket, err := client.NewBucket(ctx, bucketName, &BucketAttrs{Type: Private})
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := bucket.Object(largeFileName).NewWriter(ctx, e.opts...)
+		w.ChunkSize = csize
+		if e.seeker {
+			_, err = w.ReadFrom(bytes.NewReader(src[:e.size]))
+		} else {
+			_, err = copyContext(ctx, w, bytes.NewReader(src[:e.size]))
+		}
+		if cerr := w.Close(); err == nil {
+			err = cerr
+		}
+		if e.wantPart < 0 {
+			if err != nil {
+				t.Errorf("%s: %v", e.name, err)
+				continue
+			}
+			gmux.Lock()
+			got := root.bucketMap[bucketName][largeFileName]
+			gmux.Unlock()
+			if got != string(src[:e.size]) {
+				t.Errorf("%s: got %d bytes with SHA1 %x, want %d with SHA1 %x", e.name, len(got), sha1.Sum([]byte(got)), e.size, sha1.Sum(src[:e.size]))
+			}
+			continue
+		}
+		var herr *HashMismatchError
+		if !errors.As(err, &herr) {
+			t.Errorf("%s: got error %v, want a *HashMismatchError", e.name, err)
+			continue
+		}
+		if herr.Part != e.wantPart || herr.Name != largeFileName {
+			t.Errorf("%s: got mismatch of part %d of %q, want part %d of %q", e.name, herr.Part, herr.Name, e.wantPart, largeFileName)
+		}
+	}
+}
+
+func TestSemaphore(t *testing.T) {
+	ctx := context.Background()
+	s := newSemaphore(3)
+	if err := s.acquire(ctx, 2); err != nil {
+		t.Fatal(err)
+	}
+	got := make(chan int64, 2)
+	go func() {
+		s.acquire(ctx, 3)
+		got <- 3
+	}()
+	for s.status().Waiting != 1 {
+		runtime.Gosched()
+	}
+	// Queued behind the request for 3, even though 1 is free.
+	cctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	if err := s.acquire(cctx, 1); err != context.DeadlineExceeded {
+		t.Errorf("acquire(1) behind a waiter: got %v, want %v", err, context.DeadlineExceeded)
+	}
+	cancel()
+	if st := s.status(); st.Waiting != 1 || st.InUse != 2 {
+		t.Errorf("after a canceled acquire: %+v", st)
+	}
+	s.release(2)
+	if n := <-got; n != 3 {
+		t.Fatal(n)
+	}
+	if st := s.status(); st.Waiting != 0 || st.InUse != 3 || st.Limit != 3 {
+		t.Errorf("after release: %+v", st)
+	}
+	s.release(3)
+	if n := s.clamp(5); n != 3 {
+		t.Errorf("clamp(5) = %d, want 3", n)
+	}
+	var nilSem *semaphore
+	if err := nilSem.acquire(ctx, 100); err != nil || nilSem.status() != nil {
+		t.Errorf("nil semaphore: %v, %v", err, nilSem.status())
+	}
+}
+
+func TestTransferLimit(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	root := &testRoot{bucketMap: make(map[string]map[string]string), errs: &errCont{}, partSize: 1e4}
+	client := &Client{backend: &beRoot{b2i: root}}
+	MaxTransferConcurrency(2)(&client.opts)
+	bucket, err := client.NewBucket(ctx, bucketName, &BucketAttrs{Type: Private})
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := make([]byte, 1e5)
+	ra := &slowReaderAt{ra: bytes.NewReader(src)}
+	var mu sync.Mutex
+	var waited int
+	ra.hook = func() {
+		st := client.Status()
+		mu.Lock()
+		defer mu.Unlock()
+		if st.Transfers.Waiting > waited {
+			waited = st.Transfers.Waiting
+		}
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := bucket.Object(fmt.Sprintf("obj%d", i)).WriteFrom(ctx, ra, int64(len(src))); err != nil {
+				t.Errorf("WriteFrom: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if ra.max > 2 {
+		t.Errorf("%d parts sent at once, want at most 2", ra.max)
+	}
+	if waited == 0 {
+		t.Error("Status never reported parts waiting for MaxTransferConcurrency")
+	}
+	if st := client.Status().Transfers; st.InUse != 0 || st.Waiting != 0 {
+		t.Errorf("transfers left in use: %+v", st)
+	}
+}
+
+func TestBufferLimit(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	const csize = 10000
+	root := &testRoot{bucketMap: make(map[string]map[string]string), errs: &errCont{}, partSize: csize}
+	client := &Client{backend: &beRoot{b2i: root}}
+	MaxBufferedBytes(csize)(&client.opts)
+	bucket, err := client.NewBucket(ctx, bucketName, &BucketAttrs{Type: Private})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// One writer's partial chunk takes all there is.
+	a := bucket.Object("a").NewWriter(ctx)
+	if _, err := a.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	bctx, bcancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	b := bucket.Object("b").NewWriter(bctx)
+	done := make(chan error)
+	go func() {
+		_, err := b.Write([]byte("world"))
+		done <- err
+	}()
+	for client.Status().Buffered.Waiting == 0 {
+		runtime.Gosched()
+	}
+	if st := client.Status().Writers["b2-tests/b"]; st == nil || st.Waiting != 1 {
+		t.Errorf("writer status: got %+v, want one waiting", st)
+	}
+	if err := <-done; err != context.DeadlineExceeded {
+		t.Errorf("Write beyond MaxBufferedBytes: got %v, want %v", err, context.DeadlineExceeded)
+	}
+	b.Close()
+	bcancel()
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Writers take turns.
+	var wg sync.WaitGroup
+	src := make([]byte, 10*csize+7)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			w := bucket.Object(fmt.Sprintf("obj%d", i)).NewWriter(ctx)
+			w.ConcurrentUploads = 2
+			_, err := copyContext(ctx, w, bytes.NewReader(src))
+			if cerr := w.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				t.Errorf("writer %d: %v", i, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	for i := 0; i < 4; i++ {
+		gmux.Lock()
+		n := len(root.bucketMap[bucketName][fmt.Sprintf("obj%d", i)])
+		gmux.Unlock()
+		if n != len(src) {
+			t.Errorf("obj%d: got %d bytes, want %d", i, n, len(src))
+		}
+	}
+	if st := client.Status().Buffered; st.InUse != 0 || st.Waiting != 0 {
+		t.Errorf("buffer space left in use: %+v", st)
+	}
+}
+
+func TestRateLimits(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	const (
+		rate = 5e5
+		size = 1e5
+	)
+	root := &testRoot{bucketMap: make(map[string]map[string]string), errs: &errCont{}, partSize: 1e4}
+	client := &Client{backend: &beRoot{b2i: root}}
+	UploadRateLimit(rate)(&client.opts)
+	DownloadRateLimit(rate)(&client.opts)
+	bucket, err := client.NewBucket(ctx, bucketName, &BucketAttrs{Type: Private})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Two transfers at once, each with two parts or chunks at once, are held
+	// to the one limit, less what accumulates to begin with.
+	const want = (2*size - rate/10) / rate * float64(time.Second)
+	each := func(f func(name string) error) time.Duration {
+		start := time.Now()
+		var wg sync.WaitGroup
+		for i := 0; i < 2; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				if err := f(fmt.Sprintf("obj%d", i)); err != nil {
+					t.Errorf("%s: %v", fmt.Sprintf("obj%d", i), err)
+				}
+			}(i)
+		}
+		wg.Wait()
+		return time.Since(start)
+	}
+
+	up := each(func(name string) error {
+		w := bucket.Object(name).NewWriter(ctx)
+		w.ChunkSize = 1e4
+		w.ConcurrentUploads = 2
+		_, err := io.Copy(w, io.LimitReader(zReader{}, size))
+		if cerr := w.Close(); err == nil {
+			err = cerr
+		}
+		return err
+	})
+	if up < time.Duration(want*0.9) {
+		t.Errorf("uploads took %v, want at least %v", up, time.Duration(want))
+	}
+
+	down := each(func(name string) error {
+		r := bucket.Object(name).NewReader(ctx)
+		defer r.Close()
+		r.ChunkSize = 1e4
+		r.ConcurrentDownloads = 2
+		n, err := io.Copy(ioutil.Discard, r)
+		if err == nil && n != size {
+			err = fmt.Errorf("read %d bytes, want %d", n, int64(size))
+		}
+		return err
+	})
+	if down < time.Duration(want*0.9) {
+		t.Errorf("downloads took %v, want at least %v", down, time.Duration(want))
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	ctx := context.Background()
+	var nilBucket *tokenBucket
+	if err := nilBucket.take(ctx, 1e9); err != nil {
+		t.Errorf("nil bucket: %v", err)
+	}
+	r := resetter{strings.NewReader("x")}
+	if got := nilBucket.throttle(ctx, r); got != readResetter(r) {
+		t.Errorf("nil bucket: throttle returned %#v, want the reader itself", got)
+	}
+
+	tb := newTokenBucket(1000, systemClock{})
+	// What accumulates is taken at once, and then there is a debt to wait
+	// out, however much is asked for at a time.
+	if err := tb.take(ctx, 100); err != nil {
+		t.Fatal(err)
+	}
+	cctx, ccancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer ccancel()
+	if err := tb.take(cctx, 1000); err != context.DeadlineExceeded {
+		t.Errorf("taking a second's worth: got %v, want %v", err, context.DeadlineExceeded)
+	}
+	tb = newTokenBucket(1e5, systemClock{})
+	tr := tb.throttle(ctx, resetter{strings.NewReader(strings.Repeat("x", 2*tb.max))})
+	if n, err := tr.Read(make([]byte, 2*tb.max)); n != tb.max || err != nil {
+		t.Errorf("throttled Read: got %d, %v; want %d, nil", n, err, tb.max)
+	}
+}
+
+func TestVerifyParts(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	const csize = 10000
+	src := make([]byte, 5*csize+7)
+	rand.New(rand.NewSource(1058)).Read(src)
+
+	table := []struct {
+		name       string
+		seeker     bool
+		errs       map[int]error
+		missing    []int
+		mismatched []int
+	}{
+		{name: "ok"},
+		{name: "ok, seeker", seeker: true},
+		{name: "lost", errs: map[int]error{2: testError{lost: true}}, missing: []int{3}},
+		{name: "garbled", errs: map[int]error{1: testError{garbled: true}, 4: testError{garbled: true}}, mismatched: []int{2, 5}},
+		{name: "garbled, seeker", seeker: true, errs: map[int]error{5: testError{garbled: true}}, mismatched: []int{6}},
+	}
+	for _, e := range table {
+		root := &testRoot{
+			bucketMap: make(map[string]map[string]string),
+			errs:      &errCont{errMap: map[string]map[int]error{"uploadPart": e.errs}},
+		}
+		client := &Client{backend: &beRoot{b2i: root}}
+		bucket, err := client.NewBucket(ctx, bucketName, &BucketAttrs{Type: Private})
+		if err != nil {
+			t.Fatal(err)
+		}
+		write := func(resume bool) error {
+			w := bucket.Object(largeFileName).NewWriter(ctx, VerifyParts())
+			w.ChunkSize = csize
+			w.Resume = resume
+			if e.seeker {
+				_, err = w.ReadFrom(bytes.NewReader(src))
+			} else {
+				_, err = copyContext(ctx, w, bytes.NewReader(src))
+			}
+			if cerr := w.Close(); err == nil {
+				err = cerr
+			}
+			return err
+		}
+		err = write(false)
+		calls, _ := root.errs.opMap.Load("listParts")
+		if n := atomic.LoadUint32(calls.(*uint32)); n != 1 {
+			t.Errorf("%s: %d calls to b2_list_parts, want 1", e.name, n)
+		}
+		if e.missing == nil && e.mismatched == nil {
+			if err != nil {
+				t.Errorf("%s: %v", e.name, err)
+			}
+			continue
+		}
+		var perr *PartsError
+		if !errors.As(err, &perr) {
+			t.Errorf("%s: got error %v, want a *PartsError", e.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(perr.Missing, e.missing) || !reflect.DeepEqual(perr.Mismatched, e.mismatched) || perr.Extra != nil {
+			t.Errorf("%s: got missing %v, mismatched %v, extra %v; want missing %v, mismatched %v", e.name, perr.Missing, perr.Mismatched, perr.Extra, e.missing, e.mismatched)
+		}
+		if n := len(root.meta[bucketName].unfinished); n != 1 {
+			t.Errorf("%s: %d unfinished large files, want 1 left for Resume", e.name, n)
+			continue
+		}
+		if err := write(true); err != nil {
+			t.Errorf("%s: resuming: %v", e.name, err)
+			continue
+		}
+		gmux.Lock()
+		got := root.bucketMap[bucketName][largeFileName]
+		gmux.Unlock()
+		if got != string(src) {
+			t.Errorf("%s: resumed upload has SHA1 %x, want %x", e.name, sha1.Sum([]byte(got)), sha1.Sum(src))
+		}
+	}
+}
+
+func TestReaderChunkSizing(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	root := &testRoot{
+		bucketMap: make(map[string]map[string]string),
+		errs:      &errCont{},
+	}
+	client := &Client{backend: &beRoot{b2i: root}}
+	bucket, err := client.NewBucket(ctx, bucketName, &BucketAttrs{Type: Private})
+	if err != nil {
+		t.Fatal(err)
+	}
+	upload := func(name string, size int64) *Object {
+		obj := bucket.Object(name)
+		w := obj.NewWriter(ctx)
+		if _, err := io.Copy(w, io.LimitReader(zReader{}, size)); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return obj
+	}
+	small := upload("small", 10e6)
+	large := upload("large", 40e6)
+
+	table := []struct {
+		name       string
+		r          func() *Reader
+		size       int64
+		chunkSize  int
+		concurrent int
+		reqs       int // body requests
+		wantSize   int
+		wantConc   int
+	}{
+		{
+			name:       "small",
+			r:          func() *Reader { return small.NewReader(ctx) },
+			size:       10e6,
+			concurrent: 4,
+			reqs:       1,
+			wantSize:   16 << 20,
+			wantConc:   1,
+		},
+		{
+			// 16MB, then the remaining 24MB in 16MB chunks.
+			name:       "large",
+			r:          func() *Reader { return large.NewReader(ctx) },
+			size:       40e6,
+			concurrent: 4,
+			reqs:       3,
+			wantSize:   16 << 20,
+			wantConc:   3,
+		},
+		{
+			// io.Copy streams the object in one request with WriteTo.
+			name:       "large, one at a time",
+			r:          func() *Reader { return large.NewReader(ctx) },
+			size:       40e6,
+			concurrent: 1,
+			reqs:       1,
+			wantConc:   1,
+		},
+		{
+			name:       "range",
+			r:          func() *Reader { return large.NewRangeReader(ctx, 30e6, 5e6) },
+			size:       5e6,
+			concurrent: 4,
+			reqs:       1,
+			wantSize:   16 << 20,
+			wantConc:   1,
+		},
+		{
+			name:       "explicit",
+			r:          func() *Reader { return small.NewReader(ctx) },
+			size:       10e6,
+			chunkSize:  3e6,
+			concurrent: 2,
+			reqs:       4,
+			wantSize:   3e6,
+			wantConc:   2,
+		},
+	}
+	for _, e := range table {
+		root.errs.errMap = map[string]map[int]error{}
+		root.errs.opMap = sync.Map{}
+		r := e.r()
+		r.ChunkSize = e.chunkSize
+		r.ConcurrentDownloads = e.concurrent
+		n, err := io.Copy(ioutil.Discard, r)
+		if err != nil {
+			t.Errorf("%s: %v", e.name, err)
+		} else if n != e.size {
+			t.Errorf("%s: read %d bytes, want %d", e.name, n, e.size)
+		}
+		rs := r.status()
+		if err := r.Close(); err != nil {
+			t.Errorf("%s: Close: %v", e.name, err)
+		}
+		if rs.ChunkSize != e.wantSize || rs.Concurrency != e.wantConc {
+			t.Errorf("%s: got chunk size %d and concurrency %d, want %d and %d", e.name, rs.ChunkSize, rs.Concurrency, e.wantSize, e.wantConc)
+		}
+		var reqs uint32
+		if v, ok := root.errs.opMap.Load("readBody"); ok {
+			reqs = atomic.LoadUint32(v.(*uint32))
+		}
+		if int(reqs) != e.reqs {
+			t.Errorf("%s: got %d requests, want %d", e.name, reqs, e.reqs)
+		}
+	}
+}
+
+func TestLatencyHistogram(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	rt := &refusingTransport{
+		method: "b2_create_bucket",
+		busy:   2,
+		status: http.StatusOK,
+		body:   `{"bucketId": "id", "bucketName": "bucket", "bucketType": "allPrivate"}`,
+	}
+	client, err := NewClient(ctx, "id", "key", Transport(rt),
+		WithRetryPolicy(RetryPolicy{InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.NewBucket(ctx, "bucket", &BucketAttrs{Type: Private}); err != nil {
+		t.Fatal(err)
+	}
+	lat := client.Status().Latency
+	for method, want := range map[string]uint64{
+		"b2_authorize_account": 1,
+		"b2_create_bucket":     3,
+	} {
+		h, ok := lat[method]
+		if !ok {
+			t.Errorf("%s: no latency recorded", method)
+			continue
+		}
+		if h.Count != want {
+			t.Errorf("%s: got %d durations, want %d", method, h.Count, want)
+		}
+		var n uint64
+		for _, c := range h.Counts {
+			n += c
+		}
+		if n != h.Count {
+			t.Errorf("%s: buckets count %d durations, want %d", method, n, h.Count)
+		}
+	}
+	client.ResetLatency()
+	if lat := client.Status().Latency; len(lat) != 0 {
+		t.Errorf("after ResetLatency: got %v, want none", lat)
+	}
+
+	lc := &latencyCounter{}
+	for _, d := range []time.Duration{5 * time.Millisecond, 20 * time.Millisecond, 30 * time.Millisecond, 40 * time.Millisecond, 2 * time.Minute} {
+		lc.record(d)
+	}
+	h := lc.histogram()
+	if h.Count != 5 || h.Sum != 2*time.Minute+95*time.Millisecond {
+		t.Errorf("got %d durations summing to %v, want 5 summing to %v", h.Count, h.Sum, 2*time.Minute+95*time.Millisecond)
+	}
+	if h.Counts[0] != 1 || h.Counts[1] != 1 || h.Counts[2] != 2 || h.Counts[len(h.Bounds)] != 1 {
+		t.Errorf("got counts %v", h.Counts)
+	}
+	for _, e := range []struct {
+		p    float64
+		want time.Duration
+	}{
+		{0, 0},
+		{20, 10 * time.Millisecond},
+		{40, 25 * time.Millisecond},
+		{60, 37500 * time.Microsecond},
+		{80, 50 * time.Millisecond},
+		{100, 60 * time.Second},
+	} {
+		if got := h.Percentile(e.p); got != e.want {
+			t.Errorf("Percentile(%v): got %v, want %v", e.p, got, e.want)
+		}
+	}
+}
+
+func TestRetryLogging(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	rt := &refusingTransport{
+		method: "b2_create_bucket",
+		busy:   2,
+		status: http.StatusOK,
+		body:   `{"bucketId": "id", "bucketName": "bucket", "bucketType": "allPrivate"}`,
+	}
+	l := &testLogger{max: 1}
+	client, err := NewClient(ctx, "id", "key", Transport(rt), WithLogger(l),
+		WithRetryPolicy(RetryPolicy{InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.NewBucket(ctx, "bucket", &BucketAttrs{Type: Private}); err != nil {
+		t.Fatal(err)
+	}
+	if len(l.msgs) != 2 {
+		t.Fatalf("got %q, want a message for each retry", l.msgs)
+	}
+	for i, msg := range l.msgs {
+		want := fmt.Sprintf("1: b2_create_bucket: attempt %d failed (service_unavailable); retrying in ", i+1)
+		if !strings.HasPrefix(msg, want) {
+			t.Errorf("message %d: got %q, want prefix %q", i, msg, want)
+		}
+	}
+	if got := client.Status().Retries; !reflect.DeepEqual(got, map[string]int64{"b2_create_bucket": 2}) {
+		t.Errorf("Retries: got %v, want 2 of b2_create_bucket", got)
+	}
+}
+
+// calls returns the number of calls to op that errs has seen.
+func (e *errCont) calls(op string) int {
+	v, ok := e.opMap.Load(op)
+	if !ok {
+		return 0
+	}
+	return int(atomic.LoadUint32(v.(*uint32)))
+}
+
+func TestUploadURLPool(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	table := []struct {
+		name  string
+		opts  []ClientOption
+		calls int // to b2_get_upload_url
+	}{
+		{
+			// The third upload fails, and its URL is discarded.
+			name:  "default",
+			calls: 2,
 		},
+		{
+			name:  "off",
+			opts:  []ClientOption{UploadURLPool(-1, 0)},
+			calls: 4,
+		},
+		{
+			name:  "expired",
+			opts:  []ClientOption{UploadURLPool(0, time.Nanosecond)},
+			calls: 4,
+		},
+	}
+	for _, e := range table {
+		root := &testRoot{
+			bucketMap: make(map[string]map[string]string),
+			errs:      &errCont{errMap: map[string]map[int]error{"uploadFile": {2: testError{reupload: true}}}},
+		}
+		be := &beRoot{b2i: root}
+		opts := append(e.opts, WithRetryPolicy(RetryPolicy{MaxAttempts: 1}))
+		client := &Client{backend: be}
+		for _, o := range opts {
+			o(&client.opts)
+			o(&be.options)
+		}
+		b1, err := client.NewBucket(ctx, bucketName, &BucketAttrs{Type: Private})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Buckets for the same bucket share their URLs.
+		b2, err := client.Bucket(ctx, bucketName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, bucket := range []*Bucket{b1, b2, b2, b1} {
+			_, _, err := writeFile(ctx, bucket, fmt.Sprintf("obj%d", i), 10, 1e5)
+			if (err != nil) != (i == 2) {
+				t.Errorf("%s: upload %d: %v", e.name, i, err)
+			}
+		}
+		if got := root.errs.calls("getUploadURL"); got != e.calls {
+			t.Errorf("%s: got %d calls to getUploadURL, want %d", e.name, got, e.calls)
+		}
 	}
+}
+
+func TestPartURLPool(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
 
+	root := &testRoot{
+		bucketMap: make(map[string]map[string]string),
+		errs:      &errCont{errMap: map[string]map[int]error{"uploadPart": {1: testError{}}}},
+	}
+	client := &Client{backend: &beRoot{b2i: root}}
 	bucket, err := client.NewBucket(ctx, bucketName, &BucketAttrs{Type: Private})
 	if err != nil {
 		t.Fatal(err)
 	}
-	w := bucket.Object("test").NewWriter(ctx)
-	r := io.LimitReader(zReader{}, 1e7)
-	w.ChunkSize = 1e4
-	w.ConcurrentUploads = 4
-	if _, err := io.Copy(w, r); err == nil {
-		t.Fatalf("io.Copy: should have returned an error")
+	write := func(opts ...WriterOption) error {
+		w := bucket.Object("large").NewWriter(ctx, opts...)
+		w.ChunkSize = 1e4
+		w.ConcurrentUploads = 1
+		w.Resume = true
+		_, err := io.Copy(w, io.LimitReader(zReader{}, 3e4))
+		if cerr := w.Close(); err == nil {
+			err = cerr
+		}
+		return err
+	}
+	// The second part fails, but B2 didn't ask for a new URL, and so the
+	// Writer that resumes the file uses the first's.
+	if err := write(KeepUnfinished()); err == nil {
+		t.Fatal("first write: got no error")
+	}
+	if err := write(); err != nil {
+		t.Fatal(err)
+	}
+	if got := root.errs.calls("getUploadPartURL"); got != 1 {
+		t.Errorf("got %d calls to getUploadPartURL, want 1", got)
+	}
+	var pools int
+	client.partPools.Range(func(interface{}, interface{}) bool {
+		pools++
+		return true
+	})
+	if pools != 0 {
+		t.Errorf("%d part URL pools left after the file was finished", pools)
 	}
 }
 
-func TestFileBuffer(t *testing.T) {
-	r := io.LimitReader(zReader{}, 1e8)
-	w, err := newFileBuffer("")
+func TestPartURLPoolExpiry(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	root := &testRoot{
+		bucketMap: make(map[string]map[string]string),
+		errs:      &errCont{errMap: map[string]map[int]error{"uploadPart": {1: testError{}}}},
+	}
+	clock := fakeClock()
+	client := &Client{backend: &beRoot{b2i: root}, opts: clientOptions{clock: clock}}
+	bucket, err := client.NewBucket(ctx, bucketName, &BucketAttrs{Type: Private})
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer w.Close()
-	if _, err := io.Copy(w, r); err != nil {
+	write := func(name string, opts ...WriterOption) error {
+		w := bucket.Object(name).NewWriter(ctx, opts...)
+		w.ChunkSize = 1e4
+		w.ConcurrentUploads = 1
+		_, err := io.Copy(w, io.LimitReader(zReader{}, 3e4))
+		if cerr := w.Close(); err == nil {
+			err = cerr
+		}
+		return err
+	}
+	pools := func() int {
+		var n int
+		client.partPools.Range(func(interface{}, interface{}) bool {
+			n++
+			return true
+		})
+		return n
+	}
+	// The large file is kept unfinished, and so is its pool, until it has
+	// gone unused for longer than its URLs are kept.
+	if err := write("kept", KeepUnfinished()); err == nil {
+		t.Fatal("first write: got no error")
+	}
+	if n := pools(); n != 1 {
+		t.Fatalf("%d part URL pools after keeping a file unfinished, want 1", n)
+	}
+	clock.Advance(uploadURLPoolIdle)
+	if err := write("other"); err != nil {
 		t.Fatal(err)
 	}
-	bReader, err := w.Reader()
+	if n := pools(); n != 0 {
+		t.Errorf("%d part URL pools left after the unfinished file's expired", n)
+	}
+}
+
+func TestTransportOptions(t *testing.T) {
+	c := newClient(nil)
+	tr, ok := c.opts.transport.(*http.Transport)
+	if !ok {
+		t.Fatalf("got a %T, want an *http.Transport", c.opts.transport)
+	}
+	if tr.MaxIdleConnsPerHost != 32 || tr.TLSHandshakeTimeout != 10*time.Second || tr.ResponseHeaderTimeout != 0 || tr.Proxy == nil {
+		t.Errorf("default: got %d idle conns per host, TLS handshake timeout %v, response header timeout %v, proxy %v",
+			tr.MaxIdleConnsPerHost, tr.TLSHandshakeTimeout, tr.ResponseHeaderTimeout, tr.Proxy != nil)
+	}
+
+	proxy, err := url.Parse("http://proxy.example.com:3128")
 	if err != nil {
 		t.Fatal(err)
 	}
-	hsh := sha1.New()
-	if _, err := io.Copy(hsh, bReader); err != nil {
+	c = newClient([]ClientOption{
+		MaxIdleConnsPerHost(200),
+		DialTimeout(time.Second),
+		TLSHandshakeTimeout(2 * time.Second),
+		ResponseHeaderTimeout(3 * time.Second),
+		Proxy(http.ProxyURL(proxy)),
+	})
+	tr = c.opts.transport.(*http.Transport)
+	if tr.MaxIdleConnsPerHost != 200 || tr.MaxIdleConns < 200 || tr.TLSHandshakeTimeout != 2*time.Second || tr.ResponseHeaderTimeout != 3*time.Second {
+		t.Errorf("tuned: got %d idle conns per host of %d, TLS handshake timeout %v, response header timeout %v",
+			tr.MaxIdleConnsPerHost, tr.MaxIdleConns, tr.TLSHandshakeTimeout, tr.ResponseHeaderTimeout)
+	}
+	req, err := http.NewRequest("GET", "https://api.backblazeb2.com/", nil)
+	if err != nil {
 		t.Fatal(err)
 	}
-	hshText := fmt.Sprintf("%x", hsh.Sum(nil))
-	if hshText != w.Hash() {
-		t.Errorf("hashes are not equal: bufferWriter is %q, read buffer is %q", w.Hash(), hshText)
+	if got, err := tr.Proxy(req); err != nil || got.String() != proxy.String() {
+		t.Errorf("proxy: got %v, %v, want %v", got, err, proxy)
+	}
+	if c := newClient([]ClientOption{Proxy(nil)}); c.opts.transport.(*http.Transport).Proxy != nil {
+		t.Error("Proxy(nil): got a proxy")
+	}
+
+	rt := &refusingTransport{}
+	if c := newClient([]ClientOption{Transport(rt), MaxIdleConnsPerHost(200)}); c.opts.transport != rt {
+		t.Errorf("Transport: got %v, want the given transport", c.opts.transport)
 	}
 }
 
-func TestNonBuffer(t *testing.T) {
+// publicBucket is a bucket whose type is allPublic.
+type publicBucket struct {
+	b2BucketInterface
+}
+
+func (p *publicBucket) attrs() *BucketAttrs { return &BucketAttrs{Type: Public} }
+
+func TestHTTPHandler(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	client := &Client{
+		backend: &beRoot{
+			b2i: &testRoot{
+				bucketMap: make(map[string]map[string]string),
+				errs:      &errCont{},
+			},
+		},
+	}
+	bucket, err := client.NewBucket(ctx, bucketName, &BucketAttrs{Type: Private})
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"site/index.html": "<p>hello</p>",
+		"site/docs/a.txt": "0123456789",
+		"other":           "not served",
+	}
+	for name, body := range files {
+		w := bucket.Object(name).NewWriter(ctx)
+		if _, err := io.WriteString(w, body); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	etag := fmt.Sprintf(`"%x"`, sha1.Sum([]byte(files["site/docs/a.txt"])))
+	pub := *bucket
+	pub.b = &beBucket{
+		b2bucket: &publicBucket{bucket.b.(*beBucket).b2bucket},
+		ri:       client.backend,
+	}
+
+	private := HTTPHandler(bucket, "site/", HandlerCacheControl("max-age=60"), HandlerIndex())
+	listed := HTTPHandler(bucket, "site/", HandlerIndex(), HandlerListPrivate())
+	public := HTTPHandler(&pub, "site/", HandlerIndex())
+	unlisted := HTTPHandler(&pub, "site/")
+
 	table := []struct {
-		str  string
-		off  int64
-		len  int64
-		want string
+		name    string
+		h       http.Handler
+		method  string
+		path    string
+		header  map[string]string
+		code    int
+		body    string // if set, the body must contain it
+		wantHdr map[string]string
 	}{
 		{
-			str:  "a string",
-			off:  0,
-			len:  3,
-			want: "a s",
+			name: "get",
+			h:    private,
+			path: "/index.html",
+			code: http.StatusOK,
+			body: "<p>hello</p>",
+			wantHdr: map[string]string{
+				"Content-Length": "12",
+				"Cache-Control":  "max-age=60",
+			},
 		},
 		{
-			str:  "a string",
-			off:  3,
-			len:  1,
-			want: "t",
+			name:    "range",
+			h:       private,
+			path:    "/docs/a.txt",
+			header:  map[string]string{"Range": "bytes=2-4"},
+			code:    http.StatusPartialContent,
+			body:    "234",
+			wantHdr: map[string]string{"Content-Range": "bytes 2-4/10", "ETag": etag},
 		},
 		{
-			str:  "a string",
-			off:  3,
-			len:  5,
-			want: "tring",
+			name:    "head",
+			h:       private,
+			method:  http.MethodHead,
+			path:    "/docs/a.txt",
+			code:    http.StatusOK,
+			wantHdr: map[string]string{"Content-Length": "10"},
+		},
+		{
+			name:   "not modified",
+			h:      private,
+			path:   "/docs/a.txt",
+			header: map[string]string{"If-None-Match": etag},
+			code:   http.StatusNotModified,
+		},
+		{
+			name: "missing",
+			h:    private,
+			path: "/nope",
+			code: http.StatusNotFound,
+		},
+		{
+			name: "outside the prefix",
+			h:    private,
+			path: "/other",
+			code: http.StatusNotFound,
+		},
+		{
+			name:    "post",
+			h:       private,
+			method:  http.MethodPost,
+			path:    "/index.html",
+			code:    http.StatusMethodNotAllowed,
+			wantHdr: map[string]string{"Allow": "GET, HEAD"},
+		},
+		{
+			name: "private index",
+			h:    private,
+			path: "/",
+			code: http.StatusNotFound,
+		},
+		{
+			name: "private directory",
+			h:    private,
+			path: "/docs",
+			code: http.StatusNotFound,
+		},
+		{
+			name: "listed private index",
+			h:    listed,
+			path: "/",
+			code: http.StatusOK,
+			body: `<li><a href="docs/">docs/</a></li>
+<li><a href="index.html">index.html</a> (12 bytes)</li>`,
+			wantHdr: map[string]string{"Content-Type": "text/html; charset=utf-8"},
+		},
+		{
+			name:    "public directory",
+			h:       public,
+			path:    "/docs",
+			code:    http.StatusMovedPermanently,
+			wantHdr: map[string]string{"Location": "docs/"},
+		},
+		{
+			name: "public index",
+			h:    public,
+			path: "/docs/",
+			code: http.StatusOK,
+			body: `<li><a href="a.txt">a.txt</a> (10 bytes)</li>`,
+		},
+		{
+			name: "empty index",
+			h:    public,
+			path: "/empty/",
+			code: http.StatusNotFound,
+		},
+		{
+			name: "without HandlerIndex",
+			h:    unlisted,
+			path: "/",
+			code: http.StatusNotFound,
 		},
 	}
-
 	for _, e := range table {
-		nb := newNonBuffer(strings.NewReader(e.str), e.off, e.len)
-		want := fmt.Sprintf("%s%x", e.want, sha1.Sum([]byte(e.str[int(e.off):int(e.off+e.len)])))
-		r, err := nb.Reader()
-		if err != nil {
-			t.Error(err)
-			continue
+		method := e.method
+		if method == "" {
+			method = http.MethodGet
 		}
-		got, err := ioutil.ReadAll(r)
-		if err != nil {
-			t.Errorf("ioutil.ReadAll(%#v): %v", e, err)
-			continue
+		req := httptest.NewRequest(method, e.path, nil).WithContext(ctx)
+		for k, v := range e.header {
+			req.Header.Set(k, v)
 		}
-		if want != string(got) {
-			t.Errorf("ioutil.ReadAll(%#v): got %q, want %q", e, string(got), want)
+		rec := httptest.NewRecorder()
+		e.h.ServeHTTP(rec, req)
+		if rec.Code != e.code {
+			t.Errorf("%s: got status %d, want %d", e.name, rec.Code, e.code)
+		}
+		if body := rec.Body.String(); !strings.Contains(body, e.body) {
+			t.Errorf("%s: got body %q, want it to contain %q", e.name, body, e.body)
+		}
+		if method == http.MethodHead && rec.Body.Len() != 0 {
+			t.Errorf("%s: got %d bytes of body, want none", e.name, rec.Body.Len())
+		}
+		for k, v := range e.wantHdr {
+			if got := rec.Header().Get(k); got != v {
+				t.Errorf("%s: got %s %q, want %q", e.name, k, got, v)
+			}
 		}
 	}
 }
 
-func writeFile(ctx context.Context, bucket *Bucket, name string, size int64, csize int) (*Object, string, error) {
-	r := io.LimitReader(zReader{}, size)
-	o := bucket.Object(name)
-	f := o.NewWriter(ctx)
-	h := sha1.New()
-	w := io.MultiWriter(f, h)
-	f.ConcurrentUploads = 5
-	f.ChunkSize = csize
-	n, err := io.Copy(w, r)
-	if err != nil {
-		return nil, "", err
+// stressVar, if set to a duration such as "60s", makes TestWriterStress run
+// for that long rather than for a single round.
+const stressVar = "B2_WRITER_STRESS"
+
+// TestWriterStress runs many concurrent Writers, with several uploads each,
+// against a b2test.Server whose requests fail intermittently, while the
+// client's Status is watched.  It is meant to be run with -race.
+func TestWriterStress(t *testing.T) {
+	var d time.Duration
+	if v := os.Getenv(stressVar); v != "" {
+		var err error
+		if d, err = time.ParseDuration(v); err != nil {
+			t.Fatalf("%s: %v", stressVar, err)
+		}
 	}
-	if n != size {
-		return nil, "", fmt.Errorf("io.Copy(): wrote %d bytes; wanted %d bytes", n, size)
+	ctx, cancel := context.WithTimeout(context.Background(), d+time.Minute)
+	defer cancel()
+
+	srv := b2test.NewServer(b2test.PartSizes(1e3, 1e3))
+	defer srv.Close()
+	ft := b2test.NewFaultTransport(nil)
+	id, key := srv.Credentials()
+	client, err := NewClient(ctx, id, key, APIBase(srv.URL), Transport(ft), WithClock(fakeClock()))
+	if err != nil {
+		t.Fatal(err)
 	}
-	if err := f.Close(); err != nil {
-		return nil, "", err
+	bucket, err := client.NewBucket(ctx, bucketName, nil)
+	if err != nil {
+		t.Fatal(err)
 	}
-	return o, fmt.Sprintf("%x", h.Sum(nil)), nil
-}
 
-func readFile(ctx context.Context, obj *Object, sha string, chunk, concur int) error {
-	r := obj.NewReader(ctx)
-	r.ChunkSize = chunk
-	r.ConcurrentDownloads = concur
-	h := sha1.New()
-	if _, err := io.Copy(h, r); err != nil {
-		return err
-	}
-	if err := r.Close(); err != nil {
-		return err
+	busy := &b2test.Error{Status: http.StatusServiceUnavailable, Code: "service_unavailable", Message: "busy"}
+	bad := &b2test.Error{Status: http.StatusBadRequest, Code: "bad_request", Message: "no"}
+	faults := []b2test.Fault{
+		{Error: busy},
+		{DropRequest: true, DropAfter: 100},
+		{DropResponse: true},
+		{Delay: time.Millisecond},
+		{Error: bad},
+		{CorruptSHA1: true},
 	}
-	rsha := fmt.Sprintf("%x", h.Sum(nil))
-	if sha != rsha {
-		return fmt.Errorf("bad hash: got %s, want %s", rsha, sha)
+
+	const writers = 200
+	const (
+		copied   = iota // with io.Copy, which buffers the parts
+		written         // with Write
+		streamed        // with ReadFrom and an io.ReadSeeker
+		aborted         // with Write, and Abort midway
+		modes
+	)
+	watching := make(chan struct{})
+	watched := make(chan struct{})
+	go func() {
+		defer close(watched)
+		for {
+			select {
+			case <-watching:
+				return
+			default:
+			}
+			client.Status()
+		}
+	}()
+	defer func() {
+		close(watching)
+		<-watched
+	}()
+
+	end := time.Now().Add(d)
+	for round := 0; round == 0 || time.Now().Before(end); round++ {
+		rng := rand.New(rand.NewSource(int64(round)))
+		ft.Reset()
+		for n := 1; n <= 20*writers; n++ {
+			if rng.Intn(10) == 0 {
+				ft.Inject("b2_upload_part", n, faults[rng.Intn(len(faults))])
+			}
+		}
+		for n := 1; n <= 2*writers; n++ {
+			if rng.Intn(20) == 0 {
+				ft.Inject("b2_get_upload_part_url", n, faults[rng.Intn(len(faults))])
+			}
+		}
+
+		var wg sync.WaitGroup
+		for i := 0; i < writers; i++ {
+			name := fmt.Sprintf("stress/%d/%d", round, i)
+			size := rng.Intn(1e4) + 1e3
+			uploads := rng.Intn(4) + 1
+			mode := rng.Intn(modes)
+			cancelAt := -1
+			if mode != aborted && rng.Intn(10) == 0 {
+				cancelAt = rng.Intn(size)
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				wctx, wcancel := context.WithCancel(ctx)
+				defer wcancel()
+				w := bucket.Object(name).NewWriter(wctx, WithConcurrentUploads(uploads))
+				w.ChunkSize = 1e3
+				src := make([]byte, size)
+				var err error
+				var abort bool
+				switch mode {
+				case copied:
+					_, err = io.Copy(w, io.LimitReader(zReader{}, int64(size)))
+				case streamed:
+					_, err = w.ReadFrom(bytes.NewReader(src))
+				default:
+					for off := 0; off < size && err == nil; off += 300 {
+						if cancelAt >= 0 && off >= cancelAt {
+							wcancel()
+						}
+						if mode == aborted && off >= size/2 && !abort {
+							abort = true
+							w.Abort(ctx)
+						}
+						next := off + 300
+						if next > size {
+							next = size
+						}
+						_, err = w.Write(src[off:next])
+					}
+				}
+				// Close twice at once; both get the same error.
+				errs := make(chan error, 1)
+				go func() { errs <- w.Close() }()
+				cerr := w.Close()
+				if cerr2 := <-errs; cerr != cerr2 {
+					t.Errorf("%s: concurrent Close: got %v and %v", name, cerr, cerr2)
+				}
+				if err == nil {
+					err = cerr
+				}
+				if abort {
+					if cerr != ErrAborted {
+						t.Errorf("%s: Close after Abort: got %v, want %v", name, cerr, ErrAborted)
+					}
+					return
+				}
+				if errors.Is(err, context.Canceled) && cancelAt < 0 {
+					t.Errorf("%s: got %v, want the error that ended the upload", name, err)
+				}
+				if err != nil {
+					return
+				}
+				attrs, err := bucket.Object(name).Attrs(ctx)
+				if err != nil {
+					t.Errorf("%s: Attrs: %v", name, err)
+					return
+				}
+				if attrs.Size != int64(size) {
+					t.Errorf("%s: got %d bytes, want %d", name, attrs.Size, size)
+				}
+			}()
+		}
+		wg.Wait()
+		if t.Failed() {
+			return
+		}
 	}
-	return nil
 }
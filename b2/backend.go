@@ -16,30 +16,69 @@ package b2
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
 	"io"
-	"math/rand"
+	"sync"
 	"time"
+
+	"github.com/Backblaze/blazer/internal/retry"
 )
 
 // This file wraps the baseline interfaces with backoff and retry semantics.
 
 type beRootInterface interface {
 	backoff(error) time.Duration
+	retryPolicy(method string) RetryPolicy
+	retryBudget() *retryBudget
+	tracer() Tracer
+	clock() Clock
 	reauth(error) bool
 	transient(error) bool
 	reupload(error) bool
+	hashMismatch(error) bool
 	authorizeAccount(context.Context, string, string, clientOptions) error
 	reauthorizeAccount(context.Context) error
-	createBucket(ctx context.Context, name, btype string, info map[string]string, rules []LifecycleRule) (beBucketInterface, error)
+	authGeneration() int
+	reauthorize(ctx context.Context, gen int) error
+	authExpiry() time.Time
+	authExpiring() (gen int, ok bool)
+	session() ([]byte, error)
+	resumeSession(context.Context, []byte, clientOptions) error
+	createBucket(ctx context.Context, name, btype string, info map[string]string, rules []LifecycleRule, fileLock bool) (beBucketInterface, error)
 	listBuckets(context.Context, string) ([]beBucketInterface, error)
+	bucket(id, name string) beBucketInterface
 	createKey(context.Context, string, []string, time.Duration, string, string) (beKeyInterface, error)
 	listKeys(context.Context, int, string) ([]beKeyInterface, string, error)
+	accountInfo() *AccountInfo
 }
 
 type beRoot struct {
-	account, key string
-	b2i          b2RootInterface
-	options      clientOptions
+	creds   CredentialsProvider
+	b2i     b2RootInterface
+	options clientOptions
+	clk     Clock // the Clock of the options being authorized, before they are set
+
+	authMu     sync.Mutex
+	authGen    int         // counts reauthorizations
+	authing    *authFlight // the reauthorization in progress, if any
+	expires    time.Time   // when the authorization expires, or zero if unknown
+	keyExpires time.Time   // when the key expires, or zero if it doesn't
+}
+
+// An authorization lasts a day at most, and no longer than the key with which
+// it was made.  Calls made within reauthMargin of its expiry authorize the
+// account again first, rather than find it expired.
+var tokenLifetime = 24 * time.Hour
+
+const reauthMargin = time.Minute
+
+// An authFlight is a reauthorization, which the callers who want one while it
+// is in progress wait for and share.
+type authFlight struct {
+	done      chan struct{}
+	err       error
+	abandoned bool // by its caller, whose context is done
 }
 
 type beBucketInterface interface {
@@ -51,12 +90,13 @@ type beBucketInterface interface {
 	deleteBucket(context.Context) error
 	getUploadURL(context.Context) (beURLInterface, error)
 	startLargeFile(ctx context.Context, name, contentType string, info map[string]string) (beLargeFileInterface, error)
-	listFileNames(context.Context, int, string, string, string) ([]beFileInterface, string, error)
-	listFileVersions(context.Context, int, string, string, string, string) ([]beFileInterface, string, string, error)
+	listFileNames(context.Context, int, string, string, string, func(beFileInterface)) ([]beFileInterface, string, error)
+	listFileVersions(context.Context, int, string, string, string, string, func(beFileInterface)) ([]beFileInterface, string, string, error)
 	listUnfinishedLargeFiles(context.Context, int, string) ([]beFileInterface, string, error)
-	downloadFileByName(context.Context, string, int64, int64, bool) (beFileReaderInterface, error)
+	downloadFileByName(context.Context, string, int64, int64, bool, downloadOverrides) (beFileReaderInterface, error)
 	hideFile(context.Context, string) (beFileInterface, error)
-	getDownloadAuthorization(context.Context, string, time.Duration, string) (string, error)
+	copyFile(ctx context.Context, srcID, name string, offset, size int64, contentType string, info map[string]string) (beFileInterface, error)
+	getDownloadAuthorization(context.Context, string, time.Duration, downloadAuthOptions) (string, error)
 	baseURL() string
 	s3URL() string
 	file(string, string) beFileInterface
@@ -95,9 +135,12 @@ type beFile struct {
 }
 
 type beLargeFileInterface interface {
+	id() string
 	finishLargeFile(context.Context) (beFileInterface, error)
 	getUploadPartURL(context.Context) (beFileChunkInterface, error)
+	copyPart(ctx context.Context, srcID string, index int, offset, size int64) (int64, error)
 	cancel(context.Context) error
+	listParts(context.Context, int, int) ([]beFilePartInterface, int, error)
 }
 
 type beLargeFile struct {
@@ -119,6 +162,8 @@ type beFileReaderInterface interface {
 	io.ReadCloser
 	stats() (int, string, string, map[string]string)
 	id() string
+	size() int64
+	timestamp() time.Time
 }
 
 type beFileReader struct {
@@ -158,6 +203,8 @@ type beKeyInterface interface {
 	expires() time.Time
 	secret() string
 	id() string
+	bucketID() string
+	prefix() string
 }
 
 type beKey struct {
@@ -168,30 +215,190 @@ type beKey struct {
 func (r *beRoot) backoff(err error) time.Duration { return r.b2i.backoff(err) }
 func (r *beRoot) reauth(err error) bool           { return r.b2i.reauth(err) }
 func (r *beRoot) reupload(err error) bool         { return r.b2i.reupload(err) }
+func (r *beRoot) hashMismatch(err error) bool     { return r.b2i.hashMismatch(err) }
 func (r *beRoot) transient(err error) bool        { return r.b2i.transient(err) }
+func (r *beRoot) accountInfo() *AccountInfo       { return r.b2i.accountInfo() }
+
+func (r *beRoot) retryPolicy(method string) RetryPolicy {
+	return r.options.retryPolicy(method)
+}
+
+func (r *beRoot) retryBudget() *retryBudget {
+	return r.options.budget
+}
+
+func (r *beRoot) tracer() Tracer {
+	return r.options.tracer
+}
+
+func (r *beRoot) clock() Clock {
+	if r.clk != nil {
+		return r.clk
+	}
+	return r.options.getClock()
+}
 
 func (r *beRoot) authorizeAccount(ctx context.Context, account, key string, c clientOptions) error {
-	f := func() error {
-		if err := r.b2i.authorizeAccount(ctx, account, key, c); err != nil {
+	creds := c.credentials
+	if creds == nil {
+		creds = StaticCredentials(account, key)
+	}
+	r.clk = c.getClock()
+	f := func(ctx context.Context) error {
+		start := r.clock().Now()
+		id, key, err := credentials(ctx, creds)
+		if err != nil {
+			return err
+		}
+		if err := r.b2i.authorizeAccount(ctx, id, key, c); err != nil {
 			return err
 		}
-		r.account = account
-		r.key = key
+		r.creds = creds
 		r.options = c
+		r.clk = nil
+		r.authMu.Lock()
+		r.authorized(start)
+		r.authMu.Unlock()
 		return nil
 	}
-	return withBackoff(ctx, r, f)
+	return withBackoff(ctx, r, "b2_authorize_account", f)
+}
+
+// authorized records the expiry of an authorization requested at start.  It
+// must be called with r.authMu held.
+func (r *beRoot) authorized(start time.Time) {
+	r.keyExpires = r.b2i.accountInfo().KeyExpiration
+	r.expires = start.Add(tokenLifetime)
+	if !r.keyExpires.IsZero() && r.keyExpires.Before(r.expires) {
+		r.expires = r.keyExpires
+	}
+}
+
+func (r *beRoot) authExpiry() time.Time {
+	r.authMu.Lock()
+	defer r.authMu.Unlock()
+	return r.expires
+}
+
+// authExpiring reports whether the authorization expires soon, and another
+// would outlast it, along with its generation.  One that expires with its key
+// can't be renewed, and is left to run out.
+func (r *beRoot) authExpiring() (int, bool) {
+	r.authMu.Lock()
+	defer r.authMu.Unlock()
+	if r.expires.IsZero() || r.expires.Sub(r.clock().Now()) > reauthMargin {
+		return r.authGen, false
+	}
+	return r.authGen, r.keyExpires.IsZero() || r.expires.Before(r.keyExpires)
+}
+
+// A savedSession is a session as Client.Session saves it.
+type savedSession struct {
+	Expires time.Time       `json:"expires"`
+	Session json.RawMessage `json:"session"`
+}
+
+func (r *beRoot) session() ([]byte, error) {
+	data, err := r.b2i.session()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(savedSession{
+		Expires: r.authExpiry(),
+		Session: data,
+	})
+}
+
+func (r *beRoot) resumeSession(ctx context.Context, data []byte, c clientOptions) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	var s savedSession
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("b2: bad session: %w", err)
+	}
+	if err := r.b2i.resumeSession(s.Session, c); err != nil {
+		return fmt.Errorf("b2: bad session: %w", err)
+	}
+	r.creds = c.credentials
+	if r.creds == nil {
+		r.creds = noCredentials
+	}
+	r.options = c
+	r.authMu.Lock()
+	defer r.authMu.Unlock()
+	r.keyExpires = r.b2i.accountInfo().KeyExpiration
+	r.expires = s.Expires
+	return nil
 }
 
 func (r *beRoot) reauthorizeAccount(ctx context.Context) error {
-	return r.authorizeAccount(ctx, r.account, r.key, r.options)
+	return r.reauthorize(ctx, r.authGeneration())
 }
 
-func (r *beRoot) createBucket(ctx context.Context, name, btype string, info map[string]string, rules []LifecycleRule) (beBucketInterface, error) {
+func (r *beRoot) authGeneration() int {
+	r.authMu.Lock()
+	defer r.authMu.Unlock()
+	return r.authGen
+}
+
+// reauthorize authorizes the account again, after a call made with the
+// authorization from generation gen found that it had expired.  If the
+// account has been authorized again since, it does nothing, and if it is being
+// authorized again now, it waits for that instead, so that however many calls
+// find the same token expired, only one of them authorizes the account.
+func (r *beRoot) reauthorize(ctx context.Context, gen int) error {
+	for {
+		r.authMu.Lock()
+		if r.authGen != gen {
+			r.authMu.Unlock()
+			return nil
+		}
+		f := r.authing
+		if f == nil {
+			break
+		}
+		r.authMu.Unlock()
+		select {
+		case <-f.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if !f.abandoned {
+			return f.err
+		}
+		// Whoever was authorizing gave up; take over.
+	}
+	f := &authFlight{done: make(chan struct{})}
+	r.authing = f
+	r.authMu.Unlock()
+
+	var start time.Time
+	f.err = withBackoff(ctx, r, "b2_authorize_account", func(ctx context.Context) error {
+		start = r.clock().Now()
+		id, key, err := credentials(ctx, r.creds)
+		if err != nil {
+			return err
+		}
+		return r.b2i.authorizeAccount(ctx, id, key, r.options)
+	})
+	r.authMu.Lock()
+	r.authing = nil
+	if f.err == nil {
+		r.authGen++
+		r.authorized(start)
+	}
+	f.abandoned = f.err != nil && ctx.Err() != nil
+	r.authMu.Unlock()
+	close(f.done)
+	return f.err
+}
+
+func (r *beRoot) createBucket(ctx context.Context, name, btype string, info map[string]string, rules []LifecycleRule, fileLock bool) (beBucketInterface, error) {
 	var bi beBucketInterface
-	f := func() error {
+	f := func(ctx context.Context) error {
 		g := func() error {
-			bucket, err := r.b2i.createBucket(ctx, name, btype, info, rules)
+			bucket, err := r.b2i.createBucket(ctx, name, btype, info, rules, fileLock)
 			if err != nil {
 				return err
 			}
@@ -201,17 +408,24 @@ func (r *beRoot) createBucket(ctx context.Context, name, btype string, info map[
 			}
 			return nil
 		}
-		return withReauth(ctx, r, g)
+		return withReauth(ctx, r, "b2_create_bucket", g)
 	}
-	if err := withBackoff(ctx, r, f); err != nil {
+	if err := withBackoff(ctx, r, "b2_create_bucket", f); err != nil {
 		return nil, err
 	}
 	return bi, nil
 }
 
+func (r *beRoot) bucket(id, name string) beBucketInterface {
+	return &beBucket{
+		b2bucket: r.b2i.bucket(id, name),
+		ri:       r,
+	}
+}
+
 func (r *beRoot) listBuckets(ctx context.Context, name string) ([]beBucketInterface, error) {
 	var buckets []beBucketInterface
-	f := func() error {
+	f := func(ctx context.Context) error {
 		g := func() error {
 			bs, err := r.b2i.listBuckets(ctx, name)
 			if err != nil {
@@ -225,9 +439,9 @@ func (r *beRoot) listBuckets(ctx context.Context, name string) ([]beBucketInterf
 			}
 			return nil
 		}
-		return withReauth(ctx, r, g)
+		return withReauth(ctx, r, "b2_list_buckets", g)
 	}
-	if err := withBackoff(ctx, r, f); err != nil {
+	if err := withBackoff(ctx, r, "b2_list_buckets", f); err != nil {
 		return nil, err
 	}
 	return buckets, nil
@@ -235,7 +449,7 @@ func (r *beRoot) listBuckets(ctx context.Context, name string) ([]beBucketInterf
 
 func (r *beRoot) createKey(ctx context.Context, name string, caps []string, valid time.Duration, bucketID string, prefix string) (beKeyInterface, error) {
 	var k *beKey
-	f := func() error {
+	f := func(ctx context.Context) error {
 		g := func() error {
 			got, err := r.b2i.createKey(ctx, name, caps, valid, bucketID, prefix)
 			if err != nil {
@@ -247,9 +461,9 @@ func (r *beRoot) createKey(ctx context.Context, name string, caps []string, vali
 			}
 			return nil
 		}
-		return withReauth(ctx, r, g)
+		return withReauth(ctx, r, "b2_create_key", g)
 	}
-	if err := withBackoff(ctx, r, f); err != nil {
+	if err := withBackoff(ctx, r, "b2_create_key", f); err != nil {
 		return nil, err
 	}
 	return k, nil
@@ -258,7 +472,7 @@ func (r *beRoot) createKey(ctx context.Context, name string, caps []string, vali
 func (r *beRoot) listKeys(ctx context.Context, max int, next string) ([]beKeyInterface, string, error) {
 	var keys []beKeyInterface
 	var cur string
-	f := func() error {
+	f := func(ctx context.Context) error {
 		g := func() error {
 			got, n, err := r.b2i.listKeys(ctx, max, next)
 			if err != nil {
@@ -273,9 +487,9 @@ func (r *beRoot) listKeys(ctx context.Context, max int, next string) ([]beKeyInt
 			}
 			return nil
 		}
-		return withReauth(ctx, r, g)
+		return withReauth(ctx, r, "b2_list_keys", g)
 	}
-	if err := withBackoff(ctx, r, f); err != nil {
+	if err := withBackoff(ctx, r, "b2_list_keys", f); err != nil {
 		return nil, "", err
 	}
 	return keys, cur, nil
@@ -287,28 +501,28 @@ func (b *beBucket) attrs() *BucketAttrs { return b.b2bucket.attrs() }
 func (b *beBucket) id() string          { return b.b2bucket.id() }
 
 func (b *beBucket) updateBucket(ctx context.Context, attrs *BucketAttrs) error {
-	f := func() error {
+	f := func(ctx context.Context) error {
 		g := func() error {
 			return b.b2bucket.updateBucket(ctx, attrs)
 		}
-		return withReauth(ctx, b.ri, g)
+		return withReauth(ctx, b.ri, "b2_update_bucket", g)
 	}
-	return withBackoff(ctx, b.ri, f)
+	return withBackoff(ctx, b.ri, "b2_update_bucket", f)
 }
 
 func (b *beBucket) deleteBucket(ctx context.Context) error {
-	f := func() error {
+	f := func(ctx context.Context) error {
 		g := func() error {
 			return b.b2bucket.deleteBucket(ctx)
 		}
-		return withReauth(ctx, b.ri, g)
+		return withReauth(ctx, b.ri, "b2_delete_bucket", g)
 	}
-	return withBackoff(ctx, b.ri, f)
+	return withBackoff(ctx, b.ri, "b2_delete_bucket", f)
 }
 
 func (b *beBucket) getUploadURL(ctx context.Context) (beURLInterface, error) {
 	var url beURLInterface
-	f := func() error {
+	f := func(ctx context.Context) error {
 		g := func() error {
 			u, err := b.b2bucket.getUploadURL(ctx)
 			if err != nil {
@@ -320,9 +534,9 @@ func (b *beBucket) getUploadURL(ctx context.Context) (beURLInterface, error) {
 			}
 			return nil
 		}
-		return withReauth(ctx, b.ri, g)
+		return withReauth(ctx, b.ri, "b2_get_upload_url", g)
 	}
-	if err := withBackoff(ctx, b.ri, f); err != nil {
+	if err := withBackoff(ctx, b.ri, "b2_get_upload_url", f); err != nil {
 		return nil, err
 	}
 	return url, nil
@@ -330,7 +544,7 @@ func (b *beBucket) getUploadURL(ctx context.Context) (beURLInterface, error) {
 
 func (b *beBucket) startLargeFile(ctx context.Context, name, ct string, info map[string]string) (beLargeFileInterface, error) {
 	var file beLargeFileInterface
-	f := func() error {
+	f := func(ctx context.Context) error {
 		g := func() error {
 			f, err := b.b2bucket.startLargeFile(ctx, name, ct, info)
 			if err != nil {
@@ -342,20 +556,24 @@ func (b *beBucket) startLargeFile(ctx context.Context, name, ct string, info map
 			}
 			return nil
 		}
-		return withReauth(ctx, b.ri, g)
+		return withReauth(ctx, b.ri, "b2_start_large_file", g)
 	}
-	if err := withBackoff(ctx, b.ri, f); err != nil {
+	if err := withBackoff(ctx, b.ri, "b2_start_large_file", f); err != nil {
 		return nil, err
 	}
 	return file, nil
 }
 
-func (b *beBucket) listFileNames(ctx context.Context, count int, continuation, prefix, delimiter string) ([]beFileInterface, string, error) {
+// listFileNames lists a page of files, passing each to emit, if it is set, as
+// soon as it has been decoded.  An attempt that is retried may already have
+// passed on some of the page; those files are not passed on again.
+func (b *beBucket) listFileNames(ctx context.Context, count int, continuation, prefix, delimiter string, emit func(beFileInterface)) ([]beFileInterface, string, error) {
 	var cont string
 	var files []beFileInterface
-	f := func() error {
+	yield := b.yielder(emit)
+	f := func(ctx context.Context) error {
 		g := func() error {
-			fs, c, err := b.b2bucket.listFileNames(ctx, count, continuation, prefix, delimiter)
+			fs, c, err := b.b2bucket.listFileNames(ctx, count, continuation, prefix, delimiter, yield())
 			if err != nil {
 				return err
 			}
@@ -368,20 +586,21 @@ func (b *beBucket) listFileNames(ctx context.Context, count int, continuation, p
 			}
 			return nil
 		}
-		return withReauth(ctx, b.ri, g)
+		return withReauth(ctx, b.ri, "b2_list_file_names", g)
 	}
-	if err := withBackoff(ctx, b.ri, f); err != nil {
+	if err := withBackoff(ctx, b.ri, "b2_list_file_names", f); err != nil {
 		return nil, "", err
 	}
 	return files, cont, nil
 }
 
-func (b *beBucket) listFileVersions(ctx context.Context, count int, nextName, nextID, prefix, delimiter string) ([]beFileInterface, string, string, error) {
+func (b *beBucket) listFileVersions(ctx context.Context, count int, nextName, nextID, prefix, delimiter string, emit func(beFileInterface)) ([]beFileInterface, string, string, error) {
 	var name, id string
 	var files []beFileInterface
-	f := func() error {
+	yield := b.yielder(emit)
+	f := func(ctx context.Context) error {
 		g := func() error {
-			fs, n, d, err := b.b2bucket.listFileVersions(ctx, count, nextName, nextID, prefix, delimiter)
+			fs, n, d, err := b.b2bucket.listFileVersions(ctx, count, nextName, nextID, prefix, delimiter, yield())
 			if err != nil {
 				return err
 			}
@@ -395,18 +614,40 @@ func (b *beBucket) listFileVersions(ctx context.Context, count int, nextName, ne
 			}
 			return nil
 		}
-		return withReauth(ctx, b.ri, g)
+		return withReauth(ctx, b.ri, "b2_list_file_versions", g)
 	}
-	if err := withBackoff(ctx, b.ri, f); err != nil {
+	if err := withBackoff(ctx, b.ri, "b2_list_file_versions", f); err != nil {
 		return nil, "", "", err
 	}
 	return files, name, id, nil
 }
 
+// yielder returns a func that gives, for each attempt at listing a page, the
+// func that passes files on to emit.  Each attempt lists the same page again,
+// so it passes on only the files after those that earlier attempts passed on.
+func (b *beBucket) yielder(emit func(beFileInterface)) func() func(b2FileInterface) {
+	var sent int
+	return func() func(b2FileInterface) {
+		if emit == nil {
+			return nil
+		}
+		var n int
+		return func(f b2FileInterface) {
+			if n++; n > sent {
+				sent = n
+				emit(&beFile{
+					b2file: f,
+					ri:     b.ri,
+				})
+			}
+		}
+	}
+}
+
 func (b *beBucket) listUnfinishedLargeFiles(ctx context.Context, count int, continuation string) ([]beFileInterface, string, error) {
 	var cont string
 	var files []beFileInterface
-	f := func() error {
+	f := func(ctx context.Context) error {
 		g := func() error {
 			fs, c, err := b.b2bucket.listUnfinishedLargeFiles(ctx, count, continuation)
 			if err != nil {
@@ -421,19 +662,19 @@ func (b *beBucket) listUnfinishedLargeFiles(ctx context.Context, count int, cont
 			}
 			return nil
 		}
-		return withReauth(ctx, b.ri, g)
+		return withReauth(ctx, b.ri, "b2_list_unfinished_large_files", g)
 	}
-	if err := withBackoff(ctx, b.ri, f); err != nil {
+	if err := withBackoff(ctx, b.ri, "b2_list_unfinished_large_files", f); err != nil {
 		return nil, "", err
 	}
 	return files, cont, nil
 }
 
-func (b *beBucket) downloadFileByName(ctx context.Context, name string, offset, size int64, header bool) (beFileReaderInterface, error) {
+func (b *beBucket) downloadFileByName(ctx context.Context, name string, offset, size int64, header bool, ov downloadOverrides) (beFileReaderInterface, error) {
 	var reader beFileReaderInterface
-	f := func() error {
+	f := func(ctx context.Context) error {
 		g := func() error {
-			fr, err := b.b2bucket.downloadFileByName(ctx, name, offset, size, header)
+			fr, err := b.b2bucket.downloadFileByName(ctx, name, offset, size, header, ov)
 			if err != nil {
 				return err
 			}
@@ -443,9 +684,9 @@ func (b *beBucket) downloadFileByName(ctx context.Context, name string, offset,
 			}
 			return nil
 		}
-		return withReauth(ctx, b.ri, g)
+		return withReauth(ctx, b.ri, "b2_download_file_by_name", g)
 	}
-	if err := withBackoff(ctx, b.ri, f); err != nil {
+	if err := withBackoff(ctx, b.ri, "b2_download_file_by_name", f); err != nil {
 		return nil, err
 	}
 	return reader, nil
@@ -453,7 +694,7 @@ func (b *beBucket) downloadFileByName(ctx context.Context, name string, offset,
 
 func (b *beBucket) hideFile(ctx context.Context, name string) (beFileInterface, error) {
 	var file beFileInterface
-	f := func() error {
+	f := func(ctx context.Context) error {
 		g := func() error {
 			f, err := b.b2bucket.hideFile(ctx, name)
 			if err != nil {
@@ -465,28 +706,50 @@ func (b *beBucket) hideFile(ctx context.Context, name string) (beFileInterface,
 			}
 			return nil
 		}
-		return withReauth(ctx, b.ri, g)
+		return withReauth(ctx, b.ri, "b2_hide_file", g)
 	}
-	if err := withBackoff(ctx, b.ri, f); err != nil {
+	if err := withBackoff(ctx, b.ri, "b2_hide_file", f); err != nil {
 		return nil, err
 	}
 	return file, nil
 }
 
-func (b *beBucket) getDownloadAuthorization(ctx context.Context, p string, v time.Duration, s string) (string, error) {
+func (b *beBucket) copyFile(ctx context.Context, srcID, name string, offset, size int64, ct string, info map[string]string) (beFileInterface, error) {
+	var file beFileInterface
+	f := func(ctx context.Context) error {
+		g := func() error {
+			f, err := b.b2bucket.copyFile(ctx, srcID, name, offset, size, ct, info)
+			if err != nil {
+				return err
+			}
+			file = &beFile{
+				b2file: f,
+				ri:     b.ri,
+			}
+			return nil
+		}
+		return withReauth(ctx, b.ri, "b2_copy_file", g)
+	}
+	if err := withBackoff(ctx, b.ri, "b2_copy_file", f); err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+func (b *beBucket) getDownloadAuthorization(ctx context.Context, p string, v time.Duration, o downloadAuthOptions) (string, error) {
 	var tok string
-	f := func() error {
+	f := func(ctx context.Context) error {
 		g := func() error {
-			t, err := b.b2bucket.getDownloadAuthorization(ctx, p, v, s)
+			t, err := b.b2bucket.getDownloadAuthorization(ctx, p, v, o)
 			if err != nil {
 				return err
 			}
 			tok = t
 			return nil
 		}
-		return withReauth(ctx, b.ri, g)
+		return withReauth(ctx, b.ri, "b2_get_download_authorization", g)
 	}
-	if err := withBackoff(ctx, b.ri, f); err != nil {
+	if err := withBackoff(ctx, b.ri, "b2_get_download_authorization", f); err != nil {
 		return "", err
 	}
 	return tok, nil
@@ -509,7 +772,7 @@ func (b *beBucket) file(id, name string) beFileInterface {
 
 func (b *beURL) uploadFile(ctx context.Context, r readResetter, size int, name, ct, sha1 string, info map[string]string) (beFileInterface, error) {
 	var file beFileInterface
-	f := func() error {
+	f := func(ctx context.Context) error {
 		if err := r.Reset(); err != nil {
 			return err
 		}
@@ -524,20 +787,20 @@ func (b *beURL) uploadFile(ctx context.Context, r readResetter, size int, name,
 		}
 		return nil
 	}
-	if err := withBackoff(ctx, b.ri, f); err != nil {
+	if err := withBackoff(ctx, b.ri, "b2_upload_file", f); err != nil {
 		return nil, err
 	}
 	return file, nil
 }
 
 func (b *beFile) deleteFileVersion(ctx context.Context) error {
-	f := func() error {
+	f := func(ctx context.Context) error {
 		g := func() error {
 			return b.b2file.deleteFileVersion(ctx)
 		}
-		return withReauth(ctx, b.ri, g)
+		return withReauth(ctx, b.ri, "b2_delete_file_version", g)
 	}
-	return withBackoff(ctx, b.ri, f)
+	return withBackoff(ctx, b.ri, "b2_delete_file_version", f)
 }
 
 func (b *beFile) size() int64 {
@@ -562,7 +825,7 @@ func (b *beFile) status() string {
 
 func (b *beFile) getFileInfo(ctx context.Context) (beFileInfoInterface, error) {
 	var fileInfo beFileInfoInterface
-	f := func() error {
+	f := func(ctx context.Context) error {
 		g := func() error {
 			fi, err := b.b2file.getFileInfo(ctx)
 			if err != nil {
@@ -580,9 +843,9 @@ func (b *beFile) getFileInfo(ctx context.Context) (beFileInfoInterface, error) {
 			}
 			return nil
 		}
-		return withReauth(ctx, b.ri, g)
+		return withReauth(ctx, b.ri, "b2_get_file_info", g)
 	}
-	if err := withBackoff(ctx, b.ri, f); err != nil {
+	if err := withBackoff(ctx, b.ri, "b2_get_file_info", f); err != nil {
 		return nil, err
 	}
 	return fileInfo, nil
@@ -591,7 +854,7 @@ func (b *beFile) getFileInfo(ctx context.Context) (beFileInfoInterface, error) {
 func (b *beFile) listParts(ctx context.Context, next, count int) ([]beFilePartInterface, int, error) {
 	var fpi []beFilePartInterface
 	var rnxt int
-	f := func() error {
+	f := func(ctx context.Context) error {
 		g := func() error {
 			ps, n, err := b.b2file.listParts(ctx, next, count)
 			if err != nil {
@@ -606,9 +869,9 @@ func (b *beFile) listParts(ctx context.Context, next, count int) ([]beFilePartIn
 			}
 			return nil
 		}
-		return withReauth(ctx, b.ri, g)
+		return withReauth(ctx, b.ri, "b2_list_parts", g)
 	}
-	if err := withBackoff(ctx, b.ri, f); err != nil {
+	if err := withBackoff(ctx, b.ri, "b2_list_parts", f); err != nil {
 		return nil, 0, err
 	}
 	return fpi, rnxt, nil
@@ -621,9 +884,11 @@ func (b *beFile) compileParts(size int64, seen map[int]string) beLargeFileInterf
 	}
 }
 
+func (b *beLargeFile) id() string { return b.b2largeFile.id() }
+
 func (b *beLargeFile) getUploadPartURL(ctx context.Context) (beFileChunkInterface, error) {
 	var chunk beFileChunkInterface
-	f := func() error {
+	f := func(ctx context.Context) error {
 		g := func() error {
 			fc, err := b.b2largeFile.getUploadPartURL(ctx)
 			if err != nil {
@@ -635,9 +900,9 @@ func (b *beLargeFile) getUploadPartURL(ctx context.Context) (beFileChunkInterfac
 			}
 			return nil
 		}
-		return withReauth(ctx, b.ri, g)
+		return withReauth(ctx, b.ri, "b2_get_upload_part_url", g)
 	}
-	if err := withBackoff(ctx, b.ri, f); err != nil {
+	if err := withBackoff(ctx, b.ri, "b2_get_upload_part_url", f); err != nil {
 		return nil, err
 	}
 	return chunk, nil
@@ -645,7 +910,7 @@ func (b *beLargeFile) getUploadPartURL(ctx context.Context) (beFileChunkInterfac
 
 func (b *beLargeFile) finishLargeFile(ctx context.Context) (beFileInterface, error) {
 	var file beFileInterface
-	f := func() error {
+	f := func(ctx context.Context) error {
 		g := func() error {
 			f, err := b.b2largeFile.finishLargeFile(ctx)
 			if err != nil {
@@ -657,39 +922,85 @@ func (b *beLargeFile) finishLargeFile(ctx context.Context) (beFileInterface, err
 			}
 			return nil
 		}
-		return withReauth(ctx, b.ri, g)
+		return withReauth(ctx, b.ri, "b2_finish_large_file", g)
 	}
-	if err := withBackoff(ctx, b.ri, f); err != nil {
+	if err := withBackoff(ctx, b.ri, "b2_finish_large_file", f); err != nil {
 		return nil, err
 	}
 	return file, nil
 }
 
+func (b *beLargeFile) copyPart(ctx context.Context, srcID string, index int, offset, size int64) (int64, error) {
+	var n int64
+	f := func(ctx context.Context) error {
+		g := func() error {
+			i, err := b.b2largeFile.copyPart(ctx, srcID, index, offset, size)
+			if err != nil {
+				return err
+			}
+			n = i
+			return nil
+		}
+		return withReauth(ctx, b.ri, "b2_copy_part", g)
+	}
+	if err := withBackoff(ctx, b.ri, "b2_copy_part", f); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
 func (b *beLargeFile) cancel(ctx context.Context) error {
-	f := func() error {
+	f := func(ctx context.Context) error {
 		g := func() error {
 			return b.b2largeFile.cancel(ctx)
 		}
-		return withReauth(ctx, b.ri, g)
+		return withReauth(ctx, b.ri, "b2_cancel_large_file", g)
 	}
-	return withBackoff(ctx, b.ri, f)
+	return withBackoff(ctx, b.ri, "b2_cancel_large_file", f)
+}
+
+func (b *beLargeFile) listParts(ctx context.Context, next, count int) ([]beFilePartInterface, int, error) {
+	var fpi []beFilePartInterface
+	var rnxt int
+	f := func(ctx context.Context) error {
+		g := func() error {
+			ps, n, err := b.b2largeFile.listParts(ctx, next, count)
+			if err != nil {
+				return err
+			}
+			rnxt = n
+			fpi = nil
+			for _, p := range ps {
+				fpi = append(fpi, &beFilePart{
+					b2filePart: p,
+					ri:         b.ri,
+				})
+			}
+			return nil
+		}
+		return withReauth(ctx, b.ri, "b2_list_parts", g)
+	}
+	if err := withBackoff(ctx, b.ri, "b2_list_parts", f); err != nil {
+		return nil, 0, err
+	}
+	return fpi, rnxt, nil
 }
 
 func (b *beFileChunk) reload(ctx context.Context) error {
-	f := func() error {
+	f := func(ctx context.Context) error {
 		g := func() error {
 			return b.b2fileChunk.reload(ctx)
 		}
-		return withReauth(ctx, b.ri, g)
+		return withReauth(ctx, b.ri, "b2_get_upload_part_url", g)
 	}
-	return withBackoff(ctx, b.ri, f)
+	return withBackoff(ctx, b.ri, "b2_get_upload_part_url", f)
 }
 
 func (b *beFileChunk) uploadPart(ctx context.Context, r readResetter, sha1 string, size, index int) (int, error) {
 	// no re-auth; pass it back up to the caller so they can get an new upload URI and token
 	// TODO: we should handle that here probably
 	var i int
-	f := func() error {
+	f := func(ctx context.Context) error {
 		if err := r.Reset(); err != nil {
 			return err
 		}
@@ -700,7 +1011,7 @@ func (b *beFileChunk) uploadPart(ctx context.Context, r readResetter, sha1 strin
 		i = j
 		return nil
 	}
-	if err := withBackoff(ctx, b.ri, f); err != nil {
+	if err := withBackoff(ctx, b.ri, "b2_upload_part", f); err != nil {
 		return 0, err
 	}
 	return i, nil
@@ -718,7 +1029,10 @@ func (b *beFileReader) stats() (int, string, string, map[string]string) {
 	return b.b2fileReader.stats()
 }
 
-func (b *beFileReader) id() string { return b.b2fileReader.id() }
+func (b *beFileReader) id() string  { return b.b2fileReader.id() }
+func (b *beFileReader) size() int64 { return b.b2fileReader.size() }
+
+func (b *beFileReader) timestamp() time.Time { return b.b2fileReader.timestamp() }
 
 func (b *beFileInfo) stats() (string, string, int64, string, map[string]string, string, time.Time) {
 	return b.name, b.sha, b.size, b.ct, b.info, b.status, b.stamp
@@ -729,10 +1043,10 @@ func (b *beFilePart) sha1() string { return b.b2filePart.sha1() }
 func (b *beFilePart) size() int64  { return b.b2filePart.size() }
 
 func (b *beKey) del(ctx context.Context) error {
-	f := func() error {
+	f := func(ctx context.Context) error {
 		return b.k.del(ctx)
 	}
-	return withBackoff(ctx, b.b2i, f)
+	return withBackoff(ctx, b.b2i, "b2_delete_key", f)
 }
 
 func (b *beKey) caps() []string     { return b.k.caps() }
@@ -740,51 +1054,64 @@ func (b *beKey) name() string       { return b.k.name() }
 func (b *beKey) expires() time.Time { return b.k.expires() }
 func (b *beKey) secret() string     { return b.k.secret() }
 func (b *beKey) id() string         { return b.k.id() }
-
-func jitter(d time.Duration) time.Duration {
-	f := float64(d)
-	f /= 50
-	f += f * (rand.Float64() - 0.5)
-	return time.Duration(f)
-}
-
-func getBackoff(d time.Duration) time.Duration {
-	if d > 30*time.Second {
-		return 30*time.Second + jitter(d)
+func (b *beKey) bucketID() string   { return b.k.bucketID() }
+func (b *beKey) prefix() string     { return b.k.prefix() }
+
+// withBackoff calls f, which makes the API call method, until it succeeds or
+// its error is not to be retried.  An error from B2 is returned as an *Error,
+// and one from ctx names method.  The context f is given counts the attempts
+// at the call, for OnRequest and OnResponse.
+func withBackoff(ctx context.Context, ri beRootInterface, method string, f func(context.Context) error) error {
+	actx, span := startSpan(countAttempts(ctx), ri.tracer(), method, "method", method)
+	var calls int
+	g := func() error {
+		calls++
+		return f(actx)
 	}
-	return d*2 + jitter(d*2)
-}
-
-var after = time.After
-
-func withBackoff(ctx context.Context, ri beRootInterface, f func() error) error {
-	backoff := 500 * time.Millisecond
-	for {
-		err := f()
-		if !ri.transient(err) {
-			return err
-		}
-		bo := ri.backoff(err)
-		if bo > 0 {
-			backoff = bo
-		} else {
-			backoff = getBackoff(backoff)
-		}
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		case <-after(backoff):
-		}
+	err := retry.Do(ctx, g, apiRetries(ri, method)...)
+	span.SetAttribute("retries", calls-1)
+	if err != nil && err == ctx.Err() {
+		// It was done while waiting to try again.
+		err = interrupted(method, err)
+		span.End(err)
+		return err
 	}
+	err = apiError(err, calls-1)
+	span.End(err)
+	return err
 }
 
-func withReauth(ctx context.Context, ri beRootInterface, f func() error) error {
-	err := f()
-	if ri.reauth(err) {
-		if err := ri.reauthorizeAccount(ctx); err != nil {
-			return err
+// withReauth calls f, which makes the API call method, and if its error says
+// that the account's authorization has expired, authorizes the account again
+// and calls f once more.  If the authorization is about to expire, it is
+// renewed before f is first called.
+func withReauth(ctx context.Context, ri beRootInterface, method string, f func() error) error {
+	var reauth bool
+	var gen int
+	g := func() error {
+		if reauth {
+			if err := ri.reauthorize(ctx, gen); err != nil {
+				return err
+			}
+		} else if cur, ok := ri.authExpiring(); ok {
+			// The authorization may yet be good if this fails, so try the
+			// call anyway.
+			if err := ri.reauthorize(ctx, cur); err != nil && ctx.Err() != nil {
+				return err
+			}
 		}
-		err = f()
+		gen = ri.authGeneration()
+		return f()
 	}
-	return err
+	opts := []retry.Option{
+		retry.Attempts(2),
+		retry.RetryIf(func(err error) bool {
+			reauth = ri.reauth(err)
+			return reauth
+		}),
+	}
+	if f := ri.retryPolicy(method).OnRetry; f != nil {
+		opts = append(opts, retry.OnRetry(f))
+	}
+	return retry.Do(ctx, g, opts...)
 }
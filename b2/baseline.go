@@ -16,8 +16,12 @@ package b2
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"io"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/Backblaze/blazer/base"
@@ -32,10 +36,15 @@ type b2RootInterface interface {
 	backoff(error) time.Duration
 	reauth(error) bool
 	reupload(error) bool
-	createBucket(context.Context, string, string, map[string]string, []LifecycleRule) (b2BucketInterface, error)
+	hashMismatch(error) bool
+	createBucket(context.Context, string, string, map[string]string, []LifecycleRule, bool) (b2BucketInterface, error)
 	listBuckets(context.Context, string) ([]b2BucketInterface, error)
+	bucket(id, name string) b2BucketInterface
 	createKey(context.Context, string, []string, time.Duration, string, string) (b2KeyInterface, error)
 	listKeys(context.Context, int, string) ([]b2KeyInterface, string, error)
+	accountInfo() *AccountInfo
+	session() ([]byte, error)
+	resumeSession([]byte, clientOptions) error
 }
 
 type b2BucketInterface interface {
@@ -47,12 +56,13 @@ type b2BucketInterface interface {
 	deleteBucket(context.Context) error
 	getUploadURL(context.Context) (b2URLInterface, error)
 	startLargeFile(ctx context.Context, name, contentType string, info map[string]string) (b2LargeFileInterface, error)
-	listFileNames(context.Context, int, string, string, string) ([]b2FileInterface, string, error)
-	listFileVersions(context.Context, int, string, string, string, string) ([]b2FileInterface, string, string, error)
+	listFileNames(context.Context, int, string, string, string, func(b2FileInterface)) ([]b2FileInterface, string, error)
+	listFileVersions(context.Context, int, string, string, string, string, func(b2FileInterface)) ([]b2FileInterface, string, string, error)
 	listUnfinishedLargeFiles(context.Context, int, string) ([]b2FileInterface, string, error)
-	downloadFileByName(context.Context, string, int64, int64, bool) (b2FileReaderInterface, error)
+	downloadFileByName(context.Context, string, int64, int64, bool, downloadOverrides) (b2FileReaderInterface, error)
 	hideFile(context.Context, string) (b2FileInterface, error)
-	getDownloadAuthorization(context.Context, string, time.Duration, string) (string, error)
+	copyFile(ctx context.Context, srcID, name string, offset, size int64, contentType string, info map[string]string) (b2FileInterface, error)
+	getDownloadAuthorization(context.Context, string, time.Duration, downloadAuthOptions) (string, error)
 	baseURL() string
 	s3URL() string
 	file(string, string) b2FileInterface
@@ -76,9 +86,12 @@ type b2FileInterface interface {
 }
 
 type b2LargeFileInterface interface {
+	id() string
 	finishLargeFile(context.Context) (b2FileInterface, error)
 	getUploadPartURL(context.Context) (b2FileChunkInterface, error)
+	copyPart(ctx context.Context, srcID string, index int, offset, size int64) (int64, error)
 	cancel(context.Context) error
+	listParts(context.Context, int, int) ([]b2FilePartInterface, int, error)
 }
 
 type b2FileChunkInterface interface {
@@ -90,6 +103,8 @@ type b2FileReaderInterface interface {
 	io.ReadCloser
 	stats() (int, string, string, map[string]string)
 	id() string
+	size() int64
+	timestamp() time.Time
 }
 
 type b2FileInfoInterface interface {
@@ -109,10 +124,18 @@ type b2KeyInterface interface {
 	expires() time.Time
 	secret() string
 	id() string
+	bucketID() string
+	prefix() string
 }
 
+// ErrCircuitOpen is wrapped by the errors of API calls that were not made
+// because those before them kept failing; see BreakCircuit.
+var ErrCircuitOpen = base.ErrCircuitOpen
+
 type b2Root struct {
-	b *base.B2
+	b       *base.B2
+	limiter *base.RequestLimiter // kept across reauthorizations
+	breaker *base.CircuitBreaker // likewise
 }
 
 type b2Bucket struct {
@@ -151,7 +174,22 @@ type b2Key struct {
 	b *base.Key
 }
 
-func (b *b2Root) authorizeAccount(ctx context.Context, account, key string, c clientOptions) error {
+// escapeName encodes an object name for use in a download URL, in the same
+// way the base package does for b2_download_file_by_name.
+func escapeName(name string) string {
+	return base.Escape(name)
+}
+
+// validateUpload reports whether B2 will accept a new file with the given name
+// and info.
+func validateUpload(name string, info map[string]string) error {
+	if err := base.ValidateFileName(name); err != nil {
+		return err
+	}
+	return base.ValidateFileInfo(info)
+}
+
+func (b *b2Root) authOptions(c clientOptions) []base.AuthOption {
 	var aopts []base.AuthOption
 	ct := &clientTransport{client: c.client}
 	if c.transport != nil {
@@ -173,7 +211,29 @@ func (b *b2Root) authorizeAccount(ctx context.Context, account, key string, c cl
 	for _, agent := range c.userAgents {
 		aopts = append(aopts, base.UserAgent(agent))
 	}
-	nb, err := base.AuthorizeAccount(ctx, account, key, aopts...)
+	if c.skipValidation {
+		aopts = append(aopts, base.SkipValidation())
+	}
+	if c.maxRPS > 0 {
+		if b.limiter == nil {
+			b.limiter = base.NewRequestLimiter(c.maxRPS, c.rpsBurst)
+		}
+		aopts = append(aopts, base.LimitRequests(b.limiter))
+	}
+	if c.logger != nil {
+		aopts = append(aopts, base.WithLogger(c.logger))
+	}
+	if c.breakThreshold > 0 {
+		if b.breaker == nil {
+			b.breaker = base.NewCircuitBreaker(c.breakThreshold, c.breakCooldown, c.breakProbes)
+		}
+		aopts = append(aopts, base.BreakCircuit(b.breaker))
+	}
+	return aopts
+}
+
+func (b *b2Root) authorizeAccount(ctx context.Context, account, key string, c clientOptions) error {
+	nb, err := base.AuthorizeAccount(ctx, account, key, b.authOptions(c)...)
 	if err != nil {
 		return err
 	}
@@ -185,6 +245,33 @@ func (b *b2Root) authorizeAccount(ctx context.Context, account, key string, c cl
 	return nil
 }
 
+func (b *b2Root) accountInfo() *AccountInfo {
+	id, name := b.b.RestrictedBucket()
+	return &AccountInfo{
+		AccountID:               b.b.AccountID(),
+		Capabilities:            b.b.Capabilities(),
+		BucketID:                id,
+		BucketName:              name,
+		Prefix:                  b.b.RestrictedPrefix(),
+		RecommendedPartSize:     b.b.RecommendedPartSize(),
+		AbsoluteMinimumPartSize: b.b.AbsoluteMinimumPartSize(),
+		KeyExpiration:           b.b.KeyExpiration(),
+	}
+}
+
+func (b *b2Root) session() ([]byte, error) {
+	return json.Marshal(b.b.Session())
+}
+
+func (b *b2Root) resumeSession(data []byte, c clientOptions) error {
+	var s base.Session
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	b.b = base.ResumeSession(s, b.authOptions(c)...)
+	return nil
+}
+
 func (*b2Root) backoff(err error) time.Duration {
 	if base.Action(err) != base.Retry {
 		return 0
@@ -200,20 +287,70 @@ func (*b2Root) reupload(err error) bool {
 	return base.Action(err) == base.AttemptNewUpload
 }
 
+// hashMismatch reports whether B2 refused an upload because its data didn't
+// match the SHA1 hash sent with it.
+func (*b2Root) hashMismatch(err error) bool {
+	_, code, msg := base.MsgCode(err)
+	return code == "bad_request" && strings.Contains(strings.ToLower(msg), "sha1")
+}
+
 func (*b2Root) transient(err error) bool {
 	return base.Action(err) == base.Retry
 }
 
-func (b *b2Root) createBucket(ctx context.Context, name, btype string, info map[string]string, rules []LifecycleRule) (b2BucketInterface, error) {
+// apiError returns err as an *Error, if B2 returned it for a call that was
+// retried the given number of times, and otherwise as it is.
+func apiError(err error, retried int) error {
+	var e *Error
+	if err == nil || errors.As(err, &e) {
+		return err
+	}
+	status, code, msg := base.MsgCode(err)
+	if status == 0 {
+		return err
+	}
+	id, host := base.Request(err)
+	return &Error{
+		Status:    status,
+		Code:      code,
+		Message:   msg,
+		Method:    base.Method(err),
+		Retried:   retried,
+		RequestID: id,
+		Host:      host,
+		err:       err,
+	}
+}
+
+// retryReason returns B2's code for err, such as "service_unavailable", or
+// else its HTTP status, or "error" if it has neither.
+func retryReason(err error) string {
+	status, code, _ := base.MsgCode(err)
+	switch {
+	case code != "":
+		return code
+	case status != 0:
+		return strconv.Itoa(status)
+	}
+	return "error"
+}
+
+func storageCapExceeded(err error) bool {
+	var ce *base.CapExceededError
+	return errors.As(err, &ce) && ce.IsStorageCap()
+}
+
+func (b *b2Root) createBucket(ctx context.Context, name, btype string, info map[string]string, rules []LifecycleRule, fileLock bool) (b2BucketInterface, error) {
 	var baseRules []base.LifecycleRule
 	for _, rule := range rules {
 		baseRules = append(baseRules, base.LifecycleRule{
-			DaysNewUntilHidden:     rule.DaysNewUntilHidden,
-			DaysHiddenUntilDeleted: rule.DaysHiddenUntilDeleted,
-			Prefix:                 rule.Prefix,
+			DaysNewUntilHidden:       rule.DaysNewUntilHidden,
+			DaysHiddenUntilDeleted:   rule.DaysHiddenUntilDeleted,
+			DaysStartedUntilCanceled: rule.DaysStartedUntilCanceled,
+			Prefix:                   rule.Prefix,
 		})
 	}
-	bucket, err := b.b.CreateBucket(ctx, name, btype, info, baseRules)
+	bucket, err := b.b.CreateBucket(ctx, name, btype, info, baseRules, fileLock)
 	if err != nil {
 		return nil, err
 	}
@@ -232,6 +369,10 @@ func (b *b2Root) listBuckets(ctx context.Context, name string) ([]b2BucketInterf
 	return rtn, err
 }
 
+func (b *b2Root) bucket(id, name string) b2BucketInterface {
+	return &b2Bucket{b.b.Bucket(id, name)}
+}
+
 func (b *b2Bucket) updateBucket(ctx context.Context, attrs *BucketAttrs) error {
 	if attrs == nil {
 		return nil
@@ -246,13 +387,44 @@ func (b *b2Bucket) updateBucket(ctx context.Context, attrs *BucketAttrs) error {
 		rules := []base.LifecycleRule{}
 		for _, rule := range attrs.LifecycleRules {
 			rules = append(rules, base.LifecycleRule{
-				DaysNewUntilHidden:     rule.DaysNewUntilHidden,
-				DaysHiddenUntilDeleted: rule.DaysHiddenUntilDeleted,
-				Prefix:                 rule.Prefix,
+				DaysNewUntilHidden:       rule.DaysNewUntilHidden,
+				DaysHiddenUntilDeleted:   rule.DaysHiddenUntilDeleted,
+				DaysStartedUntilCanceled: rule.DaysStartedUntilCanceled,
+				Prefix:                   rule.Prefix,
 			})
 		}
 		b.b.LifecycleRules = rules
 	}
+	if attrs.FileLockEnabled {
+		b.b.FileLockEnabled = true
+	}
+	if attrs.DefaultRetention != nil {
+		b.b.DefaultRetention = &base.DefaultRetention{
+			Mode:     string(attrs.DefaultRetention.Mode),
+			Duration: attrs.DefaultRetention.Period.Duration,
+			Unit:     string(attrs.DefaultRetention.Period.Unit),
+		}
+	}
+	if attrs.Replication != nil {
+		rep := &base.Replication{
+			SourceKeyID: attrs.Replication.SourceKeyID,
+			KeyMapping:  attrs.Replication.DestinationKeyMapping,
+		}
+		for _, rule := range attrs.Replication.Rules {
+			rep.Rules = append(rep.Rules, base.ReplicationRule{
+				Name:                 rule.Name,
+				DestinationBucketID:  rule.DestinationBucketID,
+				Prefix:               rule.Prefix,
+				Priority:             rule.Priority,
+				IncludeExistingFiles: rule.IncludeExistingFiles,
+				Enabled:              rule.Enabled,
+			})
+		}
+		b.b.Replication = rep
+	}
+	if attrs.Revision != 0 {
+		b.b.Revision = attrs.Revision
+	}
 	newBucket, err := b.b.Update(ctx)
 	if err == nil {
 		b.b = newBucket
@@ -303,15 +475,47 @@ func (b *b2Bucket) attrs() *BucketAttrs {
 	var rules []LifecycleRule
 	for _, rule := range b.b.LifecycleRules {
 		rules = append(rules, LifecycleRule{
-			DaysNewUntilHidden:     rule.DaysNewUntilHidden,
-			DaysHiddenUntilDeleted: rule.DaysHiddenUntilDeleted,
-			Prefix:                 rule.Prefix,
+			DaysNewUntilHidden:       rule.DaysNewUntilHidden,
+			DaysHiddenUntilDeleted:   rule.DaysHiddenUntilDeleted,
+			DaysStartedUntilCanceled: rule.DaysStartedUntilCanceled,
+			Prefix:                   rule.Prefix,
 		})
 	}
+	var retention *DefaultRetention
+	if dr := b.b.DefaultRetention; dr != nil {
+		retention = &DefaultRetention{
+			Mode: RetentionMode(dr.Mode),
+			Period: RetentionPeriod{
+				Duration: dr.Duration,
+				Unit:     RetentionUnit(dr.Unit),
+			},
+		}
+	}
+	var replication *Replication
+	if rep := b.b.Replication; rep != nil {
+		replication = &Replication{
+			SourceKeyID:           rep.SourceKeyID,
+			DestinationKeyMapping: rep.KeyMapping,
+		}
+		for _, rule := range rep.Rules {
+			replication.Rules = append(replication.Rules, ReplicationRule{
+				Name:                 rule.Name,
+				DestinationBucketID:  rule.DestinationBucketID,
+				Prefix:               rule.Prefix,
+				Priority:             rule.Priority,
+				IncludeExistingFiles: rule.IncludeExistingFiles,
+				Enabled:              rule.Enabled,
+			})
+		}
+	}
 	return &BucketAttrs{
-		LifecycleRules: rules,
-		Info:           b.b.Info,
-		Type:           BucketType(b.b.Type),
+		LifecycleRules:   rules,
+		Info:             b.b.Info,
+		Type:             BucketType(b.b.Type),
+		FileLockEnabled:  b.b.FileLockEnabled,
+		DefaultRetention: retention,
+		Replication:      replication,
+		Revision:         b.b.Revision,
 	}
 }
 
@@ -333,26 +537,32 @@ func (b *b2Bucket) startLargeFile(ctx context.Context, name, ct string, info map
 	return &b2LargeFile{lf}, nil
 }
 
-func (b *b2Bucket) listFileNames(ctx context.Context, count int, continuation, prefix, delimiter string) ([]b2FileInterface, string, error) {
-	fs, c, err := b.b.ListFileNames(ctx, count, continuation, prefix, delimiter)
-	if err != nil {
-		return nil, "", err
-	}
+// listFileNames lists a page of files, passing each to emit, if it is set, as
+// soon as it has been decoded.
+func (b *b2Bucket) listFileNames(ctx context.Context, count int, continuation, prefix, delimiter string, emit func(b2FileInterface)) ([]b2FileInterface, string, error) {
 	var files []b2FileInterface
-	for _, f := range fs {
+	c, err := b.b.ListFileNamesFunc(ctx, count, continuation, prefix, delimiter, func(f *base.File) {
 		files = append(files, &b2File{f})
+		if emit != nil {
+			emit(files[len(files)-1])
+		}
+	})
+	if err != nil {
+		return nil, "", err
 	}
 	return files, c, nil
 }
 
-func (b *b2Bucket) listFileVersions(ctx context.Context, count int, nextName, nextID, prefix, delimiter string) ([]b2FileInterface, string, string, error) {
-	fs, name, id, err := b.b.ListFileVersions(ctx, count, nextName, nextID, prefix, delimiter)
-	if err != nil {
-		return nil, "", "", err
-	}
+func (b *b2Bucket) listFileVersions(ctx context.Context, count int, nextName, nextID, prefix, delimiter string, emit func(b2FileInterface)) ([]b2FileInterface, string, string, error) {
 	var files []b2FileInterface
-	for _, f := range fs {
+	name, id, err := b.b.ListFileVersionsFunc(ctx, count, nextName, nextID, prefix, delimiter, func(f *base.File) {
 		files = append(files, &b2File{f})
+		if emit != nil {
+			emit(files[len(files)-1])
+		}
+	})
+	if err != nil {
+		return nil, "", "", err
 	}
 	return files, name, id, nil
 }
@@ -369,8 +579,18 @@ func (b *b2Bucket) listUnfinishedLargeFiles(ctx context.Context, count int, cont
 	return files, cont, nil
 }
 
-func (b *b2Bucket) downloadFileByName(ctx context.Context, name string, offset, size int64, header bool) (b2FileReaderInterface, error) {
-	fr, err := b.b.DownloadFileByName(ctx, name, offset, size, header)
+func (b *b2Bucket) downloadFileByName(ctx context.Context, name string, offset, size int64, header bool, ov downloadOverrides) (b2FileReaderInterface, error) {
+	fr, err := b.b.DownloadFileByNameWithOptions(ctx, name, offset, size, header, base.DownloadOptions{
+		Overrides: base.DownloadAuthorizationOptions{
+			ContentDisposition: ov.headers.contentDisposition,
+			ContentLanguage:    ov.headers.contentLanguage,
+			Expires:            ov.headers.expires,
+			CacheControl:       ov.headers.cacheControl,
+			ContentEncoding:    ov.headers.contentEncoding,
+			ContentType:        ov.headers.contentType,
+		},
+		AuthToken: ov.token,
+	})
 	if err != nil {
 		code, _ := base.Code(err)
 		switch code {
@@ -392,8 +612,23 @@ func (b *b2Bucket) hideFile(ctx context.Context, name string) (b2FileInterface,
 	return &b2File{f}, nil
 }
 
-func (b *b2Bucket) getDownloadAuthorization(ctx context.Context, p string, v time.Duration, s string) (string, error) {
-	return b.b.GetDownloadAuthorization(ctx, p, v, s)
+func (b *b2Bucket) copyFile(ctx context.Context, srcID, name string, offset, size int64, ct string, info map[string]string) (b2FileInterface, error) {
+	f, err := b.b.CopyFile(ctx, srcID, name, offset, size, ct, info)
+	if err != nil {
+		return nil, err
+	}
+	return &b2File{f}, nil
+}
+
+func (b *b2Bucket) getDownloadAuthorization(ctx context.Context, p string, v time.Duration, o downloadAuthOptions) (string, error) {
+	return b.b.GetDownloadAuthorization(ctx, p, v, base.DownloadAuthorizationOptions{
+		ContentDisposition: o.contentDisposition,
+		ContentLanguage:    o.contentLanguage,
+		Expires:            o.expires,
+		CacheControl:       o.cacheControl,
+		ContentEncoding:    o.contentEncoding,
+		ContentType:        o.contentType,
+	})
 }
 
 func (b *b2Bucket) baseURL() string {
@@ -477,6 +712,8 @@ func (b *b2LargeFile) finishLargeFile(ctx context.Context) (b2FileInterface, err
 	return &b2File{f}, nil
 }
 
+func (b *b2LargeFile) id() string { return b.b.ID }
+
 func (b *b2LargeFile) getUploadPartURL(ctx context.Context) (b2FileChunkInterface, error) {
 	c, err := b.b.GetUploadPartURL(ctx)
 	if err != nil {
@@ -485,10 +722,26 @@ func (b *b2LargeFile) getUploadPartURL(ctx context.Context) (b2FileChunkInterfac
 	return &b2FileChunk{c}, nil
 }
 
+func (b *b2LargeFile) copyPart(ctx context.Context, srcID string, index int, offset, size int64) (int64, error) {
+	return b.b.CopyPart(ctx, srcID, index, offset, size)
+}
+
 func (b *b2LargeFile) cancel(ctx context.Context) error {
 	return b.b.CancelLargeFile(ctx)
 }
 
+func (b *b2LargeFile) listParts(ctx context.Context, next, count int) ([]b2FilePartInterface, int, error) {
+	parts, n, err := b.b.ListParts(ctx, next, count)
+	if err != nil {
+		return nil, 0, err
+	}
+	var rtn []b2FilePartInterface
+	for _, part := range parts {
+		rtn = append(rtn, &b2FilePart{part})
+	}
+	return rtn, n, nil
+}
+
 func (b *b2FileChunk) reload(ctx context.Context) error {
 	return b.b.Reload(ctx)
 }
@@ -509,7 +762,10 @@ func (b *b2FileReader) stats() (int, string, string, map[string]string) {
 	return b.b.ContentLength, b.b.ContentType, b.b.SHA1, b.b.Info
 }
 
-func (b *b2FileReader) id() string { return b.b.ID }
+func (b *b2FileReader) id() string  { return b.b.ID }
+func (b *b2FileReader) size() int64 { return b.b.Size }
+
+func (b *b2FileReader) timestamp() time.Time { return b.b.Timestamp }
 
 func (b *b2FileInfo) stats() (string, string, int64, string, map[string]string, string, time.Time) {
 	return b.b.Name, b.b.SHA1, b.b.Size, b.b.ContentType, b.b.Info, b.b.Status, b.b.Timestamp
@@ -525,3 +781,5 @@ func (b *b2Key) name() string                  { return b.b.Name }
 func (b *b2Key) expires() time.Time            { return b.b.Expires }
 func (b *b2Key) secret() string                { return b.b.Secret }
 func (b *b2Key) id() string                    { return b.b.ID }
+func (b *b2Key) bucketID() string              { return b.b.BucketID }
+func (b *b2Key) prefix() string                { return b.b.Prefix }
@@ -17,6 +17,7 @@ package b2
 import (
 	"bytes"
 	"crypto/sha1"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"hash"
@@ -64,18 +65,34 @@ type nonBuffer struct {
 	r    *io.SectionReader
 	size int
 	hsh  hash.Hash
+	sha  string // if set, the known hash, sent in place of hex digits at the end
 
 	isEOF bool
 	buf   *strings.Reader
 }
 
-func (nb *nonBuffer) Len() int                      { return nb.size + 40 }
-func (nb *nonBuffer) Hash() string                  { return "hex_digits_at_end" }
 func (nb *nonBuffer) Close() error                  { return nil }
 func (nb *nonBuffer) Reader() (readResetter, error) { return nb, nil }
 func (nb *nonBuffer) Write([]byte) (int, error)     { return 0, errors.New("writes not supported") }
 
+func (nb *nonBuffer) Len() int {
+	if nb.sha != "" {
+		return nb.size
+	}
+	return nb.size + 40
+}
+
+func (nb *nonBuffer) Hash() string {
+	if nb.sha != "" {
+		return nb.sha
+	}
+	return "hex_digits_at_end"
+}
+
 func (nb *nonBuffer) Read(p []byte) (int, error) {
+	if nb.sha != "" {
+		return nb.r.Read(p)
+	}
 	if nb.isEOF {
 		return nb.buf.Read(p)
 	}
@@ -88,6 +105,24 @@ func (nb *nonBuffer) Read(p []byte) (int, error) {
 	return n, err
 }
 
+// sha1 hashes the section of the source that nb covers, without disturbing
+// nb's own reads.
+func (nb *nonBuffer) sha1() (string, error) {
+	h := sha1.New()
+	if _, err := io.Copy(h, io.NewSectionReader(nb.r, 0, int64(nb.size))); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// sentSHA1 returns the hash of the part nb sent, once it has been sent.
+func (nb *nonBuffer) sentSHA1() string {
+	if nb.sha != "" {
+		return nb.sha
+	}
+	return fmt.Sprintf("%x", nb.hsh.Sum(nil))
+}
+
 func (nb *nonBuffer) Reset() error {
 	nb.hsh.Reset()
 	nb.isEOF = false
@@ -95,13 +130,61 @@ func (nb *nonBuffer) Reset() error {
 	return err
 }
 
+// hashedBuffer is a writeBuffer whose hash was given rather than computed.
+type hashedBuffer struct {
+	writeBuffer
+	sha string
+}
+
+func (hb hashedBuffer) Hash() string { return hb.sha }
+
+// withSHA1 returns buf with sha as its hash.  A nonBuffer then sends its hash
+// ahead of the data, and no longer computes it.
+func withSHA1(buf writeBuffer, sha string) writeBuffer {
+	if nb, ok := buf.(*nonBuffer); ok {
+		nb.sha = sha
+		return nb
+	}
+	return hashedBuffer{writeBuffer: buf, sha: sha}
+}
+
+// hashers holds the sha1 hashes of closed buffers, for new buffers to use
+// again.
+var hashers = sync.Pool{
+	New: func() interface{} { return sha1.New() },
+}
+
+func getHasher() hash.Hash {
+	h := hashers.Get().(hash.Hash)
+	h.Reset()
+	return h
+}
+
+func putHasher(h hash.Hash) {
+	if h != nil {
+		hashers.Put(h)
+	}
+}
+
+// memoryBuffer starts out small, from bufpool, and if given a slab pool
+// switches to one of its chunk-sized slabs once it outgrows smallBuffer, so
+// that small objects don't tie up whole chunks and large ones don't grow their
+// buffers by doubling.
 type memoryBuffer struct {
-	buf *bytes.Buffer
-	hsh hash.Hash
-	w   io.Writer
-	mux sync.RWMutex
+	buf  *bytes.Buffer
+	hsh  hash.Hash
+	sum  string    // the hash, once it has been asked for, until more is written
+	pool *slabPool // may be nil
+	slab bool      // buf's storage came from pool
+	mux  sync.RWMutex
+
+	sem  *semaphore // if set, held is returned to sem on Close
+	held int64
 }
 
+// smallBuffer is the most a memoryBuffer holds before taking a slab.
+const smallBuffer = 1 << 20
+
 var bufpool *sync.Pool
 
 func init() {
@@ -109,19 +192,53 @@ func init() {
 	bufpool.New = func() interface{} { return &bytes.Buffer{} }
 }
 
-func newMemoryBuffer() *memoryBuffer {
+func newMemoryBuffer(pool *slabPool) *memoryBuffer {
 	mb := &memoryBuffer{
-		hsh: sha1.New(),
+		hsh:  getHasher(),
+		pool: pool,
 	}
 	mb.buf = bufpool.Get().(*bytes.Buffer)
-	mb.w = io.MultiWriter(mb.hsh, mb.buf)
 	return mb
 }
 
+// unhashed stops mb hashing what is written to it, for when the hash is
+// expected to be given instead.  Hash then reads the whole buffer.
+func (mb *memoryBuffer) unhashed() *memoryBuffer {
+	putHasher(mb.hsh)
+	mb.hsh = nil
+	return mb
+}
+
+// reserved returns how much mb holds of the client's MaxBufferedBytes.
+func (mb *memoryBuffer) reserved() int64 {
+	mb.mux.RLock()
+	defer mb.mux.RUnlock()
+	return mb.held
+}
+
+// hold records that n more has been taken from sem for mb.
+func (mb *memoryBuffer) hold(sem *semaphore, n int64) {
+	mb.mux.Lock()
+	defer mb.mux.Unlock()
+	mb.sem = sem
+	mb.held += n
+}
+
 func (mb *memoryBuffer) Write(p []byte) (int, error) {
 	mb.mux.Lock()
 	defer mb.mux.Unlock()
-	return mb.w.Write(p)
+	if mb.pool != nil && !mb.slab && mb.buf.Len()+len(p) > smallBuffer {
+		slab := append(mb.pool.get(), mb.buf.Bytes()...)
+		mb.buf.Reset()
+		bufpool.Put(mb.buf)
+		mb.buf = bytes.NewBuffer(slab)
+		mb.slab = true
+	}
+	if mb.hsh != nil {
+		mb.hsh.Write(p) // Hash.Write never returns an error.
+	}
+	mb.sum = ""
+	return mb.buf.Write(p)
 }
 
 func (mb *memoryBuffer) Len() int {
@@ -137,9 +254,23 @@ func (mb *memoryBuffer) Reader() (readResetter, error) {
 }
 
 func (mb *memoryBuffer) Hash() string {
-	mb.mux.RLock()
-	defer mb.mux.RUnlock()
-	return fmt.Sprintf("%x", mb.hsh.Sum(nil))
+	mb.mux.Lock()
+	defer mb.mux.Unlock()
+	return mb.hash()
+}
+
+// hash returns the hash of what has been written to mb; it must be called
+// with mb.mux held.
+func (mb *memoryBuffer) hash() string {
+	if mb.sum == "" {
+		if mb.hsh == nil {
+			s := sha1.Sum(mb.buf.Bytes())
+			mb.sum = hex.EncodeToString(s[:])
+		} else {
+			mb.sum = hex.EncodeToString(mb.hsh.Sum(nil))
+		}
+	}
+	return mb.sum
 }
 
 func (mb *memoryBuffer) Close() error {
@@ -148,17 +279,93 @@ func (mb *memoryBuffer) Close() error {
 	if mb.buf == nil {
 		return nil
 	}
-	mb.buf.Truncate(0)
-	bufpool.Put(mb.buf)
+	mb.sem.release(mb.held)
+	mb.held = 0
+	if mb.hsh != nil {
+		// Keep the hash for anyone who asks for it after mb is closed.
+		mb.hash()
+		putHasher(mb.hsh)
+		mb.hsh = nil
+	}
+	switch {
+	case mb.slab:
+		mb.pool.put(mb.buf.Bytes())
+	case mb.buf.Cap() <= 2*smallBuffer:
+		mb.buf.Truncate(0)
+		bufpool.Put(mb.buf)
+	}
 	mb.buf = nil
 	return nil
 }
 
+// bufferPool keeps a slabPool for each chunk size in use by a Client's
+// Writers.  The pool for a size is kept after its last Writer is closed, for
+// the next Writer, but is dropped as soon as a Writer with a different size
+// starts, so that a change of ChunkSize doesn't leave buffers of the old size
+// behind.
+type bufferPool struct {
+	mu    sync.Mutex
+	pools map[int]*slabPool
+}
+
+// acquire returns the pool of slabs of the given size, which the caller must
+// release when it no longer needs them.
+func (bp *bufferPool) acquire(size int) *slabPool {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	if bp.pools == nil {
+		bp.pools = make(map[int]*slabPool)
+	}
+	for n, sp := range bp.pools {
+		if n != size && sp.users == 0 {
+			delete(bp.pools, n)
+		}
+	}
+	sp, ok := bp.pools[size]
+	if !ok {
+		sp = &slabPool{size: size}
+		bp.pools[size] = sp
+	}
+	sp.users++
+	return sp
+}
+
+func (bp *bufferPool) release(sp *slabPool) {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	sp.users--
+}
+
+// slabPool holds byte slices with a capacity of exactly size.
+type slabPool struct {
+	size  int
+	users int // guarded by the bufferPool's mu
+	pool  sync.Pool
+}
+
+func (sp *slabPool) get() []byte {
+	if b, ok := sp.pool.Get().(*[]byte); ok {
+		return (*b)[:0]
+	}
+	return make([]byte, 0, sp.size)
+}
+
+// put returns b to the pool, unless it has been reallocated to another size.
+func (sp *slabPool) put(b []byte) {
+	if cap(b) != sp.size {
+		return
+	}
+	b = b[:0]
+	sp.pool.Put(&b)
+}
+
 type fileBuffer struct {
-	f   *os.File
-	hsh hash.Hash
-	w   io.Writer
-	s   int
+	f      *os.File
+	hsh    hash.Hash
+	sum    string // the hash, once it has been asked for, until more is written
+	w      io.Writer
+	s      int
+	closed bool
 }
 
 func newFileBuffer(loc string) (*fileBuffer, error) {
@@ -168,20 +375,47 @@ func newFileBuffer(loc string) (*fileBuffer, error) {
 	}
 	fb := &fileBuffer{
 		f:   f,
-		hsh: sha1.New(),
+		hsh: getHasher(),
 	}
 	fb.w = io.MultiWriter(fb.f, fb.hsh)
 	return fb, nil
 }
 
+// unhashed stops fb hashing what is written to it, for when the hash is
+// expected to be given instead.  Hash then reads the whole file.
+func (fb *fileBuffer) unhashed() *fileBuffer {
+	putHasher(fb.hsh)
+	fb.hsh = nil
+	fb.w = fb.f
+	return fb
+}
+
 func (fb *fileBuffer) Write(p []byte) (int, error) {
 	n, err := fb.w.Write(p)
 	fb.s += n
+	fb.sum = ""
 	return n, err
 }
 
-func (fb *fileBuffer) Len() int     { return fb.s }
-func (fb *fileBuffer) Hash() string { return fmt.Sprintf("%x", fb.hsh.Sum(nil)) }
+func (fb *fileBuffer) Len() int { return fb.s }
+
+func (fb *fileBuffer) Hash() string {
+	if fb.sum != "" {
+		return fb.sum
+	}
+	if fb.hsh == nil {
+		h := getHasher()
+		defer putHasher(h)
+		if _, err := io.Copy(h, io.NewSectionReader(fb.f, 0, int64(fb.s))); err != nil {
+			// The upload will fail to read the file too.
+			return ""
+		}
+		fb.sum = hex.EncodeToString(h.Sum(nil))
+	} else {
+		fb.sum = hex.EncodeToString(fb.hsh.Sum(nil))
+	}
+	return fb.sum
+}
 
 func (fb *fileBuffer) Reader() (readResetter, error) {
 	if _, err := fb.f.Seek(0, 0); err != nil {
@@ -190,7 +424,18 @@ func (fb *fileBuffer) Reader() (readResetter, error) {
 	return &fr{f: fb.f}, nil
 }
 
+// Close removes the scratch file.  It may be called more than once.
 func (fb *fileBuffer) Close() error {
+	if fb.closed {
+		return nil
+	}
+	fb.closed = true
+	if fb.hsh != nil {
+		// Keep the hash for anyone who asks for it after fb is closed.
+		fb.Hash()
+		putHasher(fb.hsh)
+		fb.hsh = nil
+	}
 	fb.f.Close()
 	return os.Remove(fb.f.Name())
 }
@@ -0,0 +1,52 @@
+// Copyright 2024, the Blazer authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package b2
+
+import "time"
+
+// A Clock tells the time, and waits for it to pass.  A client waits on its
+// Clock before it retries and while it paces transfers to a rate, and tells by
+// it when its authorization is due to expire, how long upload URLs have been
+// idle, how its RetryBudget stands, and when LocalConsistency entries expire.
+// Its methods are those of package time.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+// WithClock returns a ClientOption that gives the client c in place of the
+// system's clock.  It is meant for tests: with a fake Clock, such as a
+// b2test.FakeClock, the client retries without waiting, so that retries can be
+// tested quickly, as can code that gives the client short contexts.  The
+// timeouts of contexts, and the durations that Status reports, remain those of
+// the system's clock.
+func WithClock(c Clock) ClientOption {
+	return func(o *clientOptions) {
+		o.clock = c
+	}
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time                         { return time.Now() }
+func (systemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// getClock returns the Clock that the client was given, or the system's.
+func (o clientOptions) getClock() Clock {
+	if o.clock == nil {
+		return systemClock{}
+	}
+	return o.clock
+}
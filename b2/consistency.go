@@ -0,0 +1,243 @@
+// Copyright 2024, the Blazer authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package b2
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LocalConsistency causes the client to remember, for the given duration,
+// the objects it has recently written, hidden, and deleted, and to patch
+// subsequent listings and Attrs calls made through the same client so that
+// those changes are visible even if B2 has not caught up.
+//
+// Specifically, while an operation is remembered:
+//
+//   - objects deleted through this client are omitted from all listings, and
+//     Attrs on them returns an error for which IsNotExist is true;
+//   - objects hidden through this client are omitted from listings of current
+//     objects, and Attrs on them reports that they do not exist;
+//   - objects written through this client appear in listings of current
+//     objects (in their proper place), replacing any older version that B2
+//     still reports.
+//
+// This is strictly local to the client: other clients, other processes, and
+// other machines will not see these changes any sooner.  Objects written are
+// not injected into listings that use ListHidden, ListUnfinished, or that
+// would be collapsed by ListDelimiter.
+//
+// LocalConsistency is off by default.
+func LocalConsistency(ttl time.Duration) ClientOption {
+	return func(c *clientOptions) {
+		c.consistencyTTL = ttl
+	}
+}
+
+type ccKey struct {
+	bucket, name string
+}
+
+type ccEntry struct {
+	when time.Time
+	obj  *Object // nil if the object was hidden
+}
+
+type consistencyCache struct {
+	ttl time.Duration
+	now func() time.Time
+
+	mu    sync.Mutex
+	names map[ccKey]ccEntry    // the most recent write or hide, by name
+	ids   map[string]time.Time // deleted file IDs
+}
+
+func newConsistencyCache(ttl time.Duration, now func() time.Time) *consistencyCache {
+	return &consistencyCache{
+		ttl:   ttl,
+		now:   now,
+		names: make(map[ccKey]ccEntry),
+		ids:   make(map[string]time.Time),
+	}
+}
+
+// consistency returns the client's consistency cache, or nil if
+// LocalConsistency was not requested.  All methods are safe to call on a nil
+// cache.
+func (c *Client) consistency() *consistencyCache {
+	if c == nil {
+		return nil
+	}
+	c.ccOnce.Do(func() {
+		if c.opts.consistencyTTL > 0 {
+			c.cc = newConsistencyCache(c.opts.consistencyTTL, c.opts.getClock().Now)
+		}
+	})
+	return c.cc
+}
+
+// expire removes stale entries; it must be called with cc.mu held.
+func (cc *consistencyCache) expire() {
+	now := cc.now()
+	for k, e := range cc.names {
+		if now.Sub(e.when) > cc.ttl {
+			delete(cc.names, k)
+		}
+	}
+	for id, when := range cc.ids {
+		if now.Sub(when) > cc.ttl {
+			delete(cc.ids, id)
+		}
+	}
+}
+
+func (cc *consistencyCache) wrote(o *Object) {
+	if cc == nil || o.f == nil {
+		return
+	}
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	cc.names[ccKey{bucket: o.b.Name(), name: o.name}] = ccEntry{when: cc.now(), obj: o}
+}
+
+func (cc *consistencyCache) hid(o *Object) {
+	if cc == nil {
+		return
+	}
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	cc.names[ccKey{bucket: o.b.Name(), name: o.name}] = ccEntry{when: cc.now()}
+}
+
+func (cc *consistencyCache) deleted(o *Object) {
+	if cc == nil || o.f == nil {
+		return
+	}
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	id := o.f.id()
+	cc.ids[id] = cc.now()
+	key := ccKey{bucket: o.b.Name(), name: o.name}
+	e, ok := cc.names[key]
+	if !ok {
+		return
+	}
+	switch {
+	case e.obj == nil && o.f.status() == "hide":
+		// The hide marker itself was deleted, so the object is visible again.
+		delete(cc.names, key)
+	case e.obj != nil && e.obj.f.id() == id:
+		delete(cc.names, key)
+	}
+}
+
+// gone reports whether the object is known to have been deleted or hidden.
+func (cc *consistencyCache) gone(o *Object) bool {
+	if cc == nil {
+		return false
+	}
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	cc.expire()
+	if o.f != nil {
+		if _, ok := cc.ids[o.f.id()]; ok {
+			return true
+		}
+	}
+	e, ok := cc.names[ccKey{bucket: o.b.Name(), name: o.name}]
+	return ok && e.obj == nil
+}
+
+// written returns the object most recently written under the given name, or
+// nil.
+func (cc *consistencyCache) written(b *Bucket, name string) *Object {
+	if cc == nil {
+		return nil
+	}
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	cc.expire()
+	return cc.names[ccKey{bucket: b.Name(), name: name}].obj
+}
+
+// filter patches a page of listed objects.  The page covers names in the
+// range (after, last], or (after, ∞) if final is set.  Writes and hides are
+// only applied to listings of current objects.
+func (cc *consistencyCache) filter(b *Bucket, objs []*Object, after string, final bool, opts objectIteratorOptions) []*Object {
+	if cc == nil || opts.unfinished {
+		return objs
+	}
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	cc.expire()
+
+	current := !opts.hidden
+	bname := b.Name()
+	var last string
+	if len(objs) > 0 {
+		last = objs[len(objs)-1].name
+	}
+	listed := make(map[string]bool)
+	var out []*Object
+	for _, o := range objs {
+		if o.f == nil || o.f.status() == "folder" {
+			out = append(out, o)
+			continue
+		}
+		if _, ok := cc.ids[o.f.id()]; ok {
+			continue
+		}
+		if !current {
+			out = append(out, o)
+			continue
+		}
+		listed[o.name] = true
+		e, ok := cc.names[ccKey{bucket: bname, name: o.name}]
+		switch {
+		case !ok:
+			out = append(out, o)
+		case e.obj == nil:
+			// hidden
+		default:
+			out = append(out, e.obj)
+		}
+	}
+	if !current {
+		return out
+	}
+	var added bool
+	for k, e := range cc.names {
+		if k.bucket != bname || e.obj == nil || listed[k.name] {
+			continue
+		}
+		if k.name <= after || (!final && k.name > last) {
+			continue
+		}
+		if !strings.HasPrefix(k.name, opts.prefix) {
+			continue
+		}
+		if opts.delimiter != "" && strings.Contains(k.name[len(opts.prefix):], opts.delimiter) {
+			continue
+		}
+		out = append(out, e.obj)
+		added = true
+	}
+	if added {
+		sort.SliceStable(out, func(i, j int) bool { return out[i].name < out[j].name })
+	}
+	return out
+}
@@ -0,0 +1,223 @@
+// Copyright 2024, the Blazer authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package b2
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// maxSimpleCopy is the largest object b2_copy_file will accept; anything
+// larger must be copied in parts.
+var maxSimpleCopy int64 = 5e9
+
+type copyOptions struct {
+	attrs          *Attrs
+	ranged         bool
+	offset, length int64
+}
+
+// A CopyOption alters the behavior of Object.CopyTo.
+type CopyOption func(*copyOptions)
+
+// CopyAttrs replaces the content type and metadata of the copy with those in
+// attrs.  Only ContentType, LastModified, SHA1, Info, and the header fields
+// such as CacheControl are used, as they are for WithAttrsOption.  Without
+// this option, the copy keeps the source's content type and metadata.
+func CopyAttrs(attrs *Attrs) CopyOption {
+	return func(c *copyOptions) {
+		c.attrs = attrs
+	}
+}
+
+// CopyRange copies only length bytes of the source, starting at offset.  If
+// length is negative, everything from offset to the end of the source is
+// copied.
+func CopyRange(offset, length int64) CopyOption {
+	return func(c *copyOptions) {
+		c.ranged = true
+		c.offset = offset
+		c.length = length
+	}
+}
+
+// CopyTo copies the object to dst, which may be in another bucket, without
+// downloading it.  Objects larger than 5GB cannot be copied in a single
+// request; for these, CopyTo creates dst as a large file and copies the
+// source into it part by part, using the account's recommended part size.
+//
+// Once CopyTo returns successfully, dst.Attrs reports the attributes of the
+// copy without another request to B2.
+func (o *Object) CopyTo(ctx context.Context, dst *Object, opts ...CopyOption) error {
+	copts := &copyOptions{}
+	for _, f := range opts {
+		f(copts)
+	}
+	if err := o.ensure(ctx); err != nil {
+		return err
+	}
+	fi, err := o.f.getFileInfo(ctx)
+	if err != nil {
+		return err
+	}
+	_, _, size, ct, info, _, _ := fi.stats()
+
+	var offset, length int64 = 0, size
+	if copts.ranged {
+		if copts.offset < 0 || copts.offset >= size {
+			return fmt.Errorf("b2: copy range offset %d is outside %s (%d bytes)", copts.offset, o.name, size)
+		}
+		offset = copts.offset
+		length = size - offset
+		if copts.length >= 0 && copts.length < length {
+			length = copts.length
+		}
+		if length == 0 {
+			return errors.New("b2: empty copy range")
+		}
+	}
+
+	var rct string
+	var rinfo map[string]string
+	if copts.attrs != nil {
+		rct = copts.attrs.ContentType
+		if rct == "" {
+			rct = "application/octet-stream"
+		}
+		rinfo, err = copts.attrs.rawInfo()
+		if err != nil {
+			return err
+		}
+	}
+
+	if length <= maxSimpleCopy {
+		// A zero size copies the whole source.
+		var rsize int64
+		if copts.ranged {
+			rsize = length
+		}
+		f, err := dst.b.b.copyFile(ctx, o.f.id(), dst.name, offset, rsize, rct, rinfo)
+		if err != nil {
+			return err
+		}
+		dst.f = f
+		dst.attrs = nil
+		dst.b.c.consistency().wrote(dst)
+		return nil
+	}
+
+	if rct == "" {
+		rct = ct
+		rinfo = make(map[string]string, len(info))
+		for k, v := range info {
+			rinfo[k] = v
+		}
+		if copts.ranged {
+			// The source's hash doesn't describe a part of it.
+			delete(rinfo, "large_file_sha1")
+		}
+	}
+	f, err := o.copyLarge(ctx, dst, offset, length, rct, rinfo)
+	if err != nil {
+		return err
+	}
+	sha := "none"
+	if v, ok := rinfo["large_file_sha1"]; ok {
+		sha = v
+	}
+	attrs, err := attrsFromStats(dst.name, sha, length, rct, rinfo, f.status(), f.timestamp())
+	if err != nil {
+		return err
+	}
+	attrs.ID = f.id()
+	dst.f = f
+	dst.attrs = attrs
+	dst.b.c.consistency().wrote(dst)
+	return nil
+}
+
+func (o *Object) copyLarge(ctx context.Context, dst *Object, offset, length int64, ct string, info map[string]string) (beFileInterface, error) {
+	partSize := int64(o.b.c.backend.accountInfo().RecommendedPartSize)
+	if partSize < 1 {
+		partSize = 1e8
+	}
+	lf, err := dst.b.b.startLargeFile(ctx, dst.name, ct, info)
+	if err != nil {
+		return nil, err
+	}
+	end := offset + length
+	for i, off := 1, offset; off < end; i, off = i+1, off+partSize {
+		n := partSize
+		if off+n > end {
+			n = end - off
+		}
+		if _, err := lf.copyPart(ctx, o.f.id(), i, off, n); err != nil {
+			// Unlike uploads, a copy can't be resumed, so don't leave the
+			// unfinished file behind.
+			lf.cancel(ctx)
+			return nil, err
+		}
+	}
+	return lf.finishLargeFile(ctx)
+}
+
+type updateAttrsOptions struct {
+	multipart bool
+}
+
+// An UpdateAttrsOption alters the behavior of Object.UpdateAttrs.
+type UpdateAttrsOption func(*updateAttrsOptions)
+
+// UpdateAttrsMultipart allows UpdateAttrs to rewrite objects larger than 5GB,
+// which B2 can only copy part by part.  The copy is still server-side, but
+// takes one request per part.
+func UpdateAttrsMultipart() UpdateAttrsOption {
+	return func(u *updateAttrsOptions) {
+		u.multipart = true
+	}
+}
+
+// UpdateAttrs replaces the object's content type and metadata by copying it
+// onto itself server-side, and returns the attributes of the new version.  As
+// with WithAttrsOption, only ContentType, LastModified, SHA1, Info, and the
+// header fields such as CacheControl are used, and they replace the existing
+// metadata entirely; to change a single field, start from the result of
+// Attrs.  The previous version is not removed.
+//
+// Objects larger than 5GB are refused unless UpdateAttrsMultipart is given.
+func (o *Object) UpdateAttrs(ctx context.Context, attrs *Attrs, opts ...UpdateAttrsOption) (*Attrs, error) {
+	uopts := &updateAttrsOptions{}
+	for _, f := range opts {
+		f(uopts)
+	}
+	if err := o.ensure(ctx); err != nil {
+		return nil, err
+	}
+	fi, err := o.f.getFileInfo(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, _, size, _, _, _, _ := fi.stats(); size > maxSimpleCopy && !uopts.multipart {
+		return nil, fmt.Errorf("b2: %s is %d bytes, larger than a single copy allows; use UpdateAttrsMultipart to copy it in parts", o.name, size)
+	}
+	dst := o.b.Object(o.name)
+	if err := o.CopyTo(ctx, dst, CopyAttrs(attrs)); err != nil {
+		return nil, err
+	}
+	o.f = dst.f
+	o.attrs = dst.attrs
+	return o.Attrs(ctx)
+}
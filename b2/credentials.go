@@ -0,0 +1,94 @@
+// Copyright 2024, the Blazer authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package b2
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// A CredentialsProvider gives the application key with which a client
+// authorizes the account.  It is consulted each time the client authorizes,
+// including when an authorization expires or is refused, so that a client
+// whose key is rotated picks up the new one.  It must be safe for concurrent
+// use.
+type CredentialsProvider interface {
+	Credentials(ctx context.Context) (keyID, applicationKey string, err error)
+}
+
+// CredentialsFunc adapts a function to a CredentialsProvider.
+type CredentialsFunc func(ctx context.Context) (keyID, applicationKey string, err error)
+
+// Credentials calls f.
+func (f CredentialsFunc) Credentials(ctx context.Context) (string, string, error) {
+	return f(ctx)
+}
+
+type staticCredentials struct {
+	keyID, applicationKey string
+}
+
+func (s staticCredentials) Credentials(context.Context) (string, string, error) {
+	return s.keyID, s.applicationKey, nil
+}
+
+// StaticCredentials returns a CredentialsProvider that always gives the same
+// application key.  It is what NewClient uses without WithCredentials.
+func StaticCredentials(keyID, applicationKey string) CredentialsProvider {
+	return staticCredentials{keyID: keyID, applicationKey: applicationKey}
+}
+
+// WithCredentials authorizes the client with the application keys that p
+// gives, in place of those passed to NewClient, which may be empty.
+func WithCredentials(p CredentialsProvider) ClientOption {
+	return func(c *clientOptions) {
+		c.credentials = p
+	}
+}
+
+// A CredentialsError is returned when a client could not authorize because
+// its CredentialsProvider failed, as opposed to B2 refusing the key.
+type CredentialsError struct {
+	Err error // The provider's error.
+}
+
+func (e *CredentialsError) Error() string {
+	return fmt.Sprintf("b2: couldn't get credentials: %v", e.Err)
+}
+
+func (e *CredentialsError) Unwrap() error {
+	return e.Err
+}
+
+// ErrNoCredentials is wrapped by the *CredentialsError of a client resumed from
+// a session without WithCredentials, when it needs to authorize the account.
+var ErrNoCredentials = errors.New("no credentials configured")
+
+var noCredentials = CredentialsFunc(func(context.Context) (string, string, error) {
+	return "", "", ErrNoCredentials
+})
+
+// credentials asks p for an application key.  A nil p gives an empty one.
+func credentials(ctx context.Context, p CredentialsProvider) (string, string, error) {
+	if p == nil {
+		return "", "", nil
+	}
+	id, key, err := p.Credentials(ctx)
+	if err != nil {
+		return "", "", &CredentialsError{Err: err}
+	}
+	return id, key, nil
+}
@@ -0,0 +1,156 @@
+// Copyright 2024, the Blazer authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package b2
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"github.com/Backblaze/blazer/internal/pool"
+)
+
+// defaultBatchConcurrency is the number of calls that batch operations make at
+// once without BatchConcurrency.
+const defaultBatchConcurrency = 10
+
+// BatchConcurrency sets the number of calls that batch operations made of
+// many independent calls, such as Bucket.DeleteObjects, make at once, unless
+// they are given a number of their own.  The default is 10; an n of less than
+// one keeps it.
+func BatchConcurrency(n int) ClientOption {
+	return func(c *clientOptions) {
+		c.batchConcurrency = n
+	}
+}
+
+// batchConcurrency returns the number of calls that c's batch operations make
+// at once.
+func (c *Client) batchConcurrency() int {
+	if c == nil || c.opts.batchConcurrency < 1 {
+		return defaultBatchConcurrency
+	}
+	return c.opts.batchConcurrency
+}
+
+type deleteOptions struct {
+	workers int
+}
+
+// A DeleteOption alters the behavior of Bucket.DeleteObjects.
+type DeleteOption func(*deleteOptions)
+
+// DeleteWorkers sets the number of versions that are deleted concurrently.
+// The default is the client's BatchConcurrency.
+func DeleteWorkers(n int) DeleteOption {
+	return func(d *deleteOptions) {
+		d.workers = n
+	}
+}
+
+// A DeleteFailure records a single version that DeleteObjects could not
+// remove.
+type DeleteFailure struct {
+	Name string
+	ID   string
+	Err  error
+}
+
+func (f DeleteFailure) Error() string {
+	return fmt.Sprintf("%s (%v)", f.Name, f.Err)
+}
+
+func (f DeleteFailure) Unwrap() error {
+	return f.Err
+}
+
+// A DeleteObjectsError is returned by DeleteObjects when one or more versions
+// could not be removed.
+type DeleteObjectsError struct {
+	Failures []DeleteFailure
+}
+
+func (e *DeleteObjectsError) Error() string {
+	const show = 5
+	var names []string
+	for i, f := range e.Failures {
+		if i == show {
+			names = append(names, fmt.Sprintf("and %d more", len(e.Failures)-show))
+			break
+		}
+		names = append(names, f.Error())
+	}
+	return fmt.Sprintf("b2: failed to delete %d versions: %s", len(e.Failures), strings.Join(names, ", "))
+}
+
+// DeleteObjects deletes every version of every object whose name begins with
+// prefix, including hide markers, and cancels any unfinished large files.  An
+// empty prefix empties the bucket.  It returns the number of versions removed.
+//
+// Failures to delete individual versions do not stop DeleteObjects; instead
+// they are collected and returned together as a *DeleteObjectsError once the
+// listing is exhausted.  Versions that have already disappeared are not
+// counted as failures.  If the listing itself fails, that error is returned.
+func (b *Bucket) DeleteObjects(ctx context.Context, prefix string, opts ...DeleteOption) (int, error) {
+	dopts := &deleteOptions{workers: b.c.batchConcurrency()}
+	for _, f := range opts {
+		f(dopts)
+	}
+
+	p := pool.New(ctx, dopts.workers)
+	var n int64
+	iter := b.List(ctx, ListPrefix(prefix), ListHidden())
+	for iter.Next() {
+		o := iter.Object()
+		err := p.Go(func(ctx context.Context) error {
+			err := o.deleteVersion(ctx)
+			switch {
+			case err == nil:
+				atomic.AddInt64(&n, 1)
+			case !IsNotExist(err):
+				return DeleteFailure{Name: o.name, ID: o.f.id(), Err: err}
+			}
+			return nil
+		})
+		if err != nil {
+			break
+		}
+	}
+	var failures []DeleteFailure
+	for _, err := range p.Wait() {
+		failures = append(failures, err.(DeleteFailure))
+	}
+
+	if err := iter.Err(); err != nil {
+		return int(n), err
+	}
+	if err := ctx.Err(); err != nil {
+		return int(n), err
+	}
+	if len(failures) > 0 {
+		return int(n), &DeleteObjectsError{Failures: failures}
+	}
+	return int(n), nil
+}
+
+// deleteVersion deletes a listed version, canceling it if it is an
+// unfinished large file.
+func (o *Object) deleteVersion(ctx context.Context) error {
+	if o.f.status() != "start" {
+		return o.Delete(ctx)
+	}
+	return o.f.compileParts(0, nil).cancel(ctx)
+}
@@ -0,0 +1,220 @@
+// Copyright 2024, the Blazer authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package b2
+
+import (
+	"context"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+type downloadOptions struct {
+	concurrency int
+	chunkSize   int64
+	verify      bool
+}
+
+// A DownloadOption alters the behavior of Object.DownloadTo.
+type DownloadOption func(*downloadOptions)
+
+// DownloadConcurrency sets the number of ranges that are fetched
+// simultaneously.  The default is 4.
+func DownloadConcurrency(n int) DownloadOption {
+	return func(o *downloadOptions) {
+		o.concurrency = n
+	}
+}
+
+// DownloadChunkSize sets the size of each range request.  The default is
+// 10MB.
+func DownloadChunkSize(n int64) DownloadOption {
+	return func(o *downloadOptions) {
+		o.chunkSize = n
+	}
+}
+
+// DownloadVerify causes DownloadTo to compare the SHA1 hash of the downloaded
+// content against the hash recorded by B2.  The hash is calculated by reading
+// the content back after every range has been written, and so the io.WriterAt
+// given to DownloadTo must also implement io.ReaderAt (as *os.File does).
+// Objects without a recorded hash, such as large files uploaded without one,
+// are not verified.
+func DownloadVerify() DownloadOption {
+	return func(o *downloadOptions) {
+		o.verify = true
+	}
+}
+
+// DownloadTo downloads the object into w, returning the number of bytes
+// written.  Ranges are fetched concurrently and written directly to their
+// offset in w, so unlike a Reader no data is buffered in memory beyond what
+// is in flight.  Writes arrive out of order, and w must be safe for
+// concurrent use with non-overlapping ranges.  If the object is overwritten
+// while it is downloaded, DownloadTo fails rather than mix the two versions.
+func (o *Object) DownloadTo(ctx context.Context, w io.WriterAt, opts ...DownloadOption) (int64, error) {
+	dopts := &downloadOptions{
+		concurrency: 4,
+		chunkSize:   1e7,
+	}
+	for _, f := range opts {
+		f(dopts)
+	}
+	if dopts.concurrency < 1 {
+		dopts.concurrency = 1
+	}
+	if dopts.chunkSize < 1 {
+		dopts.chunkSize = 1e7
+	}
+	var ra io.ReaderAt
+	if dopts.verify {
+		r, ok := w.(io.ReaderAt)
+		if !ok {
+			return 0, errors.New("b2: DownloadVerify requires an io.WriterAt that implements io.ReaderAt")
+		}
+		ra = r
+	}
+
+	fr, err := o.b.b.downloadFileByName(ctx, o.name, 0, 0, true, downloadOverrides{})
+	if err != nil {
+		return 0, err
+	}
+	fr.Close()
+	_, _, sha, _ := fr.stats()
+	size := fr.size()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	offsets := make(chan int64)
+	var wg sync.WaitGroup
+	var emux sync.Mutex
+	var rerr error
+	setErr := func(err error) {
+		emux.Lock()
+		defer emux.Unlock()
+		if rerr == nil {
+			rerr = err
+			cancel()
+		}
+	}
+	for i := 0; i < dopts.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for off := range offsets {
+				n := dopts.chunkSize
+				if off+n > size {
+					n = size - off
+				}
+				if err := o.downloadRange(ctx, w, fr.id(), off, n); err != nil {
+					setErr(err)
+					return
+				}
+			}
+		}()
+	}
+feed:
+	for off := int64(0); off < size; off += dopts.chunkSize {
+		select {
+		case offsets <- off:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(offsets)
+	wg.Wait()
+	if rerr != nil {
+		return 0, rerr
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	if dopts.verify && len(sha) == 40 {
+		h := sha1.New()
+		if _, err := io.Copy(h, io.NewSectionReader(ra, 0, size)); err != nil {
+			return size, err
+		}
+		if got := fmt.Sprintf("%x", h.Sum(nil)); got != sha {
+			return size, &ChecksumMismatchError{Name: o.name, Expected: sha, Actual: got}
+		}
+	}
+	return size, nil
+}
+
+// downloadRange downloads size bytes at off into w.  Every range must come
+// from the file with the ID fid, which DownloadTo found first, so that an
+// object overwritten while it is downloaded isn't pieced together from
+// different versions.
+func (o *Object) downloadRange(ctx context.Context, w io.WriterAt, fid string, off, size int64) error {
+	transfers, _ := o.b.c.limits()
+	if err := transfers.acquire(ctx, 1); err != nil {
+		return err
+	}
+	defer transfers.release(1)
+	_, down := o.b.c.throttles()
+	rt := bodyRetrier(o.b.r)
+	ow := &offsetWriter{w: w, off: off, rate: &o.b.c.readRate}
+	end := off + size
+	for {
+		fr, err := o.b.b.downloadFileByName(ctx, o.name, ow.off, end-ow.off, false, downloadOverrides{})
+		if err != nil {
+			return err
+		}
+		if fr.id() != fid {
+			fr.Close()
+			return fmt.Errorf("b2: %s changed while it was being downloaded", o.name)
+		}
+		i, err := copyContext(ctx, ow, io.LimitReader(down.throttle(ctx, noopResetter{fr}), end-ow.off))
+		fr.Close()
+		if err != nil && !bodyRetryable(err) {
+			return interrupted(fmt.Sprintf("b2: downloading %s at offset %d", o.name, ow.off), err)
+		}
+		if ow.off == end {
+			return nil
+		}
+		// Probably the network connection was closed early.  Ask for the rest.
+		if i > 0 {
+			rt.Progress()
+		}
+		if err == nil {
+			err = io.ErrUnexpectedEOF
+		}
+		if !rt.Retry(err) {
+			return fmt.Errorf("b2: downloading %s: got %d of %d bytes at offset %d: %w", o.name, ow.off-off, size, off, err)
+		}
+		o.b.c.v(1).Infof("b2 download %d: got %dB of %dB; resuming", off, ow.off-off, size)
+		if err := rt.Wait(ctx, err); err != nil {
+			return interrupted(fmt.Sprintf("b2: downloading %s at offset %d", o.name, ow.off), err)
+		}
+	}
+}
+
+// offsetWriter turns sequential writes into writes at increasing offsets.
+type offsetWriter struct {
+	w    io.WriterAt
+	off  int64
+	rate *rateMeter // if set, given the bytes written
+}
+
+func (ow *offsetWriter) Write(p []byte) (int, error) {
+	n, err := ow.w.WriteAt(p, ow.off)
+	ow.off += int64(n)
+	ow.rate.add(int64(n), 0)
+	return n, err
+}
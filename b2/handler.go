@@ -0,0 +1,275 @@
+// Copyright 2024, the Blazer authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package b2
+
+import (
+	"context"
+	"html/template"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// maxIndexEntries is the most objects an index page lists.
+const maxIndexEntries = 1000
+
+type handlerOptions struct {
+	cacheControl string
+	index        bool
+	listPrivate  bool
+}
+
+// A HandlerOption alters the behavior of HTTPHandler.
+type HandlerOption func(*handlerOptions)
+
+// HandlerCacheControl sets the Cache-Control header served with objects that
+// were not uploaded with a CacheControl of their own.
+func HandlerCacheControl(value string) HandlerOption {
+	return func(o *handlerOptions) {
+		o.cacheControl = value
+	}
+}
+
+// HandlerIndex serves an index page, from a listing with a delimiter of "/",
+// for each path that ends in "/", and redirects a path without one to it if
+// there is no object of that name but there are objects under it.  Pages list
+// at most 1000 objects.  Unless HandlerListPrivate is also given, index pages
+// are served only from allPublic buckets, whose listings are not otherwise
+// secret.
+func HandlerIndex() HandlerOption {
+	return func(o *handlerOptions) {
+		o.index = true
+	}
+}
+
+// HandlerListPrivate serves the index pages of HandlerIndex from buckets that
+// are not allPublic, too, revealing the names of their objects to anyone who
+// can reach the handler.
+func HandlerListPrivate() HandlerOption {
+	return func(o *handlerOptions) {
+		o.listPrivate = true
+	}
+}
+
+// HTTPHandler returns an http.Handler that serves the objects in bucket whose
+// names begin with prefix, each at its name without the prefix; use
+// http.StripPrefix to serve them below a path of their own.  Objects are
+// served with http.ServeContent, so GET and HEAD requests, ranges, and
+// conditional requests are supported.  The Content-Type, Content-Length,
+// Last-Modified, and ETag headers come from the object's attributes, as do
+// the headers that B2 serves for it, such as Content-Disposition.  Requests
+// for objects that don't exist are answered with 404 Not Found, and paths
+// ending in "/" are too, unless HandlerIndex is given.
+func HTTPHandler(bucket *Bucket, prefix string, opts ...HandlerOption) http.Handler {
+	h := &bucketHandler{
+		bucket: bucket,
+		prefix: prefix,
+	}
+	for _, o := range opts {
+		o(&h.opts)
+	}
+	return h
+}
+
+type bucketHandler struct {
+	bucket *Bucket
+	prefix string
+	opts   handlerOptions
+}
+
+func (h *bucketHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	p := strings.TrimPrefix(r.URL.Path, "/")
+	if p == "" || strings.HasSuffix(p, "/") {
+		if !h.listable() {
+			http.NotFound(w, r)
+			return
+		}
+		h.serveIndex(w, r, p)
+		return
+	}
+	h.serveObject(w, r, p)
+}
+
+// listable reports whether index pages are served from the bucket.
+func (h *bucketHandler) listable() bool {
+	if !h.opts.index {
+		return false
+	}
+	if h.opts.listPrivate {
+		return true
+	}
+	attrs := h.bucket.b.attrs()
+	return attrs != nil && attrs.Type == Public
+}
+
+func (h *bucketHandler) serveObject(w http.ResponseWriter, r *http.Request, p string) {
+	ctx := r.Context()
+	obj := h.bucket.Object(h.prefix + p)
+	attrs, err := obj.Attrs(ctx)
+	if IsNotExist(err) && h.listable() && h.hasObjectsUnder(ctx, h.prefix+p+"/") {
+		// The target is relative to the request, whose path the handler
+		// may not see all of.
+		target := url.PathEscape(p[strings.LastIndex(p, "/")+1:]) + "/"
+		if r.URL.RawQuery != "" {
+			target += "?" + r.URL.RawQuery
+		}
+		w.Header().Set("Location", target)
+		w.WriteHeader(http.StatusMovedPermanently)
+		return
+	}
+	if err != nil {
+		h.fail(w, r, err)
+		return
+	}
+	hdr := w.Header()
+	if attrs.ContentType != "" {
+		hdr.Set("Content-Type", attrs.ContentType)
+	}
+	if attrs.SHA1 != "" && attrs.SHA1 != "none" {
+		hdr.Set("ETag", `"`+attrs.SHA1+`"`)
+	}
+	cacheControl := attrs.CacheControl
+	if cacheControl == "" {
+		cacheControl = h.opts.cacheControl
+	}
+	for _, e := range []struct{ name, value string }{
+		{"Cache-Control", cacheControl},
+		{"Content-Disposition", attrs.ContentDisposition},
+		{"Content-Encoding", attrs.ContentEncoding},
+		{"Content-Language", attrs.ContentLanguage},
+		{"Expires", attrs.Expires},
+	} {
+		if e.value != "" {
+			hdr.Set(e.name, e.value)
+		}
+	}
+	modified := attrs.LastModified
+	if modified.IsZero() {
+		modified = attrs.UploadTimestamp
+	}
+	rdr := obj.NewReader(ctx)
+	defer rdr.Close()
+	http.ServeContent(w, r, p, modified, &content{r: rdr, size: attrs.Size})
+}
+
+// hasObjectsUnder reports whether any object's name begins with pfx.
+func (h *bucketHandler) hasObjectsUnder(ctx context.Context, pfx string) bool {
+	iter := h.bucket.List(ctx, ListPrefix(pfx), ListDelimiter("/"), ListPageSize(1))
+	return iter.Next()
+}
+
+var indexPage = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Index of /{{.Path}}</title></head>
+<body>
+<h1>Index of /{{.Path}}</h1>
+<ul>
+{{- if .Path}}
+<li><a href="../">../</a></li>
+{{- end}}
+{{- range .Entries}}
+<li><a href="{{.Href}}">{{.Name}}</a>{{if not .Dir}} ({{.Size}} bytes){{end}}</li>
+{{- end}}
+</ul>
+{{- if .More}}
+<p>Only the first {{len .Entries}} entries are shown.</p>
+{{- end}}
+</body>
+</html>
+`))
+
+type indexEntry struct {
+	Name string
+	Href string
+	Dir  bool
+	Size int64
+}
+
+func (h *bucketHandler) serveIndex(w http.ResponseWriter, r *http.Request, p string) {
+	ctx := r.Context()
+	pfx := h.prefix + p
+	page := struct {
+		Path    string
+		Entries []indexEntry
+		More    bool
+	}{Path: p}
+	iter := h.bucket.List(ctx, ListPrefix(pfx), ListDelimiter("/"))
+	for iter.Next() {
+		if len(page.Entries) == maxIndexEntries {
+			page.More = true
+			break
+		}
+		obj := iter.Object()
+		name := strings.TrimPrefix(obj.Name(), pfx)
+		e := indexEntry{Name: name, Dir: obj.IsDir()}
+		if e.Dir {
+			e.Href = url.PathEscape(strings.TrimSuffix(name, "/")) + "/"
+		} else {
+			e.Href = url.PathEscape(name)
+			if attrs, err := obj.Attrs(ctx); err == nil {
+				e.Size = attrs.Size
+			}
+		}
+		page.Entries = append(page.Entries, e)
+	}
+	if err := iter.Err(); err != nil {
+		h.fail(w, r, err)
+		return
+	}
+	if len(page.Entries) == 0 && p != "" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if r.Method == http.MethodHead {
+		return
+	}
+	indexPage.Execute(w, page)
+}
+
+// fail answers a request that failed with err, without revealing err.
+func (h *bucketHandler) fail(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case IsNotExist(err):
+		http.NotFound(w, r)
+	case r.Context().Err() != nil:
+		// The client has gone away.
+	default:
+		h.bucket.c.v(1).Infof("b2: serving %s: %v", r.URL.Path, err)
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+	}
+}
+
+// content is an object's Reader, for http.ServeContent, that knows the
+// object's size without asking B2 for it again.
+type content struct {
+	r    *Reader
+	size int64
+}
+
+func (c *content) Read(p []byte) (int, error) { return c.r.Read(p) }
+
+func (c *content) Seek(offset int64, whence int) (int64, error) {
+	if whence == io.SeekEnd {
+		offset, whence = c.size+offset, io.SeekStart
+	}
+	return c.r.Seek(offset, whence)
+}
@@ -0,0 +1,157 @@
+// Copyright 2024, the Blazer authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package b2
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// RequestInfo describes an HTTP request that a client is about to make, for
+// OnRequest.
+type RequestInfo struct {
+	// Method is the API call, such as "b2_list_file_names", "b2_upload_part",
+	// or "b2_download_file_by_name".
+	Method string
+
+	// Attempt counts the requests made for one call, including retries,
+	// from one.
+	Attempt int
+
+	Host  string
+	Bytes int64 // the size of the request body, or -1 if it isn't known
+
+	// Header holds the request's headers, other than Authorization.  Headers
+	// set or changed in it by an OnRequest hook are sent with the request.
+	Header http.Header
+}
+
+// ResponseInfo describes the outcome of an HTTP request that a client made,
+// for OnResponse.
+type ResponseInfo struct {
+	Method  string
+	Attempt int
+	Host    string
+
+	// Status is the HTTP status of the response, or zero if there was none,
+	// in which case Err says why.
+	Status int
+	Err    error
+
+	// Duration is the time from when the request was sent until the
+	// response's headers arrived; the body may take longer.
+	Duration time.Duration
+
+	BytesSent     int64 // the size of the request body, or -1 if it isn't known
+	BytesReceived int64 // the size of the response body, or -1 if it isn't known
+}
+
+// OnRequest calls f before each HTTP request the client makes: each API call,
+// upload, and download, and each attempt at one that is retried.  It can be
+// set multiple times; the functions are called in order.  They must be safe
+// for concurrent use.
+func OnRequest(f func(info RequestInfo)) ClientOption {
+	return func(c *clientOptions) {
+		c.onRequest = append(c.onRequest, f)
+	}
+}
+
+// OnResponse calls f after each HTTP request the client makes, whether or not
+// it succeeded.  It can be set multiple times; the functions are called in
+// order.  They must be safe for concurrent use.
+func OnResponse(f func(info ResponseInfo)) ClientOption {
+	return func(c *clientOptions) {
+		c.onResponse = append(c.onResponse, f)
+	}
+}
+
+type attemptsKey struct{}
+
+// countAttempts returns a context in which the requests for one call are
+// counted, unless they are counted in ctx already.
+func countAttempts(ctx context.Context) context.Context {
+	if _, ok := ctx.Value(attemptsKey{}).(*int32); ok {
+		return ctx
+	}
+	return context.WithValue(ctx, attemptsKey{}, new(int32))
+}
+
+// nextAttempt counts a request made with ctx, and returns its number.
+func nextAttempt(ctx context.Context) int {
+	n, ok := ctx.Value(attemptsKey{}).(*int32)
+	if !ok {
+		return 1
+	}
+	return int(atomic.AddInt32(n, 1))
+}
+
+// hook calls the client's OnRequest functions for r, and returns the request
+// to make, with any headers they set.
+func (ct *clientTransport) hook(r *http.Request, attempt int) *http.Request {
+	fs := ct.client.opts.onRequest
+	if len(fs) == 0 {
+		return r
+	}
+	r = r.Clone(r.Context())
+	auth, hasAuth := r.Header["Authorization"]
+	r.Header.Del("Authorization")
+	info := RequestInfo{
+		Method:  r.Header.Get("X-Blazer-Method"),
+		Attempt: attempt,
+		Host:    r.URL.Host,
+		Bytes:   r.ContentLength,
+		Header:  r.Header,
+	}
+	if r.Body == nil || r.Body == http.NoBody {
+		info.Bytes = 0
+	}
+	for _, f := range fs {
+		f(info)
+	}
+	r.Header = info.Header
+	if hasAuth {
+		r.Header["Authorization"] = auth
+	}
+	return r
+}
+
+// hookResponse calls the client's OnResponse functions.
+func (ct *clientTransport) hookResponse(r *http.Request, attempt int, resp *http.Response, err error, d time.Duration) {
+	fs := ct.client.opts.onResponse
+	if len(fs) == 0 {
+		return
+	}
+	info := ResponseInfo{
+		Method:        r.Header.Get("X-Blazer-Method"),
+		Attempt:       attempt,
+		Host:          r.URL.Host,
+		Err:           err,
+		Duration:      d,
+		BytesSent:     r.ContentLength,
+		BytesReceived: -1,
+	}
+	if r.Body == nil || r.Body == http.NoBody {
+		info.BytesSent = 0
+	}
+	if resp != nil {
+		info.Status = resp.StatusCode
+		info.BytesReceived = resp.ContentLength
+	}
+	for _, f := range fs {
+		f(info)
+	}
+}
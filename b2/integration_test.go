@@ -235,7 +235,7 @@ func TestResumeWriter(t *testing.T) {
 	ctx, cancel := context.WithTimeout(ctx, 10*time.Minute)
 	bucket, _ := startLiveTest(ctx, t)
 
-	w := bucket.Object("foo").NewWriter(ctx)
+	w := bucket.Object("foo").NewWriter(ctx, KeepUnfinished())
 	w.ChunkSize = 5e6
 	r := &cancelReader{
 		r: io.LimitReader(zReader{}, 15e6),
@@ -373,6 +373,65 @@ func TestAttrs(t *testing.T) {
 	}
 }
 
+func TestInfoKeyCaseLive(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Minute)
+	defer cancel()
+	bucket, done := startLiveTest(ctx, t)
+	defer done()
+
+	attrs := &Attrs{
+		Info: map[string]string{
+			"SrcHash":  "ABC",
+			"src_Mode": "0644",
+			"src-mode": "a b+c%20d",
+			"path":     "ünï/çødé?#&=",
+		},
+	}
+	want := map[string]string{
+		"srchash":  "ABC",
+		"src_mode": "0644",
+		"src-mode": "a b+c%20d",
+		"path":     "ünï/çødé?#&=",
+	}
+	for _, e := range []struct {
+		name string
+		size int64
+	}{
+		{name: "small", size: 1e3},
+		{name: "large", size: 5e6 + 4},
+	} {
+		w := bucket.Object(e.name).NewWriter(ctx, WithAttrsOption(attrs))
+		w.ChunkSize = 5e6
+		if _, err := io.Copy(w, io.LimitReader(zReader{}, e.size)); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		got, err := bucket.Object(e.name).Attrs(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got.Info, want) {
+			t.Errorf("%s: Attrs: got info %#v, want %#v", e.name, got.Info, want)
+		}
+	}
+	iter := bucket.List(ctx)
+	for iter.Next() {
+		got, err := iter.Object().Attrs(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got.Info, want) {
+			t.Errorf("%s: List: got info %#v, want %#v", got.Name, got.Info, want)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func TestFileBufferLive(t *testing.T) {
 	ctx := context.Background()
 	ctx, cancel := context.WithTimeout(ctx, time.Minute)
@@ -703,6 +762,10 @@ func TestNewBucket(t *testing.T) {
 						Prefix:             "whoa/",
 						DaysNewUntilHidden: 1,
 					},
+					{
+						Prefix:                   "partial/",
+						DaysStartedUntilCanceled: 7,
+					},
 				},
 			},
 		},
@@ -1346,3 +1409,31 @@ func startLiveTest(ctx context.Context, t *testing.T) (*Bucket, func()) {
 	}
 	return bucket, f
 }
+
+func TestStorageCapExceeded(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Minute)
+	defer cancel()
+	bucket, done := startLiveTest(ctx, t)
+	defer done()
+
+	client, err := NewClient(ctx, os.Getenv(apiID), os.Getenv(apiKey), ForceCapExceeded(), UserAgent("b2-test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	capped, err := client.Bucket(ctx, bucket.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, size := range []int64{1e3, 2e7} {
+		w := capped.Object(fmt.Sprintf("capped-%d", size)).NewWriter(ctx)
+		w.ChunkSize = 5e6
+		_, err := io.Copy(w, io.LimitReader(zReader{}, size))
+		if cerr := w.Close(); err == nil {
+			err = cerr
+		}
+		if !IsStorageCapExceeded(err) {
+			t.Errorf("%d bytes: got %v, want a storage cap error", size, err)
+		}
+	}
+}
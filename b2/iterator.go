@@ -16,12 +16,18 @@ package b2
 
 import (
 	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
 	"io"
 	"sync"
 )
 
 // List returns an iterator for selecting objects in a bucket.  The default
-// behavior, with no options, is to list all currently un-hidden objects.
+// behavior, with no options, is to list all currently un-hidden objects.  If
+// the client's application key is restricted to a prefix, the listing is
+// restricted to it as well, unless ListPrefix gives one within it; a prefix
+// outside it is a *RestrictionError.
 func (b *Bucket) List(ctx context.Context, opts ...ListOption) *ObjectIterator {
 	o := &ObjectIterator{
 		bucket: b,
@@ -56,30 +62,150 @@ type ObjectIterator struct {
 	init   sync.Once
 	l      lister
 	count  int
+	after  string  // the last name returned by the previous page
+	start  *cursor // the cursor that fetched the current page
+	skip   int     // objects to skip in the first page, when resuming
+	marker string  // the name to skip at the start of the listing
+
+	prefetched *pageStream // the next page, if it is being prefetched
+	streaming  *pageStream // the current page, while its objects arrive
 }
 
-type lister func(context.Context, int, *cursor) ([]*Object, *cursor, error)
+type lister func(context.Context, int, *cursor, func(*Object)) ([]*Object, *cursor, error)
 
-func (o *ObjectIterator) page(ctx context.Context) error {
+// A listed page, or the error from listing it.
+type listPage struct {
+	start *cursor
+	objs  []*Object
+	next  *cursor
+	err   error
+}
+
+// A pageStream is a page being listed in the background.  If the page is
+// streamed, its objects are sent on objs as they arrive, and objs is closed
+// before the whole page is sent on page.
+type pageStream struct {
+	start *cursor
+	objs  chan *Object
+	page  chan listPage
+}
+
+// fetch lists the page at c, passing each object to emit, if it is set, as it
+// arrives.  It touches no iterator state, so that it can run in the
+// background.
+func (o *ObjectIterator) fetch(ctx context.Context, c *cursor, emit func(*Object)) listPage {
 	if o.opts.locker != nil {
 		o.opts.locker.Lock()
 		defer o.opts.locker.Unlock()
 	}
-	objs, c, err := o.l(ctx, o.count, o.c)
-	if err != nil && err != io.EOF {
-		if bNotExist.MatchString(err.Error()) {
-			return b2err{
-				err:         err,
-				notFoundErr: true,
+	ctx, span := o.bucket.c.startSpan(ctx, "b2.ListPage", "bucket", o.bucket.Name())
+	objs, next, err := o.l(ctx, o.count, c, emit)
+	span.SetAttribute("objects", len(objs))
+	if err == io.EOF {
+		span.End(nil)
+	} else {
+		span.End(err)
+	}
+	return listPage{start: c, objs: objs, next: next, err: err}
+}
+
+// list starts listing the page at c in the background, streaming it if the
+// iterator can.
+func (o *ObjectIterator) list(ctx context.Context, c *cursor) *pageStream {
+	// The channels are buffered so that the fetch always completes, even if
+	// the caller abandons the iterator; it ends with ctx in any case.
+	s := &pageStream{start: c, page: make(chan listPage, 1)}
+	var emit func(*Object)
+	if o.streams() {
+		s.objs = make(chan *Object, o.count)
+		var full bool
+		emit = func(obj *Object) {
+			if full {
+				return
+			}
+			select {
+			case s.objs <- obj:
+			default:
+				// B2 sent more than was asked for; the rest arrives
+				// with the whole page.
+				full = true
 			}
 		}
-		return err
 	}
-	o.c = c
-	o.objs = objs
+	go func() {
+		p := o.fetch(ctx, c, emit)
+		if s.objs != nil {
+			close(s.objs)
+		}
+		s.page <- p
+	}()
+	return s
+}
+
+// streams reports whether the objects of the next page can be returned as
+// they arrive.  They can't when the page must be seen whole: to merge in the
+// writes that LocalConsistency remembers, or to skip objects at its start.
+func (o *ObjectIterator) streams() bool {
+	return o.opts.stream && !o.opts.unfinished && o.skip == 0 && o.marker == "" && o.bucket.c.consistency() == nil
+}
+
+func (o *ObjectIterator) page(ctx context.Context) error {
+	s := o.prefetched
+	o.prefetched = nil
+	if s == nil {
+		if !o.streams() {
+			return o.finish(ctx, o.fetch(ctx, o.c, nil), 0)
+		}
+		s = o.list(ctx, o.c)
+	}
+	if s.objs == nil {
+		return o.finish(ctx, <-s.page, 0)
+	}
+	o.streaming = s
+	o.start = s.start
+	o.objs = nil
 	o.idx = 0
-	if err == io.EOF {
-		o.final = true
+	return nil
+}
+
+// finish takes up the listed page p, of which the first yielded objects have
+// already been returned as they arrived.
+func (o *ObjectIterator) finish(ctx context.Context, p listPage, yielded int) error {
+	start, objs, c, err := p.start, p.objs, p.next, p.err
+	if err != nil && err != io.EOF {
+		return o.listError(err)
+	}
+	o.c = c
+	final := err == io.EOF
+	after := o.after
+	if len(objs) > 0 {
+		o.after = objs[len(objs)-1].name
+	}
+	o.objs = o.bucket.c.consistency().filter(o.bucket, objs, after, final, o.opts)
+	o.idx = yielded
+	if o.idx > len(o.objs) {
+		o.idx = len(o.objs)
+	}
+	if o.skip > 0 {
+		o.idx = o.skip
+		if o.idx > len(o.objs) {
+			o.idx = len(o.objs)
+		}
+		o.skip = 0
+	}
+	if o.marker != "" {
+		// B2 starts listings at, not after, the given name.
+		for o.idx < len(o.objs) && o.objs[o.idx].name == o.marker {
+			o.idx++
+		}
+		if o.idx < len(o.objs) || final {
+			o.marker = ""
+		}
+	}
+	o.start = start
+	o.final = final
+	if o.opts.prefetch && !final {
+		o.prefetched = o.list(ctx, c)
 	}
 	return nil
 }
@@ -91,7 +217,7 @@ func (o *ObjectIterator) page(ctx context.Context) error {
 func (o *ObjectIterator) Next() bool {
 	o.init.Do(func() {
 		o.count = o.opts.pageSize
-		if o.count < 0 || o.count > 1000 {
+		if o.count < 1 || o.count > 1000 {
 			o.count = 1000
 		}
 		switch {
@@ -105,10 +231,25 @@ func (o *ObjectIterator) Next() bool {
 		default:
 			o.l = o.bucket.listCurrentObjects
 		}
+		if o.opts.prefix == "" {
+			o.opts.prefix = o.bucket.c.backend.accountInfo().Prefix
+		}
+		if err := o.bucket.restricted(o.opts.prefix); err != nil {
+			o.err = err
+			return
+		}
 		o.c = &cursor{
 			prefix:    o.opts.prefix,
 			delimiter: o.opts.delimiter,
 		}
+		switch {
+		case o.opts.cursor != "":
+			o.err = o.resume(o.opts.cursor)
+		case o.opts.startAfter != "" && !o.opts.unfinished:
+			o.c.name = o.opts.startAfter
+			o.after = o.opts.startAfter
+			o.marker = o.opts.startAfter
+		}
 	})
 	if o.err != nil {
 		return false
@@ -118,6 +259,19 @@ func (o *ObjectIterator) Next() bool {
 		return false
 	}
 	if o.idx >= len(o.objs) {
+		if s := o.streaming; s != nil {
+			if obj, ok := <-s.objs; ok {
+				o.objs = append(o.objs, obj)
+				o.idx++
+				return true
+			}
+			o.streaming = nil
+			if err := o.finish(o.ctx, <-s.page, o.idx); err != nil {
+				o.err = err
+				return false
+			}
+			return o.Next()
+		}
 		if o.final {
 			o.err = io.EOF
 			return false
@@ -128,17 +282,72 @@ func (o *ObjectIterator) Next() bool {
 		}
 		return o.Next()
 	}
+	if err := o.failed(); err != nil {
+		o.err = err
+		return false
+	}
 	o.idx++
 	return true
 }
 
+// failed returns the error of the page being prefetched, if it has failed, so
+// that the failure is reported at once rather than after the objects before
+// it.
+func (o *ObjectIterator) failed() error {
+	if o.prefetched == nil {
+		return nil
+	}
+	select {
+	case p := <-o.prefetched.page:
+		o.prefetched.page <- p
+		if p.err != nil && p.err != io.EOF {
+			return o.listError(p.err)
+		}
+	default:
+	}
+	return nil
+}
+
+// A ListError is returned by ObjectIterator.Err when listing a page of
+// objects fails.  It wraps the error of the API call, which is an *Error if
+// B2 refused it.
+type ListError struct {
+	Bucket string
+	Cursor string // resumes the listing, with ListCursor, where it failed
+	Err    error
+}
+
+func (e *ListError) Error() string {
+	return fmt.Sprintf("b2: listing %s: %v", e.Bucket, e.Err)
+}
+
+func (e *ListError) Unwrap() error {
+	return e.Err
+}
+
+func (o *ObjectIterator) listError(err error) error {
+	if bNotExist.MatchString(err.Error()) {
+		err = b2err{
+			err:         err,
+			notFoundErr: true,
+		}
+	}
+	return &ListError{
+		Bucket: o.bucket.Name(),
+		Cursor: o.Cursor(),
+		Err:    err,
+	}
+}
+
 // Object returns the current object.
 func (o *ObjectIterator) Object() *Object {
 	return o.objs[o.idx-1]
 }
 
 // Err returns the current error or nil.  If Next() returns false and Err() is
-// nil, then all objects have been seen.
+// nil, then all objects have been seen.  If a page of objects could not be
+// listed, Err returns a *ListError, as soon as the page fails if it was
+// prefetched.  If the iterator's context is done, Err returns its error.
 func (o *ObjectIterator) Err() error {
 	if o.err == io.EOF {
 		return nil
@@ -153,18 +362,45 @@ type objectIteratorOptions struct {
 	delimiter  string
 	pageSize   int
 	locker     sync.Locker
+	cursor     string
+	prefetch   bool
+	stream     bool
+	startAfter string
+}
+
+func (o objectIteratorOptions) mode() string {
+	switch {
+	case o.unfinished:
+		return "unfinished"
+	case o.hidden:
+		return "versions"
+	}
+	return "names"
 }
 
 // A ListOption alters the default behavor of List.
 type ListOption func(*objectIteratorOptions)
 
-// ListHidden will include hidden objects in the output.
+// ListHidden will include hidden objects in the output.  This lists every
+// version of every object, exactly as ListVersions does.
 func ListHidden() ListOption {
 	return func(o *objectIteratorOptions) {
 		o.hidden = true
 	}
 }
 
+// ListVersions lists every version of every object rather than only the
+// current ones.  Versions of the same name are returned newest first, and
+// include the hide markers that B2 records when an object is hidden.  Each
+// Object refers to one specific version: Attrs reports its ID, Status, and
+// UploadTimestamp without a further request, and IsHideMarker reports whether
+// it is a hide marker rather than content.
+func ListVersions() ListOption {
+	return func(o *objectIteratorOptions) {
+		o.hidden = true
+	}
+}
+
 // ListUnfinished will list unfinished large file operations instead of
 // existing objects.
 func ListUnfinished() ListOption {
@@ -191,8 +427,9 @@ func ListPrefix(pfx string) ListOption {
 // Note that objects returned that end in the delimiter may not be actual
 // objects, e.g. you cannot read from (or write to, or delete) an object
 // "foo/", both because no actual object exists and because B2 disallows object
-// names that end with "/".  If you want to ensure that all objects returned
-// are actual objects, leave this unset.
+// names that end with "/".  Such folders can be told apart from objects with
+// Object.IsDir.  If you want to ensure that all objects returned are actual
+// objects, leave this unset.
 func ListDelimiter(delimiter string) ListOption {
 	return func(o *objectIteratorOptions) {
 		o.delimiter = delimiter
@@ -208,6 +445,33 @@ func ListPageSize(count int) ListOption {
 	}
 }
 
+// ListPrefetch causes the iterator to request each page in the background as
+// soon as the previous page arrives, so that scans of many objects do not
+// wait on B2 at every page boundary.  Because a page is requested before it
+// is needed, an iterator that is abandoned early may make one more request
+// (and incur one more transaction) than it otherwise would; the request ends
+// when the iterator's context is canceled.  If ListLocker is also given, the
+// lock is held during background requests too.
+func ListPrefetch() ListOption {
+	return func(o *objectIteratorOptions) {
+		o.prefetch = true
+	}
+}
+
+// ListStream causes the iterator to return each object as soon as it has been
+// decoded from B2's reply, rather than once the whole page has arrived, so
+// that the first objects of a large page are seen sooner, and a page that
+// ListPrefetch is fetching can be walked before it is complete.  If listing a
+// page fails partway, the objects before the failure will already have been
+// returned.  Pages are still seen whole with ListUnfinished or
+// LocalConsistency, and at the start of a listing given ListCursor or
+// ListStartAfter.
+func ListStream() ListOption {
+	return func(o *objectIteratorOptions) {
+		o.stream = true
+	}
+}
+
 // ListLocker passes the iterator a lock which will be held during network
 // round-trips.
 func ListLocker(l sync.Locker) ListOption {
@@ -216,6 +480,90 @@ func ListLocker(l sync.Locker) ListOption {
 	}
 }
 
+// ListStartAfter begins the listing with the first object whose name sorts
+// after name, skipping name itself (and, with ListVersions, all of its
+// versions).  It is ignored with ListUnfinished, and when resuming with
+// ListCursor.
+func ListStartAfter(name string) ListOption {
+	return func(o *objectIteratorOptions) {
+		o.startAfter = name
+	}
+}
+
+// ListCursor resumes a listing from a cursor returned by
+// ObjectIterator.Cursor.  The listing must be made with the same options as
+// the one that produced the cursor; if it is not (for example, if a cursor
+// from a ListVersions listing is given to a listing of current objects), the
+// iterator returns no objects and Err reports the mismatch.
+func ListCursor(cursor string) ListOption {
+	return func(o *objectIteratorOptions) {
+		o.cursor = cursor
+	}
+}
+
+// savedCursor is the serialized form of an iterator's position.
+type savedCursor struct {
+	Mode      string `json:"m"`
+	Prefix    string `json:"p,omitempty"`
+	Delimiter string `json:"d,omitempty"`
+	Name      string `json:"n,omitempty"`
+	ID        string `json:"i,omitempty"`
+	Skip      int    `json:"s,omitempty"`
+	Done      bool   `json:"x,omitempty"`
+}
+
+// Cursor returns an opaque string recording the iterator's position: a
+// listing created with ListCursor and the same options will continue with
+// the object after the one most recently returned by Object.  Cursors may be
+// saved and used by another process.  Objects written or deleted in the
+// meantime may cause a resumed listing to skip or repeat objects near the
+// cursor.
+func (o *ObjectIterator) Cursor() string {
+	sc := savedCursor{
+		Mode:      o.opts.mode(),
+		Prefix:    o.opts.prefix,
+		Delimiter: o.opts.delimiter,
+	}
+	switch {
+	case o.final && o.idx >= len(o.objs):
+		sc.Done = true
+	case o.start != nil:
+		sc.Name = o.start.name
+		sc.ID = o.start.id
+		sc.Skip = o.idx
+	}
+	b, err := json.Marshal(sc)
+	if err != nil {
+		panic(err) // can't happen
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func (o *ObjectIterator) resume(s string) error {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return fmt.Errorf("b2: invalid list cursor: %v", err)
+	}
+	var sc savedCursor
+	if err := json.Unmarshal(b, &sc); err != nil {
+		return fmt.Errorf("b2: invalid list cursor: %v", err)
+	}
+	if mode := o.opts.mode(); sc.Mode != mode {
+		return fmt.Errorf("b2: list cursor is for a %s listing, not %s", sc.Mode, mode)
+	}
+	if sc.Prefix != o.opts.prefix || sc.Delimiter != o.opts.delimiter {
+		return fmt.Errorf("b2: list cursor is for prefix %q and delimiter %q, not %q and %q", sc.Prefix, sc.Delimiter, o.opts.prefix, o.opts.delimiter)
+	}
+	if sc.Done {
+		o.final = true
+		return nil
+	}
+	o.c.name = sc.Name
+	o.c.id = sc.ID
+	o.skip = sc.Skip
+	return nil
+}
+
 type cursor struct {
 	// Prefix limits the listed objects to those that begin with this string.
 	prefix string
@@ -238,11 +586,11 @@ type cursor struct {
 	id   string
 }
 
-func (b *Bucket) listObjects(ctx context.Context, count int, c *cursor) ([]*Object, *cursor, error) {
+func (b *Bucket) listObjects(ctx context.Context, count int, c *cursor, emit func(*Object)) ([]*Object, *cursor, error) {
 	if c == nil {
 		c = &cursor{}
 	}
-	fs, name, id, err := b.b.listFileVersions(ctx, count, c.name, c.id, c.prefix, c.delimiter)
+	fs, name, id, err := b.b.listFileVersions(ctx, count, c.name, c.id, c.prefix, c.delimiter, b.emitter(emit))
 	if err != nil {
 		return nil, nil, err
 	}
@@ -264,17 +612,17 @@ func (b *Bucket) listObjects(ctx context.Context, count int, c *cursor) ([]*Obje
 		})
 	}
 	var rtnErr error
-	if len(objects) == 0 || next == nil {
+	if next == nil {
 		rtnErr = io.EOF
 	}
 	return objects, next, rtnErr
 }
 
-func (b *Bucket) listCurrentObjects(ctx context.Context, count int, c *cursor) ([]*Object, *cursor, error) {
+func (b *Bucket) listCurrentObjects(ctx context.Context, count int, c *cursor, emit func(*Object)) ([]*Object, *cursor, error) {
 	if c == nil {
 		c = &cursor{}
 	}
-	fs, name, err := b.b.listFileNames(ctx, count, c.name, c.prefix, c.delimiter)
+	fs, name, err := b.b.listFileNames(ctx, count, c.name, c.prefix, c.delimiter, b.emitter(emit))
 	if err != nil {
 		return nil, nil, err
 	}
@@ -295,13 +643,15 @@ func (b *Bucket) listCurrentObjects(ctx context.Context, count int, c *cursor) (
 		})
 	}
 	var rtnErr error
-	if len(objects) == 0 || next == nil {
+	if next == nil {
 		rtnErr = io.EOF
 	}
 	return objects, next, rtnErr
 }
 
-func (b *Bucket) listUnfinishedLargeFiles(ctx context.Context, count int, c *cursor) ([]*Object, *cursor, error) {
+// listUnfinishedLargeFiles lists a page of unfinished large files, which are
+// never streamed; emit is not called.
+func (b *Bucket) listUnfinishedLargeFiles(ctx context.Context, count int, c *cursor, emit func(*Object)) ([]*Object, *cursor, error) {
 	if c == nil {
 		c = &cursor{}
 	}
@@ -324,8 +674,23 @@ func (b *Bucket) listUnfinishedLargeFiles(ctx context.Context, count int, c *cur
 		})
 	}
 	var rtnErr error
-	if len(objects) == 0 || next == nil {
+	if next == nil {
 		rtnErr = io.EOF
 	}
 	return objects, next, rtnErr
 }
+
+// emitter returns the func that passes listed files on to emit as Objects, or
+// nil if emit is.
+func (b *Bucket) emitter(emit func(*Object)) func(beFileInterface) {
+	if emit == nil {
+		return nil
+	}
+	return func(f beFileInterface) {
+		emit(&Object{
+			name: f.name(),
+			f:    f,
+			b:    b,
+		})
+	}
+}
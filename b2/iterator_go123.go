@@ -0,0 +1,48 @@
+// Copyright 2024, the Blazer authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build go1.23
+
+package b2
+
+import (
+	"context"
+	"iter"
+)
+
+// Objects returns the objects selected by opts, as List does, for use with a
+// range loop:
+//
+//	for obj, err := range bucket.Objects(ctx) {
+//	  if err != nil {
+//	    // handle err
+//	  }
+//	  // act on obj
+//	}
+//
+// If listing fails, the final iteration yields a nil Object and the error,
+// and no objects follow it.
+func (b *Bucket) Objects(ctx context.Context, opts ...ListOption) iter.Seq2[*Object, error] {
+	return func(yield func(*Object, error) bool) {
+		it := b.List(ctx, opts...)
+		for it.Next() {
+			if !yield(it.Object(), nil) {
+				return
+			}
+		}
+		if err := it.Err(); err != nil {
+			yield(nil, err)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright 2024, the Blazer authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build go1.23
+
+package b2
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestObjectsSeq(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	client := &Client{
+		backend: &beRoot{
+			b2i: &testRoot{
+				bucketMap: make(map[string]map[string]string),
+				errs:      &errCont{},
+			},
+		},
+	}
+	bucket, err := client.NewBucket(ctx, bucketName, &BucketAttrs{Type: Private})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var all []string
+	for i := 0; i < 15; i++ {
+		name := fmt.Sprintf("%02d", i)
+		all = append(all, name)
+		if _, _, err := writeFile(ctx, bucket, name, 10, 1e8); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var got []string
+	for obj, err := range bucket.Objects(ctx, ListPageSize(4)) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, obj.Name())
+	}
+	if !reflect.DeepEqual(got, all) {
+		t.Errorf("Objects: got %v, want %v", got, all)
+	}
+
+	got = nil
+	for obj, err := range bucket.Objects(ctx) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) == 3 {
+			break
+		}
+		got = append(got, obj.Name())
+	}
+	if !reflect.DeepEqual(got, all[:3]) {
+		t.Errorf("Objects with break: got %v, want %v", got, all[:3])
+	}
+
+	var errs int
+	for obj, err := range bucket.Objects(ctx, ListCursor("garbage")) {
+		if err == nil || obj != nil {
+			t.Errorf("Objects with a bad cursor: got (%v, %v), want an error", obj, err)
+		}
+		errs++
+	}
+	if errs != 1 {
+		t.Errorf("Objects with a bad cursor: got %d errors, want 1", errs)
+	}
+}
@@ -17,10 +17,107 @@ package b2
 import (
 	"context"
 	"errors"
+	"fmt"
 	"io"
+	"strings"
 	"time"
 )
 
+// The capabilities that an application key may be granted.
+const (
+	CapListKeys                 = "listKeys"
+	CapWriteKeys                = "writeKeys"
+	CapDeleteKeys               = "deleteKeys"
+	CapListAllBucketNames       = "listAllBucketNames"
+	CapListBuckets              = "listBuckets"
+	CapReadBuckets              = "readBuckets"
+	CapWriteBuckets             = "writeBuckets"
+	CapDeleteBuckets            = "deleteBuckets"
+	CapReadBucketRetentions     = "readBucketRetentions"
+	CapWriteBucketRetentions    = "writeBucketRetentions"
+	CapReadBucketEncryption     = "readBucketEncryption"
+	CapWriteBucketEncryption    = "writeBucketEncryption"
+	CapReadBucketReplications   = "readBucketReplications"
+	CapWriteBucketReplications  = "writeBucketReplications"
+	CapReadBucketNotifications  = "readBucketNotifications"
+	CapWriteBucketNotifications = "writeBucketNotifications"
+	CapListFiles                = "listFiles"
+	CapReadFiles                = "readFiles"
+	CapShareFiles               = "shareFiles"
+	CapWriteFiles               = "writeFiles"
+	CapDeleteFiles              = "deleteFiles"
+	CapReadFileRetentions       = "readFileRetentions"
+	CapWriteFileRetentions      = "writeFileRetentions"
+	CapReadFileLegalHolds       = "readFileLegalHolds"
+	CapWriteFileLegalHolds      = "writeFileLegalHolds"
+	CapBypassGovernance         = "bypassGovernance"
+)
+
+var allCapabilities = []string{
+	CapListKeys,
+	CapWriteKeys,
+	CapDeleteKeys,
+	CapListAllBucketNames,
+	CapListBuckets,
+	CapReadBuckets,
+	CapWriteBuckets,
+	CapDeleteBuckets,
+	CapReadBucketRetentions,
+	CapWriteBucketRetentions,
+	CapReadBucketEncryption,
+	CapWriteBucketEncryption,
+	CapReadBucketReplications,
+	CapWriteBucketReplications,
+	CapReadBucketNotifications,
+	CapWriteBucketNotifications,
+	CapListFiles,
+	CapReadFiles,
+	CapShareFiles,
+	CapWriteFiles,
+	CapDeleteFiles,
+	CapReadFileRetentions,
+	CapWriteFileRetentions,
+	CapReadFileLegalHolds,
+	CapWriteFileLegalHolds,
+	CapBypassGovernance,
+}
+
+// AllCapabilities returns every capability that this package knows of, which
+// together are those of an account's master key.
+func AllCapabilities() []string {
+	return append([]string(nil), allCapabilities...)
+}
+
+// ReadOnlyCapabilities returns the capabilities of a key that can find, read,
+// and share objects, and read their buckets' settings, but change nothing.
+func ReadOnlyCapabilities() []string {
+	return []string{
+		CapListAllBucketNames,
+		CapListBuckets,
+		CapReadBuckets,
+		CapReadBucketRetentions,
+		CapReadBucketEncryption,
+		CapReadBucketReplications,
+		CapReadBucketNotifications,
+		CapListFiles,
+		CapReadFiles,
+		CapShareFiles,
+		CapReadFileRetentions,
+		CapReadFileLegalHolds,
+	}
+}
+
+// WriteOnlyCapabilities returns the capabilities of a key that can find
+// buckets and upload objects to them, but can neither list nor read what they
+// hold.
+func WriteOnlyCapabilities() []string {
+	return []string{
+		CapListAllBucketNames,
+		CapListBuckets,
+		CapWriteFiles,
+	}
+}
+
 // Key is a B2 application key.  A Key grants limited access on a global or
 // per-bucket basis.
 type Key struct {
@@ -36,7 +133,8 @@ func (k *Key) Capabilities() []string { return k.k.caps() }
 // useless.
 func (k *Key) Name() string { return k.k.name() }
 
-// Expires returns the expiration date of this application key.
+// Expires returns the expiration date of this application key, or the zero
+// time if it does not expire.
 func (k *Key) Expires() time.Time { return k.k.expires() }
 
 // Delete removes the key from B2.
@@ -51,10 +149,42 @@ func (k *Key) Secret() string { return k.k.secret() }
 // authenticate to B2.
 func (k *Key) ID() string { return k.k.id() }
 
+// BucketID returns the ID of the bucket to which this key is restricted, or
+// the empty string if the key is valid for all buckets.
+func (k *Key) BucketID() string { return k.k.bucketID() }
+
+// Prefix returns the object name prefix to which this key is restricted, or
+// the empty string if it is not restricted.
+func (k *Key) Prefix() string { return k.k.prefix() }
+
 type keyOptions struct {
 	caps     []string
 	prefix   string
 	lifetime time.Duration
+	unknown  bool // allow capabilities not in allCapabilities
+}
+
+// check returns an error if any of the capabilities requested is not one that
+// this package knows of, unless UnknownCapabilities was given.
+func (ko *keyOptions) check() error {
+	if ko.unknown {
+		return nil
+	}
+	for _, c := range ko.caps {
+		if !knownCapability(c) {
+			return fmt.Errorf("b2: unknown capability %q; the capabilities are %s", c, strings.Join(allCapabilities, ", "))
+		}
+	}
+	return nil
+}
+
+func knownCapability(c string) bool {
+	for _, k := range allCapabilities {
+		if c == k {
+			return true
+		}
+	}
+	return false
 }
 
 // KeyOption specifies desired properties for application keys.
@@ -73,13 +203,24 @@ func Deadline(t time.Time) KeyOption {
 	return Lifetime(d)
 }
 
-// Capabilities requests a key with the given capability.
+// Capabilities requests a key with the given capability.  Capabilities are
+// checked before the key is requested, and one that isn't among
+// AllCapabilities is refused; see UnknownCapabilities.
 func Capabilities(caps ...string) KeyOption {
 	return func(k *keyOptions) {
 		k.caps = append(k.caps, caps...)
 	}
 }
 
+// UnknownCapabilities allows the key to be requested with capabilities that
+// this package doesn't know of, such as those B2 adds after it was written.
+// B2 still refuses any that it doesn't know either.
+func UnknownCapabilities() KeyOption {
+	return func(k *keyOptions) {
+		k.unknown = true
+	}
+}
+
 // Prefix limits the requested application key to be valid only for objects
 // that begin with prefix.  This can only be used when requesting an
 // application key within a specific bucket.
@@ -100,6 +241,9 @@ func (c *Client) CreateKey(ctx context.Context, name string, opts ...KeyOption)
 	if ko.prefix != "" {
 		return nil, errors.New("Prefix is not a valid option for global application keys")
 	}
+	if err := ko.check(); err != nil {
+		return nil, err
+	}
 	ki, err := c.backend.createKey(ctx, name, ko.caps, ko.lifetime, "", "")
 	if err != nil {
 		return nil, err
@@ -139,12 +283,107 @@ func (c *Client) ListKeys(ctx context.Context, count int, cursor string) ([]*Key
 	return keys, next, rerr
 }
 
+// KeyIterator iterates over all the keys associated with this project,
+// fetching them from B2 a page at a time.
+//
+// It is intended to be called in a loop:
+//
+//	iter := client.Keys(ctx)
+//	for iter.Next() {
+//	  key := iter.Key()
+//	  // act on key
+//	}
+//	if err := iter.Err(); err != nil {
+//	  // handle err
+//	}
+type KeyIterator struct {
+	c      *Client
+	ctx    context.Context
+	cursor string
+	keys   []*Key
+	idx    int
+	final  bool
+	err    error
+}
+
+// Keys returns an iterator over all the keys associated with this project.
+func (c *Client) Keys(ctx context.Context) *KeyIterator {
+	return &KeyIterator{
+		c:   c,
+		ctx: ctx,
+	}
+}
+
+// Next advances the iterator to the next key.  It should be called before
+// any calls to Key().  Once Next returns false, it is important to check the
+// return value of Err().
+func (k *KeyIterator) Next() bool {
+	if k.err != nil {
+		return false
+	}
+	for k.idx >= len(k.keys) {
+		if k.final {
+			k.err = io.EOF
+			return false
+		}
+		keys, next, err := k.c.ListKeys(k.ctx, 1000, k.cursor)
+		if err == io.EOF {
+			k.final = true
+			err = nil
+		}
+		if err != nil {
+			k.err = err
+			return false
+		}
+		k.keys, k.cursor, k.idx = keys, next, 0
+	}
+	k.idx++
+	return true
+}
+
+// Key returns the current key.
+func (k *KeyIterator) Key() *Key {
+	return k.keys[k.idx-1]
+}
+
+// Err returns the current error or nil.  If Next() returns false and Err() is
+// nil, then all keys have been seen.
+func (k *KeyIterator) Err() error {
+	if k.err == io.EOF {
+		return nil
+	}
+	return k.err
+}
+
+// KeyByName returns the first key with the given name, listing the keys
+// associated with this project until it is found.  Key names need not be
+// unique; if none has this name, the error is one for which IsNotExist
+// reports true.
+func (c *Client) KeyByName(ctx context.Context, name string) (*Key, error) {
+	iter := c.Keys(ctx)
+	for iter.Next() {
+		if k := iter.Key(); k.Name() == name {
+			return k, nil
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+	return nil, b2err{
+		err:         fmt.Errorf("%s: key not found", name),
+		notFoundErr: true,
+	}
+}
+
 // CreateKey creates a scoped application key that is valid only for this bucket.
 func (b *Bucket) CreateKey(ctx context.Context, name string, opts ...KeyOption) (*Key, error) {
 	var ko keyOptions
 	for _, o := range opts {
 		o(&ko)
 	}
+	if err := ko.check(); err != nil {
+		return nil, err
+	}
 	ki, err := b.r.createKey(ctx, name, ko.caps, ko.lifetime, b.b.id(), ko.prefix)
 	if err != nil {
 		return nil, err
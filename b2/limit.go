@@ -0,0 +1,321 @@
+// Copyright 2024, the Blazer authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package b2
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
+
+// MaxTransferConcurrency limits the number of parts and chunks that all of
+// the client's Writers and Readers send or receive at once to n, however
+// many ConcurrentUploads and ConcurrentDownloads each of them has.  Parts
+// wait their turn in the order they became ready.  Without it, or if n is
+// less than one, there is no limit.
+func MaxTransferConcurrency(n int) ClientOption {
+	return func(c *clientOptions) {
+		c.maxTransfers = n
+	}
+}
+
+// MaxBufferedBytes limits the memory that all of the client's Writers use to
+// buffer chunks to about n bytes.  A writer takes room for a whole chunk once
+// it has buffered more than 1MB of it, and returns it when the chunk has been
+// sent; Write blocks until room is available, or its context is done.  A
+// chunk larger than n may still be buffered, alone.  Writers whose chunks
+// come from ReadFrom with an io.Seeker, from WriteFrom, or from scratch files
+// are not limited.  Without it, or if n is less than one, there is no limit.
+func MaxBufferedBytes(n int64) ClientOption {
+	return func(c *clientOptions) {
+		c.maxBuffered = n
+	}
+}
+
+// UploadRateLimit limits the rate at which all of the client's Writers
+// together send object data to about bytesPerSec.  Parts that are retried
+// count against the limit again.  Without it, or if bytesPerSec is less than
+// one, there is no limit.
+func UploadRateLimit(bytesPerSec int64) ClientOption {
+	return func(c *clientOptions) {
+		c.uploadRate = bytesPerSec
+	}
+}
+
+// DownloadRateLimit limits the rate at which all of the client's Readers, and
+// Object.DownloadTo, together receive object data to about bytesPerSec.
+// Without it, or if bytesPerSec is less than one, there is no limit.
+func DownloadRateLimit(bytesPerSec int64) ClientOption {
+	return func(c *clientOptions) {
+		c.downloadRate = bytesPerSec
+	}
+}
+
+// MaxRequestsPerSecond paces the client's API calls, such as listings, to rps
+// per second, allowing up to burst at once after a lull, so that B2 is not
+// asked to refuse them with 429 Too Many Requests.  An API call that is
+// refused all the same slows the client down for a while, rather than just
+// the call that was refused.  Uploads and downloads, which are limited by
+// bandwidth, are not paced; see UploadRateLimit and DownloadRateLimit.
+// Without it, or if rps is not positive, there is no limit.
+func MaxRequestsPerSecond(rps float64, burst int) ClientOption {
+	return func(c *clientOptions) {
+		c.maxRPS = rps
+		c.rpsBurst = burst
+	}
+}
+
+// limits returns the semaphores for MaxTransferConcurrency and
+// MaxBufferedBytes, either of which is nil if not set.
+func (c *Client) limits() (transfers, buffered *semaphore) {
+	c.initLimits()
+	return c.transfers, c.buffered
+}
+
+// throttles returns the token buckets for UploadRateLimit and
+// DownloadRateLimit, either of which is nil if not set.
+func (c *Client) throttles() (up, down *tokenBucket) {
+	c.initLimits()
+	return c.upload, c.download
+}
+
+func (c *Client) initLimits() {
+	c.limOnce.Do(func() {
+		if c.opts.maxTransfers > 0 {
+			c.transfers = newSemaphore(int64(c.opts.maxTransfers))
+		}
+		if c.opts.maxBuffered > 0 {
+			c.buffered = newSemaphore(c.opts.maxBuffered)
+		}
+		if c.opts.uploadRate > 0 {
+			c.upload = newTokenBucket(c.opts.uploadRate, c.opts.getClock())
+		}
+		if c.opts.downloadRate > 0 {
+			c.download = newTokenBucket(c.opts.downloadRate, c.opts.getClock())
+		}
+	})
+}
+
+// LimitStatus reports how the client's Writers and Readers stand against a
+// limit set with MaxTransferConcurrency or MaxBufferedBytes.
+type LimitStatus struct {
+	// Limit is the size of the limit: transfers, or bytes.
+	Limit int64
+
+	// InUse is how much of the limit is taken.
+	InUse int64
+
+	// Waiting is the number of parts and chunks waiting for some of it.
+	Waiting int
+}
+
+// semaphore is a weighted semaphore whose waiters are served in order.  A nil
+// semaphore never blocks.
+type semaphore struct {
+	mu      sync.Mutex
+	size    int64
+	cur     int64
+	waiters list.List // of *waiter
+}
+
+type waiter struct {
+	n     int64
+	ready chan struct{} // closed once the waiter holds n
+}
+
+func newSemaphore(size int64) *semaphore {
+	return &semaphore{size: size}
+}
+
+// acquire takes n from s, waiting until it is available or ctx is done.  n
+// must not exceed s's size.
+func (s *semaphore) acquire(ctx context.Context, n int64) error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	if s.size-s.cur >= n && s.waiters.Len() == 0 {
+		s.cur += n
+		s.mu.Unlock()
+		return nil
+	}
+	w := &waiter{n: n, ready: make(chan struct{})}
+	e := s.waiters.PushBack(w)
+	s.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		select {
+		case <-w.ready:
+			// Acquired just as ctx was done; give it back.
+			s.cur -= n
+			s.notify()
+		default:
+			front := s.waiters.Front() == e
+			s.waiters.Remove(e)
+			if front {
+				// Those behind may fit now.
+				s.notify()
+			}
+		}
+		s.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// release returns n to s.
+func (s *semaphore) release(n int64) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cur -= n
+	s.notify()
+}
+
+// notify hands s to as many waiters as now fit; it must be called with s.mu
+// held.
+func (s *semaphore) notify() {
+	for {
+		e := s.waiters.Front()
+		if e == nil {
+			return
+		}
+		w := e.Value.(*waiter)
+		if s.size-s.cur < w.n {
+			return
+		}
+		s.cur += w.n
+		s.waiters.Remove(e)
+		close(w.ready)
+	}
+}
+
+// clamp returns n, or s's size if that is smaller, so that a single request
+// larger than the limit can still proceed, alone.
+func (s *semaphore) clamp(n int64) int64 {
+	if s != nil && n > s.size {
+		return s.size
+	}
+	return n
+}
+
+func (s *semaphore) status() *LimitStatus {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return &LimitStatus{
+		Limit:   s.size,
+		InUse:   s.cur,
+		Waiting: s.waiters.Len(),
+	}
+}
+
+// A tokenBucket paces the bytes read through it to a rate.  Readers take
+// tokens for what they have read, going into debt if need be, and wait for the
+// debt to be repaid, so that readers sharing a bucket are together held to its
+// rate however many of them there are.  A nil tokenBucket never waits.
+type tokenBucket struct {
+	rate  float64 // tokens per second
+	burst float64 // the most tokens that accumulate while idle
+	max   int     // the most bytes to read at once
+	clock Clock
+
+	mu    sync.Mutex
+	avail float64 // negative when in debt
+	last  time.Time
+}
+
+func newTokenBucket(bytesPerSec int64, clock Clock) *tokenBucket {
+	// Read about a twentieth of a second's worth at a time, so that slow
+	// rates aren't met in long bursts and long pauses.
+	max := bytesPerSec / 20
+	if max < 512 {
+		max = 512
+	}
+	if max > 256<<10 {
+		max = 256 << 10
+	}
+	rate := float64(bytesPerSec)
+	return &tokenBucket{
+		rate:  rate,
+		burst: rate / 10,
+		max:   int(max),
+		avail: rate / 10,
+		clock: clock,
+		last:  clock.Now(),
+	}
+}
+
+// take removes n tokens from tb, and waits until tb is out of debt or ctx is
+// done.
+func (tb *tokenBucket) take(ctx context.Context, n int) error {
+	if tb == nil || n <= 0 {
+		return nil
+	}
+	tb.mu.Lock()
+	now := tb.clock.Now()
+	tb.avail += now.Sub(tb.last).Seconds() * tb.rate
+	if tb.avail > tb.burst {
+		tb.avail = tb.burst
+	}
+	tb.last = now
+	tb.avail -= float64(n)
+	debt := tb.avail
+	tb.mu.Unlock()
+	if debt >= 0 {
+		return nil
+	}
+	select {
+	case <-tb.clock.After(time.Duration(-debt / tb.rate * float64(time.Second))):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// throttle returns r, reading through tb, or r itself if tb is nil.
+func (tb *tokenBucket) throttle(ctx context.Context, r readResetter) readResetter {
+	if tb == nil {
+		return r
+	}
+	return &throttledReader{ctx: ctx, tb: tb, r: r}
+}
+
+type throttledReader struct {
+	ctx context.Context
+	tb  *tokenBucket
+	r   readResetter
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > t.tb.max {
+		p = p[:t.tb.max]
+	}
+	n, err := t.r.Read(p)
+	if werr := t.tb.take(t.ctx, n); werr != nil && err == nil {
+		err = werr
+	}
+	return n, err
+}
+
+func (t *throttledReader) Reset() error { return t.r.Reset() }
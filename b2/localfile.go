@@ -0,0 +1,375 @@
+// Copyright 2024, the Blazer authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package b2
+
+import (
+	"context"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// fileModeInfo is the file info key that holds a file's permission bits, in
+// octal, when FileMode is given.
+const fileModeInfo = "src_file_mode"
+
+type fileOptions struct {
+	mode      bool
+	unchanged bool
+	resume    bool
+	attrs     *Attrs
+}
+
+// A FileOption alters the behavior of Bucket.UploadFile and
+// Bucket.DownloadFile.
+type FileOption func(*fileOptions)
+
+// FileMode saves the local file's permission bits in the src_file_mode info
+// key on upload, and restores them on download.  Objects without the key are
+// downloaded with the default permissions.
+func FileMode() FileOption {
+	return func(f *fileOptions) {
+		f.mode = true
+	}
+}
+
+// FileSkipUnchanged skips the transfer if the destination already exists with
+// the same size and SHA1 hash as the source.  Objects whose hash B2 does not
+// know, such as large files uploaded without one, are always transferred.
+func FileSkipUnchanged() FileOption {
+	return func(f *fileOptions) {
+		f.unchanged = true
+	}
+}
+
+// FileResume makes DownloadFile keep what it has downloaded when it fails, in
+// a partial file beside localPath named for the object's version, and carry
+// on from the end of it the next time.  A partial file of any other version,
+// by ID, SHA1 hash, or upload time, is discarded, and if the object changes
+// while it is being downloaded, the download starts again.  The whole file is
+// checked against the object's SHA1 hash, or its size, before it replaces
+// localPath.
+func FileResume() FileOption {
+	return func(f *fileOptions) {
+		f.resume = true
+	}
+}
+
+// FileAttrs sets the content type and metadata of an uploaded file, as
+// WithAttrsOption does.  LastModified and SHA1 are always taken from the local
+// file.  It has no effect on downloads.
+func FileAttrs(attrs *Attrs) FileOption {
+	return func(f *fileOptions) {
+		f.attrs = attrs
+	}
+}
+
+// UploadFile uploads the file at localPath to objectName, recording its
+// modification time in LastModified and its SHA1 hash, which is calculated
+// before the upload begins, so that large files can later be compared with
+// FileSkipUnchanged.  The part size of large files is grown as necessary to
+// stay within B2's limit on parts, as with AutoPartSize.  It returns the
+// uploaded object.
+func (b *Bucket) UploadFile(ctx context.Context, localPath, objectName string, opts ...FileOption) (*Object, error) {
+	fopts := &fileOptions{}
+	for _, f := range opts {
+		f(fopts)
+	}
+	f, err := os.Open(localPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	sha, err := fileSHA1(f)
+	if err != nil {
+		return nil, err
+	}
+
+	obj := b.Object(objectName)
+	if fopts.unchanged {
+		attrs, err := obj.Attrs(ctx)
+		if err != nil && !IsNotExist(err) {
+			return nil, err
+		}
+		if err == nil && attrs.Size == fi.Size() && attrs.SHA1 == sha {
+			return obj, nil
+		}
+	}
+
+	attrs := &Attrs{}
+	if fopts.attrs != nil {
+		*attrs = *fopts.attrs
+	}
+	info := make(map[string]string, len(attrs.Info)+1)
+	for k, v := range attrs.Info {
+		info[k] = v
+	}
+	attrs.Info = info
+	if fopts.mode {
+		attrs.Info[fileModeInfo] = strconv.FormatUint(uint64(fi.Mode().Perm()), 8)
+	}
+	attrs.LastModified = fi.ModTime()
+	attrs.SHA1 = sha
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	w := obj.NewWriter(ctx, WithAttrsOption(attrs), AutoPartSize())
+	// Call ReadFrom directly: io.Copy would prefer os.File's WriteTo, which
+	// hides that f can seek, and so its size.
+	if _, err := w.ReadFrom(f); err != nil {
+		w.Close()
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
+
+// DownloadFile downloads objectName to localPath, and sets the file's
+// modification time to the object's LastModified, if it has one.  The content
+// is written to a temporary file in the same directory and verified against
+// the object's SHA1 hash before it replaces localPath, so an interrupted
+// download never leaves a partial file behind.  It returns the object's
+// attributes.
+func (b *Bucket) DownloadFile(ctx context.Context, objectName, localPath string, opts ...FileOption) (*Attrs, error) {
+	fopts := &fileOptions{}
+	for _, f := range opts {
+		f(fopts)
+	}
+	obj := b.Object(objectName)
+	attrs, err := obj.Attrs(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if fopts.unchanged && attrs.SHA1 != "" && attrs.SHA1 != "none" {
+		if same, err := localMatches(localPath, attrs); err != nil {
+			return nil, err
+		} else if same {
+			return attrs, nil
+		}
+	}
+
+	var tmp string
+	if fopts.resume {
+		tmp, attrs, err = resumeDownload(ctx, obj, attrs, localPath)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		tmp = fmt.Sprintf("%s.b2tmp%d", localPath, rand.Int63())
+		f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+		if err != nil {
+			return nil, err
+		}
+		defer os.Remove(tmp) // Fails harmlessly once tmp has been renamed.
+		if _, err := obj.DownloadTo(ctx, f, DownloadVerify()); err != nil {
+			f.Close()
+			return nil, err
+		}
+		if err := f.Close(); err != nil {
+			return nil, err
+		}
+	}
+	if v, ok := attrs.Info[fileModeInfo]; ok && fopts.mode {
+		if m, err := strconv.ParseUint(v, 8, 32); err == nil {
+			if err := os.Chmod(tmp, os.FileMode(m).Perm()); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := os.Rename(tmp, localPath); err != nil {
+		return nil, err
+	}
+	if !attrs.LastModified.IsZero() {
+		if err := os.Chtimes(localPath, time.Now(), attrs.LastModified); err != nil {
+			return nil, err
+		}
+	}
+	return attrs, nil
+}
+
+// maxDownloadRestarts is the number of times that a download with FileResume
+// starts again because the object changed.
+const maxDownloadRestarts = 3
+
+// resumeDownload downloads obj into a partial file beside localPath,
+// continuing any that holds the beginning of the version attrs describes, and
+// returns the partial file's name once it holds all of the object, with the
+// attributes of the version it holds.
+func resumeDownload(ctx context.Context, obj *Object, attrs *Attrs, localPath string) (string, *Attrs, error) {
+	for i := 0; ; i++ {
+		part := partialName(localPath, attrs)
+		if err := removePartials(localPath, part); err != nil {
+			return "", nil, err
+		}
+		changed, err := continueDownload(ctx, obj, attrs, part)
+		var cerr *ChecksumMismatchError
+		if errors.As(err, &cerr) {
+			// Start again next time.
+			os.Remove(part)
+		}
+		if err != nil {
+			return "", nil, err
+		}
+		if !changed {
+			return part, attrs, nil
+		}
+		if err := os.Remove(part); err != nil {
+			return "", nil, err
+		}
+		if i == maxDownloadRestarts {
+			return "", nil, fmt.Errorf("b2: %s kept changing while it was downloaded", obj.name)
+		}
+		if attrs, err = obj.Attrs(ctx); err != nil {
+			return "", nil, err
+		}
+	}
+}
+
+// continueDownload downloads whatever the partial file part lacks of the
+// object, and checks the result against attrs.  It reports whether the object
+// turned out to be a version other than the one attrs describes, in which case
+// part holds some of each.
+func continueDownload(ctx context.Context, obj *Object, attrs *Attrs, part string) (bool, error) {
+	f, err := os.OpenFile(part, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close() // Fails harmlessly once f has been closed below.
+	off, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return false, err
+	}
+	if off > attrs.Size {
+		// Not a beginning of this version after all.
+		if err := f.Truncate(0); err != nil {
+			return false, err
+		}
+		if off, err = f.Seek(0, io.SeekStart); err != nil {
+			return false, err
+		}
+	}
+	if off < attrs.Size {
+		r := obj.NewRangeReader(ctx, off, -1)
+		_, err := io.Copy(f, r)
+		got := r.Attrs()
+		r.Close()
+		if got != nil && !sameVersion(got, attrs) {
+			return true, nil
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+	sha, err := fileSHA1(f)
+	if err != nil {
+		return false, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+	if len(attrs.SHA1) == 40 && sha != attrs.SHA1 {
+		return false, &ChecksumMismatchError{Name: obj.name, Expected: attrs.SHA1, Actual: sha}
+	}
+	if fi.Size() != attrs.Size {
+		return false, &ChecksumMismatchError{Name: obj.name, ExpectedSize: attrs.Size, ActualSize: fi.Size()}
+	}
+	return false, f.Close()
+}
+
+// partialName returns the name of the partial file that FileResume keeps for
+// the version of the object that attrs describes, downloaded to localPath.
+func partialName(localPath string, attrs *Attrs) string {
+	version := fmt.Sprintf("%s/%s/%d", attrs.ID, attrs.SHA1, attrs.UploadTimestamp.UnixNano())
+	return fmt.Sprintf("%s.b2part-%x", localPath, sha1.Sum([]byte(version)))
+}
+
+// sameVersion reports whether a and b describe the same version of an object.
+func sameVersion(a, b *Attrs) bool {
+	return a.ID == b.ID && a.SHA1 == b.SHA1 && a.UploadTimestamp.Equal(b.UploadTimestamp)
+}
+
+// removePartials removes the partial files of downloads to localPath other
+// than keep.
+func removePartials(localPath, keep string) error {
+	dir, base := filepath.Split(localPath)
+	if dir == "" {
+		dir = "."
+	}
+	ents, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range ents {
+		name := filepath.Join(dir, e.Name())
+		if strings.HasPrefix(e.Name(), base+".b2part-") && name != filepath.Clean(keep) {
+			if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// localMatches reports whether the file at path has the size and SHA1 hash
+// given in attrs.  A missing file does not match.
+func localMatches(path string, attrs *Attrs) (bool, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+	if fi.Size() != attrs.Size {
+		return false, nil
+	}
+	sha, err := fileSHA1(f)
+	if err != nil {
+		return false, err
+	}
+	return sha == attrs.SHA1, nil
+}
+
+func fileSHA1(r io.Reader) (string, error) {
+	hash := sha1.New()
+	if _, err := io.Copy(hash, r); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", hash.Sum(nil)), nil
+}
@@ -0,0 +1,51 @@
+// Copyright 2024, the Blazer authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package b2
+
+import "github.com/Backblaze/blazer/internal/blog"
+
+// A Logger receives a client's log messages.  Level 1 messages report each
+// retry, with the API call, the attempt, the delay, and B2's code for the
+// error, and errors that were recovered from; level 2 messages report each API
+// request and response.  Authorization tokens, application keys, and
+// encryption keys are redacted before messages reach it.  A Logger must be
+// safe for concurrent use.
+type Logger interface {
+	// Enabled reports whether messages at level are wanted.  Messages that
+	// aren't are never formatted.
+	Enabled(level int) bool
+
+	// Log logs a message at level.
+	Log(level int, msg string)
+}
+
+// WithLogger sends the client's log messages to l.  Without it, they go to
+// the standard logger, at the verbosity set by the B2_LOG_LEVEL environment
+// variable, which is zero, for none, if it isn't set.  With Go 1.21 or later,
+// SlogLogger adapts a *slog.Logger.
+func WithLogger(l Logger) ClientOption {
+	return func(c *clientOptions) {
+		c.logger = l
+	}
+}
+
+// v returns the Verbose for target that logs to the client's Logger, if it has
+// one.
+func (c *Client) v(target int32) blog.Verbose {
+	if c == nil || c.opts.logger == nil {
+		return blog.V(target)
+	}
+	return blog.To(c.opts.logger, target)
+}
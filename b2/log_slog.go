@@ -0,0 +1,33 @@
+// Copyright 2024, the Blazer authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build go1.21
+
+package b2
+
+import (
+	"log/slog"
+
+	"github.com/Backblaze/blazer/internal/blog"
+)
+
+// SlogLogger returns a Logger, for WithLogger, that logs to l.  Level 1
+// messages are logged at slog.LevelInfo, and level 2 messages at
+// slog.LevelDebug.  Each API request and response is logged with attributes
+// rather than as text: "method" (such as "b2_list_file_names"), "request_id",
+// "attempt", and "bytes", and for requests "verb", "url", "headers", and
+// "args", and for responses "status", "duration", "headers", and "reply".
+func SlogLogger(l *slog.Logger) Logger {
+	return blog.Slog(l)
+}
@@ -0,0 +1,60 @@
+// Copyright 2024, the Blazer authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build go1.21
+
+package b2
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSlogLogger(t *testing.T) {
+	ctx := context.Background()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	buf := &bytes.Buffer{}
+	l := SlogLogger(slog.New(slog.NewTextHandler(buf, &slog.HandlerOptions{Level: slog.LevelInfo})))
+	if !l.Enabled(1) || l.Enabled(2) {
+		t.Errorf("at slog.LevelInfo: Enabled(1) = %v, Enabled(2) = %v; want true, false", l.Enabled(1), l.Enabled(2))
+	}
+
+	client := &Client{
+		backend: &beRoot{
+			b2i: &testRoot{
+				bucketMap: make(map[string]map[string]string),
+				errs: &errCont{
+					errMap: map[string]map[int]error{"uploadPart": {0: testError{}}},
+				},
+			},
+		},
+	}
+	WithLogger(l)(&client.opts)
+	bucket, err := client.NewBucket(ctx, bucketName, &BucketAttrs{Type: Private})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := writeFile(ctx, bucket, "file", 3e4, 1e4); err == nil {
+		t.Fatal("writeFile: got no error")
+	}
+	if got := buf.String(); !strings.Contains(got, `level=INFO msg="error writing file: `) {
+		t.Errorf("got %q, want the error logged at INFO", got)
+	}
+}
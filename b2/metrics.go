@@ -0,0 +1,165 @@
+// Copyright 2024, the Blazer authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package b2
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// A MetricsCollector receives a client's metrics, in the manner of Prometheus
+// counters, gauges, and histograms.  Labels are given as pairs of names and
+// values.  A client reports:
+//
+//	b2_requests_total{method, status}     requests, by API call and status
+//	                                      class: "2xx", "4xx", "5xx", or "error"
+//	                                      if there was no response
+//	b2_request_duration_seconds{method}   observed, until the response headers
+//	b2_requests_in_flight{method}         a gauge
+//	b2_retries_total{method, reason}      by B2's error code, such as
+//	                                      "service_unavailable", or else the
+//	                                      HTTP status, or "error"
+//	b2_uploaded_bytes_total               the bodies of uploads
+//	b2_downloaded_bytes_total             the bodies of downloads
+//	b2_operations_in_flight{op}           a gauge of Writers ("write") and
+//	                                      Readers ("read") not yet closed
+//
+// A MetricsCollector must be safe for concurrent use.
+type MetricsCollector interface {
+	// Inc adds delta, which is negative for a gauge that falls, to the
+	// metric name.
+	Inc(name string, delta int64, labels ...string)
+
+	// Observe records a value of the metric name.
+	Observe(name string, value float64, labels ...string)
+}
+
+// WithMetrics reports the client's metrics to m.  NewMetrics returns a
+// MetricsCollector that keeps them in memory.
+func WithMetrics(m MetricsCollector) ClientOption {
+	return func(c *clientOptions) {
+		c.metrics = m
+	}
+}
+
+// inc adds delta to the client's metric name, if it reports metrics.
+func (c *Client) inc(name string, delta int64, labels ...string) {
+	if c == nil || c.opts.metrics == nil {
+		return
+	}
+	c.opts.metrics.Inc(name, delta, labels...)
+}
+
+// Metrics is a MetricsCollector that keeps the metrics it is given in memory.
+// It is an expvar.Var, so that it can be published with expvar.Publish.
+type Metrics struct {
+	mu     sync.Mutex
+	counts map[string]int64
+	obs    map[string]Observations
+}
+
+// Observations summarizes the values observed of one metric.
+type Observations struct {
+	Count int64
+	Sum   float64
+	Max   float64
+}
+
+// MetricsSnapshot holds the values of a Metrics at one time.  Each metric is
+// keyed by its name and labels, as `b2_requests_total{method="b2_list_buckets",status="2xx"}`,
+// or just its name if it has no labels.
+type MetricsSnapshot struct {
+	Counters     map[string]int64
+	Observations map[string]Observations
+}
+
+// NewMetrics returns an empty Metrics.
+func NewMetrics() *Metrics {
+	return &Metrics{
+		counts: make(map[string]int64),
+		obs:    make(map[string]Observations),
+	}
+}
+
+func metricKey(name string, labels []string) string {
+	if len(labels) < 2 {
+		return name
+	}
+	var pairs []string
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", labels[i], labels[i+1]))
+	}
+	sort.Strings(pairs)
+	return name + "{" + strings.Join(pairs, ",") + "}"
+}
+
+// Inc adds delta to the metric name.
+func (m *Metrics) Inc(name string, delta int64, labels ...string) {
+	k := metricKey(name, labels)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.counts[k] += delta
+}
+
+// Observe records a value of the metric name.
+func (m *Metrics) Observe(name string, value float64, labels ...string) {
+	k := metricKey(name, labels)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	o := m.obs[k]
+	o.Count++
+	o.Sum += value
+	if o.Count == 1 || value > o.Max {
+		o.Max = value
+	}
+	m.obs[k] = o
+}
+
+// Snapshot returns the current values of m.
+func (m *Metrics) Snapshot() MetricsSnapshot {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := MetricsSnapshot{
+		Counters:     make(map[string]int64, len(m.counts)),
+		Observations: make(map[string]Observations, len(m.obs)),
+	}
+	for k, v := range m.counts {
+		s.Counters[k] = v
+	}
+	for k, v := range m.obs {
+		s.Observations[k] = v
+	}
+	return s
+}
+
+// String returns m's current values as JSON, for expvar.
+func (m *Metrics) String() string {
+	b, err := json.Marshal(m.Snapshot())
+	if err != nil {
+		return "{}"
+	}
+	return string(b)
+}
+
+// statusClass returns the class of an HTTP status, such as "5xx".
+func statusClass(status int) string {
+	if status < 100 || status > 599 {
+		return "error"
+	}
+	return fmt.Sprintf("%dxx", status/100)
+}
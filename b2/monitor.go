@@ -20,6 +20,8 @@ import (
 	"math"
 	"net/http"
 	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Backblaze/blazer/internal/b2assets"
@@ -37,6 +39,219 @@ type StatusInfo struct {
 	// RPCs contains information about recently made RPC calls over the last
 	// minute, five minutes, hour, and for all time.
 	RPCs map[time.Duration]MethodList
+
+	// Transfers and Buffered report use of the limits set by
+	// MaxTransferConcurrency and MaxBufferedBytes, or are nil if the limit
+	// is not set.
+	Transfers *LimitStatus
+	Buffered  *LimitStatus
+
+	// ReadRate and WriteRate are the throughput of all of the client's
+	// Readers and Writers together, including those already closed.
+	ReadRate  TransferRate
+	WriteRate TransferRate
+
+	// RetryBudget reports use of the budget set by RetryBudget, or is nil if
+	// there is none.
+	RetryBudget *RetryBudgetStatus
+
+	// Latency holds the distribution of the durations of each method's
+	// requests, from when each was sent until its response headers arrived,
+	// since the client was made or ResetLatency was last called.
+	Latency map[string]*LatencyHistogram
+
+	// Retries counts the retries of each method since the client was made,
+	// including those after the account is authorized anew and those of
+	// uploads with a new upload URL.
+	Retries map[string]int64
+}
+
+// latencyBounds are the upper bounds of the buckets of a LatencyHistogram.
+var latencyBounds = []time.Duration{
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+	25 * time.Second,
+	60 * time.Second,
+}
+
+// A LatencyHistogram counts durations in fixed buckets.
+type LatencyHistogram struct {
+	// Bounds are the upper bounds of the buckets, from 10ms to 60s.
+	// Counts[i] counts the durations no longer than Bounds[i] and longer
+	// than Bounds[i-1]; the last count, Counts[len(Bounds)], counts those
+	// longer than 60s.
+	Bounds []time.Duration
+	Counts []uint64
+
+	Count uint64
+	Sum   time.Duration
+}
+
+// Mean returns the mean duration, or zero if there are none.
+func (h *LatencyHistogram) Mean() time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	return h.Sum / time.Duration(h.Count)
+}
+
+// Percentile estimates the duration that p percent of the durations are no
+// longer than, by interpolating within its bucket.  Durations longer than the
+// last bound are taken as that bound.  It returns zero if there are none.
+func (h *LatencyHistogram) Percentile(p float64) time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	rank := p / 100 * float64(h.Count)
+	var seen float64
+	for i, n := range h.Counts {
+		if n == 0 || seen+float64(n) < rank {
+			seen += float64(n)
+			continue
+		}
+		if i == len(h.Bounds) {
+			break
+		}
+		var lo time.Duration
+		if i > 0 {
+			lo = h.Bounds[i-1]
+		}
+		frac := (rank - seen) / float64(n)
+		return lo + time.Duration(frac*float64(h.Bounds[i]-lo))
+	}
+	return h.Bounds[len(h.Bounds)-1]
+}
+
+// latencyCounter accumulates a LatencyHistogram with atomic increments.
+type latencyCounter struct {
+	counts [13]uint64 // len(latencyBounds)+1
+	count  uint64
+	sum    int64
+}
+
+func (lc *latencyCounter) record(d time.Duration) {
+	i := sort.Search(len(latencyBounds), func(i int) bool { return d <= latencyBounds[i] })
+	atomic.AddUint64(&lc.counts[i], 1)
+	atomic.AddUint64(&lc.count, 1)
+	atomic.AddInt64(&lc.sum, int64(d))
+}
+
+func (lc *latencyCounter) histogram() *LatencyHistogram {
+	h := &LatencyHistogram{
+		Bounds: append([]time.Duration(nil), latencyBounds...),
+		Counts: make([]uint64, len(lc.counts)),
+		Count:  atomic.LoadUint64(&lc.count),
+		Sum:    time.Duration(atomic.LoadInt64(&lc.sum)),
+	}
+	for i := range lc.counts {
+		h.Counts[i] = atomic.LoadUint64(&lc.counts[i])
+	}
+	return h
+}
+
+// recordLatency records the duration of a request for method.
+func (c *Client) recordLatency(method string, d time.Duration) {
+	v, ok := c.latency.Load(method)
+	if !ok {
+		v, _ = c.latency.LoadOrStore(method, &latencyCounter{})
+	}
+	v.(*latencyCounter).record(d)
+}
+
+// ResetLatency clears the durations reported in StatusInfo.Latency.  They are
+// otherwise kept for the life of the client.
+func (c *Client) ResetLatency() {
+	c.latency.Range(func(k, _ interface{}) bool {
+		c.latency.Delete(k)
+		return true
+	})
+}
+
+// TransferRate reports the throughput of a transfer over the last ten
+// seconds, in bytes per second.
+type TransferRate struct {
+	// Effective counts each byte of the object once.
+	Effective float64
+
+	// Wire counts every byte sent or received, including bytes of a part
+	// sent again when its upload is retried.
+	Wire float64
+}
+
+// The span and resolution over which rateMeters measure.
+const (
+	rateWindow     = 10 * time.Second
+	rateResolution = 100 * time.Millisecond
+)
+
+// rateMeter accumulates the bytes moved by a transfer, and by its parent, the
+// client's meter for all transfers in that direction.  The zero value is ready
+// to use.
+type rateMeter struct {
+	parent *rateMeter
+
+	mu      sync.Mutex
+	first   time.Time      // when the first bytes were added
+	wire    *window.Window // of int64
+	retried *window.Window // of int64
+}
+
+// add records n bytes moved, of which retried had been moved before.
+func (m *rateMeter) add(n, retried int64) {
+	if m == nil || n == 0 {
+		return
+	}
+	m.mu.Lock()
+	if m.wire == nil {
+		m.first = time.Now()
+		m.wire = window.New(rateWindow, rateResolution, addInt64)
+		m.retried = window.New(rateWindow, rateResolution, addInt64)
+	}
+	wire, again := m.wire, m.retried
+	m.mu.Unlock()
+	wire.Insert(n)
+	if retried > 0 {
+		again.Insert(retried)
+	}
+	m.parent.add(n, retried)
+}
+
+// rate returns the throughput over the last rateWindow, or since the first
+// bytes were moved, if that is more recent.
+func (m *rateMeter) rate() TransferRate {
+	m.mu.Lock()
+	first, wire, again := m.first, m.wire, m.retried
+	m.mu.Unlock()
+	if wire == nil {
+		return TransferRate{}
+	}
+	span := time.Since(first)
+	if span > rateWindow {
+		span = rateWindow
+	}
+	if span < rateResolution {
+		span = rateResolution
+	}
+	n, _ := wire.Reduce().(int64)
+	r, _ := again.Reduce().(int64)
+	return TransferRate{
+		Effective: float64(n-r) / span.Seconds(),
+		Wire:      float64(n) / span.Seconds(),
+	}
+}
+
+func addInt64(i, j interface{}) interface{} {
+	a, _ := i.(int64)
+	b, _ := j.(int64)
+	return a + b
 }
 
 // MethodList is an accumulation of RPC calls that have been made over a given
@@ -98,6 +313,13 @@ type WriterStatus struct {
 	// Progress is a slice of completion ratios.  The index of a ratio is its
 	// chunk id less one.
 	Progress []float64
+
+	// Waiting is the number of parts and buffers waiting on the client's
+	// MaxTransferConcurrency or MaxBufferedBytes.
+	Waiting int
+
+	// Rate is the writer's throughput.
+	Rate TransferRate
 }
 
 // ReaderStatus reports the status for each reader.
@@ -105,6 +327,20 @@ type ReaderStatus struct {
 	// Progress is a slice of completion ratios.  The index of a ratio is its
 	// chunk id less one.
 	Progress []float64
+
+	// Waiting is the number of chunks waiting on the client's
+	// MaxTransferConcurrency.
+	Waiting int
+
+	// ChunkSize and Concurrency are the size of the chunks the reader is
+	// fetching, and how many of them it fetches at once, as chosen by the
+	// reader when ChunkSize is not set.  ChunkSize is zero while the reader
+	// streams its range in a single request.
+	ChunkSize   int
+	Concurrency int
+
+	// Rate is the reader's throughput.
+	Rate TransferRate
 }
 
 // Status returns information about the current state of the client.
@@ -116,6 +352,8 @@ func (c *Client) Status() *StatusInfo {
 		Writers: make(map[string]*WriterStatus),
 		Readers: make(map[string]*ReaderStatus),
 		RPCs:    make(map[time.Duration]MethodList),
+		Latency: make(map[string]*LatencyHistogram),
+		Retries: make(map[string]int64),
 	}
 
 	for name, w := range c.sWriters {
@@ -130,6 +368,21 @@ func (c *Client) Status() *StatusInfo {
 		si.RPCs[c.d] = c.retrieve()
 	}
 
+	transfers, buffered := c.limits()
+	si.Transfers = transfers.status()
+	si.Buffered = buffered.status()
+	si.ReadRate = c.readRate.rate()
+	si.WriteRate = c.writeRate.rate()
+	si.RetryBudget = c.backend.retryBudget().status()
+	c.latency.Range(func(k, v interface{}) bool {
+		si.Latency[k.(string)] = v.(*latencyCounter).histogram()
+		return true
+	})
+	c.retries.Range(func(k, v interface{}) bool {
+		si.Retries[k.(string)] = atomic.LoadInt64(v.(*int64))
+		return true
+	})
+
 	return si
 }
 
@@ -0,0 +1,121 @@
+// Copyright 2024, the Blazer authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package b2
+
+import (
+	"context"
+	"fmt"
+)
+
+type moveOptions struct {
+	allVersions bool
+	hide        bool
+}
+
+// A MoveOption alters the behavior of Object.Rename and Object.MoveTo.
+type MoveOption func(*moveOptions)
+
+// MoveAllVersions causes every version of the source name, including hide
+// markers, to be deleted once the latest version has been copied.  Without it,
+// only the version that was copied is deleted, and any older version becomes
+// the current object under the old name.
+func MoveAllVersions() MoveOption {
+	return func(m *moveOptions) {
+		m.allVersions = true
+	}
+}
+
+// MoveHideSource causes the source to be hidden rather than deleted, leaving
+// all of its versions in place.  It has no effect with MoveAllVersions.
+func MoveHideSource() MoveOption {
+	return func(m *moveOptions) {
+		m.hide = true
+	}
+}
+
+// A MoveError is returned by Rename and MoveTo when the copy succeeded but
+// the source could not be removed.  Dst is the complete copy; the source still
+// exists, although if MoveAllVersions was given some of its versions may have
+// been deleted.
+type MoveError struct {
+	Dst *Object
+	Err error
+}
+
+func (e *MoveError) Error() string {
+	return fmt.Sprintf("b2: copied to %s, but could not remove the source: %v", e.Dst.Name(), e.Err)
+}
+
+func (e *MoveError) Unwrap() error {
+	return e.Err
+}
+
+// Rename copies the latest version of the object to newName in the same
+// bucket and then removes the source as MoveTo does.
+func (o *Object) Rename(ctx context.Context, newName string, opts ...MoveOption) (*Object, error) {
+	return o.MoveTo(ctx, o.b, newName, opts...)
+}
+
+// MoveTo copies the latest version of the object to name in dstBucket, which
+// may be the object's own bucket, and then deletes the version that was
+// copied.  If the copy fails, nothing is removed and the error is returned
+// as-is.  If the copy succeeds but removing the source fails, the returned
+// error is a *MoveError, and the returned Object is the copy.
+func (o *Object) MoveTo(ctx context.Context, dstBucket *Bucket, name string, opts ...MoveOption) (*Object, error) {
+	mopts := &moveOptions{}
+	for _, f := range opts {
+		f(mopts)
+	}
+	if dstBucket.Name() == o.b.Name() && name == o.name {
+		return nil, fmt.Errorf("b2: cannot move %s onto itself", o.name)
+	}
+	// o may be an older version, from a listing; it is the latest that is
+	// moved.
+	src := o.b.Object(o.name)
+	if err := src.ensure(ctx); err != nil {
+		return nil, err
+	}
+	dst := dstBucket.Object(name)
+	if err := src.CopyTo(ctx, dst); err != nil {
+		return nil, err
+	}
+	if err := src.removeSource(ctx, mopts); err != nil {
+		return dst, &MoveError{Dst: dst, Err: err}
+	}
+	return dst, nil
+}
+
+func (o *Object) removeSource(ctx context.Context, mopts *moveOptions) error {
+	if mopts.hide && !mopts.allVersions {
+		return o.Hide(ctx)
+	}
+	if err := o.Delete(ctx); err != nil {
+		return err
+	}
+	if !mopts.allVersions {
+		return nil
+	}
+	iter := o.b.List(ctx, ListPrefix(o.name), ListHidden())
+	for iter.Next() {
+		obj := iter.Object()
+		if obj.Name() != o.name || obj.ID() == o.ID() {
+			continue
+		}
+		if err := obj.Delete(ctx); err != nil && !IsNotExist(err) {
+			return err
+		}
+	}
+	return iter.Err()
+}
@@ -16,21 +16,70 @@ package b2
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
 	"crypto/sha1"
 	"errors"
 	"fmt"
 	"hash"
 	"io"
+	"math"
+	"net"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
-
-	"github.com/Backblaze/blazer/internal/blog"
 )
 
 var errNoMoreContent = errors.New("416: out of content")
 
+// A ChecksumMismatchError is returned by Read in place of io.EOF when the
+// whole of an object has been read and does not match what B2 recorded for it.
+// Objects uploaded as large files without a SHA1 hash can only be checked for
+// their size.
+type ChecksumMismatchError struct {
+	Name string // The object being read.
+
+	// Expected and Actual are the SHA1 hash B2 recorded and the hash of what
+	// was read, or empty if B2 has no hash for the object.
+	Expected, Actual string
+
+	// ExpectedSize and ActualSize are the object's size and the number of
+	// bytes read, when only the size could be checked.
+	ExpectedSize, ActualSize int64
+}
+
+func (e *ChecksumMismatchError) Error() string {
+	if e.Expected == "" {
+		return fmt.Sprintf("b2: %s: read %d bytes, want %d", e.Name, e.ActualSize, e.ExpectedSize)
+	}
+	return fmt.Sprintf("b2: %s: bad hash: got %s, want %s", e.Name, e.Actual, e.Expected)
+}
+
+// A NotModifiedError is returned by a Reader given IfNoneMatch or
+// IfModifiedSince when the object is unchanged, before any of it is
+// downloaded.
+type NotModifiedError struct {
+	Name            string    // The object being read.
+	SHA1            string    // Its SHA1 hash, or "none" if B2 has none for it.
+	UploadTimestamp time.Time // When its current version was uploaded.
+}
+
+func (e *NotModifiedError) Error() string {
+	return fmt.Sprintf("b2: %s: not modified", e.Name)
+}
+
 // Reader reads files from B2.
+//
+// A Reader is also an io.Seeker and an io.ReaderAt, so that it can be given to
+// http.ServeContent or archive/zip.  Seeking discards whatever has been
+// fetched ahead and starts again from the new position, so it is best done
+// before reading, or rarely.  ReadAt fetches each range with a request of its
+// own, and does not disturb Read.
+//
+// When a Reader has read a whole object from the start, Read checks what it
+// read against the object's SHA1 hash, or only its size if B2 has no hash for
+// it, and returns a *ChecksumMismatchError in place of io.EOF if they differ.
 type Reader struct {
 	// ConcurrentDownloads is the number of simultaneous downloads to pull from
 	// B2.  Values greater than one will cause B2 to make multiple HTTP requests
@@ -38,26 +87,65 @@ type Reader struct {
 	// the downloads in memory.
 	ConcurrentDownloads int
 
-	// ChunkSize is the size to fetch per ConcurrentDownload.  The default is
-	// 10MB.
+	// ChunkSize is the size to fetch per ConcurrentDownload.  If it is not
+	// set, the reader chooses for itself once the first response gives the
+	// object's size: objects under 16MB are fetched whole, and larger ones in
+	// about 100 chunks of between 16MB and 64MB, no more of them at once than
+	// ConcurrentDownloads.  Client.Status reports the choice.
 	ChunkSize int
 
-	ctx        context.Context
+	// ProgressFunc, if set, is called from Read and WriteTo with the number of
+	// bytes read so far and the number expected, or -1 if that is not known.
+	// When the whole object is read without a length, the final call reports
+	// the number read as the total.  It must be set before the first call to
+	// Read.
+	ProgressFunc func(read, total int64)
+
+	lctx       context.Context    // the reader's lifetime
+	lcancel    context.CancelFunc // cancels lctx
+	ctx        context.Context    // the current stream, from lctx
 	cancel     context.CancelFunc // cancels ctx
 	o          *Object
 	name       string
-	offset     int64 // the start of the file
+	base       int64 // the offset given to NewRangeReader
+	rlen       int64 // the length given to NewRangeReader
+	offset     int64 // the start of the current stream
 	length     int64 // the length to read, or -1
+	total      int64 // the length requested, or -1, for ProgressFunc
 	csize      int   // chunk size
-	read       int   // amount read
+	auto       bool  // csize is chosen by plan
+	next       int64 // the offset of the next chunk to fetch
+	sized      bool  // plan has run for the current stream
+	last       bool  // the final chunk has been claimed
+	toEnd      bool  // the final chunk ends at the end of the object
+	conc       int   // the number of chunks fetched at once, for status
+	read       int64 // amount read, or the position Seek set
 	chwid      int   // chunks written
 	chrid      int   // chunks read
 	chbuf      chan *rchunk
 	init       sync.Once
+	started    bool // init has run
+	wg         sync.WaitGroup
 	chunks     map[int]*rchunk
 	vrfy       hash.Hash
 	readOffEnd bool
 	sha1       string
+	fsize      int64 // the object's size, if known
+
+	attrs *Attrs // from the first response, guarded by rmux
+
+	span     Span // from NewReader until Close
+	spanDone sync.Once
+
+	decompress bool      // TransparentDecompression was given
+	encoding   string    // the object's Content-Encoding, from its first chunk
+	gzipped    bool      // dec is decompressing gzip
+	dec        io.Reader // what Read returns, with decompress
+
+	ifNoneMatch     string    // from IfNoneMatch
+	ifModifiedSince time.Time // from IfModifiedSince
+
+	dl downloadOverrides // from WithResponseHeaders and WithDownloadAuthorization
 
 	rmux  sync.Mutex // guards rcond
 	rcond *sync.Cond
@@ -67,6 +155,107 @@ type Reader struct {
 
 	smux sync.Mutex
 	smap map[int]*meteredReader
+
+	waiting int32 // chunks waiting on the client's MaxTransferConcurrency
+
+	rate rateMeter
+}
+
+// A ReaderOption alters the behavior of a Reader.
+type ReaderOption func(*Reader)
+
+// TransparentDecompression decompresses objects whose Content-Encoding, as
+// given in Attrs.ContentEncoding, is gzip, so that Read and WriteTo return
+// their content as it was before it was compressed.  Objects with any other
+// encoding, or none, are read as they are stored.
+//
+// B2's SHA1 hash is of the stored bytes, and is not compared; the reader
+// checks instead that it read as many bytes as B2 stores, and gzip checks the
+// length and CRC-32 of the decompressed content.  ProgressFunc counts stored
+// bytes.  Only whole objects can be decompressed: Seek, ReadAt, and readers
+// from NewRangeReader return an error.
+func TransparentDecompression() ReaderOption {
+	return func(r *Reader) {
+		r.decompress = true
+	}
+}
+
+// WithResponseHeaders makes the reader ask B2 to override the headers it
+// serves downloads with, as DownloadAuthorization does, by sending them as b2*
+// query parameters.  A reader given WithDownloadAuthorization must be given
+// the same options as the token was.
+func WithResponseHeaders(opts ...DownloadAuthorizationOption) ReaderOption {
+	return func(r *Reader) {
+		for _, f := range opts {
+			f(&r.dl.headers)
+		}
+	}
+}
+
+// WithContentDisposition is WithResponseHeaders(ResponseContentDisposition(v)),
+// to have browsers save what they are sent through a proxy, with a v such as
+// `attachment; filename="report.pdf"`.
+func WithContentDisposition(v string) ReaderOption {
+	return WithResponseHeaders(ResponseContentDisposition(v))
+}
+
+// WithDownloadAuthorization makes the reader authorize its requests with
+// token, from Bucket.DownloadAuthorization, rather than with the client's own
+// authorization.  The token must cover the object, and its response header
+// overrides must be given again with WithResponseHeaders.
+func WithDownloadAuthorization(token string) ReaderOption {
+	return func(r *Reader) {
+		r.dl.token = token
+	}
+}
+
+// IfNoneMatch makes the reader ask B2 for the object's SHA1 hash, with a HEAD
+// request, before it downloads anything, and fail the first Read or WriteTo
+// with a *NotModifiedError if the hash is sha1.  It is meant for refreshing
+// a cached copy: sha1 is the hash of the copy, as reported in Attrs.SHA1.  If
+// either hash is unknown, or is "none", IfModifiedSince decides, if given;
+// otherwise the object is downloaded.  ReadAt is not affected.
+func IfNoneMatch(sha1 string) ReaderOption {
+	return func(r *Reader) {
+		r.ifNoneMatch = sha1
+	}
+}
+
+// IfModifiedSince makes the reader ask B2 when the object was uploaded, with a
+// HEAD request, before it downloads anything, and fail the first Read or
+// WriteTo with a *NotModifiedError if that was no later than t.  As with HTTP,
+// a hash given to IfNoneMatch takes precedence.  ReadAt is not affected.
+func IfModifiedSince(t time.Time) ReaderOption {
+	return func(r *Reader) {
+		r.ifModifiedSince = t
+	}
+}
+
+// unmodified returns a *NotModifiedError if IfNoneMatch or IfModifiedSince
+// find the object unchanged.
+func (r *Reader) unmodified() error {
+	if r.ifNoneMatch == "" && r.ifModifiedSince.IsZero() {
+		return nil
+	}
+	fr, err := r.o.b.b.downloadFileByName(r.ctx, r.name, 0, 0, true, r.dl)
+	if err != nil {
+		return err
+	}
+	fr.Close()
+	r.noteAttrs(fr)
+	_, _, sha, _ := fr.stats()
+	stamp := fr.timestamp()
+	nm := &NotModifiedError{Name: r.name, SHA1: sha, UploadTimestamp: stamp}
+	if r.ifNoneMatch != "" && r.ifNoneMatch != "none" && len(sha) == 40 {
+		if sha == r.ifNoneMatch {
+			return nm
+		}
+		return nil
+	}
+	if !r.ifModifiedSince.IsZero() && !stamp.IsZero() && !stamp.After(r.ifModifiedSince) {
+		return nm
+	}
+	return nil
 }
 
 type rchunk struct {
@@ -76,11 +265,34 @@ type rchunk struct {
 
 // Close frees resources associated with the download.
 func (r *Reader) Close() error {
-	r.cancel()
+	r.lcancel()
+	if r.started {
+		r.wake()
+	}
 	r.o.b.c.removeReader(r)
+	r.spanDone.Do(func() {
+		if r.span == nil {
+			return
+		}
+		r.o.b.c.inc("b2_operations_in_flight", -1, "op", "read")
+		r.span.SetAttribute("bytes", r.read)
+		err := r.getErr()
+		if err == io.EOF {
+			err = nil
+		}
+		r.span.End(err)
+	})
 	return nil
 }
 
+// wake stops threads waiting for the first response once the reader's
+// context is done.
+func (r *Reader) wake() {
+	r.rmux.Lock()
+	r.rcond.Broadcast()
+	r.rmux.Unlock()
+}
+
 func (r *Reader) setErr(err error) {
 	r.emux.Lock()
 	defer r.emux.Unlock()
@@ -105,7 +317,11 @@ func (r *Reader) getErr() error {
 }
 
 func (r *Reader) thread() {
+	r.wg.Add(1)
 	go func() {
+		defer r.wg.Done()
+		transfers, _ := r.o.b.c.limits()
+		_, down := r.o.b.c.throttles()
 		for {
 			var buf *rchunk
 			select {
@@ -118,43 +334,89 @@ func (r *Reader) thread() {
 				return
 			}
 			r.rmux.Lock()
+			for r.auto && !r.sized && !r.last && r.chwid > 0 && r.getErr() == nil && r.ctx.Err() == nil {
+				// Wait for the first response to size the chunks.
+				r.rcond.Wait()
+			}
+			if r.last || r.getErr() != nil || r.ctx.Err() != nil {
+				r.rmux.Unlock()
+				return
+			}
 			chunkID := r.chwid
 			r.chwid++
-			r.rmux.Unlock()
-			offset := int64(chunkID*r.csize) + r.offset
+			offset := r.next
 			size := int64(r.csize)
 			if r.length > 0 {
-				if size > r.length {
+				if size >= r.length {
 					buf.final = true
+					r.last = true
 					size = r.length
 				}
 				r.length -= size
 			}
-			var b backoff
+			r.next += size
+			r.rmux.Unlock()
+			rt := bodyRetrier(r.o.b.r)
+			fail := func(err error) {
+				transfers.release(1)
+				r.setErr(err)
+				r.wake()
+			}
+			if transfers != nil {
+				atomic.AddInt32(&r.waiting, 1)
+				err := transfers.acquire(r.ctx, 1)
+				atomic.AddInt32(&r.waiting, -1)
+				if err != nil {
+					r.setErr(err)
+					r.rcond.Broadcast()
+					return
+				}
+			}
+			var got int64  // bytes of the chunk received so far
+			var fid string // the file the chunk is from
 		redo:
-			fr, err := r.o.b.b.downloadFileByName(r.ctx, r.name, offset, size, false)
-			if err == errNoMoreContent {
+			fr, err := r.o.b.b.downloadFileByName(r.ctx, r.name, offset+got, size-got, false, r.dl)
+			if err == errNoMoreContent && got == 0 {
+				transfers.release(1)
 				// this read generated a 416 so we are entirely past the end of the object
 				r.rmux.Lock()
 				r.readOffEnd = true
 				buf.final = true
+				r.last = true
 				r.chunks[chunkID] = buf
 				r.rmux.Unlock()
 				r.rcond.Broadcast()
 				return
 			}
 			if err != nil {
-				r.setErr(err)
-				r.rcond.Broadcast()
+				fail(err)
 				return
 			}
-			r.rmux.Lock()
-			rsize, _, sha1, _ := fr.stats()
-			if len(sha1) == 40 && r.sha1 != sha1 {
-				r.sha1 = sha1
+			_, _, sha1, info := fr.stats()
+			if got == 0 {
+				r.rmux.Lock()
+				if len(sha1) == 40 && r.sha1 != sha1 {
+					r.sha1 = sha1
+				}
+				r.encoding = info["b2-content-encoding"]
+				z := fr.size()
+				if z > 0 {
+					r.fsize = z
+				}
+				r.plan(z, offset+size, buf)
+				r.rmux.Unlock()
+				r.noteAttrs(fr)
+				// A response shorter than this was cut short, even if it
+				// says otherwise.
+				size = chunkLen(fr, offset, size)
+				fid = fr.id()
+			} else if fr.id() != fid {
+				// The rest would come from another version of the object.
+				fr.Close()
+				fail(fmt.Errorf("b2: %s changed while it was being read", r.name))
+				return
 			}
-			r.rmux.Unlock()
-			mr := &meteredReader{r: noopResetter{fr}, size: int(rsize)}
+			mr := &meteredReader{r: down.throttle(r.ctx, noopResetter{fr}), size: int(size), read: got, rate: &r.rate}
 			r.smux.Lock()
 			r.smap[chunkID] = mr
 			r.smux.Unlock()
@@ -163,23 +425,35 @@ func (r *Reader) thread() {
 			r.smux.Lock()
 			r.smap[chunkID] = nil
 			r.smux.Unlock()
-			if i < int64(rsize) || err == io.ErrUnexpectedEOF {
-				// Probably the network connection was closed early.  Retry.
-				blog.V(1).Infof("b2 reader %d: got %dB of %dB; retrying after %v", chunkID, i, rsize, b)
-				if err := b.wait(r.ctx); err != nil {
-					r.setErr(err)
-					r.rcond.Broadcast()
+			got += i
+			if err != nil && !bodyRetryable(err) {
+				fail(interrupted(fmt.Sprintf("b2: reading %s at offset %d", r.name, offset+got), err))
+				return
+			}
+			if got < size {
+				// Probably the network connection was closed early.  Ask for the rest.
+				if i > 0 {
+					rt.Progress()
+				}
+				if err == nil {
+					err = io.ErrUnexpectedEOF
+				}
+				if !rt.Retry(err) {
+					fail(fmt.Errorf("b2: reading %s: got %d of %d bytes at offset %d: %w", r.name, got, size, offset, err))
+					return
+				}
+				r.o.b.c.v(1).Infof("b2 reader %d: got %dB of %dB; resuming", chunkID, got, size)
+				if err := rt.Wait(r.ctx, err); err != nil {
+					fail(interrupted(fmt.Sprintf("b2: reading %s at offset %d", r.name, offset+got), err))
 					return
 				}
-				buf.Reset()
 				goto redo
 			}
-			if err != nil {
-				r.setErr(err)
-				r.rcond.Broadcast()
-				return
-			}
+			transfers.release(1)
 			r.rmux.Lock()
+			if buf.final && r.toEnd {
+				r.readOffEnd = true
+			}
 			r.chunks[chunkID] = buf
 			r.rmux.Unlock()
 			r.rcond.Broadcast()
@@ -187,17 +461,131 @@ func (r *Reader) thread() {
 	}()
 }
 
+// Limits on the chunk sizes that the reader chooses for itself.
+const (
+	autoMinChunk = 16 << 20 // also the first chunk, so smaller objects aren't split
+	autoMaxChunk = 64 << 20
+	autoChunks   = 100 // the number of chunks to aim for, between the limits
+)
+
+// plan lays out the rest of the stream once the first response gives the
+// object's size, whole, or zero if it is unknown.  For a read to the end of
+// the object it works out where that is, so that no chunk asks for more; buf
+// is the chunk of that response, which ends at end.  If the reader chooses its
+// own ChunkSize, it also sizes the chunks to come.  It must be called with
+// rmux held.
+func (r *Reader) plan(whole, end int64, buf *rchunk) {
+	if r.sized {
+		return
+	}
+	r.sized = true
+	defer r.rcond.Broadcast()
+	if whole <= 0 {
+		return
+	}
+	if r.length < 0 {
+		switch left := whole - r.next; {
+		case left > 0:
+			r.length = left
+			r.toEnd = true
+		case end >= whole && end == r.next:
+			buf.final = true
+			r.last = true
+			r.toEnd = true
+		}
+	}
+	if r.auto {
+		left := whole - r.next
+		size := left / autoChunks
+		if size < autoMinChunk {
+			size = autoMinChunk
+		}
+		if size > autoMaxChunk {
+			size = autoMaxChunk
+		}
+		r.csize = int(size)
+	}
+	chunks := r.chwid
+	if r.length > 0 {
+		chunks += int((r.length + int64(r.csize) - 1) / int64(r.csize))
+	}
+	if r.conc = r.ConcurrentDownloads; r.conc < 1 {
+		r.conc = 1
+	}
+	if chunks < r.conc {
+		r.conc = chunks
+	}
+}
+
+// Attrs returns the object's attributes, from the headers of the first
+// response B2 sent the reader, or nil if there has been none: it is set by the
+// first Read, WriteTo, or Stat.  As with HeadAttrs, CacheControl may be the
+// bucket's default, and Size is the whole object's, even for a range.
+func (r *Reader) Attrs() *Attrs {
+	r.rmux.Lock()
+	defer r.rmux.Unlock()
+	if r.attrs == nil {
+		return nil
+	}
+	return r.attrs.clone()
+}
+
+// Stat returns the object's attributes as Attrs does, asking B2 for them with
+// a HEAD request if nothing has been read yet.
+func (r *Reader) Stat(ctx context.Context) (*Attrs, error) {
+	if attrs := r.Attrs(); attrs != nil {
+		return attrs, nil
+	}
+	fr, err := r.o.b.b.downloadFileByName(ctx, r.name, 0, 0, true, r.dl)
+	if err != nil {
+		return nil, err
+	}
+	fr.Close()
+	attrs, err := attrsFromReader(r.name, fr)
+	if err != nil {
+		return nil, err
+	}
+	r.rmux.Lock()
+	if r.attrs == nil {
+		r.attrs = attrs
+	}
+	r.rmux.Unlock()
+	return attrs.clone(), nil
+}
+
+// noteAttrs records the attributes in fr's headers, unless the reader has
+// some already.
+func (r *Reader) noteAttrs(fr beFileReaderInterface) {
+	r.rmux.Lock()
+	have := r.attrs != nil
+	r.rmux.Unlock()
+	if have {
+		return
+	}
+	attrs, err := attrsFromReader(r.name, fr)
+	if err != nil {
+		r.o.b.c.v(1).Infof("b2 reader: %s: %v", r.name, err)
+		return
+	}
+	r.rmux.Lock()
+	if r.attrs == nil {
+		r.attrs = attrs
+	}
+	r.rmux.Unlock()
+}
+
 func (r *Reader) curChunk() (*rchunk, error) {
 	ch := make(chan *rchunk)
+	ctx := r.ctx // Seek may replace it
 	go func() {
 		r.rmux.Lock()
 		defer r.rmux.Unlock()
-		for r.chunks[r.chrid] == nil && r.getErr() == nil && r.ctx.Err() == nil {
+		for r.chunks[r.chrid] == nil && r.getErr() == nil && ctx.Err() == nil {
 			r.rcond.Wait()
 		}
 		select {
 		case ch <- r.chunks[r.chrid]:
-		case <-r.ctx.Done():
+		case <-ctx.Done():
 			return
 		}
 	}()
@@ -213,19 +601,47 @@ func (r *Reader) curChunk() (*rchunk, error) {
 }
 
 func (r *Reader) initFunc() {
+	r.setup()
+	if r.getErr() == nil {
+		r.start()
+	}
+}
+
+// setup prepares the reader for its first read, which fails if the object
+// hasn't been modified.
+func (r *Reader) setup() {
+	defer func() {
+		if err := r.unmodified(); err != nil {
+			r.setErr(err)
+		}
+	}()
+	r.started = true
+	r.o.b.c.addReader(r)
+	r.rcond = sync.NewCond(&r.rmux)
+	r.total = r.rlen
+	if r.total < 0 {
+		r.total = -1
+	}
+}
+
+// start begins fetching chunks from r.offset.
+func (r *Reader) start() {
 	r.smux.Lock()
 	r.smap = make(map[int]*meteredReader)
 	r.smux.Unlock()
-	r.o.b.c.addReader(r)
-	r.rcond = sync.NewCond(&r.rmux)
 	cr := r.ConcurrentDownloads
 	if cr < 1 {
 		cr = 1
 	}
-	if r.ChunkSize < 1 {
-		r.ChunkSize = 1e7
+	r.rmux.Lock()
+	r.next = r.offset
+	r.sized, r.last, r.toEnd = false, false, false
+	r.auto = r.ChunkSize < 1
+	r.csize, r.conc = r.ChunkSize, cr
+	if r.auto {
+		r.csize, r.conc = autoMinChunk, 1
 	}
-	r.csize = r.ChunkSize
+	r.rmux.Unlock()
 	r.chbuf = make(chan *rchunk, cr)
 	for i := 0; i < cr; i++ {
 		r.thread()
@@ -235,6 +651,57 @@ func (r *Reader) initFunc() {
 }
 
 func (r *Reader) Read(p []byte) (int, error) {
+	if !r.decompress {
+		return r.readStored(p)
+	}
+	if err := r.decoder(); err != nil {
+		return 0, err
+	}
+	return r.dec.Read(p)
+}
+
+// decoder sets dec, once the first chunk says what the object's encoding is,
+// to decompress it, or to read it as it is stored.
+func (r *Reader) decoder() error {
+	if r.dec != nil {
+		return nil
+	}
+	if r.base != 0 || r.rlen >= 0 {
+		return fmt.Errorf("b2: %s: TransparentDecompression can only read whole objects", r.name)
+	}
+	if err := r.getErr(); err != nil {
+		return err
+	}
+	r.init.Do(r.initFunc)
+	if _, err := r.curChunk(); err != nil {
+		r.setErrNoCancel(err)
+		return err
+	}
+	r.rmux.Lock()
+	enc := r.encoding
+	r.rmux.Unlock()
+	if enc != "gzip" {
+		r.dec = storedReader{r}
+		return nil
+	}
+	r.gzipped = true
+	zr, err := gzip.NewReader(storedReader{r})
+	if err != nil {
+		err = fmt.Errorf("b2: %s: %w", r.name, err)
+		r.setErrNoCancel(err)
+		return err
+	}
+	r.dec = zr
+	return nil
+}
+
+// storedReader reads the object as it is stored, for dec.
+type storedReader struct{ r *Reader }
+
+func (sr storedReader) Read(p []byte) (int, error) { return sr.r.readStored(p) }
+
+// readStored reads the object's bytes as B2 stores them.
+func (r *Reader) readStored(p []byte) (int, error) {
 	if err := r.getErr(); err != nil {
 		return 0, err
 	}
@@ -246,28 +713,431 @@ func (r *Reader) Read(p []byte) (int, error) {
 	}
 	n, err := chunk.Read(p)
 	r.vrfy.Write(p[:n]) // Hash.Write never returns an error.
-	r.read += n
+	r.read += int64(n)
 	if err == io.EOF {
 		if chunk.final {
-			close(r.chbuf)
-			r.setErrNoCancel(err)
-			return n, err
+			return n, r.finish()
 		}
 		r.chrid++
 		chunk.Reset()
 		r.chbuf <- chunk
 		err = nil
 	}
+	if r.ProgressFunc != nil && n > 0 {
+		r.ProgressFunc(r.read, r.total)
+	}
+	r.setErrNoCancel(err)
+	return n, err
+}
+
+// finish ends the reader once all of it has been read, and returns io.EOF, or
+// the error check finds.
+func (r *Reader) finish() error {
+	if r.ProgressFunc != nil {
+		r.ProgressFunc(r.read, r.read)
+	}
+	if r.chbuf != nil {
+		close(r.chbuf)
+	}
+	err := io.EOF
+	if cerr := r.check(); cerr != nil {
+		err = cerr
+	}
 	r.setErrNoCancel(err)
+	return err
+}
+
+// WriteTo writes the rest of the reader to w, as io.WriterTo does, so that
+// io.Copy needs no buffer of its own.  Chunks fetched concurrently are written
+// from the reader's buffers as each becomes ready, in order.  A reader with
+// one ConcurrentDownloads that has not yet been read from streams the download
+// straight into w instead, without buffering chunks at all.
+//
+// If w returns an error, WriteTo returns it, and the reader can go on reading
+// from where w stopped.
+func (r *Reader) WriteTo(w io.Writer) (int64, error) {
+	if r.decompress {
+		if err := r.decoder(); err != nil {
+			return 0, err
+		}
+		return io.Copy(w, r.dec)
+	}
+	if err := r.getErr(); err != nil {
+		if err == io.EOF {
+			err = nil
+		}
+		return 0, err
+	}
+	if !r.started && r.ConcurrentDownloads <= 1 {
+		return r.stream(w)
+	}
+	r.init.Do(r.initFunc)
+	var n int64
+	for {
+		chunk, err := r.curChunk()
+		if err != nil {
+			r.setErrNoCancel(err)
+			return n, err
+		}
+		b := chunk.Bytes()
+		k, err := w.Write(b)
+		r.vrfy.Write(b[:k])
+		chunk.Next(k)
+		n += int64(k)
+		r.read += int64(k)
+		if r.ProgressFunc != nil && k > 0 {
+			r.ProgressFunc(r.read, r.total)
+		}
+		if err != nil {
+			return n, err
+		}
+		if chunk.final {
+			if err := r.finish(); err != io.EOF {
+				return n, err
+			}
+			return n, nil
+		}
+		r.chrid++
+		chunk.Reset()
+		r.chbuf <- chunk
+	}
+}
+
+// stream writes the rest of the reader's range to w with a single download,
+// resuming it if the connection fails, as the reader's threads do for chunks.
+func (r *Reader) stream(w io.Writer) (int64, error) {
+	r.init.Do(r.setup)
+	if err := r.getErr(); err != nil {
+		return 0, err
+	}
+	r.vrfy = sha1.New()
+	hw := &hashWriter{w: w, r: r}
+	if r.rlen >= 0 && r.length <= 0 {
+		return 0, nil
+	}
+	transfers, _ := r.o.b.c.limits()
+	_, down := r.o.b.c.throttles()
+	atomic.AddInt32(&r.waiting, 1)
+	err := transfers.acquire(r.ctx, 1)
+	atomic.AddInt32(&r.waiting, -1)
+	if err != nil {
+		r.setErr(err)
+		return 0, err
+	}
+	defer transfers.release(1)
+	r.rmux.Lock()
+	r.conc = 1
+	r.rmux.Unlock()
+
+	offset, size := r.offset, r.length
+	if size < 0 {
+		size = 0 // the rest of the object
+	}
+	rt := bodyRetrier(r.o.b.r)
+	var want int64 // bytes the range holds
+	var fid string // the file the range is from
+	for {
+		left := size - hw.n
+		if size == 0 {
+			left = 0
+		}
+		fr, err := r.o.b.b.downloadFileByName(r.ctx, r.name, offset+hw.n, left, false, r.dl)
+		if err == errNoMoreContent && hw.n == 0 {
+			r.readOffEnd = true
+			break
+		}
+		if err != nil {
+			r.setErr(err)
+			return hw.n, err
+		}
+		if fid == "" {
+			_, _, sha1, _ := fr.stats()
+			r.rmux.Lock()
+			if len(sha1) == 40 {
+				r.sha1 = sha1
+			}
+			if z := fr.size(); z > 0 {
+				r.fsize = z
+			}
+			r.rmux.Unlock()
+			r.noteAttrs(fr)
+			want = size
+			if want == 0 {
+				want = math.MaxInt64
+			}
+			want = chunkLen(fr, offset, want)
+			fid = fr.id()
+		} else if fr.id() != fid {
+			fr.Close()
+			err := fmt.Errorf("b2: %s changed while it was being read", r.name)
+			r.setErr(err)
+			return hw.n, err
+		}
+		i, err := io.Copy(hw, io.LimitReader(down.throttle(r.ctx, noopResetter{fr}), want-hw.n))
+		fr.Close()
+		if hw.err != nil {
+			// Leave the rest for Read.
+			r.offset += hw.n
+			if r.length > 0 {
+				r.length -= hw.n
+			}
+			r.start()
+			return hw.n, hw.err
+		}
+		if hw.n == want {
+			r.readOffEnd = size == 0
+			break
+		}
+		if err != nil && !bodyRetryable(err) {
+			err = interrupted(fmt.Sprintf("b2: reading %s at offset %d", r.name, offset+hw.n), err)
+			r.setErr(err)
+			return hw.n, err
+		}
+		if i > 0 {
+			rt.Progress()
+		}
+		if err == nil {
+			err = io.ErrUnexpectedEOF
+		}
+		if !rt.Retry(err) {
+			err = fmt.Errorf("b2: reading %s: got %d of %d bytes at offset %d: %w", r.name, hw.n, want, offset, err)
+			r.setErr(err)
+			return hw.n, err
+		}
+		r.o.b.c.v(1).Infof("b2 reader: got %d of %d bytes; resuming", hw.n, want)
+		if err := rt.Wait(r.ctx, err); err != nil {
+			err = interrupted(fmt.Sprintf("b2: reading %s at offset %d", r.name, offset+hw.n), err)
+			r.setErr(err)
+			return hw.n, err
+		}
+	}
+	if err := r.finish(); err != io.EOF {
+		return hw.n, err
+	}
+	return hw.n, nil
+}
+
+// hashWriter passes writes on to w, counting and hashing what w accepts for
+// the reader, and keeping w's error apart from the download's.
+type hashWriter struct {
+	w   io.Writer
+	r   *Reader
+	n   int64
+	err error
+}
+
+func (hw *hashWriter) Write(p []byte) (int, error) {
+	n, err := hw.w.Write(p)
+	hw.r.vrfy.Write(p[:n])
+	hw.n += int64(n)
+	hw.r.read += int64(n)
+	hw.r.rate.add(int64(n), 0)
+	if hw.r.ProgressFunc != nil && n > 0 {
+		hw.r.ProgressFunc(hw.r.read, hw.r.total)
+	}
+	if err != nil {
+		hw.err = err
+	}
 	return n, err
 }
 
+// Seek sets the position of the next Read within the reader's range, as
+// io.Seeker does; seeking relative to the end asks B2 for the object's size.
+// Seeking past the end is allowed, and later reads return io.EOF.  Whatever
+// has been fetched ahead of the old position is discarded, and the download
+// starts again from the new one.  Seek returns the error that stopped Read,
+// if any other than io.EOF.
+func (r *Reader) Seek(offset int64, whence int) (int64, error) {
+	if err := r.lctx.Err(); err != nil {
+		return 0, err
+	}
+	if r.decompress {
+		return 0, fmt.Errorf("b2: Seek %s: can't seek with TransparentDecompression", r.name)
+	}
+	if err := r.getErr(); err != nil && err != io.EOF {
+		return 0, err
+	}
+	var pos int64
+	switch whence {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos = r.read + offset
+	case io.SeekEnd:
+		size, err := r.size()
+		if err != nil {
+			return 0, err
+		}
+		pos = size + offset
+	default:
+		return 0, fmt.Errorf("b2: Seek %s: invalid whence %d", r.name, whence)
+	}
+	if pos < 0 {
+		return 0, fmt.Errorf("b2: Seek %s: negative position %d", r.name, pos)
+	}
+	if pos == r.read {
+		return pos, nil
+	}
+
+	if r.started {
+		r.cancel()
+		r.wake()
+		r.wg.Wait()
+	}
+	r.ctx, r.cancel = context.WithCancel(r.lctx)
+	r.rmux.Lock()
+	r.chunks = make(map[int]*rchunk)
+	r.chwid, r.chrid = 0, 0
+	r.readOffEnd = false
+	r.rmux.Unlock()
+	r.emux.Lock()
+	r.err = nil
+	r.emux.Unlock()
+	r.read = pos
+	r.offset = r.base + pos
+	r.length = -1
+	if r.rlen >= 0 {
+		r.length = r.rlen - pos
+		if r.length <= 0 {
+			r.setErrNoCancel(io.EOF)
+			return pos, nil
+		}
+	}
+	if r.started {
+		r.start()
+	}
+	return pos, nil
+}
+
+// size returns the length of the reader's range, or of as much of it as the
+// object holds.
+func (r *Reader) size() (int64, error) {
+	attrs, err := r.o.Attrs(r.lctx)
+	if err != nil {
+		return 0, err
+	}
+	n := attrs.Size - r.base
+	if n < 0 {
+		n = 0
+	}
+	if r.rlen >= 0 && r.rlen < n {
+		n = r.rlen
+	}
+	return n, nil
+}
+
+// ReadAt reads len(p) bytes from off within the reader's range, as
+// io.ReaderAt does, with a request of its own.  It may be called from several
+// goroutines at once, and alongside Read and Seek, which it does not affect.
+func (r *Reader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("b2: ReadAt %s: negative offset %d", r.name, off)
+	}
+	if r.decompress {
+		return 0, fmt.Errorf("b2: ReadAt %s: can't read at an offset with TransparentDecompression", r.name)
+	}
+	if err := r.lctx.Err(); err != nil {
+		return 0, err
+	}
+	size := int64(len(p))
+	if r.rlen >= 0 && off+size > r.rlen {
+		size = r.rlen - off
+		if size <= 0 {
+			return 0, io.EOF
+		}
+	}
+	if size == 0 {
+		return 0, nil
+	}
+	transfers, _ := r.o.b.c.limits()
+	if err := transfers.acquire(r.lctx, 1); err != nil {
+		return 0, err
+	}
+	defer transfers.release(1)
+	_, down := r.o.b.c.throttles()
+	rt := bodyRetrier(r.o.b.r)
+	var got int64  // bytes received so far
+	var want int64 // bytes the range holds
+	var fid string // the file the range is from
+	for {
+		fr, err := r.o.b.b.downloadFileByName(r.lctx, r.name, r.base+off+got, size-got, false, r.dl)
+		if err == errNoMoreContent && got == 0 {
+			return 0, io.EOF
+		}
+		if err != nil {
+			return int(got), err
+		}
+		if fid == "" {
+			want = chunkLen(fr, r.base+off, size)
+			fid = fr.id()
+		} else if fr.id() != fid {
+			fr.Close()
+			return int(got), fmt.Errorf("b2: %s changed while it was being read", r.name)
+		}
+		n, err := io.ReadFull(down.throttle(r.lctx, noopResetter{fr}), p[got:want])
+		fr.Close()
+		got += int64(n)
+		if got == want {
+			if want < int64(len(p)) {
+				return int(got), io.EOF
+			}
+			return int(got), nil
+		}
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if !bodyRetryable(err) {
+			return int(got), interrupted(fmt.Sprintf("b2: reading %s at offset %d", r.name, off+got), err)
+		}
+		// Probably the network connection was closed early.  Ask for the rest.
+		if n > 0 {
+			rt.Progress()
+		}
+		if !rt.Retry(err) {
+			return int(got), fmt.Errorf("b2: reading %s: got %d of %d bytes at offset %d: %w", r.name, got, want, off, err)
+		}
+		r.o.b.c.v(1).Infof("b2 reader at %d: got %d of %d bytes; resuming", off, got, want)
+		if err := rt.Wait(r.lctx, err); err != nil {
+			return int(got), interrupted(fmt.Sprintf("b2: reading %s at offset %d", r.name, off+got), err)
+		}
+	}
+}
+
+// chunkLen returns the number of bytes that a response to a request for size
+// bytes at offset must hold: size, or fewer at the end of the object.  If the
+// response doesn't give the object's size, its own length is trusted.
+func chunkLen(fr beFileReaderInterface, offset, size int64) int64 {
+	clen, _, _, _ := fr.stats()
+	whole := fr.size()
+	if whole <= offset {
+		return int64(clen)
+	}
+	if whole-offset < size {
+		return whole - offset
+	}
+	return size
+}
+
+// Rate returns the reader's throughput over the last ten seconds, in bytes per
+// second.  Client.Status reports it along with the rate of bytes received,
+// including any received again.
+func (r *Reader) Rate() float64 {
+	return r.rate.rate().Effective
+}
+
 func (r *Reader) status() *ReaderStatus {
+	r.rmux.Lock()
+	csize, conc := r.csize, r.conc
+	r.rmux.Unlock()
 	r.smux.Lock()
 	defer r.smux.Unlock()
 
 	rs := &ReaderStatus{
-		Progress: make([]float64, len(r.smap)),
+		Progress:    make([]float64, len(r.smap)),
+		Waiting:     int(atomic.LoadInt32(&r.waiting)),
+		ChunkSize:   csize,
+		Concurrency: conc,
+		Rate:        r.rate.rate(),
 	}
 
 	for i := 1; i <= len(r.smap); i++ {
@@ -277,6 +1147,32 @@ func (r *Reader) status() *ReaderStatus {
 	return rs
 }
 
+// check compares what has been read with the SHA1 hash or, failing that, the
+// size that B2 gave for the object, once the whole object has been read from
+// the start.  Reads of a range, or from a position Seek set, aren't checked,
+// and decompressed reads are checked only for their size.
+func (r *Reader) check() error {
+	if r.base != 0 || r.rlen >= 0 || r.offset != 0 {
+		return nil
+	}
+	r.rmux.Lock()
+	sha, size, end := r.sha1, r.fsize, r.readOffEnd
+	r.rmux.Unlock()
+	if !end {
+		return nil
+	}
+	if len(sha) == 40 && !r.gzipped {
+		if got := fmt.Sprintf("%x", r.vrfy.Sum(nil)); got != sha {
+			return &ChecksumMismatchError{Name: r.name, Expected: sha, Actual: got}
+		}
+		return nil
+	}
+	if size > 0 && r.read != size {
+		return &ChecksumMismatchError{Name: r.name, ExpectedSize: size, ActualSize: r.read}
+	}
+	return nil
+}
+
 // Verify checks the SHA1 hash on download and compares it to the SHA1 hash
 // submitted on upload.  If the two differ, this returns an error.  If the
 // correct hash could not be calculated (if, for example, the entire object was
@@ -295,7 +1191,7 @@ func (r *Reader) Verify() (error, bool) {
 	if r.offset > 0 || !r.readOffEnd || len(r.sha1) != 40 {
 		return nil, false
 	}
-	return fmt.Errorf("bad hash: got %v, want %v", got, r.sha1), true
+	return &ChecksumMismatchError{Name: r.name, Expected: r.sha1, Actual: got}, true
 }
 
 // strip a writer of any non-Write methods
@@ -322,29 +1218,26 @@ func copyContext(ctx context.Context, w io.Writer, r io.Reader) (int64, error) {
 	}
 }
 
-type noopResetter struct {
-	io.Reader
-}
-
-func (noopResetter) Reset() error { return nil }
+// maxBodyRetries is the number of times in a row that a download is resumed
+// after its connection fails partway through the body without new bytes
+// arriving.  Failures before the body begins are retried by the backend.
+const maxBodyRetries = 5
 
-type backoff time.Duration
-
-func (b *backoff) wait(ctx context.Context) error {
-	if *b == 0 {
-		*b = backoff(time.Millisecond)
+// bodyRetryable reports whether err, from reading the body of a download,
+// means the connection was lost, so that the rest can be asked for again.
+func bodyRetryable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
 	}
-	select {
-	case <-time.After(time.Duration(*b)):
-		if time.Duration(*b) < time.Second*10 {
-			*b <<= 1
-		}
-		return nil
-	case <-ctx.Done():
-		return ctx.Err()
+	if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET) {
+		return true
 	}
+	var ne net.Error
+	return errors.As(err, &ne)
 }
 
-func (b backoff) String() string {
-	return time.Duration(b).String()
+type noopResetter struct {
+	io.Reader
 }
+
+func (noopResetter) Reset() error { return nil }
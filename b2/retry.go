@@ -0,0 +1,428 @@
+// Copyright 2024, the Blazer authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package b2
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Backblaze/blazer/internal/blog"
+	"github.com/Backblaze/blazer/internal/retry"
+)
+
+// A RetryPolicy controls how a client retries what fails for reasons that
+// may pass: API calls that B2 asks to be made again, uploads of files and
+// parts that must start again with a new upload URL, and downloads whose
+// connections drop.  The zero value of each field keeps the default for each
+// kind of operation.
+type RetryPolicy struct {
+	// MaxAttempts limits the number of times one operation is attempted,
+	// including the first.  A download that makes headway starts its count
+	// again.  By default API calls and uploads are retried until their
+	// context is done, and downloads are attempted up to six times in a row
+	// without headway.
+	MaxAttempts int
+
+	// InitialBackoff is the delay before the first retry, which doubles with
+	// each retry after it, up to MaxBackoff.  By default API calls wait from
+	// one second up to thirty, give or take a little, uploads from 15ms up to
+	// 15s, and downloads from 1ms up to 10s.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+
+	// MaxRetryAfter limits the delay that B2 asks for with a Retry-After
+	// header, which is used in place of the backoff.  A longer delay is cut
+	// short to MaxRetryAfter.  The default is five minutes.
+	MaxRetryAfter time.Duration
+
+	// OnRetry, if set, is called before each retry with the number of
+	// attempts so far, the error that the last of them met, and the delay
+	// before the next, after any limit.  The delay that B2 asked for, if any,
+	// is given by base.Backoff(err).  It is called from whichever goroutine is
+	// retrying, and so can be called from many at once.
+	OnRetry func(attempt int, err error, delay time.Duration)
+}
+
+// WithRetryPolicy sets the client's RetryPolicy.  It applies to all of the
+// client's operations, including each part of a Writer's large file and each
+// chunk of a Reader, which are retried independently.  RetryFor sets a
+// different policy for a class of operations.
+func WithRetryPolicy(p RetryPolicy) ClientOption {
+	return func(c *clientOptions) {
+		c.retry = p
+	}
+}
+
+// An OpClass is a class of operations, whose retries can be set apart from
+// the rest with RetryFor.
+type OpClass int
+
+const (
+	// OpOther is any operation not in another class, such as creating and
+	// updating buckets and keys, getting file info, and hiding and deleting
+	// files.
+	OpOther OpClass = iota
+
+	// OpAuthorize is authorizing the account, b2_authorize_account.
+	OpAuthorize
+
+	// OpList is listing buckets, keys, files, file versions, unfinished large
+	// files, and parts.
+	OpList
+
+	// OpUpload is getting upload URLs, uploading files and parts, and
+	// starting, finishing, and canceling large files.
+	OpUpload
+
+	// OpDownload is downloading files, b2_download_file_by_name, including
+	// resuming a download whose connection drops.
+	OpDownload
+
+	// OpCopy is copying files and parts server-side.
+	OpCopy
+)
+
+// opClass returns the class of the API call method, as named in the
+// X-Blazer-Method header of its requests.
+func opClass(method string) OpClass {
+	switch method {
+	case "b2_authorize_account":
+		return OpAuthorize
+	case "b2_list_buckets", "b2_list_keys", "b2_list_file_names", "b2_list_file_versions", "b2_list_unfinished_large_files", "b2_list_parts":
+		return OpList
+	case "b2_get_upload_url", "b2_upload_file", "b2_start_large_file", "b2_get_upload_part_url", "b2_upload_part", "b2_finish_large_file", "b2_cancel_large_file":
+		return OpUpload
+	case "b2_download_file_by_name":
+		return OpDownload
+	case "b2_copy_file", "b2_copy_part":
+		return OpCopy
+	}
+	return OpOther
+}
+
+// RetryFor sets the RetryPolicy of one class of operations.  The fields of p
+// that are left zero are taken from the policy set with WithRetryPolicy, or
+// the defaults, so that
+//
+//	b2.RetryFor(b2.OpList, b2.RetryPolicy{MaxAttempts: 2, InitialBackoff: 200 * time.Millisecond})
+//
+// changes only the attempts and first delay of listings.  It can be given for
+// any number of classes; the last for each class wins.
+func RetryFor(class OpClass, p RetryPolicy) ClientOption {
+	return func(c *clientOptions) {
+		if c.retryFor == nil {
+			c.retryFor = make(map[OpClass]RetryPolicy)
+		}
+		c.retryFor[class] = p
+	}
+}
+
+// OnRetry sets a function to be called before every retry of the client's
+// operations, with the API call that failed, such as "b2_upload_part", the
+// number of attempts at it so far, the error that the last of them met, and
+// the delay before the next.  It is called for the retries of every
+// RetryPolicy, as well as when an API call is made again after the account is
+// authorized anew, and when an upload starts again with a new upload URL.
+// base.MsgCode(err) gives the HTTP status and B2's code for the error, if B2
+// replied with one.
+//
+// It is called from whichever goroutine is retrying, and so can be called
+// from many at once.
+func OnRetry(f func(method string, attempt int, err error, delay time.Duration)) ClientOption {
+	return func(c *clientOptions) {
+		c.onRetry = f
+	}
+}
+
+// retryPolicy returns the RetryPolicy of the API call method, whose OnRetry
+// also logs and counts the retry, counts it in the client's metrics, and calls
+// the client's.
+func (c clientOptions) retryPolicy(method string) RetryPolicy {
+	p := c.retry
+	if o, ok := c.retryFor[opClass(method)]; ok {
+		p = o.over(p)
+	}
+	if f, cl := p.OnRetry, c.client; cl != nil {
+		p.OnRetry = func(attempt int, err error, delay time.Duration) {
+			cl.retried(method, attempt, err, delay)
+			if f != nil {
+				f(attempt, err, delay)
+			}
+		}
+	}
+	if f, mc := p.OnRetry, c.metrics; mc != nil {
+		p.OnRetry = func(attempt int, err error, delay time.Duration) {
+			mc.Inc("b2_retries_total", 1, "method", method, "reason", retryReason(err))
+			if f != nil {
+				f(attempt, err, delay)
+			}
+		}
+	}
+	if f, g := p.OnRetry, c.onRetry; g != nil {
+		p.OnRetry = func(attempt int, err error, delay time.Duration) {
+			if f != nil {
+				f(attempt, err, delay)
+			}
+			g(method, attempt, err, delay)
+		}
+	}
+	return p
+}
+
+// retried logs the retry of method, after attempt attempts, the last of which
+// failed with err, and counts it in the client's Status.
+func (c *Client) retried(method string, attempt int, err error, delay time.Duration) {
+	v, ok := c.retries.Load(method)
+	if !ok {
+		v, _ = c.retries.LoadOrStore(method, new(int64))
+	}
+	atomic.AddInt64(v.(*int64), 1)
+	if l := c.v(1); l.Enabled() {
+		reason := retryReason(err)
+		l.Event("b2 retry", []blog.Attr{
+			{Key: "method", Value: method},
+			{Key: "attempt", Value: attempt},
+			{Key: "delay", Value: delay},
+			{Key: "reason", Value: reason},
+			{Key: "error", Value: err.Error()},
+		}, fmt.Sprintf("%s: attempt %d failed (%s); retrying in %v: %v", method, attempt, reason, delay, err))
+	}
+}
+
+// over returns the policy o over p: o's fields, and p's where o leaves them
+// zero.
+func (o RetryPolicy) over(p RetryPolicy) RetryPolicy {
+	if o.MaxAttempts > 0 {
+		p.MaxAttempts = o.MaxAttempts
+	}
+	if o.InitialBackoff > 0 {
+		p.InitialBackoff = o.InitialBackoff
+	}
+	if o.MaxBackoff > 0 {
+		p.MaxBackoff = o.MaxBackoff
+	}
+	if o.MaxRetryAfter > 0 {
+		p.MaxRetryAfter = o.MaxRetryAfter
+	}
+	if o.OnRetry != nil {
+		p.OnRetry = o.OnRetry
+	}
+	return p
+}
+
+// retryOptions returns the options for retries under p, where the defaults
+// for the kind of operation are given.
+func retryOptions(ri beRootInterface, p RetryPolicy, initial, max time.Duration, attempts int) []retry.Option {
+	if p.MaxAttempts > 0 {
+		attempts = p.MaxAttempts
+	}
+	if p.InitialBackoff > 0 {
+		initial = p.InitialBackoff
+	}
+	if p.MaxBackoff > 0 {
+		max = p.MaxBackoff
+	}
+	opts := []retry.Option{
+		retry.Attempts(attempts),
+		retry.Delay(initial, max),
+		retry.WithAfter(ri.clock().After),
+	}
+	if p.OnRetry != nil {
+		opts = append(opts, retry.OnRetry(p.OnRetry))
+	}
+	if b := ri.retryBudget(); b != nil {
+		opts = append(opts, retry.WithBudget(b))
+	}
+	return opts
+}
+
+// defaultMaxRetryAfter is the longest delay that B2 can ask for before an API
+// call is retried, unless the RetryPolicy says otherwise.
+const defaultMaxRetryAfter = 5 * time.Minute
+
+// apiRetries returns the options for the retries of the API call method, which
+// retries transient errors after the delay B2 asks for, if it does.
+func apiRetries(ri beRootInterface, method string) []retry.Option {
+	p := ri.retryPolicy(method)
+	maxRetryAfter := defaultMaxRetryAfter
+	if p.MaxRetryAfter > 0 {
+		maxRetryAfter = p.MaxRetryAfter
+	}
+	return append(retryOptions(ri, p, time.Second, 30*time.Second, 0),
+		retry.Jitter(),
+		retry.RetryIf(ri.transient),
+		retry.DynamicDelay(ri.backoff),
+		retry.MaxDynamicDelay(maxRetryAfter),
+	)
+}
+
+// uploadRetrier returns a Retrier for the upload of a file or a part, by the
+// API call method, which is retried with a new upload URL.
+func uploadRetrier(ri beRootInterface, method string) *retry.Retrier {
+	opts := append(retryOptions(ri, ri.retryPolicy(method), 15*time.Millisecond, 15*time.Second, 0),
+		retry.RetryIf(ri.reupload),
+	)
+	return retry.New(opts...)
+}
+
+// bodyRetrier returns a Retrier for resuming a download.
+func bodyRetrier(ri beRootInterface) *retry.Retrier {
+	return retry.New(retryOptions(ri, ri.retryPolicy("b2_download_file_by_name"), time.Millisecond, 10*time.Second, maxBodyRetries+1)...)
+}
+
+// BreakCircuit stops the client's API calls, other than uploads, from being
+// made while they are failing.  Once threshold calls in a row have failed with
+// a 5xx status or a network error, such as a timeout, calls fail at once with
+// an error that wraps ErrCircuitOpen, and are not retried, until cooldown has
+// passed.  Then up to probes calls at a time are let through, and the first to
+// succeed lets the rest through as well; if one fails, calls fail at once for
+// another cooldown.  Downloads are not stopped.  Without it, or if threshold is
+// less than one, calls are never stopped.
+func BreakCircuit(threshold int, cooldown time.Duration, probes int) ClientOption {
+	return func(c *clientOptions) {
+		c.breakThreshold = threshold
+		c.breakCooldown = cooldown
+		c.breakProbes = probes
+	}
+}
+
+// RetryBudget limits the retries of all of the client's operations together
+// to perMinute a minute, on average, so that many concurrent operations that
+// fail together don't keep retrying together.  Up to perMinute retries can be
+// made at once after the client has made none for a while.  An operation
+// whose retry would exceed the budget fails at once with a *RetryBudgetError.
+// Making an API call again after the account is authorized anew doesn't count
+// against the budget.  Without it, or if perMinute is less than one, there is
+// no budget.
+func RetryBudget(perMinute int) ClientOption {
+	return func(c *clientOptions) {
+		c.budget = newRetryBudget(perMinute)
+	}
+}
+
+// A RetryBudgetError is returned by an operation that could have been retried,
+// but wasn't, because the client's RetryBudget was spent.
+type RetryBudgetError struct {
+	Err error // The error that was not retried.
+}
+
+func (e *RetryBudgetError) Error() string {
+	return fmt.Sprintf("b2: retry budget exhausted: %v", e.Err)
+}
+
+func (e *RetryBudgetError) Unwrap() error {
+	return e.Err
+}
+
+// RetryBudgetStatus reports how the client stands against its RetryBudget.
+type RetryBudgetStatus struct {
+	// PerMinute is the size of the budget.
+	PerMinute int
+
+	// Available is the number of retries that can be made now.  The budget
+	// is exhausted when it is zero.
+	Available int
+
+	// Refused is the number of retries that the budget has refused.
+	Refused int64
+}
+
+// retryBudget is a token bucket of retries, which starts full.  A nil
+// retryBudget is no budget.
+type retryBudget struct {
+	perMinute int
+
+	mu      sync.Mutex
+	now     func() time.Time
+	tokens  float64
+	last    time.Time
+	refused int64
+}
+
+func newRetryBudget(perMinute int) *retryBudget {
+	if perMinute < 1 {
+		return nil
+	}
+	return &retryBudget{
+		perMinute: perMinute,
+		tokens:    float64(perMinute),
+		now:       time.Now,
+		last:      time.Now(),
+	}
+}
+
+// useClock makes b tell the time by c, and starts it full again.
+func (b *retryBudget) useClock(c Clock) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.now = c.Now
+	b.tokens = float64(b.perMinute)
+	b.last = c.Now()
+}
+
+// refill adds the retries that have accrued since the last call.  It must be
+// called with b.mu held.
+func (b *retryBudget) refill() {
+	t := b.now()
+	b.tokens += t.Sub(b.last).Minutes() * float64(b.perMinute)
+	if max := float64(b.perMinute); b.tokens > max {
+		b.tokens = max
+	}
+	b.last = t
+}
+
+// Spend implements retry.Budget.
+func (b *retryBudget) Spend(err error) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill()
+	if b.tokens < 1 {
+		b.refused++
+		return &RetryBudgetError{Err: err}
+	}
+	b.tokens--
+	return nil
+}
+
+func (b *retryBudget) status() *RetryBudgetStatus {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill()
+	return &RetryBudgetStatus{
+		PerMinute: b.perMinute,
+		Available: int(b.tokens),
+		Refused:   b.refused,
+	}
+}
+
+// interrupted wraps err with what it interrupted, such as "b2_upload_part
+// (part 3)", if it is the error of a context that is done, so that it is clear
+// where an operation stopped.  errors.Is still finds the context's error.
+func interrupted(what string, err error) error {
+	if !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded) {
+		return err
+	}
+	return fmt.Errorf("%s: %w", what, err)
+}
@@ -0,0 +1,94 @@
+// Copyright 2024, the Blazer authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package b2
+
+import "context"
+
+// A Tracer starts the spans in which a client's operations are traced.  It
+// can adapt a tracing library, such as OpenTelemetry, without this package
+// depending on it:
+//
+//	type otelTracer struct{ t trace.Tracer }
+//
+//	func (o otelTracer) Start(ctx context.Context, name string) (context.Context, b2.Span) {
+//	  ctx, s := o.t.Start(ctx, name)
+//	  return ctx, otelSpan{s}
+//	}
+//
+// A client traces each Writer, from NewWriter until Close, in a "b2.Writer"
+// span; each Reader, from NewReader until Close, in a "b2.Reader" span; and
+// each page of a listing in a "b2.ListPage" span.  Each API call, such as
+// "b2_upload_part", made by any of them or by any other method, is traced in
+// a span named for it, which is a child of the span in the context with which
+// it was made.  Spans have the attributes "bucket", "object", "method",
+// "status", "bytes", and "retries", as they apply.
+type Tracer interface {
+	// Start starts a span named name, as a child of the span in ctx, if
+	// there is one, and returns a context that holds the new span.
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// A Span is one operation that a Tracer traces.  It must be safe for
+// concurrent use.
+type Span interface {
+	// SetAttribute annotates the span.  The value is a string, an int, or an
+	// int64.
+	SetAttribute(key string, value interface{})
+
+	// End ends the span.  Err is the error with which the operation failed,
+	// or nil.
+	End(err error)
+}
+
+// WithTracer traces the client's operations with t.
+func WithTracer(t Tracer) ClientOption {
+	return func(c *clientOptions) {
+		c.tracer = t
+	}
+}
+
+type noSpan struct{}
+
+func (noSpan) SetAttribute(string, interface{}) {}
+func (noSpan) End(error)                        {}
+
+type spanKey struct{}
+
+// startSpan starts a span named name with t, if t is not nil, with the given
+// attributes, given as pairs of keys and values.
+func startSpan(ctx context.Context, t Tracer, name string, attrs ...interface{}) (context.Context, Span) {
+	if t == nil {
+		return ctx, noSpan{}
+	}
+	ctx, s := t.Start(ctx, name)
+	for i := 0; i+1 < len(attrs); i += 2 {
+		s.SetAttribute(attrs[i].(string), attrs[i+1])
+	}
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// startSpan starts a span with the client's Tracer.
+func (c *Client) startSpan(ctx context.Context, name string, attrs ...interface{}) (context.Context, Span) {
+	if c == nil {
+		return ctx, noSpan{}
+	}
+	return startSpan(ctx, c.opts.tracer, name, attrs...)
+}
+
+// spanFrom returns the innermost span that the client started in ctx, or nil.
+func spanFrom(ctx context.Context) Span {
+	s, _ := ctx.Value(spanKey{}).(Span)
+	return s
+}
@@ -0,0 +1,126 @@
+// Copyright 2024, the Blazer authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package b2
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// The defaults of a client's own transport.  There are enough idle connections
+// for each host to keep up with 32 concurrent uploads or downloads, so that a
+// Writer or Reader with many doesn't open and close connections as it goes.
+const (
+	defaultMaxIdleConnsPerHost = 32
+	defaultMaxIdleConns        = 128
+	defaultDialTimeout         = 30 * time.Second
+	defaultTLSHandshakeTimeout = 10 * time.Second
+	defaultIdleConnTimeout     = 90 * time.Second
+)
+
+// transportOptions hold the settings of the transport that a client makes
+// when it isn't given one.
+type transportOptions struct {
+	maxIdleConnsPerHost   int
+	dialTimeout           time.Duration
+	tlsHandshakeTimeout   time.Duration
+	responseHeaderTimeout time.Duration
+	proxy                 func(*http.Request) (*url.URL, error)
+	proxySet              bool
+}
+
+// MaxIdleConnsPerHost sets how many idle connections to each host the
+// client's transport keeps for reuse.  The default is 32.  Like the other
+// transport options, it has no effect if the client is given a Transport.
+func MaxIdleConnsPerHost(n int) ClientOption {
+	return func(c *clientOptions) {
+		c.transportOpts.maxIdleConnsPerHost = n
+	}
+}
+
+// DialTimeout limits how long the client's transport waits for a connection
+// to be made.  The default is 30 seconds.
+func DialTimeout(d time.Duration) ClientOption {
+	return func(c *clientOptions) {
+		c.transportOpts.dialTimeout = d
+	}
+}
+
+// TLSHandshakeTimeout limits how long the client's transport waits for a TLS
+// handshake.  The default is 10 seconds.
+func TLSHandshakeTimeout(d time.Duration) ClientOption {
+	return func(c *clientOptions) {
+		c.transportOpts.tlsHandshakeTimeout = d
+	}
+}
+
+// ResponseHeaderTimeout limits how long the client's transport waits for the
+// headers of a response, once a request, including its body, has been sent.
+// By default there is no limit.  Uploaded parts are checked before B2 replies,
+// and so a limit should allow for the time that takes.
+func ResponseHeaderTimeout(d time.Duration) ClientOption {
+	return func(c *clientOptions) {
+		c.transportOpts.responseHeaderTimeout = d
+	}
+}
+
+// Proxy sets the function that chooses the proxy, if any, for each of the
+// client's requests, as http.Transport's Proxy does.  By default the proxy
+// is taken from the environment, with http.ProxyFromEnvironment; a nil f
+// makes requests directly.
+func Proxy(f func(*http.Request) (*url.URL, error)) ClientOption {
+	return func(c *clientOptions) {
+		c.transportOpts.proxy = f
+		c.transportOpts.proxySet = true
+	}
+}
+
+// newTransport returns the transport that a client uses when it isn't given
+// one.
+func (o transportOptions) newTransport() *http.Transport {
+	t := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          defaultMaxIdleConns,
+		MaxIdleConnsPerHost:   defaultMaxIdleConnsPerHost,
+		IdleConnTimeout:       defaultIdleConnTimeout,
+		TLSHandshakeTimeout:   defaultTLSHandshakeTimeout,
+		ResponseHeaderTimeout: o.responseHeaderTimeout,
+		ExpectContinueTimeout: time.Second,
+	}
+	dial := defaultDialTimeout
+	if o.dialTimeout > 0 {
+		dial = o.dialTimeout
+	}
+	t.DialContext = (&net.Dialer{
+		Timeout:   dial,
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+	if o.maxIdleConnsPerHost > 0 {
+		t.MaxIdleConnsPerHost = o.maxIdleConnsPerHost
+		if t.MaxIdleConns < o.maxIdleConnsPerHost {
+			t.MaxIdleConns = o.maxIdleConnsPerHost
+		}
+	}
+	if o.tlsHandshakeTimeout > 0 {
+		t.TLSHandshakeTimeout = o.tlsHandshakeTimeout
+	}
+	if o.proxySet {
+		t.Proxy = o.proxy
+	}
+	return t
+}
@@ -19,15 +19,21 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"mime"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
-
-	"github.com/Backblaze/blazer/internal/blog"
 )
 
 var ErrClosed = errors.New("file already closed")
 
+// ErrAborted is returned by a Writer's methods after Abort has been called.
+var ErrAborted = errors.New("b2: writer aborted")
+
 // Writer writes data into Backblaze.  It automatically switches to the large
 // file API if the file exceeds ChunkSize bytes.  Due to that and other
 // Backblaze API details, there is a large buffer.
@@ -43,27 +49,50 @@ type Writer struct {
 
 	// Resume an upload.  If true, and the upload is a large file, and a file of
 	// the same name was started but not finished, then assume that we are
-	// resuming that file, and don't upload duplicate chunks.
+	// resuming that file, and don't upload duplicate chunks.  Each part
+	// already uploaded is compared with the data written, by size and SHA1,
+	// and uploaded again if it differs.  If several files of the same name
+	// are unfinished, the most recently started is resumed.
 	Resume bool
 
 	// ChunkSize is the size, in bytes, of each individual part, when writing
 	// large files, and also when determining whether to upload a file normally
-	// or when to split it into parts.  The default is 100M (1e8)  The minimum is
-	// 5M (5e6); values less than this are not an error, but will fail.  The
-	// maximum is 5GB (5e9).
+	// or when to split it into parts.  The default is the account's
+	// recommended part size, or 100M (1e8) if B2 did not give one.  Large files
+	// with parts smaller than the account's absolute minimum part size, or
+	// larger than 5GB (5e9), are refused before any part is uploaded.  A large
+	// file may have at most 10,000 parts; see AutoPartSize.
 	ChunkSize int
 
 	// UseFileBuffer controls whether to use an in-memory buffer (the default) or
 	// scratch space on the file system.  If this is true, b2 will save chunks in
-	// FileBufferDir.
+	// FileBufferDir, and remove them on Close.  See also WithFileBuffer.
 	UseFileBuffer bool
 
 	// FileBufferDir specifies the directory where scratch files are kept.  If
 	// blank, os.TempDir() is used.
 	FileBufferDir string
 
-	contentType string
-	info        map[string]string
+	// ProgressFunc, if set, is called as the object is sent to B2 with the
+	// number of bytes written so far and the total size of the object, or -1
+	// if the total is not yet known.  Bytes that must be resent because a
+	// request failed are subtracted before they are sent again, so written can
+	// go down as well as up, but never counts any byte twice.  Calls are never
+	// made concurrently, even when ConcurrentUploads is greater than one.
+	ProgressFunc func(written, total int64)
+
+	contentType    string
+	info           map[string]string
+	detect         bool   // if contentType is empty, detect it from sniff
+	sniff          []byte // up to sniffLen bytes from the start of the object
+	autoPart       bool   // grow csize to fit expected into maxParts parts
+	keepUnfinished bool   // don't cancel the large file on error
+	cancelOthers   bool   // cancel unfinished files that aren't resumed
+	resumeCheck    func([]Part) bool
+	sha1           string // the object's hash, from Attrs.SHA1
+	partSHA1       func(part int, offset, size int64) string
+	verify         bool  // check B2's parts before finishing
+	expected       int64 // the size of the object, if known before it is sent
 
 	csize       int
 	ctx         context.Context
@@ -72,16 +101,21 @@ type Writer struct {
 	errf        func(error)
 	ready       chan chunk
 	cdone       chan struct{}
+	stop        sync.Once // closes cdone
 	wg          sync.WaitGroup
 	start       sync.Once
 	once        sync.Once
 	done        sync.Once
 	file        beLargeFileInterface
-	seen        map[int]string
+	seen        map[int]Part // parts uploaded before resuming
+	umux        sync.Mutex
+	uploaded    map[int]Part // parts uploaded or resumed, for VerifyParts
 	everStarted bool
 	newBuffer   func() (writeBuffer, error)
+	slabs       *slabPool // for memory buffers; released on Close
 
 	closed     bool
+	aborted    bool
 	closeWrite sync.RWMutex
 
 	o    *Object
@@ -94,13 +128,25 @@ type Writer struct {
 	emux sync.RWMutex
 	err  error
 
+	cancelling sync.WaitGroup // the cancellation of the large file on error
+
 	smux sync.RWMutex
 	smap map[int]*meteredReader
+
+	pmux  sync.Mutex // guards sent and total, and serializes ProgressFunc
+	sent  int64
+	total int64
+
+	waiting int32 // parts and buffers waiting on the client's limits
+
+	rate rateMeter
+	span Span // from NewWriter until Close or Abort
 }
 
 type chunk struct {
 	id  int
 	buf writeBuffer
+	sha string // the part's hash, if given by PartSHA1
 }
 
 func (w *Writer) setErr(err error) {
@@ -108,28 +154,64 @@ func (w *Writer) setErr(err error) {
 		return
 	}
 	w.emux.Lock()
-	defer w.emux.Unlock()
 	if w.err != nil {
+		w.emux.Unlock()
 		return
 	}
-	blog.V(1).Infof("error writing %s: %v", w.name, err)
+	w.o.b.c.v(1).Infof("error writing %s: %v", w.name, err)
 	w.err = err
 	w.cancel()
-	if w.ctxf == nil {
+	file := w.file
+	if file == nil || w.keepUnfinished {
+		w.emux.Unlock()
 		return
 	}
-	if w.errf == nil {
-		w.errf = func(error) {}
+	// The large file is cancelled without the lock, which would otherwise
+	// hold up every caller of getErr for as long as it takes, and deadlock an
+	// errf that calls back into the Writer.  Close waits for it.
+	w.cancelling.Add(1)
+	w.emux.Unlock()
+
+	// w.ctx is dead, so the cancellation needs a context of its own.
+	var ctx context.Context
+	if w.ctxf != nil {
+		ctx = w.ctxf()
+	} else {
+		c, cancel := context.WithTimeout(context.Background(), cancelTimeout)
+		defer cancel()
+		ctx = c
+	}
+	cerr := file.cancel(ctx)
+	if cerr == nil {
+		w.o.b.c.dropPartURLs(file.id())
+	}
+	w.cancelling.Done()
+	if w.errf != nil {
+		w.errf(cerr)
+	} else if cerr != nil {
+		w.o.b.c.v(1).Infof("cancel unfinished %s: %v", w.name, cerr)
 	}
-	w.errf(w.file.cancel(w.ctxf()))
 }
 
+// cancelTimeout bounds the b2_cancel_large_file call made when a large file
+// upload fails, unless WithCancelOnError provides a context.
+const cancelTimeout = 10 * time.Second
+
 func (w *Writer) getErr() error {
 	w.emux.RLock()
 	defer w.emux.RUnlock()
 	return w.err
 }
 
+// ctxErr returns the error that ended the upload: the first one recorded,
+// which canceled w.ctx, or else the reason the caller's context is done.
+func (w *Writer) ctxErr() error {
+	if err := w.getErr(); err != nil {
+		return err
+	}
+	return w.ctx.Err()
+}
+
 func (w *Writer) registerChunk(id int, r *meteredReader) {
 	w.smux.Lock()
 	w.smap[id] = r
@@ -142,69 +224,141 @@ func (w *Writer) completeChunk(id int) {
 	w.smux.Unlock()
 }
 
-var gid int32
+// meter returns a meteredReader for buf that reports its progress to
+// ProgressFunc, and is held to the client's UploadRateLimit.
+func (w *Writer) meter(r readResetter, buf writeBuffer) *meteredReader {
+	up, _ := w.o.b.c.throttles()
+	mr := &meteredReader{r: up.throttle(w.ctx, r), size: buf.Len(), rate: &w.rate}
+	if w.counting() {
+		mr.payload = payloadLen(buf)
+		mr.progress = w.progress
+	}
+	return mr
+}
 
-func sleepCtx(ctx context.Context, d time.Duration) error {
-	select {
-	case <-ctx.Done():
-		return ctx.Err()
-	case <-time.After(d):
-		return nil
+// progress adds n to the bytes written and reports them to ProgressFunc.
+func (w *Writer) progress(n int64) {
+	w.pmux.Lock()
+	defer w.pmux.Unlock()
+	w.sent += n
+	if w.ProgressFunc != nil {
+		w.ProgressFunc(w.sent, w.total)
+	}
+}
+
+// counting reports whether the bytes written are counted, for ProgressFunc or
+// for the writer's span.
+func (w *Writer) counting() bool {
+	return w.ProgressFunc != nil || w.o.b.c.opts.tracer != nil
+}
+
+// setTotal records the size of the object, if it is not already known, and
+// reports it to ProgressFunc.
+func (w *Writer) setTotal(n int64) {
+	w.pmux.Lock()
+	defer w.pmux.Unlock()
+	if w.total >= 0 {
+		return
+	}
+	w.total = n
+	if w.ProgressFunc != nil {
+		w.ProgressFunc(w.sent, w.total)
 	}
 }
 
+// payloadLen returns the number of bytes of the object in buf, which for a
+// nonBuffer excludes the hash sent after them.  It doesn't ask buf for its
+// hash, which for a buffer that wasn't hashed as it was written would mean
+// reading all of it.
+func payloadLen(buf writeBuffer) int64 {
+	n := int64(buf.Len())
+	if nb, ok := buf.(*nonBuffer); ok && nb.sha == "" {
+		n -= 40
+	}
+	return n
+}
+
+var gid int32
+
 func (w *Writer) thread() {
 	w.wg.Add(1)
 	go func() {
 		defer w.wg.Done()
 		id := atomic.AddInt32(&gid, 1)
-		fc, err := w.file.getUploadPartURL(w.ctx)
-		if err != nil {
-			w.setErr(err)
-			return
+		transfers, _ := w.o.b.c.limits()
+		pool := w.o.b.c.partURLs(w.file.id())
+		fc, ok := pool.get().(beFileChunkInterface)
+		if !ok {
+			f, err := w.file.getUploadPartURL(w.ctx)
+			if err != nil {
+				w.setErr(err)
+				return
+			}
+			fc = f
 		}
+		var uerr error
+		defer func() {
+			if w.reusable(uerr) {
+				pool.put(fc)
+			}
+		}()
 		for {
 			var cnk chunk
 			select {
 			case cnk = <-w.ready:
 			case <-w.cdone:
 				return
+			case <-w.ctx.Done():
+				return
 			}
-			if sha, ok := w.seen[cnk.id]; ok {
-				if sha != cnk.buf.Hash() {
-					w.setErr(errors.New("resumable upload was requested, but chunks don't match"))
+			if p, ok := w.seen[cnk.id]; ok {
+				same, err := w.resumable(p, cnk.buf)
+				if err != nil {
+					w.setErr(err)
 					return
 				}
+				if same {
+					w.recordPart(p)
+					w.progress(payloadLen(cnk.buf))
+					cnk.buf.Close()
+					w.completeChunk(cnk.id)
+					w.o.b.c.v(2).Infof("skipping chunk %d", cnk.id)
+					continue
+				}
+				w.o.b.c.v(1).Infof("b2 writer: part %d of unfinished %s doesn't match; uploading it again", cnk.id, w.name)
+			}
+			w.o.b.c.v(2).Infof("thread %d handling chunk %d", id, cnk.id)
+			if err := w.acquire(transfers, 1); err != nil {
+				w.setErr(interrupted(fmt.Sprintf("b2: writing %s part %d", w.name, cnk.id), err))
 				cnk.buf.Close()
-				w.completeChunk(cnk.id)
-				blog.V(2).Infof("skipping chunk %d", cnk.id)
-				continue
+				return
 			}
-			blog.V(2).Infof("thread %d handling chunk %d", id, cnk.id)
 			r, err := cnk.buf.Reader()
 			if err != nil {
+				transfers.release(1)
 				w.setErr(err)
 				return
 			}
-			mr := &meteredReader{r: r, size: cnk.buf.Len()}
+			mr := w.meter(r, cnk.buf)
 			w.registerChunk(cnk.id, mr)
-			sleep := time.Millisecond * 15
+			rt := uploadRetrier(w.o.b.r, "b2_upload_part")
+			actx := countAttempts(w.ctx)
 		redo:
-			n, err := fc.uploadPart(w.ctx, mr, cnk.buf.Hash(), cnk.buf.Len(), cnk.id)
+			n, err := fc.uploadPart(actx, mr, cnk.buf.Hash(), cnk.buf.Len(), cnk.id)
+			uerr = err
 			if n != cnk.buf.Len() || err != nil {
-				if w.o.b.r.reupload(err) {
-					if err := sleepCtx(w.ctx, sleep); err != nil {
-						w.setErr(err)
+				if rt.Retry(err) {
+					if err := rt.Wait(w.ctx, err); err != nil {
+						transfers.release(1)
+						w.setErr(interrupted(fmt.Sprintf("b2: writing %s part %d", w.name, cnk.id), err))
 						w.completeChunk(cnk.id)
 						cnk.buf.Close() // TODO: log error
+						return
 					}
-					sleep *= 2
-					if sleep > time.Second*15 {
-						sleep = time.Second * 15
-					}
-					blog.V(1).Infof("b2 writer: wrote %d of %d: error: %v; retrying", n, cnk.buf.Len(), err)
+					w.o.b.c.v(2).Infof("b2 writer: wrote %d of %d: error: %v; retrying", n, cnk.buf.Len(), err)
 					f, err := w.file.getUploadPartURL(w.ctx)
 					if err != nil {
+						transfers.release(1)
 						w.setErr(err)
 						w.completeChunk(cnk.id)
 						cnk.buf.Close() // TODO: log error
@@ -213,14 +367,20 @@ func (w *Writer) thread() {
 					fc = f
 					goto redo
 				}
-				w.setErr(err)
+				transfers.release(1)
+				if cnk.sha != "" && w.o.b.r.hashMismatch(err) {
+					err = &HashMismatchError{Name: w.name, Part: cnk.id, SHA1: cnk.sha, err: err}
+				}
+				w.setErr(interrupted(fmt.Sprintf("b2: writing %s part %d", w.name, cnk.id), err))
 				w.completeChunk(cnk.id)
 				cnk.buf.Close() // TODO: log error
 				return
 			}
+			transfers.release(1)
+			w.recordPart(Part{Number: cnk.id, Size: payloadLen(cnk.buf), SHA1: sentSHA1(cnk.buf)})
 			w.completeChunk(cnk.id)
 			cnk.buf.Close() // TODO: log error
-			blog.V(2).Infof("chunk %d handled", cnk.id)
+			w.o.b.c.v(2).Infof("chunk %d handled", cnk.id)
 		}
 	}()
 }
@@ -228,18 +388,41 @@ func (w *Writer) thread() {
 func (w *Writer) init() {
 	w.start.Do(func() {
 		w.everStarted = true
+		w.total = -1
 		w.smux.Lock()
 		w.smap = make(map[int]*meteredReader)
 		w.smux.Unlock()
 		w.o.b.c.addWriter(w)
 		w.csize = w.ChunkSize
 		if w.csize == 0 {
+			w.csize = w.o.b.c.backend.accountInfo().RecommendedPartSize
+		}
+		if w.csize < 1 {
 			w.csize = 1e8
 		}
+		if w.autoPart && w.expected > int64(w.csize)*maxParts {
+			w.csize = int((w.expected + maxParts - 1) / maxParts)
+		}
 		if w.newBuffer == nil {
-			w.newBuffer = func() (writeBuffer, error) { return newMemoryBuffer(), nil }
+			// Don't hash what will probably be given.
+			given := w.sha1 != "" || w.partSHA1 != nil
 			if w.UseFileBuffer {
-				w.newBuffer = func() (writeBuffer, error) { return newFileBuffer(w.FileBufferDir) }
+				w.newBuffer = func() (writeBuffer, error) {
+					fb, err := newFileBuffer(w.FileBufferDir)
+					if err == nil && given {
+						fb.unhashed()
+					}
+					return fb, err
+				}
+			} else {
+				w.slabs = w.o.b.c.bufs.acquire(w.csize)
+				w.newBuffer = func() (writeBuffer, error) {
+					mb := newMemoryBuffer(w.slabs)
+					if given {
+						mb.unhashed()
+					}
+					return mb, nil
+				}
 			}
 		}
 		v, err := w.newBuffer()
@@ -248,24 +431,62 @@ func (w *Writer) init() {
 			return
 		}
 		w.w = v
+		if err := w.o.b.restricted(w.name); err != nil {
+			w.setEarlyErr(err)
+		}
+		if !w.o.b.c.opts.skipValidation {
+			// Fail before the first chunk is buffered, rather than after.
+			if err := validateUpload(w.name, w.info); err != nil {
+				w.setEarlyErr(err)
+			}
+		}
 	})
 }
 
+// closedErr returns the error for a call made after Close: the error that
+// ended the upload, if there was one, or ErrClosed.
+func (w *Writer) closedErr() error {
+	if err := w.getErr(); err != nil {
+		return err
+	}
+	return ErrClosed
+}
+
 // Write satisfies the io.Writer interface.
 func (w *Writer) Write(p []byte) (int, error) {
 	w.closeWrite.RLock()
 	defer w.closeWrite.RUnlock()
+	if w.aborted {
+		return 0, ErrAborted
+	}
 	if w.closed {
-		return 0, ErrClosed
+		return 0, w.closedErr()
 	}
 	if len(p) == 0 {
 		return 0, nil
 	}
 	w.init()
+	return w.write(p)
+}
+
+// write is Write without the locking, which must not be taken twice: a
+// pending Close would block the second RLock, and so itself.
+func (w *Writer) write(p []byte) (int, error) {
 	if err := w.getErr(); err != nil {
 		return 0, err
 	}
+	if w.detect && len(w.sniff) < sniffLen {
+		n := sniffLen - len(w.sniff)
+		if n > len(p) {
+			n = len(p)
+		}
+		w.sniff = append(w.sniff, p[:n]...)
+	}
 	left := w.csize - w.w.Len()
+	if err := w.reserve(w.w.Len() + len(p)); err != nil {
+		w.setErr(err)
+		return 0, err
+	}
 	if len(p) < left {
 		return w.w.Write(p)
 	}
@@ -278,47 +499,123 @@ func (w *Writer) Write(p []byte) (int, error) {
 		w.setErr(err)
 		return i, w.getErr()
 	}
-	k, err := w.Write(p[left:])
+	k, err := w.write(p[left:])
 	if err != nil {
 		w.setErr(err)
 	}
 	return i + k, err
 }
 
+// acquire takes n from sem, one of the client's limits, counting the writer
+// as waiting until it has.
+func (w *Writer) acquire(sem *semaphore, n int64) error {
+	if sem == nil {
+		return nil
+	}
+	atomic.AddInt32(&w.waiting, 1)
+	defer atomic.AddInt32(&w.waiting, -1)
+	return sem.acquire(w.ctx, n)
+}
+
+// reserve takes room from the client's MaxBufferedBytes for the current
+// buffer to hold n bytes: as much as a small buffer holds at first, and a
+// whole chunk once it takes a slab.
+func (w *Writer) reserve(n int) error {
+	_, sem := w.o.b.c.limits()
+	mb, ok := w.w.(*memoryBuffer)
+	if sem == nil || !ok {
+		return nil
+	}
+	need := int64(w.csize)
+	if n <= smallBuffer && need > smallBuffer {
+		need = smallBuffer
+	}
+	need = sem.clamp(need)
+	have := mb.reserved()
+	if need <= have {
+		return nil
+	}
+	if err := w.acquire(sem, need-have); err != nil {
+		return err
+	}
+	mb.hold(sem, need-have)
+	return nil
+}
+
 func (w *Writer) getUploadURL(ctx context.Context) (beURLInterface, error) {
-	u := w.o.b.urlPool.get()
-	if u == nil {
-		return w.o.b.b.getUploadURL(w.ctx)
+	if u, ok := w.o.b.urlPool.get().(beURLInterface); ok {
+		return u, nil
 	}
+	return w.o.b.b.getUploadURL(w.ctx)
+}
 
-	return u, nil
+// reusable reports whether an upload URL, or part upload URL, whose last
+// upload failed with err, or succeeded if err is nil, can be used again.  B2
+// asks for a new URL after some failures, and after a failure it didn't
+// reply to, or one the writer gave up on, the URL may still be in use.
+func (w *Writer) reusable(err error) bool {
+	if err == nil {
+		return true
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	return !w.o.b.r.reupload(err) && !w.o.b.r.transient(err)
 }
 
 func (w *Writer) simpleWriteFile() error {
+	if err := w.getErr(); err != nil {
+		return err
+	}
+	transfers, _ := w.o.b.c.limits()
+	if err := w.acquire(transfers, 1); err != nil {
+		return err
+	}
+	defer transfers.release(1)
 	ue, err := w.getUploadURL(w.ctx)
 	if err != nil {
 		return err
 	}
 	// This defer needs to be in a func() so that we put whatever the value of ue
-	// is at function exit.
-	defer func() { w.o.b.urlPool.put(ue) }()
-	sha1 := w.w.Hash()
-	ctype := w.contentType
-	if ctype == "" {
-		ctype = "application/octet-stream"
-	}
-	r, err := w.w.Reader()
+	// is at function exit, if its last upload allows.
+	var uerr error
+	defer func() {
+		if w.reusable(uerr) {
+			w.o.b.urlPool.put(ue)
+		}
+	}()
+	buf := w.w
+	given, part := w.sha1, 0
+	if given == "" && w.partSHA1 != nil {
+		given, part = w.partSHA1(1, 0, payloadLen(buf)), 1
+	}
+	if given != "" {
+		buf = withSHA1(buf, given)
+	}
+	sha1 := buf.Hash()
+	ctype := w.ctype()
+	r, err := buf.Reader()
 	if err != nil {
 		return err
 	}
-	mr := &meteredReader{r: r, size: w.w.Len()}
+	w.setTotal(payloadLen(buf))
+	mr := w.meter(r, buf)
 	w.registerChunk(1, mr)
 	defer w.completeChunk(1)
+	rt := uploadRetrier(w.o.b.r, "b2_upload_file")
+	actx := countAttempts(w.ctx)
 redo:
-	f, err := ue.uploadFile(w.ctx, mr, int(w.w.Len()), w.name, ctype, sha1, w.info)
+	f, err := ue.uploadFile(actx, mr, int(buf.Len()), w.name, ctype, sha1, w.info)
+	uerr = err
 	if err != nil {
-		if w.o.b.r.reupload(err) {
-			blog.V(2).Infof("b2 writer: %v; retrying", err)
+		if given != "" && w.o.b.r.hashMismatch(err) {
+			return &HashMismatchError{Name: w.name, Part: part, SHA1: given, err: err}
+		}
+		if rt.Retry(err) {
+			if err := rt.Wait(w.ctx, err); err != nil {
+				return interrupted("b2: writing "+w.name, err)
+			}
+			w.o.b.c.v(2).Infof("b2 writer: %v; retrying", err)
 			u, err := w.o.b.b.getUploadURL(w.ctx)
 			if err != nil {
 				return err
@@ -329,62 +626,255 @@ redo:
 		return err
 	}
 	w.o.f = f
+	w.o.attrs = nil
+	return nil
+}
+
+// sniffLen is the most data http.DetectContentType considers.
+const sniffLen = 512
+
+// ctype returns the content type to upload with.
+func (w *Writer) ctype() string {
+	if w.contentType != "" {
+		return w.contentType
+	}
+	if w.detect {
+		return detectContentType(w.name, w.sniff)
+	}
+	return "application/octet-stream"
+}
+
+// detectContentType guesses the content type from the first bytes of the
+// object, falling back to the extension of its name when those are
+// inconclusive.  The sniffer recognizes few text formats, so a plain text
+// result also defers to the extension; otherwise CSS, JavaScript, and JSON
+// would all be served as text/plain.
+func detectContentType(name string, data []byte) string {
+	ct := "application/octet-stream"
+	if len(data) > 0 {
+		ct = http.DetectContentType(data)
+	}
+	if ct != "application/octet-stream" && !strings.HasPrefix(ct, "text/plain") {
+		return ct
+	}
+	if ext := mime.TypeByExtension(path.Ext(name)); ext != "" {
+		return ext
+	}
+	return ct
+}
+
+// B2's limits on the parts of a large file.
+const (
+	maxParts    = 10000
+	maxPartSize = 5e9
+)
+
+// checkPartSize reports whether the object can be uploaded as a large file in
+// parts of w.csize bytes.
+func (w *Writer) checkPartSize() error {
+	if min := w.o.b.c.backend.accountInfo().AbsoluteMinimumPartSize; w.csize < min {
+		return fmt.Errorf("b2: %s: ChunkSize %d is smaller than the minimum part size of %d", w.name, w.csize, min)
+	}
+	if w.csize > maxPartSize {
+		return fmt.Errorf("b2: %s: ChunkSize %d is larger than the maximum part size of %d", w.name, w.csize, int64(maxPartSize))
+	}
+	if w.expected > int64(w.csize)*maxParts {
+		return fmt.Errorf("b2: %s: %d bytes would need more than %d parts of %d bytes; use a larger ChunkSize or AutoPartSize", w.name, w.expected, maxParts, w.csize)
+	}
 	return nil
 }
 
 func (w *Writer) getLargeFile() (beLargeFileInterface, error) {
+	if err := w.getErr(); err != nil {
+		return nil, err
+	}
+	if err := w.checkPartSize(); err != nil {
+		return nil, err
+	}
 	if !w.Resume {
-		ctype := w.contentType
-		if ctype == "" {
-			ctype = "application/octet-stream"
-		}
-		return w.o.b.b.startLargeFile(w.ctx, w.name, ctype, w.info)
+		return w.o.b.b.startLargeFile(w.ctx, w.name, w.ctype(), w.info)
 	}
-	var got bool
+	var files []beFileInterface
 	iter := w.o.b.List(w.ctx, ListPrefix(w.name), ListUnfinished())
-	var fi beFileInterface
 	for iter.Next() {
 		obj := iter.Object()
 		if obj.Name() == w.name {
-			got = true
-			fi = obj.f
+			files = append(files, obj.f)
 		}
 	}
 	if iter.Err() != nil {
 		return nil, iter.Err()
 	}
-	if !got {
+	if len(files) == 0 {
 		w.Resume = false
 		return w.getLargeFile()
 	}
+	// Resume the most recently started file.
+	sort.SliceStable(files, func(i, j int) bool { return files[i].timestamp().After(files[j].timestamp()) })
+	fi := files[0]
+	if w.cancelOthers {
+		for _, f := range files[1:] {
+			if err := f.compileParts(0, nil).cancel(w.ctx); err != nil {
+				return nil, err
+			}
+		}
+	}
 
 	next := 1
 	seen := make(map[int]string)
+	var parts []Part
 	var size int64
 	for {
-		parts, n, err := fi.listParts(w.ctx, next, 100)
+		ps, n, err := fi.listParts(w.ctx, next, 100)
 		if err != nil {
 			return nil, err
 		}
 		next = n
-		for _, p := range parts {
+		for _, p := range ps {
 			seen[p.number()] = p.sha1()
+			parts = append(parts, Part{Number: p.number(), Size: p.size(), SHA1: p.sha1()})
 			size += p.size()
 		}
-		if len(parts) == 0 {
+		if len(ps) == 0 {
 			break
 		}
 		if next == 0 {
 			break
 		}
 	}
-	w.seen = make(map[int]string) // copy the map
-	for id, sha := range seen {
-		w.seen[id] = sha
+	if w.resumeCheck != nil && !w.resumeCheck(parts) {
+		if err := fi.compileParts(0, nil).cancel(w.ctx); err != nil {
+			return nil, err
+		}
+		w.Resume = false
+		return w.getLargeFile()
+	}
+	w.seen = make(map[int]Part, len(parts))
+	for _, p := range parts {
+		w.seen[p.Number] = p
 	}
 	return fi.compileParts(size, seen), nil
 }
 
+// recordPart notes that p is in the large file, for VerifyParts.
+func (w *Writer) recordPart(p Part) {
+	if !w.verify {
+		return
+	}
+	w.umux.Lock()
+	defer w.umux.Unlock()
+	if w.uploaded == nil {
+		w.uploaded = make(map[int]Part)
+	}
+	w.uploaded[p.Number] = p
+}
+
+// sentSHA1 returns the hash of a part that has been sent.
+func sentSHA1(buf writeBuffer) string {
+	if nb, ok := buf.(*nonBuffer); ok {
+		return nb.sentSHA1()
+	}
+	return buf.Hash()
+}
+
+// verifyParts lists the parts B2 has for the large file, and compares them
+// with parts 1 through last as they were uploaded.
+func (w *Writer) verifyParts(last int) error {
+	have := make(map[int]Part)
+	next := 1
+	for {
+		ps, n, err := w.file.listParts(w.ctx, next, 1000)
+		if err != nil {
+			return err
+		}
+		for _, p := range ps {
+			have[p.number()] = Part{Number: p.number(), Size: p.size(), SHA1: p.sha1()}
+		}
+		if len(ps) == 0 || n == 0 {
+			break
+		}
+		next = n
+	}
+	w.umux.Lock()
+	defer w.umux.Unlock()
+	perr := &PartsError{Name: w.name}
+	for i := 1; i <= last; i++ {
+		want, ok := w.uploaded[i]
+		if !ok {
+			// Never sent; B2 can't have it either.
+			perr.Missing = append(perr.Missing, i)
+			perr.details = append(perr.details, fmt.Sprintf("part %d was not uploaded", i))
+			continue
+		}
+		got, ok := have[i]
+		if !ok {
+			perr.Missing = append(perr.Missing, i)
+			perr.details = append(perr.details, fmt.Sprintf("part %d (%d bytes, SHA1 %s) is missing", i, want.Size, want.SHA1))
+			continue
+		}
+		if got.Size != want.Size || got.SHA1 != want.SHA1 {
+			perr.Mismatched = append(perr.Mismatched, i)
+			perr.details = append(perr.details, fmt.Sprintf("part %d has %d bytes with SHA1 %s, but %d bytes with SHA1 %s were uploaded", i, got.Size, got.SHA1, want.Size, want.SHA1))
+		}
+	}
+	var extra []int
+	for i := range have {
+		if i > last {
+			extra = append(extra, i)
+		}
+	}
+	sort.Ints(extra)
+	for _, i := range extra {
+		perr.Extra = append(perr.Extra, i)
+		perr.details = append(perr.details, fmt.Sprintf("part %d is beyond the last part, %d", i, last))
+	}
+	if len(perr.details) == 0 {
+		return nil
+	}
+	return perr
+}
+
+// A PartsError reports that the parts B2 has for a large file differ from
+// those the Writer uploaded, as found by VerifyParts.  The large file is left
+// unfinished, so that it can be resumed.
+type PartsError struct {
+	Name       string // The object being written.
+	Missing    []int  // Parts that B2 does not have.
+	Mismatched []int  // Parts whose size or SHA1 hash differ.
+	Extra      []int  // Parts B2 has beyond the end of the object.
+
+	details []string
+}
+
+func (e *PartsError) Error() string {
+	return fmt.Sprintf("b2: large file %s can't be finished: %s", e.Name, strings.Join(e.details, "; "))
+}
+
+// A Part is a part of an unfinished large file, as found by Resume.
+type Part struct {
+	Number int    // The part number, starting from 1.
+	Size   int64  // The size of the part, in bytes.
+	SHA1   string // The SHA1 hash of the part, as B2 computed it.
+}
+
+// resumable reports whether a part that was uploaded before the writer
+// resumed holds the same data as buf.
+func (w *Writer) resumable(p Part, buf writeBuffer) (bool, error) {
+	if p.Size != payloadLen(buf) {
+		return false, nil
+	}
+	sha := buf.Hash()
+	if nb, ok := buf.(*nonBuffer); ok && sha == "hex_digits_at_end" {
+		// The hash is otherwise only known once the part has been sent.
+		s, err := nb.sha1()
+		if err != nil {
+			return false, err
+		}
+		sha = s
+	}
+	return sha == p.SHA1, nil
+}
+
 func (w *Writer) sendChunk() error {
 	var err error
 	w.once.Do(func() {
@@ -409,16 +899,23 @@ func (w *Writer) sendChunk() error {
 
 	var cidx = -1
 	var ww writeBuffer = nil
-	w.emux.RLock()
-	defer w.emux.RUnlock()
-	if w.ctx.Err() == nil {
-		// Only claim the read lock if we need it
-		w.wmux.RLock()
-		cidx = w.cidx + 1
-		ww = w.w
-		w.wmux.RUnlock()
-	} else {
-		return w.ctx.Err()
+	if err := w.ctxErr(); err != nil {
+		return err
+	}
+	// Only claim the read lock if we need it
+	w.wmux.RLock()
+	cidx = w.cidx + 1
+	ww = w.w
+	w.wmux.RUnlock()
+	if cidx > maxParts {
+		return fmt.Errorf("b2: %s: more than %d parts of %d bytes; use a larger ChunkSize, or AutoPartSize with an io.Seeker passed to ReadFrom", w.name, maxParts, w.csize)
+	}
+	var sha string
+	if w.partSHA1 != nil {
+		sha = w.partSHA1(cidx, int64(cidx-1)*int64(w.csize), payloadLen(ww))
+	}
+	if sha != "" {
+		ww = withSHA1(ww, sha)
 	}
 	select {
 	case <-w.cdone:
@@ -426,9 +923,10 @@ func (w *Writer) sendChunk() error {
 	case w.ready <- chunk{
 		id:  cidx,
 		buf: ww,
+		sha: sha,
 	}:
 	case <-w.ctx.Done():
-		return w.ctx.Err()
+		return w.ctxErr()
 	}
 	w.wmux.Lock()
 	defer w.wmux.Unlock()
@@ -451,14 +949,27 @@ func (w *Writer) sendChunk() error {
 //
 // Note that io.Copy will automatically choose to use ReadFrom.
 //
-// ReadFrom currently doesn't handle w.Resume; if w.Resume is true, ReadFrom
-// will act as if r is not an io.Seeker.
+// If w.Resume is true and r is an io.Seeker, each part already uploaded is
+// checked against the corresponding range of r, and uploaded again if it
+// differs.
 func (w *Writer) ReadFrom(r io.Reader) (int64, error) {
+	w.closeWrite.RLock()
+	closed := w.closed
+	w.closeWrite.RUnlock()
+	if closed {
+		return 0, w.closedErr()
+	}
 	rs, ok := r.(io.ReadSeeker)
-	if !ok || w.Resume {
-		return copyContext(w.ctx, w, r)
+	if !ok {
+		n, err := copyContext(w.ctx, w, r)
+		if err != nil && w.ctx.Err() != nil {
+			// w.ctx may have been canceled by the error that ended the
+			// upload, which is the one to report.
+			err = w.ctxErr()
+		}
+		return n, err
 	}
-	blog.V(2).Info("streaming without buffer")
+	w.o.b.c.v(2).Info("streaming without buffer")
 	size, err := rs.Seek(0, io.SeekEnd)
 	if err != nil {
 		return 0, err
@@ -469,6 +980,23 @@ func (w *Writer) ReadFrom(r io.Reader) (int64, error) {
 	} else {
 		ra = enReaderAt(rs)
 	}
+	return w.readFromAt(ra, size)
+}
+
+// readFromAt sends the first size bytes of ra in parts that are each read
+// from ra by the thread uploading them, so that parts are read concurrently
+// and a retried part reads its range again instead of being held in memory.
+func (w *Writer) readFromAt(ra io.ReaderAt, size int64) (int64, error) {
+	if w.detect {
+		buf := make([]byte, sniffLen)
+		n, _ := ra.ReadAt(buf, 0)
+		w.sniff = buf[:n]
+	}
+	w.expected = size
+	if size == 0 {
+		// Close sends an empty file.
+		return 0, nil
+	}
 	var offset int64
 	var wrote int64
 	w.newBuffer = func() (writeBuffer, error) {
@@ -476,8 +1004,8 @@ func (w *Writer) ReadFrom(r io.Reader) (int64, error) {
 		if left <= 0 {
 			// We're done sending real chunks; send empty chunks from now on so that
 			// Close() works.
-			w.newBuffer = func() (writeBuffer, error) { return newMemoryBuffer(), nil }
-			w.w = newMemoryBuffer()
+			w.newBuffer = func() (writeBuffer, error) { return newMemoryBuffer(nil), nil }
+			w.w = newMemoryBuffer(nil)
 			return nil, io.EOF
 		}
 		csize := int64(w.csize)
@@ -490,6 +1018,7 @@ func (w *Writer) ReadFrom(r io.Reader) (int64, error) {
 		return nb, nil
 	}
 	w.init()
+	w.setTotal(size)
 	if size < int64(w.csize) {
 		// the magic happens on w.Close()
 		return size, nil
@@ -504,15 +1033,70 @@ func (w *Writer) ReadFrom(r io.Reader) (int64, error) {
 	}
 }
 
+// defaultWriteFromUploads is the number of parts WriteFrom uploads at once
+// unless told otherwise.
+const defaultWriteFromUploads = 4
+
+// WriteFrom writes the first size bytes of ra to the object, as a Writer
+// would, and closes it.  Parts are read from ra by the threads uploading them,
+// so that a slow source doesn't leave them idle, and a part that must be sent
+// again is read again rather than kept in memory.  Unless
+// WithConcurrentUploads says otherwise, four parts are uploaded at once.
+//
+// Once WriteFrom returns successfully, o.Attrs reports the new version's
+// attributes without another request, as after Writer.Close.
+func (o *Object) WriteFrom(ctx context.Context, ra io.ReaderAt, size int64, opts ...WriterOption) error {
+	if size < 0 {
+		return fmt.Errorf("b2: WriteFrom %s: negative size %d", o.name, size)
+	}
+	w := o.NewWriter(ctx, opts...)
+	if w.ConcurrentUploads == 0 {
+		w.ConcurrentUploads = defaultWriteFromUploads
+	}
+	if _, err := w.readFromAt(ra, size); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
 // Close satisfies the io.Closer interface.  It is critical to check the return
 // value of Close for all writers.
+//
+// Once Close has returned successfully, the Object's Attrs method reports the
+// new version's ID, size, SHA1 hash, and upload time from B2's response to the
+// upload, without another request.  B2 does not know the hash of a large file
+// as a whole, so large files report a SHA1 of "none" unless one was given with
+// WithAttrsOption.
+//
+// Close may be called more than once, and from several goroutines; every call
+// returns the result of the first.  If the upload has already failed, Close
+// cancels the parts in flight, rather than waiting for them to finish, and
+// returns the error.  Write and ReadFrom return the same error
+// afterward, or ErrClosed if Close succeeded.
 func (w *Writer) Close() error {
 	w.done.Do(func() {
+		defer w.end()
 		w.closeWrite.Lock()
 		defer w.closeWrite.Unlock()
+		// Whatever happens, nothing more may be written.
+		w.closed = true
+		defer func() {
+			if w.slabs != nil {
+				w.o.b.c.bufs.release(w.slabs)
+			}
+		}()
+		defer func() {
+			if w.getErr() == nil {
+				w.o.b.c.consistency().wrote(w.o)
+			}
+		}()
 		if !w.everStarted {
 			w.init()
 			w.setErr(w.simpleWriteFile())
+			if w.w != nil {
+				w.w.Close()
+			}
 			return
 		}
 		defer w.o.b.c.removeWriter(w)
@@ -521,59 +1105,191 @@ func (w *Writer) Close() error {
 			defer w.wmux.Unlock()
 			if err := w.w.Close(); err != nil {
 				// this is non-fatal, but alarming
-				blog.V(1).Infof("close %s: %v", w.name, err)
+				w.o.b.c.v(1).Infof("close %s: %v", w.name, err)
 			}
 		}()
 		// We need the lock to dereference w.cidx and w.w.Len()
 		w.wmux.RLock()
 		// Don't defer the RUnlock, since we don't want to be RLocked when we call sendChunk
+		if err := w.getErr(); err != nil {
+			// The upload has already failed; don't wait for anything.
+			w.wmux.RUnlock()
+			w.cancel()
+			w.stopThreads()
+			return
+		}
 		if w.cidx == 0 {
 			w.wmux.RUnlock()
 			w.setErr(w.simpleWriteFile())
 			return
 		}
+		w.setTotal(int64(w.cidx)*int64(w.csize) + payloadLen(w.w))
 		if w.w.Len() > 0 {
 			w.wmux.RUnlock()
 			if err := w.sendChunk(); err != nil {
 				w.setErr(err)
+				w.stopThreads()
 				return
 			}
 			// Get the lock back, so all code paths have it
 			w.wmux.RLock()
 		}
 		defer w.wmux.RUnlock()
-		// See https://github.com/Backblaze/blazer/issues/60 for why we use a special
-		// channel for this.
-		close(w.cdone)
-		w.wg.Wait()
+		w.stopThreads()
 		err := w.ctx.Err()
+		for id := range w.seen {
+			if id > w.cidx && err == nil {
+				// B2 would refuse to finish the file anyway.
+				err = fmt.Errorf("b2: resumed %s has part %d, but the data written ends at part %d", w.name, id, w.cidx)
+			}
+		}
+		if err == nil && w.verify {
+			if err = w.verifyParts(w.cidx); err != nil {
+				// Leave the large file for Resume.
+				w.keepUnfinished = true
+			}
+		}
 		var f beFileInterface = nil
 		if err == nil {
 			f, err = w.file.finishLargeFile(w.ctx)
+			if err == nil {
+				w.o.b.c.dropPartURLs(w.file.id())
+			}
 		}
 		if err != nil {
 			w.setErr(err)
 			return
 		}
 		w.o.f = f
-		w.closed = true
+		w.o.attrs = nil
 	})
+	w.cancelling.Wait()
 	return w.getErr()
 }
 
+// Abort abandons the upload.  It stops any parts being uploaded, cancels the
+// large file with b2_cancel_large_file if one was started, and frees the
+// writer's buffers.  Nothing is written to the object.  Afterward, Write and
+// Close return ErrAborted, and Close does not attempt to finish the upload.
+//
+// Abort returns the error, if any, from cancelling the large file, or
+// ErrClosed if the writer has already been closed.
+func (w *Writer) Abort(ctx context.Context) error {
+	err := ErrClosed
+	w.done.Do(func() {
+		err = nil
+		defer w.end()
+		// Cancel first, so that a Write waiting on a part gives up the
+		// closeWrite lock.
+		w.emux.Lock()
+		w.err = ErrAborted
+		w.cancel()
+		w.emux.Unlock()
+
+		w.closeWrite.Lock()
+		defer w.closeWrite.Unlock()
+		w.closed = true
+		w.aborted = true
+		if !w.everStarted {
+			return
+		}
+		defer w.o.b.c.removeWriter(w)
+		defer func() {
+			if w.slabs != nil {
+				w.o.b.c.bufs.release(w.slabs)
+			}
+		}()
+		w.stopThreads()
+		w.wmux.Lock()
+		if w.w != nil {
+			w.w.Close()
+		}
+		w.wmux.Unlock()
+		if w.file != nil {
+			if err = w.file.cancel(ctx); err == nil {
+				w.o.b.c.dropPartURLs(w.file.id())
+			}
+		}
+	})
+	return err
+}
+
+// end ends the writer's span, with the bytes sent and its error, and counts
+// it out of the operations in flight.
+func (w *Writer) end() {
+	if w.span == nil {
+		// It wasn't made by NewWriter.
+		return
+	}
+	w.o.b.c.inc("b2_operations_in_flight", -1, "op", "write")
+	w.pmux.Lock()
+	w.span.SetAttribute("bytes", w.sent)
+	w.pmux.Unlock()
+	w.span.End(w.getErr())
+}
+
+// stopThreads waits for the upload threads to finish their chunks, if they
+// were started, and to release their buffers.
+func (w *Writer) stopThreads() {
+	if w.cdone == nil {
+		return
+	}
+	// See https://github.com/Backblaze/blazer/issues/60 for why we use a special
+	// channel for this.
+	w.stop.Do(func() { close(w.cdone) })
+	w.wg.Wait()
+}
+
 func (w *Writer) withAttrs(attrs *Attrs) *Writer {
 	w.contentType = attrs.ContentType
-	w.info = make(map[string]string)
-	for k, v := range attrs.Info {
-		w.info[k] = v
+	w.sha1 = attrs.SHA1
+	info, err := attrs.rawInfo()
+	if err != nil {
+		w.setEarlyErr(err)
+	}
+	w.info = info
+	return w
+}
+
+// setEarlyErr records an error found before anything has been started, and so
+// there is nothing to cancel.  It is returned by the first Write or by Close.
+func (w *Writer) setEarlyErr(err error) {
+	w.emux.Lock()
+	defer w.emux.Unlock()
+	if w.err == nil {
+		w.err = err
 	}
-	if len(w.info) < 10 && attrs.SHA1 != "" {
-		w.info["large_file_sha1"] = attrs.SHA1
+}
+
+// rawInfo returns the file info map that B2 should store for the given
+// attributes.
+func (a *Attrs) rawInfo() (map[string]string, error) {
+	info := make(map[string]string)
+	for k, v := range a.Info {
+		info[k] = v
 	}
-	if len(w.info) < 10 && !attrs.LastModified.IsZero() {
-		w.info["src_last_modified_millis"] = fmt.Sprintf("%d", attrs.LastModified.UnixNano()/1e6)
+	for _, h := range headerInfo {
+		v := *h.field(a)
+		if v == "" {
+			continue
+		}
+		for k, iv := range a.Info {
+			if strings.EqualFold(k, h.key) && iv != v {
+				return nil, fmt.Errorf("b2: Attrs.%s is %q, but Info[%q] is %q", h.name, v, k, iv)
+			}
+			if strings.EqualFold(k, h.key) {
+				delete(info, k)
+			}
+		}
+		info[h.key] = v
 	}
-	return w
+	if len(info) < 10 && a.SHA1 != "" {
+		info["large_file_sha1"] = a.SHA1
+	}
+	if len(info) < 10 && !a.LastModified.IsZero() {
+		info["src_last_modified_millis"] = fmt.Sprintf("%d", a.LastModified.UnixNano()/1e6)
+	}
+	return info, nil
 }
 
 // A WriterOption sets Writer-specific behavior.
@@ -586,11 +1302,49 @@ func WithAttrsOption(attrs *Attrs) WriterOption {
 	}
 }
 
-// WithCancelOnError requests the writer, if it has started a large file
-// upload, to call b2_cancel_large_file on any permanent error.  It calls ctxf
-// to obtain a context with which to cancel the file; this is to allow callers
-// to set specific timeouts.  If errf is non-nil, then it is called with the
-// (possibly nil) output of b2_cancel_large_file.
+// DetectContentType causes the writer to choose a content type when none is
+// given, by examining the first 512 bytes of the object with
+// http.DetectContentType and, if that is inconclusive or finds only plain
+// text, by looking up its extension with mime.TypeByExtension.  Without it,
+// objects without a content type are uploaded as application/octet-stream.
+func DetectContentType() WriterOption {
+	return func(w *Writer) {
+		w.detect = true
+	}
+}
+
+// WithFileBuffer stages each part of the upload in a scratch file in dir,
+// rather than in memory, as setting UseFileBuffer and FileBufferDir does.  The
+// upload streams from the file, and rereads it if the part must be retried.
+// Scratch files are removed by Close, whether or not the upload succeeded, so
+// Close must be called even if the writer's context is canceled.  If dir is
+// blank, os.TempDir() is used.
+func WithFileBuffer(dir string) WriterOption {
+	return func(w *Writer) {
+		w.UseFileBuffer = true
+		w.FileBufferDir = dir
+	}
+}
+
+// AutoPartSize allows the writer to use parts larger than ChunkSize when the
+// object would otherwise need more than the 10,000 parts B2 allows in a large
+// file.  Part sizes must be chosen before the first part is uploaded, so this
+// only takes effect when the size of the object is known in advance: when the
+// source given to ReadFrom is an io.Seeker, as it is for Bucket.UploadFile.
+func AutoPartSize() WriterOption {
+	return func(w *Writer) {
+		w.autoPart = true
+	}
+}
+
+// WithCancelOnError controls how the writer cancels the large file it has
+// started when the upload fails.  The writer always calls
+// b2_cancel_large_file after a permanent error, including the cancellation of
+// its context, unless KeepUnfinished is given; by default it uses a new
+// context with a ten second timeout, since the writer's own is done.  With
+// this option it calls ctxf to obtain the context instead; this is to allow
+// callers to set specific timeouts.  If errf is non-nil, then it is called
+// with the (possibly nil) output of b2_cancel_large_file.
 func WithCancelOnError(ctxf func() context.Context, errf func(error)) WriterOption {
 	return func(w *Writer) {
 		w.ctxf = ctxf
@@ -598,6 +1352,89 @@ func WithCancelOnError(ctxf func() context.Context, errf func(error)) WriterOpti
 	}
 }
 
+// PartSHA1 gives the SHA1 hash of each part of a large file, as hex digits,
+// so that the writer needn't compute them.  f is called with the part number,
+// starting from 1, and the offset and size of the part within the object,
+// before the part is sent; if it returns "", the writer computes the hash as
+// usual.  An object small enough to be sent in one request is part 1, unless
+// its hash is given in Attrs.SHA1 with WithAttrsOption.
+//
+// If B2 finds that the data doesn't match a hash that was given, the writer
+// fails with a *HashMismatchError.
+func PartSHA1(f func(part int, offset, size int64) string) WriterOption {
+	return func(w *Writer) {
+		w.partSHA1 = f
+	}
+}
+
+// A HashMismatchError reports that B2 refused an upload because its data
+// didn't match the SHA1 hash given for it with PartSHA1 or Attrs.SHA1.
+type HashMismatchError struct {
+	Name string // The object being written.
+	Part int    // The part of a large file, or 0 for the value of Attrs.SHA1.
+	SHA1 string // The hash that didn't match.
+	err  error
+}
+
+func (e *HashMismatchError) Error() string {
+	if e.Part == 0 {
+		return fmt.Sprintf("b2: %s does not match SHA1 %s: %v", e.Name, e.SHA1, e.err)
+	}
+	return fmt.Sprintf("b2: part %d of %s does not match SHA1 %s: %v", e.Part, e.Name, e.SHA1, e.err)
+}
+
+func (e *HashMismatchError) Unwrap() error { return e.err }
+
+// VerifyParts makes the writer, before finishing a large file, list the
+// parts B2 has for it and compare their number, sizes, and SHA1 hashes with
+// those it uploaded.  If they differ, Close returns a *PartsError describing
+// each difference, and leaves the large file unfinished, to be resumed.  It
+// costs one b2_list_parts request for each thousand parts.
+func VerifyParts() WriterOption {
+	return func(w *Writer) {
+		w.verify = true
+	}
+}
+
+// WithConcurrentUploads sets the writer's ConcurrentUploads.
+func WithConcurrentUploads(n int) WriterOption {
+	return func(w *Writer) {
+		w.ConcurrentUploads = n
+	}
+}
+
+// ResumeCheck is called, when Resume finds an unfinished large file to
+// resume, with the parts that file already has, before anything is uploaded.
+// Parts are checked against the data as it is written, and any that differ are
+// uploaded again; ResumeCheck allows callers that know more, such as those
+// writing from a source that can't seek, to decide against resuming.  If f
+// returns false, the unfinished file is cancelled and the upload starts over.
+func ResumeCheck(f func(parts []Part) bool) WriterOption {
+	return func(w *Writer) {
+		w.resumeCheck = f
+	}
+}
+
+// CancelOtherUnfinished makes a resuming writer that finds several unfinished
+// large files with its name cancel all but the most recently started, which
+// it resumes.  Without it, the others are left alone.
+func CancelOtherUnfinished() WriterOption {
+	return func(w *Writer) {
+		w.cancelOthers = true
+	}
+}
+
+// KeepUnfinished leaves the large file, and the parts already uploaded, in
+// place when the upload fails, so that a later Writer with Resume set can pick
+// up where this one left off.  B2 bills for the parts of unfinished large
+// files until they are finished or cancelled; those left behind can be found
+// with ListUnfinished.
+func KeepUnfinished() WriterOption {
+	return func(w *Writer) {
+		w.keepUnfinished = true
+	}
+}
+
 // DefaultWriterOptions returns a ClientOption that will apply the given
 // WriterOptions to every Writer.  These options can be overridden by passing
 // new options to NewWriter.
@@ -607,12 +1444,21 @@ func DefaultWriterOptions(opts ...WriterOption) ClientOption {
 	}
 }
 
+// Rate returns the writer's throughput over the last ten seconds, in bytes per
+// second, counting the bytes of a part that was retried once.  Client.Status
+// reports it along with the rate of bytes sent, including the retries.
+func (w *Writer) Rate() float64 {
+	return w.rate.rate().Effective
+}
+
 func (w *Writer) status() *WriterStatus {
 	w.smux.RLock()
 	defer w.smux.RUnlock()
 
 	ws := &WriterStatus{
 		Progress: make([]float64, len(w.smap)),
+		Waiting:  int(atomic.LoadInt32(&w.waiting)),
+		Rate:     w.rate.rate(),
 	}
 
 	for i := 1; i <= len(w.smap); i++ {
@@ -627,23 +1473,62 @@ type meteredReader struct {
 	size int
 	r    readResetter
 	mux  sync.Mutex
+
+	// If progress is set, it is called with the change in the number of
+	// bytes read, counting no more than the first payload bytes.
+	payload  int64
+	progress func(int64)
+
+	// If rate is set, it is given the bytes read, of which those before high,
+	// the most read before a Reset, were read before.
+	rate *rateMeter
+	high int64
 }
 
 func (mr *meteredReader) Read(p []byte) (int, error) {
 	mr.mux.Lock()
 	defer mr.mux.Unlock()
 	n, err := mr.r.Read(p)
-	mr.read += int64(n)
+	before := mr.counted()
+	at := atomic.AddInt64(&mr.read, int64(n)) // done reads it without the lock
+	if d := mr.counted() - before; d != 0 && mr.progress != nil {
+		mr.progress(d)
+	}
+	if mr.rate != nil && n > 0 {
+		var again int64
+		if mr.high > at-int64(n) {
+			again = mr.high - (at - int64(n))
+			if again > int64(n) {
+				again = int64(n)
+			}
+		}
+		if at > mr.high {
+			mr.high = at
+		}
+		mr.rate.add(int64(n), again)
+	}
 	return n, err
 }
 
 func (mr *meteredReader) Reset() error {
 	mr.mux.Lock()
 	defer mr.mux.Unlock()
-	mr.read = 0
+	if d := mr.counted(); d != 0 && mr.progress != nil {
+		mr.progress(-d)
+	}
+	atomic.StoreInt64(&mr.read, 0)
 	return mr.r.Reset()
 }
 
+// counted returns the number of bytes read that have been reported to
+// progress.
+func (mr *meteredReader) counted() int64 {
+	if mr.read < mr.payload {
+		return mr.read
+	}
+	return mr.payload
+}
+
 func (mr *meteredReader) done() float64 {
 	if mr == nil {
 		return 1
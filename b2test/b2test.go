@@ -0,0 +1,451 @@
+// Copyright 2024, the Blazer authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package b2test provides an in-memory B2 server for tests.
+//
+// A Server speaks enough of the B2 Native API for blazer, or any other client,
+// to authorize an account, create, list, update, and delete buckets, upload
+// objects whole or as large files in parts, list them a page at a time, read
+// their metadata, hide, copy, and delete them, and download them whole or in
+// ranges, with or without download authorizations.  Its URL is used in place
+// of the API's:
+//
+//	srv := b2test.NewServer()
+//	defer srv.Close()
+//	id, key := srv.Credentials()
+//	client, err := b2.NewClient(ctx, id, key, b2.APIBase(srv.URL))
+//
+// Calls can be made to fail, once or many times, with FailNext, Intercept, or
+// ExpireTokens, to see how the code under test copes.  The X-Bz-Test-Mode
+// headers sent by blazer's FailSomeUploads, ExpireSomeAuthTokens, and
+// ForceCapExceeded options are honored as well.  A FaultTransport, given to a
+// client with the b2.Transport option, fails requests on the client's side
+// instead, whether they are sent to a Server or to B2.  A Cassette records a
+// session with B2 to replay later, without it.  A FakeClock, given to a
+// client with the b2.WithClock option, lets it retry without waiting.
+//
+// Buckets' lifecycle rules are applied when RunLifecycle is called, as of the
+// time given by the Clock option, rather than once a day.  FreezeListings
+// makes listings lag behind the changes made to buckets, as B2's may.
+//
+// The server keeps everything in memory and is meant for small objects; give
+// it small PartSizes to test large files.  It enforces no caps, and it doesn't
+// check the capabilities of keys.
+package b2test
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Backblaze/blazer/internal/b2types"
+)
+
+// The credentials and part sizes of a Server without options.
+const (
+	DefaultAccountID = "b2test-account"
+	DefaultKey       = "b2test-key"
+
+	defaultPartSize    = 100 * 1e6
+	defaultMinPartSize = 5 * 1e6
+)
+
+// capabilities are those of an account's master key.
+var capabilities = []string{
+	"listKeys", "writeKeys", "deleteKeys",
+	"listBuckets", "listAllBucketNames", "readBuckets", "writeBuckets", "deleteBuckets",
+	"readBucketRetentions", "writeBucketRetentions", "readBucketEncryption", "writeBucketEncryption",
+	"readBucketReplications", "writeBucketReplications", "readBucketNotifications", "writeBucketNotifications",
+	"listFiles", "readFiles", "shareFiles", "writeFiles", "deleteFiles",
+	"readFileLegalHolds", "writeFileLegalHolds", "readFileRetentions", "writeFileRetentions",
+	"bypassGovernance",
+}
+
+// An Error is the reply to a call that fails, as B2 sends it: an HTTP status,
+// and a code and message in the body.  A RetryAfter of more than zero is sent
+// as the Retry-After header, in seconds.
+type Error struct {
+	Status     int
+	Code       string
+	Message    string
+	RetryAfter int
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.Status, e.Code, e.Message)
+}
+
+func errorf(status int, code, format string, args ...interface{}) *Error {
+	return &Error{Status: status, Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// An Option configures a Server.
+type Option func(*Server)
+
+// Account sets the account ID and application key that the server accepts.
+func Account(id, key string) Option {
+	return func(s *Server) {
+		s.account, s.key = id, key
+	}
+}
+
+// PartSizes sets the recommended and absolute minimum part sizes that the
+// server reports when an account is authorized.
+func PartSizes(recommended, absoluteMinimum int) Option {
+	return func(s *Server) {
+		s.partSize, s.minPartSize = recommended, absoluteMinimum
+	}
+}
+
+// Clock sets the function from which the server takes the time, for the
+// timestamps of uploads, the expiry of download authorizations, and lifecycle
+// rules.  The default is time.Now.
+func Clock(now func() time.Time) Option {
+	return func(s *Server) {
+		s.clock = now
+	}
+}
+
+// Intercept calls f before each call is handled, with the name of the call,
+// such as "b2_upload_file" or "b2_download_file_by_name", and the request.
+// If f returns an Error, the call fails with it.  f may be called from many
+// goroutines at once, and must not read the request's body.
+func Intercept(f func(method string, r *http.Request) *Error) Option {
+	return func(s *Server) {
+		s.intercept = f
+	}
+}
+
+// A Server is an in-memory B2, listening on a local address.  It is safe for
+// concurrent use.
+type Server struct {
+	*httptest.Server
+
+	account, key          string
+	partSize, minPartSize int
+	intercept             func(string, *http.Request) *Error
+	clock                 func() time.Time
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket    // by ID
+	files     map[string]*file      // every version, by ID
+	large     map[string]*largeFile // unfinished large files, by ID
+	tokens    map[string]*token
+	fails     map[string][]Error
+	lastID    int
+	uploads   int // uploads made in fail_some_uploads test mode
+	authCalls int // calls made in expire_some_account_authorization_tokens test mode
+}
+
+// NewServer starts and returns a Server.  Call Close when done with it.
+func NewServer(opts ...Option) *Server {
+	s := &Server{
+		account:     DefaultAccountID,
+		key:         DefaultKey,
+		partSize:    defaultPartSize,
+		minPartSize: defaultMinPartSize,
+		buckets:     make(map[string]*bucket),
+		files:       make(map[string]*file),
+		large:       make(map[string]*largeFile),
+		tokens:      make(map[string]*token),
+		fails:       make(map[string][]Error),
+		clock:       time.Now,
+	}
+	for _, o := range opts {
+		o(s)
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+// Credentials returns the account ID and application key that the server
+// accepts.
+func (s *Server) Credentials() (accountID, key string) {
+	return s.account, s.key
+}
+
+// FailNext makes the next n calls named method, such as "b2_list_file_names",
+// fail with e.  Failures queued for the same call are used up in order.
+func (s *Server) FailNext(method string, n int, e Error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := 0; i < n; i++ {
+		s.fails[method] = append(s.fails[method], e)
+	}
+}
+
+// ExpireTokens expires every authorization token that the server has handed
+// out, so that the next call made with each fails with 401 Unauthorized and
+// the code "expired_auth_token".
+func (s *Server) ExpireTokens() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, t := range s.tokens {
+		t.expired = true
+	}
+}
+
+// FreezeListings makes listings of each bucket show its objects as they are
+// now until ThawListings is called, as B2's listings may lag behind the
+// changes made to a bucket.  Every other call sees those changes at once.
+func (s *Server) FreezeListings() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, b := range s.buckets {
+		b.listed = make(map[string][]*file, len(b.versions))
+		for name, vs := range b.versions {
+			b.listed[name] = vs
+		}
+	}
+}
+
+// ThawListings undoes FreezeListings, so that listings are again up to date.
+func (s *Server) ThawListings() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, b := range s.buckets {
+		b.listed = nil
+	}
+}
+
+type tokenKind int
+
+const (
+	accountToken tokenKind = iota
+	uploadToken
+	partToken
+	downloadToken
+)
+
+type token struct {
+	kind    tokenKind
+	expired bool
+
+	// The bucket ID of upload and download tokens, or the file ID of part
+	// tokens.
+	target string
+
+	// For download tokens.
+	prefix    string
+	expires   time.Time
+	overrides map[string]string // b2* query parameters that downloads must send
+}
+
+// now returns the time in milliseconds since the epoch, as B2 gives it.
+func (s *Server) now() int64 {
+	return s.clock().UnixNano() / 1e6
+}
+
+// newID returns an ID that the server has not handed out before.  It must be
+// called with s.mu held.
+func (s *Server) newID(kind string) string {
+	s.lastID++
+	return fmt.Sprintf("b2test_%s_%012d", kind, s.lastID)
+}
+
+// newToken hands out a token.  It must be called with s.mu held.
+func (s *Server) newToken(t *token) string {
+	id := s.newID("token")
+	s.tokens[id] = t
+	return id
+}
+
+// apiCalls are the calls made to /b2api/v1/, other than uploads, which take
+// their arguments in the request body as JSON.
+var apiCalls = map[string]func(*Server, []byte) (interface{}, *Error){
+	"b2_create_bucket":               (*Server).createBucket,
+	"b2_delete_bucket":               (*Server).deleteBucket,
+	"b2_list_buckets":                (*Server).listBuckets,
+	"b2_update_bucket":               (*Server).updateBucket,
+	"b2_get_upload_url":              (*Server).getUploadURL,
+	"b2_start_large_file":            (*Server).startLargeFile,
+	"b2_get_upload_part_url":         (*Server).getUploadPartURL,
+	"b2_finish_large_file":           (*Server).finishLargeFile,
+	"b2_cancel_large_file":           (*Server).cancelLargeFile,
+	"b2_list_unfinished_large_files": (*Server).listUnfinishedLargeFiles,
+	"b2_list_parts":                  (*Server).listParts,
+	"b2_hide_file":                   (*Server).hideFile,
+	"b2_copy_file":                   (*Server).copyFile,
+	"b2_list_file_names":             (*Server).listFileNames,
+	"b2_list_file_versions":          (*Server).listFileVersions,
+	"b2_get_file_info":               (*Server).getFileInfo,
+	"b2_delete_file_version":         (*Server).deleteFileVersion,
+	"b2_get_download_authorization":  (*Server).getDownloadAuthorization,
+}
+
+// method returns the name of the call that r makes, and what follows it in
+// the path.
+func method(r *http.Request) (string, string) {
+	p := r.URL.Path
+	if strings.HasPrefix(p, "/file/") {
+		return "b2_download_file_by_name", strings.TrimPrefix(p, "/file/")
+	}
+	if !strings.HasPrefix(p, b2types.V1api) {
+		return "", ""
+	}
+	p = strings.TrimPrefix(p, b2types.V1api)
+	if i := strings.Index(p, "/"); i >= 0 {
+		return p[:i], p[i+1:]
+	}
+	return p, ""
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	name, rest := method(r)
+	if e := s.injected(name, r); e != nil {
+		reply(w, nil, e)
+		return
+	}
+	switch name {
+	case "b2_authorize_account":
+		resp, e := s.authorizeAccount(r)
+		reply(w, resp, e)
+	case "b2_upload_file":
+		resp, e := s.uploadFile(r, rest)
+		reply(w, resp, e)
+	case "b2_upload_part":
+		resp, e := s.uploadPart(r, rest)
+		reply(w, resp, e)
+	case "b2_download_file_by_name":
+		s.downloadFileByName(w, r, rest)
+	default:
+		f, ok := apiCalls[name]
+		if !ok {
+			reply(w, nil, errorf(http.StatusNotFound, "not_found", "unknown call %q", name))
+			return
+		}
+		if r.Method != http.MethodPost {
+			reply(w, nil, errorf(http.StatusMethodNotAllowed, "method_not_allowed", "%s takes POST", name))
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			reply(w, nil, errorf(http.StatusBadRequest, "bad_request", "%v", err))
+			return
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if e := s.checkAccountToken(r); e != nil {
+			reply(w, nil, e)
+			return
+		}
+		resp, e := f(s, body)
+		reply(w, resp, e)
+	}
+}
+
+// injected returns the failure, if any, that the caller has asked for the call
+// named method to meet.
+func (s *Server) injected(method string, r *http.Request) *Error {
+	if s.intercept != nil {
+		if e := s.intercept(method, r); e != nil {
+			return e
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	q := s.fails[method]
+	if len(q) == 0 {
+		return nil
+	}
+	e := q[0]
+	s.fails[method] = q[1:]
+	return &e
+}
+
+// testMode reports whether r asks for the named X-Bz-Test-Mode.
+func testMode(r *http.Request, mode string) bool {
+	for _, v := range r.Header.Values("X-Bz-Test-Mode") {
+		if v == mode {
+			return true
+		}
+	}
+	return false
+}
+
+// checkAccountToken checks that r is authorized by an account token.  It must
+// be called with s.mu held.
+func (s *Server) checkAccountToken(r *http.Request) *Error {
+	id := r.Header.Get("Authorization")
+	t, ok := s.tokens[id]
+	if !ok || t.kind != accountToken {
+		return errorf(http.StatusUnauthorized, "bad_auth_token", "invalid authorization token")
+	}
+	if testMode(r, "expire_some_account_authorization_tokens") {
+		s.authCalls++
+		if s.authCalls%5 == 0 {
+			t.expired = true
+		}
+	}
+	if t.expired {
+		return errorf(http.StatusUnauthorized, "expired_auth_token", "authorization token has expired")
+	}
+	return nil
+}
+
+// reply writes resp as JSON, or e as B2 would.
+func reply(w http.ResponseWriter, resp interface{}, e *Error) {
+	w.Header().Set("Content-Type", "application/json")
+	if e != nil {
+		if e.RetryAfter > 0 {
+			w.Header().Set("Retry-After", fmt.Sprint(e.RetryAfter))
+		}
+		w.WriteHeader(e.Status)
+		json.NewEncoder(w).Encode(b2types.ErrorMessage{Status: e.Status, Code: e.Code, Msg: e.Message})
+		return
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+func decode(body []byte, req interface{}) *Error {
+	if err := json.Unmarshal(body, req); err != nil {
+		return errorf(http.StatusBadRequest, "bad_request", "%v", err)
+	}
+	return nil
+}
+
+func (s *Server) authorizeAccount(r *http.Request) (interface{}, *Error) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Basic ") {
+		return nil, errorf(http.StatusUnauthorized, "bad_auth_token", "basic authorization required")
+	}
+	creds, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(auth, "Basic "))
+	if err != nil {
+		return nil, errorf(http.StatusBadRequest, "bad_request", "%v", err)
+	}
+	id, key, ok := strings.Cut(string(creds), ":")
+	if !ok || id != s.account || key != s.key {
+		return nil, errorf(http.StatusUnauthorized, "unauthorized", "bad account ID or application key")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return &b2types.AuthorizeAccountResponse{
+		AccountID:      s.account,
+		AuthToken:      s.newToken(&token{kind: accountToken}),
+		URI:            s.URL,
+		DownloadURI:    s.URL,
+		MinPartSize:    s.partSize,
+		PartSize:       s.partSize,
+		AbsMinPartSize: s.minPartSize,
+		Allowed: b2types.Allowance{
+			Capabilities: capabilities,
+		},
+	}, nil
+}
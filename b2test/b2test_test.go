@@ -0,0 +1,778 @@
+// Copyright 2024, the Blazer authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package b2test_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Backblaze/blazer/b2"
+	"github.com/Backblaze/blazer/b2test"
+	"github.com/Backblaze/blazer/base"
+)
+
+// newClient returns a client of srv that doesn't wait long between retries.
+func newClient(ctx context.Context, t *testing.T, srv *b2test.Server, opts ...b2.ClientOption) *b2.Client {
+	t.Helper()
+	id, key := srv.Credentials()
+	// Retries, even those B2 asks to be held off, don't wait.
+	clock := b2test.NewFakeClock(time.Now())
+	clock.AdvanceOnWait(true)
+	opts = append([]b2.ClientOption{b2.APIBase(srv.URL), b2.WithClock(clock)}, opts...)
+	client, err := b2.NewClient(ctx, id, key, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func write(ctx context.Context, t *testing.T, bucket *b2.Bucket, name, body string, opts ...b2.WriterOption) {
+	t.Helper()
+	w := bucket.Object(name).NewWriter(ctx, opts...)
+	if _, err := io.WriteString(w, body); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func read(ctx context.Context, r io.ReadCloser) (string, error) {
+	defer r.Close()
+	b, err := io.ReadAll(r)
+	return string(b), err
+}
+
+func list(ctx context.Context, bucket *b2.Bucket, opts ...b2.ListOption) ([]string, error) {
+	var names []string
+	iter := bucket.List(ctx, opts...)
+	for iter.Next() {
+		names = append(names, iter.Object().Name())
+	}
+	return names, iter.Err()
+}
+
+func TestServer(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	srv := b2test.NewServer()
+	defer srv.Close()
+	client := newClient(ctx, t, srv)
+
+	bucket, err := client.NewBucket(ctx, "b2test-bucket", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"a":       "alpha",
+		"b/1":     "one",
+		"b/2":     "two",
+		"c d+e":   "escaped",
+		"zz.json": `{}`,
+	}
+	for name, body := range files {
+		write(ctx, t, bucket, name, body, b2.WithAttrsOption(&b2.Attrs{ContentType: "b2/x-auto", Info: map[string]string{"src": name}}))
+	}
+
+	got, err := list(ctx, bucket, b2.ListPageSize(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a", "b/1", "b/2", "c d+e", "zz.json"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("List: got %v, want %v", got, want)
+	}
+	got, err = list(ctx, bucket, b2.ListDelimiter("/"), b2.ListPageSize(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a", "b/", "c d+e", "zz.json"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("List with a delimiter: got %v, want %v", got, want)
+	}
+
+	for name, body := range files {
+		obj := bucket.Object(name)
+		got, err := read(ctx, obj.NewReader(ctx))
+		if err != nil || got != body {
+			t.Errorf("reading %q: got %q, %v, want %q", name, got, err, body)
+		}
+		attrs, err := obj.Attrs(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if attrs.Size != int64(len(body)) || attrs.Info["src"] != name {
+			t.Errorf("Attrs(%q): got size %d and info %v, want %d and src %q", name, attrs.Size, attrs.Info, len(body), name)
+		}
+	}
+	if attrs, err := bucket.Object("zz.json").Attrs(ctx); err != nil || attrs.ContentType != "application/json" {
+		t.Errorf("Attrs(zz.json): got content type %q, %v, want application/json", attrs.ContentType, err)
+	}
+	if got, err := read(ctx, bucket.Object("a").NewRangeReader(ctx, 1, 3)); err != nil || got != "lph" {
+		t.Errorf("reading a range: got %q, %v, want %q", got, err, "lph")
+	}
+	if _, err := bucket.Object("nope").Attrs(ctx); !b2.IsNotExist(err) {
+		t.Errorf("Attrs of a missing object: got %v, want a not found error", err)
+	}
+
+	if err := bucket.Object("a").Delete(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := bucket.DeleteObjects(ctx, "b/"); err != nil || n != 2 {
+		t.Errorf("DeleteObjects: got %d, %v, want 2", n, err)
+	}
+	got, err = list(ctx, bucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"c d+e", "zz.json"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("List after deleting: got %v, want %v", got, want)
+	}
+	if err := bucket.Delete(ctx); err == nil {
+		t.Error("deleted a bucket that isn't empty")
+	}
+}
+
+func TestServerBuckets(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	srv := b2test.NewServer()
+	defer srv.Close()
+	client := newClient(ctx, t, srv)
+
+	for _, name := range []string{"bucket-two", "bucket-one"} {
+		if _, err := client.NewBucket(ctx, name, &b2.BucketAttrs{Type: b2.Public}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	buckets, err := client.ListBuckets(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, b := range buckets {
+		names = append(names, b.Name())
+	}
+	if want := []string{"bucket-one", "bucket-two"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("ListBuckets: got %v, want %v", names, want)
+	}
+
+	bucket, err := client.Bucket(ctx, "bucket-one")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bucket.Update(ctx, &b2.BucketAttrs{Info: map[string]string{"k": "v"}}); err != nil {
+		t.Fatal(err)
+	}
+	attrs, err := bucket.Attrs(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attrs.Type != b2.Public || attrs.Info["k"] != "v" {
+		t.Errorf("Attrs after Update: got type %q and info %v", attrs.Type, attrs.Info)
+	}
+	if err := bucket.Update(ctx, &b2.BucketAttrs{Revision: 1, Type: b2.Private}); !b2.IsUpdateConflict(err) {
+		t.Errorf("Update of a stale revision: got %v, want a conflict", err)
+	}
+	if err := bucket.Delete(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := client.BucketExists(ctx, "bucket-one"); ok || err != nil {
+		t.Errorf("BucketExists after Delete: got %v, %v", ok, err)
+	}
+	if _, err := client.NewBucket(ctx, "no", nil); err == nil {
+		t.Error("created a bucket with a short name")
+	}
+}
+
+func TestServerDownloadAuthorization(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	srv := b2test.NewServer()
+	defer srv.Close()
+	client := newClient(ctx, t, srv)
+
+	private, err := client.NewBucket(ctx, "private-bucket", &b2.BucketAttrs{Type: b2.Private})
+	if err != nil {
+		t.Fatal(err)
+	}
+	public, err := client.NewBucket(ctx, "public-bucket", &b2.BucketAttrs{Type: b2.Public})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range []*b2.Bucket{private, public} {
+		write(ctx, t, b, "docs/a.txt", "hello")
+		write(ctx, t, b, "other", "secret")
+	}
+
+	get := func(u string) (int, string, http.Header) {
+		t.Helper()
+		resp, err := http.Get(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := read(ctx, resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, body, resp.Header
+	}
+
+	if code, body, _ := get(public.Object("docs/a.txt").URL()); code != http.StatusOK || body != "hello" {
+		t.Errorf("public download: got %d %q, want 200 %q", code, body, "hello")
+	}
+	if code, _, _ := get(private.Object("docs/a.txt").URL()); code != http.StatusUnauthorized {
+		t.Errorf("private download without a token: got %d, want 401", code)
+	}
+	_, u, err := private.DownloadAuthorization(ctx, "docs/", time.Minute, b2.ResponseContentDisposition("attachment"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.Path = "/file/private-bucket/docs/a.txt"
+	code, body, hdr := get(u.String())
+	if code != http.StatusOK || body != "hello" || hdr.Get("Content-Disposition") != "attachment" {
+		t.Errorf("authorized download: got %d %q with Content-Disposition %q, want 200 %q with attachment", code, body, hdr.Get("Content-Disposition"), "hello")
+	}
+	u.Path = "/file/private-bucket/other"
+	if code, _, _ := get(u.String()); code != http.StatusUnauthorized {
+		t.Errorf("download outside the authorized prefix: got %d, want 401", code)
+	}
+	u.Path = "/file/private-bucket/docs/a.txt"
+	q := u.Query()
+	q.Del("b2ContentDisposition")
+	u.RawQuery = q.Encode()
+	if code, _, _ := get(u.String()); code != http.StatusUnauthorized {
+		t.Errorf("download without the authorized overrides: got %d, want 401", code)
+	}
+}
+
+func TestServerFailures(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var uploads int32
+	srv := b2test.NewServer(b2test.Intercept(func(method string, r *http.Request) *b2test.Error {
+		if method == "b2_upload_file" && atomic.AddInt32(&uploads, 1) == 1 {
+			return &b2test.Error{Status: http.StatusServiceUnavailable, Code: "service_unavailable", Message: "busy"}
+		}
+		return nil
+	}))
+	defer srv.Close()
+	client := newClient(ctx, t, srv)
+
+	bucket, err := client.NewBucket(ctx, "b2test-bucket", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	write(ctx, t, bucket, "a", "alpha")
+	if n := atomic.LoadInt32(&uploads); n != 2 {
+		t.Errorf("got %d upload attempts, want 2", n)
+	}
+
+	// Retried.
+	srv.FailNext("b2_list_file_names", 2, b2test.Error{Status: http.StatusServiceUnavailable, Code: "service_unavailable", Message: "busy"})
+	if got, err := list(ctx, bucket); err != nil || !reflect.DeepEqual(got, []string{"a"}) {
+		t.Errorf("List after transient failures: got %v, %v", got, err)
+	}
+
+	// Not retried.
+	srv.FailNext("b2_list_file_names", 1, b2test.Error{Status: http.StatusBadRequest, Code: "bad_request", Message: "no"})
+	if _, err := list(ctx, bucket); err == nil || !strings.Contains(err.Error(), "no") {
+		t.Errorf("List after a permanent failure: got %v, want the failure", err)
+	}
+
+	// Authorized again.
+	srv.ExpireTokens()
+	if got, err := list(ctx, bucket); err != nil || !reflect.DeepEqual(got, []string{"a"}) {
+		t.Errorf("List after tokens expired: got %v, %v", got, err)
+	}
+
+	// Uploads fail in the ways B2 is asked to fail them.
+	capped := newClient(ctx, t, srv, b2.ForceCapExceeded())
+	cb, err := capped.Bucket(ctx, "b2test-bucket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := cb.Object("b").NewWriter(ctx)
+	io.WriteString(w, "beta")
+	if err := w.Close(); !b2.IsStorageCapExceeded(err) {
+		t.Errorf("upload with the cap exceeded: got %v", err)
+	}
+	flaky := newClient(ctx, t, srv, b2.FailSomeUploads())
+	fb, err := flaky.Bucket(ctx, "b2test-bucket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 6; i++ {
+		write(ctx, t, fb, fmt.Sprintf("flaky/%d", i), "data")
+	}
+	if got, err := list(ctx, bucket, b2.ListPrefix("flaky/")); err != nil || len(got) != 6 {
+		t.Errorf("List of uploads that sometimes failed: got %v, %v", got, err)
+	}
+}
+
+func TestServerChecksSHA1(t *testing.T) {
+	srv := b2test.NewServer()
+	defer srv.Close()
+	ctx := context.Background()
+	client := newClient(ctx, t, srv)
+	bucket, err := client.NewBucket(ctx, "b2test-bucket", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A Writer that is given the wrong hash sends it.
+	w := bucket.Object("a").NewWriter(ctx, b2.WithAttrsOption(&b2.Attrs{SHA1: strings.Repeat("0", 40)}))
+	io.Copy(w, bytes.NewReader([]byte("alpha")))
+	if err := w.Close(); err == nil {
+		t.Error("upload with the wrong SHA1 succeeded")
+	}
+}
+
+// baseBucket returns the named bucket of srv through package base, to make
+// calls that package b2 makes only on its own terms.
+func baseBucket(ctx context.Context, t *testing.T, srv *b2test.Server, name string) *base.Bucket {
+	t.Helper()
+	id, key := srv.Credentials()
+	b, err := base.AuthorizeAccount(ctx, id, key, base.SetAPIBase(srv.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buckets, err := b.ListBuckets(ctx, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(buckets) != 1 {
+		t.Fatalf("ListBuckets(%q): got %d buckets, want 1", name, len(buckets))
+	}
+	return buckets[0]
+}
+
+func sha1Hex(data []byte) string {
+	sum := sha1.Sum(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestServerLargeFiles(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	srv := b2test.NewServer(b2test.PartSizes(1e4, 5e3))
+	defer srv.Close()
+	client := newClient(ctx, t, srv)
+	bucket, err := client.NewBucket(ctx, "b2test-bucket", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := make([]byte, 25e3)
+	rand.New(rand.NewSource(1)).Read(data)
+	w := bucket.Object("large").NewWriter(ctx)
+	w.ChunkSize = 1e4
+	w.ConcurrentUploads = 2
+	if _, err := io.Copy(w, bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := read(ctx, bucket.Object("large").NewReader(ctx)); err != nil || got != string(data) {
+		t.Errorf("reading a large file: got %d bytes, %v, want %d", len(got), err, len(data))
+	}
+	if got, err := read(ctx, bucket.Object("large").NewRangeReader(ctx, 9998, 4)); err != nil || got != string(data[9998:10002]) {
+		t.Errorf("reading across parts: got %q, %v, want %q", got, err, data[9998:10002])
+	}
+	if attrs, err := bucket.Object("large").Attrs(ctx); err != nil || attrs.Size != int64(len(data)) {
+		t.Errorf("Attrs of a large file: got %+v, %v, want size %d", attrs, err, len(data))
+	}
+
+	b := baseBucket(ctx, t, srv, "b2test-bucket")
+	lf, err := b.StartLargeFile(ctx, "unfinished", "application/octet-stream", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fc, err := lf.GetUploadPartURL(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	small, part := data[:1e3], data[:5e3]
+	if _, err := fc.UploadPart(ctx, bytes.NewReader(part), strings.Repeat("0", 40), len(part), 1); err == nil {
+		t.Error("part with the wrong SHA1 was uploaded")
+	}
+	for i, p := range [][]byte{small, part} {
+		if _, err := fc.UploadPart(ctx, bytes.NewReader(p), sha1Hex(p), len(p), i+1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := lf.FinishLargeFile(ctx); err == nil {
+		t.Error("finished a large file whose first part is too small")
+	}
+	// Uploading a part again replaces it.
+	if _, err := fc.UploadPart(ctx, bytes.NewReader(part), sha1Hex(part), len(part), 1); err != nil {
+		t.Fatal(err)
+	}
+	wrong := b.File(lf.ID, "unfinished").CompileParts(10e3, map[int]string{1: sha1Hex(small), 2: sha1Hex(part)})
+	if _, err := wrong.FinishLargeFile(ctx); err == nil {
+		t.Error("finished a large file with the wrong partSha1Array")
+	}
+	parts, _, err := b.File(lf.ID, "unfinished").ListParts(ctx, 1, 10)
+	if err != nil || len(parts) != 2 || parts[0].SHA1 != sha1Hex(part) {
+		t.Errorf("ListParts: got %+v, %v, want two parts, the first with SHA1 %s", parts, err, sha1Hex(part))
+	}
+
+	got, err := list(ctx, bucket, b2.ListUnfinished())
+	if err != nil || !reflect.DeepEqual(got, []string{"unfinished"}) {
+		t.Errorf("List of unfinished large files: got %v, %v", got, err)
+	}
+	if err := lf.CancelLargeFile(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := list(ctx, bucket, b2.ListUnfinished()); err != nil || len(got) != 0 {
+		t.Errorf("List of unfinished large files after canceling: got %v, %v", got, err)
+	}
+	if got, err := list(ctx, bucket); err != nil || !reflect.DeepEqual(got, []string{"large"}) {
+		t.Errorf("List: got %v, %v", got, err)
+	}
+}
+
+func TestServerHide(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	srv := b2test.NewServer()
+	defer srv.Close()
+	client := newClient(ctx, t, srv)
+	bucket, err := client.NewBucket(ctx, "b2test-bucket", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	write(ctx, t, bucket, "a", "one")
+	write(ctx, t, bucket, "a", "two")
+	write(ctx, t, bucket, "b", "beta")
+
+	if err := bucket.Object("a").Hide(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := list(ctx, bucket); err != nil || !reflect.DeepEqual(got, []string{"b"}) {
+		t.Errorf("List after hiding: got %v, %v, want [b]", got, err)
+	}
+	if got, err := list(ctx, bucket, b2.ListHidden()); err != nil || !reflect.DeepEqual(got, []string{"a", "a", "a", "b"}) {
+		t.Errorf("List of every version: got %v, %v, want [a a a b]", got, err)
+	}
+	if _, err := bucket.Object("a").Attrs(ctx); !b2.IsNotExist(err) {
+		t.Errorf("Attrs of a hidden object: got %v, want a not found error", err)
+	}
+	if _, err := baseBucket(ctx, t, srv, "b2test-bucket").HideFile(ctx, "a"); err == nil {
+		t.Error("hid an object that is already hidden")
+	}
+	if err := bucket.Reveal(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := read(ctx, bucket.Object("a").NewReader(ctx)); err != nil || got != "two" {
+		t.Errorf("reading a revealed object: got %q, %v, want %q", got, err, "two")
+	}
+}
+
+func TestServerFreezeListings(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	srv := b2test.NewServer()
+	defer srv.Close()
+	client := newClient(ctx, t, srv)
+	bucket, err := client.NewBucket(ctx, "b2test-bucket", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	write(ctx, t, bucket, "a", "alpha")
+	write(ctx, t, bucket, "b", "beta")
+
+	srv.FreezeListings()
+	if err := bucket.Object("a").Delete(ctx); err != nil {
+		t.Fatal(err)
+	}
+	write(ctx, t, bucket, "c", "gamma")
+	if got, err := list(ctx, bucket); err != nil || !reflect.DeepEqual(got, []string{"a", "b"}) {
+		t.Errorf("List while frozen: got %v, %v, want [a b]", got, err)
+	}
+	if got, err := read(ctx, bucket.Object("c").NewReader(ctx)); err != nil || got != "gamma" {
+		t.Errorf("reading an object written while frozen: got %q, %v, want %q", got, err, "gamma")
+	}
+	srv.ThawListings()
+	if got, err := list(ctx, bucket); err != nil || !reflect.DeepEqual(got, []string{"b", "c"}) {
+		t.Errorf("List after thawing: got %v, %v, want [b c]", got, err)
+	}
+}
+
+func TestServerLifecycle(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).UnixNano()
+	advance := func(d time.Duration) { atomic.AddInt64(&now, int64(d)) }
+	srv := b2test.NewServer(b2test.Clock(func() time.Time { return time.Unix(0, atomic.LoadInt64(&now)) }))
+	defer srv.Close()
+	client := newClient(ctx, t, srv)
+	bucket, err := client.NewBucket(ctx, "b2test-bucket", &b2.BucketAttrs{
+		LifecycleRules: []b2.LifecycleRule{{
+			Prefix:                   "logs/",
+			DaysNewUntilHidden:       1,
+			DaysHiddenUntilDeleted:   2,
+			DaysStartedUntilCanceled: 1,
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	write(ctx, t, bucket, "logs/a", "alpha")
+	write(ctx, t, bucket, "keep", "kept")
+	if _, err := baseBucket(ctx, t, srv, "b2test-bucket").StartLargeFile(ctx, "logs/large", "application/octet-stream", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	srv.RunLifecycle()
+	if got, err := list(ctx, bucket); err != nil || !reflect.DeepEqual(got, []string{"keep", "logs/a"}) {
+		t.Errorf("List before a day has passed: got %v, %v", got, err)
+	}
+
+	advance(25 * time.Hour)
+	srv.RunLifecycle()
+	if got, err := list(ctx, bucket); err != nil || !reflect.DeepEqual(got, []string{"keep"}) {
+		t.Errorf("List after a day: got %v, %v, want [keep]", got, err)
+	}
+	if got, err := list(ctx, bucket, b2.ListHidden()); err != nil || !reflect.DeepEqual(got, []string{"keep", "logs/a", "logs/a"}) {
+		t.Errorf("List of every version after a day: got %v, %v, want the hidden version and its hide marker", got, err)
+	}
+	if got, err := list(ctx, bucket, b2.ListUnfinished()); err != nil || len(got) != 0 {
+		t.Errorf("List of unfinished large files after a day: got %v, %v, want none", got, err)
+	}
+
+	advance(48 * time.Hour)
+	srv.RunLifecycle()
+	if got, err := list(ctx, bucket, b2.ListHidden()); err != nil || !reflect.DeepEqual(got, []string{"keep"}) {
+		t.Errorf("List of every version after three days: got %v, %v, want [keep]", got, err)
+	}
+}
+
+func TestFaultTransport(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	srv := b2test.NewServer()
+	defer srv.Close()
+	ft := b2test.NewFaultTransport(nil)
+	client := newClient(ctx, t, srv, b2.Transport(ft))
+	bucket, err := client.NewBucket(ctx, "b2test-bucket", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Retried.
+	ft.Inject("b2_upload_file", 1, b2test.Fault{Error: &b2test.Error{Status: http.StatusServiceUnavailable, Code: "service_unavailable", Message: "busy"}})
+	ft.Inject("b2_upload_file", 2, b2test.Fault{DropRequest: true, DropAfter: 2})
+	write(ctx, t, bucket, "a", "alpha")
+	var uploads []b2test.Call
+	for _, c := range ft.Calls() {
+		if c.Method == "b2_upload_file" {
+			uploads = append(uploads, c)
+		}
+	}
+	if len(uploads) != 3 {
+		t.Fatalf("got %d uploads, want 3", len(uploads))
+	}
+	if uploads[0].Status != http.StatusServiceUnavailable || !errors.Is(uploads[1].Err, b2test.ErrDropped) || uploads[2].Status != http.StatusOK || uploads[2].Fault != nil {
+		t.Errorf("uploads: got %+v, want a 503, a dropped connection, and a success", uploads)
+	}
+
+	// Not retried.
+	ft.Inject("b2_upload_file", 4, b2test.Fault{CorruptSHA1: true})
+	w := bucket.Object("b").NewWriter(ctx)
+	io.WriteString(w, "beta")
+	if err := w.Close(); err == nil {
+		t.Error("upload with a corrupted SHA1 succeeded")
+	}
+	ft.Inject("b2_download_file_by_name", 1, b2test.Fault{CorruptSHA1: true})
+	var mismatch *b2.ChecksumMismatchError
+	if _, err := read(ctx, bucket.Object("a").NewReader(ctx)); !errors.As(err, &mismatch) {
+		t.Errorf("download with a corrupted SHA1: got %v, want a checksum mismatch", err)
+	}
+	ft.Inject("b2_download_file_by_name", 2, b2test.Fault{DropResponse: true, DropAfter: 2})
+	if _, err := read(ctx, bucket.Object("a").NewReader(ctx)); !errors.Is(err, b2test.ErrDropped) {
+		t.Errorf("download of a dropped connection: got %v, want the connection dropped", err)
+	}
+	dctx, dcancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer dcancel()
+	ft.Inject("b2_list_file_names", 1, b2test.Fault{Delay: time.Hour})
+	if _, err := list(dctx, bucket); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("List delayed past its deadline: got %v", err)
+	}
+
+	ft.Reset()
+	ft.Inject("", 2, b2test.Fault{Error: &b2test.Error{Status: http.StatusBadRequest, Code: "bad_request", Message: "no"}})
+	if got, err := list(ctx, bucket); err != nil || !reflect.DeepEqual(got, []string{"a"}) {
+		t.Errorf("List: got %v, %v", got, err)
+	}
+	if _, err := list(ctx, bucket); err == nil {
+		t.Error("second request after Reset succeeded")
+	}
+	if calls := ft.Calls(); len(calls) != 2 || calls[1].Method != "b2_list_file_names" || calls[1].N != 2 {
+		t.Errorf("Calls after Reset: got %+v", calls)
+	}
+}
+
+func TestCassette(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	srv := b2test.NewServer(b2test.PartSizes(1e4, 5e3))
+	path := filepath.Join(t.TempDir(), "cassette.json")
+	data := make([]byte, 25e3)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	// session makes the same calls each time, and returns what it saw.
+	session := func(rt http.RoundTripper) []string {
+		client := newClient(ctx, t, srv, b2.Transport(rt))
+		bucket, err := client.NewBucket(ctx, "b2test-bucket", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		write(ctx, t, bucket, "small", "alpha")
+		w := bucket.Object("large").NewWriter(ctx)
+		w.ChunkSize = 1e4
+		if _, err := io.Copy(w, bytes.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		names, err := list(ctx, bucket)
+		if err != nil {
+			t.Fatal(err)
+		}
+		small, err := read(ctx, bucket.Object("small").NewRangeReader(ctx, 1, 3))
+		if err != nil {
+			t.Fatal(err)
+		}
+		large, err := read(ctx, bucket.Object("large").NewReader(ctx))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return append(names, small, sha1Hex([]byte(large)))
+	}
+
+	rec := b2test.Record(path, nil)
+	want := session(rec)
+	if err := rec.Close(); err != nil {
+		t.Fatal(err)
+	}
+	srv.Close()
+
+	tape, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(tape, []byte("b2test_token_")) {
+		t.Error("the cassette holds authorization tokens")
+	}
+	if bytes.Contains(tape, data[:1e3]) {
+		t.Error("the cassette holds the bodies of uploads")
+	}
+
+	play, err := b2test.Replay(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := session(play); !reflect.DeepEqual(got, want) {
+		t.Errorf("replayed session: got %v, want %v", got, want)
+	}
+	if n := play.Unplayed(); n != 0 {
+		t.Errorf("%d recorded responses were not replayed", n)
+	}
+
+	// A request that wasn't recorded fails.
+	req, err := http.NewRequest(http.MethodPost, srv.URL+"/b2api/v1/b2_list_buckets", strings.NewReader("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := play.RoundTrip(req); err == nil {
+		t.Error("a request that wasn't recorded was answered")
+	}
+}
+
+func Example() {
+	srv := b2test.NewServer()
+	defer srv.Close()
+
+	ctx := context.Background()
+	id, key := srv.Credentials()
+	client, err := b2.NewClient(ctx, id, key, b2.APIBase(srv.URL))
+	if err != nil {
+		log.Fatal(err)
+	}
+	bucket, err := client.NewBucket(ctx, "example-bucket", nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	w := bucket.Object("hello.txt").NewWriter(ctx)
+	io.WriteString(w, "hello, world\n")
+	if err := w.Close(); err != nil {
+		log.Fatal(err)
+	}
+	r := bucket.Object("hello.txt").NewReader(ctx)
+	defer r.Close()
+	io.Copy(os.Stdout, r)
+	// Output: hello, world
+}
+
+func TestFakeClock(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := b2test.NewFakeClock(start)
+	ch := c.After(time.Minute)
+	if n := c.Waiting(); n != 1 {
+		t.Errorf("Waiting: got %d, want 1", n)
+	}
+	c.Advance(30 * time.Second)
+	select {
+	case <-ch:
+		t.Error("After(time.Minute) fired after 30s")
+	default:
+	}
+	c.Advance(30 * time.Second)
+	select {
+	case got := <-ch:
+		if want := start.Add(time.Minute); !got.Equal(want) {
+			t.Errorf("After(time.Minute): got %v, want %v", got, want)
+		}
+	default:
+		t.Error("After(time.Minute) didn't fire after a minute")
+	}
+
+	c.AdvanceOnWait(true)
+	<-c.After(time.Hour)
+	if got, want := c.Now(), start.Add(time.Hour+time.Minute); !got.Equal(want) {
+		t.Errorf("Now: got %v, want %v", got, want)
+	}
+	if got, want := c.Waits(), []time.Duration{time.Minute, time.Hour}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Waits: got %v, want %v", got, want)
+	}
+	if n := c.Waiting(); n != 0 {
+		t.Errorf("Waiting: got %d, want 0", n)
+	}
+}
@@ -0,0 +1,187 @@
+// Copyright 2024, the Blazer authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package b2test
+
+import (
+	"net/http"
+	"sort"
+
+	"github.com/Backblaze/blazer/internal/b2types"
+)
+
+type bucket struct {
+	id, name string
+	typ      string
+	info     map[string]string
+	rules    []b2types.LifecycleRule
+	lock     bool
+	revision int
+
+	// Every version of each name, newest first.
+	versions map[string][]*file
+
+	// What listings show while they are frozen, or nil.
+	listed map[string][]*file
+}
+
+func (b *bucket) response() *b2types.CreateBucketResponse {
+	return &b2types.CreateBucketResponse{
+		BucketID:       b.id,
+		Name:           b.name,
+		Type:           b.typ,
+		Info:           b.info,
+		LifecycleRules: b.rules,
+		FileLockConfiguration: b2types.FileLockConfiguration{
+			IsClientAuthorizedToRead: true,
+			Value:                    &b2types.FileLockValue{IsFileLockEnabled: b.lock},
+		},
+		Replication: b2types.ReplicationConfigurationResponse{
+			IsClientAuthorizedToRead: true,
+		},
+		Revision: b.revision,
+	}
+}
+
+// validBucketName reports whether B2 would accept name for a new bucket: six
+// to fifty letters, digits, and hyphens.
+func validBucketName(name string) bool {
+	if len(name) < 6 || len(name) > 50 {
+		return false
+	}
+	for _, c := range name {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9', c == '-':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func validBucketType(typ string) bool {
+	return typ == "allPrivate" || typ == "allPublic"
+}
+
+// bucket returns the bucket with the given ID.  It must be called with s.mu
+// held.
+func (s *Server) bucket(id string) (*bucket, *Error) {
+	b, ok := s.buckets[id]
+	if !ok {
+		return nil, errorf(http.StatusBadRequest, "bad_bucket_id", "invalid bucket ID %q", id)
+	}
+	return b, nil
+}
+
+// bucketNamed returns the bucket with the given name, or nil.  It must be
+// called with s.mu held.
+func (s *Server) bucketNamed(name string) *bucket {
+	for _, b := range s.buckets {
+		if b.name == name {
+			return b
+		}
+	}
+	return nil
+}
+
+func (s *Server) createBucket(body []byte) (interface{}, *Error) {
+	var req b2types.CreateBucketRequest
+	if e := decode(body, &req); e != nil {
+		return nil, e
+	}
+	if !validBucketName(req.Name) {
+		return nil, errorf(http.StatusBadRequest, "bad_request", "invalid bucket name %q", req.Name)
+	}
+	if !validBucketType(req.Type) {
+		return nil, errorf(http.StatusBadRequest, "bad_request", "invalid bucket type %q", req.Type)
+	}
+	if s.bucketNamed(req.Name) != nil {
+		return nil, errorf(http.StatusBadRequest, "duplicate_bucket_name", "bucket name %q is already in use", req.Name)
+	}
+	b := &bucket{
+		id:       s.newID("bucket"),
+		name:     req.Name,
+		typ:      req.Type,
+		info:     req.Info,
+		rules:    req.LifecycleRules,
+		lock:     req.FileLockEnabled,
+		revision: 1,
+		versions: make(map[string][]*file),
+	}
+	s.buckets[b.id] = b
+	return b.response(), nil
+}
+
+func (s *Server) deleteBucket(body []byte) (interface{}, *Error) {
+	var req b2types.DeleteBucketRequest
+	if e := decode(body, &req); e != nil {
+		return nil, e
+	}
+	b, e := s.bucket(req.BucketID)
+	if e != nil {
+		return nil, e
+	}
+	if len(b.versions) > 0 {
+		return nil, errorf(http.StatusBadRequest, "cannot_delete_non_empty_bucket", "bucket %q is not empty", b.name)
+	}
+	delete(s.buckets, b.id)
+	return b.response(), nil
+}
+
+func (s *Server) listBuckets(body []byte) (interface{}, *Error) {
+	var req b2types.ListBucketsRequest
+	if e := decode(body, &req); e != nil {
+		return nil, e
+	}
+	resp := &b2types.ListBucketsResponse{Buckets: []b2types.CreateBucketResponse{}}
+	for _, b := range s.buckets {
+		if (req.Bucket != "" && b.id != req.Bucket) || (req.Name != "" && b.name != req.Name) {
+			continue
+		}
+		resp.Buckets = append(resp.Buckets, *b.response())
+	}
+	sort.Slice(resp.Buckets, func(i, j int) bool { return resp.Buckets[i].Name < resp.Buckets[j].Name })
+	return resp, nil
+}
+
+func (s *Server) updateBucket(body []byte) (interface{}, *Error) {
+	var req b2types.UpdateBucketRequest
+	if e := decode(body, &req); e != nil {
+		return nil, e
+	}
+	b, e := s.bucket(req.BucketID)
+	if e != nil {
+		return nil, e
+	}
+	if req.IfRevisionIs != 0 && req.IfRevisionIs != b.revision {
+		return nil, errorf(http.StatusConflict, "conflict", "bucket revision is %d, not %d", b.revision, req.IfRevisionIs)
+	}
+	if req.Type != "" {
+		if !validBucketType(req.Type) {
+			return nil, errorf(http.StatusBadRequest, "bad_request", "invalid bucket type %q", req.Type)
+		}
+		b.typ = req.Type
+	}
+	if req.Info != nil {
+		b.info = req.Info
+	}
+	if req.LifecycleRules != nil {
+		b.rules = req.LifecycleRules
+	}
+	if req.FileLockEnabled {
+		b.lock = true
+	}
+	b.revision++
+	return b.response(), nil
+}
@@ -0,0 +1,346 @@
+// Copyright 2024, the Blazer authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package b2test
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"unicode/utf8"
+)
+
+// redacted replaces secrets in what a Cassette records.
+const redacted = "REDACTED"
+
+// matchHeaders are the request headers, other than the method, URL, and body,
+// by which a replayed request is matched to a recorded one.
+var matchHeaders = []string{
+	"Range",
+	"X-Bz-File-Name",
+	"X-Bz-Part-Number",
+	"X-Bz-Content-Sha1",
+	"X-Bz-Test-Mode",
+}
+
+// uploadCalls are the calls that are matched by name rather than URL, and
+// whose bodies aren't recorded.
+var uploadCalls = map[string]bool{
+	"b2_upload_file": true,
+	"b2_upload_part": true,
+}
+
+// secretFields are the fields of JSON replies whose values are redacted.
+var secretFields = map[string]bool{
+	"authorizationToken": true,
+	"applicationKey":     true,
+}
+
+// An interaction is a request and its response, as a Cassette stores them.
+type interaction struct {
+	Method   string      `json:"method"`
+	URL      string      `json:"url"`
+	Header   http.Header `json:"header,omitempty"`
+	BodySHA1 string      `json:"bodySha1"`
+	Body     string      `json:"body,omitempty"` // but not the body of an upload
+
+	Status         int         `json:"status"`
+	ResponseHeader http.Header `json:"responseHeader,omitempty"`
+	ResponseBody   string      `json:"responseBody,omitempty"`
+	ResponseBinary []byte      `json:"responseBinary,omitempty"` // if the body isn't UTF-8
+}
+
+func (in *interaction) matches(o *interaction) bool {
+	if in.Method != o.Method || in.URL != o.URL || in.BodySHA1 != o.BodySHA1 {
+		return false
+	}
+	for _, k := range matchHeaders {
+		if in.Header.Get(k) != o.Header.Get(k) {
+			return false
+		}
+	}
+	return true
+}
+
+// A Cassette is an http.RoundTripper that records requests and their
+// responses to a file, or replays them from one, so that tests written
+// against B2 can run without it, or without credentials.  It is safe for
+// concurrent use.
+//
+// Authorization headers aren't recorded, and Authorization query parameters
+// and the tokens and keys in B2's replies are recorded as "REDACTED".  Bodies
+// are matched by their SHA1 hash, and the bodies of uploads aren't recorded at
+// all.  Uploads are matched by the call, and not the rest of their URL, since
+// which upload URL a request is given depends on timing.
+//
+// A request is replayed with the first recorded response to an unreplayed
+// request with the same method, URL, body, and headers that matter to B2,
+// such as Range and X-Bz-File-Name.  The code under test must make the same
+// requests each time, then: with the same names and data, and without
+// randomly injected failures.
+type Cassette struct {
+	path   string
+	rt     http.RoundTripper
+	record bool
+
+	mu     sync.Mutex
+	tape   []*interaction
+	played []bool
+}
+
+// Record returns a Cassette that sends requests through rt, and records them
+// and their responses, to be written to path when it is closed.  If rt is nil,
+// the http.DefaultTransport is used.
+func Record(path string, rt http.RoundTripper) *Cassette {
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	return &Cassette{path: path, rt: rt, record: true}
+}
+
+// Replay returns a Cassette that answers requests with the responses recorded
+// at path, and sends nothing on.
+func Replay(path string) (*Cassette, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c := &Cassette{path: path}
+	if err := json.Unmarshal(data, &c.tape); err != nil {
+		return nil, fmt.Errorf("b2test: %s: %v", path, err)
+	}
+	c.played = make([]bool, len(c.tape))
+	return c, nil
+}
+
+// Close writes what a recording Cassette has recorded to its file.  It does
+// nothing to one that is replaying.
+func (c *Cassette) Close() error {
+	if !c.record {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	data, err := json.MarshalIndent(c.tape, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(c.path, append(data, '\n'), 0644)
+}
+
+// Unplayed returns the number of recorded responses that a replaying Cassette
+// has not yet played back.
+func (c *Cassette) Unplayed() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var n int
+	for _, p := range c.played {
+		if !p {
+			n++
+		}
+	}
+	return n
+}
+
+func (c *Cassette) RoundTrip(req *http.Request) (*http.Response, error) {
+	if c.record {
+		return c.recordTrip(req)
+	}
+	return c.replayTrip(req)
+}
+
+// request returns the interaction that req begins, without its body.
+func request(req *http.Request) *interaction {
+	in := &interaction{Method: req.Method, URL: redactURL(req.URL)}
+	if name, _ := method(req); uploadCalls[name] {
+		in.URL = name
+	}
+	for _, k := range matchHeaders {
+		for _, v := range req.Header.Values(k) {
+			if in.Header == nil {
+				in.Header = make(http.Header)
+			}
+			in.Header.Add(k, v)
+		}
+	}
+	return in
+}
+
+func redactURL(u *url.URL) string {
+	q := u.Query()
+	if _, ok := q["Authorization"]; !ok {
+		return u.String()
+	}
+	q.Set("Authorization", redacted)
+	v := *u
+	v.RawQuery = q.Encode()
+	return v.String()
+}
+
+// A hashReader hashes, and perhaps keeps, what is read through it.
+type hashReader struct {
+	io.ReadCloser
+	h    hash.Hash
+	keep *bytes.Buffer
+}
+
+func (r *hashReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.h.Write(p[:n])
+	if r.keep != nil {
+		r.keep.Write(p[:n])
+	}
+	return n, err
+}
+
+func (r *hashReader) sum() string {
+	return hex.EncodeToString(r.h.Sum(nil))
+}
+
+func (c *Cassette) recordTrip(req *http.Request) (*http.Response, error) {
+	in := request(req)
+	var hr *hashReader
+	if req.Body != nil {
+		hr = &hashReader{ReadCloser: req.Body, h: sha1.New()}
+		if !uploadCalls[in.URL] {
+			hr.keep = &bytes.Buffer{}
+		}
+		// The inner transport reads the body through hr, and mustn't get it
+		// back whole with GetBody.
+		req = req.Clone(req.Context())
+		req.Body = hr
+		req.GetBody = nil
+	}
+	resp, err := c.rt.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	in.BodySHA1 = hex.EncodeToString(sha1.New().Sum(nil))
+	if hr != nil {
+		in.BodySHA1 = hr.sum()
+		if hr.keep != nil {
+			in.Body = hr.keep.String()
+		}
+	}
+	in.Status = resp.StatusCode
+	in.ResponseHeader = resp.Header.Clone()
+	if body = redactJSON(body); utf8.Valid(body) {
+		in.ResponseBody = string(body)
+	} else {
+		in.ResponseBinary = body
+	}
+	c.mu.Lock()
+	c.tape = append(c.tape, in)
+	c.mu.Unlock()
+	return resp, nil
+}
+
+// redactJSON returns body with the secrets in it redacted, if it is a JSON
+// object, or else as it is.
+func redactJSON(body []byte) []byte {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var v map[string]interface{}
+	if err := dec.Decode(&v); err != nil {
+		return body
+	}
+	if !redactValue(v) {
+		return body
+	}
+	out, err := json.Marshal(v)
+	if err != nil {
+		return body
+	}
+	return out
+}
+
+// redactValue redacts the secret fields of v and anything within it, and
+// reports whether there were any.
+func redactValue(v interface{}) bool {
+	var found bool
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, f := range v {
+			if _, ok := f.(string); ok && secretFields[k] {
+				v[k] = redacted
+				found = true
+				continue
+			}
+			found = redactValue(f) || found
+		}
+	case []interface{}:
+		for _, f := range v {
+			found = redactValue(f) || found
+		}
+	}
+	return found
+}
+
+func (c *Cassette) replayTrip(req *http.Request) (*http.Response, error) {
+	in := request(req)
+	h := sha1.New()
+	if req.Body != nil {
+		_, err := io.Copy(h, req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	in.BodySHA1 = hex.EncodeToString(h.Sum(nil))
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, rec := range c.tape {
+		if c.played[i] || !rec.matches(in) {
+			continue
+		}
+		c.played[i] = true
+		body := rec.ResponseBinary
+		if body == nil {
+			body = []byte(rec.ResponseBody)
+		}
+		// Redaction may have changed the length.
+		hdr := rec.ResponseHeader.Clone()
+		if hdr == nil {
+			hdr = make(http.Header)
+		}
+		hdr.Set("Content-Length", fmt.Sprint(len(body)))
+		return &http.Response{
+			Status:        fmt.Sprintf("%d %s", rec.Status, http.StatusText(rec.Status)),
+			StatusCode:    rec.Status,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        hdr,
+			Body:          io.NopCloser(bytes.NewReader(body)),
+			ContentLength: int64(len(body)),
+			Request:       req,
+		}, nil
+	}
+	return nil, fmt.Errorf("b2test: %s: no recorded response to %s %s", c.path, in.Method, in.URL)
+}
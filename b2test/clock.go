@@ -0,0 +1,115 @@
+// Copyright 2024, the Blazer authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package b2test
+
+import (
+	"sync"
+	"time"
+)
+
+// A FakeClock is a clock whose time passes only when it is told to.  Given to
+// a client with the b2.WithClock option, it lets a test retry without waiting,
+// and see how long the client meant to wait; its Now method can be given to a
+// Server's Clock option as well, so that both keep the same time.  It is safe
+// for concurrent use.
+type FakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	auto    bool
+	waits   []time.Duration
+	waiters []waiter
+}
+
+type waiter struct {
+	at time.Time
+	ch chan time.Time
+}
+
+// NewFakeClock returns a FakeClock that reads start until it is advanced.
+func NewFakeClock(start time.Time) *FakeClock {
+	return &FakeClock{now: start}
+}
+
+// Now returns the clock's time.
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// After returns a channel that receives the clock's time once it has been
+// advanced by d, as time.After does.  If the clock advances on waits, it is
+// advanced by d at once.
+func (c *FakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.waits = append(c.waits, d)
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+		return ch
+	}
+	c.waiters = append(c.waiters, waiter{at: c.now.Add(d), ch: ch})
+	if c.auto {
+		c.advance(d)
+	}
+	return ch
+}
+
+// Advance moves the clock forward by d, and wakes whatever has been waiting
+// for that long.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.advance(d)
+}
+
+// advance must be called with c.mu held.
+func (c *FakeClock) advance(d time.Duration) {
+	c.now = c.now.Add(d)
+	var left []waiter
+	for _, w := range c.waiters {
+		if w.at.After(c.now) {
+			left = append(left, w)
+			continue
+		}
+		w.ch <- c.now
+	}
+	c.waiters = left
+}
+
+// AdvanceOnWait sets whether each call to After advances the clock by as long
+// as it waits, so that nothing waiting on the clock is ever held up.
+func (c *FakeClock) AdvanceOnWait(on bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.auto = on
+}
+
+// Waits returns how long each call to After has been asked to wait, in the
+// order they were made.
+func (c *FakeClock) Waits() []time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]time.Duration(nil), c.waits...)
+}
+
+// Waiting returns the number of channels returned by After that have not yet
+// received the time.
+func (c *FakeClock) Waiting() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.waiters)
+}
@@ -0,0 +1,258 @@
+// Copyright 2024, the Blazer authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package b2test
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+)
+
+// ErrDropped is the error with which a FaultTransport cuts off the body of a
+// request or response.
+var ErrDropped = errors.New("b2test: connection dropped")
+
+// A Fault is what a FaultTransport does to a request.  Its effects are
+// applied in the order of its fields.
+type Fault struct {
+	// Delay holds up the request for this long, or until its context is
+	// done.
+	Delay time.Duration
+
+	// Error, if set, is the reply to the request, which is not sent on.
+	Error *Error
+
+	// DropRequest cuts off the request's body, and DropResponse the
+	// response's, with ErrDropped after DropAfter bytes, as though the
+	// connection had been lost.
+	DropRequest  bool
+	DropResponse bool
+	DropAfter    int64
+
+	// CorruptSHA1 changes the SHA1 hash that the request sends for its body,
+	// in the X-Bz-Content-Sha1 header or after the data, and the one that the
+	// response gives in its X-Bz-Content-Sha1 header, so that neither matches
+	// the data.
+	CorruptSHA1 bool
+}
+
+// A Call is a request that a FaultTransport has seen, and what became of it.
+type Call struct {
+	Method  string // the name of the call, such as "b2_upload_file"
+	N       int    // which call of Method it was, counting from 1
+	Request *http.Request
+	Fault   *Fault // what was done to the request, if anything
+
+	// Status is that of the response, and Err the error from the inner
+	// transport, if any.  They are set once the round trip returns.
+	Status int
+	Err    error
+}
+
+type faultKey struct {
+	method string
+	n      int
+}
+
+// A FaultTransport is an http.RoundTripper that sends requests on through
+// another, except for those it has been told to fail.  Given to a client with
+// the b2.Transport option, it makes failures happen exactly where a test
+// wants them, with B2 or with a Server alike.  It is safe for concurrent use.
+type FaultTransport struct {
+	rt http.RoundTripper
+
+	mu     sync.Mutex
+	faults map[faultKey]Fault
+	counts map[string]int
+	calls  []*Call
+}
+
+// NewFaultTransport returns a FaultTransport that sends requests through rt.
+// If rt is nil, the http.DefaultTransport is used.
+func NewFaultTransport(rt http.RoundTripper) *FaultTransport {
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	return &FaultTransport{
+		rt:     rt,
+		faults: make(map[faultKey]Fault),
+		counts: make(map[string]int),
+	}
+}
+
+// Inject makes the nth request for the call named method, counting from 1,
+// meet f, in place of any fault already injected there.  Requests are named
+// as a Server names them; an empty method counts every request.
+func (t *FaultTransport) Inject(method string, n int, f Fault) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.faults[faultKey{method, n}] = f
+}
+
+// Calls returns the requests that the transport has seen, in the order they
+// were made.
+func (t *FaultTransport) Calls() []Call {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	out := make([]Call, len(t.calls))
+	for i, c := range t.calls {
+		out[i] = *c
+	}
+	return out
+}
+
+// Reset forgets every injected fault and every request seen, and starts
+// counting requests from the beginning.
+func (t *FaultTransport) Reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.faults = make(map[faultKey]Fault)
+	t.counts = make(map[string]int)
+	t.calls = nil
+}
+
+// fault counts req, and returns the record of it and the fault it meets, if
+// any.  A fault injected for its call comes before one for every request.
+func (t *FaultTransport) fault(req *http.Request) (*Call, *Fault) {
+	name, _ := method(req)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.counts[""]++
+	if name != "" {
+		t.counts[name]++
+	}
+	c := &Call{Method: name, N: t.counts[name], Request: req}
+	t.calls = append(t.calls, c)
+	for _, k := range []faultKey{{name, t.counts[name]}, {"", t.counts[""]}} {
+		if f, ok := t.faults[k]; ok {
+			c.Fault = &f
+			break
+		}
+	}
+	return c, c.Fault
+}
+
+func (t *FaultTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	c, f := t.fault(req)
+	resp, err := t.roundTrip(req, f)
+	t.mu.Lock()
+	if resp != nil {
+		c.Status = resp.StatusCode
+	}
+	c.Err = err
+	t.mu.Unlock()
+	return resp, err
+}
+
+func (t *FaultTransport) roundTrip(req *http.Request, f *Fault) (*http.Response, error) {
+	if f == nil {
+		return t.rt.RoundTrip(req)
+	}
+	if f.Delay > 0 {
+		tm := time.NewTimer(f.Delay)
+		select {
+		case <-tm.C:
+		case <-req.Context().Done():
+			tm.Stop()
+			if req.Body != nil {
+				req.Body.Close()
+			}
+			return nil, req.Context().Err()
+		}
+	}
+	if f.Error != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		w := httptest.NewRecorder()
+		reply(w, nil, f.Error)
+		resp := w.Result()
+		resp.Request = req
+		return resp, nil
+	}
+	if f.CorruptSHA1 || f.DropRequest {
+		// A RoundTripper mustn't change the request it is given, and the
+		// inner one mustn't get the body back whole with GetBody.
+		req = req.Clone(req.Context())
+		req.GetBody = nil
+	}
+	if f.CorruptSHA1 {
+		switch sha := req.Header.Get("X-Bz-Content-Sha1"); {
+		case sha == "hex_digits_at_end" && req.Body != nil && req.ContentLength >= 40:
+			req.Body = &corruptReader{ReadCloser: req.Body, at: req.ContentLength - 40}
+		case len(sha) == 40:
+			req.Header.Set("X-Bz-Content-Sha1", corrupt(sha))
+		}
+	}
+	if f.DropRequest && req.Body != nil {
+		req.Body = &dropReader{ReadCloser: req.Body, left: f.DropAfter}
+	}
+	resp, err := t.rt.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if sha := resp.Header.Get("X-Bz-Content-Sha1"); f.CorruptSHA1 && len(sha) == 40 {
+		resp.Header.Set("X-Bz-Content-Sha1", corrupt(sha))
+	}
+	if f.DropResponse {
+		resp.Body = &dropReader{ReadCloser: resp.Body, left: f.DropAfter}
+	}
+	return resp, nil
+}
+
+// corrupt returns the hex digits of sha with the first changed.
+func corrupt(sha string) string {
+	c := byte('0')
+	if sha[0] == '0' {
+		c = '1'
+	}
+	return string(c) + sha[1:]
+}
+
+// A corruptReader changes the hex digit at offset at as corrupt does.
+type corruptReader struct {
+	io.ReadCloser
+	at, off int64
+}
+
+func (r *corruptReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if i := r.at - r.off; 0 <= i && i < int64(n) {
+		p[i] = corrupt(string(p[i : i+1]))[0]
+	}
+	r.off += int64(n)
+	return n, err
+}
+
+// A dropReader fails with ErrDropped once left bytes have been read.
+type dropReader struct {
+	io.ReadCloser
+	left int64
+}
+
+func (r *dropReader) Read(p []byte) (int, error) {
+	if r.left <= 0 {
+		return 0, ErrDropped
+	}
+	if int64(len(p)) > r.left {
+		p = p[:r.left]
+	}
+	n, err := r.ReadCloser.Read(p)
+	r.left -= int64(n)
+	return n, err
+}
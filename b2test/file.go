@@ -0,0 +1,659 @@
+// Copyright 2024, the Blazer authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package b2test
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Backblaze/blazer/base"
+	"github.com/Backblaze/blazer/internal/b2types"
+)
+
+// List calls return at most maxListCount files, and defaultListCount if the
+// caller doesn't say.
+const (
+	defaultListCount = 100
+	maxListCount     = 10000
+)
+
+// maxDownloadAuthorization is the longest validity of a download
+// authorization, in seconds.
+const maxDownloadAuthorization = 7 * 24 * 60 * 60
+
+// A file is one version of an object.  Its data is never changed once it has
+// been stored, so it may be read without holding s.mu.
+type file struct {
+	id, name    string
+	bucketID    string
+	data        []byte
+	sha1        string
+	contentType string
+	info        map[string]string
+	action      string // "upload" or "hide", or "folder" in listings
+	stamp       int64  // milliseconds since the epoch
+}
+
+func (f *file) response(account string) b2types.GetFileInfoResponse {
+	if f.action == "folder" {
+		return b2types.GetFileInfoResponse{Name: f.name, Action: f.action}
+	}
+	return b2types.GetFileInfoResponse{
+		FileID:      f.id,
+		Name:        f.name,
+		AccountID:   account,
+		BucketID:    f.bucketID,
+		Size:        int64(len(f.data)),
+		SHA1:        f.sha1,
+		ContentType: f.contentType,
+		Info:        f.info,
+		Action:      f.action,
+		Timestamp:   f.stamp,
+	}
+}
+
+func (s *Server) getUploadURL(body []byte) (interface{}, *Error) {
+	var req b2types.GetUploadURLRequest
+	if e := decode(body, &req); e != nil {
+		return nil, e
+	}
+	if _, e := s.bucket(req.BucketID); e != nil {
+		return nil, e
+	}
+	return &b2types.GetUploadURLResponse{
+		URI:   s.URL + b2types.V1api + "b2_upload_file/" + req.BucketID,
+		Token: s.newToken(&token{kind: uploadToken, target: req.BucketID}),
+	}, nil
+}
+
+// upload is the body and headers of an upload, checked against each other.
+type upload struct {
+	contentType string
+	sha1        string
+	info        map[string]string
+	data        []byte
+}
+
+// readUpload reads the upload that r makes, and checks its SHA1, including one
+// sent after the data when the X-Bz-Content-Sha1 header is
+// "hex_digits_at_end".
+func readUpload(r *http.Request) (*upload, *Error) {
+	u := &upload{
+		contentType: r.Header.Get("Content-Type"),
+		sha1:        r.Header.Get("X-Bz-Content-Sha1"),
+	}
+	if r.ContentLength < 0 {
+		return nil, errorf(http.StatusLengthRequired, "bad_request", "Content-Length is required")
+	}
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, errorf(http.StatusBadRequest, "bad_request", "%v", err)
+	}
+	if u.sha1 == "hex_digits_at_end" {
+		if len(data) < 40 {
+			return nil, errorf(http.StatusBadRequest, "bad_request", "no SHA1 at the end of the data")
+		}
+		data, u.sha1 = data[:len(data)-40], string(data[len(data)-40:])
+	}
+	sum := sha1.Sum(data)
+	if got := hex.EncodeToString(sum[:]); u.sha1 != "do_not_verify" && !strings.EqualFold(got, u.sha1) {
+		return nil, errorf(http.StatusBadRequest, "bad_request", "SHA1 %s does not match the data, whose SHA1 is %s", u.sha1, got)
+	}
+	u.sha1 = hex.EncodeToString(sum[:])
+	u.data = data
+	u.info = make(map[string]string)
+	for k := range r.Header {
+		if !strings.HasPrefix(k, "X-Bz-Info-") {
+			continue
+		}
+		v, err := base.Unescape(r.Header.Get(k))
+		if err != nil {
+			return nil, errorf(http.StatusBadRequest, "bad_request", "%s: %v", k, err)
+		}
+		// Like B2, keep keys in lowercase.
+		u.info[strings.ToLower(strings.TrimPrefix(k, "X-Bz-Info-"))] = v
+	}
+	return u, nil
+}
+
+// checkUploadToken checks that r is authorized by a token of the given kind
+// for target, and that the test modes r asks for don't fail it.  It must be
+// called with s.mu held.
+func (s *Server) checkUploadToken(r *http.Request, kind tokenKind, target string) *Error {
+	t, ok := s.tokens[r.Header.Get("Authorization")]
+	if !ok || t.kind != kind || t.target != target {
+		return errorf(http.StatusUnauthorized, "bad_auth_token", "invalid upload authorization token")
+	}
+	if t.expired {
+		return errorf(http.StatusUnauthorized, "expired_auth_token", "upload authorization token has expired")
+	}
+	if testMode(r, "force_cap_exceeded") {
+		return errorf(http.StatusForbidden, "storage_cap_exceeded", "storage cap exceeded")
+	}
+	if testMode(r, "fail_some_uploads") {
+		s.uploads++
+		if s.uploads%3 == 0 {
+			return errorf(http.StatusServiceUnavailable, "service_unavailable", "upload failed, as asked")
+		}
+	}
+	return nil
+}
+
+func (s *Server) uploadFile(r *http.Request, bucketID string) (interface{}, *Error) {
+	name, err := base.Unescape(r.Header.Get("X-Bz-File-Name"))
+	if err != nil {
+		return nil, errorf(http.StatusBadRequest, "bad_request", "X-Bz-File-Name: %v", err)
+	}
+	if name == "" {
+		return nil, errorf(http.StatusBadRequest, "bad_request", "X-Bz-File-Name is required")
+	}
+	// Read the body before taking the lock, so that uploads go on together.
+	u, ue := readUpload(r)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e := s.checkUploadToken(r, uploadToken, bucketID); e != nil {
+		return nil, e
+	}
+	if ue != nil {
+		return nil, ue
+	}
+	b, e := s.bucket(bucketID)
+	if e != nil {
+		return nil, e
+	}
+	ct := u.contentType
+	if ct == "" || ct == "b2/x-auto" {
+		ct = mime.TypeByExtension(path.Ext(name))
+		if ct == "" {
+			ct = "application/octet-stream"
+		}
+	}
+	f := &file{
+		id:          s.newID("file"),
+		name:        name,
+		bucketID:    b.id,
+		data:        u.data,
+		sha1:        u.sha1,
+		contentType: ct,
+		info:        u.info,
+		action:      "upload",
+		stamp:       s.now(),
+	}
+	s.add(b, f)
+	resp := f.response(s.account)
+	return &resp, nil
+}
+
+// add stores f as the newest version of its name.  It must be called with s.mu
+// held.
+func (s *Server) add(b *bucket, f *file) {
+	b.versions[f.name] = append([]*file{f}, b.versions[f.name]...)
+	s.files[f.id] = f
+}
+
+// listing returns, in order, the files that a listing of b shows: every version
+// of each name if versions is set, or else the newest version of each name,
+// if it is an upload.  Names that contain delim after prefix are shown as one
+// folder for each distinct part up to delim.  It must be called with s.mu held.
+func (b *bucket) listing(prefix, delim string, versions bool) []*file {
+	all := b.versions
+	if b.listed != nil {
+		all = b.listed
+	}
+	var names []string
+	for name := range all {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	var out []*file
+	var folder string
+	for _, name := range names {
+		if folder != "" && strings.HasPrefix(name, folder) {
+			continue
+		}
+		vs := all[name]
+		if !versions && vs[0].action != "upload" {
+			continue
+		}
+		if i := strings.Index(name[len(prefix):], delim); delim != "" && i >= 0 {
+			folder = name[:len(prefix)+i+len(delim)]
+			out = append(out, &file{name: folder, action: "folder"})
+			continue
+		}
+		if !versions {
+			vs = vs[:1]
+		}
+		out = append(out, vs...)
+	}
+	return out
+}
+
+// page returns up to count of files, starting at the first with name, or at
+// the version with ID if it exists, and the name and ID of the file after.
+func page(files []*file, count int, name, id string) ([]*file, string, string) {
+	if count <= 0 {
+		count = defaultListCount
+	}
+	if count > maxListCount {
+		count = maxListCount
+	}
+	i := sort.Search(len(files), func(i int) bool { return files[i].name >= name })
+	if id != "" {
+		for j := i; j < len(files) && files[j].name == name; j++ {
+			if files[j].id == id {
+				i = j
+				break
+			}
+		}
+	}
+	files = files[i:]
+	if len(files) <= count {
+		return files, "", ""
+	}
+	return files[:count], files[count].name, files[count].id
+}
+
+func (s *Server) responses(files []*file) []b2types.GetFileInfoResponse {
+	out := make([]b2types.GetFileInfoResponse, 0, len(files))
+	for _, f := range files {
+		out = append(out, f.response(s.account))
+	}
+	return out
+}
+
+func (s *Server) listFileNames(body []byte) (interface{}, *Error) {
+	var req b2types.ListFileNamesRequest
+	if e := decode(body, &req); e != nil {
+		return nil, e
+	}
+	b, e := s.bucket(req.BucketID)
+	if e != nil {
+		return nil, e
+	}
+	files, next, _ := page(b.listing(req.Prefix, req.Delimiter, false), req.Count, req.Continuation, "")
+	return &b2types.ListFileNamesResponse{
+		Continuation: next,
+		Files:        s.responses(files),
+	}, nil
+}
+
+func (s *Server) listFileVersions(body []byte) (interface{}, *Error) {
+	var req b2types.ListFileVersionsRequest
+	if e := decode(body, &req); e != nil {
+		return nil, e
+	}
+	b, e := s.bucket(req.BucketID)
+	if e != nil {
+		return nil, e
+	}
+	files, name, id := page(b.listing(req.Prefix, req.Delimiter, true), req.Count, req.StartName, req.StartID)
+	return &b2types.ListFileVersionsResponse{
+		NextName: name,
+		NextID:   id,
+		Files:    s.responses(files),
+	}, nil
+}
+
+func (s *Server) getFileInfo(body []byte) (interface{}, *Error) {
+	var req b2types.GetFileInfoRequest
+	if e := decode(body, &req); e != nil {
+		return nil, e
+	}
+	if l, ok := s.large[req.ID]; ok {
+		resp := l.response(s.account)
+		return &resp, nil
+	}
+	f, ok := s.files[req.ID]
+	if !ok {
+		return nil, errorf(http.StatusNotFound, "not_found", "file not present: %s", req.ID)
+	}
+	resp := f.response(s.account)
+	return &resp, nil
+}
+
+func (s *Server) deleteFileVersion(body []byte) (interface{}, *Error) {
+	var req b2types.DeleteFileVersionRequest
+	if e := decode(body, &req); e != nil {
+		return nil, e
+	}
+	// Deleting an unfinished large file cancels it.
+	if l, ok := s.large[req.FileID]; ok && l.name == req.Name {
+		delete(s.large, l.id)
+		return &b2types.DeleteFileVersionRequest{Name: l.name, FileID: l.id}, nil
+	}
+	f, ok := s.files[req.FileID]
+	if !ok || f.name != req.Name {
+		return nil, errorf(http.StatusBadRequest, "file_not_present", "file not present: %s %s", req.Name, req.FileID)
+	}
+	s.remove(f)
+	return &b2types.DeleteFileVersionRequest{Name: f.name, FileID: f.id}, nil
+}
+
+// remove deletes the version f.  It must be called with s.mu held.
+func (s *Server) remove(f *file) {
+	b := s.buckets[f.bucketID]
+	vs := b.versions[f.name]
+	for i, v := range vs {
+		if v == f {
+			vs = append(vs[:i:i], vs[i+1:]...)
+			break
+		}
+	}
+	if len(vs) == 0 {
+		delete(b.versions, f.name)
+	} else {
+		b.versions[f.name] = vs
+	}
+	delete(s.files, f.id)
+}
+
+// hide stores a hide marker as the newest version of name.  It must be called
+// with s.mu held.
+func (s *Server) hide(b *bucket, name string) *file {
+	f := &file{
+		id:       s.newID("file"),
+		name:     name,
+		bucketID: b.id,
+		action:   "hide",
+		stamp:    s.now(),
+	}
+	s.add(b, f)
+	return f
+}
+
+func (s *Server) hideFile(body []byte) (interface{}, *Error) {
+	var req b2types.HideFileRequest
+	if e := decode(body, &req); e != nil {
+		return nil, e
+	}
+	b, e := s.bucket(req.BucketID)
+	if e != nil {
+		return nil, e
+	}
+	vs := b.versions[req.File]
+	if len(vs) == 0 {
+		return nil, errorf(http.StatusBadRequest, "file_not_present", "file not present: %s", req.File)
+	}
+	if vs[0].action == "hide" {
+		return nil, errorf(http.StatusBadRequest, "already_hidden", "file already hidden: %s", req.File)
+	}
+	f := s.hide(b, req.File)
+	resp := f.response(s.account)
+	return &resp, nil
+}
+
+func (s *Server) copyFile(body []byte) (interface{}, *Error) {
+	var req b2types.CopyFileRequest
+	if e := decode(body, &req); e != nil {
+		return nil, e
+	}
+	src, ok := s.files[req.SourceID]
+	if !ok || src.action != "upload" {
+		return nil, errorf(http.StatusBadRequest, "bad_request", "file not present: %s", req.SourceID)
+	}
+	b, e := s.bucket(src.bucketID)
+	if req.DestBucketID != "" {
+		b, e = s.bucket(req.DestBucketID)
+	}
+	if e != nil {
+		return nil, e
+	}
+	if req.Name == "" {
+		return nil, errorf(http.StatusBadRequest, "bad_request", "fileName is required")
+	}
+	off, n, _, e := byteRange(req.Range, int64(len(src.data)))
+	if e != nil {
+		return nil, e
+	}
+	data := src.data[off : off+n]
+	sum := sha1.Sum(data)
+	f := &file{
+		id:          s.newID("file"),
+		name:        req.Name,
+		bucketID:    b.id,
+		data:        data,
+		sha1:        hex.EncodeToString(sum[:]),
+		contentType: src.contentType,
+		info:        src.info,
+		action:      "upload",
+		stamp:       s.now(),
+	}
+	switch req.MetadataDirective {
+	case "", "COPY":
+		if req.ContentType != "" || req.Info != nil {
+			return nil, errorf(http.StatusBadRequest, "bad_request", "contentType and fileInfo are only allowed with the REPLACE metadataDirective")
+		}
+	case "REPLACE":
+		if req.ContentType == "" {
+			return nil, errorf(http.StatusBadRequest, "bad_request", "contentType is required with the REPLACE metadataDirective")
+		}
+		f.contentType, f.info = req.ContentType, req.Info
+		if f.info == nil {
+			f.info = make(map[string]string)
+		}
+	default:
+		return nil, errorf(http.StatusBadRequest, "bad_request", "invalid metadataDirective %q", req.MetadataDirective)
+	}
+	s.add(b, f)
+	resp := f.response(s.account)
+	return &resp, nil
+}
+
+// overrideParams are the b2* query parameters that a download may send, and
+// the headers in which they are served.
+var overrideParams = map[string]string{
+	"b2ContentDisposition": "Content-Disposition",
+	"b2ContentLanguage":    "Content-Language",
+	"b2Expires":            "Expires",
+	"b2CacheControl":       "Cache-Control",
+	"b2ContentEncoding":    "Content-Encoding",
+	"b2ContentType":        "Content-Type",
+}
+
+func (s *Server) getDownloadAuthorization(body []byte) (interface{}, *Error) {
+	var req b2types.GetDownloadAuthorizationRequest
+	if e := decode(body, &req); e != nil {
+		return nil, e
+	}
+	if _, e := s.bucket(req.BucketID); e != nil {
+		return nil, e
+	}
+	if req.Valid < 1 || req.Valid > maxDownloadAuthorization {
+		return nil, errorf(http.StatusBadRequest, "bad_request", "validDurationInSeconds must be between 1 and %d", maxDownloadAuthorization)
+	}
+	overrides := make(map[string]string)
+	for k, v := range map[string]string{
+		"b2ContentDisposition": req.ContentDisposition,
+		"b2ContentLanguage":    req.ContentLanguage,
+		"b2Expires":            req.Expires,
+		"b2CacheControl":       req.CacheControl,
+		"b2ContentEncoding":    req.ContentEncoding,
+		"b2ContentType":        req.ContentType,
+	} {
+		if v != "" {
+			overrides[k] = v
+		}
+	}
+	return &b2types.GetDownloadAuthorizationResponse{
+		BucketID: req.BucketID,
+		Prefix:   req.Prefix,
+		Token: s.newToken(&token{
+			kind:      downloadToken,
+			target:    req.BucketID,
+			prefix:    req.Prefix,
+			expires:   s.clock().Add(time.Duration(req.Valid) * time.Second),
+			overrides: overrides,
+		}),
+	}, nil
+}
+
+// checkDownload checks that r may download name from b.  Objects in public
+// buckets may be downloaded by anyone; others need an account token, or a
+// download token for a prefix of name, sent in the Authorization header or
+// query parameter.  It must be called with s.mu held.
+func (s *Server) checkDownload(r *http.Request, b *bucket, name string) *Error {
+	if b.typ == "allPublic" {
+		return nil
+	}
+	id := r.Header.Get("Authorization")
+	if id == "" {
+		id = r.URL.Query().Get("Authorization")
+	}
+	t, ok := s.tokens[id]
+	if !ok || t.kind == uploadToken {
+		return errorf(http.StatusUnauthorized, "bad_auth_token", "invalid authorization token")
+	}
+	if t.expired {
+		return errorf(http.StatusUnauthorized, "expired_auth_token", "authorization token has expired")
+	}
+	if t.kind == accountToken {
+		return nil
+	}
+	if t.target != b.id || !strings.HasPrefix(name, t.prefix) {
+		return errorf(http.StatusUnauthorized, "unauthorized", "token is not valid for %s", name)
+	}
+	if s.clock().After(t.expires) {
+		return errorf(http.StatusUnauthorized, "expired_auth_token", "download authorization has expired")
+	}
+	q := r.URL.Query()
+	for k, v := range t.overrides {
+		if q.Get(k) != v {
+			return errorf(http.StatusUnauthorized, "unauthorized", "token requires %s=%s", k, v)
+		}
+	}
+	return nil
+}
+
+// byteRange parses the Range header of a download of size bytes, and returns
+// the first byte and the number of bytes to send, and whether the header asked
+// for a range at all.
+func byteRange(hdr string, size int64) (off, n int64, ranged bool, e *Error) {
+	if hdr == "" {
+		return 0, size, false, nil
+	}
+	bad := errorf(http.StatusBadRequest, "bad_request", "invalid Range %q", hdr)
+	spec := strings.TrimPrefix(hdr, "bytes=")
+	first, last, ok := strings.Cut(spec, "-")
+	if spec == hdr || !ok || strings.Contains(spec, ",") {
+		return 0, 0, false, bad
+	}
+	if first == "" {
+		// The final bytes.
+		k, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || k <= 0 {
+			return 0, 0, false, bad
+		}
+		if k > size {
+			k = size
+		}
+		return size - k, k, true, nil
+	}
+	off, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || off < 0 {
+		return 0, 0, false, bad
+	}
+	if off >= size {
+		return 0, 0, false, errorf(http.StatusRequestedRangeNotSatisfiable, "range_not_satisfiable", "range %q is past the end of %d bytes", hdr, size)
+	}
+	end := size - 1
+	if last != "" {
+		end, err = strconv.ParseInt(last, 10, 64)
+		if err != nil || end < off {
+			return 0, 0, false, bad
+		}
+		if end >= size {
+			end = size - 1
+		}
+	}
+	return off, end - off + 1, true, nil
+}
+
+func (s *Server) downloadFileByName(w http.ResponseWriter, r *http.Request, p string) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		reply(w, nil, errorf(http.StatusMethodNotAllowed, "method_not_allowed", "downloads take GET or HEAD"))
+		return
+	}
+	bucketName, name, _ := strings.Cut(p, "/")
+	s.mu.Lock()
+	f, e := s.downloadable(r, bucketName, name)
+	s.mu.Unlock()
+	if e != nil {
+		reply(w, nil, e)
+		return
+	}
+	size := int64(len(f.data))
+	off, n, ranged, e := byteRange(r.Header.Get("Range"), size)
+	if e != nil {
+		reply(w, nil, e)
+		return
+	}
+	hdr := w.Header()
+	hdr.Set("Content-Type", f.contentType)
+	hdr.Set("Content-Length", strconv.FormatInt(n, 10))
+	hdr.Set("X-Bz-File-Id", f.id)
+	hdr.Set("X-Bz-File-Name", base.Escape(f.name))
+	hdr.Set("X-Bz-Content-Sha1", f.sha1)
+	hdr.Set("X-Bz-Upload-Timestamp", strconv.FormatInt(f.stamp, 10))
+	hdr.Set("Accept-Ranges", "bytes")
+	for k, v := range f.info {
+		hdr.Set("X-Bz-Info-"+base.Escape(k), base.Escape(v))
+		if h := strings.TrimPrefix(k, "b2-"); h != k {
+			hdr.Set(h, v)
+		}
+	}
+	q := r.URL.Query()
+	for param, h := range overrideParams {
+		if v := q.Get(param); v != "" {
+			hdr.Set(h, v)
+		}
+	}
+	status := http.StatusOK
+	if ranged {
+		hdr.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", off, off+n-1, size))
+		status = http.StatusPartialContent
+	}
+	w.WriteHeader(status)
+	if r.Method == http.MethodGet {
+		w.Write(f.data[off : off+n])
+	}
+}
+
+// downloadable returns the newest version of name in the named bucket, if r
+// may download it.  It must be called with s.mu held.
+func (s *Server) downloadable(r *http.Request, bucketName, name string) (*file, *Error) {
+	b := s.bucketNamed(bucketName)
+	if b == nil {
+		return nil, errorf(http.StatusNotFound, "not_found", "bucket %q does not exist", bucketName)
+	}
+	if e := s.checkDownload(r, b, name); e != nil {
+		return nil, e
+	}
+	vs := b.versions[name]
+	if len(vs) == 0 || vs[0].action != "upload" {
+		return nil, errorf(http.StatusNotFound, "not_found", "file not present: %s", name)
+	}
+	return vs[0], nil
+}
@@ -0,0 +1,334 @@
+// Copyright 2024, the Blazer authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package b2test
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Backblaze/blazer/internal/b2types"
+)
+
+// A large file may have parts numbered from 1 to maxParts.
+const maxParts = 10000
+
+// A largeFile is a large file that has been started but not yet finished or
+// canceled.
+type largeFile struct {
+	id, name    string
+	bucketID    string
+	contentType string
+	info        map[string]string
+	stamp       int64
+	parts       map[int]*part
+}
+
+// A part is one uploaded part of a large file.  Like a file's, its data is
+// never changed once it has been stored.
+type part struct {
+	number int
+	data   []byte
+	sha1   string
+	stamp  int64
+}
+
+func (l *largeFile) response(account string) b2types.GetFileInfoResponse {
+	return b2types.GetFileInfoResponse{
+		FileID:      l.id,
+		Name:        l.name,
+		AccountID:   account,
+		BucketID:    l.bucketID,
+		ContentType: l.contentType,
+		Info:        l.info,
+		Action:      "start",
+		Timestamp:   l.stamp,
+	}
+}
+
+// largeFile returns the unfinished large file with the given ID.  It must be
+// called with s.mu held.
+func (s *Server) largeFile(id string) (*largeFile, *Error) {
+	l, ok := s.large[id]
+	if !ok {
+		return nil, errorf(http.StatusBadRequest, "bad_request", "no unfinished large file with ID %q", id)
+	}
+	return l, nil
+}
+
+func (s *Server) startLargeFile(body []byte) (interface{}, *Error) {
+	var req b2types.StartLargeFileRequest
+	if e := decode(body, &req); e != nil {
+		return nil, e
+	}
+	b, e := s.bucket(req.BucketID)
+	if e != nil {
+		return nil, e
+	}
+	if req.Name == "" {
+		return nil, errorf(http.StatusBadRequest, "bad_request", "fileName is required")
+	}
+	if req.ContentType == "" {
+		return nil, errorf(http.StatusBadRequest, "bad_request", "contentType is required")
+	}
+	info := make(map[string]string, len(req.Info))
+	for k, v := range req.Info {
+		info[strings.ToLower(k)] = v
+	}
+	l := &largeFile{
+		id:          s.newID("file"),
+		name:        req.Name,
+		bucketID:    b.id,
+		contentType: req.ContentType,
+		info:        info,
+		stamp:       s.now(),
+		parts:       make(map[int]*part),
+	}
+	s.large[l.id] = l
+	resp := l.response(s.account)
+	return &resp, nil
+}
+
+// As in base, these are not in b2types.
+type getUploadPartURLRequest struct {
+	ID string `json:"fileId"`
+}
+
+type getUploadPartURLResponse struct {
+	ID    string `json:"fileId"`
+	URL   string `json:"uploadUrl"`
+	Token string `json:"authorizationToken"`
+}
+
+func (s *Server) getUploadPartURL(body []byte) (interface{}, *Error) {
+	var req getUploadPartURLRequest
+	if e := decode(body, &req); e != nil {
+		return nil, e
+	}
+	if _, e := s.largeFile(req.ID); e != nil {
+		return nil, e
+	}
+	return &getUploadPartURLResponse{
+		ID:    req.ID,
+		URL:   s.URL + b2types.V1api + "b2_upload_part/" + req.ID,
+		Token: s.newToken(&token{kind: partToken, target: req.ID}),
+	}, nil
+}
+
+type uploadPartResponse struct {
+	FileID    string `json:"fileId"`
+	Number    int    `json:"partNumber"`
+	Size      int64  `json:"contentLength"`
+	SHA1      string `json:"contentSha1"`
+	Timestamp int64  `json:"uploadTimestamp"`
+}
+
+func (s *Server) uploadPart(r *http.Request, fileID string) (interface{}, *Error) {
+	n, err := strconv.Atoi(r.Header.Get("X-Bz-Part-Number"))
+	if err != nil || n < 1 || n > maxParts {
+		return nil, errorf(http.StatusBadRequest, "bad_request", "X-Bz-Part-Number must be between 1 and %d", maxParts)
+	}
+	u, ue := readUpload(r)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e := s.checkUploadToken(r, partToken, fileID); e != nil {
+		return nil, e
+	}
+	if ue != nil {
+		return nil, ue
+	}
+	l, e := s.largeFile(fileID)
+	if e != nil {
+		return nil, e
+	}
+	// A part uploaded again replaces the one before.
+	p := &part{number: n, data: u.data, sha1: u.sha1, stamp: s.now()}
+	l.parts[n] = p
+	return &uploadPartResponse{
+		FileID:    l.id,
+		Number:    p.number,
+		Size:      int64(len(p.data)),
+		SHA1:      p.sha1,
+		Timestamp: p.stamp,
+	}, nil
+}
+
+func (s *Server) listParts(body []byte) (interface{}, *Error) {
+	var req b2types.ListPartsRequest
+	if e := decode(body, &req); e != nil {
+		return nil, e
+	}
+	l, e := s.largeFile(req.ID)
+	if e != nil {
+		return nil, e
+	}
+	count := req.Count
+	if count <= 0 {
+		count = defaultListCount
+	}
+	if count > maxListCount {
+		count = maxListCount
+	}
+	var numbers []int
+	for n := range l.parts {
+		if n >= req.Start {
+			numbers = append(numbers, n)
+		}
+	}
+	sort.Ints(numbers)
+	resp := &b2types.ListPartsResponse{}
+	if len(numbers) > count {
+		resp.Next = numbers[count]
+		numbers = numbers[:count]
+	}
+	parts := make([]struct {
+		ID     string `json:"fileId"`
+		Number int    `json:"partNumber"`
+		SHA1   string `json:"contentSha1"`
+		Size   int64  `json:"contentLength"`
+	}, len(numbers))
+	for i, n := range numbers {
+		p := l.parts[n]
+		parts[i].ID, parts[i].Number, parts[i].SHA1, parts[i].Size = l.id, n, p.sha1, int64(len(p.data))
+	}
+	resp.Parts = parts
+	return resp, nil
+}
+
+// finishLargeFile checks that the parts uploaded are those of partSha1Array,
+// numbered from 1 without gaps, and that every part but the last is at least the
+// absolute minimum part size, and stores their data as one version.
+func (s *Server) finishLargeFile(body []byte) (interface{}, *Error) {
+	var req b2types.FinishLargeFileRequest
+	if e := decode(body, &req); e != nil {
+		return nil, e
+	}
+	l, e := s.largeFile(req.ID)
+	if e != nil {
+		return nil, e
+	}
+	if len(req.Hashes) == 0 {
+		return nil, errorf(http.StatusBadRequest, "bad_request", "partSha1Array is empty")
+	}
+	if len(req.Hashes) != len(l.parts) {
+		return nil, errorf(http.StatusBadRequest, "bad_request", "%d parts were uploaded, but partSha1Array has %d", len(l.parts), len(req.Hashes))
+	}
+	var size int
+	for i, h := range req.Hashes {
+		p, ok := l.parts[i+1]
+		if !ok {
+			return nil, errorf(http.StatusBadRequest, "bad_request", "part %d was not uploaded", i+1)
+		}
+		if !strings.EqualFold(p.sha1, h) {
+			return nil, errorf(http.StatusBadRequest, "bad_request", "part %d has SHA1 %s, not %s", i+1, p.sha1, h)
+		}
+		if i < len(req.Hashes)-1 && len(p.data) < s.minPartSize {
+			return nil, errorf(http.StatusBadRequest, "bad_request", "part %d is %d bytes, less than the minimum of %d", i+1, len(p.data), s.minPartSize)
+		}
+		size += len(p.data)
+	}
+	data := make([]byte, 0, size)
+	for i := range req.Hashes {
+		data = append(data, l.parts[i+1].data...)
+	}
+	b, e := s.bucket(l.bucketID)
+	if e != nil {
+		return nil, e
+	}
+	f := &file{
+		id:          l.id,
+		name:        l.name,
+		bucketID:    b.id,
+		data:        data,
+		sha1:        "none",
+		contentType: l.contentType,
+		info:        l.info,
+		action:      "upload",
+		stamp:       l.stamp,
+	}
+	delete(s.large, l.id)
+	s.add(b, f)
+	return &b2types.FinishLargeFileResponse{
+		Name:        f.name,
+		FileID:      f.id,
+		Timestamp:   f.stamp,
+		Action:      f.action,
+		Size:        int64(len(f.data)),
+		SHA1:        f.sha1,
+		ContentType: f.contentType,
+		Info:        f.info,
+	}, nil
+}
+
+type cancelLargeFileResponse struct {
+	FileID    string `json:"fileId"`
+	AccountID string `json:"accountId"`
+	BucketID  string `json:"bucketId"`
+	Name      string `json:"fileName"`
+}
+
+func (s *Server) cancelLargeFile(body []byte) (interface{}, *Error) {
+	var req b2types.CancelLargeFileRequest
+	if e := decode(body, &req); e != nil {
+		return nil, e
+	}
+	l, e := s.largeFile(req.ID)
+	if e != nil {
+		return nil, e
+	}
+	delete(s.large, l.id)
+	return &cancelLargeFileResponse{
+		FileID:    l.id,
+		AccountID: s.account,
+		BucketID:  l.bucketID,
+		Name:      l.name,
+	}, nil
+}
+
+func (s *Server) listUnfinishedLargeFiles(body []byte) (interface{}, *Error) {
+	var req b2types.ListUnfinishedLargeFilesRequest
+	if e := decode(body, &req); e != nil {
+		return nil, e
+	}
+	b, e := s.bucket(req.BucketID)
+	if e != nil {
+		return nil, e
+	}
+	count := req.Count
+	if count <= 0 {
+		count = defaultListCount
+	}
+	if count > maxListCount {
+		count = maxListCount
+	}
+	var files []*largeFile
+	for _, l := range s.large {
+		if l.bucketID == b.id && l.id >= req.Continuation {
+			files = append(files, l)
+		}
+	}
+	// IDs are handed out in order, so this lists the files oldest first.
+	sort.Slice(files, func(i, j int) bool { return files[i].id < files[j].id })
+	resp := &b2types.ListUnfinishedLargeFilesResponse{Files: []b2types.GetFileInfoResponse{}}
+	if len(files) > count {
+		resp.Continuation = files[count].id
+		files = files[:count]
+	}
+	for _, l := range files {
+		resp.Files = append(resp.Files, l.response(s.account))
+	}
+	return resp, nil
+}
@@ -0,0 +1,76 @@
+// Copyright 2024, the Blazer authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package b2test
+
+import (
+	"strings"
+
+	"github.com/Backblaze/blazer/internal/b2types"
+)
+
+// day is a day in milliseconds.
+const day = 24 * 60 * 60 * 1000
+
+// RunLifecycle applies the lifecycle rules of every bucket, as B2 does once a
+// day, as of the time on the server's clock.  For each rule, objects whose
+// names begin with its prefix are hidden once their current version is
+// DaysNewUntilHidden old, versions that are no longer current are deleted
+// DaysHiddenUntilDeleted after they were superseded, as are hide markers with
+// nothing left to hide, and unfinished large files are canceled
+// DaysStartedUntilCanceled after they were started.
+func (s *Server) RunLifecycle() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	for _, b := range s.buckets {
+		for _, rule := range b.rules {
+			s.applyRule(b, rule, now)
+		}
+	}
+}
+
+// applyRule applies rule to b as of now.  It must be called with s.mu held.
+func (s *Server) applyRule(b *bucket, rule b2types.LifecycleRule, now int64) {
+	if n := rule.DaysStartedUntilCanceled; n > 0 {
+		for id, l := range s.large {
+			if l.bucketID == b.id && strings.HasPrefix(l.name, rule.Prefix) && now-l.stamp >= int64(n)*day {
+				delete(s.large, id)
+			}
+		}
+	}
+	for name, vs := range b.versions {
+		if !strings.HasPrefix(name, rule.Prefix) {
+			continue
+		}
+		if n := rule.DaysNewUntilHidden; n > 0 && vs[0].action == "upload" && now-vs[0].stamp >= int64(n)*day {
+			s.hide(b, name)
+			vs = b.versions[name]
+		}
+		n := rule.DaysHiddenUntilDeleted
+		if n <= 0 {
+			continue
+		}
+		// Each version stopped being current when the one before it, which
+		// is newer, was stored.
+		for i := len(vs) - 1; i > 0; i-- {
+			if now-vs[i-1].stamp >= int64(n)*day {
+				s.remove(vs[i])
+			}
+		}
+		if vs = b.versions[name]; len(vs) == 1 && vs[0].action == "hide" && now-vs[0].stamp >= int64(n)*day {
+			s.remove(vs[0])
+		}
+	}
+}
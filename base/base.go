@@ -26,16 +26,19 @@ import (
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
-	"regexp"
+	"net/url"
+	"reflect"
 	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
+	"unicode"
 
 	"github.com/Backblaze/blazer/internal/b2types"
 	"github.com/Backblaze/blazer/internal/blog"
@@ -52,19 +55,118 @@ type b2err struct {
 	retry   int
 	code    int
 	msgCode string
+	req     reqInfo
 }
 
 func (e b2err) Error() string {
 	if e.method == "" {
-		return fmt.Sprintf("b2 error: %s", e.msg)
+		return fmt.Sprintf("b2 error: %s%s", e.msg, e.req)
 	}
-	return fmt.Sprintf("%s: %d: %s", e.method, e.code, e.msg)
+	return fmt.Sprintf("%s: %d: %s%s", e.method, e.code, e.msg, e.req)
+}
+
+// idHeaders are the response headers that, when present, help Backblaze find
+// a request that failed.
+var idHeaders = []string{"Cf-Ray", "X-Bz-Upload-Timestamp"}
+
+// reqInfo identifies the request an error came from, for support tickets.
+type reqInfo struct {
+	id      string   // our X-Blazer-Request-ID
+	host    string   // that served the request
+	date    string   // of the response
+	headers []string // any idHeaders, as "name value"
+}
+
+func newReqInfo(resp *http.Response) reqInfo {
+	r := reqInfo{date: resp.Header.Get("Date")}
+	if t, err := http.ParseTime(r.date); err == nil {
+		r.date = t.UTC().Format(time.RFC3339)
+	}
+	if req := resp.Request; req != nil {
+		r.id = req.Header.Get("X-Blazer-Request-ID")
+		if req.URL != nil {
+			r.host = req.URL.Host
+		}
+	}
+	for _, h := range idHeaders {
+		if v := resp.Header.Get(h); v != "" {
+			r.headers = append(r.headers, strings.ToLower(h)+" "+v)
+		}
+	}
+	return r
+}
+
+// String returns r compactly, as " (request 7, host api.example.com,
+// 2024-01-01T00:00:00Z, cf-ray 1a2b)", or "" if nothing is known.
+func (r reqInfo) String() string {
+	var parts []string
+	if r.id != "" {
+		parts = append(parts, "request "+r.id)
+	}
+	if r.host != "" {
+		parts = append(parts, "host "+r.host)
+	}
+	if r.date != "" {
+		parts = append(parts, r.date)
+	}
+	parts = append(parts, r.headers...)
+	if len(parts) == 0 {
+		return ""
+	}
+	return " (" + strings.Join(parts, ", ") + ")"
+}
+
+// CapExceededError is returned when a request would exceed one of the caps
+// set on the account, such as its storage cap.  Retrying will not help until
+// the cap is raised, so Action returns Punt for it.
+type CapExceededError struct {
+	Method string // The API call, such as "b2_upload_part".
+	Code   string // B2's code for the cap, such as "storage_cap_exceeded".
+	Msg    string
+
+	status int
+	req    reqInfo
+}
+
+func (e *CapExceededError) Error() string {
+	return fmt.Sprintf("%s: %d: %s%s", e.Method, e.status, e.Msg, e.req)
+}
+
+// IsStorageCap reports whether the account's storage cap, rather than a
+// transaction or download cap, was exceeded.
+func (e *CapExceededError) IsStorageCap() bool {
+	return e.Code == "storage_cap_exceeded" || e.Code == "cap_exceeded"
+}
+
+// capCodes are the msgCodes B2 returns when an account cap is exceeded.
+var capCodes = map[string]bool{
+	"cap_exceeded":             true,
+	"storage_cap_exceeded":     true,
+	"transaction_cap_exceeded": true,
+	"download_cap_exceeded":    true,
+}
+
+// asB2err returns the details of an error from B2, which err may wrap.
+func asB2err(err error) (b2err, bool) {
+	var e b2err
+	if errors.As(err, &e) {
+		return e, true
+	}
+	var ce *CapExceededError
+	if errors.As(err, &ce) {
+		return b2err{msg: ce.Msg, method: ce.Method, code: ce.status, msgCode: ce.Code, req: ce.req}, true
+	}
+	return b2err{}, false
 }
 
 // Action checks an error and returns a recommended course of action.
 func Action(err error) ErrAction {
-	e, ok := err.(b2err)
-	if !ok {
+	var ce *CapExceededError
+	if errors.As(err, &ce) {
+		return Punt
+	}
+	var e b2err
+	if !errors.As(err, &e) {
 		return Punt
 	}
 	if e.retry > 0 {
@@ -102,7 +204,7 @@ type ErrAction int
 
 // Code returns the error code and message.
 func Code(err error) (int, string) {
-	e, ok := err.(b2err)
+	e, ok := asB2err(err)
 	if !ok {
 		return 0, ""
 	}
@@ -111,13 +213,26 @@ func Code(err error) (int, string) {
 
 // MsgCode returns the error code, msgCode and message.
 func MsgCode(err error) (int, string, string) {
-	e, ok := err.(b2err)
+	e, ok := asB2err(err)
 	if !ok {
 		return 0, "", ""
 	}
 	return e.code, e.msgCode, e.msg
 }
 
+// Method returns the API call, such as "b2_list_buckets", that returned err.
+func Method(err error) string {
+	e, _ := asB2err(err)
+	return e.method
+}
+
+// Request returns the X-Blazer-Request-ID of the request for which B2 returned
+// err, and the host that served it.
+func Request(err error) (id, host string) {
+	e, _ := asB2err(err)
+	return e.req.id, e.req.host
+}
+
 const (
 	// ReAuthenticate indicates that the B2 account authentication tokens have
 	// expired, and should be refreshed with a new call to AuthorizeAccount.
@@ -137,13 +252,13 @@ const (
 	Punt
 )
 
-func mkErr(resp *http.Response) error {
+func (o *b2Options) mkErr(resp *http.Response) error {
 	data, err := ioutil.ReadAll(resp.Body)
 	var msgBody string
 	if err != nil {
 		msgBody = fmt.Sprintf("couldn't read message body: %v", err)
 	}
-	logResponse(resp, data)
+	o.logResponse(resp, data)
 	msg := &b2types.ErrorMessage{}
 	if err := json.Unmarshal(data, msg); err != nil {
 		if msgBody != "" {
@@ -159,70 +274,137 @@ func mkErr(resp *http.Response) error {
 		r, err := strconv.ParseInt(retry, 10, 64)
 		if err != nil {
 			r = 0
-			blog.V(1).Infof("couldn't parse retry-after header %q: %v", retry, err)
+			o.v(1).Infof("couldn't parse retry-after header %q: %v", retry, err)
 		}
 		retryAfter = int(r)
 	}
+	method := resp.Request.Header.Get("X-Blazer-Method")
+	if capCodes[msg.Code] {
+		return &CapExceededError{
+			Method: method,
+			Code:   msg.Code,
+			Msg:    msgBody,
+			status: resp.StatusCode,
+			req:    newReqInfo(resp),
+		}
+	}
 	return b2err{
 		msg:     msgBody,
 		retry:   retryAfter,
 		code:    resp.StatusCode,
 		msgCode: msg.Code,
-		method:  resp.Request.Header.Get("X-Blazer-Method"),
+		method:  method,
+		req:     newReqInfo(resp),
 	}
 }
 
 // Backoff returns an appropriate amount of time to wait, given an error, if
 // any was returned by the server.  If the return value is 0, but Action
 // indicates Retry, the user should implement their own exponential backoff,
-// beginning with one second.
+// beginning with one second.  The value is what B2 asked for, which during an
+// incident can be an hour or more; most callers should set a limit on it.
 func Backoff(err error) time.Duration {
-	e, ok := err.(b2err)
-	if !ok {
+	var e b2err
+	if !errors.As(err, &e) {
 		return 0
 	}
 	return time.Duration(e.retry) * time.Second
 }
 
-func logRequest(req *http.Request, args []byte) {
-	if !blog.V(2) {
+// v returns the Verbose for target that logs to the session's Logger, if it
+// has one.
+func (o *b2Options) v(target int32) blog.Verbose {
+	return blog.To(o.logger, target)
+}
+
+// logRequest logs req, and its arguments, if it has any.  To an AttrLogger, a
+// request has the attributes "method", "request_id", "attempt", "verb", "url",
+// "headers", "bytes", and "args"; to any other Logger, they are formatted as
+// text.
+func (o *b2Options) logRequest(req *http.Request, args []byte) {
+	v := o.v(2)
+	if !v.Enabled() {
 		return
 	}
-	var headers []string
-	for k, v := range req.Header {
-		if k == "Authorization" || k == "X-Blazer-Method" {
-			continue
-		}
-		headers = append(headers, fmt.Sprintf("%s: %s", k, strings.Join(v, ",")))
-	}
-	hstr := strings.Join(headers, ";")
+	hstr := redactHeaders(req.Header, ";")
+	uri := redactURL(req.URL)
 	method := req.Header.Get("X-Blazer-Method")
+	attrs := []blog.Attr{
+		{Key: "method", Value: method},
+		{Key: "request_id", Value: req.Header.Get("X-Blazer-Request-ID")},
+		{Key: "attempt", Value: attempt(req.Context())},
+		{Key: "verb", Value: req.Method},
+		{Key: "url", Value: uri},
+		{Key: "headers", Value: hstr},
+		{Key: "bytes", Value: req.ContentLength},
+	}
 	if args != nil {
-		blog.V(2).Infof(">> %s %v: %v headers: {%s} args: (%s)", method, req.Method, req.URL, hstr, string(args))
+		safe := redact(args)
+		attrs = append(attrs, blog.Attr{Key: "args", Value: safe})
+		v.Event("b2 request", attrs, fmt.Sprintf(">> %s %v: %v headers: {%s} args: (%s)", method, req.Method, uri, hstr, safe))
 		return
 	}
-	blog.V(2).Infof(">> %s %v: %v {%s} (no args)", method, req.Method, req.URL, hstr)
+	v.Event("b2 request", attrs, fmt.Sprintf(">> %s %v: %v {%s} (no args)", method, req.Method, uri, hstr))
 }
 
-var authRegexp = regexp.MustCompile(`"authorizationToken": ".[^"]*"`)
-
-func logResponse(resp *http.Response, reply []byte) {
-	if !blog.V(2) {
+// logResponse logs resp, and its reply, if it has one.  To an AttrLogger, a
+// response has the attributes "method", "request_id", "attempt", "status",
+// "duration", "headers", "bytes", and "reply"; to any other Logger, they are
+// formatted as text.
+func (o *b2Options) logResponse(resp *http.Response, reply []byte) {
+	v := o.v(2)
+	if !v.Enabled() {
 		return
 	}
-	var headers []string
-	for k, v := range resp.Header {
-		headers = append(headers, fmt.Sprintf("%s: %s", k, strings.Join(v, ",")))
-	}
-	hstr := strings.Join(headers, "; ")
+	hstr := redactHeaders(resp.Header, "; ")
 	method := resp.Request.Header.Get("X-Blazer-Method")
 	id := resp.Request.Header.Get("X-Blazer-Request-ID")
+	size := resp.ContentLength
+	if reply != nil {
+		size = int64(len(reply))
+	}
+	attrs := []blog.Attr{
+		{Key: "method", Value: method},
+		{Key: "request_id", Value: id},
+		{Key: "attempt", Value: attempt(resp.Request.Context())},
+		{Key: "status", Value: resp.StatusCode},
+		{Key: "duration", Value: sinceSent(resp.Request.Context())},
+		{Key: "headers", Value: hstr},
+		{Key: "bytes", Value: size},
+	}
 	if reply != nil {
-		safe := string(authRegexp.ReplaceAll(reply, []byte(`"authorizationToken": "[redacted]"`)))
-		blog.V(2).Infof("<< %s (%s) %s {%s} (%s)", method, id, resp.Status, hstr, safe)
+		safe := redact(reply)
+		attrs = append(attrs, blog.Attr{Key: "reply", Value: safe})
+		v.Event("b2 response", attrs, fmt.Sprintf("<< %s (%s) %s {%s} (%s)", method, id, resp.Status, hstr, safe))
 		return
 	}
-	blog.V(2).Infof("<< %s (%s) %s {%s} (no reply)", method, id, resp.Status, hstr)
+	v.Event("b2 response", attrs, fmt.Sprintf("<< %s (%s) %s {%s} (no reply)", method, id, resp.Status, hstr))
+}
+
+type attemptKey struct{}
+type sentKey struct{}
+
+// withAttempt returns a context for the nth attempt at a request.
+func withAttempt(ctx context.Context, n int) context.Context {
+	return context.WithValue(ctx, attemptKey{}, n)
+}
+
+// attempt returns the attempt at a request that is made with ctx, counting
+// from one.
+func attempt(ctx context.Context) int {
+	if n, ok := ctx.Value(attemptKey{}).(int); ok {
+		return n
+	}
+	return 1
+}
+
+// sinceSent returns the time since the request made with ctx was sent, or zero
+// if it hasn't been.
+func sinceSent(ctx context.Context) time.Duration {
+	if t, ok := ctx.Value(sentKey{}).(time.Time); ok {
+		return time.Since(t)
+	}
+	return 0
 }
 
 func millitime(t int64) time.Time {
@@ -236,6 +418,10 @@ type b2Options struct {
 	capExceeded     bool
 	apiBase         string
 	userAgent       string
+	skipValidation  bool
+	limiter         *RequestLimiter
+	breaker         *CircuitBreaker
+	logger          blog.Logger
 }
 
 func (o *b2Options) addHeaders(req *http.Request) {
@@ -260,7 +446,7 @@ func (o *b2Options) getAPIBase() string {
 
 func (o *b2Options) getUserAgent() string {
 	if o.userAgent != "" {
-		return fmt.Sprintf("%s %s", o.userAgent, DefaultUserAgent)
+		return o.userAgent + " " + DefaultUserAgent
 	}
 	return DefaultUserAgent
 }
@@ -274,25 +460,125 @@ func (o *b2Options) getTransport() http.RoundTripper {
 
 // B2 holds account information for Backblaze.
 type B2 struct {
+	mu          sync.RWMutex // guards the rest, which Update replaces
 	accountID   string
 	authToken   string
 	apiURI      string
 	s3URI       string
 	downloadURI string
 	minPartSize int
+	partSize    int
 	opts        *b2Options
+	caps        []string
 	bucket      string // restricted to this bucket if present
-	pfx         string // restricted to objects with this prefix if present
+	bucketName  string
+	pfx         string    // restricted to objects with this prefix if present
+	keyExpires  time.Time // zero if the key does not expire
 }
 
-// Update replaces the B2 object with a new one, in-place.
+// Update replaces the B2 object with a new one, in-place.  It is safe to call
+// while b is in use.
 func (b *B2) Update(n *B2) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	b.mu.Lock()
+	defer b.mu.Unlock()
 	b.accountID = n.accountID
 	b.authToken = n.authToken
 	b.apiURI = n.apiURI
+	b.s3URI = n.s3URI
 	b.downloadURI = n.downloadURI
 	b.minPartSize = n.minPartSize
+	b.partSize = n.partSize
 	b.opts = n.opts
+	b.caps = n.caps
+	b.bucket = n.bucket
+	b.bucketName = n.bucketName
+	b.pfx = n.pfx
+	b.keyExpires = n.keyExpires
+}
+
+func (b *B2) getAuthToken() string {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.authToken
+}
+
+func (b *B2) getAPIURI() string {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.apiURI
+}
+
+func (b *B2) getS3URI() string {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.s3URI
+}
+
+func (b *B2) getDownloadURI() string {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.downloadURI
+}
+
+func (b *B2) getOpts() *b2Options {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.opts
+}
+
+// AccountID returns the ID of the account that was authorized.
+func (b *B2) AccountID() string {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.accountID
+}
+
+// Capabilities returns the capabilities granted to the authorizing key.
+func (b *B2) Capabilities() []string {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.caps
+}
+
+// RecommendedPartSize returns the part size B2 recommends for large files.
+func (b *B2) RecommendedPartSize() int {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.partSize
+}
+
+// AbsoluteMinimumPartSize returns the smallest part size B2 will accept for
+// any but the last part of a large file.
+func (b *B2) AbsoluteMinimumPartSize() int {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.minPartSize
+}
+
+// KeyExpiration returns the time at which the authorizing key expires, or the
+// zero time if it does not expire.
+func (b *B2) KeyExpiration() time.Time {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.keyExpires
+}
+
+// RestrictedBucket returns the ID and name of the bucket to which the
+// authorizing key is restricted, or empty strings if it is not restricted.
+func (b *B2) RestrictedBucket() (id, name string) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.bucket, b.bucketName
+}
+
+// RestrictedPrefix returns the object name prefix to which the authorizing
+// key is restricted, or the empty string if it is not restricted.
+func (b *B2) RestrictedPrefix() string {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.pfx
 }
 
 type httpReply struct {
@@ -301,16 +587,15 @@ type httpReply struct {
 }
 
 func makeNetRequest(ctx context.Context, req *http.Request, rt http.RoundTripper) (*http.Response, error) {
-	req = req.WithContext(ctx)
+	req = req.WithContext(context.WithValue(ctx, sentKey{}, time.Now()))
 	resp, err := rt.RoundTrip(req)
+	err = redactError(err)
 	switch err {
 	case nil:
 		return resp, nil
 	case context.Canceled, context.DeadlineExceeded:
-		return nil, err
+		return nil, fmt.Errorf("%s: %w", describeRequest(req), err)
 	default:
-		method := req.Header.Get("X-Blazer-Method")
-		blog.V(2).Infof(">> %s uri: %v err: %v", method, req.URL, err)
 		switch err.(type) {
 		case x509.UnknownAuthorityError:
 			return nil, err
@@ -318,10 +603,24 @@ func makeNetRequest(ctx context.Context, req *http.Request, rt http.RoundTripper
 		return nil, b2err{
 			msg:   err.Error(),
 			retry: 1,
+			req:   reqInfo{id: req.Header.Get("X-Blazer-Request-ID"), host: req.URL.Host},
 		}
 	}
 }
 
+// describeRequest names the API call that req makes, with the part it uploads
+// or the range it downloads, as "b2_upload_part (part 3)".
+func describeRequest(req *http.Request) string {
+	method := req.Header.Get("X-Blazer-Method")
+	if n := req.Header.Get("X-Bz-Part-Number"); n != "" {
+		return fmt.Sprintf("%s (part %s)", method, n)
+	}
+	if rng := req.Header.Get("Range"); rng != "" {
+		return fmt.Sprintf("%s (%s)", method, rng)
+	}
+	return method
+}
+
 type requestBody struct {
 	size int64
 	body io.Reader
@@ -378,7 +677,20 @@ func (k *keepFinalBytes) Read(p []byte) (int, error) {
 
 var reqID int64
 
+// apiRequest makes the API call method, which needs no headers but the
+// Authorization, with a POST of b2req to uri, and decodes the reply into
+// b2resp.
+func (o *b2Options) apiRequest(ctx context.Context, method, uri, token string, b2req, b2resp interface{}) error {
+	return o.send(ctx, method, "POST", uri, token, b2req, b2resp, nil, nil)
+}
+
 func (o *b2Options) makeRequest(ctx context.Context, method, verb, uri string, b2req, b2resp interface{}, headers map[string]string, body *requestBody) error {
+	return o.send(ctx, method, verb, uri, "", b2req, b2resp, headers, body)
+}
+
+// send makes the API call method, authorized by token, if it is set, or by the
+// Authorization in headers.
+func (o *b2Options) send(ctx context.Context, method, verb, uri, token string, b2req, b2resp interface{}, headers map[string]string, body *requestBody) error {
 	var args []byte
 	if b2req != nil {
 		enc, err := json.Marshal(b2req)
@@ -386,54 +698,217 @@ func (o *b2Options) makeRequest(ctx context.Context, method, verb, uri string, b
 			return err
 		}
 		args = enc
-		body = &requestBody{
-			body: bytes.NewBuffer(enc),
-			size: int64(len(enc)),
+	}
+	for tries := 1; ; tries++ {
+		if args != nil {
+			body = &requestBody{
+				body: bytes.NewReader(args),
+				size: int64(len(args)),
+			}
+		}
+		err := o.request(withAttempt(ctx, tries), method, verb, uri, token, args, b2resp, headers, body)
+		var de *DecodeError
+		// A reply that isn't JSON may be from something between us and B2,
+		// such as a captive portal, that is gone a moment later; try once more,
+		// if the request can be made again.
+		if errors.As(err, &de) && tries < 2 && (args != nil || body == nil) && !started(b2resp) {
+			o.v(1).Infof("%v; trying again", err)
+			continue
 		}
+		return err
 	}
-	req, err := http.NewRequest(verb, uri, body.getBody())
+}
+
+func (o *b2Options) request(ctx context.Context, method, verb, uri, token string, args []byte, b2resp interface{}, headers map[string]string, body *requestBody) error {
+	req, err := http.NewRequestWithContext(ctx, verb, uri, body.getBody())
 	if err != nil {
 		return err
 	}
 	req.ContentLength = body.getSize()
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
 	for k, v := range headers {
 		if strings.HasPrefix(k, "X-Bz-Info") || strings.HasPrefix(k, "X-Bz-File-Name") {
-			v = escape(v)
+			v = Escape(v)
 		}
 		req.Header.Set(k, v)
 	}
-	req.Header.Set("X-Blazer-Request-ID", fmt.Sprintf("%d", atomic.AddInt64(&reqID, 1)))
+	req.Header.Set("X-Blazer-Request-ID", strconv.FormatInt(atomic.AddInt64(&reqID, 1), 10))
 	req.Header.Set("X-Blazer-Method", method)
 	o.addHeaders(req)
-	logRequest(req, args)
+	var probe bool
+	if limited(method) {
+		var ok bool
+		if ok, probe = o.breaker.allow(); !ok {
+			return fmt.Errorf("%s: %w", method, ErrCircuitOpen)
+		}
+		if err := o.limiter.wait(ctx); err != nil {
+			o.breaker.record(probe, false, true)
+			return fmt.Errorf("%s: %w", method, err)
+		}
+	}
+	o.logRequest(req, args)
 	resp, err := makeNetRequest(ctx, req, o.getTransport())
+	if limited(method) {
+		var status int
+		if resp != nil {
+			status = resp.StatusCode
+		}
+		failed, abandoned := breakerFailure(ctx, status, err)
+		o.breaker.record(probe, failed, abandoned)
+	}
 	if err != nil {
+		o.v(2).Infof(">> %s uri: %v err: %v", method, redactURL(req.URL), err)
 		return err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusTooManyRequests && limited(method) {
+		o.limiter.throttled()
+	}
 	if resp.StatusCode != 200 {
-		return mkErr(resp)
-	}
-	var replyArgs []byte
-	if b2resp != nil {
-		rbuf := &bytes.Buffer{}
-		r := io.TeeReader(resp.Body, rbuf)
-		decoder := json.NewDecoder(r)
-		if err := decoder.Decode(b2resp); err != nil {
-			return err
+		return o.mkErr(resp)
+	}
+	if sr, ok := b2resp.(streamReply); ok {
+		return o.stream(method, resp, sr)
+	}
+	if b2resp == nil && !o.v(2).Enabled() {
+		if _, err := io.Copy(ioutil.Discard, resp.Body); err != nil {
+			o.v(1).Infof("%s: couldn't read response: %v", method, err)
 		}
-		replyArgs = rbuf.Bytes()
-	} else {
-		ra, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			blog.V(1).Infof("%s: couldn't read response: %v", method, err)
+		return nil
+	}
+	// The reply is decoded as it is read, and kept whole only to be logged;
+	// otherwise only enough of it is kept for a DecodeError.
+	kept := getReplyBuffer(decodeSnippet)
+	defer putReplyBuffer(kept)
+	if o.v(2).Enabled() {
+		kept.n = -1
+	}
+	if b2resp == nil {
+		if _, err := io.Copy(kept, resp.Body); err != nil {
+			o.v(1).Infof("%s: couldn't read response: %v", method, err)
+		}
+		o.logResponse(resp, kept.b)
+		return nil
+	}
+	r := io.TeeReader(resp.Body, kept)
+	err = json.NewDecoder(r).Decode(b2resp)
+	if err == nil {
+		// Read what's left, so that the connection can be used again.
+		_, err = io.Copy(ioutil.Discard, r)
+	}
+	if err != nil {
+		if n := decodeSnippet - len(kept.b); n > 0 {
+			io.CopyN(kept, resp.Body, int64(n))
+		}
+		o.logResponse(resp, kept.b)
+		return &DecodeError{
+			Method:      method,
+			Status:      resp.StatusCode,
+			ContentType: resp.Header.Get("Content-Type"),
+			Body:        sanitize([]byte(redact(kept.b)), decodeSnippet),
+			Err:         err,
+			req:         newReqInfo(resp),
 		}
-		replyArgs = ra
 	}
-	logResponse(resp, replyArgs)
+	o.logResponse(resp, kept.b)
 	return nil
 }
 
+// A prefixBuffer keeps the first n bytes written to it, or all of them if n
+// is negative, and discards the rest.
+type prefixBuffer struct {
+	b []byte
+	n int
+}
+
+func (p *prefixBuffer) Write(b []byte) (int, error) {
+	keep := b
+	if p.n >= 0 {
+		if room := p.n - len(p.b); room < len(keep) {
+			if room < 0 {
+				room = 0
+			}
+			keep = keep[:room]
+		}
+	}
+	p.b = append(p.b, keep...)
+	return len(b), nil
+}
+
+// maxPooledReply is the largest reply buffer kept for reuse.  Larger ones,
+// which hold whole replies that were logged, are left to the garbage
+// collector, so that a few large replies don't leave megabytes pooled.
+const maxPooledReply = 64 << 10
+
+var replyBuffers = sync.Pool{
+	New: func() interface{} { return &prefixBuffer{} },
+}
+
+// getReplyBuffer returns an empty prefixBuffer that keeps n bytes.
+func getReplyBuffer(n int) *prefixBuffer {
+	p := replyBuffers.Get().(*prefixBuffer)
+	p.b = p.b[:0]
+	p.n = n
+	return p
+}
+
+func putReplyBuffer(p *prefixBuffer) {
+	if cap(p.b) > maxPooledReply {
+		return
+	}
+	replyBuffers.Put(p)
+}
+
+// decodeSnippet is how much of a reply that couldn't be decoded is kept in the
+// DecodeError.
+const decodeSnippet = 200
+
+// A DecodeError is returned when a successful reply can't be decoded as the
+// JSON that the API call returns.  This is usually because something other
+// than B2, such as a proxy or a captive portal, answered the request.  Calls
+// that can be made again are tried once more before the error is returned.
+type DecodeError struct {
+	Method      string // The API call, such as "b2_list_file_names".
+	Status      int
+	ContentType string
+	Body        string // The start of the reply, with control characters removed.
+	Err         error  // The error from encoding/json.
+
+	req reqInfo
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("%s: couldn't decode %d reply (Content-Type %q): %v: %q%s", e.Method, e.Status, e.ContentType, e.Err, e.Body, e.req)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// sanitize returns up to n bytes of b as valid UTF-8, with runs of whitespace
+// and control characters replaced with a single space.
+func sanitize(b []byte, n int) string {
+	if len(b) > n {
+		b = b[:n]
+	}
+	var sb strings.Builder
+	var space bool
+	for _, r := range strings.ToValidUTF8(string(b), "") {
+		if unicode.IsSpace(r) || unicode.IsControl(r) {
+			space = true
+			continue
+		}
+		if space && sb.Len() > 0 {
+			sb.WriteByte(' ')
+		}
+		space = false
+		sb.WriteRune(r)
+	}
+	return sb.String()
+}
+
 // AuthorizeAccount wraps b2_authorize_account.
 func AuthorizeAccount(ctx context.Context, account, key string, opts ...AuthOption) (*B2, error) {
 	auth := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%s:%s", account, key)))
@@ -448,19 +923,91 @@ func AuthorizeAccount(ctx context.Context, account, key string, opts ...AuthOpti
 	if err := b2opts.makeRequest(ctx, "b2_authorize_account", "GET", b2opts.getAPIBase()+b2types.V1api+"b2_authorize_account", nil, b2resp, headers, nil); err != nil {
 		return nil, err
 	}
+	var keyExpires time.Time
+	if b2resp.KeyExpires > 0 {
+		keyExpires = millitime(b2resp.KeyExpires)
+	}
 	return &B2{
 		accountID:   b2resp.AccountID,
 		authToken:   b2resp.AuthToken,
 		apiURI:      b2resp.URI,
 		s3URI:       b2resp.S3URI,
 		downloadURI: b2resp.DownloadURI,
-		minPartSize: b2resp.PartSize,
+		minPartSize: b2resp.AbsMinPartSize,
+		partSize:    b2resp.PartSize,
+		caps:        b2resp.Allowed.Capabilities,
 		bucket:      b2resp.Allowed.Bucket,
+		bucketName:  b2resp.Allowed.BucketName,
 		pfx:         b2resp.Allowed.Prefix,
+		keyExpires:  keyExpires,
 		opts:        b2opts,
 	}, nil
 }
 
+// A Session is what AuthorizeAccount learns of an account.  It can be saved,
+// and resumed with ResumeSession by another process, for as long as its
+// authorization token is good, without authorizing the account again.  It
+// holds the token, and should be kept as secret as the application key.
+type Session struct {
+	AccountID               string    `json:"accountId"`
+	AuthToken               string    `json:"authorizationToken"`
+	APIURL                  string    `json:"apiUrl"`
+	S3URL                   string    `json:"s3ApiUrl"`
+	DownloadURL             string    `json:"downloadUrl"`
+	RecommendedPartSize     int       `json:"recommendedPartSize"`
+	AbsoluteMinimumPartSize int       `json:"absoluteMinimumPartSize"`
+	Capabilities            []string  `json:"capabilities"`
+	BucketID                string    `json:"bucketId,omitempty"`
+	BucketName              string    `json:"bucketName,omitempty"`
+	Prefix                  string    `json:"namePrefix,omitempty"`
+	KeyExpiration           time.Time `json:"keyExpiration"`
+}
+
+// Session returns b's session.
+func (b *B2) Session() Session {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return Session{
+		AccountID:               b.accountID,
+		AuthToken:               b.authToken,
+		APIURL:                  b.apiURI,
+		S3URL:                   b.s3URI,
+		DownloadURL:             b.downloadURI,
+		RecommendedPartSize:     b.partSize,
+		AbsoluteMinimumPartSize: b.minPartSize,
+		Capabilities:            b.caps,
+		BucketID:                b.bucket,
+		BucketName:              b.bucketName,
+		Prefix:                  b.pfx,
+		KeyExpiration:           b.keyExpires,
+	}
+}
+
+// ResumeSession returns a B2 for a session saved from another.  It makes no
+// request; if the session's token has expired, calls fail as they would for
+// any B2 whose token has expired.
+func ResumeSession(s Session, opts ...AuthOption) *B2 {
+	b2opts := &b2Options{}
+	for _, f := range opts {
+		f(b2opts)
+	}
+	return &B2{
+		accountID:   s.AccountID,
+		authToken:   s.AuthToken,
+		apiURI:      s.APIURL,
+		s3URI:       s.S3URL,
+		downloadURI: s.DownloadURL,
+		minPartSize: s.AbsoluteMinimumPartSize,
+		partSize:    s.RecommendedPartSize,
+		caps:        s.Capabilities,
+		bucket:      s.BucketID,
+		bucketName:  s.BucketName,
+		pfx:         s.Prefix,
+		keyExpires:  s.KeyExpiration,
+		opts:        b2opts,
+	}
+}
+
 // An AuthOption allows callers to choose per-session settings.
 type AuthOption func(*b2Options)
 
@@ -516,67 +1063,234 @@ func SetAPIBase(url string) AuthOption {
 	}
 }
 
+// A Logger receives the session's log messages, in place of the standard
+// logger, whose verbosity is set by the B2_LOG_LEVEL environment variable.
+// Level 1 messages report retries and errors that were recovered from; level 2
+// messages report each request and response, with authorization tokens and
+// keys redacted.
+type Logger interface {
+	// Enabled reports whether messages at level are wanted.
+	Enabled(level int) bool
+
+	// Log logs a message at level.
+	Log(level int, msg string)
+}
+
+// WithLogger returns an AuthOption that sends the session's log messages to l.
+func WithLogger(l Logger) AuthOption {
+	return func(o *b2Options) {
+		o.logger = l
+	}
+}
+
+// SkipValidation returns an AuthOption that disables the client-side checks
+// on file names and file info that are otherwise made before uploads, large
+// file starts, and copies.  It is an escape hatch for when B2's limits are
+// relaxed before those in this package.
+func SkipValidation() AuthOption {
+	return func(o *b2Options) {
+		o.skipValidation = true
+	}
+}
+
 type LifecycleRule struct {
-	Prefix                 string
-	DaysNewUntilHidden     int
-	DaysHiddenUntilDeleted int
+	Prefix                   string
+	DaysNewUntilHidden       int
+	DaysHiddenUntilDeleted   int
+	DaysStartedUntilCanceled int
+}
+
+// DefaultRetention is the object lock retention applied to new files in a
+// bucket.  An empty Mode means that new files are not locked.
+type DefaultRetention struct {
+	Mode     string
+	Duration int
+	Unit     string
+}
+
+func fileLockConfiguration(flc b2types.FileLockConfiguration) (bool, *DefaultRetention) {
+	// If the key lacks readBucketRetentions, B2 still returns the structure but
+	// with a null value.
+	if !flc.IsClientAuthorizedToRead || flc.Value == nil {
+		return false, nil
+	}
+	dr := flc.Value.DefaultRetention
+	if dr.Mode == nil {
+		return flc.Value.IsFileLockEnabled, nil
+	}
+	ret := &DefaultRetention{
+		Mode: *dr.Mode,
+	}
+	if dr.Period != nil {
+		ret.Duration = dr.Period.Duration
+		ret.Unit = dr.Period.Unit
+	}
+	return flc.Value.IsFileLockEnabled, ret
+}
+
+func (dr *DefaultRetention) toB2types() *b2types.DefaultRetention {
+	if dr == nil {
+		return nil
+	}
+	if dr.Mode == "" {
+		return &b2types.DefaultRetention{}
+	}
+	mode := dr.Mode
+	return &b2types.DefaultRetention{
+		Mode: &mode,
+		Period: &b2types.RetentionPeriod{
+			Duration: dr.Duration,
+			Unit:     dr.Unit,
+		},
+	}
+}
+
+// ReplicationRule describes a single replication rule on a source bucket.
+type ReplicationRule struct {
+	Name                 string
+	DestinationBucketID  string
+	Prefix               string
+	Priority             int
+	IncludeExistingFiles bool
+	Enabled              bool
+}
+
+// Replication is a bucket's Cloud Replication configuration.  A bucket may be
+// a replication source, destination, or both.
+type Replication struct {
+	// SourceKeyID and Rules configure the bucket as a replication source.
+	SourceKeyID string
+	Rules       []ReplicationRule
+
+	// KeyMapping maps source application key IDs to destination application
+	// key IDs and configures the bucket as a replication destination.
+	KeyMapping map[string]string
+}
+
+func replicationConfiguration(rc b2types.ReplicationConfigurationResponse) *Replication {
+	// As with file lock configuration, a key without readBucketReplications
+	// gets a null value.
+	if !rc.IsClientAuthorizedToRead || rc.Value == nil {
+		return nil
+	}
+	if rc.Value.Source == nil && rc.Value.Destination == nil {
+		return nil
+	}
+	r := &Replication{}
+	if src := rc.Value.Source; src != nil {
+		r.SourceKeyID = src.SourceKeyID
+		for _, rule := range src.Rules {
+			r.Rules = append(r.Rules, ReplicationRule{
+				Name:                 rule.Name,
+				DestinationBucketID:  rule.DestinationBucketID,
+				Prefix:               rule.Prefix,
+				Priority:             rule.Priority,
+				IncludeExistingFiles: rule.IncludeExistingFiles,
+				Enabled:              rule.Enabled,
+			})
+		}
+	}
+	if dst := rc.Value.Destination; dst != nil && len(dst.KeyMapping) > 0 {
+		r.KeyMapping = make(map[string]string)
+		for k, v := range dst.KeyMapping {
+			r.KeyMapping[k] = v
+		}
+	}
+	return r
+}
+
+func (r *Replication) toB2types() *b2types.ReplicationConfiguration {
+	if r == nil {
+		return nil
+	}
+	rc := &b2types.ReplicationConfiguration{}
+	if r.SourceKeyID != "" || len(r.Rules) > 0 {
+		rc.Source = &b2types.ReplicationSource{
+			SourceKeyID: r.SourceKeyID,
+			Rules:       []b2types.ReplicationRule{},
+		}
+		for _, rule := range r.Rules {
+			rc.Source.Rules = append(rc.Source.Rules, b2types.ReplicationRule{
+				Name:                 rule.Name,
+				DestinationBucketID:  rule.DestinationBucketID,
+				Prefix:               rule.Prefix,
+				Priority:             rule.Priority,
+				IncludeExistingFiles: rule.IncludeExistingFiles,
+				Enabled:              rule.Enabled,
+			})
+		}
+	}
+	if len(r.KeyMapping) > 0 {
+		rc.Destination = &b2types.ReplicationDestination{
+			KeyMapping: make(map[string]string),
+		}
+		for k, v := range r.KeyMapping {
+			rc.Destination.KeyMapping[k] = v
+		}
+	}
+	return rc
 }
 
 // CreateBucket wraps b2_create_bucket.
-func (b *B2) CreateBucket(ctx context.Context, name, btype string, info map[string]string, rules []LifecycleRule) (*Bucket, error) {
+func (b *B2) CreateBucket(ctx context.Context, name, btype string, info map[string]string, rules []LifecycleRule, fileLock bool) (*Bucket, error) {
 	if btype != "allPublic" {
 		btype = "allPrivate"
 	}
 	var b2rules []b2types.LifecycleRule
 	for _, rule := range rules {
 		b2rules = append(b2rules, b2types.LifecycleRule{
-			Prefix:                 rule.Prefix,
-			DaysNewUntilHidden:     rule.DaysNewUntilHidden,
-			DaysHiddenUntilDeleted: rule.DaysHiddenUntilDeleted,
+			Prefix:                   rule.Prefix,
+			DaysNewUntilHidden:       rule.DaysNewUntilHidden,
+			DaysHiddenUntilDeleted:   rule.DaysHiddenUntilDeleted,
+			DaysStartedUntilCanceled: rule.DaysStartedUntilCanceled,
 		})
 	}
 	b2req := &b2types.CreateBucketRequest{
-		AccountID:      b.accountID,
-		Name:           name,
-		Type:           btype,
-		Info:           info,
-		LifecycleRules: b2rules,
+		AccountID:       b.AccountID(),
+		Name:            name,
+		Type:            btype,
+		Info:            info,
+		LifecycleRules:  b2rules,
+		FileLockEnabled: fileLock,
 	}
 	b2resp := &b2types.CreateBucketResponse{}
-	headers := map[string]string{
-		"Authorization": b.authToken,
-	}
-	if err := b.opts.makeRequest(ctx, "b2_create_bucket", "POST", b.apiURI+b2types.V1api+"b2_create_bucket", b2req, b2resp, headers, nil); err != nil {
+	if err := b.getOpts().apiRequest(ctx, "b2_create_bucket", b.getAPIURI()+b2types.V1api+"b2_create_bucket", b.getAuthToken(), b2req, b2resp); err != nil {
 		return nil, err
 	}
 	var respRules []LifecycleRule
 	for _, rule := range b2resp.LifecycleRules {
 		respRules = append(respRules, LifecycleRule{
-			Prefix:                 rule.Prefix,
-			DaysNewUntilHidden:     rule.DaysNewUntilHidden,
-			DaysHiddenUntilDeleted: rule.DaysHiddenUntilDeleted,
+			Prefix:                   rule.Prefix,
+			DaysNewUntilHidden:       rule.DaysNewUntilHidden,
+			DaysHiddenUntilDeleted:   rule.DaysHiddenUntilDeleted,
+			DaysStartedUntilCanceled: rule.DaysStartedUntilCanceled,
 		})
 	}
+	fileLock, retention := fileLockConfiguration(b2resp.FileLockConfiguration)
+	replication := replicationConfiguration(b2resp.Replication)
 	return &Bucket{
-		Name:           name,
-		Info:           b2resp.Info,
-		LifecycleRules: respRules,
-		ID:             b2resp.BucketID,
-		rev:            b2resp.Revision,
-		b2:             b,
+		Name:             name,
+		Info:             b2resp.Info,
+		LifecycleRules:   respRules,
+		FileLockEnabled:  fileLock,
+		lockEnabled:      fileLock,
+		DefaultRetention: retention,
+		retention:        retention.toB2types(),
+		Replication:      replication,
+		replication:      replication.toB2types(),
+		ID:               b2resp.BucketID,
+		Revision:         b2resp.Revision,
+		b2:               b,
 	}, nil
 }
 
 // DeleteBucket wraps b2_delete_bucket.
 func (b *Bucket) DeleteBucket(ctx context.Context) error {
 	b2req := &b2types.DeleteBucketRequest{
-		AccountID: b.b2.accountID,
+		AccountID: b.b2.AccountID(),
 		BucketID:  b.ID,
 	}
-	headers := map[string]string{
-		"Authorization": b.b2.authToken,
-	}
-	return b.b2.opts.makeRequest(ctx, "b2_delete_bucket", "POST", b.b2.apiURI+b2types.V1api+"b2_delete_bucket", b2req, nil, headers, nil)
+	return b.b2.getOpts().apiRequest(ctx, "b2_delete_bucket", b.b2.getAPIURI()+b2types.V1api+"b2_delete_bucket", b.b2.getAuthToken(), b2req, nil)
 }
 
 // Bucket holds B2 bucket details.
@@ -586,8 +1300,28 @@ type Bucket struct {
 	Info           map[string]string
 	LifecycleRules []LifecycleRule
 	ID             string
-	rev            int
 	b2             *B2
+
+	// Revision is the bucket's revision as last reported by B2.  Update
+	// succeeds only if the bucket's revision still matches.
+	Revision int
+
+	// FileLockEnabled reports whether object lock is enabled.  It can be set to
+	// true during an Update, but cannot be unset once enabled.
+	FileLockEnabled bool
+	lockEnabled     bool // as last reported by B2
+
+	// DefaultRetention is the bucket's default object lock retention.  If nil
+	// during an Update, the retention is not changed.
+	DefaultRetention *DefaultRetention
+	retention        *b2types.DefaultRetention // as last reported by B2
+
+	// Replication is the bucket's replication configuration.  It is nil if
+	// the bucket has no replication configured, or if the key is not
+	// authorized to read it.  If nil during an Update, the configuration is
+	// not changed.
+	Replication *Replication
+	replication *b2types.ReplicationConfiguration // as last reported by B2
 }
 
 // Update wraps b2_update_bucket.
@@ -595,68 +1329,87 @@ func (b *Bucket) Update(ctx context.Context) (*Bucket, error) {
 	var rules []b2types.LifecycleRule
 	for _, rule := range b.LifecycleRules {
 		rules = append(rules, b2types.LifecycleRule{
-			DaysNewUntilHidden:     rule.DaysNewUntilHidden,
-			DaysHiddenUntilDeleted: rule.DaysHiddenUntilDeleted,
-			Prefix:                 rule.Prefix,
+			DaysNewUntilHidden:       rule.DaysNewUntilHidden,
+			DaysHiddenUntilDeleted:   rule.DaysHiddenUntilDeleted,
+			DaysStartedUntilCanceled: rule.DaysStartedUntilCanceled,
+			Prefix:                   rule.Prefix,
 		})
 	}
+	// Retention and replication settings require their own capabilities to
+	// write, so only send them if they've changed.
+	reqRetention := b.DefaultRetention.toB2types()
+	if reflect.DeepEqual(reqRetention, b.retention) {
+		reqRetention = nil
+	}
+	reqReplication := b.Replication.toB2types()
+	if reflect.DeepEqual(reqReplication, b.replication) {
+		reqReplication = nil
+	}
 	b2req := &b2types.UpdateBucketRequest{
-		AccountID: b.b2.accountID,
+		AccountID: b.b2.AccountID(),
 		BucketID:  b.ID,
 		// Name:           b.Name,
-		Type:           b.Type,
-		Info:           b.Info,
-		LifecycleRules: rules,
-		IfRevisionIs:   b.rev,
-	}
-	headers := map[string]string{
-		"Authorization": b.b2.authToken,
+		Type:             b.Type,
+		Info:             b.Info,
+		LifecycleRules:   rules,
+		FileLockEnabled:  b.FileLockEnabled && !b.lockEnabled,
+		DefaultRetention: reqRetention,
+		Replication:      reqReplication,
+		IfRevisionIs:     b.Revision,
 	}
 	b2resp := &b2types.UpdateBucketResponse{}
-	if err := b.b2.opts.makeRequest(ctx, "b2_update_bucket", "POST", b.b2.apiURI+b2types.V1api+"b2_update_bucket", b2req, b2resp, headers, nil); err != nil {
+	if err := b.b2.getOpts().apiRequest(ctx, "b2_update_bucket", b.b2.getAPIURI()+b2types.V1api+"b2_update_bucket", b.b2.getAuthToken(), b2req, b2resp); err != nil {
 		return nil, err
 	}
 	var respRules []LifecycleRule
 	for _, rule := range b2resp.LifecycleRules {
 		respRules = append(respRules, LifecycleRule{
-			Prefix:                 rule.Prefix,
-			DaysNewUntilHidden:     rule.DaysNewUntilHidden,
-			DaysHiddenUntilDeleted: rule.DaysHiddenUntilDeleted,
+			Prefix:                   rule.Prefix,
+			DaysNewUntilHidden:       rule.DaysNewUntilHidden,
+			DaysHiddenUntilDeleted:   rule.DaysHiddenUntilDeleted,
+			DaysStartedUntilCanceled: rule.DaysStartedUntilCanceled,
 		})
 	}
+	fileLock, retention := fileLockConfiguration(b2resp.FileLockConfiguration)
+	replication := replicationConfiguration(b2resp.Replication)
 	return &Bucket{
-		Name:           b.Name,
-		Type:           b2resp.Type,
-		Info:           b2resp.Info,
-		LifecycleRules: respRules,
-		ID:             b2resp.BucketID,
-		b2:             b.b2,
+		Name:             b.Name,
+		Type:             b2resp.Type,
+		Info:             b2resp.Info,
+		LifecycleRules:   respRules,
+		FileLockEnabled:  fileLock,
+		lockEnabled:      fileLock,
+		DefaultRetention: retention,
+		retention:        retention.toB2types(),
+		Replication:      replication,
+		replication:      replication.toB2types(),
+		ID:               b2resp.BucketID,
+		Revision:         b2resp.Revision,
+		b2:               b.b2,
 	}, nil
 }
 
 // BaseURL returns the base part of the download URLs.
 func (b *Bucket) BaseURL() string {
-	return b.b2.downloadURI
+	return b.b2.getDownloadURI()
 }
 
 // S3URL returns the base URL for S3-compatible API calls.
 func (b *Bucket) S3URL() string {
-	return b.b2.s3URI
+	return b.b2.getS3URI()
 }
 
 // ListBuckets wraps b2_list_buckets.  If name is non-empty, only that bucket
 // will be returned if it exists; else nothing will be returned.
 func (b *B2) ListBuckets(ctx context.Context, name string) ([]*Bucket, error) {
+	id, _ := b.RestrictedBucket()
 	b2req := &b2types.ListBucketsRequest{
-		AccountID: b.accountID,
-		Bucket:    b.bucket,
+		AccountID: b.AccountID(),
+		Bucket:    id,
 		Name:      name,
 	}
 	b2resp := &b2types.ListBucketsResponse{}
-	headers := map[string]string{
-		"Authorization": b.authToken,
-	}
-	if err := b.opts.makeRequest(ctx, "b2_list_buckets", "POST", b.apiURI+b2types.V1api+"b2_list_buckets", b2req, b2resp, headers, nil); err != nil {
+	if err := b.getOpts().apiRequest(ctx, "b2_list_buckets", b.getAPIURI()+b2types.V1api+"b2_list_buckets", b.getAuthToken(), b2req, b2resp); err != nil {
 		return nil, err
 	}
 	var buckets []*Bucket
@@ -664,24 +1417,40 @@ func (b *B2) ListBuckets(ctx context.Context, name string) ([]*Bucket, error) {
 		var rules []LifecycleRule
 		for _, rule := range bucket.LifecycleRules {
 			rules = append(rules, LifecycleRule{
-				Prefix:                 rule.Prefix,
-				DaysNewUntilHidden:     rule.DaysNewUntilHidden,
-				DaysHiddenUntilDeleted: rule.DaysHiddenUntilDeleted,
+				Prefix:                   rule.Prefix,
+				DaysNewUntilHidden:       rule.DaysNewUntilHidden,
+				DaysHiddenUntilDeleted:   rule.DaysHiddenUntilDeleted,
+				DaysStartedUntilCanceled: rule.DaysStartedUntilCanceled,
 			})
 		}
+		fileLock, retention := fileLockConfiguration(bucket.FileLockConfiguration)
+		replication := replicationConfiguration(bucket.Replication)
 		buckets = append(buckets, &Bucket{
-			Name:           bucket.Name,
-			Type:           bucket.Type,
-			Info:           bucket.Info,
-			LifecycleRules: rules,
-			ID:             bucket.BucketID,
-			rev:            bucket.Revision,
-			b2:             b,
+			Name:             bucket.Name,
+			Type:             bucket.Type,
+			Info:             bucket.Info,
+			LifecycleRules:   rules,
+			FileLockEnabled:  fileLock,
+			lockEnabled:      fileLock,
+			DefaultRetention: retention,
+			retention:        retention.toB2types(),
+			Replication:      replication,
+			replication:      replication.toB2types(),
+			ID:               bucket.BucketID,
+			Revision:         bucket.Revision,
+			b2:               b,
 		})
 	}
 	return buckets, nil
 }
 
+// Bucket returns a bare Bucket struct with the given ID and name, without
+// consulting B2.  Only methods that need nothing more than the bucket's ID and
+// name, such as those that list, upload, and download files, may be used.
+func (b *B2) Bucket(id, name string) *Bucket {
+	return &Bucket{ID: id, Name: name, b2: b}
+}
+
 // URL holds information from the b2_get_upload_url API.
 type URL struct {
 	uri    string
@@ -708,10 +1477,7 @@ func (b *Bucket) GetUploadURL(ctx context.Context) (*URL, error) {
 		BucketID: b.ID,
 	}
 	b2resp := &b2types.GetUploadURLResponse{}
-	headers := map[string]string{
-		"Authorization": b.b2.authToken,
-	}
-	if err := b.b2.opts.makeRequest(ctx, "b2_get_upload_url", "POST", b.b2.apiURI+b2types.V1api+"b2_get_upload_url", b2req, b2resp, headers, nil); err != nil {
+	if err := b.b2.getOpts().apiRequest(ctx, "b2_get_upload_url", b.b2.getAPIURI()+b2types.V1api+"b2_get_upload_url", b.b2.getAuthToken(), b2req, b2resp); err != nil {
 		return nil, err
 	}
 	return &URL{
@@ -739,28 +1505,60 @@ func (b *Bucket) File(id, name string) *File {
 	return &File{ID: id, b2: b.b2, Name: name}
 }
 
-// UploadFile wraps b2_upload_file.
+// UploadFile wraps b2_upload_file.  The name and info are validated before
+// the request is sent; see SkipValidation.  The returned File's Info is filled
+// in from the response, so GetFileInfo is not needed.
 func (url *URL) UploadFile(ctx context.Context, r io.Reader, size int, name, contentType, sha1 string, info map[string]string) (*File, error) {
+	if err := url.b2.getOpts().validate(name, info); err != nil {
+		return nil, err
+	}
 	headers := map[string]string{
 		"Authorization":     url.token,
 		"X-Bz-File-Name":    name,
 		"Content-Type":      contentType,
-		"Content-Length":    fmt.Sprintf("%d", size),
+		"Content-Length":    strconv.Itoa(size),
 		"X-Bz-Content-Sha1": sha1,
 	}
-	for k, v := range info {
+	for k, v := range canonicalInfo(info) {
 		headers[fmt.Sprintf("X-Bz-Info-%s", k)] = v
 	}
 	b2resp := &b2types.UploadFileResponse{}
-	if err := url.b2.opts.makeRequest(ctx, "b2_upload_file", "POST", url.uri, nil, b2resp, headers, &requestBody{body: r, size: int64(size)}); err != nil {
+	if err := url.b2.getOpts().makeRequest(ctx, "b2_upload_file", "POST", url.uri, nil, b2resp, headers, &requestBody{body: r, size: int64(size)}); err != nil {
 		return nil, err
 	}
+	fi := &FileInfo{
+		Name:        name,
+		SHA1:        b2resp.SHA1,
+		MD5:         b2resp.MD5,
+		Size:        b2resp.Size,
+		ContentType: b2resp.ContentType,
+		Info:        canonicalInfo(b2resp.Info),
+		Status:      b2resp.Action,
+		Timestamp:   millitime(b2resp.Timestamp),
+	}
+	// Fill in anything the response left out from the request.
+	if fi.SHA1 == "" && sha1 != "hex_digits_at_end" {
+		fi.SHA1 = sha1
+	}
+	if fi.Size == 0 {
+		fi.Size = int64(size)
+		if sha1 == "hex_digits_at_end" {
+			fi.Size -= 40
+		}
+	}
+	if fi.ContentType == "" {
+		fi.ContentType = contentType
+	}
+	if fi.Info == nil {
+		fi.Info = canonicalInfo(info)
+	}
 	return &File{
 		Name:      name,
-		Size:      int64(size),
-		Timestamp: millitime(b2resp.Timestamp),
+		Size:      fi.Size,
+		Timestamp: fi.Timestamp,
 		Status:    b2resp.Action,
 		ID:        b2resp.FileID,
+		Info:      fi,
 		b2:        url.b2,
 	}, nil
 }
@@ -771,10 +1569,7 @@ func (f *File) DeleteFileVersion(ctx context.Context) error {
 		Name:   f.Name,
 		FileID: f.ID,
 	}
-	headers := map[string]string{
-		"Authorization": f.b2.authToken,
-	}
-	return f.b2.opts.makeRequest(ctx, "b2_delete_file_version", "POST", f.b2.apiURI+b2types.V1api+"b2_delete_file_version", b2req, nil, headers, nil)
+	return f.b2.getOpts().apiRequest(ctx, "b2_delete_file_version", f.b2.getAPIURI()+b2types.V1api+"b2_delete_file_version", f.b2.getAuthToken(), b2req, nil)
 }
 
 // LargeFile holds information necessary to implement B2 large file support.
@@ -787,19 +1582,20 @@ type LargeFile struct {
 	hashes map[int]string
 }
 
-// StartLargeFile wraps b2_start_large_file.
+// StartLargeFile wraps b2_start_large_file.  The name and info are validated
+// before the request is sent; see SkipValidation.
 func (b *Bucket) StartLargeFile(ctx context.Context, name, contentType string, info map[string]string) (*LargeFile, error) {
+	if err := b.b2.getOpts().validate(name, info); err != nil {
+		return nil, err
+	}
 	b2req := &b2types.StartLargeFileRequest{
 		BucketID:    b.ID,
 		Name:        name,
 		ContentType: contentType,
-		Info:        info,
+		Info:        canonicalInfo(info),
 	}
 	b2resp := &b2types.StartLargeFileResponse{}
-	headers := map[string]string{
-		"Authorization": b.b2.authToken,
-	}
-	if err := b.b2.opts.makeRequest(ctx, "b2_start_large_file", "POST", b.b2.apiURI+b2types.V1api+"b2_start_large_file", b2req, b2resp, headers, nil); err != nil {
+	if err := b.b2.getOpts().apiRequest(ctx, "b2_start_large_file", b.b2.getAPIURI()+b2types.V1api+"b2_start_large_file", b.b2.getAuthToken(), b2req, b2resp); err != nil {
 		return nil, err
 	}
 	return &LargeFile{
@@ -814,10 +1610,7 @@ func (l *LargeFile) CancelLargeFile(ctx context.Context) error {
 	b2req := &b2types.CancelLargeFileRequest{
 		ID: l.ID,
 	}
-	headers := map[string]string{
-		"Authorization": l.b2.authToken,
-	}
-	return l.b2.opts.makeRequest(ctx, "b2_cancel_large_file", "POST", l.b2.apiURI+b2types.V1api+"b2_cancel_large_file", b2req, nil, headers, nil)
+	return l.b2.getOpts().apiRequest(ctx, "b2_cancel_large_file", l.b2.getAPIURI()+b2types.V1api+"b2_cancel_large_file", l.b2.getAuthToken(), b2req, nil)
 }
 
 // FilePart is a piece of a started, but not finished, large file upload.
@@ -835,10 +1628,7 @@ func (f *File) ListParts(ctx context.Context, next, count int) ([]*FilePart, int
 		Count: count,
 	}
 	b2resp := &b2types.ListPartsResponse{}
-	headers := map[string]string{
-		"Authorization": f.b2.authToken,
-	}
-	if err := f.b2.opts.makeRequest(ctx, "b2_list_parts", "POST", f.b2.apiURI+b2types.V1api+"b2_list_parts", b2req, b2resp, headers, nil); err != nil {
+	if err := f.b2.getOpts().apiRequest(ctx, "b2_list_parts", f.b2.getAPIURI()+b2types.V1api+"b2_list_parts", f.b2.getAuthToken(), b2req, b2resp); err != nil {
 		return nil, 0, err
 	}
 	var parts []*FilePart
@@ -890,10 +1680,7 @@ func (l *LargeFile) GetUploadPartURL(ctx context.Context) (*FileChunk, error) {
 		ID: l.ID,
 	}
 	b2resp := &getUploadPartURLResponse{}
-	headers := map[string]string{
-		"Authorization": l.b2.authToken,
-	}
-	if err := l.b2.opts.makeRequest(ctx, "b2_get_upload_part_url", "POST", l.b2.apiURI+b2types.V1api+"b2_get_upload_part_url", b2req, b2resp, headers, nil); err != nil {
+	if err := l.b2.getOpts().apiRequest(ctx, "b2_get_upload_part_url", l.b2.getAPIURI()+b2types.V1api+"b2_get_upload_part_url", l.b2.getAuthToken(), b2req, b2resp); err != nil {
 		return nil, err
 	}
 	return &FileChunk{
@@ -918,27 +1705,36 @@ func (fc *FileChunk) Reload(ctx context.Context) error {
 func (fc *FileChunk) UploadPart(ctx context.Context, r io.Reader, sha1 string, size, index int) (int, error) {
 	headers := map[string]string{
 		"Authorization":     fc.token,
-		"X-Bz-Part-Number":  fmt.Sprintf("%d", index),
-		"Content-Length":    fmt.Sprintf("%d", size),
+		"X-Bz-Part-Number":  strconv.Itoa(index),
+		"Content-Length":    strconv.Itoa(size),
 		"X-Bz-Content-Sha1": sha1,
 	}
 	if sha1 == "hex_digits_at_end" {
 		r = &keepFinalBytes{r: r, remain: size}
 	}
-	if err := fc.file.b2.opts.makeRequest(ctx, "b2_upload_part", "POST", fc.url, nil, nil, headers, &requestBody{body: r, size: int64(size)}); err != nil {
+	if err := fc.file.b2.getOpts().makeRequest(ctx, "b2_upload_part", "POST", fc.url, nil, nil, headers, &requestBody{body: r, size: int64(size)}); err != nil {
 		return 0, err
 	}
 	fc.file.mu.Lock()
+	psize := int64(size)
 	if sha1 == "hex_digits_at_end" {
 		sha1 = string(r.(*keepFinalBytes).sha[:])
+		psize -= int64(len(sha1))
 	}
 	fc.file.hashes[index] = sha1
-	fc.file.size += int64(size)
+	fc.file.size += psize
 	fc.file.mu.Unlock()
 	return size, nil
 }
 
-// FinishLargeFile wraps b2_finish_large_file.
+// ListParts wraps b2_list_parts, for the parts uploaded to l so far.
+func (l *LargeFile) ListParts(ctx context.Context, next, count int) ([]*FilePart, int, error) {
+	f := &File{ID: l.ID, b2: l.b2}
+	return f.ListParts(ctx, next, count)
+}
+
+// FinishLargeFile wraps b2_finish_large_file.  As with UploadFile, the returned
+// File's Info is filled in from the response.
 func (l *LargeFile) FinishLargeFile(ctx context.Context) (*File, error) {
 	l.mu.Lock()
 	defer l.mu.Unlock()
@@ -947,26 +1743,49 @@ func (l *LargeFile) FinishLargeFile(ctx context.Context) (*File, error) {
 		Hashes: make([]string, len(l.hashes)),
 	}
 	b2resp := &b2types.FinishLargeFileResponse{}
-	for k, v := range l.hashes {
-		if len(b2req.Hashes) < k {
-			return nil, fmt.Errorf("b2_finish_large_file: invalid index %d", k)
+	for k := range b2req.Hashes {
+		v, ok := l.hashes[k+1]
+		if !ok {
+			// The parts must be numbered from 1 without gaps.
+			return nil, fmt.Errorf("b2_finish_large_file: %d parts were uploaded, but part %d is missing", len(l.hashes), k+1)
 		}
-		b2req.Hashes[k-1] = v
-	}
-	headers := map[string]string{
-		"Authorization": l.b2.authToken,
+		b2req.Hashes[k] = v
 	}
-	if err := l.b2.opts.makeRequest(ctx, "b2_finish_large_file", "POST", l.b2.apiURI+b2types.V1api+"b2_finish_large_file", b2req, b2resp, headers, nil); err != nil {
+	if err := l.b2.getOpts().apiRequest(ctx, "b2_finish_large_file", l.b2.getAPIURI()+b2types.V1api+"b2_finish_large_file", l.b2.getAuthToken(), b2req, b2resp); err != nil {
 		return nil, err
 	}
-	return &File{
+	size := l.size
+	if b2resp.Size > 0 {
+		// Parts uploaded again after resuming are counted twice in l.size.
+		size = b2resp.Size
+	}
+	f := &File{
 		Name:      b2resp.Name,
-		Size:      l.size,
+		Size:      size,
 		Timestamp: millitime(b2resp.Timestamp),
 		Status:    b2resp.Action,
 		ID:        b2resp.FileID,
 		b2:        l.b2,
-	}, nil
+	}
+	// B2 returns the complete file info; if this response has it, there is no
+	// need for GetFileInfo.
+	if b2resp.ContentType != "" {
+		sha1 := b2resp.SHA1
+		if sha1 == "" {
+			// B2 doesn't know the hash of a large file as a whole.
+			sha1 = "none"
+		}
+		f.Info = &FileInfo{
+			Name:        b2resp.Name,
+			SHA1:        sha1,
+			Size:        size,
+			ContentType: b2resp.ContentType,
+			Info:        canonicalInfo(b2resp.Info),
+			Status:      b2resp.Action,
+			Timestamp:   f.Timestamp,
+		}
+	}
+	return f, nil
 }
 
 // ListUnfinishedLargeFiles wraps b2_list_unfinished_large_files.
@@ -977,10 +1796,7 @@ func (b *Bucket) ListUnfinishedLargeFiles(ctx context.Context, count int, contin
 		Count:        count,
 	}
 	b2resp := &b2types.ListUnfinishedLargeFilesResponse{}
-	headers := map[string]string{
-		"Authorization": b.b2.authToken,
-	}
-	if err := b.b2.opts.makeRequest(ctx, "b2_list_unfinished_large_files", "POST", b.b2.apiURI+b2types.V1api+"b2_list_unfinished_large_files", b2req, b2resp, headers, nil); err != nil {
+	if err := b.b2.getOpts().apiRequest(ctx, "b2_list_unfinished_large_files", b.b2.getAPIURI()+b2types.V1api+"b2_list_unfinished_large_files", b.b2.getAuthToken(), b2req, b2resp); err != nil {
 		return nil, "", err
 	}
 	cont := b2resp.Continuation
@@ -994,7 +1810,7 @@ func (b *Bucket) ListUnfinishedLargeFiles(ctx context.Context, count int, contin
 			Info: &FileInfo{
 				Name:        f.Name,
 				ContentType: f.ContentType,
-				Info:        f.Info,
+				Info:        canonicalInfo(f.Info),
 				Timestamp:   millitime(f.Timestamp),
 			},
 		})
@@ -1004,8 +1820,24 @@ func (b *Bucket) ListUnfinishedLargeFiles(ctx context.Context, count int, contin
 
 // ListFileNames wraps b2_list_file_names.
 func (b *Bucket) ListFileNames(ctx context.Context, count int, continuation, prefix, delimiter string) ([]*File, string, error) {
+	var files []*File
+	cont, err := b.ListFileNamesFunc(ctx, count, continuation, prefix, delimiter, func(f *File) {
+		files = append(files, f)
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return files, cont, nil
+}
+
+// ListFileNamesFunc wraps b2_list_file_names as ListFileNames does, but
+// instead of returning the files once the whole reply has been read, it calls
+// fn with each one as soon as it has been decoded.  If the call fails partway
+// through the reply, fn will already have been called for the files before the
+// failure.
+func (b *Bucket) ListFileNamesFunc(ctx context.Context, count int, continuation, prefix, delimiter string, fn func(*File)) (string, error) {
 	if prefix == "" {
-		prefix = b.b2.pfx
+		prefix = b.b2.RestrictedPrefix()
 	}
 	b2req := &b2types.ListFileNamesRequest{
 		Count:        count,
@@ -1014,42 +1846,30 @@ func (b *Bucket) ListFileNames(ctx context.Context, count int, continuation, pre
 		Prefix:       prefix,
 		Delimiter:    delimiter,
 	}
-	b2resp := &b2types.ListFileNamesResponse{}
-	headers := map[string]string{
-		"Authorization": b.b2.authToken,
-	}
-	if err := b.b2.opts.makeRequest(ctx, "b2_list_file_names", "POST", b.b2.apiURI+b2types.V1api+"b2_list_file_names", b2req, b2resp, headers, nil); err != nil {
-		return nil, "", err
-	}
-	cont := b2resp.Continuation
-	var files []*File
-	for _, f := range b2resp.Files {
-		files = append(files, &File{
-			Name:      f.Name,
-			Size:      f.Size,
-			Status:    f.Action,
-			Timestamp: millitime(f.Timestamp),
-			Info: &FileInfo{
-				Name:        f.Name,
-				SHA1:        f.SHA1,
-				MD5:         f.MD5,
-				Size:        f.Size,
-				ContentType: f.ContentType,
-				Info:        f.Info,
-				Status:      f.Action,
-				Timestamp:   millitime(f.Timestamp),
-			},
-			ID: f.FileID,
-			b2: b.b2,
-		})
+	b2resp := &listReply{fn: func(f *b2types.GetFileInfoResponse) { fn(b.listedFile(f)) }}
+	if err := b.b2.getOpts().apiRequest(ctx, "b2_list_file_names", b.b2.getAPIURI()+b2types.V1api+"b2_list_file_names", b.b2.getAuthToken(), b2req, b2resp); err != nil {
+		return "", err
 	}
-	return files, cont, nil
+	return b2resp.nextName, nil
 }
 
 // ListFileVersions wraps b2_list_file_versions.
 func (b *Bucket) ListFileVersions(ctx context.Context, count int, startName, startID, prefix, delimiter string) ([]*File, string, string, error) {
+	var files []*File
+	name, id, err := b.ListFileVersionsFunc(ctx, count, startName, startID, prefix, delimiter, func(f *File) {
+		files = append(files, f)
+	})
+	if err != nil {
+		return nil, "", "", err
+	}
+	return files, name, id, nil
+}
+
+// ListFileVersionsFunc wraps b2_list_file_versions, calling fn with each file
+// as it is decoded, as ListFileNamesFunc does.
+func (b *Bucket) ListFileVersionsFunc(ctx context.Context, count int, startName, startID, prefix, delimiter string, fn func(*File)) (string, string, error) {
 	if prefix == "" {
-		prefix = b.b2.pfx
+		prefix = b.b2.RestrictedPrefix()
 	}
 	b2req := &b2types.ListFileVersionsRequest{
 		BucketID:  b.ID,
@@ -1059,50 +1879,63 @@ func (b *Bucket) ListFileVersions(ctx context.Context, count int, startName, sta
 		Prefix:    prefix,
 		Delimiter: delimiter,
 	}
-	b2resp := &b2types.ListFileVersionsResponse{}
-	headers := map[string]string{
-		"Authorization": b.b2.authToken,
-	}
-	if err := b.b2.opts.makeRequest(ctx, "b2_list_file_versions", "POST", b.b2.apiURI+b2types.V1api+"b2_list_file_versions", b2req, b2resp, headers, nil); err != nil {
-		return nil, "", "", err
+	b2resp := &listReply{fn: func(f *b2types.GetFileInfoResponse) { fn(b.listedFile(f)) }}
+	if err := b.b2.getOpts().apiRequest(ctx, "b2_list_file_versions", b.b2.getAPIURI()+b2types.V1api+"b2_list_file_versions", b.b2.getAuthToken(), b2req, b2resp); err != nil {
+		return "", "", err
 	}
-	var files []*File
-	for _, f := range b2resp.Files {
-		files = append(files, &File{
-			Name:      f.Name,
-			Size:      f.Size,
-			Status:    f.Action,
-			Timestamp: millitime(f.Timestamp),
-			Info: &FileInfo{
-				Name:        f.Name,
-				SHA1:        f.SHA1,
-				MD5:         f.MD5,
-				Size:        f.Size,
-				ContentType: f.ContentType,
-				Info:        f.Info,
-				Status:      f.Action,
-				Timestamp:   millitime(f.Timestamp),
-			},
-			ID: f.FileID,
-			b2: b.b2,
-		})
-	}
-	return files, b2resp.NextName, b2resp.NextID, nil
+	return b2resp.nextName, b2resp.nextID, nil
+}
+
+// listedFile returns the File for an entry in a list reply.
+func (b *Bucket) listedFile(f *b2types.GetFileInfoResponse) *File {
+	return &File{
+		Name:      f.Name,
+		Size:      f.Size,
+		Status:    f.Action,
+		Timestamp: millitime(f.Timestamp),
+		Info: &FileInfo{
+			Name:        f.Name,
+			SHA1:        f.SHA1,
+			MD5:         f.MD5,
+			Size:        f.Size,
+			ContentType: f.ContentType,
+			Info:        canonicalInfo(f.Info),
+			Status:      f.Action,
+			Timestamp:   millitime(f.Timestamp),
+		},
+		ID: f.FileID,
+		b2: b.b2,
+	}
+}
+
+// DownloadAuthorizationOptions holds response header overrides for
+// GetDownloadAuthorization.  Downloads made with the resulting token must pass
+// the same values as b2* query parameters, and B2 will serve them as the
+// corresponding response headers.  Empty fields are not overridden.
+type DownloadAuthorizationOptions struct {
+	ContentDisposition string
+	ContentLanguage    string
+	Expires            string
+	CacheControl       string
+	ContentEncoding    string
+	ContentType        string
 }
 
 // GetDownloadAuthorization wraps b2_get_download_authorization.
-func (b *Bucket) GetDownloadAuthorization(ctx context.Context, prefix string, valid time.Duration, contentDisposition string) (string, error) {
+func (b *Bucket) GetDownloadAuthorization(ctx context.Context, prefix string, valid time.Duration, opts DownloadAuthorizationOptions) (string, error) {
 	b2req := &b2types.GetDownloadAuthorizationRequest{
 		BucketID:           b.ID,
 		Prefix:             prefix,
 		Valid:              int(valid.Seconds()),
-		ContentDisposition: contentDisposition,
+		ContentDisposition: opts.ContentDisposition,
+		ContentLanguage:    opts.ContentLanguage,
+		Expires:            opts.Expires,
+		CacheControl:       opts.CacheControl,
+		ContentEncoding:    opts.ContentEncoding,
+		ContentType:        opts.ContentType,
 	}
 	b2resp := &b2types.GetDownloadAuthorizationResponse{}
-	headers := map[string]string{
-		"Authorization": b.b2.authToken,
-	}
-	if err := b.b2.opts.makeRequest(ctx, "b2_get_download_authorization", "POST", b.b2.apiURI+b2types.V1api+"b2_get_download_authorization", b2req, b2resp, headers, nil); err != nil {
+	if err := b.b2.getOpts().apiRequest(ctx, "b2_get_download_authorization", b.b2.getAPIURI()+b2types.V1api+"b2_get_download_authorization", b.b2.getAuthToken(), b2req, b2resp); err != nil {
 		return "", err
 	}
 	return b2resp.Token, nil
@@ -1116,6 +1949,23 @@ type FileReader struct {
 	SHA1          string
 	ID            string
 	Info          map[string]string
+
+	// Size is the size of the whole file, from the Content-Range header of a
+	// ranged download, or else ContentLength.
+	Size int64
+
+	// Timestamp is the file's upload time, from X-Bz-Upload-Timestamp.
+	Timestamp time.Time
+}
+
+// infoHeaders are the headers in which B2 serves the b2-* file info keys.
+// Cache-Control may instead come from the bucket's default.
+var infoHeaders = map[string]string{
+	"Cache-Control":       "b2-cache-control",
+	"Content-Disposition": "b2-content-disposition",
+	"Content-Encoding":    "b2-content-encoding",
+	"Content-Language":    "b2-content-language",
+	"Expires":             "b2-expires",
 }
 
 func mkRange(offset, size int64) string {
@@ -1128,9 +1978,48 @@ func mkRange(offset, size int64) string {
 	return fmt.Sprintf("bytes=%d-%d", offset, offset+size-1)
 }
 
+// DownloadOptions holds the optional parts of a download.
+type DownloadOptions struct {
+	// Overrides are sent as b2* query parameters, and B2 serves them as the
+	// corresponding response headers.  A download authorized by a token from
+	// GetDownloadAuthorization must send the values the token was made with.
+	Overrides DownloadAuthorizationOptions
+
+	// AuthToken, if set, authorizes the download in place of the account's
+	// token; it may come from GetDownloadAuthorization.
+	AuthToken string
+}
+
+// query returns the b2* query parameters for o's overrides.
+func (o DownloadAuthorizationOptions) query() url.Values {
+	v := url.Values{}
+	for key, val := range map[string]string{
+		"b2ContentDisposition": o.ContentDisposition,
+		"b2ContentLanguage":    o.ContentLanguage,
+		"b2Expires":            o.Expires,
+		"b2CacheControl":       o.CacheControl,
+		"b2ContentEncoding":    o.ContentEncoding,
+		"b2ContentType":        o.ContentType,
+	} {
+		if val != "" {
+			v.Set(key, val)
+		}
+	}
+	return v
+}
+
 // DownloadFileByName wraps b2_download_file_by_name.
 func (b *Bucket) DownloadFileByName(ctx context.Context, name string, offset, size int64, header bool) (*FileReader, error) {
-	uri := fmt.Sprintf("%s/file/%s/%s", b.b2.downloadURI, b.Name, escape(name))
+	return b.DownloadFileByNameWithOptions(ctx, name, offset, size, header, DownloadOptions{})
+}
+
+// DownloadFileByNameWithOptions wraps b2_download_file_by_name, with response
+// header overrides or another authorization.
+func (b *Bucket) DownloadFileByNameWithOptions(ctx context.Context, name string, offset, size int64, header bool, opts DownloadOptions) (*FileReader, error) {
+	uri := fmt.Sprintf("%s/file/%s/%s", b.b2.getDownloadURI(), b.Name, Escape(name))
+	if q := opts.Overrides.query(); len(q) > 0 {
+		uri += "?" + q.Encode()
+	}
 	method := "GET"
 	if header {
 		method = "HEAD"
@@ -1139,23 +2028,34 @@ func (b *Bucket) DownloadFileByName(ctx context.Context, name string, offset, si
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Set("Authorization", b.b2.authToken)
-	req.Header.Set("X-Blazer-Request-ID", fmt.Sprintf("%d", atomic.AddInt64(&reqID, 1)))
+	token := b.b2.getAuthToken()
+	if opts.AuthToken != "" {
+		token = opts.AuthToken
+	}
+	req.Header.Set("Authorization", token)
+	req.Header.Set("X-Blazer-Request-ID", strconv.FormatInt(atomic.AddInt64(&reqID, 1), 10))
 	req.Header.Set("X-Blazer-Method", "b2_download_file_by_name")
-	b.b2.opts.addHeaders(req)
+	b.b2.getOpts().addHeaders(req)
 	rng := mkRange(offset, size)
 	if rng != "" {
 		req.Header.Set("Range", rng)
+	} else {
+		// Without a Range header, net/http would ask for gzip and quietly
+		// decompress objects stored with that Content-Encoding, hiding their
+		// length and hash.
+		req.Header.Set("Accept-Encoding", "identity")
 	}
-	logRequest(req, nil)
-	resp, err := makeNetRequest(ctx, req, b.b2.opts.getTransport())
+	o := b.b2.getOpts()
+	o.logRequest(req, nil)
+	resp, err := makeNetRequest(ctx, req, o.getTransport())
 	if err != nil {
+		o.v(2).Infof(">> %s uri: %v err: %v", "b2_download_file_by_name", redactURL(req.URL), err)
 		return nil, err
 	}
-	logResponse(resp, nil)
+	o.logResponse(resp, nil)
 	if resp.StatusCode != 200 && resp.StatusCode != 206 {
 		defer resp.Body.Close()
-		return nil, mkErr(resp)
+		return nil, o.mkErr(resp)
 	}
 	clen, err := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
 	if err != nil {
@@ -1167,21 +2067,43 @@ func (b *Bucket) DownloadFileByName(ctx context.Context, name string, offset, si
 		if !strings.HasPrefix(key, "X-Bz-Info-") {
 			continue
 		}
-		name, err := unescape(strings.TrimPrefix(key, "X-Bz-Info-"))
+		name, err := Unescape(strings.TrimPrefix(key, "X-Bz-Info-"))
 		if err != nil {
 			resp.Body.Close()
 			return nil, err
 		}
-		val, err := unescape(resp.Header.Get(key))
+		val, err := Unescape(resp.Header.Get(key))
 		if err != nil {
 			resp.Body.Close()
 			return nil, err
 		}
-		info[name] = val
+		// Header names are canonicalized, so "src_hash" arrives as
+		// "X-Bz-Info-Src_hash".
+		info[strings.ToLower(name)] = val
+	}
+	for h, key := range infoHeaders {
+		if v := resp.Header.Get(h); v != "" && info[key] == "" {
+			info[key] = v
+		}
+	}
+	var stamp time.Time
+	if ts := resp.Header.Get("X-Bz-Upload-Timestamp"); ts != "" {
+		if ms, err := strconv.ParseInt(ts, 10, 64); err == nil {
+			stamp = millitime(ms)
+		}
 	}
 	sha1 := resp.Header.Get("X-Bz-Content-Sha1")
-	if sha1 == "none" && info["Large_file_sha1"] != "" {
-		sha1 = info["Large_file_sha1"]
+	if sha1 == "none" && info["large_file_sha1"] != "" {
+		sha1 = info["large_file_sha1"]
+	}
+	whole := clen
+	if cr := resp.Header.Get("Content-Range"); cr != "" {
+		// bytes 0-999/10007
+		if i := strings.LastIndex(cr, "/"); i >= 0 {
+			if n, err := strconv.ParseInt(cr[i+1:], 10, 64); err == nil {
+				whole = n
+			}
+		}
 	}
 	return &FileReader{
 		ReadCloser:    resp.Body,
@@ -1190,6 +2112,8 @@ func (b *Bucket) DownloadFileByName(ctx context.Context, name string, offset, si
 		ContentType:   resp.Header.Get("Content-Type"),
 		ContentLength: int(clen),
 		Info:          info,
+		Size:          whole,
+		Timestamp:     stamp,
 	}, nil
 }
 
@@ -1200,10 +2124,7 @@ func (b *Bucket) HideFile(ctx context.Context, name string) (*File, error) {
 		File:     name,
 	}
 	b2resp := &b2types.HideFileResponse{}
-	headers := map[string]string{
-		"Authorization": b.b2.authToken,
-	}
-	if err := b.b2.opts.makeRequest(ctx, "b2_hide_file", "POST", b.b2.apiURI+b2types.V1api+"b2_hide_file", b2req, b2resp, headers, nil); err != nil {
+	if err := b.b2.getOpts().apiRequest(ctx, "b2_hide_file", b.b2.getAPIURI()+b2types.V1api+"b2_hide_file", b.b2.getAuthToken(), b2req, b2resp); err != nil {
 		return nil, err
 	}
 	return &File{
@@ -1233,10 +2154,7 @@ func (f *File) GetFileInfo(ctx context.Context) (*FileInfo, error) {
 		ID: f.ID,
 	}
 	b2resp := &b2types.GetFileInfoResponse{}
-	headers := map[string]string{
-		"Authorization": f.b2.authToken,
-	}
-	if err := f.b2.opts.makeRequest(ctx, "b2_get_file_info", "POST", f.b2.apiURI+b2types.V1api+"b2_get_file_info", b2req, b2resp, headers, nil); err != nil {
+	if err := f.b2.getOpts().apiRequest(ctx, "b2_get_file_info", f.b2.getAPIURI()+b2types.V1api+"b2_get_file_info", f.b2.getAuthToken(), b2req, b2resp); err != nil {
 		return nil, err
 	}
 	f.Status = b2resp.Action
@@ -1248,27 +2166,103 @@ func (f *File) GetFileInfo(ctx context.Context) (*FileInfo, error) {
 		MD5:         b2resp.MD5,
 		Size:        b2resp.Size,
 		ContentType: b2resp.ContentType,
-		Info:        b2resp.Info,
+		Info:        canonicalInfo(b2resp.Info),
 		Status:      b2resp.Action,
 		Timestamp:   millitime(b2resp.Timestamp),
 	}
 	return f.Info, nil
 }
 
+// CopyFile wraps b2_copy_file.  The new file, name, is created in this
+// bucket from the file with the given ID.  If size is non-zero, only the given
+// range of the source is copied.  If contentType is empty the source's
+// content type and info are kept; otherwise they are replaced with
+// contentType and info.
+func (b *Bucket) CopyFile(ctx context.Context, srcID, name string, offset, size int64, contentType string, info map[string]string) (*File, error) {
+	if err := b.b2.getOpts().validate(name, info); err != nil {
+		return nil, err
+	}
+	b2req := &b2types.CopyFileRequest{
+		SourceID:          srcID,
+		DestBucketID:      b.ID,
+		Name:              name,
+		Range:             mkRange(offset, size),
+		MetadataDirective: "COPY",
+	}
+	if contentType != "" {
+		b2req.MetadataDirective = "REPLACE"
+		b2req.ContentType = contentType
+		b2req.Info = canonicalInfo(info)
+	}
+	b2resp := &b2types.GetFileInfoResponse{}
+	if err := b.b2.getOpts().apiRequest(ctx, "b2_copy_file", b.b2.getAPIURI()+b2types.V1api+"b2_copy_file", b.b2.getAuthToken(), b2req, b2resp); err != nil {
+		return nil, err
+	}
+	return &File{
+		Name:      b2resp.Name,
+		Size:      b2resp.Size,
+		Status:    b2resp.Action,
+		Timestamp: millitime(b2resp.Timestamp),
+		ID:        b2resp.FileID,
+		Info: &FileInfo{
+			Name:        b2resp.Name,
+			SHA1:        b2resp.SHA1,
+			MD5:         b2resp.MD5,
+			Size:        b2resp.Size,
+			ContentType: b2resp.ContentType,
+			Info:        canonicalInfo(b2resp.Info),
+			Status:      b2resp.Action,
+			Timestamp:   millitime(b2resp.Timestamp),
+		},
+		b2: b.b2,
+	}, nil
+}
+
+// CopyPart wraps b2_copy_part.  It copies size bytes, starting at offset, of
+// the file with the given ID into part number index of the large file.
+func (l *LargeFile) CopyPart(ctx context.Context, srcID string, index int, offset, size int64) (int64, error) {
+	b2req := &b2types.CopyPartRequest{
+		SourceID:    srcID,
+		LargeFileID: l.ID,
+		PartNumber:  index,
+		Range:       mkRange(offset, size),
+	}
+	b2resp := &b2types.CopyPartResponse{}
+	if err := l.b2.getOpts().apiRequest(ctx, "b2_copy_part", l.b2.getAPIURI()+b2types.V1api+"b2_copy_part", l.b2.getAuthToken(), b2req, b2resp); err != nil {
+		return 0, err
+	}
+	l.mu.Lock()
+	l.hashes[index] = b2resp.SHA1
+	l.size += b2resp.Size
+	l.mu.Unlock()
+	return b2resp.Size, nil
+}
+
 // Key is a B2 application key.
 type Key struct {
 	ID           string
 	Secret       string
 	Name         string
 	Capabilities []string
-	Expires      time.Time
+	Expires      time.Time // zero if the key does not expire
+	BucketID     string    // empty for keys valid for all buckets
+	Prefix       string
 	b2           *B2
 }
 
+// keyExpiry returns the time of a key's expirationTimestamp, which is null for
+// keys that don't expire.
+func keyExpiry(t int64) time.Time {
+	if t <= 0 {
+		return time.Time{}
+	}
+	return millitime(t)
+}
+
 // CreateKey wraps b2_create_key.
 func (b *B2) CreateKey(ctx context.Context, name string, caps []string, valid time.Duration, bucketID string, prefix string) (*Key, error) {
 	b2req := &b2types.CreateKeyRequest{
-		AccountID:    b.accountID,
+		AccountID:    b.AccountID(),
 		Capabilities: caps,
 		Name:         name,
 		Valid:        int(valid.Seconds()),
@@ -1276,10 +2270,7 @@ func (b *B2) CreateKey(ctx context.Context, name string, caps []string, valid ti
 		Prefix:       prefix,
 	}
 	b2resp := &b2types.CreateKeyResponse{}
-	headers := map[string]string{
-		"Authorization": b.authToken,
-	}
-	if err := b.opts.makeRequest(ctx, "b2_create_key", "POST", b.apiURI+b2types.V1api+"b2_create_key", b2req, b2resp, headers, nil); err != nil {
+	if err := b.getOpts().apiRequest(ctx, "b2_create_key", b.getAPIURI()+b2types.V1api+"b2_create_key", b.getAuthToken(), b2req, b2resp); err != nil {
 		return nil, err
 	}
 	return &Key{
@@ -1287,7 +2278,9 @@ func (b *B2) CreateKey(ctx context.Context, name string, caps []string, valid ti
 		ID:           b2resp.ID,
 		Secret:       b2resp.Secret,
 		Capabilities: b2resp.Capabilities,
-		Expires:      millitime(b2resp.Expires),
+		Expires:      keyExpiry(b2resp.Expires),
+		BucketID:     b2resp.BucketID,
+		Prefix:       b2resp.Prefix,
 		b2:           b,
 	}, nil
 }
@@ -1297,24 +2290,18 @@ func (k *Key) Delete(ctx context.Context) error {
 	b2req := &b2types.DeleteKeyRequest{
 		KeyID: k.ID,
 	}
-	headers := map[string]string{
-		"Authorization": k.b2.authToken,
-	}
-	return k.b2.opts.makeRequest(ctx, "b2_delete_key", "POST", k.b2.apiURI+b2types.V1api+"b2_delete_key", b2req, nil, headers, nil)
+	return k.b2.getOpts().apiRequest(ctx, "b2_delete_key", k.b2.getAPIURI()+b2types.V1api+"b2_delete_key", k.b2.getAuthToken(), b2req, nil)
 }
 
 // ListKeys wraps b2_list_keys.
 func (b *B2) ListKeys(ctx context.Context, max int, next string) ([]*Key, string, error) {
 	b2req := &b2types.ListKeysRequest{
-		AccountID: b.accountID,
+		AccountID: b.AccountID(),
 		Max:       max,
 		Next:      next,
 	}
-	headers := map[string]string{
-		"Authorization": b.authToken,
-	}
 	b2resp := &b2types.ListKeysResponse{}
-	if err := b.opts.makeRequest(ctx, "b2_list_keys", "POST", b.apiURI+b2types.V1api+"b2_list_keys", b2req, b2resp, headers, nil); err != nil {
+	if err := b.getOpts().apiRequest(ctx, "b2_list_keys", b.getAPIURI()+b2types.V1api+"b2_list_keys", b.getAuthToken(), b2req, b2resp); err != nil {
 		return nil, "", err
 	}
 	var keys []*Key
@@ -1323,7 +2310,9 @@ func (b *B2) ListKeys(ctx context.Context, max int, next string) ([]*Key, string
 			Name:         key.Name,
 			ID:           key.ID,
 			Capabilities: key.Capabilities,
-			Expires:      millitime(key.Expires),
+			Expires:      keyExpiry(key.Expires),
+			BucketID:     key.BucketID,
+			Prefix:       key.Prefix,
 			b2:           b,
 		})
 	}
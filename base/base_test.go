@@ -0,0 +1,1445 @@
+// Copyright 2024, the Blazer authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package base
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Backblaze/blazer/internal/b2types"
+	"github.com/Backblaze/blazer/internal/blog"
+)
+
+func TestFileLockConfiguration(t *testing.T) {
+	table := []struct {
+		desc    string
+		json    string
+		enabled bool
+		want    *DefaultRetention
+	}{
+		{
+			desc: "unauthorized",
+			json: `{"isClientAuthorizedToRead": false, "value": null}`,
+		},
+		{
+			desc:    "no default retention",
+			json:    `{"isClientAuthorizedToRead": true, "value": {"isFileLockEnabled": true, "defaultRetention": {"mode": null, "period": null}}}`,
+			enabled: true,
+		},
+		{
+			desc:    "governance",
+			json:    `{"isClientAuthorizedToRead": true, "value": {"isFileLockEnabled": true, "defaultRetention": {"mode": "governance", "period": {"duration": 7, "unit": "days"}}}}`,
+			enabled: true,
+			want:    &DefaultRetention{Mode: "governance", Duration: 7, Unit: "days"},
+		},
+	}
+
+	for _, e := range table {
+		var flc b2types.FileLockConfiguration
+		if err := json.Unmarshal([]byte(e.json), &flc); err != nil {
+			t.Fatalf("%s: %v", e.desc, err)
+		}
+		enabled, got := fileLockConfiguration(flc)
+		if enabled != e.enabled {
+			t.Errorf("%s: got enabled %v, want %v", e.desc, enabled, e.enabled)
+		}
+		if !reflect.DeepEqual(got, e.want) {
+			t.Errorf("%s: got %#v, want %#v", e.desc, got, e.want)
+		}
+	}
+}
+
+func TestDefaultRetentionRequest(t *testing.T) {
+	table := []struct {
+		dr   *DefaultRetention
+		want string
+	}{
+		{
+			dr:   nil,
+			want: `null`,
+		},
+		{
+			dr:   &DefaultRetention{},
+			want: `{"mode":null,"period":null}`,
+		},
+		{
+			dr:   &DefaultRetention{Mode: "compliance", Duration: 1, Unit: "years"},
+			want: `{"mode":"compliance","period":{"duration":1,"unit":"years"}}`,
+		},
+	}
+
+	for _, e := range table {
+		b, err := json.Marshal(e.dr.toB2types())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != e.want {
+			t.Errorf("%#v: got %s, want %s", e.dr, b, e.want)
+		}
+	}
+}
+
+func TestReplicationConfiguration(t *testing.T) {
+	table := []struct {
+		desc string
+		json string
+		want *Replication
+	}{
+		{
+			desc: "unauthorized",
+			json: `{"isClientAuthorizedToRead": false, "value": null}`,
+		},
+		{
+			desc: "not configured",
+			json: `{"isClientAuthorizedToRead": true, "value": {"asReplicationSource": null, "asReplicationDestination": null}}`,
+		},
+		{
+			desc: "source and destination",
+			json: `{"isClientAuthorizedToRead": true, "value": {
+				"asReplicationSource": {
+					"sourceApplicationKeyId": "srckey",
+					"replicationRules": [{"destinationBucketId": "dst", "fileNamePrefix": "a/", "includeExistingFiles": true, "isEnabled": true, "priority": 2, "replicationRuleName": "rule"}]
+				},
+				"asReplicationDestination": {"sourceToDestinationKeyMapping": {"otherkey": "dstkey"}}
+			}}`,
+			want: &Replication{
+				SourceKeyID: "srckey",
+				Rules: []ReplicationRule{
+					{
+						Name:                 "rule",
+						DestinationBucketID:  "dst",
+						Prefix:               "a/",
+						Priority:             2,
+						IncludeExistingFiles: true,
+						Enabled:              true,
+					},
+				},
+				KeyMapping: map[string]string{"otherkey": "dstkey"},
+			},
+		},
+	}
+
+	for _, e := range table {
+		var rc b2types.ReplicationConfigurationResponse
+		if err := json.Unmarshal([]byte(e.json), &rc); err != nil {
+			t.Fatalf("%s: %v", e.desc, err)
+		}
+		got := replicationConfiguration(rc)
+		if !reflect.DeepEqual(got, e.want) {
+			t.Errorf("%s: got %#v, want %#v", e.desc, got, e.want)
+		}
+	}
+}
+
+func TestReplicationRequest(t *testing.T) {
+	table := []struct {
+		r    *Replication
+		want string
+	}{
+		{
+			r:    nil,
+			want: `null`,
+		},
+		{
+			r:    &Replication{},
+			want: `{}`,
+		},
+		{
+			r:    &Replication{KeyMapping: map[string]string{"a": "b"}},
+			want: `{"asReplicationDestination":{"sourceToDestinationKeyMapping":{"a":"b"}}}`,
+		},
+	}
+
+	for _, e := range table {
+		b, err := json.Marshal(e.r.toB2types())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != e.want {
+			t.Errorf("%#v: got %s, want %s", e.r, b, e.want)
+		}
+	}
+}
+
+func TestLifecycleRuleJSON(t *testing.T) {
+	table := []struct {
+		rule b2types.LifecycleRule
+		want string
+	}{
+		{
+			rule: b2types.LifecycleRule{Prefix: "a/"},
+			want: `{"fileNamePrefix":"a/"}`,
+		},
+		{
+			rule: b2types.LifecycleRule{Prefix: "b/", DaysStartedUntilCanceled: 3},
+			want: `{"daysFromStartingToCancelingUnfinishedLargeFiles":3,"fileNamePrefix":"b/"}`,
+		},
+		{
+			rule: b2types.LifecycleRule{DaysHiddenUntilDeleted: 1, DaysNewUntilHidden: 2, DaysStartedUntilCanceled: 4},
+			want: `{"daysFromHidingToDeleting":1,"daysFromUploadingToHiding":2,"daysFromStartingToCancelingUnfinishedLargeFiles":4,"fileNamePrefix":""}`,
+		},
+	}
+
+	for _, e := range table {
+		b, err := json.Marshal(e.rule)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != e.want {
+			t.Errorf("%#v: got %s, want %s", e.rule, b, e.want)
+		}
+		var got b2types.LifecycleRule
+		if err := json.Unmarshal(b, &got); err != nil {
+			t.Fatal(err)
+		}
+		if got != e.rule {
+			t.Errorf("round trip: got %#v, want %#v", got, e.rule)
+		}
+	}
+
+	// B2 reports unset counts as null.
+	var rule b2types.LifecycleRule
+	if err := json.Unmarshal([]byte(`{"daysFromHidingToDeleting":null,"daysFromUploadingToHiding":null,"daysFromStartingToCancelingUnfinishedLargeFiles":null,"fileNamePrefix":""}`), &rule); err != nil {
+		t.Fatal(err)
+	}
+	if rule != (b2types.LifecycleRule{}) {
+		t.Errorf("null counts: got %#v, want zero rule", rule)
+	}
+}
+
+// cannedTransport replies to each API call with the JSON registered for its
+// method.
+type cannedTransport map[string]string
+
+func (c cannedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, ok := c[req.Header.Get("X-Blazer-Method")]
+	code := http.StatusOK
+	if !ok {
+		code = http.StatusNotFound
+		body = `{"status": 404, "code": "not_found", "message": "no canned reply"}`
+	}
+	return &http.Response{
+		StatusCode: code,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       ioutil.NopCloser(bytes.NewBufferString(body)),
+		Request:    req,
+	}, nil
+}
+
+func TestAuthorizeAccountInfo(t *testing.T) {
+	table := []struct {
+		desc    string
+		json    string
+		caps    []string
+		bucket  string
+		name    string
+		pfx     string
+		expires time.Time
+	}{
+		{
+			desc: "unrestricted",
+			json: `{"accountId": "acct", "recommendedPartSize": 100, "absoluteMinimumPartSize": 5,
+				"allowed": {"capabilities": ["listBuckets", "writeFiles"], "bucketId": null, "bucketName": null, "namePrefix": null},
+				"applicationKeyExpirationTimestamp": null}`,
+			caps: []string{"listBuckets", "writeFiles"},
+		},
+		{
+			desc: "restricted",
+			json: `{"accountId": "acct", "recommendedPartSize": 100, "absoluteMinimumPartSize": 5,
+				"allowed": {"capabilities": ["readFiles"], "bucketId": "bid", "bucketName": "bname", "namePrefix": "pfx/"},
+				"applicationKeyExpirationTimestamp": 1700000000123}`,
+			caps:    []string{"readFiles"},
+			bucket:  "bid",
+			name:    "bname",
+			pfx:     "pfx/",
+			expires: time.Unix(1700000000, 123e6),
+		},
+	}
+
+	for _, e := range table {
+		rt := cannedTransport{"b2_authorize_account": e.json}
+		b2, err := AuthorizeAccount(context.Background(), "id", "key", Transport(rt))
+		if err != nil {
+			t.Fatalf("%s: %v", e.desc, err)
+		}
+		if got := b2.AccountID(); got != "acct" {
+			t.Errorf("%s: AccountID: got %q, want %q", e.desc, got, "acct")
+		}
+		if got := b2.Capabilities(); !reflect.DeepEqual(got, e.caps) {
+			t.Errorf("%s: Capabilities: got %v, want %v", e.desc, got, e.caps)
+		}
+		if got := b2.RecommendedPartSize(); got != 100 {
+			t.Errorf("%s: RecommendedPartSize: got %d, want 100", e.desc, got)
+		}
+		if got := b2.AbsoluteMinimumPartSize(); got != 5 {
+			t.Errorf("%s: AbsoluteMinimumPartSize: got %d, want 5", e.desc, got)
+		}
+		if id, name := b2.RestrictedBucket(); id != e.bucket || name != e.name {
+			t.Errorf("%s: RestrictedBucket: got (%q, %q), want (%q, %q)", e.desc, id, name, e.bucket, e.name)
+		}
+		if got := b2.RestrictedPrefix(); got != e.pfx {
+			t.Errorf("%s: RestrictedPrefix: got %q, want %q", e.desc, got, e.pfx)
+		}
+		if got := b2.KeyExpiration(); !got.Equal(e.expires) {
+			t.Errorf("%s: KeyExpiration: got %v, want %v", e.desc, got, e.expires)
+		}
+	}
+}
+
+func TestUpdateBucketRevision(t *testing.T) {
+	ctx := context.Background()
+	rt := cannedTransport{
+		"b2_authorize_account": `{"accountId": "acct", "apiUrl": "https://api.example.com", "allowed": {"capabilities": ["writeBuckets"]}}`,
+		"b2_update_bucket":     `{"bucketId": "id", "bucketName": "name", "bucketType": "allPrivate", "revision": 5}`,
+	}
+	b2, err := AuthorizeAccount(ctx, "id", "key", Transport(rt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := b2.Bucket("id", "name")
+	b.Revision = 4
+	nb, err := b.Update(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nb.Revision != 5 {
+		t.Errorf("Update: got revision %d, want 5", nb.Revision)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tenKeys := make(map[string]string)
+	for i := 0; i < 10; i++ {
+		tenKeys[fmt.Sprintf("key%d", i)] = "v"
+	}
+	elevenKeys := map[string]string{"one_more": "v"}
+	for k, v := range tenKeys {
+		elevenKeys[k] = v
+	}
+	table := []struct {
+		desc string
+		name string
+		info map[string]string
+		want string // a substring of the error, or empty
+	}{
+		{desc: "ok", name: "a/b c.txt", info: tenKeys},
+		{desc: "empty name", want: "empty"},
+		{desc: "long name", name: strings.Repeat("é", 513), want: "1026 bytes, 2 more than the limit of 1024"},
+		{desc: "control character", name: "a\nb", want: "U+000A"},
+		{desc: "delete", name: "a\x7fb", want: "U+007F"},
+		{desc: "invalid utf-8", name: "a\xffb", want: "UTF-8"},
+		{desc: "too many keys", name: "a", info: elevenKeys, want: "11 keys, 1 more"},
+		{desc: "bad key", name: "a", info: map[string]string{"src.hash": "v"}, want: `"src.hash" contains '.'`},
+		{desc: "long key", name: "a", info: map[string]string{strings.Repeat("k", 51): "v"}, want: "51 bytes"},
+		{desc: "large info", name: "a", info: map[string]string{"a": strings.Repeat("v", 4000), "b": strings.Repeat("v", 3000)}, want: "7022 bytes, 22 more"},
+	}
+	for _, e := range table {
+		err := ValidateFileName(e.name)
+		if err == nil {
+			err = ValidateFileInfo(e.info)
+		}
+		switch {
+		case e.want == "" && err != nil:
+			t.Errorf("%s: %v", e.desc, err)
+		case e.want != "" && err == nil:
+			t.Errorf("%s: got no error, want %q", e.desc, e.want)
+		case e.want != "" && !strings.Contains(err.Error(), e.want):
+			t.Errorf("%s: got %v, want %q", e.desc, err, e.want)
+		}
+	}
+
+	o := &b2Options{skipValidation: true}
+	if err := o.validate("", elevenKeys); err != nil {
+		t.Errorf("validate with SkipValidation: %v", err)
+	}
+}
+
+// infoTransport stores the file info sent with b2_upload_file the way B2
+// does, with lowercased keys and decoded values, and serves it back from
+// b2_download_file_by_name.
+type infoTransport struct {
+	canned cannedTransport
+	info   map[string]string
+}
+
+func (it *infoTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	switch req.Header.Get("X-Blazer-Method") {
+	case "b2_upload_file":
+		it.info = make(map[string]string)
+		for k := range req.Header {
+			if !strings.HasPrefix(k, "X-Bz-Info-") {
+				continue
+			}
+			v, err := url.QueryUnescape(req.Header.Get(k))
+			if err != nil {
+				return nil, err
+			}
+			it.info[strings.ToLower(strings.TrimPrefix(k, "X-Bz-Info-"))] = v
+		}
+	case "b2_download_file_by_name":
+		h := http.Header{"Content-Length": []string{"0"}}
+		for k, v := range it.info {
+			h.Set("X-Bz-Info-"+k, url.QueryEscape(v))
+		}
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     h,
+			Body:       ioutil.NopCloser(&bytes.Buffer{}),
+			Request:    req,
+		}, nil
+	}
+	return it.canned.RoundTrip(req)
+}
+
+func TestInfoRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	rt := &infoTransport{
+		canned: cannedTransport{
+			"b2_authorize_account": `{"accountId": "acct", "apiUrl": "https://api.example.com", "downloadUrl": "https://f000.example.com", "allowed": {"capabilities": ["writeFiles"]}}`,
+			"b2_get_upload_url":    `{"uploadUrl": "https://upload.example.com", "authorizationToken": "token"}`,
+			"b2_upload_file":       `{"fileId": "id", "fileName": "name", "action": "upload"}`,
+		},
+	}
+	b2, err := AuthorizeAccount(ctx, "id", "key", Transport(rt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := b2.Bucket("id", "bucket")
+	u, err := b.GetUploadURL(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := map[string]string{
+		"SrcHash":  "ABC",
+		"src_Mode": "0644",
+		"src-mode": "a b+c%20d",
+		"path":     "ünï/çødé?#&=",
+	}
+	if _, err := u.UploadFile(ctx, strings.NewReader(""), 0, "name", "text/plain", "none", info); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"srchash":  "ABC",
+		"src_mode": "0644",
+		"src-mode": "a b+c%20d",
+		"path":     "ünï/çødé?#&=",
+	}
+	if !reflect.DeepEqual(rt.info, want) {
+		t.Errorf("UploadFile: stored %v, want %v", rt.info, want)
+	}
+	fr, err := b.DownloadFileByName(ctx, "name", 0, 0, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fr.Close()
+	if !reflect.DeepEqual(fr.Info, want) {
+		t.Errorf("DownloadFileByName: got %v, want %v", fr.Info, want)
+	}
+}
+
+func TestUploadResultInfo(t *testing.T) {
+	ctx := context.Background()
+	rt := cannedTransport{
+		"b2_authorize_account": `{"accountId": "acct", "apiUrl": "https://api.example.com", "allowed": {"capabilities": ["writeFiles"]}}`,
+		"b2_get_upload_url":    `{"uploadUrl": "https://upload.example.com", "authorizationToken": "token"}`,
+		"b2_upload_file": `{"fileId": "id1", "fileName": "small", "action": "upload", "contentLength": 5,
+			"contentSha1": "sha", "contentType": "text/plain", "fileInfo": {"Key": "v"}, "uploadTimestamp": 1700000000123}`,
+		"b2_start_large_file": `{"fileId": "id2"}`,
+		"b2_finish_large_file": `{"fileId": "id2", "fileName": "large", "action": "upload", "contentLength": 10,
+			"contentSha1": "none", "contentType": "text/plain", "fileInfo": {"large_file_sha1": "whole"}, "uploadTimestamp": 1700000000456}`,
+	}
+	b2, err := AuthorizeAccount(ctx, "id", "key", Transport(rt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := b2.Bucket("id", "bucket")
+	u, err := b.GetUploadURL(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := u.UploadFile(ctx, strings.NewReader("hello"), 5, "small", "text/plain", "sha", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &FileInfo{
+		Name:        "small",
+		SHA1:        "sha",
+		Size:        5,
+		ContentType: "text/plain",
+		Info:        map[string]string{"key": "v"},
+		Status:      "upload",
+		Timestamp:   time.Unix(1700000000, 123e6),
+	}
+	if !reflect.DeepEqual(f.Info, want) {
+		t.Errorf("UploadFile: got info %+v, want %+v", f.Info, want)
+	}
+	lf, err := b.StartLargeFile(ctx, "large", "text/plain", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lf.size = 10
+	f, err = lf.FinishLargeFile(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = &FileInfo{
+		Name:        "large",
+		SHA1:        "none",
+		Size:        10,
+		ContentType: "text/plain",
+		Info:        map[string]string{"large_file_sha1": "whole"},
+		Status:      "upload",
+		Timestamp:   time.Unix(1700000000, 456e6),
+	}
+	if !reflect.DeepEqual(f.Info, want) {
+		t.Errorf("FinishLargeFile: got info %+v, want %+v", f.Info, want)
+	}
+}
+
+func TestFinishLargeFileParts(t *testing.T) {
+	ctx := context.Background()
+	rt := cannedTransport{
+		"b2_authorize_account": `{"accountId": "acct", "apiUrl": "https://api.example.com", "allowed": {"capabilities": ["writeFiles"]}}`,
+		"b2_start_large_file":  `{"fileId": "id"}`,
+		"b2_finish_large_file": `{"fileId": "id", "fileName": "large", "action": "upload"}`,
+	}
+	b2, err := AuthorizeAccount(ctx, "id", "key", Transport(rt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := b2.Bucket("id", "bucket")
+	table := []struct {
+		hashes  map[int]string
+		missing int // 0 if the request should be sent
+	}{
+		{hashes: map[int]string{1: "a", 2: "b"}},
+		{hashes: map[int]string{1: "a", 3: "c"}, missing: 2},
+		{hashes: map[int]string{2: "b", 3: "c"}, missing: 1},
+		{hashes: map[int]string{0: "z", 1: "a"}, missing: 2},
+	}
+	for _, e := range table {
+		lf, err := b.StartLargeFile(ctx, "large", "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lf.hashes = e.hashes
+		_, err = lf.FinishLargeFile(ctx)
+		if e.missing == 0 {
+			if err != nil {
+				t.Errorf("FinishLargeFile with parts %v: %v", e.hashes, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), fmt.Sprintf("part %d is missing", e.missing)) {
+			t.Errorf("FinishLargeFile with parts %v: got %v, want part %d missing", e.hashes, err, e.missing)
+		}
+	}
+}
+
+// rangeTransport answers downloads with the given Content-Range header.
+type rangeTransport struct {
+	canned cannedTransport
+	crange string
+}
+
+func (rt *rangeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("X-Blazer-Method") != "b2_download_file_by_name" {
+		return rt.canned.RoundTrip(req)
+	}
+	h := http.Header{"Content-Length": []string{"10"}}
+	code := http.StatusOK
+	if rt.crange != "" {
+		h.Set("Content-Range", rt.crange)
+		code = http.StatusPartialContent
+	}
+	return &http.Response{
+		StatusCode: code,
+		Header:     h,
+		Body:       ioutil.NopCloser(strings.NewReader("0123456789")),
+		Request:    req,
+	}, nil
+}
+
+func TestDownloadSize(t *testing.T) {
+	ctx := context.Background()
+	rt := &rangeTransport{
+		canned: cannedTransport{
+			"b2_authorize_account": `{"accountId": "acct", "apiUrl": "https://api.example.com", "downloadUrl": "https://f000.example.com", "allowed": {"capabilities": ["readFiles"]}}`,
+		},
+	}
+	b2, err := AuthorizeAccount(ctx, "id", "key", Transport(rt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := b2.Bucket("id", "bucket")
+	table := []struct {
+		crange string
+		want   int64
+	}{
+		{want: 10},
+		{crange: "bytes 20-29/10007", want: 10007},
+		{crange: "bytes 20-29/*", want: 10},
+	}
+	for _, e := range table {
+		rt.crange = e.crange
+		fr, err := b.DownloadFileByName(ctx, "name", 20, 10, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fr.Close()
+		if fr.Size != e.want {
+			t.Errorf("Content-Range %q: got size %d, want %d", e.crange, fr.Size, e.want)
+		}
+	}
+}
+
+// downloadTransport sends downloads to a real transport, and answers
+// everything else from canned.
+type downloadTransport struct {
+	canned cannedTransport
+}
+
+func (dt *downloadTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("X-Blazer-Method") != "b2_download_file_by_name" {
+		return dt.canned.RoundTrip(req)
+	}
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestDownloadHeaders(t *testing.T) {
+	ctx := context.Background()
+	stored := "\x1f\x8b pretend this is gzip"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if ae := req.Header.Get("Accept-Encoding"); ae != "identity" {
+			t.Errorf("Accept-Encoding: got %q, want identity", ae)
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Set("Content-Language", "en")
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("X-Bz-Upload-Timestamp", "1500000000123")
+		w.Header().Set("Content-Length", fmt.Sprint(len(stored)))
+		w.Write([]byte(stored))
+	}))
+	defer srv.Close()
+	dt := &downloadTransport{
+		canned: cannedTransport{
+			"b2_authorize_account": fmt.Sprintf(`{"accountId": "acct", "apiUrl": "https://api.example.com", "downloadUrl": %q, "allowed": {"capabilities": ["readFiles"]}}`, srv.URL),
+		},
+	}
+	b2, err := AuthorizeAccount(ctx, "id", "key", Transport(dt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fr, err := b2.Bucket("id", "bucket").DownloadFileByName(ctx, "name", 0, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fr.Close()
+	body, err := ioutil.ReadAll(fr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != stored || fr.ContentLength != len(stored) {
+		t.Errorf("got %d bytes %q, want the %d stored", fr.ContentLength, body, len(stored))
+	}
+	wantInfo := map[string]string{"b2-cache-control": "max-age=60", "b2-content-encoding": "gzip", "b2-content-language": "en"}
+	if !reflect.DeepEqual(fr.Info, wantInfo) {
+		t.Errorf("Info: got %v, want %v", fr.Info, wantInfo)
+	}
+	if want := time.Unix(1500000000, 123e6); !fr.Timestamp.Equal(want) {
+		t.Errorf("Timestamp: got %v, want %v", fr.Timestamp, want)
+	}
+}
+
+// recordTransport remembers the last download it was sent, and answers it
+// with an empty body.
+type recordTransport struct {
+	canned cannedTransport
+	req    *http.Request
+}
+
+func (rt *recordTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("X-Blazer-Method") != "b2_download_file_by_name" {
+		return rt.canned.RoundTrip(req)
+	}
+	rt.req = req
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Length": []string{"0"}},
+		Body:       ioutil.NopCloser(strings.NewReader("")),
+		Request:    req,
+	}, nil
+}
+
+func TestDownloadOptions(t *testing.T) {
+	ctx := context.Background()
+	rt := &recordTransport{
+		canned: cannedTransport{
+			"b2_authorize_account": `{"accountId": "acct", "authorizationToken": "account-token", "apiUrl": "https://api.example.com", "downloadUrl": "https://f000.example.com", "allowed": {"capabilities": ["readFiles"]}}`,
+		},
+	}
+	b2, err := AuthorizeAccount(ctx, "id", "key", Transport(rt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := b2.Bucket("id", "bucket")
+	table := []struct {
+		opts      DownloadOptions
+		wantQuery url.Values
+		wantAuth  string
+	}{
+		{wantQuery: url.Values{}, wantAuth: "account-token"},
+		{
+			opts: DownloadOptions{
+				Overrides: DownloadAuthorizationOptions{
+					ContentDisposition: `attachment; filename="a b+c.pdf"`,
+					ContentType:        "application/pdf",
+				},
+				AuthToken: "download-token",
+			},
+			wantQuery: url.Values{
+				"b2ContentDisposition": {`attachment; filename="a b+c.pdf"`},
+				"b2ContentType":        {"application/pdf"},
+			},
+			wantAuth: "download-token",
+		},
+	}
+	for _, e := range table {
+		fr, err := b.DownloadFileByNameWithOptions(ctx, "some file", 0, 0, false, e.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fr.Close()
+		if got := rt.req.URL.Query(); !reflect.DeepEqual(got, e.wantQuery) {
+			t.Errorf("%+v: got query %v, want %v", e.opts, got, e.wantQuery)
+		}
+		if got := rt.req.Header.Get("Authorization"); got != e.wantAuth {
+			t.Errorf("%+v: got Authorization %q, want %q", e.opts, got, e.wantAuth)
+		}
+		if got := rt.req.URL.Path; got != "/file/bucket/some file" {
+			t.Errorf("%+v: got path %q", e.opts, got)
+		}
+	}
+}
+
+func TestCapExceeded(t *testing.T) {
+	table := []struct {
+		code    string
+		status  int
+		capped  bool
+		storage bool
+		want    ErrAction
+	}{
+		{code: "storage_cap_exceeded", status: 403, capped: true, storage: true, want: Punt},
+		{code: "cap_exceeded", status: 403, capped: true, storage: true, want: Punt},
+		{code: "transaction_cap_exceeded", status: 403, capped: true, want: Punt},
+		{code: "download_cap_exceeded", status: 403, capped: true, want: Punt},
+		{code: "service_unavailable", status: 503, want: Retry},
+	}
+
+	for _, e := range table {
+		req, err := http.NewRequest("POST", "https://example.com/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-Blazer-Method", "b2_upload_part")
+		resp := &http.Response{
+			StatusCode: e.status,
+			// A cap isn't lifted by waiting, whatever the response says.
+			Header:  http.Header{"Retry-After": []string{"5"}},
+			Body:    ioutil.NopCloser(strings.NewReader(fmt.Sprintf(`{"status": %d, "code": %q, "message": "nope"}`, e.status, e.code))),
+			Request: req,
+		}
+		err = (&b2Options{}).mkErr(resp)
+		ce, ok := err.(*CapExceededError)
+		if ok != e.capped {
+			t.Errorf("%s: got %T, want a *CapExceededError: %v", e.code, err, e.capped)
+		}
+		if ok && ce.IsStorageCap() != e.storage {
+			t.Errorf("%s: IsStorageCap: got %v, want %v", e.code, ce.IsStorageCap(), e.storage)
+		}
+		if got := Action(err); got != e.want {
+			t.Errorf("%s: Action: got %v, want %v", e.code, got, e.want)
+		}
+		if status, msgCode, _ := MsgCode(err); status != e.status || msgCode != e.code {
+			t.Errorf("%s: MsgCode: got %d, %q", e.code, status, msgCode)
+		}
+	}
+}
+
+func TestInterruptedRequest(t *testing.T) {
+	table := []struct {
+		headers map[string]string
+		want    string
+	}{
+		{want: "b2_list_buckets: context deadline exceeded"},
+		{
+			headers: map[string]string{"X-Bz-Part-Number": "3"},
+			want:    "b2_list_buckets (part 3): context deadline exceeded",
+		},
+		{
+			headers: map[string]string{"Range": "bytes=10-19"},
+			want:    "b2_list_buckets (bytes=10-19): context deadline exceeded",
+		},
+	}
+	for _, e := range table {
+		req, err := http.NewRequest("POST", "https://example.com/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-Blazer-Method", "b2_list_buckets")
+		for k, v := range e.headers {
+			req.Header.Set(k, v)
+		}
+		rt := roundTripFunc(func(*http.Request) (*http.Response, error) {
+			return nil, context.DeadlineExceeded
+		})
+		_, err = makeNetRequest(context.Background(), req, rt)
+		if !errors.Is(err, context.DeadlineExceeded) || err.Error() != e.want {
+			t.Errorf("got %v, want %q", err, e.want)
+		}
+	}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
+func TestWrappedErrors(t *testing.T) {
+	req, err := http.NewRequest("POST", "https://example.com/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Blazer-Method", "b2_list_buckets")
+	req.Header.Set("X-Blazer-Request-ID", "7")
+	resp := &http.Response{
+		StatusCode: 503,
+		Header: http.Header{
+			"Retry-After": []string{"5"},
+			"Date":        []string{"Tue, 13 Oct 2026 12:00:00 GMT"},
+			"Cf-Ray":      []string{"8a1b2c"},
+		},
+		Body:    ioutil.NopCloser(strings.NewReader(`{"status": 503, "code": "service_unavailable", "message": "later"}`)),
+		Request: req,
+	}
+	err = fmt.Errorf("listing: %w", (&b2Options{}).mkErr(resp))
+	if got := Action(err); got != Retry {
+		t.Errorf("Action: got %v, want %v", got, Retry)
+	}
+	if got := Backoff(err); got != 5*time.Second {
+		t.Errorf("Backoff: got %v, want 5s", got)
+	}
+	if status, code, msg := MsgCode(err); status != 503 || code != "service_unavailable" || msg != "later" {
+		t.Errorf("MsgCode: got %d, %q, %q", status, code, msg)
+	}
+	if got := Method(err); got != "b2_list_buckets" {
+		t.Errorf("Method: got %q, want %q", got, "b2_list_buckets")
+	}
+	if id, host := Request(err); id != "7" || host != "example.com" {
+		t.Errorf("Request: got %q, %q", id, host)
+	}
+	want := "listing: b2_list_buckets: 503: later (request 7, host example.com, 2026-10-13T12:00:00Z, cf-ray 8a1b2c)"
+	if err.Error() != want {
+		t.Errorf("Error: got %q, want %q", err.Error(), want)
+	}
+}
+
+// busyTransport refuses the first refuse API calls with 429 Too Many
+// Requests, and replies to the rest as cannedTransport does.
+type busyTransport struct {
+	cannedTransport
+	mu     sync.Mutex
+	refuse int
+}
+
+func (b *busyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	b.mu.Lock()
+	busy := b.refuse > 0
+	b.refuse--
+	b.mu.Unlock()
+	if !busy {
+		return b.cannedTransport.RoundTrip(req)
+	}
+	return &http.Response{
+		StatusCode: http.StatusTooManyRequests,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       ioutil.NopCloser(strings.NewReader(`{"status": 429, "code": "too_many_requests", "message": "slow down"}`)),
+		Request:    req,
+	}, nil
+}
+
+// portalTransport answers the first pages requests with an HTML page, as a
+// captive portal would, and the rest as cannedTransport.
+type portalTransport struct {
+	cannedTransport
+	pages int
+	calls int
+}
+
+func (p *portalTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	p.calls++
+	if p.calls > p.pages {
+		return p.cannedTransport.RoundTrip(req)
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{"text/html"}},
+		Body:       ioutil.NopCloser(strings.NewReader("<html>\n\t<body>Sign in\x00 to continue " + strings.Repeat("x", 300) + "</body></html>")),
+		Request:    req,
+	}, nil
+}
+
+func TestDecodeError(t *testing.T) {
+	ctx := context.Background()
+	canned := cannedTransport{"b2_authorize_account": `{"accountId": "acct"}`}
+
+	rt := &portalTransport{cannedTransport: canned, pages: 1}
+	if _, err := AuthorizeAccount(ctx, "id", "key", Transport(rt)); err != nil || rt.calls != 2 {
+		t.Errorf("one bad reply: got %v after %d calls, want success after 2", err, rt.calls)
+	}
+
+	rt = &portalTransport{cannedTransport: canned, pages: 2}
+	_, err := AuthorizeAccount(ctx, "id", "key", Transport(rt))
+	var de *DecodeError
+	if !errors.As(err, &de) {
+		t.Fatalf("two bad replies: got %v, want a *DecodeError", err)
+	}
+	if rt.calls != 2 {
+		t.Errorf("two bad replies: %d calls, want 2", rt.calls)
+	}
+	if de.Method != "b2_authorize_account" || de.Status != 200 || de.ContentType != "text/html" {
+		t.Errorf("got method %q, status %d, Content-Type %q", de.Method, de.Status, de.ContentType)
+	}
+	if want := "<html> <body>Sign in to continue xxx"; !strings.HasPrefix(de.Body, want) || len(de.Body) > decodeSnippet {
+		t.Errorf("Body: got %q, want %q... in at most %d bytes", de.Body, want, decodeSnippet)
+	}
+	var se *json.SyntaxError
+	if !errors.As(err, &se) {
+		t.Errorf("got %v, want it to wrap a *json.SyntaxError", err)
+	}
+	if !strings.HasPrefix(err.Error(), `b2_authorize_account: couldn't decode 200 reply (Content-Type "text/html"): `) {
+		t.Errorf("Error: got %q", err.Error())
+	}
+	if Action(err) != Punt {
+		t.Errorf("Action: got %v, want %v", Action(err), Punt)
+	}
+}
+
+func TestDecodeErrorSnippet(t *testing.T) {
+	ctx := context.Background()
+	// The reply fails to decode only at its end, once all of it has been
+	// read; unless it is logged, only its start is kept.
+	reply := `{"accountId": "acct", "pad": "` + strings.Repeat("x", 32<<10) + `", }`
+	_, err := AuthorizeAccount(ctx, "id", "key", Transport(cannedTransport{"b2_authorize_account": reply}))
+	var de *DecodeError
+	if !errors.As(err, &de) {
+		t.Fatalf("got %v, want a *DecodeError", err)
+	}
+	if want := sanitize([]byte(reply[:decodeSnippet]), decodeSnippet); de.Body != want {
+		t.Errorf("Body: got %q, want %q", de.Body, want)
+	}
+	// The buffer that kept the reply has been pooled; it should hold no more
+	// than the snippet.
+	if p := getReplyBuffer(decodeSnippet); cap(p.b) > 4<<10 {
+		t.Errorf("reply buffer grew to %d bytes; want the reply not kept whole", cap(p.b))
+	}
+}
+
+func TestListFileNamesFunc(t *testing.T) {
+	ctx := context.Background()
+	canned := cannedTransport{
+		"b2_authorize_account": `{"accountId": "acct", "authorizationToken": "tok", "apiUrl": "https://api.example.com"}`,
+		"b2_list_buckets":      `{"buckets": [{"bucketId": "id", "bucketName": "bucket", "bucketType": "allPrivate"}]}`,
+	}
+	table := []struct {
+		desc  string
+		reply string
+		names []string
+		next  string
+		fail  bool
+	}{
+		{
+			desc:  "whole",
+			reply: `{"files": [{"fileName": "a", "fileInfo": {"k": "v"}}, {"fileName": "b"}], "nextFileName": "c"}`,
+			names: []string{"a", "b"},
+			next:  "c",
+		},
+		{
+			desc:  "empty",
+			reply: `{"files": [], "nextFileName": null}`,
+		},
+		{
+			desc:  "cut off",
+			reply: `{"files": [{"fileName": "a"}, {"fileName": "b"}, {"fileNa`,
+			names: []string{"a", "b"},
+			fail:  true,
+		},
+	}
+	for _, e := range table {
+		canned["b2_list_file_names"] = e.reply
+		rt := &portalTransport{cannedTransport: canned}
+		b2, err := AuthorizeAccount(ctx, "id", "key", Transport(rt))
+		if err != nil {
+			t.Fatal(err)
+		}
+		buckets, err := b2.ListBuckets(ctx, "")
+		if err != nil || len(buckets) != 1 {
+			t.Fatalf("got %v buckets, %v", buckets, err)
+		}
+		calls := rt.calls
+		var names []string
+		next, err := buckets[0].ListFileNamesFunc(ctx, 10, "", "", "", func(f *File) {
+			names = append(names, f.Name)
+			if f.Name == "b" && f.Info.Info != nil {
+				t.Errorf("%s: file b got the info of file a: %v", e.desc, f.Info.Info)
+			}
+		})
+		var de *DecodeError
+		if e.fail != errors.As(err, &de) {
+			t.Errorf("%s: got %v, want a *DecodeError: %t", e.desc, err, e.fail)
+		}
+		if !reflect.DeepEqual(names, e.names) || next != e.next {
+			t.Errorf("%s: got %v and %q, want %v and %q", e.desc, names, next, e.names, e.next)
+		}
+		// Files already handed on can't be taken back, so a reply that
+		// fails partway is not tried again.
+		if n := rt.calls - calls; n != 1 {
+			t.Errorf("%s: %d calls, want 1", e.desc, n)
+		}
+	}
+}
+
+func TestListKeys(t *testing.T) {
+	ctx := context.Background()
+	rt := cannedTransport{
+		"b2_authorize_account": `{"accountId": "acct", "authorizationToken": "token", "apiUrl": "https://api.example.com"}`,
+		"b2_list_keys": `{"keys": [
+			{"keyName": "forever", "applicationKeyId": "k1", "capabilities": ["listFiles"], "expirationTimestamp": null, "bucketId": null, "namePrefix": null},
+			{"keyName": "scoped", "applicationKeyId": "k2", "capabilities": ["readFiles", "shareFiles"], "expirationTimestamp": 1700000000000, "bucketId": "b1", "namePrefix": "pfx/"}
+		], "nextApplicationKeyId": "k3"}`,
+	}
+	b, err := AuthorizeAccount(ctx, "id", "key", Transport(rt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, next, err := b.ListKeys(ctx, 2, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next != "k3" || len(keys) != 2 {
+		t.Fatalf("ListKeys: got %d keys and %q, want 2 and k3", len(keys), next)
+	}
+	if k := keys[0]; k.Name != "forever" || !k.Expires.IsZero() || k.BucketID != "" || k.Prefix != "" {
+		t.Errorf("key without restrictions: got %+v", k)
+	}
+	k := keys[1]
+	if want := time.Unix(1700000000, 0); k.Name != "scoped" || !k.Expires.Equal(want) || k.BucketID != "b1" || k.Prefix != "pfx/" {
+		t.Errorf("restricted key: got %+v", k)
+	}
+	if !reflect.DeepEqual(k.Capabilities, []string{"readFiles", "shareFiles"}) {
+		t.Errorf("restricted key: got capabilities %v", k.Capabilities)
+	}
+}
+
+type testLogger struct {
+	max  int
+	msgs []string
+}
+
+func (l *testLogger) Enabled(level int) bool { return level <= l.max }
+
+func (l *testLogger) Log(level int, msg string) {
+	l.msgs = append(l.msgs, fmt.Sprintf("%d: %s", level, msg))
+}
+
+func TestLogger(t *testing.T) {
+	ctx := context.Background()
+	rt := cannedTransport{
+		"b2_authorize_account": `{"accountId": "acct", "authorizationToken": "secret-token", "apiUrl": "https://api.example.com"}`,
+		"b2_create_key":        `{"applicationKeyId": "id", "applicationKey":"secret-key"}`,
+	}
+	l := &testLogger{max: 2}
+	b, err := AuthorizeAccount(ctx, "id", "secret-app-key", Transport(rt), WithLogger(l))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.CreateKey(ctx, "key", []string{"listFiles"}, 0, "", ""); err != nil {
+		t.Fatal(err)
+	}
+	if len(l.msgs) != 4 {
+		t.Fatalf("got %d messages, want a request and a response for each call: %q", len(l.msgs), l.msgs)
+	}
+	for i, msg := range l.msgs {
+		prefix := "2: >> "
+		if i%2 == 1 {
+			prefix = "2: << "
+		}
+		if !strings.HasPrefix(msg, prefix) {
+			t.Errorf("message %d: got %q, want prefix %q", i, msg, prefix)
+		}
+		if strings.Contains(msg, "secret") {
+			t.Errorf("message %d: not redacted: %q", i, msg)
+		}
+	}
+	if !strings.Contains(l.msgs[3], `"applicationKey": "[redacted]"`) {
+		t.Errorf("got %q, want the key redacted", l.msgs[3])
+	}
+
+	l = &testLogger{max: 1}
+	if _, err := AuthorizeAccount(ctx, "id", "key", Transport(rt), WithLogger(l)); err != nil {
+		t.Fatal(err)
+	}
+	if len(l.msgs) != 0 {
+		t.Errorf("logging up to level 1: got %q", l.msgs)
+	}
+}
+
+// attrLogger records the attributes of each message.
+type attrLogger struct {
+	testLogger
+	attrs []map[string]interface{}
+}
+
+func (l *attrLogger) LogAttrs(level int, msg string, attrs []blog.Attr) {
+	m := map[string]interface{}{"msg": msg}
+	for _, a := range attrs {
+		m[a.Key] = a.Value
+	}
+	l.attrs = append(l.attrs, m)
+}
+
+func TestLogAttrs(t *testing.T) {
+	ctx := context.Background()
+	canned := cannedTransport{"b2_authorize_account": `{"accountId": "acct", "authorizationToken": "secret-token"}`}
+	rt := &portalTransport{cannedTransport: canned, pages: 1}
+	l := &attrLogger{testLogger: testLogger{max: 2}}
+	if _, err := AuthorizeAccount(ctx, "id", "key", Transport(rt), WithLogger(l)); err != nil {
+		t.Fatal(err)
+	}
+	if len(l.msgs) != 1 || len(l.attrs) != 4 {
+		t.Fatalf("got %q and %v, want one message, about the retry, and four with attributes", l.msgs, l.attrs)
+	}
+	for i, want := range []map[string]interface{}{
+		{"msg": "b2 request", "method": "b2_authorize_account", "attempt": 1, "verb": "GET", "bytes": int64(0)},
+		{"msg": "b2 response", "method": "b2_authorize_account", "attempt": 1, "status": 200},
+		{"msg": "b2 request", "method": "b2_authorize_account", "attempt": 2},
+		{"msg": "b2 response", "method": "b2_authorize_account", "attempt": 2, "status": 200, "reply": `{"accountId": "acct", "authorizationToken": "[redacted]"}`},
+	} {
+		got := l.attrs[i]
+		for k, v := range want {
+			if got[k] != v {
+				t.Errorf("message %d: %s: got %v, want %v", i, k, got[k], v)
+			}
+		}
+		if got["request_id"] == "" {
+			t.Errorf("message %d: no request_id", i)
+		}
+		if d, ok := got["duration"].(time.Duration); got["msg"] == "b2 response" && (!ok || d < 0) {
+			t.Errorf("message %d: duration: got %v", i, got["duration"])
+		}
+	}
+}
+
+func TestRequestLimiter(t *testing.T) {
+	ctx := context.Background()
+	const rps = 50
+	l := NewRequestLimiter(rps, 2)
+	rt := &busyTransport{cannedTransport: cannedTransport{"b2_authorize_account": `{"accountId": "acct"}`}}
+	auth := func() error {
+		_, err := AuthorizeAccount(ctx, "id", "key", Transport(rt), LimitRequests(l))
+		return err
+	}
+
+	// The burst goes at once, and the rest at the rate.
+	start := time.Now()
+	for i := 0; i < 6; i++ {
+		if err := auth(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, want := time.Since(start), 4*time.Second/rps; got < want*9/10 {
+		t.Errorf("6 calls with a burst of 2 took %v, want at least %v", got, want)
+	}
+
+	rt.refuse = 2
+	for i := 0; i < 2; i++ {
+		if err := auth(); Action(err) != Retry {
+			t.Errorf("refused call: got %v, want an error to retry", err)
+		}
+	}
+	if got := l.Rate(); got > rps/4*1.1 {
+		t.Errorf("after two 429s: rate is %v, want about %v", got, rps/4)
+	}
+	if err := auth(); err != nil {
+		t.Fatal(err)
+	}
+
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := AuthorizeAccount(cctx, "id", "key", Transport(rt), LimitRequests(l)); !errors.Is(err, context.Canceled) || !strings.HasPrefix(err.Error(), "b2_authorize_account: ") {
+		t.Errorf("waiting with a cancelled context: got %v, want %v from b2_authorize_account", err, context.Canceled)
+	}
+
+	for _, m := range []string{"b2_upload_file", "b2_upload_part"} {
+		if limited(m) {
+			t.Errorf("%s is limited, want it left to bandwidth", m)
+		}
+	}
+	if !limited("b2_list_file_names") {
+		t.Error("b2_list_file_names is not limited")
+	}
+}
+
+// downTransport replies to API calls with 503 Service Unavailable while it is
+// down, and as cannedTransport does otherwise.
+type downTransport struct {
+	cannedTransport
+	mu    sync.Mutex
+	down  bool
+	calls int
+}
+
+func (d *downTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	d.mu.Lock()
+	down := d.down
+	d.calls++
+	d.mu.Unlock()
+	if !down {
+		return d.cannedTransport.RoundTrip(req)
+	}
+	return &http.Response{
+		StatusCode: http.StatusServiceUnavailable,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       ioutil.NopCloser(strings.NewReader(`{"status": 503, "code": "service_unavailable", "message": "down"}`)),
+		Request:    req,
+	}, nil
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	ctx := context.Background()
+	const cooldown = 50 * time.Millisecond
+	cb := NewCircuitBreaker(3, cooldown, 1)
+	rt := &downTransport{cannedTransport: cannedTransport{"b2_authorize_account": `{"accountId": "acct"}`}, down: true}
+	auth := func() error {
+		_, err := AuthorizeAccount(ctx, "id", "key", Transport(rt), BreakCircuit(cb))
+		return err
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := auth(); Action(err) != Retry {
+			t.Fatalf("call %d: got %v, want a 503", i+1, err)
+		}
+	}
+	if !cb.Open() {
+		t.Error("circuit closed after three failures")
+	}
+	if err := auth(); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("open circuit: got %v, want %v", err, ErrCircuitOpen)
+	}
+	if rt.calls != 3 {
+		t.Errorf("open circuit: %d calls made, want 3", rt.calls)
+	}
+
+	// A failed probe opens the circuit again.
+	time.Sleep(cooldown * 3 / 2)
+	if err := auth(); Action(err) != Retry {
+		t.Errorf("probe: got %v, want a 503", err)
+	}
+	if err := auth(); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("after a failed probe: got %v, want %v", err, ErrCircuitOpen)
+	}
+
+	// And a good one closes it.
+	time.Sleep(cooldown * 3 / 2)
+	rt.down = false
+	for i := 0; i < 3; i++ {
+		if err := auth(); err != nil {
+			t.Errorf("closed circuit: call %d: %v", i+1, err)
+		}
+	}
+	if cb.Open() {
+		t.Error("circuit open after a successful probe")
+	}
+	if rt.calls != 7 {
+		t.Errorf("%d calls made, want 7", rt.calls)
+	}
+}
+
+// discardLogger wants every message and keeps none.
+type discardLogger struct{}
+
+func (discardLogger) Enabled(int) bool { return true }
+func (discardLogger) Log(int, string)  {}
+
+// BenchmarkListFileNames decodes a 1MB page of names, with and without
+// logging at level 2, which formats the whole reply.
+func BenchmarkListFileNames(b *testing.B) {
+	ctx := context.Background()
+	files := make([]b2types.GetFileInfoResponse, 0, 5000)
+	size := 0
+	for i := 0; size < 1<<20; i++ {
+		f := b2types.GetFileInfoResponse{
+			FileID:      fmt.Sprintf("4_z27c88f1d182b150646ff0b16_f1004ba650fe24e6b_d20180101_m000000_c000_v0001000_t%04d", i),
+			Name:        fmt.Sprintf("photos/2018/01/01/img_%06d.jpg", i),
+			Size:        int64(i),
+			SHA1:        "2c3d3dbc7ad5b2a6cd22cdb6b8e75b2b3a0e8085",
+			ContentType: "image/jpeg",
+			Action:      "upload",
+			Timestamp:   1514764800000,
+		}
+		js, err := json.Marshal(f)
+		if err != nil {
+			b.Fatal(err)
+		}
+		size += len(js)
+		files = append(files, f)
+	}
+	page, err := json.Marshal(b2types.ListFileNamesResponse{Files: files})
+	if err != nil {
+		b.Fatal(err)
+	}
+	rt := cannedTransport{
+		"b2_authorize_account": `{"accountId": "acct", "authorizationToken": "tok", "apiUrl": "https://api.example.com"}`,
+		"b2_list_buckets":      `{"buckets": [{"bucketId": "id", "bucketName": "bucket", "bucketType": "allPrivate"}]}`,
+		"b2_list_file_names":   string(page),
+	}
+	for _, e := range []struct {
+		name string
+		opts []AuthOption
+	}{
+		{name: "quiet"},
+		{name: "logged", opts: []AuthOption{WithLogger(discardLogger{})}},
+	} {
+		b.Run(e.name, func(b *testing.B) {
+			b2, err := AuthorizeAccount(ctx, "id", "key", append(e.opts, Transport(rt))...)
+			if err != nil {
+				b.Fatal(err)
+			}
+			buckets, err := b2.ListBuckets(ctx, "")
+			if err != nil || len(buckets) != 1 {
+				b.Fatalf("got %v buckets, %v", buckets, err)
+			}
+			b.ReportAllocs()
+			b.SetBytes(int64(len(page)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				fs, _, err := buckets[0].ListFileNames(ctx, len(files), "", "", "")
+				if err != nil || len(fs) != len(files) {
+					b.Fatalf("got %d files, %v", len(fs), err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkListFileNames10k lists a page of 10,000 files, as ListFileNames
+// returns it and as ListFileNamesFunc hands it on, to show the memory that
+// each needs.
+func BenchmarkListFileNames10k(b *testing.B) {
+	ctx := context.Background()
+	files := make([]b2types.GetFileInfoResponse, 10000)
+	for i := range files {
+		files[i] = b2types.GetFileInfoResponse{
+			FileID:      fmt.Sprintf("4_z27c88f1d182b150646ff0b16_f1004ba650fe24e6b_d20180101_m000000_c000_v0001000_t%05d", i),
+			Name:        fmt.Sprintf("photos/2018/01/01/img_%06d.jpg", i),
+			Size:        int64(i),
+			SHA1:        "2c3d3dbc7ad5b2a6cd22cdb6b8e75b2b3a0e8085",
+			ContentType: "image/jpeg",
+			Info:        map[string]string{"src_last_modified_millis": "1514764800000"},
+			Action:      "upload",
+			Timestamp:   1514764800000,
+		}
+	}
+	page, err := json.Marshal(b2types.ListFileNamesResponse{Files: files})
+	if err != nil {
+		b.Fatal(err)
+	}
+	rt := cannedTransport{
+		"b2_authorize_account": `{"accountId": "acct", "authorizationToken": "tok", "apiUrl": "https://api.example.com"}`,
+		"b2_list_buckets":      `{"buckets": [{"bucketId": "id", "bucketName": "bucket", "bucketType": "allPrivate"}]}`,
+		"b2_list_file_names":   string(page),
+	}
+	b2, err := AuthorizeAccount(ctx, "id", "key", Transport(rt))
+	if err != nil {
+		b.Fatal(err)
+	}
+	buckets, err := b2.ListBuckets(ctx, "")
+	if err != nil || len(buckets) != 1 {
+		b.Fatalf("got %v buckets, %v", buckets, err)
+	}
+	bucket := buckets[0]
+	b.Run("slice", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(page)))
+		for i := 0; i < b.N; i++ {
+			fs, _, err := bucket.ListFileNames(ctx, len(files), "", "", "")
+			if err != nil || len(fs) != len(files) {
+				b.Fatalf("got %d files, %v", len(fs), err)
+			}
+		}
+	})
+	b.Run("func", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(page)))
+		for i := 0; i < b.N; i++ {
+			var n int
+			_, err := bucket.ListFileNamesFunc(ctx, len(files), "", "", "", func(*File) { n++ })
+			if err != nil || n != len(files) {
+				b.Fatalf("got %d files, %v", n, err)
+			}
+		}
+	})
+}
+
+// BenchmarkMakeRequest makes a metadata call with a small reply, as
+// Object.Attrs does.
+func BenchmarkMakeRequest(b *testing.B) {
+	ctx := context.Background()
+	rt := cannedTransport{
+		"b2_authorize_account": `{"accountId": "acct", "authorizationToken": "tok", "apiUrl": "https://api.example.com"}`,
+		"b2_list_buckets":      `{"buckets": [{"bucketId": "id", "bucketName": "bucket", "bucketType": "allPrivate"}]}`,
+		"b2_get_file_info": `{"fileId": "4_z27c88f1d182b150646ff0b16_f1004ba650fe24e6b_d20180101_m000000_c000_v0001000_t0001",
+			"fileName": "photos/2018/01/01/img_000001.jpg", "contentLength": 1024, "contentSha1": "2c3d3dbc7ad5b2a6cd22cdb6b8e75b2b3a0e8085",
+			"contentType": "image/jpeg", "fileInfo": {"src_last_modified_millis": "1514764800000"}, "action": "upload", "uploadTimestamp": 1514764800000}`,
+	}
+	b2, err := AuthorizeAccount(ctx, "id", "key", Transport(rt))
+	if err != nil {
+		b.Fatal(err)
+	}
+	buckets, err := b2.ListBuckets(ctx, "")
+	if err != nil || len(buckets) != 1 {
+		b.Fatalf("got %v buckets, %v", buckets, err)
+	}
+	f := buckets[0].File("4_z27c88f1d182b150646ff0b16_f1004ba650fe24e6b_d20180101_m000000_c000_v0001000_t0001", "photos/2018/01/01/img_000001.jpg")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := f.GetFileInfo(ctx); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright 2024, the Blazer authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package base
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned, wrapped with the name of the API call, by calls
+// that a CircuitBreaker refused to make.
+var ErrCircuitOpen = errors.New("circuit open: recent API calls have failed")
+
+// A CircuitBreaker stops API calls from being made while the API is failing.
+// Once threshold calls in a row, other than uploads, have failed with a 5xx
+// status or a network error, such as a timeout, the circuit is open: for the
+// cooldown that follows, calls fail at once with ErrCircuitOpen.  After the
+// cooldown the circuit is half open, and up to probes calls at a time are made
+// to see whether the API has recovered.  The first to succeed closes the
+// circuit; if one fails, the circuit opens again for another cooldown.  It can
+// be shared by any number of sessions, and is safe for concurrent use.
+type CircuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+	probes    int
+
+	mu       sync.Mutex
+	failures int       // in a row
+	until    time.Time // when the circuit half opens, or zero when it's closed
+	probing  int       // calls in flight while the circuit is half open
+}
+
+// NewCircuitBreaker returns a closed CircuitBreaker.  A threshold or probes of
+// less than one are taken as one.
+func NewCircuitBreaker(threshold int, cooldown time.Duration, probes int) *CircuitBreaker {
+	if threshold < 1 {
+		threshold = 1
+	}
+	if probes < 1 {
+		probes = 1
+	}
+	return &CircuitBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		probes:    probes,
+	}
+}
+
+// Open reports whether cb is refusing calls now.
+func (cb *CircuitBreaker) Open() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return !cb.until.IsZero() && (time.Now().Before(cb.until) || cb.probing >= cb.probes)
+}
+
+// allow reports whether a call can be made now, and if so, whether it is a
+// probe of a half open circuit.
+func (cb *CircuitBreaker) allow() (ok, probe bool) {
+	if cb == nil {
+		return true, false
+	}
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if cb.until.IsZero() {
+		return true, false
+	}
+	if time.Now().Before(cb.until) || cb.probing >= cb.probes {
+		return false, false
+	}
+	cb.probing++
+	return true, true
+}
+
+// record records the outcome of a call that allow let through: whether it
+// failed in a way that counts against the API, and whether it was abandoned by
+// its caller, in which case it says nothing about the API either way.
+func (cb *CircuitBreaker) record(probe, failed, abandoned bool) {
+	if cb == nil {
+		return
+	}
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if probe {
+		cb.probing--
+	}
+	switch {
+	case abandoned:
+	case !failed:
+		cb.failures = 0
+		cb.until = time.Time{}
+	case probe:
+		cb.until = time.Now().Add(cb.cooldown)
+	default:
+		cb.failures++
+		if cb.until.IsZero() && cb.failures >= cb.threshold {
+			cb.until = time.Now().Add(cb.cooldown)
+		}
+	}
+}
+
+// breakerFailure reports whether a call that returned status or err counts as
+// a failure of the API, and whether the caller abandoned it.
+func breakerFailure(ctx context.Context, status int, err error) (failed, abandoned bool) {
+	if err != nil {
+		if ctx.Err() != nil {
+			return false, true
+		}
+		return true, false
+	}
+	return status >= 500 && status < 600, false
+}
+
+// BreakCircuit returns an AuthOption that stops the session's API calls,
+// other than uploads, with cb while they are failing.  Downloads are not
+// stopped.
+func BreakCircuit(cb *CircuitBreaker) AuthOption {
+	return func(o *b2Options) {
+		o.breaker = cb
+	}
+}
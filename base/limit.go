@@ -0,0 +1,149 @@
+// Copyright 2024, the Blazer authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package base
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// How a RequestLimiter adapts to 429 responses: each one halves its rate, to
+// no less than a minRateFraction of the rate it was given, and the rate then
+// climbs back at a rateRecovery of the given rate per second.
+const (
+	minRateFraction = 1.0 / 32
+	rateRecovery    = 1.0 / 30
+)
+
+// A RequestLimiter paces API calls to a rate, as a token bucket.  It can be
+// shared by any number of sessions, and is safe for concurrent use.  Uploads
+// and downloads are not paced.  When B2 replies with 429 Too Many Requests,
+// the limiter lowers its rate for a while, so that the calls that follow are
+// not refused as well.
+type RequestLimiter struct {
+	max   float64 // the rate given to NewRequestLimiter
+	burst float64
+
+	mu     sync.Mutex
+	rate   float64 // calls per second, less than max after a 429
+	tokens float64 // negative when calls are waiting
+	last   time.Time
+}
+
+// NewRequestLimiter returns a RequestLimiter that allows rps calls per
+// second, and up to burst calls at once after it has been idle.  A burst of
+// less than one is taken as one.
+func NewRequestLimiter(rps float64, burst int) *RequestLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &RequestLimiter{
+		max:    rps,
+		burst:  float64(burst),
+		rate:   rps,
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// Rate returns the number of calls per second that l allows now.
+func (l *RequestLimiter) Rate() float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill(time.Now())
+	return l.rate
+}
+
+// refill brings l up to t, adding the tokens and recovering the rate that
+// have accrued since the last call.  It must be called with l.mu held.
+func (l *RequestLimiter) refill(t time.Time) {
+	d := t.Sub(l.last).Seconds()
+	if d <= 0 {
+		return
+	}
+	l.last = t
+	l.tokens += d * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	if l.rate < l.max {
+		l.rate += d * l.max * rateRecovery
+		if l.rate > l.max {
+			l.rate = l.max
+		}
+	}
+}
+
+// wait takes a token from l, and waits for its turn or until ctx is done.
+func (l *RequestLimiter) wait(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	l.refill(time.Now())
+	l.tokens--
+	d := time.Duration(-l.tokens / l.rate * float64(time.Second))
+	l.mu.Unlock()
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		// Give back the turn.
+		l.mu.Lock()
+		l.tokens++
+		l.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// throttled halves l's rate after a 429, and spends any burst it had saved.
+func (l *RequestLimiter) throttled() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill(time.Now())
+	l.rate /= 2
+	if min := l.max * minRateFraction; l.rate < min {
+		l.rate = min
+	}
+	if l.tokens > 0 {
+		l.tokens = 0
+	}
+}
+
+// limited reports whether calls of method are paced by a RequestLimiter.
+func limited(method string) bool {
+	switch method {
+	case "b2_upload_file", "b2_upload_part":
+		return false
+	}
+	return true
+}
+
+// LimitRequests returns an AuthOption that paces the session's API calls,
+// other than uploads, with l.  Downloads are not paced.
+func LimitRequests(l *RequestLimiter) AuthOption {
+	return func(o *b2Options) {
+		o.limiter = l
+	}
+}
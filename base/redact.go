@@ -0,0 +1,135 @@
+// Copyright 2024, the Blazer authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package base
+
+import (
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Everything that base logs, or puts in an error that may be logged, passes
+// through the functions here first, so that no credential reaches a log.
+
+const redacted = "[redacted]"
+
+// secretHeaders are the request headers whose values are never logged.
+var secretHeaders = map[string]bool{
+	"Authorization": true,
+	"X-Bz-Server-Side-Encryption-Customer-Key": true,
+}
+
+// secretParams are the query parameters whose values are never logged.  A
+// download URL can carry its authorization token as a parameter.
+var secretParams = map[string]bool{
+	"Authorization": true,
+}
+
+// uploadMethods are the path elements after which an upload URL holds a
+// token of its own, which authorizes uploads to it.
+var uploadMethods = map[string]bool{
+	"b2_upload_file": true,
+	"b2_upload_part": true,
+}
+
+// secretFields are the JSON fields whose values are never logged.
+var secretFields = regexp.MustCompile(`"(authorizationToken|applicationKey|customerKey)":\s*"[^"]*"`)
+
+// urlFields are the JSON fields whose values are upload URLs.
+var urlFields = regexp.MustCompile(`"(uploadUrl)":\s*"([^"]*)"`)
+
+// redactHeaders formats h for a log, without its secret values or the
+// X-Blazer-Method header, which is logged on its own, and with each header
+// separated by sep.
+func redactHeaders(h http.Header, sep string) string {
+	var headers []string
+	for k, v := range h {
+		if k == "X-Blazer-Method" {
+			continue
+		}
+		val := strings.Join(v, ",")
+		if secretHeaders[k] {
+			val = redacted
+		}
+		headers = append(headers, k+": "+val)
+	}
+	return strings.Join(headers, sep)
+}
+
+// redactURL formats u for a log, without its secret parameters or an upload
+// URL's token.
+func redactURL(u *url.URL) string {
+	if u == nil {
+		return ""
+	}
+	r := *u
+	r.User = nil
+	// Everything after the method is opaque, and whatever of it is the
+	// token, it isn't worth guessing which.
+	parts := strings.Split(r.EscapedPath(), "/")
+	for i, p := range parts {
+		if uploadMethods[p] && i < len(parts)-1 {
+			r.RawPath = strings.Join(append(parts[:i+1], redacted), "/")
+			r.Path, _ = url.PathUnescape(r.RawPath)
+			break
+		}
+	}
+	if r.RawQuery != "" {
+		params := strings.Split(r.RawQuery, "&")
+		for i, p := range params {
+			k := p
+			if j := strings.IndexByte(p, '='); j >= 0 {
+				k = p[:j]
+			}
+			if name, err := url.QueryUnescape(k); err != nil || secretParams[name] {
+				params[i] = k + "=" + redacted
+			}
+		}
+		r.RawQuery = strings.Join(params, "&")
+	}
+	return r.String()
+}
+
+// redactRawURL is redactURL for a URL that hasn't been parsed.  A URL that
+// can't be parsed is redacted entirely.
+func redactRawURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil {
+		return redacted
+	}
+	return redactURL(u)
+}
+
+// redact replaces the secrets in a JSON request or reply, such as
+// authorization tokens, application keys, and the tokens in upload URLs, so
+// that it can be logged.
+func redact(b []byte) string {
+	b = secretFields.ReplaceAll(b, []byte(`"$1": "`+redacted+`"`))
+	b = urlFields.ReplaceAllFunc(b, func(m []byte) []byte {
+		sm := urlFields.FindSubmatch(m)
+		return []byte(`"` + string(sm[1]) + `": "` + redactRawURL(string(sm[2])) + `"`)
+	})
+	return string(b)
+}
+
+// redactError removes the secrets from the URL that err names, if it is a
+// *url.Error, as the errors of an http.Client are.
+func redactError(err error) error {
+	if ue, ok := err.(*url.Error); ok {
+		return &url.Error{Op: ue.Op, URL: redactRawURL(ue.URL), Err: ue.Err}
+	}
+	return err
+}
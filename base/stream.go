@@ -0,0 +1,150 @@
+// Copyright 2024, the Blazer authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package base
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/Backblaze/blazer/internal/b2types"
+)
+
+// A streamReply decodes itself from a reply as the reply is read, rather than
+// from a buffer holding all of it, and may hand on what it has decoded before
+// the end.
+type streamReply interface {
+	decodeFrom(*json.Decoder) error
+
+	// started reports whether anything has been handed on; if it has, the
+	// call can't be made again.
+	started() bool
+}
+
+// started reports whether b2resp is a streamReply that has handed on part of a
+// reply.
+func started(b2resp interface{}) bool {
+	sr, ok := b2resp.(streamReply)
+	return ok && sr.started()
+}
+
+// stream decodes the reply to method into sr as it is read.  Unless replies
+// are logged, only the start of the reply is kept, for a DecodeError.
+func (o *b2Options) stream(method string, resp *http.Response, sr streamReply) error {
+	kept := getReplyBuffer(streamHead)
+	defer putReplyBuffer(kept)
+	if o.v(2).Enabled() {
+		kept.n = -1
+	}
+	r := io.TeeReader(resp.Body, kept)
+	err := sr.decodeFrom(json.NewDecoder(r))
+	if err == nil {
+		// Read what's left, so that the connection can be used again.
+		_, err = io.Copy(ioutil.Discard, r)
+	}
+	o.logResponse(resp, kept.b)
+	if err != nil {
+		return &DecodeError{
+			Method:      method,
+			Status:      resp.StatusCode,
+			ContentType: resp.Header.Get("Content-Type"),
+			Body:        sanitize([]byte(redact(kept.b)), decodeSnippet),
+			Err:         err,
+			req:         newReqInfo(resp),
+		}
+	}
+	return nil
+}
+
+// streamHead is how much of a streamed reply is kept when replies aren't
+// logged.
+const streamHead = 1 << 10
+
+// A listReply decodes a b2_list_file_names or b2_list_file_versions reply,
+// calling fn with each file as soon as it is decoded, so that a page of
+// thousands of files is never held twice.  The file passed to fn is reused.
+type listReply struct {
+	fn func(*b2types.GetFileInfoResponse)
+
+	nextName string
+	nextID   string
+	n        int // files passed to fn
+}
+
+func (r *listReply) started() bool {
+	return r.n > 0
+}
+
+func (r *listReply) decodeFrom(d *json.Decoder) error {
+	r.nextName, r.nextID = "", ""
+	if err := expectDelim(d, '{'); err != nil {
+		return err
+	}
+	for d.More() {
+		t, err := d.Token()
+		if err != nil {
+			return err
+		}
+		switch t {
+		case "nextFileName":
+			err = d.Decode(&r.nextName)
+		case "nextFileId":
+			err = d.Decode(&r.nextID)
+		case "files":
+			err = r.decodeFiles(d)
+		default:
+			var skip json.RawMessage
+			err = d.Decode(&skip)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return expectDelim(d, '}')
+}
+
+func (r *listReply) decodeFiles(d *json.Decoder) error {
+	t, err := d.Token()
+	if err != nil || t == nil {
+		return err
+	}
+	if t != json.Delim('[') {
+		return fmt.Errorf("files: got %v, want an array", t)
+	}
+	var f b2types.GetFileInfoResponse
+	for d.More() {
+		f = b2types.GetFileInfoResponse{}
+		if err := d.Decode(&f); err != nil {
+			return err
+		}
+		r.n++
+		r.fn(&f)
+	}
+	return expectDelim(d, ']')
+}
+
+// expectDelim reads the next token from d, which must be delim.
+func expectDelim(d *json.Decoder, delim json.Delim) error {
+	t, err := d.Token()
+	if err != nil {
+		return err
+	}
+	if t != delim {
+		return fmt.Errorf("got %v, want %v", t, delim)
+	}
+	return nil
+}
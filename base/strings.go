@@ -15,14 +15,88 @@
 package base
 
 import (
-	"net/url"
+	"fmt"
 	"strings"
 )
 
-func escape(s string) string {
-	return strings.Replace(url.QueryEscape(s), "%2F", "/", -1)
+// Escape percent-encodes s according to B2's string encoding rules, for use
+// in URL paths and in the X-Bz-File-Name and X-Bz-Info-* headers.  Letters,
+// digits, '/', and "-._~!$'()*;=:@" are left as they are; every other byte,
+// including each byte of a multi-byte UTF-8 character, is encoded as %XX.
+// Spaces are encoded as %20 rather than '+', which some URL handlers would
+// take literally.
+func Escape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if shouldEscape(c) {
+			fmt.Fprintf(&b, "%%%02X", c)
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
 }
 
-func unescape(s string) (string, error) {
-	return url.QueryUnescape(s)
+func shouldEscape(c byte) bool {
+	switch {
+	case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		return false
+	}
+	return !strings.ContainsRune("/-._~!$'()*;=:@", rune(c))
+}
+
+// Unescape decodes a string encoded by B2 or by Escape.  As B2 specifies, a
+// '+' decodes to a space; a literal '+' is always encoded as %2B.
+func Unescape(s string) (string, error) {
+	if !strings.ContainsAny(s, "%+") {
+		return s, nil
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '+':
+			b.WriteByte(' ')
+		case '%':
+			if i+2 >= len(s) || !isHex(s[i+1]) || !isHex(s[i+2]) {
+				end := i + 3
+				if end > len(s) {
+					end = len(s)
+				}
+				return "", fmt.Errorf("b2: invalid escape %q in %q", s[i:end], s)
+			}
+			b.WriteByte(unhex(s[i+1])<<4 | unhex(s[i+2]))
+			i += 2
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String(), nil
+}
+
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+func unhex(c byte) byte {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0'
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10
+	}
+	return c - 'A' + 10
+}
+
+// canonicalInfo returns info with its keys lowercased, which is how B2 stores
+// them.  It returns nil if info is nil.
+func canonicalInfo(info map[string]string) map[string]string {
+	if info == nil {
+		return nil
+	}
+	c := make(map[string]string, len(info))
+	for k, v := range info {
+		c[strings.ToLower(k)] = v
+	}
+	return c
 }
@@ -0,0 +1,100 @@
+// Copyright 2024, the Blazer authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package base
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// Limits that B2 places on file names and file info.
+const (
+	MaxFileNameBytes = 1024 // The longest file name, in bytes of UTF-8.
+	MaxInfoKeys      = 10   // The most file info keys a file can have.
+	MaxInfoKeyBytes  = 50   // The longest file info key.
+	MaxInfoBytes     = 7000 // The most bytes of X-Bz-Info-* headers, including their names.
+)
+
+// ValidateFileName reports whether B2 will accept name as a file name.
+func ValidateFileName(name string) error {
+	if name == "" {
+		return errors.New("b2: file name is empty")
+	}
+	if len(name) > MaxFileNameBytes {
+		return fmt.Errorf("b2: file name is %d bytes, %d more than the limit of %d", len(name), len(name)-MaxFileNameBytes, MaxFileNameBytes)
+	}
+	if !utf8.ValidString(name) {
+		return fmt.Errorf("b2: file name %q is not valid UTF-8", name)
+	}
+	for i, r := range name {
+		if r < 32 || r == 127 {
+			return fmt.Errorf("b2: file name %q contains control character %U at byte %d", name, r, i)
+		}
+	}
+	return nil
+}
+
+// ValidateFileInfo reports whether B2 will accept info as the file info of a
+// new file.
+func ValidateFileInfo(info map[string]string) error {
+	if len(info) > MaxInfoKeys {
+		return fmt.Errorf("b2: file info has %d keys, %d more than the limit of %d", len(info), len(info)-MaxInfoKeys, MaxInfoKeys)
+	}
+	keys := make([]string, 0, len(info))
+	for k := range info {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var total int
+	lower := make(map[string]string, len(keys))
+	for _, k := range keys {
+		if k == "" {
+			return errors.New("b2: file info key is empty")
+		}
+		if o, ok := lower[strings.ToLower(k)]; ok && info[o] != info[k] {
+			return fmt.Errorf("b2: file info keys %q and %q differ only in case, which B2 does not preserve", o, k)
+		}
+		lower[strings.ToLower(k)] = k
+		if len(k) > MaxInfoKeyBytes {
+			return fmt.Errorf("b2: file info key %q is %d bytes, %d more than the limit of %d", k, len(k), len(k)-MaxInfoKeyBytes, MaxInfoKeyBytes)
+		}
+		for _, r := range k {
+			if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+				return fmt.Errorf("b2: file info key %q contains %q; only letters, digits, '-', and '_' are allowed", k, r)
+			}
+		}
+		if !utf8.ValidString(info[k]) {
+			return fmt.Errorf("b2: file info %q is not valid UTF-8", k)
+		}
+		total += len("X-Bz-Info-") + len(k) + len(info[k])
+	}
+	if total > MaxInfoBytes {
+		return fmt.Errorf("b2: file info headers are %d bytes, %d more than the limit of %d", total, total-MaxInfoBytes, MaxInfoBytes)
+	}
+	return nil
+}
+
+func (o *b2Options) validate(name string, info map[string]string) error {
+	if o.skipValidation {
+		return nil
+	}
+	if err := ValidateFileName(name); err != nil {
+		return err
+	}
+	return ValidateFileInfo(info)
+}
@@ -38,35 +38,99 @@ type AuthorizeAccountResponse struct {
 	PartSize       int       `json:"recommendedPartSize"`
 	AbsMinPartSize int       `json:"absoluteMinimumPartSize"`
 	Allowed        Allowance `json:"allowed"`
+	KeyExpires     int64     `json:"applicationKeyExpirationTimestamp"`
 }
 
 type Allowance struct {
 	Capabilities []string `json:"capabilities"`
 	Bucket       string   `json:"bucketId"`
+	BucketName   string   `json:"bucketName"`
 	Prefix       string   `json:"namePrefix"`
 }
 
+// LifecycleRule day counts are omitted when zero, which B2 treats as "never";
+// zero is not itself a valid count.
 type LifecycleRule struct {
-	DaysHiddenUntilDeleted int    `json:"daysFromHidingToDeleting,omitempty"`
-	DaysNewUntilHidden     int    `json:"daysFromUploadingToHiding,omitempty"`
-	Prefix                 string `json:"fileNamePrefix"`
+	DaysHiddenUntilDeleted   int    `json:"daysFromHidingToDeleting,omitempty"`
+	DaysNewUntilHidden       int    `json:"daysFromUploadingToHiding,omitempty"`
+	DaysStartedUntilCanceled int    `json:"daysFromStartingToCancelingUnfinishedLargeFiles,omitempty"`
+	Prefix                   string `json:"fileNamePrefix"`
+}
+
+type RetentionPeriod struct {
+	Duration int    `json:"duration"`
+	Unit     string `json:"unit"`
+}
+
+// DefaultRetention is sent as-is on update; a nil Mode and Period clear the
+// bucket's default retention.
+type DefaultRetention struct {
+	Mode   *string          `json:"mode"`
+	Period *RetentionPeriod `json:"period"`
+}
+
+type FileLockValue struct {
+	DefaultRetention  DefaultRetention `json:"defaultRetention"`
+	IsFileLockEnabled bool             `json:"isFileLockEnabled"`
+}
+
+// FileLockConfiguration is only populated if IsClientAuthorizedToRead is true;
+// otherwise Value is null.
+type FileLockConfiguration struct {
+	IsClientAuthorizedToRead bool           `json:"isClientAuthorizedToRead"`
+	Value                    *FileLockValue `json:"value"`
+}
+
+type ReplicationRule struct {
+	DestinationBucketID  string `json:"destinationBucketId"`
+	Prefix               string `json:"fileNamePrefix"`
+	IncludeExistingFiles bool   `json:"includeExistingFiles"`
+	Enabled              bool   `json:"isEnabled"`
+	Priority             int    `json:"priority"`
+	Name                 string `json:"replicationRuleName"`
+}
+
+type ReplicationSource struct {
+	Rules       []ReplicationRule `json:"replicationRules"`
+	SourceKeyID string            `json:"sourceApplicationKeyId"`
+}
+
+type ReplicationDestination struct {
+	KeyMapping map[string]string `json:"sourceToDestinationKeyMapping"`
+}
+
+// ReplicationConfiguration is sent as-is on update; an empty configuration
+// removes replication from the bucket.
+type ReplicationConfiguration struct {
+	Source      *ReplicationSource      `json:"asReplicationSource,omitempty"`
+	Destination *ReplicationDestination `json:"asReplicationDestination,omitempty"`
+}
+
+// ReplicationConfigurationResponse is only populated if
+// IsClientAuthorizedToRead is true; otherwise Value is null.
+type ReplicationConfigurationResponse struct {
+	IsClientAuthorizedToRead bool                      `json:"isClientAuthorizedToRead"`
+	Value                    *ReplicationConfiguration `json:"value"`
 }
 
 type CreateBucketRequest struct {
-	AccountID      string            `json:"accountId"`
-	Name           string            `json:"bucketName"`
-	Type           string            `json:"bucketType"`
-	Info           map[string]string `json:"bucketInfo"`
-	LifecycleRules []LifecycleRule   `json:"lifecycleRules"`
+	AccountID       string            `json:"accountId"`
+	Name            string            `json:"bucketName"`
+	Type            string            `json:"bucketType"`
+	Info            map[string]string `json:"bucketInfo"`
+	LifecycleRules  []LifecycleRule   `json:"lifecycleRules"`
+	FileLockEnabled bool              `json:"fileLockEnabled,omitempty"`
 }
 
 type CreateBucketResponse struct {
-	BucketID       string            `json:"bucketId"`
-	Name           string            `json:"bucketName"`
-	Type           string            `json:"bucketType"`
-	Info           map[string]string `json:"bucketInfo"`
-	LifecycleRules []LifecycleRule   `json:"lifecycleRules"`
-	Revision       int               `json:"revision"`
+	BucketID              string                           `json:"bucketId"`
+	Name                  string                           `json:"bucketName"`
+	Type                  string                           `json:"bucketType"`
+	Info                  map[string]string                `json:"bucketInfo"`
+	LifecycleRules        []LifecycleRule                  `json:"lifecycleRules"`
+	FileLockConfiguration FileLockConfiguration            `json:"fileLockConfiguration"`
+	Replication           ReplicationConfigurationResponse `json:"replicationConfiguration"`
+	Revision              int                              `json:"revision"`
 }
 
 type DeleteBucketRequest struct {
@@ -85,12 +149,15 @@ type ListBucketsResponse struct {
 }
 
 type UpdateBucketRequest struct {
-	AccountID      string            `json:"accountId"`
-	BucketID       string            `json:"bucketId"`
-	Type           string            `json:"bucketType,omitempty"`
-	Info           map[string]string `json:"bucketInfo,omitempty"`
-	LifecycleRules []LifecycleRule   `json:"lifecycleRules,omitempty"`
-	IfRevisionIs   int               `json:"ifRevisionIs,omitempty"`
+	AccountID        string                    `json:"accountId"`
+	BucketID         string                    `json:"bucketId"`
+	Type             string                    `json:"bucketType,omitempty"`
+	Info             map[string]string         `json:"bucketInfo,omitempty"`
+	LifecycleRules   []LifecycleRule           `json:"lifecycleRules,omitempty"`
+	FileLockEnabled  bool                      `json:"fileLockEnabled,omitempty"`
+	DefaultRetention *DefaultRetention         `json:"defaultRetention,omitempty"`
+	Replication      *ReplicationConfiguration `json:"replicationConfiguration,omitempty"`
+	IfRevisionIs     int                       `json:"ifRevisionIs,omitempty"`
 }
 
 type UpdateBucketResponse CreateBucketResponse
@@ -157,10 +224,14 @@ type FinishLargeFileRequest struct {
 }
 
 type FinishLargeFileResponse struct {
-	Name      string `json:"fileName"`
-	FileID    string `json:"fileId"`
-	Timestamp int64  `json:"uploadTimestamp"`
-	Action    string `json:"action"`
+	Name        string            `json:"fileName"`
+	FileID      string            `json:"fileId"`
+	Timestamp   int64             `json:"uploadTimestamp"`
+	Action      string            `json:"action"`
+	Size        int64             `json:"contentLength,omitempty"`
+	SHA1        string            `json:"contentSha1,omitempty"`
+	ContentType string            `json:"contentType,omitempty"`
+	Info        map[string]string `json:"fileInfo,omitempty"`
 }
 
 type ListFileNamesRequest struct {
@@ -220,11 +291,40 @@ type GetFileInfoResponse struct {
 	Timestamp   int64             `json:"uploadTimestamp,omitempty"`
 }
 
+type CopyFileRequest struct {
+	SourceID          string            `json:"sourceFileId"`
+	DestBucketID      string            `json:"destinationBucketId,omitempty"`
+	Name              string            `json:"fileName"`
+	Range             string            `json:"range,omitempty"`
+	MetadataDirective string            `json:"metadataDirective,omitempty"`
+	ContentType       string            `json:"contentType,omitempty"`
+	Info              map[string]string `json:"fileInfo,omitempty"`
+}
+
+type CopyPartRequest struct {
+	SourceID    string `json:"sourceFileId"`
+	LargeFileID string `json:"largeFileId"`
+	PartNumber  int    `json:"partNumber"`
+	Range       string `json:"range,omitempty"`
+}
+
+type CopyPartResponse struct {
+	FileID     string `json:"fileId"`
+	PartNumber int    `json:"partNumber"`
+	Size       int64  `json:"contentLength"`
+	SHA1       string `json:"contentSha1"`
+}
+
 type GetDownloadAuthorizationRequest struct {
 	BucketID           string `json:"bucketId"`
 	Prefix             string `json:"fileNamePrefix"`
 	Valid              int    `json:"validDurationInSeconds"`
 	ContentDisposition string `json:"b2ContentDisposition,omitempty"`
+	ContentLanguage    string `json:"b2ContentLanguage,omitempty"`
+	Expires            string `json:"b2Expires,omitempty"`
+	CacheControl       string `json:"b2CacheControl,omitempty"`
+	ContentEncoding    string `json:"b2ContentEncoding,omitempty"`
+	ContentType        string `json:"b2ContentType,omitempty"`
 }
 
 type GetDownloadAuthorizationResponse struct {
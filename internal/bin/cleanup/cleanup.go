@@ -5,21 +5,25 @@ import (
 	"fmt"
 	"os"
 	"strings"
-	"sync"
 
 	"github.com/Backblaze/blazer/b2"
+	"github.com/Backblaze/blazer/internal/pool"
 )
 
 const (
 	apiID  = "B2_ACCOUNT_ID"
 	apiKey = "B2_SECRET_KEY"
+
+	// How many buckets are emptied at once, and how many objects in each.
+	bucketWorkers = 4
+	objectWorkers = 25
 )
 
 func main() {
 	id := os.Getenv(apiID)
 	key := os.Getenv(apiKey)
 	ctx := context.Background()
-	client, err := b2.NewClient(ctx, id, key)
+	client, err := b2.NewClient(ctx, id, key, b2.BatchConcurrency(objectWorkers))
 	if err != nil {
 		fmt.Println(err)
 		return
@@ -38,18 +42,19 @@ func main() {
 			kill = append(kill, bucket.Name())
 		}
 	}
-	var wg sync.WaitGroup
+	p := pool.New(ctx, bucketWorkers)
 	for _, name := range kill {
-		wg.Add(1)
-		go func(name string) {
-			defer wg.Done()
+		name := name
+		if err := p.Go(func(ctx context.Context) error {
 			fmt.Println("removing", name)
-			if err := killBucket(ctx, client, name); err != nil {
-				fmt.Println(err)
-			}
-		}(name)
+			return killBucket(ctx, client, name)
+		}); err != nil {
+			break
+		}
+	}
+	for _, err := range p.Wait() {
+		fmt.Println(err)
 	}
-	wg.Wait()
 }
 
 func killBucket(ctx context.Context, client *b2.Client, name string) error {
@@ -61,11 +66,8 @@ func killBucket(ctx context.Context, client *b2.Client, name string) error {
 		return err
 	}
 	defer bucket.Delete(ctx)
-	iter := bucket.List(ctx, b2.ListHidden())
-	for iter.Next() {
-		if err := iter.Object().Delete(ctx); err != nil {
-			fmt.Println(err)
-		}
+	if _, err := bucket.DeleteObjects(ctx, ""); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
 	}
-	return iter.Err()
+	return nil
 }
@@ -19,6 +19,7 @@
 package blog
 
 import (
+	"fmt"
 	"log"
 	"os"
 	"strconv"
@@ -26,7 +27,39 @@ import (
 
 var level int32
 
-type Verbose bool
+// A Logger receives the messages of a session that has one, in place of the
+// standard logger.  Level 1 messages report retries and errors that were
+// recovered from; level 2 messages report each request and response.
+type Logger interface {
+	// Enabled reports whether messages at level are wanted.
+	Enabled(level int) bool
+
+	// Log logs a message at level.
+	Log(level int, msg string)
+}
+
+// An Attr is a key and value that describe a message, such as the API call
+// that a request makes.
+type Attr struct {
+	Key   string
+	Value interface{}
+}
+
+// An AttrLogger is a Logger that takes the attributes of the messages that
+// have them, instead of text in which they are formatted.
+type AttrLogger interface {
+	Logger
+
+	// LogAttrs logs a message, with its attributes, at level.
+	LogAttrs(level int, msg string, attrs []Attr)
+}
+
+// A Verbose logs messages at one level, if that level is enabled.
+type Verbose struct {
+	on    bool
+	level int
+	l     Logger
+}
 
 func init() {
 	lvl := os.Getenv("B2_LOG_LEVEL")
@@ -37,18 +70,56 @@ func init() {
 	level = int32(i)
 }
 
+// Enabled reports whether v logs anything.
+func (v Verbose) Enabled() bool {
+	return v.on
+}
+
 func (v Verbose) Info(a ...interface{}) {
-	if v {
-		log.Print(a...)
+	if !v.on {
+		return
+	}
+	if v.l != nil {
+		v.l.Log(v.level, fmt.Sprint(a...))
+		return
 	}
+	log.Print(a...)
 }
 
 func (v Verbose) Infof(format string, a ...interface{}) {
-	if v {
-		log.Printf(format, a...)
+	if !v.on {
+		return
+	}
+	if v.l != nil {
+		v.l.Log(v.level, fmt.Sprintf(format, a...))
+		return
 	}
+	log.Printf(format, a...)
 }
 
+// Event logs msg and attrs to an AttrLogger, or text, which should say the same
+// as they do, to any other Logger or the standard logger.
+func (v Verbose) Event(msg string, attrs []Attr, text string) {
+	if !v.on {
+		return
+	}
+	if al, ok := v.l.(AttrLogger); ok {
+		al.LogAttrs(v.level, msg, attrs)
+		return
+	}
+	v.Info(text)
+}
+
+// V returns the Verbose for target, which logs to the standard logger if
+// target is no more than B2_LOG_LEVEL.
 func V(target int32) Verbose {
-	return Verbose(target <= level)
+	return Verbose{on: target <= level, level: int(target)}
+}
+
+// To returns the Verbose for target that logs to l, or, if l is nil, V(target).
+func To(l Logger, target int32) Verbose {
+	if l == nil {
+		return V(target)
+	}
+	return Verbose{on: l.Enabled(int(target)), level: int(target), l: l}
 }
@@ -0,0 +1,57 @@
+// Copyright 2024, the Blazer authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build go1.21
+
+package blog
+
+import (
+	"context"
+	"log/slog"
+)
+
+type slogLogger struct {
+	l *slog.Logger
+}
+
+// Slog returns an AttrLogger that logs to l.
+func Slog(l *slog.Logger) AttrLogger {
+	return slogLogger{l: l}
+}
+
+// slogLevel returns the slog.Level for level: slog.LevelInfo for level 1,
+// and slog.LevelDebug for level 2, with each level after that below the one
+// before.
+func slogLevel(level int) slog.Level {
+	if level <= 1 {
+		return slog.LevelInfo
+	}
+	return slog.LevelDebug - slog.Level(level-2)
+}
+
+func (s slogLogger) Enabled(level int) bool {
+	return s.l.Enabled(context.Background(), slogLevel(level))
+}
+
+func (s slogLogger) Log(level int, msg string) {
+	s.l.Log(context.Background(), slogLevel(level), msg)
+}
+
+func (s slogLogger) LogAttrs(level int, msg string, attrs []Attr) {
+	sattrs := make([]slog.Attr, len(attrs))
+	for i, a := range attrs {
+		sattrs[i] = slog.Any(a.Key, a.Value)
+	}
+	s.l.LogAttrs(context.Background(), slogLevel(level), msg, sattrs...)
+}
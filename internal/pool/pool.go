@@ -0,0 +1,80 @@
+// Copyright 2024, the Blazer authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package pool runs tasks on a bounded number of goroutines, for operations,
+// such as deleting every object in a bucket, that are made of many
+// independent calls.
+package pool
+
+import (
+	"context"
+	"sync"
+)
+
+// A Pool runs tasks on up to a fixed number of goroutines at once.  Its tasks
+// share a context; once it is done, no more are started.
+type Pool struct {
+	ctx  context.Context
+	sem  chan struct{}
+	wg   sync.WaitGroup
+	mu   sync.Mutex
+	errs []error
+}
+
+// New returns a Pool that runs up to n tasks at once with ctx.  An n of less
+// than one is taken as one.
+func New(ctx context.Context, n int) *Pool {
+	if n < 1 {
+		n = 1
+	}
+	return &Pool{
+		ctx: ctx,
+		sem: make(chan struct{}, n),
+	}
+}
+
+// Go waits until fewer than n tasks are running, and then runs f on a
+// goroutine of its own.  If the pool's context is done first, f is not run,
+// and Go returns the context's error.
+func (p *Pool) Go(f func(context.Context) error) error {
+	if err := p.ctx.Err(); err != nil {
+		return err
+	}
+	select {
+	case p.sem <- struct{}{}:
+	case <-p.ctx.Done():
+		return p.ctx.Err()
+	}
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		defer func() { <-p.sem }()
+		if err := f(p.ctx); err != nil {
+			p.mu.Lock()
+			p.errs = append(p.errs, err)
+			p.mu.Unlock()
+		}
+	}()
+	return nil
+}
+
+// Wait waits for every task that Go started to return, including those that
+// are still running when the context is canceled, and returns the errors they
+// returned, in the order they returned them.
+func (p *Pool) Wait() []error {
+	p.wg.Wait()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.errs
+}
@@ -0,0 +1,96 @@
+// Copyright 2024, the Blazer authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPool(t *testing.T) {
+	ctx := context.Background()
+	p := New(ctx, 3)
+	var running, most int32
+	for i := 0; i < 20; i++ {
+		i := i
+		err := p.Go(func(context.Context) error {
+			n := atomic.AddInt32(&running, 1)
+			defer atomic.AddInt32(&running, -1)
+			for {
+				m := atomic.LoadInt32(&most)
+				if n <= m || atomic.CompareAndSwapInt32(&most, m, n) {
+					break
+				}
+			}
+			time.Sleep(time.Millisecond)
+			if i%5 == 0 {
+				return fmt.Errorf("task %d", i)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	errs := p.Wait()
+	if most > 3 {
+		t.Errorf("%d tasks ran at once, want at most 3", most)
+	}
+	var got []string
+	for _, err := range errs {
+		got = append(got, err.Error())
+	}
+	sort.Strings(got)
+	if want := []string{"task 0", "task 10", "task 15", "task 5"}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got errors %v, want %v", got, want)
+	}
+}
+
+func TestPoolCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	p := New(ctx, 2)
+	var done int32
+	for i := 0; i < 2; i++ {
+		if err := p.Go(func(ctx context.Context) error {
+			<-ctx.Done()
+			time.Sleep(10 * time.Millisecond)
+			atomic.AddInt32(&done, 1)
+			return ctx.Err()
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The pool is full, so this waits until the context is canceled, and
+	// then fails without running its task.
+	time.AfterFunc(10*time.Millisecond, cancel)
+	if err := p.Go(func(context.Context) error {
+		t.Error("task ran after the context was canceled")
+		return nil
+	}); err != context.Canceled {
+		t.Errorf("Go: got %v, want %v", err, context.Canceled)
+	}
+	errs := p.Wait()
+	if done != 2 {
+		t.Errorf("Wait returned with %d of 2 running tasks done", done)
+	}
+	if len(errs) != 2 || !errors.Is(errs[0], context.Canceled) {
+		t.Errorf("Wait: got %v, want two %v", errs, context.Canceled)
+	}
+}
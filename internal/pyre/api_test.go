@@ -15,6 +15,7 @@
 package pyre
 
 import (
+	"net/http"
 	"reflect"
 	"sort"
 	"strings"
@@ -135,3 +136,26 @@ func TestGetDirNames(t *testing.T) {
 		}
 	}
 }
+
+func TestParseUploadHeaders(t *testing.T) {
+	r, err := http.NewRequest("POST", "https://example.com"+uploadFilePrefix+"bucket", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("X-Bz-File-Name", "name")
+	r.Header.Set("Content-Length", "10")
+	r.Header.Set("X-Bz-Info-SrcHash", "ABC")
+	r.Header.Set("X-Bz-Info-src_mode", "0644")
+	r.Header.Set("X-Bz-Info-src-mode", "a+b%2Bc%2520d")
+	ur, err := parseUploadHeaders(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"srchash": "ABC", "src_mode": "0644", "src-mode": "a b+c%20d"}
+	if !reflect.DeepEqual(ur.info, want) {
+		t.Errorf("parseUploadHeaders: got info %v, want %v", ur.info, want)
+	}
+	if ur.bucket != "bucket" {
+		t.Errorf("parseUploadHeaders: got bucket %q, want %q", ur.bucket, "bucket")
+	}
+}
@@ -19,6 +19,7 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 
@@ -56,11 +57,16 @@ func parseUploadHeaders(r *http.Request) (*uploadRequest, error) {
 	}
 	ur.size = size
 	for k := range r.Header {
-		if !strings.HasPrefix("X-Bz-Info-", k) {
+		if !strings.HasPrefix(k, "X-Bz-Info-") {
 			continue
 		}
-		name := strings.TrimPrefix("X-Bz-Info-", k)
-		ur.info[name] = r.Header.Get(k)
+		// Like B2, store keys in lowercase and values decoded.
+		name := strings.ToLower(strings.TrimPrefix(k, "X-Bz-Info-"))
+		val, err := url.QueryUnescape(r.Header.Get(k))
+		if err != nil {
+			return nil, err
+		}
+		ur.info[name] = val
 	}
 	ur.bucket = strings.TrimPrefix(r.URL.Path, uploadFilePrefix)
 	return ur, nil
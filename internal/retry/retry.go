@@ -0,0 +1,223 @@
+// Copyright 2024, the Blazer authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package retry implements the retry loop that blazer uses for API calls,
+// uploads, and downloads, with exponential backoff.
+package retry
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+// An OnRetryFunc is told of each retry: the number of attempts so far, the
+// error that the last of them met, and the delay before the next.
+type OnRetryFunc func(attempt int, err error, delay time.Duration)
+
+// An Option configures a Retrier.
+type Option func(*Retrier)
+
+// Attempts limits the number of attempts to n, including the first.  Zero,
+// the default, means no limit.
+func Attempts(n int) Option {
+	return func(r *Retrier) {
+		r.attempts = n
+	}
+}
+
+// Delay sets the delay before the first retry, which doubles with each retry
+// after it, up to max.  Without it, there is no delay.
+func Delay(initial, max time.Duration) Option {
+	return func(r *Retrier) {
+		r.initial, r.max = initial, max
+	}
+}
+
+// Jitter adds between one and three percent to each delay, so that callers
+// who fail together don't retry together.
+func Jitter() Option {
+	return func(r *Retrier) {
+		r.jitter = true
+	}
+}
+
+// DynamicDelay sets a function that gives the delay that an error asks for,
+// such as the Retry-After of a 503 response.  If it returns a positive delay,
+// that delay is used instead of the computed one.
+func DynamicDelay(f func(error) time.Duration) Option {
+	return func(r *Retrier) {
+		r.dynamic = f
+	}
+}
+
+// MaxDynamicDelay caps the delay that DynamicDelay asks for at max.  Zero, the
+// default, means no cap.
+func MaxDynamicDelay(max time.Duration) Option {
+	return func(r *Retrier) {
+		r.maxDynamic = max
+	}
+}
+
+// RetryIf sets the function that decides whether an error is worth another
+// attempt.  Do retries any error without it.
+func RetryIf(f func(error) bool) Option {
+	return func(r *Retrier) {
+		r.retryIf = f
+	}
+}
+
+// OnRetry sets a function to be called before each retry.
+func OnRetry(f OnRetryFunc) Option {
+	return func(r *Retrier) {
+		r.onRetry = f
+	}
+}
+
+// A Budget limits the retries of many Retriers together.
+type Budget interface {
+	// Spend takes one retry, after an attempt failed with err, from the
+	// budget.  If none is left, it returns the error with which to fail.
+	Spend(err error) error
+}
+
+// WithBudget makes each retry spend from b.  An operation whose retry b
+// refuses fails at once, with the error b gives.
+func WithBudget(b Budget) Option {
+	return func(r *Retrier) {
+		r.budget = b
+	}
+}
+
+// WithAfter replaces time.After in the waits between attempts.
+func WithAfter(f func(time.Duration) <-chan time.Time) Option {
+	return func(r *Retrier) {
+		r.after = f
+	}
+}
+
+// A Retrier paces the attempts at one operation.  Do uses one for a single
+// function; callers whose attempts don't fit in one can use the Retrier
+// directly.
+type Retrier struct {
+	attempts   int // the most allowed, or zero for no limit
+	initial    time.Duration
+	max        time.Duration
+	jitter     bool
+	dynamic    func(error) time.Duration
+	maxDynamic time.Duration
+	retryIf    func(error) bool
+	onRetry    OnRetryFunc
+	budget     Budget
+	after      func(time.Duration) <-chan time.Time
+
+	tries int           // the attempts that have failed
+	delay time.Duration // the last computed delay, before any jitter
+}
+
+// New returns a Retrier with the given options.
+func New(opts ...Option) *Retrier {
+	r := &Retrier{after: time.After}
+	for _, o := range opts {
+		o(r)
+	}
+	if r.initial > r.max {
+		r.initial = r.max
+	}
+	return r
+}
+
+// Retry records that an attempt failed with err, and reports whether another
+// is allowed.
+func (r *Retrier) Retry(err error) bool {
+	r.tries++
+	if r.retryIf != nil && !r.retryIf(err) {
+		return false
+	}
+	return r.attempts <= 0 || r.tries < r.attempts
+}
+
+// Progress starts the count of attempts, and the delays, again, after an
+// attempt made some headway.
+func (r *Retrier) Progress() {
+	r.tries, r.delay = 0, 0
+}
+
+// Wait waits to make another attempt after one failed with err, or until ctx
+// is done.  It fails at once if the Retrier's Budget is spent.
+func (r *Retrier) Wait(ctx context.Context, err error) error {
+	if r.budget != nil {
+		if err := r.budget.Spend(err); err != nil {
+			return err
+		}
+	}
+	d := r.next(err)
+	if r.onRetry != nil {
+		r.onRetry(r.tries, err, d)
+	}
+	if d <= 0 {
+		return ctx.Err()
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-r.after(d):
+		return nil
+	}
+}
+
+// next returns the delay before the next attempt.
+func (r *Retrier) next(err error) time.Duration {
+	if r.delay == 0 {
+		r.delay = r.initial
+	} else if r.delay *= 2; r.delay > r.max {
+		r.delay = r.max
+	}
+	d := r.delay
+	if r.jitter {
+		d += jitter(d)
+	}
+	if r.dynamic != nil {
+		if dd := r.dynamic(err); dd > 0 {
+			d = dd
+			if r.maxDynamic > 0 && d > r.maxDynamic {
+				d = r.maxDynamic
+			}
+		}
+	}
+	return d
+}
+
+func jitter(d time.Duration) time.Duration {
+	f := float64(d)
+	f /= 50
+	f += f * (rand.Float64() - 0.5)
+	return time.Duration(f)
+}
+
+// Do calls f until it succeeds, until an error is not to be retried or the
+// attempts run out, in which case it returns the last error, or until ctx is
+// done, in which case it returns ctx's error.
+func Do(ctx context.Context, f func() error, opts ...Option) error {
+	r := New(opts...)
+	for {
+		err := f()
+		if err == nil || !r.Retry(err) {
+			return err
+		}
+		if err := r.Wait(ctx, err); err != nil {
+			return err
+		}
+	}
+}
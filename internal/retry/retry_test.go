@@ -0,0 +1,211 @@
+// Copyright 2024, the Blazer authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package retry
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var (
+	errAgain = errors.New("again")
+	errStop  = errors.New("stop")
+)
+
+// instant is an after that records delays and doesn't wait for them.
+type instant struct {
+	delays []time.Duration
+}
+
+func (i *instant) after(d time.Duration) <-chan time.Time {
+	i.delays = append(i.delays, d)
+	ch := make(chan time.Time, 1)
+	ch <- time.Time{}
+	return ch
+}
+
+func TestDo(t *testing.T) {
+	asked := func(err error) time.Duration {
+		if err == errStop {
+			return time.Hour
+		}
+		return 0
+	}
+	table := []struct {
+		name   string
+		errs   []error // returned by each call; the rest succeed
+		opts   []Option
+		want   error
+		calls  int
+		delays []time.Duration
+	}{
+		{
+			name:  "success",
+			calls: 1,
+		},
+		{
+			name:   "retried",
+			errs:   []error{errAgain, errAgain, errAgain},
+			opts:   []Option{Delay(time.Second, 3*time.Second)},
+			calls:  4,
+			delays: []time.Duration{time.Second, 2 * time.Second, 3 * time.Second},
+		},
+		{
+			name:  "no delay",
+			errs:  []error{errAgain, errAgain},
+			calls: 3,
+		},
+		{
+			name:   "out of attempts",
+			errs:   []error{errAgain, errAgain, errAgain},
+			opts:   []Option{Attempts(2), Delay(time.Second, time.Minute)},
+			want:   errAgain,
+			calls:  2,
+			delays: []time.Duration{time.Second},
+		},
+		{
+			name:  "not retried",
+			errs:  []error{errAgain, errStop},
+			opts:  []Option{RetryIf(func(err error) bool { return err == errAgain })},
+			want:  errStop,
+			calls: 2,
+		},
+		{
+			name:   "asked to wait",
+			errs:   []error{errStop, errAgain},
+			opts:   []Option{Delay(time.Second, time.Minute), DynamicDelay(asked)},
+			calls:  3,
+			delays: []time.Duration{time.Hour, 2 * time.Second},
+		},
+		{
+			name:   "asked to wait too long",
+			errs:   []error{errStop},
+			opts:   []Option{Delay(time.Second, time.Minute), DynamicDelay(asked), MaxDynamicDelay(5 * time.Minute)},
+			calls:  2,
+			delays: []time.Duration{5 * time.Minute},
+		},
+	}
+	for _, e := range table {
+		var calls int
+		f := func() error {
+			calls++
+			if calls <= len(e.errs) {
+				return e.errs[calls-1]
+			}
+			return nil
+		}
+		in := &instant{}
+		var retried []time.Duration
+		onRetry := func(attempt int, err error, d time.Duration) {
+			if attempt != len(retried)+1 || err != e.errs[attempt-1] {
+				t.Errorf("%s: OnRetry(%d, %v), want attempt %d", e.name, attempt, err, len(retried)+1)
+			}
+			retried = append(retried, d)
+		}
+		opts := append([]Option{WithAfter(in.after), OnRetry(onRetry)}, e.opts...)
+		if err := Do(context.Background(), f, opts...); err != e.want {
+			t.Errorf("%s: got %v, want %v", e.name, err, e.want)
+		}
+		if calls != e.calls {
+			t.Errorf("%s: %d calls, want %d", e.name, calls, e.calls)
+		}
+		if !reflect.DeepEqual(in.delays, e.delays) {
+			t.Errorf("%s: waited %v, want %v", e.name, in.delays, e.delays)
+		}
+		if len(retried) != calls-1 && e.want == nil {
+			t.Errorf("%s: OnRetry called %d times, want %d", e.name, len(retried), calls-1)
+		}
+	}
+}
+
+func TestDoCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var calls int
+	f := func() error {
+		calls++
+		cancel()
+		return errAgain
+	}
+	if err := Do(ctx, f, Delay(time.Hour, time.Hour)); err != context.Canceled {
+		t.Errorf("got %v, want %v", err, context.Canceled)
+	}
+	if calls != 1 {
+		t.Errorf("%d calls, want 1", calls)
+	}
+
+	// Without a delay, too.
+	calls = 0
+	if err := Do(ctx, f); err != context.Canceled || calls != 1 {
+		t.Errorf("without a delay: got %v after %d calls, want %v after 1", err, calls, context.Canceled)
+	}
+}
+
+func TestRetrier(t *testing.T) {
+	in := &instant{}
+	r := New(Attempts(3), Delay(time.Second, time.Minute), Jitter(), WithAfter(in.after))
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		if !r.Retry(errAgain) {
+			t.Fatalf("attempt %d: no retry", i+1)
+		}
+		if err := r.Wait(ctx, errAgain); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if r.Retry(errAgain) {
+		t.Error("retry after the last attempt")
+	}
+	r.Progress()
+	if !r.Retry(errAgain) {
+		t.Error("no retry after progress")
+	}
+	if err := r.Wait(ctx, errAgain); err != nil {
+		t.Fatal(err)
+	}
+	want := []time.Duration{time.Second, 2 * time.Second, time.Second}
+	for i, d := range in.delays {
+		if d < want[i]*101/100 || d > want[i]*103/100 {
+			t.Errorf("delay %d: got %v, want %v and a little", i, d, want[i])
+		}
+	}
+}
+
+type testBudget int
+
+func (b *testBudget) Spend(err error) error {
+	if *b == 0 {
+		return errStop
+	}
+	*b--
+	return nil
+}
+
+func TestBudget(t *testing.T) {
+	b := testBudget(2)
+	var calls int
+	f := func() error {
+		calls++
+		return errAgain
+	}
+	if err := Do(context.Background(), f, WithBudget(&b)); err != errStop {
+		t.Errorf("got %v, want %v", err, errStop)
+	}
+	if calls != 3 {
+		t.Errorf("%d calls, want 3", calls)
+	}
+}